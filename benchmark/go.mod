@@ -1,3 +1,5 @@
 module benchmark
 
 go 1.25.4
+
+require golang.org/x/net v0.38.0
@@ -0,0 +1,157 @@
+package benchmark
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// ============================================================================
+// HPACK TABLE SIZE EXPERIMENTS (GRPC_HEADER_TABLE_SIZE on the services)
+// ============================================================================
+
+// headerTableSizes are the SETTINGS_HEADER_TABLE_SIZE values compared: grpc-go
+// servers accept up to the 4096 default, larger tables are what a sidecar
+// such as Envoy could negotiate between proxies
+var headerTableSizes = []uint32{0, 1024, hpackDefaultTableSize, 16 << 10, 64 << 10}
+
+const (
+	requestsPerConn  = 100
+	requestsPerToken = 10
+)
+
+// dynamicClaims change on every renewal, as in the frontend's claim classifier
+var dynamicClaims = map[string]bool{
+	"exp": true, "iat": true, "nbf": true, "jti": true, "auth_time": true,
+	"nonce": true, "at_hash": true, "c_hash": true, "random_value": true,
+}
+
+// renewedToken is the split of the renewal'th token a user holds: the same
+// static claims with new dynamic claims and signature
+type renewedToken struct {
+	Header, Payload, Static, Dynamic, Signature string
+}
+
+func renewToken(b *testing.B, g goldenJWT, renewal int) renewedToken {
+	b.Helper()
+	parts := strings.Split(g.Token, ".")
+	if len(parts) != 3 {
+		b.Fatalf("%s: not a JWT", g.Name)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(g.Payload), &claims); err != nil {
+		b.Fatalf("%s: payload: %v", g.Name, err)
+	}
+	static, dynamic := map[string]interface{}{}, map[string]interface{}{}
+	for k, v := range claims {
+		if dynamicClaims[k] {
+			dynamic[k] = v
+		} else {
+			static[k] = v
+		}
+	}
+	dynamic["iat"] = 1700000000 + renewal*900
+	dynamic["exp"] = 1700000900 + renewal*900
+	dynamic["jti"] = fmt.Sprintf("%s-%d", g.Name, renewal)
+	claims["iat"], claims["exp"], claims["jti"] = dynamic["iat"], dynamic["exp"], dynamic["jti"]
+
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	sig := parts[2]
+	if len(sig) > 4 {
+		sig = sig[:len(sig)-4] + fmt.Sprintf("%04d", renewal%10000)
+	}
+	return renewedToken{
+		Header:    parts[0],
+		Payload:   encode(claims),
+		Static:    encode(static),
+		Dynamic:   encode(dynamic),
+		Signature: sig,
+	}
+}
+
+// tokenFields returns the JWT header fields of a request in one format;
+// signatures and dynamic claims are never indexed, as the services send them
+func tokenFields(format string, t renewedToken) []hpack.HeaderField {
+	switch format {
+	case "full":
+		return []hpack.HeaderField{
+			{Name: "authorization", Value: "Bearer " + t.Header + "." + t.Payload + "." + t.Signature},
+		}
+	case "split":
+		return []hpack.HeaderField{
+			{Name: "x-jwt-header", Value: t.Header},
+			{Name: "x-jwt-payload", Value: t.Payload},
+			{Name: "x-jwt-sig", Value: t.Signature, Sensitive: true},
+		}
+	default: // "static"
+		return []hpack.HeaderField{
+			{Name: "x-jwt-header", Value: t.Header},
+			{Name: "x-jwt-static", Value: t.Static},
+			{Name: "x-jwt-dynamic", Value: t.Dynamic, Sensitive: true},
+			{Name: "x-jwt-sig", Value: t.Signature, Sensitive: true},
+		}
+	}
+}
+
+// encodeConnection encodes requestsPerConn requests on one connection whose
+// peer advertised tableSize, renewing the token every requestsPerToken
+// requests, and returns the average header block size after the first request
+func encodeConnection(tokens []renewedToken, format string, tableSize uint32) float64 {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.SetMaxDynamicTableSizeLimit(tableSize)
+	enc.SetMaxDynamicTableSize(tableSize)
+	total := 0
+	for i := 0; i < requestsPerConn; i++ {
+		buf.Reset()
+		for _, f := range tokenFields(format, tokens[i/requestsPerToken]) {
+			_ = enc.WriteField(f)
+		}
+		if i > 0 {
+			total += buf.Len()
+		}
+	}
+	return float64(total) / float64(requestsPerConn-1)
+}
+
+// BenchmarkHeaderTableSize reports the JWT header bytes per request on a
+// warm connection for each golden token, format and table size. The static
+// block only pays off once it fits the table: from the size where
+// static-indexable turns 1, static-bytes drops to the dynamic claims and
+// signature. For the 150-group Azure AD token that takes 16KB, beyond what a
+// grpc-go server decodes, so its savings need a proxy with a larger table.
+func BenchmarkHeaderTableSize(b *testing.B) {
+	for _, g := range loadGoldenJWTs(b) {
+		tokens := make([]renewedToken, requestsPerConn/requestsPerToken)
+		for i := range tokens {
+			tokens[i] = renewToken(b, g, i)
+		}
+		for _, size := range headerTableSizes {
+			b.Run(fmt.Sprintf("%s/table=%d", g.Name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				var full, split, static float64
+				for i := 0; i < b.N; i++ {
+					full = encodeConnection(tokens, "full", size)
+					split = encodeConnection(tokens, "split", size)
+					static = encodeConnection(tokens, "static", size)
+				}
+				indexable := 0.0
+				if hpackEntrySize("x-jwt-static", tokens[0].Static) <= int(size) {
+					indexable = 1
+				}
+				b.ReportMetric(full, "full-bytes")
+				b.ReportMetric(split, "split-bytes")
+				b.ReportMetric(static, "static-bytes")
+				b.ReportMetric(indexable, "static-indexable")
+			})
+		}
+	}
+}
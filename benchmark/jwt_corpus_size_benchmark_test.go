@@ -0,0 +1,70 @@
+package benchmark
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// ============================================================================
+// CORPUS SIZE BENCHMARKS (golden tokens, including Azure AD group tokens)
+// ============================================================================
+
+const goldenJWTFile = "../test-suite/golden/jwt_golden.json"
+
+// hpackDefaultTableSize is SETTINGS_HEADER_TABLE_SIZE unless a peer raises it;
+// an entry larger than the table can never be indexed (RFC 7541 §4.4)
+const hpackDefaultTableSize = 4096
+
+type goldenJWT struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	Header    string `json:"header"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func loadGoldenJWTs(b *testing.B) []goldenJWT {
+	b.Helper()
+	data, err := os.ReadFile(goldenJWTFile)
+	if err != nil {
+		b.Fatalf("failed to read golden JWTs: %v", err)
+	}
+	var golden []goldenJWT
+	if err := json.Unmarshal(data, &golden); err != nil {
+		b.Fatalf("failed to parse golden JWTs: %v", err)
+	}
+	return golden
+}
+
+// hpackEntrySize is the RFC 7541 size of a header field in the dynamic table
+func hpackEntrySize(name, value string) int {
+	return len(name) + len(value) + 32
+}
+
+// BenchmarkCorpusSizes decomposes every golden token and reports its wire
+// size in both formats. payload-indexable drops to 0 for tokens like the
+// 150-group Azure AD one, whose payload can't enter a default HPACK table, so
+// splitting them saves nothing on repeat requests.
+func BenchmarkCorpusSizes(b *testing.B) {
+	for _, g := range loadGoldenJWTs(b) {
+		g := g
+		b.Run(g.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = DecomposeJWT(g.Token)
+			}
+			full := hpackEntrySize("authorization", "Bearer "+g.Token)
+			split := hpackEntrySize("x-jwt-header", g.Header) +
+				hpackEntrySize("x-jwt-payload", g.Payload) +
+				hpackEntrySize("x-jwt-sig", g.Signature)
+			indexable := 0.0
+			if hpackEntrySize("x-jwt-payload", g.Payload) <= hpackDefaultTableSize {
+				indexable = 1
+			}
+			b.ReportMetric(float64(full), "full-bytes")
+			b.ReportMetric(float64(split), "split-bytes")
+			b.ReportMetric(indexable, "payload-indexable")
+		})
+	}
+}
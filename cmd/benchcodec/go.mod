@@ -0,0 +1,15 @@
+module github.com/GoogleCloudPlatform/microservices-demo/cmd/benchcodec
+
+go 1.23.0
+
+require (
+	github.com/GoogleCloudPlatform/microservices-demo/src/frontend v0.0.0
+	google.golang.org/grpc v1.71.0
+)
+
+require (
+	golang.org/x/sys v0.31.0 // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+)
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/frontend => ../../src/frontend
@@ -0,0 +1,207 @@
+// Command benchcodec runs every registered JWT metadata codec over a token
+// corpus and writes one CSV row per token and codec: the metadata size, the
+// size HPACK charges for it in the dynamic table, and the time and
+// allocations of an encode and a decode. It replaces reading sizes off the
+// ad-hoc benchmark test with a comparison that can be rerun on any corpus.
+//
+// The corpus is either the golden JSON file (an array of objects with name
+// and token) or a text file with one token per line; blank lines and lines
+// starting with # are skipped.
+//
+// Usage:
+//
+//	benchcodec [-corpus test-suite/golden/jwt_golden.json] [-codecs full,cbor,...] [-benchtime 1s] [-o results.csv]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/jwtcodec"
+	"google.golang.org/grpc/metadata"
+)
+
+var header = []string{"token", "codec", "token_bytes", "metadata_bytes", "hpack_bytes",
+	"encode_ns", "encode_allocs", "decode_ns", "decode_allocs"}
+
+type corpusToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+func main() {
+	corpus := flag.String("corpus", "test-suite/golden/jwt_golden.json", "token corpus: golden JSON file or one token per line")
+	names := flag.String("codecs", "", "comma-separated codecs to run (default all registered)")
+	benchtime := flag.Duration("benchtime", time.Second, "minimum time spent on each encode and decode measurement")
+	out := flag.String("o", "", "CSV output file (default stdout)")
+	flag.Parse()
+
+	testing.Init()
+	if err := flag.Set("test.benchtime", benchtime.String()); err != nil {
+		fatal(err)
+	}
+	// reference-token needs a store to be available; an in-process one
+	// measures the codec without the cost of a network lookup
+	jwtcodec.SetReferenceStore(jwtcodec.NewMemoryStore(time.Hour))
+
+	tokens, err := loadCorpus(*corpus)
+	if err != nil {
+		fatal(err)
+	}
+	codecs, err := selectCodecs(*names)
+	if err != nil {
+		fatal(err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		fatal(err)
+	}
+	for _, t := range tokens {
+		for _, c := range codecs {
+			row, err := measure(c, t)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "benchcodec: %s/%s: %v\n", t.Name, c.Name(), err)
+				continue
+			}
+			if err := cw.Write(row); err != nil {
+				fatal(err)
+			}
+		}
+		cw.Flush()
+	}
+	if err := cw.Error(); err != nil {
+		fatal(err)
+	}
+}
+
+// measure encodes and decodes t.Token with c, checking the round trip
+// before timing it
+func measure(c jwtcodec.Codec, t corpusToken) ([]string, error) {
+	md, err := c.Encode(t.Token)
+	if err != nil {
+		return nil, err
+	}
+	got, ok, err := c.Decode(md)
+	switch {
+	case err != nil:
+		return nil, err
+	case !ok:
+		return nil, errors.New("decode found none of the codec's keys")
+	case got != t.Token:
+		return nil, errors.New("round trip changed the token")
+	}
+	mdBytes, hpackBytes := metadataSize(md)
+
+	enc := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Encode(t.Token); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	dec := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.Decode(md); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	if enc.N == 0 || dec.N == 0 {
+		return nil, errors.New("benchmark failed")
+	}
+	return []string{t.Name, c.Name(), strconv.Itoa(len(t.Token)), strconv.Itoa(mdBytes), strconv.Itoa(hpackBytes),
+		strconv.FormatInt(enc.NsPerOp(), 10), strconv.FormatInt(enc.AllocsPerOp(), 10),
+		strconv.FormatInt(dec.NsPerOp(), 10), strconv.FormatInt(dec.AllocsPerOp(), 10)}, nil
+}
+
+// metadataSize returns the bytes of every key and value in md, and the
+// RFC 7541 size of the same fields in the dynamic table
+func metadataSize(md metadata.MD) (raw, hpack int) {
+	for k, vs := range md {
+		for _, v := range vs {
+			raw += len(k) + len(v)
+			hpack += len(k) + len(v) + 32
+		}
+	}
+	return raw, hpack
+}
+
+func selectCodecs(names string) ([]jwtcodec.Codec, error) {
+	list := jwtcodec.Names()
+	if names != "" {
+		list = strings.Split(names, ",")
+	}
+	var codecs []jwtcodec.Codec
+	for _, name := range list {
+		c, ok := jwtcodec.Lookup(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %q (registered: %s)", name, strings.Join(jwtcodec.Names(), ", "))
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
+
+func loadCorpus(path string) ([]corpusToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var tokens []corpusToken
+		if err := json.Unmarshal(trimmed, &tokens); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for i := range tokens {
+			if tokens[i].Name == "" {
+				tokens[i].Name = "token-" + strconv.Itoa(i+1)
+			}
+		}
+		return tokens, nil
+	}
+	var tokens []corpusToken
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		tok := strings.TrimSpace(sc.Text())
+		if tok == "" || strings.HasPrefix(tok, "#") {
+			continue
+		}
+		tokens = append(tokens, corpusToken{Name: "line-" + strconv.Itoa(line), Token: tok})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return tokens, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "benchcodec:", err)
+	os.Exit(1)
+}
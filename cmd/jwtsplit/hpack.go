@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// hpackResult holds the encoded header block sizes for a simulated connection
+type hpackResult struct {
+	FirstRequest   int     `json:"first_request_bytes"`
+	SubsequentAvg  float64 `json:"subsequent_avg_bytes"`
+	Total          int     `json:"total_bytes"`
+	Requests       int     `json:"requests"`
+	TableSizeBytes uint32  `json:"table_size_bytes"`
+}
+
+// simulateHPACK encodes the same header fields for n requests on one
+// connection and reports how many bytes the JWT headers cost on the wire
+func simulateHPACK(fields []hpack.HeaderField, n int, tableSize uint32) hpackResult {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.SetMaxDynamicTableSizeLimit(tableSize)
+	enc.SetMaxDynamicTableSize(tableSize)
+
+	res := hpackResult{Requests: n, TableSizeBytes: tableSize}
+	for i := 0; i < n; i++ {
+		buf.Reset()
+		for _, f := range fields {
+			// Errors are impossible when writing to a bytes.Buffer
+			_ = enc.WriteField(f)
+		}
+		if i == 0 {
+			res.FirstRequest = buf.Len()
+		}
+		res.Total += buf.Len()
+	}
+	if n > 1 {
+		res.SubsequentAvg = float64(res.Total-res.FirstRequest) / float64(n-1)
+	}
+	return res
+}
+
+// fullJWTFields are the header fields sent with compression disabled
+func fullJWTFields(token string) []hpack.HeaderField {
+	return []hpack.HeaderField{
+		{Name: "authorization", Value: "Bearer " + token},
+	}
+}
+
+// splitJWTFields are the header fields sent with compression enabled;
+// neverIndexSig marks the signature as sensitive so it is never indexed
+func splitJWTFields(c *JWTComponents, neverIndexSig bool) []hpack.HeaderField {
+	return []hpack.HeaderField{
+		{Name: "x-jwt-header", Value: c.Header},
+		{Name: "x-jwt-payload", Value: c.Payload},
+		{Name: "x-jwt-sig", Value: c.Signature, Sensitive: neverIndexSig},
+	}
+}
+
+// headerBytes is the uncompressed size (name + value) of the header fields
+func headerBytes(fields []hpack.HeaderField) int {
+	n := 0
+	for _, f := range fields {
+		n += len(f.Name) + len(f.Value)
+	}
+	return n
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// h2CaptureMagic starts a capture written by the frontend's
+// JWT_H2_CAPTURE_FILE; see h2_capture.go there for the record layout
+const h2CaptureMagic = "H2HCAP1\n"
+
+const (
+	h2FrameHeaders   = 0x1
+	h2FlagEndHeaders = 0x4
+
+	// captureTableLimit bounds the dynamic table size updates accepted from
+	// a capture; the frontend raises the table well past the 4KB default
+	captureTableLimit = 16 << 20
+)
+
+// keyStats is how one header key fared over a capture
+type keyStats struct {
+	Key          string `json:"key"`
+	Fields       int    `json:"fields"`
+	RawBytes     int    `json:"raw_bytes"`
+	EncodedBytes int    `json:"encoded_bytes"`
+	Indexed      int    `json:"indexed"`
+	LiteralIndex int    `json:"literal_indexed"`
+	LiteralPlain int    `json:"literal_not_indexed"`
+	NeverIndexed int    `json:"never_indexed"`
+}
+
+// Ratio is encoded bytes per raw byte; lower is better
+func (k *keyStats) Ratio() float64 {
+	if k.RawBytes == 0 {
+		return 0
+	}
+	return float64(k.EncodedBytes) / float64(k.RawBytes)
+}
+
+// captureAnalysis summarizes a capture file
+type captureAnalysis struct {
+	File         string      `json:"file"`
+	Connections  int         `json:"connections"`
+	Blocks       int         `json:"header_blocks"`
+	RawBytes     int         `json:"raw_bytes"`
+	EncodedBytes int         `json:"encoded_bytes"`
+	Keys         []*keyStats `json:"keys"`
+}
+
+// captureConn replays one connection's HPACK dynamic table
+type captureConn struct {
+	dec     *hpack.Decoder
+	pending []byte
+}
+
+// analyzeCapture decodes every header block of a capture, attributing the
+// encoded bytes of each field to its key
+func analyzeCapture(name string, r io.Reader) (*captureAnalysis, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(h2CaptureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != h2CaptureMagic {
+		return nil, errors.New("not an HTTP/2 header capture (JWT_H2_CAPTURE_FILE)")
+	}
+
+	res := &captureAnalysis{File: name}
+	keys := make(map[string]*keyStats)
+	conns := make(map[uint32]*captureConn)
+	var hdr [22]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// A capture cut short by the process exiting
+				break
+			}
+			return nil, err
+		}
+		id := binary.BigEndian.Uint32(hdr[0:])
+		typ, flags := hdr[16], hdr[17]
+		fragment := make([]byte, binary.BigEndian.Uint32(hdr[18:]))
+		if _, err := io.ReadFull(br, fragment); err != nil {
+			break
+		}
+
+		c := conns[id]
+		if c == nil {
+			c = &captureConn{dec: hpack.NewDecoder(4096, nil)}
+			c.dec.SetAllowedMaxDynamicTableSize(captureTableLimit)
+			conns[id] = c
+		}
+		if typ == h2FrameHeaders {
+			c.pending = c.pending[:0]
+		}
+		c.pending = append(c.pending, fragment...)
+		if flags&h2FlagEndHeaders == 0 {
+			continue
+		}
+		if err := c.decodeBlock(keys); err != nil {
+			return nil, fmt.Errorf("connection %d, block %d: %w", id, res.Blocks+1, err)
+		}
+		res.Blocks++
+	}
+
+	res.Connections = len(conns)
+	for _, k := range keys {
+		res.RawBytes += k.RawBytes
+		res.EncodedBytes += k.EncodedBytes
+		res.Keys = append(res.Keys, k)
+	}
+	sort.Slice(res.Keys, func(i, j int) bool {
+		if res.Keys[i].EncodedBytes != res.Keys[j].EncodedBytes {
+			return res.Keys[i].EncodedBytes > res.Keys[j].EncodedBytes
+		}
+		return res.Keys[i].Key < res.Keys[j].Key
+	})
+	return res, nil
+}
+
+// decodeBlock feeds the pending block to the decoder one byte at a time, so
+// the bytes consumed between two emitted fields are that field's encoding
+func (c *captureConn) decodeBlock(keys map[string]*keyStats) error {
+	block, start := c.pending, 0
+	var emitted *hpack.HeaderField
+	c.dec.SetEmitFunc(func(f hpack.HeaderField) { emitted = &f })
+	for i := range block {
+		if _, err := c.dec.Write(block[i : i+1]); err != nil {
+			return err
+		}
+		if emitted == nil {
+			continue
+		}
+		k := keys[emitted.Name]
+		if k == nil {
+			k = &keyStats{Key: emitted.Name}
+			keys[emitted.Name] = k
+		}
+		k.Fields++
+		k.RawBytes += len(emitted.Name) + len(emitted.Value)
+		k.EncodedBytes += i + 1 - start
+		switch hpackRepresentation(block[start : i+1]) {
+		case hpackIndexed:
+			k.Indexed++
+		case hpackLiteralIndexed:
+			k.LiteralIndex++
+		case hpackNeverIndexed:
+			k.NeverIndexed++
+		default:
+			k.LiteralPlain++
+		}
+		emitted, start = nil, i+1
+	}
+	return c.dec.Close()
+}
+
+const (
+	hpackIndexed = iota
+	hpackLiteralIndexed
+	hpackLiteralPlain
+	hpackNeverIndexed
+)
+
+// hpackRepresentation classifies an encoded field by its first byte,
+// skipping any dynamic table size updates in front of it (RFC 7541 6)
+func hpackRepresentation(b []byte) int {
+	for len(b) > 0 && b[0]&0xe0 == 0x20 {
+		n := 1
+		if b[0]&0x1f == 0x1f {
+			for n < len(b) && b[n]&0x80 != 0 {
+				n++
+			}
+			n++
+		}
+		b = b[min(n, len(b)):]
+	}
+	switch {
+	case len(b) == 0:
+		return hpackLiteralPlain
+	case b[0]&0x80 != 0:
+		return hpackIndexed
+	case b[0]&0xc0 == 0x40:
+		return hpackLiteralIndexed
+	case b[0]&0xf0 == 0x10:
+		return hpackNeverIndexed
+	}
+	return hpackLiteralPlain
+}
+
+func runHPACKAnalyze(args []string) error {
+	fs := flag.NewFlagSet("hpack-analyze", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the analysis as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("expected one or more capture files")
+	}
+	var results []*captureAnalysis
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		res, err := analyzeCapture(path, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		results = append(results, res)
+	}
+	if *asJSON {
+		return printJSON(results)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, res := range results {
+		fmt.Fprintf(w, "%s: %d connections, %d header blocks\n", res.File, res.Connections, res.Blocks)
+		fmt.Fprintln(w, "key\tfields\traw\tencoded\tratio\tindexed\tlit+idx\tlit\tnever\t")
+		for _, k := range res.Keys {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.3f\t%d\t%d\t%d\t%d\t\n", k.Key, k.Fields, k.RawBytes, k.EncodedBytes, k.Ratio(), k.Indexed, k.LiteralIndex, k.LiteralPlain, k.NeverIndexed)
+		}
+		fmt.Fprintln(w)
+	}
+	// Comparison mode: one line per capture, e.g. one run per JWT mode
+	if len(results) > 1 {
+		fmt.Fprintln(w, "capture\tblocks\traw/block\tencoded/block\tratio\t")
+		for _, res := range results {
+			fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%.3f\t\n", res.File, res.Blocks, perBlock(res.RawBytes, res.Blocks), perBlock(res.EncodedBytes, res.Blocks), perBlock(res.EncodedBytes, res.RawBytes))
+		}
+	}
+	return w.Flush()
+}
+
+func perBlock(n, blocks int) float64 {
+	if blocks == 0 {
+		return 0
+	}
+	return float64(n) / float64(blocks)
+}
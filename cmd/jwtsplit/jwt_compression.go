@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// JWTComponents represents the decomposed parts of a JWT for compression
+// 3-header design: header + payload + signature
+// Kept in sync with src/*/jwt_compression.go
+type JWTComponents struct {
+	Header    string `json:"header"`    // Original header (base64url encoded, for IdP compatibility)
+	Payload   string `json:"payload"`   // Raw JSON payload (base64 decoded for HPACK efficiency)
+	Signature string `json:"signature"` // Original signature (base64url encoded, unchanged)
+}
+
+// DecomposeJWT splits a JWT for optimized transmission
+// Input: "header.payload.signature" JWT string
+// Output: JWTComponents with header, raw JSON payload, and signature
+func DecomposeJWT(jwtToken string) (*JWTComponents, error) {
+	parts := strings.Split(jwtToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWT format: expected 3 parts, got %d", len(parts))
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+
+	return &JWTComponents{
+		Header:    parts[0],
+		Payload:   string(payloadJSON),
+		Signature: parts[2],
+	}, nil
+}
+
+// ReassembleJWT reconstructs a JWT from its decomposed components
+// Input: JWTComponents with header, raw JSON payload, and signature
+// Output: "header.payload.signature" JWT string
+func ReassembleJWT(components *JWTComponents) (string, error) {
+	payloadB64 := base64.RawURLEncoding.EncodeToString([]byte(components.Payload))
+	return fmt.Sprintf("%s.%s.%s", components.Header, payloadB64, components.Signature), nil
+}
+
+// GetJWTComponentSizes returns the byte sizes of each component for logging/metrics
+func GetJWTComponentSizes(components *JWTComponents) map[string]int {
+	return map[string]int{
+		"header":    len(components.Header),
+		"payload":   len(components.Payload),
+		"signature": len(components.Signature),
+		"total":     len(components.Header) + len(components.Payload) + len(components.Signature),
+	}
+}
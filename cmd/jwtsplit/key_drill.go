@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// key-drill rehearses a signing key compromise against running services: it
+// has the frontend rotate its key and revoke the old kid through the debug
+// server (DEBUG_PORT), then polls the /debug/keys of every verifier until it
+// accepts the new key and refuses the old one. Verifiers that take longer
+// than -within are reported as laggards.
+
+// drillKeys is the part of /debug/keys the drill reads
+type drillKeys struct {
+	Current string   `json:"current"`
+	KeyIDs  []string `json:"kids"`
+}
+
+type drillVerifier struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// NewKeyAfter and OldKeyRefusedAfter are measured from the rotation,
+	// empty when it didn't happen in time
+	NewKeyAfter        string `json:"new_key_after,omitempty"`
+	OldKeyRefusedAfter string `json:"old_key_refused_after,omitempty"`
+	Laggard            bool   `json:"laggard"`
+	Error              string `json:"error,omitempty"`
+}
+
+type drillReport struct {
+	OldKid    string          `json:"old_kid"`
+	NewKid    string          `json:"new_kid"`
+	Within    string          `json:"within"`
+	Verifiers []drillVerifier `json:"verifiers"`
+}
+
+func runKeyDrill(args []string) error {
+	fs := flag.NewFlagSet("key-drill", flag.ExitOnError)
+	frontend := fs.String("frontend", "", "debug server of the frontend (DEBUG_PORT, reachable with DEBUG_LISTEN_ADDR), e.g. http://frontend:9090")
+	within := fs.Duration("within", time.Minute, "time every verifier has to accept the new key and refuse the old one")
+	poll := fs.Duration("poll", time.Second, "interval between polls of the verifiers")
+	direct := fs.Bool("revoke-direct", false, "also POST the revocation to every verifier's /jwt/revoke, for frontends without JWT_REVOCATION_URLS")
+	adminToken := fs.String("admin-token", os.Getenv("DEBUG_ADMIN_TOKEN"), "bearer token the frontend requires to rotate and revoke keys (DEBUG_ADMIN_TOKEN)")
+	revocationKey := fs.String("revocation-key", os.Getenv("JWT_REVOCATION_KEY"), "key the verifiers check -revoke-direct notices against (JWT_REVOCATION_KEY)")
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	if *frontend == "" {
+		return errors.New("-frontend is required")
+	}
+	if *adminToken == "" {
+		return errors.New("-admin-token or DEBUG_ADMIN_TOKEN is required")
+	}
+	if *direct && *revocationKey == "" {
+		return errors.New("-revoke-direct needs -revocation-key or JWT_REVOCATION_KEY")
+	}
+	if fs.NArg() == 0 {
+		return errors.New("expected at least one verifier as name=debug-url, e.g. checkout=http://checkoutservice:9090")
+	}
+	verifiers := make([]drillVerifier, 0, fs.NArg())
+	for _, arg := range fs.Args() {
+		name, u, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || u == "" {
+			return fmt.Errorf("verifier %q is not name=debug-url", arg)
+		}
+		verifiers = append(verifiers, drillVerifier{Name: name, URL: strings.TrimSuffix(u, "/")})
+	}
+	base := strings.TrimSuffix(*frontend, "/")
+	client := &http.Client{Timeout: 10 * time.Second}
+	admin := http.Header{"Authorization": {"Bearer " + *adminToken}}
+
+	var before drillKeys
+	if err := drillRequest(client, http.MethodGet, base+"/debug/keys", nil, nil, &before); err != nil {
+		return fmt.Errorf("frontend keys: %w", err)
+	}
+	start := time.Now()
+	var after drillKeys
+	if err := drillRequest(client, http.MethodPost, base+"/debug/keys/rotate", admin, nil, &after); err != nil {
+		return fmt.Errorf("rotate: %w", err)
+	}
+	if after.Current == before.Current {
+		return fmt.Errorf("rotate: the frontend still signs with %s", before.Current)
+	}
+	if err := drillRequest(client, http.MethodPost, base+"/debug/keys/revoke?kid="+url.QueryEscape(before.Current), admin, nil, nil); err != nil {
+		return fmt.Errorf("revoke %s: %w", before.Current, err)
+	}
+	if *direct {
+		notice, _ := json.Marshal(map[string]interface{}{"kid": before.Current, "exp": time.Now().Unix()})
+		mac := hmac.New(sha256.New, []byte(*revocationKey))
+		mac.Write(notice)
+		signed := http.Header{"X-Revocation-Signature": {base64.RawURLEncoding.EncodeToString(mac.Sum(nil))}}
+		for i, v := range verifiers {
+			if err := drillRequest(client, http.MethodPost, v.URL+"/jwt/revoke", signed, notice, nil); err != nil {
+				verifiers[i].Error = "revoke: " + err.Error()
+			}
+		}
+	}
+
+	deadline := start.Add(*within)
+	for {
+		pending := 0
+		for i := range verifiers {
+			v := &verifiers[i]
+			if v.NewKeyAfter != "" && v.OldKeyRefusedAfter != "" {
+				continue
+			}
+			var keys drillKeys
+			if err := drillRequest(client, http.MethodGet, v.URL+"/debug/keys", nil, nil, &keys); err != nil {
+				v.Error = err.Error()
+				pending++
+				continue
+			}
+			v.Error = ""
+			elapsed := time.Since(start).Round(10 * time.Millisecond).String()
+			if v.NewKeyAfter == "" && slices.Contains(keys.KeyIDs, after.Current) {
+				v.NewKeyAfter = elapsed
+			}
+			if v.OldKeyRefusedAfter == "" && !slices.Contains(keys.KeyIDs, before.Current) {
+				v.OldKeyRefusedAfter = elapsed
+			}
+			if v.NewKeyAfter == "" || v.OldKeyRefusedAfter == "" {
+				pending++
+			}
+		}
+		if pending == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(*poll)
+	}
+
+	report := drillReport{OldKid: before.Current, NewKid: after.Current, Within: within.String(), Verifiers: verifiers}
+	laggards := 0
+	for i := range report.Verifiers {
+		v := &report.Verifiers[i]
+		v.Laggard = v.NewKeyAfter == "" || v.OldKeyRefusedAfter == ""
+		if v.Laggard {
+			laggards++
+		}
+	}
+	if *jsonOut {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		printDrillReport(report)
+	}
+	if laggards > 0 {
+		return fmt.Errorf("%d of %d verifiers missed the %s deadline", laggards, len(verifiers), within)
+	}
+	return nil
+}
+
+func printDrillReport(r drillReport) {
+	fmt.Printf("rotated %s -> %s, verifiers had %s\n\n", r.OldKid, r.NewKid, r.Within)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERIFIER\tNEW KEY\tOLD KEY REFUSED\tSTATUS")
+	for _, v := range r.Verifiers {
+		status := "ok"
+		if v.Laggard {
+			status = "LAGGARD"
+		}
+		if v.Error != "" {
+			status += " (" + v.Error + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Name, orDash(v.NewKeyAfter), orDash(v.OldKeyRefusedAfter), status)
+	}
+	tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// drillRequest sends body, if any, as JSON with the extra header and decodes
+// a JSON response into out, if not nil
+func drillRequest(client *http.Client, method, u string, header http.Header, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg := new(bytes.Buffer)
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s %s: %s %s", method, u, resp.Status, strings.TrimSpace(msg.String()))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
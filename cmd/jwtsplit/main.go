@@ -0,0 +1,241 @@
+// Command jwtsplit reproduces the split-JWT wire format offline: it decomposes
+// and reassembles tokens, verifies them against a JWKS, reports header sizes
+// with and without HPACK so captured mesh headers can be debugged, and replays
+// requests captured by the services' JWT_CAPTURE_FILE. hpack-analyze reads
+// the HTTP/2 header blocks captured by the frontend's JWT_H2_CAPTURE_FILE;
+// trace-report compares header bytes per hop across OTLP trace exports;
+// key-drill rehearses a signing key compromise against running services.
+//
+// Usage:
+//
+//	jwtsplit decompose <token|->
+//	jwtsplit reassemble -header <b64url> -payload <json> -sig <b64url>
+//	jwtsplit reassemble -json <file|->
+//	jwtsplit verify -jwks-url <url> <token|->
+//	jwtsplit size-report <token|->
+//	jwtsplit simulate-hpack [-n 100] [-table-size 4096] [-never-index-sig] <token|->
+//	jwtsplit replay -addr <host:port> [-method <substr>] [-timeout 5s] <capture-file|->
+//	jwtsplit hpack-analyze [-json] <h2-capture-file>...
+//	jwtsplit trace-report [-o report.html] [-json] <label=otlp-export.json>...
+//	jwtsplit key-drill -frontend <debug-url> [-admin-token t] [-within 1m] [-poll 1s] [-revoke-direct] [-revocation-key k] [-json] <name=debug-url>...
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `usage: jwtsplit <command> [flags] [token|-]
+
+commands:
+  decompose       split a JWT into x-jwt-header / x-jwt-payload / x-jwt-sig
+  reassemble      rebuild a JWT from its components
+  verify          verify a JWT signature against a JWKS (-jwks-url)
+  size-report     compare header bytes of the full and split formats
+  simulate-hpack  encode repeated requests with HPACK and report wire bytes
+  replay          re-send requests from a JWT_CAPTURE_FILE against a service
+  hpack-analyze   report HPACK efficiency per header key from JWT_H2_CAPTURE_FILE
+  trace-report    compare header bytes per hop across OTLP trace exports (HTML)
+  key-drill       rotate the signing key, revoke the old kid and time every verifier
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "decompose":
+		err = runDecompose(args)
+	case "reassemble":
+		err = runReassemble(args)
+	case "verify":
+		err = runVerify(args)
+	case "size-report":
+		err = runSizeReport(args)
+	case "simulate-hpack":
+		err = runSimulateHPACK(args)
+	case "replay":
+		err = runReplay(args)
+	case "hpack-analyze":
+		err = runHPACKAnalyze(args)
+	case "trace-report":
+		err = runTraceReport(args)
+	case "key-drill":
+		err = runKeyDrill(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jwtsplit %s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func runDecompose(args []string) error {
+	fs := flag.NewFlagSet("decompose", flag.ExitOnError)
+	fs.Parse(args)
+
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		return err
+	}
+	return printJSON(struct {
+		*JWTComponents
+		Sizes map[string]int `json:"sizes"`
+	}{components, GetJWTComponentSizes(components)})
+}
+
+func runReassemble(args []string) error {
+	fs := flag.NewFlagSet("reassemble", flag.ExitOnError)
+	header := fs.String("header", "", "x-jwt-header value (base64url)")
+	payload := fs.String("payload", "", "x-jwt-payload value (raw JSON)")
+	sig := fs.String("sig", "", "x-jwt-sig value (base64url)")
+	jsonIn := fs.String("json", "", "read components from a decompose output file, or - for stdin")
+	fs.Parse(args)
+
+	components := &JWTComponents{Header: *header, Payload: *payload, Signature: *sig}
+	if *jsonIn != "" {
+		data, err := readInput(*jsonIn)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, components); err != nil {
+			return fmt.Errorf("failed to parse components: %w", err)
+		}
+	}
+	if components.Header == "" || components.Payload == "" || components.Signature == "" {
+		return errors.New("header, payload and signature are all required")
+	}
+	if !json.Valid([]byte(components.Payload)) {
+		return errors.New("payload is not valid JSON")
+	}
+
+	token, err := ReassembleJWT(components)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	jwksURL := fs.String("jwks-url", "", "URL of the JSON Web Key Set")
+	fs.Parse(args)
+
+	if *jwksURL == "" {
+		return errors.New("-jwks-url is required")
+	}
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+	keys, err := fetchJWKS(*jwksURL)
+	if err != nil {
+		return err
+	}
+	kid, err := verifyJWT(token, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("signature valid (kid %q)\n", kid)
+	return nil
+}
+
+func runSizeReport(args []string) error {
+	fs := flag.NewFlagSet("size-report", flag.ExitOnError)
+	fs.Parse(args)
+
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		return err
+	}
+
+	full := headerBytes(fullJWTFields(token))
+	split := headerBytes(splitJWTFields(components, false))
+	return printJSON(map[string]interface{}{
+		"token_bytes":          len(token),
+		"component_sizes":      GetJWTComponentSizes(components),
+		"full_header_bytes":    full,
+		"split_header_bytes":   split,
+		"uncompressed_savings": fmt.Sprintf("%.1f%%", 100*float64(full-split)/float64(full)),
+	})
+}
+
+func runSimulateHPACK(args []string) error {
+	fs := flag.NewFlagSet("simulate-hpack", flag.ExitOnError)
+	n := fs.Int("n", 100, "number of requests on the simulated connection")
+	tableSize := fs.Uint("table-size", 4096, "HPACK dynamic table size in bytes")
+	neverIndexSig := fs.Bool("never-index-sig", false, "send x-jwt-sig as never-indexed")
+	fs.Parse(args)
+
+	if *n < 1 {
+		return errors.New("-n must be at least 1")
+	}
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(map[string]hpackResult{
+		"full":  simulateHPACK(fullJWTFields(token), *n, uint32(*tableSize)),
+		"split": simulateHPACK(splitJWTFields(components, *neverIndexSig), *n, uint32(*tableSize)),
+	})
+}
+
+// readToken returns the token given as the only argument, reading stdin for "-"
+func readToken(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected exactly one token argument (or - for stdin)")
+	}
+	data, err := readInput(args[0])
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	return strings.TrimPrefix(token, "Bearer "), nil
+}
+
+// readInput returns arg itself, the contents of stdin for "-", or the file
+// contents when arg is an existing path
+func readInput(arg string) ([]byte, error) {
+	if arg == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	if data, err := os.ReadFile(arg); err == nil {
+		return data, nil
+	}
+	return []byte(arg), nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
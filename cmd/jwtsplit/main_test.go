@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testToken signs payload with key under kid, RS256
+func testToken(t *testing.T, key *rsa.PrivateKey, kid, payload string) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid})
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestDecomposeReassemble(t *testing.T) {
+	payload := `{"sub":"urn:hipstershop:user:s1","session_id":"s1"}`
+	token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+	c, err := DecomposeJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Payload != payload {
+		t.Errorf("payload = %q, want the raw JSON %q", c.Payload, payload)
+	}
+	if got, _ := ReassembleJWT(c); got != token {
+		t.Errorf("reassembled %q, want %q", got, token)
+	}
+	sizes := GetJWTComponentSizes(c)
+	if sizes["total"] != len(c.Header)+len(payload)+len(c.Signature) {
+		t.Errorf("sizes = %v", sizes)
+	}
+	for _, bad := range []string{"a.b", "a.!!.c"} {
+		if _, err := DecomposeJWT(bad); err == nil {
+			t.Errorf("DecomposeJWT(%q) accepted", bad)
+		}
+	}
+}
+
+// TestVerifyJWT checks verification against a JWKS fetched over HTTP: the
+// key named by kid verifies, a tampered token or an unknown kid doesn't
+func TestVerifyJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "RSA", Kid: "k1", Alg: "RS256",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+	keys, err := fetchJWKS(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := testToken(t, key, "k1", `{"sub":"s1"}`)
+	if kid, err := verifyJWT(token, keys); err != nil || kid != "k1" {
+		t.Errorf("valid token: got (%q, %v), want k1", kid, err)
+	}
+	c, _ := DecomposeJWT(token)
+	c.Payload = `{"sub":"s2"}`
+	tampered, _ := ReassembleJWT(c)
+	if _, err := verifyJWT(tampered, keys); err == nil {
+		t.Error("tampered token verified")
+	}
+	if _, err := verifyJWT(testToken(t, key, "k2", `{"sub":"s1"}`), keys); err == nil {
+		t.Error("token of an unknown kid verified")
+	}
+}
+
+// TestSimulateHPACK checks that repeated split headers cost less than the
+// full token once the static parts are indexed, and that a never-indexed
+// signature is sent in full every time
+func TestSimulateHPACK(t *testing.T) {
+	payload := `{"iss":"https://auth.hipstershop.com","aud":["urn:hipstershop:api"],"sub":"urn:hipstershop:user:s1","session_id":"s1"}`
+	token := "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJlc2lnbmF0dXJlc2lnbmF0dXJl"
+	c, err := DecomposeJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := simulateHPACK(fullJWTFields(token), 10, 4096)
+	if full.Requests != 10 || full.SubsequentAvg >= float64(full.FirstRequest) {
+		t.Errorf("full token: %+v, want later requests indexed", full)
+	}
+	indexed := simulateHPACK(splitJWTFields(c, false), 10, 4096)
+	sensitive := simulateHPACK(splitJWTFields(c, true), 10, 4096)
+	if sensitive.SubsequentAvg <= indexed.SubsequentAvg || sensitive.SubsequentAvg < float64(len(c.Signature)) {
+		t.Errorf("never-indexed signature: %.1f bytes per request, indexed %.1f", sensitive.SubsequentAvg, indexed.SubsequentAvg)
+	}
+	if noTable := simulateHPACK(fullJWTFields(token), 10, 0); noTable.SubsequentAvg <= 2*full.SubsequentAvg {
+		t.Errorf("without a dynamic table: %+v, want the token resent on every request", noTable)
+	}
+	if n := headerBytes(fullJWTFields(token)); n != len("authorization")+len("Bearer ")+len(token) {
+		t.Errorf("headerBytes = %d", n)
+	}
+}
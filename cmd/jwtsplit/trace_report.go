@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Span attributes the frontend and checkout set on their gRPC spans (see
+// annotateSpan in their grpc_stats.go)
+const (
+	spanAttrJWTMode          = "jwt.mode"
+	spanAttrJWTMetadataBytes = "jwt.metadata_bytes"
+	spanAttrHeaderWireBytes  = "rpc.header_wire_bytes"
+)
+
+// OTLP/JSON as written by the collector's file exporter: one
+// ExportTraceServiceRequest per line, or a single one per file
+type otlpExport struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+		// Collectors before v0.50 wrote the old name
+		InstrumentationLibrarySpans []otlpScopeSpans `json:"instrumentationLibrarySpans"`
+	} `json:"resourceSpans"`
+}
+
+type otlpScopeSpans struct {
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId"`
+	Name         string          `json:"name"`
+	Kind         json.RawMessage `json:"kind"`
+	Attributes   []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string         `json:"stringValue"`
+		IntValue    json.RawMessage `json:"intValue"`
+	} `json:"value"`
+}
+
+// spanKind reads kind, an enum number or its name
+func (s *otlpSpan) spanKind() string {
+	k := strings.Trim(string(s.Kind), `"`)
+	switch k {
+	case "2", "SPAN_KIND_SERVER":
+		return "server"
+	case "3", "SPAN_KIND_CLIENT":
+		return "client"
+	}
+	return k
+}
+
+func attrString(attrs []otlpAttribute, key string) (string, bool) {
+	for _, a := range attrs {
+		if a.Key == key && a.Value.StringValue != nil {
+			return *a.Value.StringValue, true
+		}
+	}
+	return "", false
+}
+
+// attrInt reads an int attribute; proto3 JSON encodes int64 as a string
+func attrInt(attrs []otlpAttribute, key string) (int64, bool) {
+	for _, a := range attrs {
+		if a.Key == key && a.Value.IntValue != nil {
+			n, err := strconv.ParseInt(strings.Trim(string(a.Value.IntValue), `"`), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// hopStats sums one caller -> method hop of a run. Callers report the JWT
+// metadata they sent; callees the HPACK-encoded size of the headers they
+// received, which is where the split format pays off.
+type hopStats struct {
+	Hop              string         `json:"hop"`
+	Calls            int            `json:"calls"`
+	JWTMetadataBytes int64          `json:"jwt_metadata_bytes"`
+	WireCalls        int            `json:"wire_calls"`
+	HeaderWireBytes  int64          `json:"header_wire_bytes"`
+	Modes            map[string]int `json:"modes"`
+
+	// Server-side metadata, used when the caller isn't traced
+	serverCalls int
+	serverBytes int64
+}
+
+func (h *hopStats) JWTPerCall() float64  { return perCall(h.JWTMetadataBytes, h.Calls) }
+func (h *hopStats) WirePerCall() float64 { return perCall(h.HeaderWireBytes, h.WireCalls) }
+
+// runStats is one labelled run, from one or more exports
+type runStats struct {
+	Label            string         `json:"label"`
+	Files            []string       `json:"files"`
+	Spans            int            `json:"spans"`
+	Calls            int            `json:"calls"`
+	JWTMetadataBytes int64          `json:"jwt_metadata_bytes"`
+	WireCalls        int            `json:"wire_calls"`
+	HeaderWireBytes  int64          `json:"header_wire_bytes"`
+	Modes            map[string]int `json:"modes"`
+	Hops             []*hopStats    `json:"hops"`
+}
+
+func (r *runStats) JWTPerCall() float64  { return perCall(r.JWTMetadataBytes, r.Calls) }
+func (r *runStats) WirePerCall() float64 { return perCall(r.HeaderWireBytes, r.WireCalls) }
+
+func (r *runStats) hop(name string) *hopStats {
+	for _, h := range r.Hops {
+		if h.Hop == name {
+			return h
+		}
+	}
+	return nil
+}
+
+func perCall(n int64, calls int) float64 {
+	if calls == 0 {
+		return 0
+	}
+	return float64(n) / float64(calls)
+}
+
+// tracedSpan is a span with the service that emitted it
+type tracedSpan struct {
+	otlpSpan
+	service string
+}
+
+// readOTLPSpans reads every span of an export
+func readOTLPSpans(r io.Reader) ([]tracedSpan, error) {
+	var spans []tracedSpan
+	dec := json.NewDecoder(r)
+	for {
+		var export otlpExport
+		if err := dec.Decode(&export); err == io.EOF {
+			return spans, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, rs := range export.ResourceSpans {
+			service, _ := attrString(rs.Resource.Attributes, "service.name")
+			for _, ss := range append(rs.ScopeSpans, rs.InstrumentationLibrarySpans...) {
+				for _, s := range ss.Spans {
+					spans = append(spans, tracedSpan{otlpSpan: s, service: service})
+				}
+			}
+		}
+	}
+}
+
+// analyzeRun sums the header-size attributes of a run's spans per hop. A
+// server span's caller is the service of its parent span, when that is in
+// the export too.
+func analyzeRun(label string, files []string) (*runStats, error) {
+	run := &runStats{Label: label, Files: files, Modes: map[string]int{}}
+	var spans []tracedSpan
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		s, err := readOTLPSpans(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		spans = append(spans, s...)
+	}
+	run.Spans = len(spans)
+	serviceOf := make(map[string]string, len(spans))
+	for _, s := range spans {
+		serviceOf[s.SpanID] = s.service
+	}
+
+	hops := map[string]*hopStats{}
+	for _, s := range spans {
+		jwtBytes, hasJWT := attrInt(s.Attributes, spanAttrJWTMetadataBytes)
+		if !hasJWT {
+			continue
+		}
+		mode, _ := attrString(s.Attributes, spanAttrJWTMode)
+		caller := s.service
+		if s.spanKind() == "server" {
+			caller = serviceOf[s.ParentSpanID]
+			if caller == "" {
+				caller = "?"
+			}
+		}
+		name := caller + " → " + s.Name
+		h := hops[name]
+		if h == nil {
+			h = &hopStats{Hop: name, Modes: map[string]int{}}
+			hops[name] = h
+		}
+		if s.spanKind() == "server" {
+			h.serverCalls++
+			h.serverBytes += jwtBytes
+			if wire, ok := attrInt(s.Attributes, spanAttrHeaderWireBytes); ok {
+				h.WireCalls++
+				h.HeaderWireBytes += wire
+			}
+			if caller == "?" {
+				h.Modes[mode]++
+			}
+			continue
+		}
+		h.Calls++
+		h.JWTMetadataBytes += jwtBytes
+		h.Modes[mode]++
+	}
+
+	for _, h := range hops {
+		if h.Calls == 0 {
+			h.Calls, h.JWTMetadataBytes = h.serverCalls, h.serverBytes
+		}
+		run.Calls += h.Calls
+		run.JWTMetadataBytes += h.JWTMetadataBytes
+		run.WireCalls += h.WireCalls
+		run.HeaderWireBytes += h.HeaderWireBytes
+		for m, n := range h.Modes {
+			run.Modes[m] += n
+		}
+		run.Hops = append(run.Hops, h)
+	}
+	sort.Slice(run.Hops, func(i, j int) bool { return run.Hops[i].Hop < run.Hops[j].Hop })
+	if run.Calls == 0 {
+		return nil, fmt.Errorf("run %s: no spans carry %s; were the services built with span size attributes and traced?", label, spanAttrJWTMetadataBytes)
+	}
+	return run, nil
+}
+
+// traceReport compares runs against the first one
+type traceReport struct {
+	Runs []*runStats
+	Hops []string
+}
+
+// Delta is how much smaller (negative) or larger v is than base, in percent
+func (traceReport) Delta(v, base float64) string {
+	if base == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%+.1f%%", (v-base)/base*100)
+}
+
+// HopStats returns the run's stats for hop, nil when the run never made it
+func (traceReport) HopStats(r *runStats, hop string) *hopStats { return r.hop(hop) }
+
+var traceReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>JWT header bytes per hop</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+{{- $r := . }}
+{{- $base := index .Runs 0 }}
+<h1>JWT header bytes per hop</h1>
+<p>Deltas are against <b>{{ $base.Label }}</b>. JWT metadata is the uncompressed size of the JWT headers the caller sent; header wire bytes are the HPACK-encoded size of all headers the callee received.</p>
+
+<h2>Runs</h2>
+<table>
+<tr><th>run</th><th>spans</th><th>RPCs</th><th>JWT modes</th><th>JWT metadata / call</th><th>Δ</th><th>header wire bytes / call</th><th>Δ</th></tr>
+{{- range .Runs }}
+<tr>
+<td>{{ .Label }}<br><span class="muted">{{ range $i, $f := .Files }}{{ if $i }}, {{ end }}{{ $f }}{{ end }}</span></td>
+<td>{{ .Spans }}</td>
+<td>{{ .Calls }}</td>
+<td>{{ range $m, $n := .Modes }}{{ $m }}: {{ $n }}<br>{{ end }}</td>
+<td>{{ printf "%.1f" .JWTPerCall }}</td>
+<td>{{ if ne . $base }}{{ $r.Delta .JWTPerCall $base.JWTPerCall }}{{ end }}</td>
+<td>{{ if .WireCalls }}{{ printf "%.1f" .WirePerCall }}{{ end }}</td>
+<td>{{ if and .WireCalls (ne . $base) }}{{ $r.Delta .WirePerCall $base.WirePerCall }}{{ end }}</td>
+</tr>
+{{- end }}
+</table>
+
+<h2>JWT metadata bytes per call, by hop</h2>
+<table>
+<tr><th>hop</th>{{ range .Runs }}<th>{{ .Label }}</th>{{ if ne . $base }}<th>Δ</th>{{ end }}{{ end }}</tr>
+{{- range $hop := .Hops }}
+<tr><td>{{ $hop }}</td>
+{{- $b := $r.HopStats $base $hop }}
+{{- range $r.Runs }}
+{{- $h := $r.HopStats . $hop }}
+<td>{{ if $h }}{{ printf "%.1f" $h.JWTPerCall }} <span class="muted">×{{ $h.Calls }}</span>{{ end }}</td>
+{{- if ne . $base }}<td>{{ if and $h $b }}{{ $r.Delta $h.JWTPerCall $b.JWTPerCall }}{{ end }}</td>{{ end }}
+{{- end }}
+</tr>
+{{- end }}
+</table>
+
+<h2>Header wire bytes per call, by hop</h2>
+<table>
+<tr><th>hop</th>{{ range .Runs }}<th>{{ .Label }}</th>{{ if ne . $base }}<th>Δ</th>{{ end }}{{ end }}</tr>
+{{- range $hop := .Hops }}
+<tr><td>{{ $hop }}</td>
+{{- $b := $r.HopStats $base $hop }}
+{{- range $r.Runs }}
+{{- $h := $r.HopStats . $hop }}
+<td>{{ if and $h $h.WireCalls }}{{ printf "%.1f" $h.WirePerCall }} <span class="muted">×{{ $h.WireCalls }}</span>{{ end }}</td>
+{{- if ne . $base }}<td>{{ if and $h $b $h.WireCalls $b.WireCalls }}{{ $r.Delta $h.WirePerCall $b.WirePerCall }}{{ end }}</td>{{ end }}
+{{- end }}
+</tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+func runTraceReport(args []string) error {
+	fs := flag.NewFlagSet("trace-report", flag.ExitOnError)
+	out := fs.String("o", "-", "write the HTML report to this file, - for stdout")
+	asJSON := fs.Bool("json", false, "print the per-hop sums as JSON instead")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		return errors.New("expected label=export.json arguments, e.g. full=run-off.json split=run-on.json")
+	}
+	// A label may repeat to merge several exports into one run
+	var labels []string
+	files := map[string][]string{}
+	for _, arg := range fs.Args() {
+		label, path, ok := strings.Cut(arg, "=")
+		if !ok || label == "" || path == "" {
+			return fmt.Errorf("argument %q is not label=export.json", arg)
+		}
+		if _, seen := files[label]; !seen {
+			labels = append(labels, label)
+		}
+		files[label] = append(files[label], path)
+	}
+
+	report := &traceReport{}
+	hops := map[string]bool{}
+	for _, label := range labels {
+		run, err := analyzeRun(label, files[label])
+		if err != nil {
+			return err
+		}
+		report.Runs = append(report.Runs, run)
+		for _, h := range run.Hops {
+			if !hops[h.Hop] {
+				hops[h.Hop] = true
+				report.Hops = append(report.Hops, h.Hop)
+			}
+		}
+	}
+	sort.Strings(report.Hops)
+	if *asJSON {
+		return printJSON(report.Runs)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return traceReportTemplate.Execute(w, report)
+}
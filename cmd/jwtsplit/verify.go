@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwk is the subset of an RSA JSON Web Key needed for signature verification
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwtHeader is the subset of the JOSE header needed to pick a key
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var rsaHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// fetchJWKS downloads the key set published at url
+func fetchJWKS(url string) ([]jwk, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	return set.Keys, nil
+}
+
+// publicKey converts an RSA JWK into an rsa.PublicKey
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus for key %q: %w", k.Kid, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent for key %q: %w", k.Kid, err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// verifyJWT checks the token signature against the key set and returns the
+// kid of the key that verified it. Only RSA (RS256/384/512) keys are supported.
+func verifyJWT(token string, keys []jwk) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid JWT format: expected 3 parts, got %d", len(parts))
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode JWT header: %w", err)
+	}
+	var hdr jwtHeader
+	if err := json.Unmarshal(headerJSON, &hdr); err != nil {
+		return "", fmt.Errorf("failed to parse JWT header: %w", err)
+	}
+	hash, ok := rsaHashes[hdr.Alg]
+	if !ok {
+		return "", fmt.Errorf("unsupported signing algorithm %q", hdr.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode JWT signature: %w", err)
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	tried := 0
+	for _, k := range keys {
+		if k.Kty != "RSA" || (hdr.Kid != "" && k.Kid != hdr.Kid) {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return "", err
+		}
+		tried++
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+			return k.Kid, nil
+		}
+	}
+	if tried == 0 {
+		return "", fmt.Errorf("no RSA key in JWKS matches kid %q", hdr.Kid)
+	}
+	return "", fmt.Errorf("signature verification failed against %d key(s)", tried)
+}
@@ -0,0 +1,278 @@
+// Command loadgen drives headless load straight at checkout and shipping.
+// Each virtual user gets a session and its JWT from the frontend, the way a
+// browser would, then calls the internal services over gRPC itself,
+// alternating between the two header formats: the whole token in
+// authorization, and the split x-jwt-header/x-jwt-payload/x-jwt-sig form.
+// The HTML frontend stays out of the measured path. At the end it prints
+// calls, errors and latencies per method and format, and exits non-zero
+// when the error ratio exceeds -max-errors.
+//
+// Usage:
+//
+//	loadgen -frontend http://frontend -shipping shippingservice:50051 [-checkout checkoutservice:5050 -cart cartservice:7070] [-users 10] [-duration 1m] [-formats authorization,split]
+//
+// PlaceOrder needs items in the cart; with -cart each order is preceded by
+// an AddItem to the user's cart, otherwise orders are placed with the cart
+// the session already has.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func main() {
+	frontend := flag.String("frontend", "http://localhost:8080", "base URL of the frontend the sessions come from, including any BASE_URL")
+	checkoutAddr := flag.String("checkout", "", "checkoutservice gRPC address; PlaceOrder is skipped when empty")
+	shippingAddr := flag.String("shipping", "", "shippingservice gRPC address; GetQuote is skipped when empty")
+	cartAddr := flag.String("cart", "", "cartservice gRPC address used to fill carts before PlaceOrder")
+	formats := flag.String("formats", formatAuth+","+formatSplit, "comma-separated header formats to alternate between")
+	users := flag.Int("users", 10, "concurrent virtual users")
+	duration := flag.Duration("duration", time.Minute, "how long to run")
+	think := flag.Duration("think", 500*time.Millisecond, "pause of each user between calls")
+	timeout := flag.Duration("timeout", 10*time.Second, "deadline of one call")
+	product := flag.String("product", "OLJCESPC7Z", "product quoted and ordered")
+	maxErrors := flag.Float64("max-errors", 0.01, "error ratio above which loadgen exits non-zero")
+	flag.Parse()
+
+	if *checkoutAddr == "" && *shippingAddr == "" {
+		log.Fatal("nothing to call: set -checkout, -shipping or both")
+	}
+	var fs []string
+	for _, f := range strings.Split(*formats, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case formatAuth, formatSplit:
+			fs = append(fs, f)
+		default:
+			log.Fatalf("unknown format %q, want %s or %s", f, formatAuth, formatSplit)
+		}
+	}
+
+	g := &generator{
+		frontend: strings.TrimSuffix(*frontend, "/"),
+		formats:  fs,
+		think:    *think,
+		timeout:  *timeout,
+		product:  *product,
+		stats:    make(map[statKey]*callStats),
+	}
+	if *shippingAddr != "" {
+		g.shipping = pb.NewShippingServiceClient(dial(*shippingAddr))
+	}
+	if *checkoutAddr != "" {
+		g.checkout = pb.NewCheckoutServiceClient(dial(*checkoutAddr))
+	}
+	if *cartAddr != "" {
+		g.cart = pb.NewCartServiceClient(dial(*cartAddr))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	log.Printf("running %d users against %s for %s", *users, strings.Join(g.targets(), ", "), *duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g.user(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+
+	if ratio := g.report(os.Stdout); ratio > *maxErrors {
+		fmt.Fprintf(os.Stderr, "error ratio %.2f%% exceeds %.2f%%\n", 100*ratio, 100**maxErrors)
+		os.Exit(1)
+	}
+}
+
+func dial(addr string) *grpc.ClientConn {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("dialing %s: %v", addr, err)
+	}
+	return conn
+}
+
+type generator struct {
+	frontend string
+	formats  []string
+	think    time.Duration
+	timeout  time.Duration
+	product  string
+
+	shipping pb.ShippingServiceClient
+	checkout pb.CheckoutServiceClient
+	cart     pb.CartServiceClient
+
+	mu    sync.Mutex
+	stats map[statKey]*callStats
+}
+
+func (g *generator) targets() []string {
+	var t []string
+	if g.shipping != nil {
+		t = append(t, "GetQuote")
+	}
+	if g.checkout != nil {
+		t = append(t, "PlaceOrder")
+	}
+	return t
+}
+
+// user runs one virtual user until ctx ends, taking the formats in turn
+func (g *generator) user(ctx context.Context, n int) {
+	s := newSession(g.frontend, g.timeout)
+	for i := n; ctx.Err() == nil; i++ {
+		format := g.formats[i%len(g.formats)]
+		token, id, err := s.Token(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				g.record("session", format, 0, err)
+				sleep(ctx, g.think)
+			}
+			continue
+		}
+		if g.shipping != nil {
+			g.call(ctx, "GetQuote", token, format, func(ctx context.Context) error {
+				_, err := g.shipping.GetQuote(ctx, &pb.GetQuoteRequest{Address: address, Items: g.items()})
+				return err
+			})
+			sleep(ctx, g.think)
+		}
+		if g.checkout != nil {
+			if g.cart != nil {
+				g.call(ctx, "AddItem", token, format, func(ctx context.Context) error {
+					_, err := g.cart.AddItem(ctx, &pb.AddItemRequest{UserId: id, Item: g.items()[0]})
+					return err
+				})
+			}
+			g.call(ctx, "PlaceOrder", token, format, func(ctx context.Context) error {
+				_, err := g.checkout.PlaceOrder(ctx, &pb.PlaceOrderRequest{
+					UserId: id, UserCurrency: "USD", Address: address, Email: "loadgen@example.com", CreditCard: card})
+				return err
+			})
+			sleep(ctx, g.think)
+		}
+	}
+}
+
+// call runs fn with token attached in format and records the outcome
+func (g *generator) call(ctx context.Context, method, token, format string, fn func(context.Context) error) {
+	md, sent := tokenMetadata(token, format)
+	callCtx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), g.timeout)
+	defer cancel()
+	start := time.Now()
+	err := fn(callCtx)
+	if ctx.Err() != nil {
+		return // the run ended mid-call
+	}
+	g.record(method, sent, time.Since(start), err)
+}
+
+func (g *generator) items() []*pb.CartItem {
+	return []*pb.CartItem{{ProductId: g.product, Quantity: 1}}
+}
+
+var (
+	address = &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043}
+	card    = &pb.CreditCardInfo{CreditCardNumber: "4432801561520454", CreditCardCvv: 672, CreditCardExpirationYear: int32(time.Now().Year() + 1), CreditCardExpirationMonth: 1}
+)
+
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+type statKey struct {
+	method, format string
+}
+
+type callStats struct {
+	calls     int
+	errors    map[string]int
+	latencies []time.Duration
+}
+
+func (g *generator) record(method, format string, d time.Duration, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	k := statKey{method, format}
+	s, ok := g.stats[k]
+	if !ok {
+		s = &callStats{errors: make(map[string]int)}
+		g.stats[k] = s
+	}
+	s.calls++
+	if err != nil {
+		s.errors[status.Code(err).String()]++
+		return
+	}
+	s.latencies = append(s.latencies, d)
+}
+
+// report prints one line per method and format and returns the overall
+// error ratio
+func (g *generator) report(w io.Writer) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([]statKey, 0, len(g.stats))
+	for k := range g.stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].format < keys[j].format
+	})
+	fmt.Fprintf(w, "%-12s %-14s %8s %8s %10s %10s  %s\n", "method", "format", "calls", "errors", "p50", "p99", "error codes")
+	var calls, failed int
+	for _, k := range keys {
+		s := g.stats[k]
+		n := s.calls - len(s.latencies)
+		calls += s.calls
+		failed += n
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		var codes []string
+		for c, n := range s.errors {
+			codes = append(codes, fmt.Sprintf("%s=%d", c, n))
+		}
+		sort.Strings(codes)
+		fmt.Fprintf(w, "%-12s %-14s %8d %8d %10s %10s  %s\n", k.method, k.format, s.calls, n,
+			percentile(s.latencies, 0.5), percentile(s.latencies, 0.99), strings.Join(codes, " "))
+	}
+	if calls == 0 {
+		return 1
+	}
+	return float64(failed) / float64(calls)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))].Round(10 * time.Microsecond)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	jwtCookie     = "shop_jwt"
+	formatAuth    = "authorization"
+	formatSplit   = "split"
+	renewalMargin = 10 * time.Second
+)
+
+// session is one virtual user: a frontend session and the token the
+// frontend issued it, fetched again shortly before it expires
+type session struct {
+	base   string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	id      string
+	expires time.Time
+}
+
+func newSession(base string, timeout time.Duration) *session {
+	jar, _ := cookiejar.New(nil)
+	return &session{base: base, client: &http.Client{Jar: jar, Timeout: timeout}}
+}
+
+// Token returns the session's current token and session ID
+func (s *session) Token(ctx context.Context) (token, id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expires) > renewalMargin {
+		return s.token, s.id, nil
+	}
+	if err := s.fetch(ctx); err != nil {
+		return "", "", err
+	}
+	return s.token, s.id, nil
+}
+
+// fetch loads the home page, which issues a token once the previous one
+// has expired, and reads it from the cookie jar. The page itself may fail
+// when the services behind it aren't running; the cookie is set first.
+func (s *session) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	var token string
+	for _, c := range s.client.Jar.Cookies(req.URL) {
+		if c.Name == jwtCookie {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("GET /: %s without a %s cookie", resp.Status, jwtCookie)
+	}
+	claims, err := payloadClaims(token)
+	if err != nil {
+		return err
+	}
+	if token == s.token {
+		// The frontend still considers it valid; wait out the margin
+		s.expires = time.Now().Add(renewalMargin + time.Second)
+		return nil
+	}
+	s.token, s.id, s.expires = token, claims.SessionID, time.Unix(claims.ExpiresAt, 0)
+	return nil
+}
+
+type tokenClaims struct {
+	SessionID string `json:"session_id"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func payloadClaims(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("token has %d parts", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, err
+	}
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+// tokenMetadata carries token in format: whole in authorization, or as the
+// x-jwt-header, x-jwt-payload and x-jwt-sig headers the frontend sends.
+// A payload that isn't printable can't be a header value and goes whole.
+func tokenMetadata(token, format string) (metadata.MD, string) {
+	parts := strings.Split(token, ".")
+	if format == formatSplit && len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && printable(payload) {
+			return metadata.Pairs("x-jwt-header", parts[0], "x-jwt-payload", string(payload), "x-jwt-sig", parts[2]), formatSplit
+		}
+	}
+	return metadata.Pairs("authorization", "Bearer "+token), formatAuth
+}
+
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+// Command probe is a synthetic monitor for the auth path of a deployed
+// environment. Once per interval it logs in (a fresh session, so a fresh
+// JWT), browses a product, adds it to the cart and checks out, and asserts
+// from the services' wire statistics that the order carried a JWT at every
+// hop: frontend to checkout, into checkout, checkout to shipping and into
+// shipping. The outcome is exported on /metrics in the style of the
+// Prometheus blackbox exporter, for alerting on probe_success.
+//
+// Usage:
+//
+//	probe -frontend http://frontend [-frontend-debug http://frontend:9090] [-checkout-debug http://checkoutservice:9090] [-shipping-debug http://shippingservice:9090] [-interval 1m] [-listen :9115]
+//	probe -frontend http://frontend -once
+//
+// Wire statistics are read from the /debug/grpcstats of each service's debug
+// server; hops of a service whose debug URL is empty are not checked.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	frontend := flag.String("frontend", "http://localhost:8080", "base URL of the frontend, including any BASE_URL")
+	frontendDebug := flag.String("frontend-debug", "", "debug server of the frontend (DEBUG_PORT, reachable with DEBUG_LISTEN_ADDR), e.g. http://frontend:9090")
+	checkoutDebug := flag.String("checkout-debug", "", "debug server of checkoutservice (DEBUG_PORT), e.g. http://checkoutservice:9090")
+	shippingDebug := flag.String("shipping-debug", "", "debug server of shippingservice (DEBUG_PORT), e.g. http://shippingservice:9090")
+	product := flag.String("product", "OLJCESPC7Z", "product browsed and ordered")
+	interval := flag.Duration("interval", time.Minute, "time between probes")
+	timeout := flag.Duration("timeout", 30*time.Second, "deadline of one probe")
+	listen := flag.String("listen", ":9115", "address /metrics is served on")
+	once := flag.Bool("once", false, "run a single probe, print its steps and exit non-zero on failure")
+	flag.Parse()
+
+	p := &prober{
+		frontend: strings.TrimSuffix(*frontend, "/"),
+		product:  *product,
+		hops:     defaultHops(debugURL(*frontendDebug), debugURL(*checkoutDebug), debugURL(*shippingDebug)),
+		timeout:  *timeout,
+	}
+
+	if *once {
+		r := p.run(context.Background())
+		for _, s := range r.steps {
+			fmt.Printf("%-8s %-5v %8s %s\n", s.name, s.ok, s.duration.Round(time.Millisecond), s.err)
+		}
+		for _, h := range r.hops {
+			fmt.Printf("hop %-32s %-5v %s\n", h.name, h.ok, h.err)
+		}
+		if !r.ok() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	m := newProbeMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	go func() {
+		log.Printf("serving probe metrics on %s", *listen)
+		if err := http.ListenAndServe(*listen, mux); err != nil {
+			log.Fatalf("metrics server stopped: %v", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		r := p.run(ctx)
+		m.record(r)
+		if !r.ok() {
+			log.Printf("probe failed: %s", r.failure())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// debugURL points at the wire statistics of a service's debug server
+func debugURL(base string) string {
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/debug/grpcstats"
+}
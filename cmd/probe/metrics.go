@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// probeMetrics exports the last probe and running totals in the Prometheus
+// text format, named after the blackbox exporter's probe_* metrics
+type probeMetrics struct {
+	mu          sync.Mutex
+	last        probeResult
+	runs        int64
+	failures    map[string]int64 // by the step or hop that failed first
+	lastSuccess float64
+}
+
+func newProbeMetrics() *probeMetrics {
+	return &probeMetrics{failures: make(map[string]int64)}
+}
+
+func (m *probeMetrics) record(r probeResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = r
+	m.runs++
+	if r.ok() {
+		m.lastSuccess = float64(r.start.Add(r.duration).UnixMilli()) / 1000
+		return
+	}
+	for _, s := range r.steps {
+		if !s.ok {
+			m.failures["step:"+s.name]++
+			return
+		}
+	}
+	for _, h := range r.hops {
+		if !h.ok {
+			m.failures["hop:"+h.name]++
+			return
+		}
+	}
+}
+
+func (m *probeMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if m.runs == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "# HELP probe_success Whether the last probe logged in, browsed, checked out and saw a JWT at every hop")
+	fmt.Fprintln(w, "# TYPE probe_success gauge")
+	fmt.Fprintf(w, "probe_success %d\n", boolValue(m.last.ok()))
+	fmt.Fprintln(w, "# HELP probe_duration_seconds How long the last probe took")
+	fmt.Fprintln(w, "# TYPE probe_duration_seconds gauge")
+	fmt.Fprintf(w, "probe_duration_seconds %g\n", m.last.duration.Seconds())
+
+	fmt.Fprintln(w, "# HELP probe_step_success Whether a step of the last probe succeeded")
+	fmt.Fprintln(w, "# TYPE probe_step_success gauge")
+	for _, s := range m.last.steps {
+		fmt.Fprintf(w, "probe_step_success{step=%q} %d\n", s.name, boolValue(s.ok))
+	}
+	fmt.Fprintln(w, "# HELP probe_step_duration_seconds How long a step of the last probe took")
+	fmt.Fprintln(w, "# TYPE probe_step_duration_seconds gauge")
+	for _, s := range m.last.steps {
+		fmt.Fprintf(w, "probe_step_duration_seconds{step=%q} %g\n", s.name, s.duration.Seconds())
+	}
+	fmt.Fprintln(w, "# HELP probe_hop_jwt_present Whether the last probe's order carried a JWT on a hop")
+	fmt.Fprintln(w, "# TYPE probe_hop_jwt_present gauge")
+	for _, h := range m.last.hops {
+		fmt.Fprintf(w, "probe_hop_jwt_present{hop=%q} %d\n", h.name, boolValue(h.ok))
+	}
+
+	fmt.Fprintln(w, "# HELP probe_runs_total Probes run")
+	fmt.Fprintln(w, "# TYPE probe_runs_total counter")
+	fmt.Fprintf(w, "probe_runs_total %d\n", m.runs)
+	fmt.Fprintln(w, "# HELP probe_failures_total Failed probes by the step or hop that failed first")
+	fmt.Fprintln(w, "# TYPE probe_failures_total counter")
+	reasons := make([]string, 0, len(m.failures))
+	for reason := range m.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "probe_failures_total{reason=%q} %d\n", reason, m.failures[reason])
+	}
+	if m.lastSuccess > 0 {
+		fmt.Fprintln(w, "# HELP probe_last_success_timestamp_seconds When the last successful probe finished")
+		fmt.Fprintln(w, "# TYPE probe_last_success_timestamp_seconds gauge")
+		fmt.Fprintf(w, "probe_last_success_timestamp_seconds %g\n", m.lastSuccess)
+	}
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	jwtCookie = "shop_jwt"
+	jwtNone   = "none" // jwt_mode of RPCs that carried no JWT
+
+	placeOrder = "/hipstershop.CheckoutService/PlaceOrder"
+	shipOrder  = "/hipstershop.ShippingService/ShipOrder"
+)
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// hop is one leg of the checkout the JWT has to reach, read from the wire
+// statistics of the service on one end of it
+type hop struct {
+	name   string
+	url    string // the service's grpcstats endpoint
+	side   string // client or server
+	method string
+}
+
+func defaultHops(frontendDebug, checkoutDebug, shippingDebug string) []hop {
+	var hops []hop
+	if frontendDebug != "" {
+		hops = append(hops, hop{name: "frontend->checkoutservice", url: frontendDebug, side: "client", method: placeOrder})
+	}
+	if checkoutDebug != "" {
+		hops = append(hops,
+			hop{name: "checkoutservice", url: checkoutDebug, side: "server", method: placeOrder},
+			hop{name: "checkoutservice->shippingservice", url: checkoutDebug, side: "client", method: shipOrder})
+	}
+	if shippingDebug != "" {
+		hops = append(hops, hop{name: "shippingservice", url: shippingDebug, side: "server", method: shipOrder})
+	}
+	return hops
+}
+
+// wireStat is the part of an entry of /debug/grpcstats the probe reads
+type wireStat struct {
+	Side    string `json:"side"`
+	Method  string `json:"method"`
+	JWTMode string `json:"jwt_mode"`
+	Calls   int64  `json:"calls"`
+}
+
+// calls counts the calls of a hop with and without a JWT
+func (h hop) calls(stats []wireStat) (withJWT, without int64) {
+	for _, s := range stats {
+		if s.Side != h.side || s.Method != h.method {
+			continue
+		}
+		if s.JWTMode == jwtNone {
+			without += s.Calls
+		} else {
+			withJWT += s.Calls
+		}
+	}
+	return withJWT, without
+}
+
+type stepResult struct {
+	name     string
+	ok       bool
+	duration time.Duration
+	err      error
+}
+
+type hopResult struct {
+	name string
+	ok   bool
+	err  error
+}
+
+type probeResult struct {
+	start    time.Time
+	duration time.Duration
+	steps    []stepResult
+	hops     []hopResult
+}
+
+func (r probeResult) ok() bool {
+	return r.failure() == ""
+}
+
+// failure describes the first failed step or hop, empty when all passed
+func (r probeResult) failure() string {
+	for _, s := range r.steps {
+		if !s.ok {
+			return fmt.Sprintf("step %s: %v", s.name, s.err)
+		}
+	}
+	for _, h := range r.hops {
+		if !h.ok {
+			return fmt.Sprintf("hop %s: %v", h.name, h.err)
+		}
+	}
+	return ""
+}
+
+type prober struct {
+	frontend string
+	product  string
+	hops     []hop
+	timeout  time.Duration
+}
+
+// run performs one scripted session. The hops are checked only once the
+// order went through, against statistics taken before the session started;
+// other traffic may add JWT calls, but a call without one fails the hop.
+func (p *prober) run(ctx context.Context) (r probeResult) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	r = probeResult{start: time.Now()}
+	defer func() { r.duration = time.Since(r.start) }()
+
+	stats := &http.Client{Timeout: p.timeout}
+	before := make(map[string][]wireStat)
+	beforeErr := make(map[string]error)
+	for _, h := range p.hops {
+		if _, ok := before[h.url]; !ok && beforeErr[h.url] == nil {
+			before[h.url], beforeErr[h.url] = fetchStats(ctx, stats, h.url)
+		}
+	}
+
+	jar, _ := cookiejar.New(nil)
+	s := &session{base: p.frontend, client: &http.Client{Jar: jar, Timeout: p.timeout}}
+	steps := []struct {
+		name string
+		fn   func(context.Context) error
+	}{
+		{"login", s.login},
+		{"browse", func(ctx context.Context) error { return s.browse(ctx, p.product) }},
+		{"checkout", s.checkout},
+	}
+	for _, step := range steps {
+		start := time.Now()
+		err := step.fn(ctx)
+		r.steps = append(r.steps, stepResult{name: step.name, ok: err == nil, duration: time.Since(start), err: err})
+		if err != nil {
+			return r
+		}
+	}
+
+	after := make(map[string][]wireStat)
+	afterErr := make(map[string]error)
+	for _, h := range p.hops {
+		res := hopResult{name: h.name}
+		if _, ok := after[h.url]; !ok && afterErr[h.url] == nil {
+			after[h.url], afterErr[h.url] = fetchStats(ctx, stats, h.url)
+		}
+		switch {
+		case beforeErr[h.url] != nil:
+			res.err = beforeErr[h.url]
+		case afterErr[h.url] != nil:
+			res.err = afterErr[h.url]
+		default:
+			jwt0, none0 := h.calls(before[h.url])
+			jwt1, none1 := h.calls(after[h.url])
+			if none1 > none0 {
+				res.err = fmt.Errorf("%d %s calls without a JWT", none1-none0, h.method)
+			} else if jwt1 == jwt0 {
+				res.err = fmt.Errorf("no %s call with a JWT", h.method)
+			}
+		}
+		res.ok = res.err == nil
+		r.hops = append(r.hops, res)
+	}
+	return r
+}
+
+func fetchStats(ctx context.Context, client *http.Client, u string) ([]wireStat, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	var stats []wireStat
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	return stats, nil
+}
+
+// session is one shopper, holding the session and JWT cookies
+type session struct {
+	base   string
+	client *http.Client
+}
+
+// login opens a session; the frontend issues its JWT with the first page
+func (s *session) login(ctx context.Context) error {
+	if _, err := s.do(ctx, http.MethodGet, "/", nil); err != nil {
+		return err
+	}
+	u, _ := url.Parse(s.base + "/")
+	for _, c := range s.client.Jar.Cookies(u) {
+		if c.Name == jwtCookie && c.Value != "" {
+			return nil
+		}
+	}
+	return errors.New("no " + jwtCookie + " cookie issued")
+}
+
+func (s *session) browse(ctx context.Context, product string) error {
+	page, err := s.do(ctx, http.MethodGet, "/product/"+product, nil)
+	if err != nil {
+		return err
+	}
+	m := csrfField.FindStringSubmatch(page)
+	if m == nil {
+		return errors.New("no CSRF token on the product page")
+	}
+	_, err = s.do(ctx, http.MethodPost, "/cart", url.Values{"csrf_token": {m[1]}, "product_id": {product}, "quantity": {"1"}})
+	return err
+}
+
+func (s *session) checkout(ctx context.Context) error {
+	cart, err := s.do(ctx, http.MethodGet, "/cart", nil)
+	if err != nil {
+		return err
+	}
+	m := csrfField.FindStringSubmatch(cart)
+	if m == nil {
+		return errors.New("no CSRF token on the cart page")
+	}
+	order, err := s.do(ctx, http.MethodPost, "/cart/checkout", url.Values{
+		"csrf_token":                   {m[1]},
+		"email":                        {"probe@example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"94043"},
+		"city":                         {"Mountain View"},
+		"state":                        {"CA"},
+		"country":                      {"United States"},
+		"credit_card_number":           {"4432801561520454"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {fmt.Sprint(time.Now().Year() + 2)},
+		"credit_card_cvv":              {"672"},
+	})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(order, "Confirmation #") {
+		return errors.New("order page without a confirmation")
+	}
+	return nil
+}
+
+// do sends a request and returns the body of a 200 response
+func (s *session) do(ctx context.Context, method, path string, form url.Values) (string, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.base+path, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "jwt-split-probe")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return string(b), nil
+}
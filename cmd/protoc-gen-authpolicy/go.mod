@@ -0,0 +1,5 @@
+module github.com/GoogleCloudPlatform/microservices-demo/cmd/protoc-gen-authpolicy
+
+go 1.23.0
+
+require google.golang.org/protobuf v1.36.4
@@ -0,0 +1,3 @@
+module github.com/GoogleCloudPlatform/microservices-demo/cmd/soak
+
+go 1.23.0
@@ -0,0 +1,124 @@
+// Command soak drives millions of distinct synthetic sessions through the
+// JWT middlewares and interceptors of the frontend, checkout and shipping
+// services, in process, and fails when a cache outgrows its bound or the
+// heap keeps growing once the caches are full. It runs each service's
+// TestSoak (built with the soak tag) and leaves heap profiles taken when
+// the caches had filled and at the end, to compare with
+//
+//	go tool pprof -base heap-saturated.pb.gz heap-final.pb.gz
+//
+// Usage:
+//
+//	soak [-sessions 2000000] [-services frontend,checkout,shipping] [-profiles soak-profiles] [-workers N] [-root <repo>]
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var serviceDirs = map[string]string{
+	"frontend": "frontend",
+	"checkout": "checkoutservice",
+	"shipping": "shippingservice",
+}
+
+func main() {
+	sessions := flag.Int("sessions", 2000000, "distinct sessions to drive through each service")
+	services := flag.String("services", "frontend,checkout,shipping", "comma-separated services to soak")
+	profiles := flag.String("profiles", "soak-profiles", "directory for heap profiles, one subdirectory per service")
+	workers := flag.Int("workers", 0, "sessions driven concurrently (default GOMAXPROCS)")
+	root := flag.String("root", "", "repository root (default: found from the working directory)")
+	flag.Parse()
+
+	if *root == "" {
+		var err error
+		if *root, err = findRoot(); err != nil {
+			fatal(err)
+		}
+	}
+	profileDir, err := filepath.Abs(*profiles)
+	if err != nil {
+		fatal(err)
+	}
+
+	var failed []string
+	for _, svc := range strings.Split(*services, ",") {
+		svc = strings.TrimSpace(svc)
+		dir, ok := serviceDirs[svc]
+		if !ok {
+			fatal(fmt.Errorf("unknown service %q", svc))
+		}
+		args := []string{"test", "-tags", "soak", "-run", "^TestSoak$", "-count=1", "-timeout", "0", "-v", ".",
+			"-args", "-soak.sessions=" + strconv.Itoa(*sessions), "-soak.profiles=" + filepath.Join(profileDir, svc)}
+		if *workers > 0 {
+			args = append(args, "-soak.workers="+strconv.Itoa(*workers))
+		}
+		start := time.Now()
+		if err := run(filepath.Join(*root, "src", dir), svc, args); err != nil {
+			fmt.Printf("%s: FAIL after %s: %v\n", svc, time.Since(start).Round(time.Second), err)
+			failed = append(failed, svc)
+			continue
+		}
+		fmt.Printf("%s: ok after %s\n", svc, time.Since(start).Round(time.Second))
+	}
+	if len(failed) > 0 {
+		fmt.Printf("soak failed: %s\n", strings.Join(failed, ", "))
+		os.Exit(1)
+	}
+}
+
+// run runs go with args in dir, streaming its output prefixed with svc
+func run(dir, svc string, args []string) error {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	prefix(os.Stdout, out, svc)
+	return cmd.Wait()
+}
+
+func prefix(w io.Writer, r io.Reader, svc string) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fmt.Fprintf(w, "[%s] %s\n", svc, s.Text())
+	}
+}
+
+// findRoot walks up from the working directory to the repository root
+func findRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "src", "frontend", "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("repository root not found, pass -root")
+		}
+		dir = parent
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "soak: %v\n", err)
+	os.Exit(2)
+}
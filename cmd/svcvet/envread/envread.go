@@ -0,0 +1,272 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package envread reports environment reads on a service's request path.
+// Configuration is read while the process starts, in init, main, the
+// initializers of package-level variables and the functions they call, and
+// kept from then on. A read anywhere else lets a setting change meaning
+// halfway through a process's life and hides a knob from config validation.
+//
+// Only package main is checked: library packages such as keyring expose
+// FromEnv constructors and leave it to the service when to call them.
+package envread
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name: "envread",
+	Doc:  "report os.Getenv, os.LookupEnv and os.Environ reachable from outside startup code in package main",
+	Run:  run,
+}
+
+var envFuncs = map[string]bool{"Getenv": true, "LookupEnv": true, "Environ": true}
+
+// funcInfo is what run needs to know about one function of the package
+type funcInfo struct {
+	decl  *ast.FuncDecl
+	calls []*types.Func // functions of this package called directly
+	reads []*ast.CallExpr
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	if pass.Pkg.Name() != "main" {
+		return nil, nil
+	}
+	funcs := make(map[*types.Func]*funcInfo)
+	var roots []*types.Func
+	var values []*types.Func // functions used other than by a direct call
+	var litReads []*ast.CallExpr
+
+	local := func(call *ast.CallExpr) *types.Func {
+		fn := typeutil.StaticCallee(pass.TypesInfo, call)
+		if fn == nil || fn.Pkg() != pass.Pkg {
+			return nil
+		}
+		return fn
+	}
+	// scan records what body calls and reads, and which functions it
+	// refers to without calling. info is nil for package-level
+	// initializers, which run once at startup. Function literals run
+	// whenever whoever holds them decides to, so what they call and read
+	// is never startup work, unless body only ever calls them itself.
+	var scan func(body ast.Node, info *funcInfo, lit bool)
+	scan = func(body ast.Node, info *funcInfo, lit bool) {
+		called := make(map[*ast.Ident]bool)
+		inline := localCalls(pass, body)
+		ast.Inspect(body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				if inline[n] {
+					return true
+				}
+				scan(n.Body, nil, true)
+				return false
+			case *ast.CallExpr:
+				if isEnvRead(pass, n) {
+					switch {
+					case lit:
+						litReads = append(litReads, n)
+					case info != nil:
+						info.reads = append(info.reads, n)
+					}
+				}
+				if fn := local(n); fn != nil {
+					called[calleeIdent(n.Fun)] = true
+					switch {
+					case lit:
+						values = append(values, fn)
+					case info != nil:
+						info.calls = append(info.calls, fn)
+					default:
+						roots = append(roots, fn)
+					}
+				}
+			case *ast.Ident:
+				if fn, ok := pass.TypesInfo.Uses[n].(*types.Func); ok && fn.Pkg() == pass.Pkg && !called[n] {
+					values = append(values, fn)
+				}
+			}
+			return true
+		})
+	}
+
+	for _, f := range pass.Files {
+		if strings.HasSuffix(pass.Fset.Position(f.Pos()).Filename, "_test.go") {
+			continue
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				scan(d, nil, false)
+			case *ast.FuncDecl:
+				if d.Body == nil || configSource(d) {
+					continue
+				}
+				fn, _ := pass.TypesInfo.Defs[d.Name].(*types.Func)
+				if fn == nil {
+					continue
+				}
+				info := &funcInfo{decl: d}
+				funcs[fn] = info
+				scan(d.Body, info, false)
+				if d.Recv == nil && (d.Name.Name == "init" || d.Name.Name == "main") {
+					roots = append(roots, fn)
+				}
+			}
+		}
+	}
+
+	// startup holds every function reachable from the roots by direct calls
+	startup := make(map[*types.Func]bool)
+	var visit func(*types.Func)
+	visit = func(fn *types.Func) {
+		if startup[fn] {
+			return
+		}
+		startup[fn] = true
+		if info := funcs[fn]; info != nil {
+			for _, c := range info.calls {
+				visit(c)
+			}
+		}
+	}
+	for _, fn := range roots {
+		visit(fn)
+	}
+
+	// anything else that runs, runs on behalf of a request: functions no
+	// startup code calls, and functions handed out as values
+	request := make(map[*types.Func]bool)
+	var mark func(*types.Func)
+	mark = func(fn *types.Func) {
+		if request[fn] {
+			return
+		}
+		request[fn] = true
+		if info := funcs[fn]; info != nil {
+			for _, c := range info.calls {
+				mark(c)
+			}
+		}
+	}
+	for fn := range funcs {
+		if !startup[fn] {
+			mark(fn)
+		}
+	}
+	for _, fn := range values {
+		mark(fn)
+	}
+
+	for fn, info := range funcs {
+		if !request[fn] {
+			continue
+		}
+		for _, call := range info.reads {
+			pass.Reportf(call.Pos(), "%s in %s runs outside startup; read it once at startup and keep the value",
+				types.ExprString(call.Fun), fn.Name())
+		}
+	}
+	for _, call := range litReads {
+		pass.Reportf(call.Pos(), "%s in a function literal runs outside startup; read it once at startup and keep the value",
+			types.ExprString(call.Fun))
+	}
+	return nil, nil
+}
+
+// configSource reports whether fn carries the //svcvet:config directive,
+// which marks the function a package reads all of its settings through
+func configSource(fn *ast.FuncDecl) bool {
+	if fn.Doc == nil {
+		return false
+	}
+	for _, c := range fn.Doc.List {
+		if c.Text == "//svcvet:config" {
+			return true
+		}
+	}
+	return false
+}
+
+// localCalls returns the function literals in body that body only calls
+// itself: ones called where they are written, and ones bound to a local
+// variable that is only ever called
+func localCalls(pass *analysis.Pass, body ast.Node) map[*ast.FuncLit]bool {
+	bound := make(map[types.Object]*ast.FuncLit)
+	calls := make(map[*ast.Ident]bool)
+	inline := make(map[*ast.FuncLit]bool)
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n.Tok != token.DEFINE || len(n.Lhs) != len(n.Rhs) {
+				break
+			}
+			for i, rhs := range n.Rhs {
+				lit, ok := rhs.(*ast.FuncLit)
+				id, isIdent := n.Lhs[i].(*ast.Ident)
+				if ok && isIdent {
+					if obj := pass.TypesInfo.Defs[id]; obj != nil {
+						bound[obj] = lit
+					}
+				}
+			}
+		case *ast.CallExpr:
+			switch fun := ast.Unparen(n.Fun).(type) {
+			case *ast.FuncLit:
+				inline[fun] = true
+			case *ast.Ident:
+				calls[fun] = true
+			}
+		}
+		return true
+	})
+	escaped := make(map[types.Object]bool)
+	for id, obj := range pass.TypesInfo.Uses {
+		if _, ok := bound[obj]; ok && !calls[id] && id.Pos() >= body.Pos() && id.End() <= body.End() {
+			escaped[obj] = true
+		}
+	}
+	for obj, lit := range bound {
+		if !escaped[obj] {
+			inline[lit] = true
+		}
+	}
+	return inline
+}
+
+func isEnvRead(pass *analysis.Pass, call *ast.CallExpr) bool {
+	fn := typeutil.StaticCallee(pass.TypesInfo, call)
+	return fn != nil && fn.Pkg() != nil && fn.Pkg().Path() == "os" && envFuncs[fn.Name()]
+}
+
+// calleeIdent returns the identifier naming the function in a call
+func calleeIdent(fun ast.Expr) *ast.Ident {
+	switch f := ast.Unparen(fun).(type) {
+	case *ast.Ident:
+		return f
+	case *ast.SelectorExpr:
+		return f.Sel
+	case *ast.IndexExpr:
+		return calleeIdent(f.X)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+var port = os.Getenv("PORT")
+
+var timeout = loadTimeout()
+
+func loadTimeout() string {
+	return os.Getenv("TIMEOUT")
+}
+
+func init() {
+	_ = os.Getenv("INIT")
+}
+
+func main() {
+	_ = helper()
+	intEnv := func(key string) string { return os.Getenv(key) }
+	_ = intEnv("LIMIT")
+	http.HandleFunc("/", handle)
+	http.HandleFunc("/lit", func(http.ResponseWriter, *http.Request) {
+		_ = os.Getenv("LIT") // want `os.Getenv in a function literal runs outside startup`
+	})
+}
+
+// helper is called from main and from handle, so it runs per request too
+func helper() string {
+	return os.Getenv("HELPER") // want `os.Getenv in helper runs outside startup`
+}
+
+func handle(http.ResponseWriter, *http.Request) {
+	_ = helper()
+	_, _ = os.LookupEnv("HANDLE") // want `os.LookupEnv in handle runs outside startup`
+}
+
+// lookup is the package's configuration source
+//
+//svcvet:config
+func lookup(name string) string {
+	return os.Getenv(name)
+}
+
+func handleConfig(http.ResponseWriter, *http.Request) {
+	_ = lookup("X")
+}
+
+var _ = handleConfig
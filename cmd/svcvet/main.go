@@ -0,0 +1,22 @@
+// Command svcvet is a go vet tool with the repo's own checks for service
+// code: envread, which keeps environment reads at startup, and mdindex, which
+// reports unchecked indexing of gRPC metadata values. Run it from a service
+// directory, on its own or through go vet:
+//
+//	svcvet ./...
+//	go vet -vettool=$(which svcvet) ./...
+//
+// TestServices runs it over every Go service, so a new violation fails the
+// tests of this module.
+package main
+
+import (
+	"golang.org/x/tools/go/analysis/multichecker"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/cmd/svcvet/envread"
+	"github.com/GoogleCloudPlatform/microservices-demo/cmd/svcvet/mdindex"
+)
+
+func main() {
+	multichecker.Main(envread.Analyzer, mdindex.Analyzer)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/checker"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/cmd/svcvet/envread"
+	"github.com/GoogleCloudPlatform/microservices-demo/cmd/svcvet/mdindex"
+)
+
+// services are the Go services that carry the JWT. productcatalogservice is
+// left out: it reloads its catalog per request on purpose, to demo a bug.
+var services = []string{"frontend", "checkoutservice", "shippingservice", "orderhistoryservice"}
+
+// TestServices fails on any finding in the services' own code
+func TestServices(t *testing.T) {
+	if testing.Short() {
+		t.Skip("loads every service")
+	}
+	for _, svc := range services {
+		t.Run(svc, func(t *testing.T) {
+			cfg := &packages.Config{Mode: packages.LoadAllSyntax, Dir: filepath.Join("..", "..", "src", svc)}
+			pkgs, err := packages.Load(cfg, "./...")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packages.PrintErrors(pkgs) > 0 {
+				t.Fatal("packages failed to load")
+			}
+			graph, err := checker.Analyze([]*analysis.Analyzer{envread.Analyzer, mdindex.Analyzer}, pkgs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for act := range graph.All() {
+				if act.Err != nil {
+					t.Errorf("%s: %v", act, act.Err)
+				}
+				for _, d := range act.Diagnostics {
+					t.Errorf("%s: %s", act.Package.Fset.Position(d.Pos), d.Message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mdindex reports indexing the result of metadata.MD.Get, or of
+// indexing an MD directly, without a length check. A missing header then
+// panics the handler instead of failing the request, and a caller controls
+// which headers are missing.
+package mdindex
+
+import (
+	"go/ast"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+const metadataPath = "google.golang.org/grpc/metadata"
+
+var Analyzer = &analysis.Analyzer{
+	Name: "mdindex",
+	Doc:  "report md.Get(key)[i] and md[key][i] on gRPC metadata",
+	Run:  run,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	for _, f := range pass.Files {
+		if strings.HasSuffix(pass.Fset.Position(f.Pos()).Filename, "_test.go") {
+			continue
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			idx, ok := n.(*ast.IndexExpr)
+			if !ok {
+				return true
+			}
+			switch x := ast.Unparen(idx.X).(type) {
+			case *ast.CallExpr:
+				if fn := typeutil.StaticCallee(pass.TypesInfo, x); fn != nil && fn.Name() == "Get" && isMD(recvType(fn)) {
+					pass.Reportf(idx.Pos(), "indexing %s panics when the key is absent; check its length first", types.ExprString(x))
+				}
+			case *ast.IndexExpr:
+				if isMD(pass.TypesInfo.TypeOf(x.X)) {
+					pass.Reportf(idx.Pos(), "indexing %s panics when the key is absent; check its length first", types.ExprString(x))
+				}
+			}
+			return true
+		})
+	}
+	return nil, nil
+}
+
+func recvType(fn *types.Func) types.Type {
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return nil
+	}
+	return sig.Recv().Type()
+}
+
+// isMD reports whether t is metadata.MD or a pointer to it
+func isMD(t types.Type) bool {
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Name() == "MD" && obj.Pkg() != nil && filepath.ToSlash(obj.Pkg().Path()) == metadataPath
+}
@@ -0,0 +1,19 @@
+package a
+
+import "google.golang.org/grpc/metadata"
+
+type headers map[string][]string
+
+func (h headers) Get(k string) []string { return h[k] }
+
+func f(md metadata.MD, pmd *metadata.MD, h headers) string {
+	_ = md.Get("authorization")[0] // want `indexing md.Get\("authorization"\) panics when the key is absent`
+	_ = (md.Get("x"))[1]           // want `indexing md.Get\("x"\) panics`
+	_ = md["x-jwt-sig"][0]         // want `indexing md\["x-jwt-sig"\] panics`
+	_ = pmd.Get("x")[0]            // want `indexing pmd.Get\("x"\) panics`
+	_ = h.Get("x")[0]
+	if v := md.Get("x-jwt-header"); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
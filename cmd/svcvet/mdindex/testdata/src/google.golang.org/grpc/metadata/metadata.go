@@ -0,0 +1,6 @@
+// Package metadata is the part of grpc's metadata package the tests use
+package metadata
+
+type MD map[string][]string
+
+func (md MD) Get(k string) []string { return md[k] }
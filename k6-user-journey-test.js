@@ -92,6 +92,13 @@ function extractCookies(response) {
   return cookies;
 }
 
+// Form posts are CSRF protected; the token is rendered into every page and
+// stays the same for the whole session
+function extractCSRFToken(response) {
+  const match = /name="csrf_token" value="([^"]*)"/.exec(response.body || '');
+  return match ? match[1] : '';
+}
+
 function buildCookieHeader(cookies) {
   return Object.entries(cookies)
     .map(([key, value]) => `${key}=${value}`)
@@ -109,6 +116,7 @@ export function warmupTest() {
   // Homepage visit
   let response = http.get(BASE_URL, { tags: { scenario: 'warmup' } });
   Object.assign(userCookies, extractCookies(response));
+  const csrfToken = extractCSRFToken(response);
   
   if (Object.keys(userCookies).length > 0) {
     const jwt = userCookies['shop_jwt'];
@@ -120,6 +128,7 @@ export function warmupTest() {
   // Cart add to prime cart service connection
   if (Object.keys(userCookies).length > 0) {
     response = http.post(`${BASE_URL}/cart`, {
+      csrf_token: csrfToken,
       product_id: PRODUCT_1,
       quantity: '1',
     }, {
@@ -154,6 +163,7 @@ export function mainTest() {
   });
   
   Object.assign(userCookies, extractCookies(response));
+  const csrfToken = extractCSRFToken(response);
   
   if (Object.keys(userCookies).length > 0) {
     jwtRenewals.add(1);
@@ -169,6 +179,7 @@ export function mainTest() {
   response = http.post(
     `${BASE_URL}/cart`,
     {
+      csrf_token: csrfToken,
       product_id: PRODUCT_1,
       quantity: '1',
     },
@@ -192,6 +203,7 @@ export function mainTest() {
   response = http.post(
     `${BASE_URL}/cart`,
     {
+      csrf_token: csrfToken,
       product_id: PRODUCT_2,
       quantity: '2',
     },
@@ -275,6 +287,7 @@ export function mainTest() {
   response = http.post(
     `${BASE_URL}/cart`,
     {
+      csrf_token: csrfToken,
       product_id: PRODUCT_3,
       quantity: '1',
     },
@@ -297,9 +310,18 @@ export function mainTest() {
   // ========================================
   // PHASE 6: Place order
   // ========================================
+  response = http.get(`${BASE_URL}/cart`, {
+    headers: {
+      'Cookie': buildCookieHeader(userCookies),
+    },
+    tags: { phase: 'view_cart', jwt_state: 'second_jwt' }
+  });
+  Object.assign(userCookies, extractCookies(response));
+
   response = http.post(
     `${BASE_URL}/cart/checkout`,
     {
+      csrf_token: csrfToken,
       email: `user${__VU}@example.com`,
       street_address: '123 Main St',
       zip_code: '12345',
@@ -0,0 +1,54 @@
+package orderevents
+
+import (
+	"context"
+	"errors"
+	"expvar"
+)
+
+// consumerStats counts handled events and rejections by reason
+var consumerStats = expvar.NewMap("order_event_consumer")
+
+// HandlerFunc processes a verified event
+type HandlerFunc func(ctx context.Context, event *Event) error
+
+// Handler returns a function that verifies a message body and passes the
+// event to next. Verification errors are returned as is, so a consumer can
+// drop (ErrSignature, ErrExpired) or redeliver later (ErrUnknownKey, the
+// new key may not have reached it yet).
+func (v *Verifier) Handler(next HandlerFunc) func(ctx context.Context, body []byte) error {
+	return func(ctx context.Context, body []byte) error {
+		event, err := v.Verify(body)
+		if err != nil {
+			consumerStats.Add(rejectReason(err), 1)
+			return err
+		}
+		if err := next(ctx, event); err != nil {
+			consumerStats.Add("failed", 1)
+			return err
+		}
+		consumerStats.Add("handled", 1)
+		return nil
+	}
+}
+
+// Retryable reports whether err may go away on redelivery
+func Retryable(err error) bool {
+	return errors.Is(err, ErrUnknownKey) || !(errors.Is(err, ErrMalformed) ||
+		errors.Is(err, ErrSignature) || errors.Is(err, ErrExpired) || errors.Is(err, ErrUnknownType))
+}
+
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownKey):
+		return "unknown_key"
+	case errors.Is(err, ErrSignature):
+		return "bad_signature"
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	case errors.Is(err, ErrUnknownType):
+		return "unknown_type"
+	default:
+		return "malformed"
+	}
+}
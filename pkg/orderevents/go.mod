@@ -0,0 +1,3 @@
+module github.com/GoogleCloudPlatform/microservices-demo/pkg/orderevents
+
+go 1.23.0
@@ -0,0 +1,169 @@
+// Package orderevents is the consumer side of the OrderPlaced events
+// checkoutservice publishes with ORDER_EVENTS_NATS_URL. Consumers run long
+// after the user token has expired and never see it; what they get instead
+// is an identity envelope, the subject, issuer and tenant checkout verified,
+// inside an event signed as a compact JWS (HS256 with ORDER_EVENTS_KEY, kid
+// naming the key). A Verifier checks that signature and the event's expiry
+// before anything trusts the identity:
+//
+//	v, err := orderevents.NewVerifier(strings.Split(os.Getenv("ORDER_EVENTS_KEYS"), ",")...)
+//	...
+//	handle := v.Handler(func(ctx context.Context, e *orderevents.Event) error {
+//		return credit(ctx, e.Identity.Subject, e.Total)
+//	})
+//	nc.Subscribe("hipstershop.orders.placed", func(m *nats.Msg) { handle(context.Background(), m.Data) })
+//
+// The package only needs the message body, so it works with any transport.
+package orderevents
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OrderPlacedType is the type of the events checkout publishes
+const OrderPlacedType = "hipstershop.order.placed"
+
+// Errors Verify wraps, so consumers can tell a rotation gap (ErrUnknownKey)
+// from a forgery (ErrSignature) or a late redelivery (ErrExpired)
+var (
+	ErrMalformed   = errors.New("malformed order event")
+	ErrUnknownKey  = errors.New("unknown order event key")
+	ErrSignature   = errors.New("order event signature does not match")
+	ErrExpired     = errors.New("order event expired")
+	ErrUnknownType = errors.New("unexpected order event type")
+)
+
+// Identity is the verified identity an event was produced for
+type Identity struct {
+	Subject string `json:"sub"`
+	Issuer  string `json:"iss"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+// Money mirrors hipstershop.Money
+type Money struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+}
+
+// Event is the signed payload of an OrderPlaced message
+type Event struct {
+	Type               string   `json:"type"`
+	ID                 string   `json:"id"`
+	OccurredAt         int64    `json:"occurred_at"`
+	ExpiresAt          int64    `json:"exp"`
+	Identity           Identity `json:"identity"`
+	OrderID            string   `json:"order_id"`
+	ShippingTrackingID string   `json:"shipping_tracking_id"`
+	Items              int      `json:"items"`
+	Total              Money    `json:"total"`
+}
+
+// KeyID names key the way checkout does: hex of the first 4 bytes of its
+// SHA-256
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Verifier checks order events against a set of keys
+type Verifier struct {
+	// Keys maps key IDs to keys; holding the old and the new key lets a
+	// consumer ride through a rotation
+	Keys map[string][]byte
+	// Leeway tolerates clock skew between checkout and the consumer
+	Leeway time.Duration
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+// NewVerifier returns a Verifier for keys, ignoring empty ones. Keys must be
+// at least 32 bytes, as checkout requires.
+func NewVerifier(keys ...string) (*Verifier, error) {
+	v := &Verifier{Keys: map[string][]byte{}, Leeway: 30 * time.Second}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if len(k) < 32 {
+			return nil, fmt.Errorf("order event key %s is shorter than the 32 bytes HS256 needs", KeyID([]byte(k)))
+		}
+		v.Keys[KeyID([]byte(k))] = []byte(k)
+	}
+	if len(v.Keys) == 0 {
+		return nil, errors.New("no order event keys")
+	}
+	return v, nil
+}
+
+// Verify checks body's signature with the key its kid names, decodes the
+// event and rejects it once expired
+func (v *Verifier) Verify(body []byte) (*Event, error) {
+	parts := strings.Split(string(body), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", ErrMalformed)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformed, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformed, err)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: signing method %q", ErrMalformed, header.Alg)
+	}
+	key, ok := v.Keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrMalformed, err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrMalformed, err)
+	}
+	event := &Event{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrMalformed, err)
+	}
+	if event.Type != OrderPlacedType {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, event.Type)
+	}
+	if event.Identity.Subject == "" || event.Identity.Issuer == "" {
+		return nil, fmt.Errorf("%w: event %s has no identity", ErrMalformed, event.ID)
+	}
+	// Events signed before checkout set exp have none and are never accepted
+	if event.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: event %s has no exp", ErrExpired, event.ID)
+	}
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	if now().Add(-v.Leeway).Unix() >= event.ExpiresAt {
+		return nil, fmt.Errorf("%w: event %s expired at %s", ErrExpired, event.ID, time.Unix(event.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return event, nil
+}
@@ -0,0 +1,102 @@
+package orderevents
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign encodes event the way checkoutservice's signOrderEvent does
+func sign(key []byte, event *Event) []byte {
+	payload, _ := json.Marshal(event)
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":"HS256","typ":"order-event+jws","kid":"%s"}`, KeyID(key)))) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return []byte(signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// TestVerify checks that a consumer holding the old and the new key accepts
+// events signed with either, and rejects forged, expired and unknown-key
+// events with errors that say whether a redelivery could help.
+func TestVerify(t *testing.T) {
+	oldKey, newKey := strings.Repeat("o", 32), strings.Repeat("n", 32)
+	if _, err := NewVerifier("short"); err == nil {
+		t.Fatal("accepted a key shorter than 32 bytes")
+	}
+	v, err := NewVerifier(oldKey, " "+newKey+" ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	v.Now = func() time.Time { return now }
+
+	event := &Event{
+		Type: OrderPlacedType, ID: "o-1", OrderID: "o-1",
+		OccurredAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(),
+		Identity: Identity{Subject: "urn:hipstershop:user:s1", Issuer: "https://auth.hipstershop.com", Tenant: "DE"},
+		Items:    3, Total: Money{CurrencyCode: "EUR", Units: 12},
+	}
+	for _, key := range []string{oldKey, newKey} {
+		got, err := v.Verify(sign([]byte(key), event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != *event {
+			t.Errorf("got %+v, want %+v", got, event)
+		}
+	}
+
+	expired := *event
+	expired.ExpiresAt = now.Add(-time.Minute).Unix()
+	noExp := *event
+	noExp.ExpiresAt = 0
+	forged := *event
+	forged.Identity.Subject = "urn:hipstershop:user:s2"
+	good := strings.Split(string(sign([]byte(newKey), event)), ".")
+	swapped := good[0] + "." + strings.Split(string(sign([]byte(newKey), &forged)), ".")[1] + "." + good[2]
+	for name, tc := range map[string]struct {
+		body      []byte
+		want      error
+		retryable bool
+	}{
+		"expired":         {sign([]byte(newKey), &expired), ErrExpired, false},
+		"no exp":          {sign([]byte(newKey), &noExp), ErrExpired, false},
+		"payload swapped": {[]byte(swapped), ErrSignature, false},
+		"unknown key":     {sign([]byte(strings.Repeat("x", 32)), event), ErrUnknownKey, true},
+		"not a JWS":       {[]byte("o-1"), ErrMalformed, false},
+	} {
+		_, err := v.Verify(tc.body)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+		if Retryable(err) != tc.retryable {
+			t.Errorf("%s: Retryable = %v", name, !tc.retryable)
+		}
+	}
+
+	// Within the leeway an event that just expired still verifies
+	expired.ExpiresAt = now.Add(-10 * time.Second).Unix()
+	if _, err := v.Verify(sign([]byte(newKey), &expired)); err != nil {
+		t.Errorf("within leeway: %v", err)
+	}
+
+	var handled []string
+	handle := v.Handler(func(_ context.Context, e *Event) error {
+		handled = append(handled, e.Identity.Subject)
+		return nil
+	})
+	if err := handle(context.Background(), []byte(swapped)); err == nil {
+		t.Error("handler accepted a forged event")
+	}
+	if err := handle(context.Background(), sign([]byte(oldKey), event)); err != nil || len(handled) != 1 {
+		t.Errorf("handler: %v, handled %v", err, handled)
+	}
+}
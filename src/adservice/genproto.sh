@@ -18,6 +18,6 @@
 # protos are needed in adservice folder for compiling during Docker build.
 
 mkdir -p proto && \
-cp ../../protos/demo.proto src/main/proto
+cp ../../protos/auth_options.proto ../../protos/demo.proto src/main/proto
 
 # [END gke_adservice_genproto]
\ No newline at end of file
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Access log
+//
+// With ACCESS_LOG_SAMPLE=N, one call in N is logged as a single "[ACCESS]"
+// line with its auth outcome: the JWT wire mode, whether the token verified,
+// a hash of its subject, and how long reassembling and verifying the token
+// and the rest of the handler took. Failed calls, and those slower than
+// ACCESS_LOG_SLOW, are always logged. Streams are logged when they end.
+
+var (
+	accessLogSampleEvery = loadAccessLogSample()
+	accessLogSlow        = loadAccessLogSlow()
+	accessLogCount       atomic.Uint64
+)
+
+func loadAccessLogSample() uint64 {
+	n, _ := strconv.ParseUint(os.Getenv("ACCESS_LOG_SAMPLE"), 10, 64)
+	return n
+}
+
+func loadAccessLogSlow() time.Duration {
+	d, _ := time.ParseDuration(os.Getenv("ACCESS_LOG_SLOW"))
+	return d
+}
+
+type ctxKeyAccess struct{}
+
+// accessRecord collects the auth outcome of one call
+type accessRecord struct {
+	mu          sync.Mutex
+	verified    bool
+	subjectHash string
+	decompose   time.Duration
+	verify      time.Duration
+	wireFormat  string
+}
+
+// accessFromContext returns the call's record, nil outside the access log
+func accessFromContext(ctx context.Context) *accessRecord {
+	a, _ := ctx.Value(ctxKeyAccess{}).(*accessRecord)
+	return a
+}
+
+// reassembled records the time spent rebuilding the token from its headers
+func (a *accessRecord) reassembled(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.decompose += d
+}
+
+// arrivedAs records the wire format of the call's token
+func (a *accessRecord) arrivedAs(format string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.wireFormat = format
+}
+
+// verifiedAs records a verification of the call's token
+func (a *accessRecord) verifiedAs(claims *UserClaims, ok bool, d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.verified = ok
+	a.verify += d
+	if claims != nil && claims.Subject != "" {
+		a.subjectHash = pseudonym(claims.Subject)
+	}
+}
+
+// accessLogged reports whether a call is logged: failures and slow calls
+// always, the rest one in accessLogSampleEvery
+func accessLogged(failed bool, took time.Duration) bool {
+	if accessLogSampleEvery == 0 {
+		return false
+	}
+	if failed || (accessLogSlow > 0 && took >= accessLogSlow) {
+		return true
+	}
+	return accessLogCount.Add(1)%accessLogSampleEvery == 0
+}
+
+// logAccess writes the access log line of a finished call
+func logAccess(ctx context.Context, method string, a *accessRecord, took time.Duration, err error) {
+	code := status.Code(err)
+	if !accessLogged(err != nil, took) {
+		return
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	fields := redactedJWTFields(md)
+	if traceID := traceIDFromMetadata(md); traceID != "" {
+		fields["trace_id"] = traceID
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fields["grpc.method"] = method
+	fields["grpc.code"] = code.String()
+	fields["auth.verified"] = a.verified
+	fields["latency.total_us"] = took.Microseconds()
+	fields["latency.decompose_us"] = a.decompose.Microseconds()
+	fields["latency.verify_us"] = a.verify.Microseconds()
+	fields["latency.handler_us"] = (took - a.decompose - a.verify).Microseconds()
+	if a.subjectHash != "" {
+		fields["auth.subject_hash"] = a.subjectHash
+	}
+	if a.wireFormat != "" {
+		fields["auth.wire_format"] = a.wireFormat
+	}
+	log.WithFields(fields).Info("[ACCESS]")
+}
+
+func accessLogUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	// The record also feeds the auth timing trailer, see auth_timing.go
+	timing := authTimingRequested(ctx)
+	if accessLogSampleEvery == 0 && !timing {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	a := &accessRecord{}
+	handlerCtx := context.WithValue(ctx, ctxKeyAccess{}, a)
+	var t *authTiming
+	if timing {
+		t = &authTiming{}
+		handlerCtx = context.WithValue(handlerCtx, ctxKeyAuthTiming{}, t)
+	}
+	resp, err := handler(handlerCtx, req)
+	if timing {
+		sendAuthTiming(ctx, info.FullMethod, a, t)
+	}
+	logAccess(ctx, info.FullMethod, a, time.Since(start), err)
+	return resp, err
+}
+
+func accessLogStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if accessLogSampleEvery == 0 {
+		return handler(srv, ss)
+	}
+	start := time.Now()
+	a := &accessRecord{}
+	ctx := context.WithValue(ss.Context(), ctxKeyAccess{}, a)
+	err := handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	logAccess(ss.Context(), info.FullMethod, a, time.Since(start), err)
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Actor token metadata keys. The actor token identifies the service acting on
+// behalf of the user and travels alongside the user token in the same two
+// formats: split (x-jwt-actor-header/-payload/-sig) or full (x-jwt-actor).
+const (
+	mdActorHeader  = "x-jwt-actor-header"
+	mdActorPayload = "x-jwt-actor-payload"
+	mdActorSig     = "x-jwt-actor-sig"
+	mdActorFull    = "x-jwt-actor"
+)
+
+// Context key for the actor token received on the incoming request
+type ctxKeyActorJWT struct{}
+
+// serviceActorToken is checkout's own identity token, attached as the actor on
+// outgoing calls. Loaded from ACTOR_JWT or the file named by ACTOR_JWT_FILE.
+var serviceActorToken string
+
+// loadActorToken reads the service identity token; running without one is
+// allowed, in which case a verified incoming actor token is forwarded
+func loadActorToken() error {
+	if v := os.Getenv("ACTOR_JWT"); v != "" {
+		serviceActorToken = strings.TrimSpace(v)
+		return nil
+	}
+	if path := os.Getenv("ACTOR_JWT_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		serviceActorToken = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// actorJWTFromMetadata returns the actor token carried by incoming metadata,
+// reassembling it when it arrives split
+func actorJWTFromMetadata(md metadata.MD) (string, error) {
+	if payloadHeaders := md.Get(mdActorPayload); len(payloadHeaders) > 0 {
+		var header, signature string
+		if headerHeaders := md.Get(mdActorHeader); len(headerHeaders) > 0 {
+			header = headerHeaders[0]
+		}
+		if sigHeaders := md.Get(mdActorSig); len(sigHeaders) > 0 {
+			signature = sigHeaders[0]
+		}
+		return ReassembleJWT(&JWTComponents{
+			Header:    header,
+			Payload:   payloadHeaders[0],
+			Signature: signature,
+		})
+	}
+	if fullHeaders := md.Get(mdActorFull); len(fullHeaders) > 0 {
+		return fullHeaders[0], nil
+	}
+	return "", nil
+}
+
+// withActorJWT stores the incoming actor token, if any, in the context. The
+// token is verified like a user token, against the trusted issuers, and
+// dropped when that fails, so a caller can't have checkout relay an identity
+// it made up.
+func withActorJWT(ctx context.Context, md metadata.MD) context.Context {
+	actor, err := actorJWTFromMetadata(md)
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to reassemble actor JWT: %v", err)
+		jwtSLO.RecordFailure(sloReasonReassembly)
+		return ctx
+	}
+	if actor == "" {
+		return ctx
+	}
+	if _, err := verifyUserJWT(actor); err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Dropping actor JWT that failed verification: %v", err)
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyActorJWT{}, actor)
+}
+
+// ActorJWTFromContext returns the verified actor token of the incoming
+// request
+func ActorJWTFromContext(ctx context.Context) (string, bool) {
+	actor, ok := ctx.Value(ctxKeyActorJWT{}).(string)
+	return actor, ok && actor != ""
+}
+
+// UserJWTFromContext returns the user token of the incoming request, whichever
+// format it arrived in
+func UserJWTFromContext(ctx context.Context) (string, bool) {
+	if token, ok := ctx.Value(ctxKeyJWT{}).(string); ok && token != "" {
+		return token, true
+	}
+	payload, ok := ctx.Value(ctxKeyJWTPayload{}).(string)
+	if !ok || payload == "" {
+		return "", false
+	}
+	header, _ := ctx.Value(ctxKeyJWTHeader{}).(string)
+	sig, _ := ctx.Value(ctxKeyJWTSig{}).(string)
+	token, err := ReassembleJWT(&JWTComponents{Header: header, Payload: payload, Signature: sig})
+	if err != nil {
+		return "", false
+	}
+	return token, true
+}
+
+// appendActorJWT attaches the actor token to an outgoing call: checkout's own
+// identity when configured, otherwise the verified actor it received
+func appendActorJWT(ctx context.Context) context.Context {
+	actor := serviceActorToken
+	if actor == "" {
+		actor, _ = ActorJWTFromContext(ctx)
+	}
+	if actor == "" {
+		return ctx
+	}
+
+	if jwtCompressionEnabled(ctx) {
+		if components, err := DecomposeJWT(actor); err == nil {
+			return metadata.AppendToOutgoingContext(ctx,
+				mdActorHeader, components.Header,
+				mdActorPayload, components.Payload,
+				mdActorSig, components.Signature)
+		} else {
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to decompose actor JWT, using full token: %v", err)
+			jwtSLO.RecordFailure(sloReasonReassembly)
+		}
+	}
+	return metadata.AppendToOutgoingContext(ctx, mdActorFull, actor)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/jwttest"
+	"google.golang.org/grpc/metadata"
+)
+
+// outgoingActor returns the actor token appendActorJWT put on ctx, in
+// whichever format it was sent
+func outgoingActor(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if full := md.Get(mdActorFull); len(full) > 0 {
+		return full[0]
+	}
+	actor, err := actorJWTFromMetadata(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return actor
+}
+
+// TestActorJWTRelay checks that checkout relays only actor tokens it could
+// verify, and its own identity whenever it has one
+func TestActorJWTRelay(t *testing.T) {
+	iss := jwttest.RS256()
+	useTestIssuer(t, iss)
+	other, err := jwttest.NewIssuer("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(own string) { serviceActorToken = own }(serviceActorToken)
+	serviceActorToken = ""
+
+	trusted := iss.Mint(jwttest.Claims{"sub": "spiffe://hipstershop/frontend"})
+	for _, tc := range []struct {
+		name, actor string
+		relayed     bool
+	}{
+		{"trusted issuer", trusted, true},
+		{"untrusted issuer", other.Mint(jwttest.Claims{"sub": "spiffe://hipstershop/frontend"}), false},
+		{"bad signature", jwttest.BadSignature(trusted), false},
+		{"expired", iss.Mint(jwttest.Claims{"sub": "spiffe://hipstershop/frontend"}, jwttest.TTL(-time.Minute)), false},
+		{"not a JWT", "made-up-actor", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := withActorJWT(context.Background(), metadata.Pairs(mdActorFull, tc.actor))
+			if _, ok := ActorJWTFromContext(ctx); ok != tc.relayed {
+				t.Errorf("ActorJWTFromContext ok = %v, want %v", ok, tc.relayed)
+			}
+			got := outgoingActor(t, appendActorJWT(ctx))
+			if tc.relayed && got != tc.actor {
+				t.Errorf("relayed %q, want the incoming actor", got)
+			}
+			if !tc.relayed && got != "" {
+				t.Errorf("relayed %q, want no actor", got)
+			}
+		})
+	}
+
+	// Checkout's own identity replaces whatever it received
+	serviceActorToken = "checkout-identity"
+	ctx := withActorJWT(context.Background(), metadata.Pairs(mdActorFull, trusted))
+	if got := outgoingActor(t, appendActorJWT(ctx)); got != serviceActorToken {
+		t.Errorf("relayed %q, want checkout's own identity", got)
+	}
+}
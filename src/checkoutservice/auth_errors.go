@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Auth failure reasons
+//
+// Every status refusing a request because of its user token carries a
+// google.rpc.ErrorInfo in jwtErrorDomain whose reason says why, so callers
+// can tell an expired session from a forged token without parsing messages.
+// Shipping uses the same reasons; PlaceOrder passes its refusals through.
+const (
+	reasonJWTMalformed       = "JWT_MALFORMED"
+	reasonJWTExpired         = "JWT_EXPIRED"
+	reasonJWTClaimsInvalid   = "JWT_CLAIMS_INVALID"
+	reasonJWTRevoked         = "JWT_REVOKED"
+	reasonJWTHeaderConflict  = "JWT_HEADER_CONFLICT"
+	reasonJWTDuplicateHeader = "JWT_DUPLICATE_HEADER"
+	reasonJWTBindingMismatch = "JWT_BINDING_MISMATCH"
+)
+
+// authError builds a status of code carrying an ErrorInfo with reason
+func authError(code codes.Code, reason, msg string, metadata map[string]string) error {
+	st := status.New(code, msg)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   jwtErrorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// downstreamAuthError returns the status of a downstream call wrapped in err
+// when it refused the user token, so it reaches the caller with its code and
+// ErrorInfo instead of being flattened into a generic failure; nil otherwise.
+// Static block misses and downgrade requests stay internal: the retry has
+// already been made.
+func downstreamAuthError(err error) error {
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return nil
+	}
+	st, _ := status.FromError(err)
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if ok && info.GetDomain() == jwtErrorDomain && info.GetReason() != staticBlockUnknownReason && info.GetReason() != splitDowngradeReason {
+			return st.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Auth timing
+//
+// A call carrying x-debug-auth-timing from a peer in AUTH_TIMING_ALLOW (a
+// list of CIDRs, off when empty) gets an x-auth-timing trailer, one
+// Server-Timing style entry per value: how long reassembling and verifying
+// its token took here, followed by the entries of the downstream calls it
+// made, which are asked for theirs in turn. The frontend returns them all as
+// the Server-Timing trailer of the page. Unary calls only.
+
+const (
+	authTimingHeader  = "x-debug-auth-timing"
+	authTimingTrailer = "x-auth-timing"
+	authTimingHop     = "checkoutservice"
+)
+
+var authTimingAllow, authTimingAllowErr = parseAuthTimingAllow(os.Getenv("AUTH_TIMING_ALLOW"))
+
+// parseAuthTimingAllow reads a comma separated list of CIDRs
+func parseAuthTimingAllow(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_TIMING_ALLOW: %q is not a CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// authTiming collects the entries of the downstream calls of one call
+type authTiming struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+type ctxKeyAuthTiming struct{}
+
+func authTimingFromContext(ctx context.Context) *authTiming {
+	t, _ := ctx.Value(ctxKeyAuthTiming{}).(*authTiming)
+	return t
+}
+
+func (t *authTiming) add(entries ...string) {
+	if t == nil || len(entries) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, entries...)
+}
+
+// authTimingRequested reports whether the caller asked for the timings of
+// this call and may see them
+func authTimingRequested(ctx context.Context) bool {
+	if len(authTimingAllow) == 0 {
+		return false
+	}
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get(authTimingHeader)) == 0 {
+		return false
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	addr, ok := p.Addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range authTimingAllow {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// authTimingEntry formats one step of one hop
+func authTimingEntry(step string, d time.Duration, method string) string {
+	return fmt.Sprintf("%s-%s;dur=%.3f;desc=%q", authTimingHop, step, float64(d.Microseconds())/1000, method[strings.LastIndex(method, "/")+1:])
+}
+
+// sendAuthTiming sets the trailer of a finished call from its access record
+// and the entries its downstream calls returned
+func sendAuthTiming(ctx context.Context, method string, a *accessRecord, t *authTiming) {
+	a.mu.Lock()
+	entries := []string{authTimingEntry("reassemble", a.decompose, method), authTimingEntry("verify", a.verify, method)}
+	a.mu.Unlock()
+	t.mu.Lock()
+	entries = append(entries, t.entries...)
+	t.mu.Unlock()
+	grpc.SetTrailer(ctx, metadata.MD{authTimingTrailer: entries})
+}
+
+// authTimingInvoker asks the downstream for its timings when the call being
+// served asked for them
+func authTimingInvoker(invoker grpc.UnaryInvoker) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		t := authTimingFromContext(ctx)
+		if t == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		var trailer metadata.MD
+		ctx = metadata.AppendToOutgoingContext(ctx, authTimingHeader, "1")
+		err := invoker(ctx, method, req, reply, cc, append(opts[:len(opts):len(opts)], grpc.Trailer(&trailer))...)
+		t.add(trailer.Get(authTimingTrailer)...)
+		return err
+	}
+}
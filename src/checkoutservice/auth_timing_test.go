@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// trailerStream records the trailer a handler sets
+type trailerStream struct {
+	grpc.ServerTransportStream
+	trailer metadata.MD
+}
+
+func (s *trailerStream) Method() string               { return "/hipstershop.CheckoutService/PlaceOrder" }
+func (s *trailerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *trailerStream) SendHeader(metadata.MD) error { return nil }
+func (s *trailerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+func TestAuthTimingTrailer(t *testing.T) {
+	defer func(allow []*net.IPNet) { authTimingAllow = allow }(authTimingAllow)
+	authTimingAllow, _ = parseAuthTimingAllow("10.0.0.0/8")
+
+	shipping := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		// Only callers asking for timings get them
+		if md, _ := metadata.FromOutgoingContext(ctx); len(md.Get(authTimingHeader)) == 0 {
+			return nil
+		}
+		for _, o := range opts {
+			if tr, ok := o.(grpc.TrailerCallOption); ok {
+				*tr.TrailerAddr = metadata.Pairs(authTimingTrailer, `shippingservice-verify;dur=0.400;desc="ShipOrder"`)
+			}
+		}
+		return nil
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		accessFromContext(ctx).reassembled(50 * time.Microsecond)
+		accessFromContext(ctx).verifiedAs(nil, true, 800*time.Microsecond)
+		return nil, authTimingInvoker(shipping)(ctx, "/hipstershop.ShippingService/ShipOrder", nil, nil, nil)
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.CheckoutService/PlaceOrder"}
+
+	call := func(ip string) metadata.MD {
+		stream := &trailerStream{}
+		ctx := grpc.NewContextWithServerTransportStream(context.Background(), stream)
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(authTimingHeader, "1"))
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}})
+		if _, err := accessLogUnaryServerInterceptor(ctx, nil, info, handler); err != nil {
+			t.Fatal(err)
+		}
+		return stream.trailer
+	}
+
+	got := strings.Join(call("10.1.2.3").Get(authTimingTrailer), ", ")
+	want := `checkoutservice-reassemble;dur=0.050;desc="PlaceOrder", checkoutservice-verify;dur=0.800;desc="PlaceOrder", shippingservice-verify;dur=0.400;desc="ShipOrder"`
+	if got != want {
+		t.Errorf("trailer = %s\nwant %s", got, want)
+	}
+	if got := call("192.168.1.1"); len(got.Get(authTimingTrailer)) != 0 {
+		t.Errorf("caller outside AUTH_TIMING_ALLOW got %v", got)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Claim sealing
+//
+// The frontend can seal sensitive claims (email, name) of a split payload
+// with a key shared by the mesh, see claim_sealing.go in the frontend. With
+// the same key in JWT_FIELD_KEY_FILE checkout opens them back into the
+// signed payload on receipt, and seals JWT_ENCRYPTED_CLAIMS again when it
+// forwards the payload split. Only the services in JWT_PII_SERVICES
+// (default shipping) hold the key; the others are sent tokens carrying
+// those claims whole in authorization.
+
+const (
+	sealedClaimPrefix       = "enc:v1:"
+	defaultEncryptedClaims  = "email,name"
+	defaultPIIServices      = "shipping"
+	splitDecisionPIIRefused = "whole_pii"
+)
+
+var errPayloadNotCompact = errors.New("payload isn't compact JSON, claims can't be sealed in place")
+
+// claimSealer seals and opens claim values with the mesh field key
+type claimSealer struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	claims   map[string]bool
+}
+
+var (
+	fieldSealer, _ = loadFieldSealer()
+	piiServices    = loadPIIServices()
+)
+
+// loadFieldSealer reads JWT_FIELD_KEY_FILE; without it claims are neither
+// sealed nor opened
+func loadFieldSealer() (*claimSealer, error) {
+	path := os.Getenv("JWT_FIELD_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold 32 base64-encoded bytes", path)
+	}
+	v, ok := os.LookupEnv("JWT_ENCRYPTED_CLAIMS")
+	if !ok {
+		v = defaultEncryptedClaims
+	}
+	return newClaimSealer(key, splitList(v))
+}
+
+func loadPIIServices() map[string]bool {
+	v, ok := os.LookupEnv("JWT_PII_SERVICES")
+	if !ok {
+		v = defaultPIIServices
+	}
+	services := make(map[string]bool)
+	for _, s := range splitList(v) {
+		services[strings.ToLower(s)] = true
+	}
+	return services
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newClaimSealer derives the cipher and nonce keys from key
+func newClaimSealer(key []byte, claims []string) (*claimSealer, error) {
+	derive := func(label string) []byte {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(label))
+		return m.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("claim-seal"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &claimSealer{aead: aead, nonceKey: derive("claim-nonce"), claims: make(map[string]bool)}
+	for _, c := range claims {
+		s.claims[c] = true
+	}
+	return s, nil
+}
+
+// Covers reports whether payload carries a claim to seal
+func (s *claimSealer) Covers(payload string) bool {
+	for c := range s.claims {
+		if strings.Contains(payload, `"`+c+`":`) {
+			return true
+		}
+	}
+	return false
+}
+
+// Seal returns payload with the configured claims sealed
+func (s *claimSealer) Seal(payload string) (string, error) {
+	members, err := claimMembers(payload)
+	if err != nil {
+		return "", err
+	}
+	if encodeClaimMembers(members) != payload {
+		return "", errPayloadNotCompact
+	}
+	for i, m := range members {
+		if !s.claims[m.Key] {
+			continue
+		}
+		mac := hmac.New(sha256.New, s.nonceKey)
+		mac.Write([]byte(m.Key))
+		mac.Write([]byte{0})
+		mac.Write(m.Value)
+		nonce := mac.Sum(nil)[:s.aead.NonceSize()]
+		sealed := s.aead.Seal(nonce, nonce, m.Value, []byte(m.Key))
+		members[i].Value, _ = json.Marshal(sealedClaimPrefix + base64.RawURLEncoding.EncodeToString(sealed))
+	}
+	return encodeClaimMembers(members), nil
+}
+
+// Open returns payload with its sealed claims opened; a nil sealer opens
+// payloads without sealed claims only
+func (s *claimSealer) Open(payload string) (string, error) {
+	if !strings.Contains(payload, `"`+sealedClaimPrefix) {
+		return payload, nil
+	}
+	members, err := claimMembers(payload)
+	if err != nil {
+		return "", err
+	}
+	for i, m := range members {
+		var v string
+		if json.Unmarshal(m.Value, &v) != nil || !strings.HasPrefix(v, sealedClaimPrefix) {
+			continue
+		}
+		if s == nil {
+			return "", fmt.Errorf("claim %q is sealed and JWT_FIELD_KEY_FILE isn't set", m.Key)
+		}
+		sealed, err := base64.RawURLEncoding.DecodeString(v[len(sealedClaimPrefix):])
+		if err != nil || len(sealed) < s.aead.NonceSize() {
+			return "", fmt.Errorf("claim %q is not a sealed value", m.Key)
+		}
+		n := s.aead.NonceSize()
+		value, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(m.Key))
+		if err != nil {
+			return "", fmt.Errorf("claim %q doesn't open with the field key", m.Key)
+		}
+		members[i].Value = value
+	}
+	return encodeClaimMembers(members), nil
+}
+
+// sealedPayloadFor returns payload as it is forwarded split to method's
+// service, with its sensitive claims sealed. It reports false when the
+// payload has to go whole instead: the service doesn't hold the field key,
+// or the claims couldn't be sealed.
+func sealedPayloadFor(method, payload string) (string, bool) {
+	if fieldSealer == nil || !fieldSealer.Covers(payload) {
+		return payload, true
+	}
+	service := serviceFromMethod(method)
+	short := strings.TrimSuffix(service[strings.LastIndex(service, ".")+1:], "Service")
+	if !piiServices[strings.ToLower(service)] && !piiServices[strings.ToLower(short)] {
+		jwtSplitDecisions.Add(service+" "+splitDecisionPIIRefused, 1)
+		return payload, false
+	}
+	sealed, err := fieldSealer.Seal(payload)
+	if err != nil {
+		log.Warnf("[JWT-FLOW] Failed to seal claims for %s, sending the whole token: %v", service, err)
+		return payload, false
+	}
+	return sealed, true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sealedClaimVector is sealed by the frontend with a key of 32 sevens
+const sealedClaimVector = `{"sub":"u1","email":"enc:v1:MdivyZjLoX0WTcwIMRHcGDSwS0AdCRGYkkNUNvUwq38-hL6jLrJD6A3OUg"}`
+
+// TestClaimSealing checks that claims sealed by the frontend open into the
+// signed payload, that checkout seals them the same way when forwarding and
+// that a payload with sealed claims can't be opened without the key
+func TestClaimSealing(t *testing.T) {
+	s, err := newClaimSealer(bytes.Repeat([]byte{7}, 32), []string{"email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"sub":"u1","email":"a@example.com"}`
+	if got, err := s.Open(sealedClaimVector); err != nil || got != payload {
+		t.Fatalf("Open = %s, %v, want %s", got, err, payload)
+	}
+	if got, err := s.Seal(payload); err != nil || got != sealedClaimVector {
+		t.Errorf("Seal = %s, %v, want the frontend's %s", got, err, sealedClaimVector)
+	}
+	if _, err := (*claimSealer)(nil).Open(sealedClaimVector); err == nil {
+		t.Error("opened sealed claims without a key")
+	}
+	if got, err := (*claimSealer)(nil).Open(payload); err != nil || got != payload {
+		t.Errorf("Open of a plain payload without a key = %s, %v", got, err)
+	}
+	other, _ := newClaimSealer(bytes.Repeat([]byte{8}, 32), nil)
+	if _, err := other.Open(sealedClaimVector); err == nil {
+		t.Error("opened sealed claims with the wrong key")
+	}
+
+	defer func(f *claimSealer) { fieldSealer = f }(fieldSealer)
+	fieldSealer = s
+	if got, ok := sealedPayloadFor("/hipstershop.ShippingService/GetQuote", payload); !ok || got != sealedClaimVector {
+		t.Errorf("forwarding to shipping = %s, %v, want sealed claims", got, ok)
+	}
+	if _, ok := sealedPayloadFor("/hipstershop.CartService/EmptyCart", payload); ok {
+		t.Error("forwarding sealed claims to cart split, want the whole token")
+	}
+}
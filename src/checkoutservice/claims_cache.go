@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verified claims caching
+//
+// A PlaceOrder fans out to cart, shipping, payment and email, and every
+// step that needs the user's claims asks VerifiedUserClaims. The server
+// interceptors attach a request-scoped memo, so the token is verified at most
+// once per request however many hops consult it. Across requests, a
+// session-scoped cache keyed by session_id keeps the last verified claims of
+// each session: the session's next request costs a SHA-256 of the token
+// instead of an RSA verification.
+//
+// A cached entry is only reused for the exact token bytes it was verified
+// from. It lives at most JWT_CLAIMS_CACHE_TTL (default 1m, 0 disables the
+// session cache) and never past the token's exp, so a key dropped by
+// rotation stops being trusted within the TTL. Revoking the session drops its
+// entry; revoked tokens are refused by checkRevocation before the handler
+// runs either way.
+
+// verifiedClaimsCache is the session-scoped cache
+var verifiedClaimsCache = newClaimsCache(10000, claimsCacheTTL())
+
+// claimsCacheEvents counts request memo hits, session cache hits and misses
+var claimsCacheEvents = expvar.NewMap("jwt_claims_cache")
+
+// claimsCacheTTL reads JWT_CLAIMS_CACHE_TTL
+func claimsCacheTTL() time.Duration {
+	v := os.Getenv("JWT_CLAIMS_CACHE_TTL")
+	if v == "" {
+		return time.Minute
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return time.Minute
+	}
+	return d
+}
+
+// Context key for the verified-claims memo of the current request
+type ctxKeyClaimsMemo struct{}
+
+// claimsMemo holds the outcome of the request's single verification
+type claimsMemo struct {
+	once   sync.Once
+	claims *UserClaims
+	err    error
+}
+
+// withClaimsMemo gives the request its verified-claims memo
+func withClaimsMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyClaimsMemo{}, &claimsMemo{})
+}
+
+type claimsCache struct {
+	maxEntries int
+	ttl        time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]claimsEntry
+}
+
+type claimsEntry struct {
+	digest  [sha256.Size]byte
+	claims  *UserClaims
+	expires time.Time
+}
+
+func newClaimsCache(maxEntries int, ttl time.Duration) *claimsCache {
+	return &claimsCache{maxEntries: maxEntries, ttl: ttl, sessions: make(map[string]claimsEntry)}
+}
+
+// Verify returns the claims of token, verifying it only when the token's
+// session has no live entry for these exact bytes. The returned claims are
+// shared and must not be modified.
+func (c *claimsCache) Verify(token string) (*UserClaims, error) {
+	if c.ttl <= 0 {
+		return verifyUserJWT(token)
+	}
+	digest := sha256.Sum256([]byte(token))
+	// The unverified session_id only picks the entry; the digest decides
+	if session := tokenSessionID(token); session != "" {
+		now := time.Now()
+		c.mu.Lock()
+		e, ok := c.sessions[session]
+		c.mu.Unlock()
+		if ok && e.digest == digest && now.Before(e.expires) {
+			claimsCacheEvents.Add("session_hits", 1)
+			return e.claims, nil
+		}
+	}
+
+	claimsCacheEvents.Add("misses", 1)
+	claims, err := verifyUserJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	c.add(digest, claims)
+	return claims, nil
+}
+
+func (c *claimsCache) add(digest [sha256.Size]byte, claims *UserClaims) {
+	if claims.SessionID == "" {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(c.ttl)
+	if claims.ExpiresAt != 0 && time.Unix(claims.ExpiresAt, 0).Before(expires) {
+		expires = time.Unix(claims.ExpiresAt, 0)
+	}
+	if !expires.After(now) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sessions[claims.SessionID]; !ok && len(c.sessions) >= c.maxEntries {
+		for k, e := range c.sessions {
+			if now.After(e.expires) {
+				delete(c.sessions, k)
+			}
+		}
+		if len(c.sessions) >= c.maxEntries {
+			return
+		}
+	}
+	c.sessions[claims.SessionID] = claimsEntry{digest: digest, claims: claims, expires: expires}
+}
+
+// Forget drops the entry of a revoked session
+func (c *claimsCache) Forget(session string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, session)
+}
+
+// Reset drops every entry, e.g. once a signing key is revoked
+func (c *claimsCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions = make(map[string]claimsEntry)
+}
+
+// tokenSessionID reads the unverified session_id claim; only ever used to
+// find a cache entry, never to accept a token
+func tokenSessionID(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.SessionID
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/keyring"
+)
+
+func TestVerifiedClaimsCache(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.New(context.Background(), keyring.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, c *claimsCache) { jwtKeys, verifiedClaimsCache = k, c }(jwtKeys, verifiedClaimsCache)
+	jwtKeys = keys
+	verifiedClaimsCache = newClaimsCache(10, time.Minute)
+
+	sign := func(jti string) string {
+		payload := `{"iss":"` + jwtIssuer + `","aud":"` + jwtAudience + `","sub":"u","session_id":"s1","jti":"` + jti +
+			`","exp":` + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + `}`
+		input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(payload))
+		digest := sha256.Sum256([]byte(input))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	request := func(token string) context.Context {
+		return withClaimsMemo(context.WithValue(context.Background(), ctxKeyJWT{}, token))
+	}
+	counts := func() (misses, session, memo int64) {
+		get := func(k string) int64 {
+			if v, ok := claimsCacheEvents.Get(k).(interface{ Value() int64 }); ok {
+				return v.Value()
+			}
+			return 0
+		}
+		return get("misses"), get("session_hits"), get("request_hits")
+	}
+	expect := func(step string, ctx context.Context, calls int, misses, session, memo int64) {
+		t.Helper()
+		m0, s0, r0 := counts()
+		for i := 0; i < calls; i++ {
+			if _, err := VerifiedUserClaims(ctx); err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+		}
+		m1, s1, r1 := counts()
+		if m1-m0 != misses || s1-s0 != session || r1-r0 != memo {
+			t.Errorf("%s: misses/session hits/request hits = %d/%d/%d, want %d/%d/%d", step, m1-m0, s1-s0, r1-r0, misses, session, memo)
+		}
+	}
+
+	first := sign("a")
+	expect("first request", request(first), 4, 1, 0, 3)
+	expect("same token, next request", request(first), 2, 0, 1, 1)
+	expect("renewed token", request(sign("b")), 1, 1, 0, 0)
+
+	verifiedClaimsCache.Forget("s1")
+	expect("revoked session", request(first), 1, 1, 0, 0)
+
+	tampered := first[:len(first)-4] + "AAAA"
+	if _, err := VerifiedUserClaims(request(tampered)); err == nil {
+		t.Error("a token differing from the cached one was accepted")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type claimsTransformerFunc struct {
+	name string
+	fn   func(*UserClaims) error
+}
+
+func (t claimsTransformerFunc) Name() string { return t.name }
+
+func (t claimsTransformerFunc) Transform(_ context.Context, c *UserClaims) error { return t.fn(c) }
+
+// TestTransformClaims checks that transformers run in order on a copy of the
+// claims and that an error fails the transformation
+func TestTransformClaims(t *testing.T) {
+	defer func(ts []ClaimsTransformer) { claimsTransformers = ts }(claimsTransformers)
+	claimsTransformers = nil
+
+	roles, err := parseGroupRoles("admins=admin, admins=support,ops=operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterClaimsTransformer(roles)
+	RegisterClaimsTransformer(claimsTransformerFunc{"audit", func(c *UserClaims) error {
+		c.Roles = append(c.Roles, "seen-after-"+c.Roles[0])
+		return nil
+	}})
+
+	verified := &UserClaims{Subject: "u", Groups: []string{"admins", "guests"}}
+	got, err := transformClaims(context.Background(), verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"admin", "support", "seen-after-admin"}; !reflect.DeepEqual(got.Roles, want) {
+		t.Errorf("roles = %v, want %v", got.Roles, want)
+	}
+	if verified.Roles != nil {
+		t.Errorf("verified claims were modified: %v", verified.Roles)
+	}
+
+	RegisterClaimsTransformer(claimsTransformerFunc{"deny", func(*UserClaims) error { return errors.New("suspended") }})
+	if _, err := transformClaims(context.Background(), verified); err == nil {
+		t.Error("failing transformer was ignored")
+	}
+
+	if _, err := parseGroupRoles("admins"); err == nil {
+		t.Error("entry without a role was accepted")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Clock skew calibration
+//
+// A node whose clock drifts from the issuer's refuses good tokens: running
+// behind, a fresh token's nbf is still in the future; running ahead, tokens
+// expire early. With JWT_CLOCK_SKEW_MAX set (e.g. 30s; 0, the default,
+// disables calibration) checkout estimates per issuer how far its clock is
+// ahead of the issuer's and judges exp and nbf on the issuer's clock.
+//
+// A token is received no earlier than it was issued, so now - iat of a
+// verified token bounds the offset from above, and the smallest bound of the
+// last JWT_CLOCK_SKEW_WINDOW (default 5m) comes from the freshest token.
+// Bounds beyond the maximum come from old tokens and are ignored. With
+// JWT_CLOCK_SKEW_URL set, checkout also sends a HEAD request there every
+// minute and reads the offset from the Date header, NTP style; that estimate
+// applies to JWT_ISSUER and is still capped by the iat bound. Estimates never
+// exceed ±JWT_CLOCK_SKEW_MAX.
+
+const (
+	defaultClockSkewWindow = 5 * time.Minute
+	clockSkewProbeInterval = time.Minute
+)
+
+var (
+	clockSkewMax    = clockSkewDuration("JWT_CLOCK_SKEW_MAX", 0)
+	clockSkewWindow = clockSkewDuration("JWT_CLOCK_SKEW_WINDOW", defaultClockSkewWindow)
+	clockSkewURL    = os.Getenv("JWT_CLOCK_SKEW_URL")
+)
+
+var clockSkewSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "jwt_clock_skew_seconds",
+	Help: "Estimated offset of the local clock ahead of the token issuer's.",
+}, []string{"issuer"})
+
+// clockSkewDuration reads a non-negative duration setting
+func clockSkewDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d < 0 {
+		return def
+	}
+	return d
+}
+
+// skewEstimator estimates the offset of the local clock ahead of one
+// issuer's
+type skewEstimator struct {
+	max    time.Duration
+	window time.Duration
+
+	mu        sync.Mutex
+	bound     time.Duration // smallest now - iat of the current window
+	prevBound time.Duration // and of the previous one
+	hasBound  bool
+	hasPrev   bool
+	windowEnd time.Time
+	date      time.Duration
+	dateAt    time.Time
+	nowFunc   func() time.Time
+}
+
+func newSkewEstimator(max, window time.Duration) *skewEstimator {
+	return &skewEstimator{max: max, window: window, nowFunc: time.Now}
+}
+
+// ObserveIssuedAt records the iat of a verified token
+func (e *skewEstimator) ObserveIssuedAt(iat int64) {
+	if e == nil || iat == 0 {
+		return
+	}
+	now := e.nowFunc()
+	bound := now.Sub(time.Unix(iat, 0))
+	if bound > e.max {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rotateLocked(now)
+	if !e.hasBound || bound < e.bound {
+		e.bound, e.hasBound = bound, true
+	}
+}
+
+// ObserveDate records an offset measured against the issuer's Date header
+func (e *skewEstimator) ObserveDate(offset time.Duration) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.date, e.dateAt = offset, e.nowFunc()
+}
+
+// Skew returns the estimated offset of the local clock ahead of the
+// issuer's, 0 without an estimate
+func (e *skewEstimator) Skew() time.Duration {
+	if e == nil {
+		return 0
+	}
+	now := e.nowFunc()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rotateLocked(now)
+	bound, hasBound := e.bound, e.hasBound
+	if e.hasPrev && (!hasBound || e.prevBound < bound) {
+		bound, hasBound = e.prevBound, true
+	}
+	var skew time.Duration
+	switch {
+	case !e.dateAt.IsZero() && now.Sub(e.dateAt) < e.window:
+		skew = e.date
+		if hasBound && bound < skew {
+			skew = bound
+		}
+	case hasBound:
+		skew = bound
+	}
+	if skew > e.max {
+		skew = e.max
+	} else if skew < -e.max {
+		skew = -e.max
+	}
+	return skew
+}
+
+// rotateLocked starts a new window once the current one ended; e.mu must be
+// held
+func (e *skewEstimator) rotateLocked(now time.Time) {
+	if now.Before(e.windowEnd) {
+		return
+	}
+	e.prevBound, e.hasPrev = e.bound, e.hasBound && now.Sub(e.windowEnd) < e.window
+	e.hasBound = false
+	e.windowEnd = now.Add(e.window)
+}
+
+var (
+	clockSkewsMu sync.Mutex
+	clockSkews   = map[string]*skewEstimator{}
+)
+
+// clockSkewFor returns the estimator of issuer, nil when calibration is off
+func clockSkewFor(issuer string) *skewEstimator {
+	if clockSkewMax == 0 {
+		return nil
+	}
+	clockSkewsMu.Lock()
+	defer clockSkewsMu.Unlock()
+	e, ok := clockSkews[issuer]
+	if !ok {
+		e = newSkewEstimator(clockSkewMax, clockSkewWindow)
+		clockSkews[issuer] = e
+	}
+	return e
+}
+
+// issuerNow is the current time on issuer's clock as far as it is known
+func issuerNow(issuer string) time.Time {
+	return time.Now().Add(-clockSkewFor(issuer).Skew())
+}
+
+// observeIssuedAt feeds the iat of a token verified for issuer into its
+// estimate
+func observeIssuedAt(issuer string, iat int64) {
+	e := clockSkewFor(issuer)
+	if e == nil {
+		return
+	}
+	e.ObserveIssuedAt(iat)
+	clockSkewSeconds.WithLabelValues(issuer).Set(e.Skew().Seconds())
+}
+
+// watchIssuerClock probes JWT_CLOCK_SKEW_URL every minute until ctx ends
+func watchIssuerClock(ctx context.Context) {
+	e := clockSkewFor(jwtIssuer)
+	if e == nil || clockSkewURL == "" {
+		return
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		if offset, err := probeClockOffset(ctx, client, clockSkewURL); err != nil {
+			log.Warnf("[JWT-FLOW] Failed to read the issuer's clock from %s: %v", clockSkewURL, err)
+		} else {
+			e.ObserveDate(offset)
+			clockSkewSeconds.WithLabelValues(jwtIssuer).Set(e.Skew().Seconds())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(clockSkewProbeInterval):
+		}
+	}
+}
+
+// probeClockOffset measures how far the local clock is ahead of the one
+// serving url, from the Date header of a HEAD request
+func probeClockOffset(ctx context.Context, client *http.Client, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header: %v", err)
+	}
+	// Date is truncated to the second, half a second early on average
+	mid := sent.Add(received.Sub(sent) / 2)
+	return mid.Sub(date.Add(500 * time.Millisecond)), nil
+}
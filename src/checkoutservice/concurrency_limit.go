@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Adaptive concurrency limit
+//
+// With CONCURRENCY_LIMIT=adaptive, checkout admits only as many unary
+// requests at once as it handles without queueing internally. The limit
+// starts at CONCURRENCY_LIMIT_INITIAL (default 20) and moves between
+// CONCURRENCY_LIMIT_MIN and CONCURRENCY_LIMIT_MAX (4 and 200) by AIMD on
+// latency: it grows by one per limit's worth of requests completing within
+// twice the lowest latency seen recently, and shrinks by 10%, at most once
+// per that latency, when one is slower or fails with Unavailable,
+// DeadlineExceeded or ResourceExhausted.
+//
+// Requests over the limit wait in a queue per x-request-priority, bounded
+// by CONCURRENCY_QUEUE_SIZE (default 50), and get the next free slot high
+// priority first. A request that finds its queue full, or waits longer than
+// CONCURRENCY_QUEUE_TIMEOUT (default 100ms), is rejected like a shed one
+// (load_shedding.go): ResourceExhausted with a retry pushback, which the
+// frontend's retry interceptor waits out. Streams aren't limited; their
+// lifetime says nothing about load.
+
+const (
+	concurrencyTolerance  = 2.0
+	concurrencyBackoff    = 0.9
+	concurrencyRTTWindow  = 10 * time.Second
+	concurrencyRejectFull = "queue_full"
+	concurrencyRejectWait = "queue_timeout"
+	concurrencyRejectGone = "canceled"
+)
+
+// concurrencyPriorities are served in this order
+var concurrencyPriorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+var (
+	concurrencyLimitGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "concurrency_limit",
+		Help: "Current adaptive concurrency limit of inbound unary RPCs.",
+	})
+	concurrencyQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "concurrency_queue_wait_seconds",
+		Help:    "Time admitted requests waited for a concurrency slot, by x-request-priority.",
+		Buckets: prometheus.ExponentialBuckets(1e-4, 4, 8),
+	}, []string{"priority"})
+	concurrencyRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "concurrency_rejected_total",
+		Help: "Requests rejected by the concurrency limiter, by x-request-priority and reason.",
+	}, []string{"priority", "reason"})
+)
+
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// concurrencyLimiter is an AIMD concurrency limit with priority queues
+type concurrencyLimiter struct {
+	min, max     float64
+	queueSize    int
+	queueTimeout time.Duration
+
+	mu          sync.Mutex
+	limit       float64
+	inflight    int
+	queues      map[string][]*concurrencyWaiter
+	minRTT      time.Duration
+	minRTTSince time.Time
+	lastDrop    time.Time
+}
+
+var concurrency = loadConcurrencyLimiter()
+
+func loadConcurrencyLimiter() *concurrencyLimiter {
+	if os.Getenv("CONCURRENCY_LIMIT") != "adaptive" {
+		return nil
+	}
+	intEnv := func(key string, def int) int {
+		if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+			return n
+		}
+		return def
+	}
+	timeout := 100 * time.Millisecond
+	if d, err := time.ParseDuration(os.Getenv("CONCURRENCY_QUEUE_TIMEOUT")); err == nil && d >= 0 {
+		timeout = d
+	}
+	return newConcurrencyLimiter(intEnv("CONCURRENCY_LIMIT_INITIAL", 20), intEnv("CONCURRENCY_LIMIT_MIN", 4),
+		intEnv("CONCURRENCY_LIMIT_MAX", 200), intEnv("CONCURRENCY_QUEUE_SIZE", 50), timeout)
+}
+
+func newConcurrencyLimiter(initial, min, max, queueSize int, queueTimeout time.Duration) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		min:          float64(min),
+		max:          float64(max),
+		queueSize:    queueSize,
+		queueTimeout: queueTimeout,
+		limit:        math.Max(float64(min), math.Min(float64(initial), float64(max))),
+		queues:       make(map[string][]*concurrencyWaiter),
+	}
+	concurrencyLimitGauge.Set(l.limit)
+	return l
+}
+
+// Limit returns the current limit
+func (l *concurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Acquire waits for a slot for a request of priority; it returns the reason
+// when the request is rejected instead
+func (l *concurrencyLimiter) Acquire(ctx context.Context, priority string) (reason string, ok bool) {
+	start := time.Now()
+	l.mu.Lock()
+	if l.inflight < int(l.limit) && l.queued() == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return "", true
+	}
+	if len(l.queues[priority]) >= l.queueSize {
+		l.mu.Unlock()
+		return concurrencyRejectFull, false
+	}
+	w := &concurrencyWaiter{ready: make(chan struct{})}
+	l.queues[priority] = append(l.queues[priority], w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	reason = concurrencyRejectWait
+	select {
+	case <-w.ready:
+		concurrencyQueueWait.WithLabelValues(priority).Observe(time.Since(start).Seconds())
+		return "", true
+	case <-timer.C:
+	case <-ctx.Done():
+		reason = concurrencyRejectGone
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// The slot came while giving up; take it after all
+		concurrencyQueueWait.WithLabelValues(priority).Observe(time.Since(start).Seconds())
+		return "", true
+	}
+	q := l.queues[priority]
+	for i := range q {
+		if q[i] == w {
+			l.queues[priority] = append(q[:i], q[i+1:]...)
+			break
+		}
+	}
+	return reason, false
+}
+
+func (l *concurrencyLimiter) queued() int {
+	n := 0
+	for _, q := range l.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Release frees the slot of a request that took rtt and failed with code,
+// adjusts the limit and hands free slots to the queue
+func (l *concurrencyLimiter) Release(rtt time.Duration, code codes.Code) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if l.minRTT == 0 || rtt < l.minRTT || now.Sub(l.minRTTSince) > concurrencyRTTWindow {
+		l.minRTT, l.minRTTSince = rtt, now
+	}
+	overloaded := code == codes.Unavailable || code == codes.DeadlineExceeded || code == codes.ResourceExhausted
+	switch {
+	case overloaded || float64(rtt) > concurrencyTolerance*float64(l.minRTT):
+		if now.Sub(l.lastDrop) > l.minRTT {
+			l.limit = math.Max(l.min, l.limit*concurrencyBackoff)
+			l.lastDrop = now
+		}
+	case float64(l.inflight+1) >= l.limit/2:
+		// Only grow a limit that is in use
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	concurrencyLimitGauge.Set(l.limit)
+
+	for l.inflight < int(l.limit) {
+		w := l.dequeue()
+		if w == nil {
+			break
+		}
+		l.inflight++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+func (l *concurrencyLimiter) dequeue() *concurrencyWaiter {
+	for _, p := range concurrencyPriorities {
+		if q := l.queues[p]; len(q) > 0 {
+			l.queues[p] = q[1:]
+			return q[0]
+		}
+	}
+	return nil
+}
+
+// concurrencyLimitUnaryServerInterceptor holds requests to the adaptive
+// concurrency limit
+func concurrencyLimitUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if concurrency == nil || !requiresJWT(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	priority := requestPriority(md)
+	if reason, ok := concurrency.Acquire(ctx, priority); !ok {
+		concurrencyRejectedTotal.WithLabelValues(priority, reason).Inc()
+		trailer, err := shedStatus(info.FullMethod, priority)
+		grpc.SetTrailer(ctx, trailer)
+		return nil, err
+	}
+	start := time.Now()
+	var err error
+	defer func() { concurrency.Release(time.Since(start), status.Code(err)) }()
+	var resp interface{}
+	resp, err = handler(ctx, req)
+	return resp, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// TestConcurrencyLimiter checks that queued requests get free slots high
+// priority first, that full queues and long waits are rejected and that the
+// limit grows with fast requests and shrinks with slow ones
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newConcurrencyLimiter(1, 1, 1, 1, time.Second)
+	ctx := context.Background()
+	if _, ok := l.Acquire(ctx, priorityNormal); !ok {
+		t.Fatal("first request wasn't admitted")
+	}
+
+	order := make(chan string, 2)
+	for _, p := range []string{priorityLow, priorityHigh} {
+		go func(p string) {
+			if _, ok := l.Acquire(ctx, p); ok {
+				order <- p
+				l.Release(time.Millisecond, codes.OK)
+			}
+		}(p)
+		// Queue low before high
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			l.mu.Lock()
+			n := len(l.queues[p])
+			l.mu.Unlock()
+			if n == 1 || time.Now().After(deadline) {
+				break
+			}
+		}
+	}
+	if reason, ok := l.Acquire(ctx, priorityLow); ok || reason != concurrencyRejectFull {
+		t.Errorf("third request into a full low queue: %q, %v", reason, ok)
+	}
+	l.Release(time.Millisecond, codes.OK)
+	if first, second := <-order, <-order; first != priorityHigh || second != priorityLow {
+		t.Errorf("queue served %s before %s, want high first", first, second)
+	}
+
+	short := newConcurrencyLimiter(1, 1, 10, 5, 10*time.Millisecond)
+	short.Acquire(ctx, priorityNormal)
+	if reason, ok := short.Acquire(ctx, priorityHigh); ok || reason != concurrencyRejectWait {
+		t.Errorf("request waiting past the queue timeout: %q, %v", reason, ok)
+	}
+
+	aimd := newConcurrencyLimiter(4, 2, 8, 5, time.Millisecond)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 4; j++ {
+			aimd.Acquire(ctx, priorityNormal)
+		}
+		for j := 0; j < 4; j++ {
+			aimd.Release(time.Millisecond, codes.OK)
+		}
+	}
+	if n := aimd.Limit(); n != 8 {
+		t.Errorf("limit after fast requests = %d, want the maximum 8", n)
+	}
+	for i := 0; i < 20; i++ {
+		aimd.Acquire(ctx, priorityNormal)
+		aimd.lastDrop = time.Time{}
+		aimd.Release(time.Millisecond, codes.Unavailable)
+	}
+	if n := aimd.Limit(); n != 2 {
+		t.Errorf("limit after failing requests = %d, want the minimum 2", n)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/grpcserver"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/keyring"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/subjecthash"
+)
+
+// configReport collects every configuration problem so they can be reported
+// together rather than one restart at a time
+type configReport struct {
+	problems []string
+}
+
+func (c *configReport) addf(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *configReport) err() error {
+	if len(c.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration (%d problems):\n  - %s",
+		len(c.problems), strings.Join(c.problems, "\n  - "))
+}
+
+// checkBool flags values other than "true"/"false", which would otherwise be
+// silently read as false
+func (c *configReport) checkBool(key string) {
+	if v := os.Getenv(key); v != "" && v != "true" && v != "false" {
+		c.addf("%s=%q must be \"true\" or \"false\"", key, v)
+	}
+}
+
+// checkFloat flags values that don't parse or fall outside [min, max]
+func (c *configReport) checkFloat(key string, min, max float64) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || f > max {
+		c.addf("%s=%q must be a number between %g and %g", key, v, min, max)
+	}
+}
+
+// checkDuration flags values that are not positive Go durations
+func (c *configReport) checkDuration(key string) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+		c.addf("%s=%q must be a positive duration such as 5m", key, v)
+	}
+}
+
+// checkFile flags paths that can't be read
+func (c *configReport) checkFile(what, path string) {
+	if _, err := os.Stat(path); err != nil {
+		c.addf("%s %s is not readable: %v", what, path, err)
+	}
+}
+
+// validateConfig checks the JWT, context claims and SLO settings for
+// consistency before the server starts
+func validateConfig() error {
+	c := &configReport{}
+
+	c.checkBool("ENABLE_JWT_COMPRESSION")
+	c.checkBool("JWT_STREAM_BOUND_CLAIMS")
+	c.checkBool("JWT_TOKEN_BINDING")
+	tlsFiles := 0
+	for _, key := range []string{"GRPC_TLS_CERT_FILE", "GRPC_TLS_KEY_FILE", "GRPC_TLS_CA_FILE"} {
+		if path := os.Getenv(key); path != "" {
+			c.checkFile(key, path)
+			tlsFiles++
+		}
+	}
+	if tlsFiles != 0 && tlsFiles != 3 {
+		c.addf("GRPC_TLS_CERT_FILE, GRPC_TLS_KEY_FILE and GRPC_TLS_CA_FILE must be set together")
+	}
+	if os.Getenv("JWT_TOKEN_BINDING") == "true" && tlsFiles == 0 {
+		c.addf("JWT_TOKEN_BINDING=true needs GRPC_TLS_*: bound tokens are checked against TLS client certificates")
+	}
+	for relay := range parseBindingRelays(os.Getenv("JWT_BINDING_RELAYS")) {
+		if !validBindingRelay(relay) {
+			c.addf("JWT_BINDING_RELAYS entry %q is not a base64url SHA-256 certificate thumbprint", relay)
+		}
+	}
+	c.checkBool("JWT_DUAL_WRITE")
+	if v := os.Getenv("JWT_SPLIT_MIN_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			c.addf("JWT_SPLIT_MIN_BYTES=%q must be a non-negative integer", v)
+		}
+	}
+	if v := os.Getenv("OFREP_ENDPOINT"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("OFREP_ENDPOINT=%q must be an http(s) URL", v)
+	}
+	c.checkBool("REQUIRE_VERIFIED_EMAIL")
+	loader, err := keyring.FromEnv("JWT_PUBLIC_KEY", "")
+	if err != nil {
+		c.addf("%v", err)
+	} else if file, ok := loader.(keyring.File); ok {
+		c.checkFile("JWT_PUBLIC_KEY_FILE", string(file))
+	}
+	keyConfigured := loader != nil || err != nil
+	if configs, err := parseIssuerConfigs(os.Getenv("JWT_ISSUERS")); err != nil {
+		c.addf("%v", err)
+	} else if len(configs) > 0 && !keyConfigured {
+		c.addf("JWT_ISSUERS is set but no JWT public key is configured")
+	} else {
+		for _, ic := range configs {
+			l, err := keyring.FromEnv(ic.Keys, "")
+			switch {
+			case err != nil:
+				c.addf("JWT_ISSUERS issuer %q: %v", ic.Issuer, err)
+			case l == nil:
+				c.addf("JWT_ISSUERS issuer %q: neither %s_SOURCE nor %s_FILE is set", ic.Issuer, ic.Keys, ic.Keys)
+			default:
+				if file, ok := l.(keyring.File); ok {
+					c.checkFile(ic.Keys+"_FILE", string(file))
+				}
+			}
+		}
+	}
+	if v := os.Getenv("JWT_KEY_REFRESH_INTERVAL"); v != "0" {
+		c.checkDuration("JWT_KEY_REFRESH_INTERVAL")
+	}
+	if v := os.Getenv("JWT_KEY_MAX_STALENESS"); v != "0" {
+		c.checkDuration("JWT_KEY_MAX_STALENESS")
+	}
+	if v := os.Getenv("JWT_CLOCK_SKEW_MAX"); v != "" && v != "0" {
+		c.checkDuration("JWT_CLOCK_SKEW_MAX")
+		if d, err := time.ParseDuration(v); err == nil && d > 5*time.Minute {
+			c.addf("JWT_CLOCK_SKEW_MAX=%s is longer than 5m; fix the node's clock instead", v)
+		}
+	}
+	c.checkDuration("JWT_CLOCK_SKEW_WINDOW")
+	if v := os.Getenv("JWT_CLOCK_SKEW_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.addf("JWT_CLOCK_SKEW_URL=%q must be an http or https URL", v)
+		}
+		if clockSkewMax == 0 {
+			c.addf("JWT_CLOCK_SKEW_URL is set but JWT_CLOCK_SKEW_MAX is not")
+		}
+	}
+	if v := os.Getenv("JWT_CLAIMS_CACHE_TTL"); v != "0" {
+		c.checkDuration("JWT_CLAIMS_CACHE_TTL")
+	}
+	if v := os.Getenv("ORDER_DEDUPE_WINDOW"); v != "0" {
+		c.checkDuration("ORDER_DEDUPE_WINDOW")
+	}
+	if !keyConfigured && os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true" {
+		c.addf("REQUIRE_VERIFIED_EMAIL=true needs a JWT public key to verify the email claim")
+	}
+
+	if os.Getenv("ACTOR_JWT") != "" && os.Getenv("ACTOR_JWT_FILE") != "" {
+		c.addf("ACTOR_JWT and ACTOR_JWT_FILE are both set; set only one")
+	}
+	if path := os.Getenv("ACTOR_JWT_FILE"); path != "" {
+		c.checkFile("ACTOR_JWT_FILE", path)
+	}
+	if v := os.Getenv("CTX_CLAIMS_KEY"); v != "" && len(v) < 32 {
+		c.addf("CTX_CLAIMS_KEY must be at least 32 bytes for HS256, got %d", len(v))
+	}
+	if os.Getenv("ORDER_EVENTS_NATS_URL") != "" && len(os.Getenv("ORDER_EVENTS_KEY")) < 32 {
+		c.addf("ORDER_EVENTS_NATS_URL is set but ORDER_EVENTS_KEY is shorter than the 32 bytes HS256 needs")
+	}
+	c.checkDuration("ORDER_EVENTS_TTL")
+
+	c.checkBool("GRPC_XDS")
+	if os.Getenv("GRPC_XDS") == "true" {
+		if path := os.Getenv("GRPC_XDS_BOOTSTRAP"); path != "" {
+			c.checkFile("GRPC_XDS_BOOTSTRAP", path)
+		} else if os.Getenv("GRPC_XDS_BOOTSTRAP_CONFIG") == "" {
+			c.addf("GRPC_XDS=true needs GRPC_XDS_BOOTSTRAP or GRPC_XDS_BOOTSTRAP_CONFIG")
+		}
+	}
+	if _, err := subjecthash.Load(os.Getenv("SUBJECT_HASH_KEY_FILE")); err != nil {
+		c.addf("SUBJECT_HASH_KEY_FILE: %v", err)
+	}
+	if _, err := loadFieldSealer(); err != nil {
+		c.addf("JWT_FIELD_KEY_FILE: %v", err)
+	}
+	if _, err := parseGroupRoles(os.Getenv("CLAIMS_GROUP_ROLES")); err != nil {
+		c.addf("%v", err)
+	}
+	c.checkBool("JWT_VALIDATE_PAYLOAD")
+	if v, ok := os.LookupEnv("JWT_REQUIRED_CLAIMS"); ok && len(parseRequiredClaims(v)) == 0 {
+		c.addf("JWT_REQUIRED_CLAIMS is set but names no claims")
+	}
+	switch headerConflictPolicy {
+	case headerConflictStrict, headerConflictPreferSplit, headerConflictPreferAuthorization:
+	default:
+		c.addf("JWT_HEADER_CONFLICT_POLICY=%q must be strict, prefer-split or prefer-authorization", headerConflictPolicy)
+	}
+	if contractReportErr != nil {
+		c.addf("JWT_CONTRACT_REPORT: %v", contractReportErr)
+	}
+	if v := os.Getenv("JWT_REFERENCE_RESOLVER_URL"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("JWT_REFERENCE_RESOLVER_URL=%q must be an http(s) URL", v)
+	}
+	if _, err := keyring.FromEnv("EGRESS_CREDENTIALS", ""); err != nil {
+		c.addf("%v", err)
+	}
+	if v := os.Getenv("REST_PORT"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 16); err != nil || n == 0 {
+			c.addf("REST_PORT=%q must be a port number", v)
+		} else if v == os.Getenv("PORT") || v == os.Getenv("DEBUG_PORT") {
+			c.addf("REST_PORT=%q is already used by the gRPC or debug server", v)
+		}
+	}
+	if v := os.Getenv("GRPC_MAX_HEADER_LIST_SIZE"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil || n == 0 {
+			c.addf("GRPC_MAX_HEADER_LIST_SIZE=%q must be a positive number of bytes", v)
+		}
+	}
+	if v := os.Getenv("GRPC_HEADER_TABLE_SIZE"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil || n > grpcserver.MaxHeaderTableSize {
+			c.addf("GRPC_HEADER_TABLE_SIZE=%q must be a number of bytes up to %d, grpc-go can't decode with a larger table", v, grpcserver.MaxHeaderTableSize)
+		}
+	}
+	switch v := os.Getenv("JWT_HEADER_OVERFLOW_FALLBACK"); v {
+	case "", "bearer", "gzip-split", "off":
+	default:
+		c.addf("JWT_HEADER_OVERFLOW_FALLBACK=%q must be bearer, gzip-split or off", v)
+	}
+	if v := os.Getenv("JWT_DOWNGRADE_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			c.addf("JWT_DOWNGRADE_THRESHOLD=%q must be a number of failures, 0 to turn downgrades off", v)
+		}
+	}
+	c.checkDuration("JWT_DOWNGRADE_COOLDOWN")
+	if v := os.Getenv("ACCESS_LOG_SAMPLE"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.addf("ACCESS_LOG_SAMPLE=%q must be a non-negative integer (1 in N calls)", v)
+		}
+	}
+	c.checkDuration("ACCESS_LOG_SLOW")
+	if v := os.Getenv("LOAD_SHED_MAX_INFLIGHT"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.addf("LOAD_SHED_MAX_INFLIGHT=%q must be a non-negative number of requests, 0 to turn shedding off", v)
+		}
+	}
+	c.checkDuration("LOAD_SHED_PUSHBACK")
+	if v := os.Getenv("CONCURRENCY_LIMIT"); v != "" && v != "adaptive" {
+		c.addf("CONCURRENCY_LIMIT=%q must be \"adaptive\" or empty", v)
+	}
+	for _, key := range []string{"CONCURRENCY_LIMIT_INITIAL", "CONCURRENCY_LIMIT_MIN", "CONCURRENCY_LIMIT_MAX", "CONCURRENCY_QUEUE_SIZE"} {
+		if v := os.Getenv(key); v != "" {
+			if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+				c.addf("%s=%q must be a positive integer", key, v)
+			}
+		}
+	}
+	if min, max := os.Getenv("CONCURRENCY_LIMIT_MIN"), os.Getenv("CONCURRENCY_LIMIT_MAX"); min != "" && max != "" {
+		if lo, _ := strconv.Atoi(min); lo > 0 {
+			if hi, _ := strconv.Atoi(max); hi > 0 && lo > hi {
+				c.addf("CONCURRENCY_LIMIT_MIN=%s is above CONCURRENCY_LIMIT_MAX=%s", min, max)
+			}
+		}
+	}
+	c.checkDuration("CONCURRENCY_QUEUE_TIMEOUT")
+	if authTimingAllowErr != nil {
+		c.addf("%v", authTimingAllowErr)
+	}
+	c.checkFloat("JWT_CAPTURE_RATE", 0, 1)
+	if os.Getenv("JWT_CAPTURE_RATE") != "" && os.Getenv("JWT_CAPTURE_FILE") == "" {
+		c.addf("JWT_CAPTURE_RATE is set but JWT_CAPTURE_FILE is not")
+	}
+	if v := os.Getenv("PYROSCOPE_SERVER_ADDRESS"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("PYROSCOPE_SERVER_ADDRESS=%q must be an http(s) URL", v)
+	}
+
+	c.checkFloat("JWT_SLO_TARGET", 0, 1)
+	if v := os.Getenv("JWT_SLO_TARGET"); v == "0" || v == "1" {
+		c.addf("JWT_SLO_TARGET=%q must be strictly between 0 and 1", v)
+	}
+	c.checkDuration("JWT_SLO_WINDOW")
+	c.checkFloat("JWT_SLO_BURN_RATE", 0, 1000)
+
+	return c.err()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// JWT_CONTRACT_REPORT points at the JSON written by the contract tests in
+// test-suite/integration. Downstreams whose verdict is "authorization" get
+// the Bearer header as if listed in JWT_FORCE_AUTHORIZATION_FOR.
+
+const (
+	contractVerdictSplit         = "split"
+	contractVerdictAuthorization = "authorization"
+	contractVerdictBroken        = "broken"
+)
+
+type contractReport struct {
+	Services map[string]contractResult `json:"services"`
+}
+
+type contractResult struct {
+	Method   string            `json:"method"`
+	Outcomes map[string]string `json:"outcomes"`
+	Codecs   string            `json:"codecs,omitempty"`
+	Verdict  string            `json:"verdict"`
+}
+
+var contractServices, contractReportErr = loadContractReport(os.Getenv("JWT_CONTRACT_REPORT"))
+
+// loadContractReport reads the report at path; no path means no report
+func loadContractReport(path string) (map[string]contractResult, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report contractReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for service, r := range report.Services {
+		switch r.Verdict {
+		case contractVerdictSplit, contractVerdictAuthorization, contractVerdictBroken:
+		default:
+			return nil, fmt.Errorf("%s: unknown verdict %q for %s", path, r.Verdict, service)
+		}
+	}
+	return report.Services, nil
+}
+
+// contractRequiresAuthorization reports whether the contract tests found
+// that service rejects the split headers but accepts the Bearer header
+func contractRequiresAuthorization(service string) bool {
+	return contractServices[service].Verdict == contractVerdictAuthorization
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// x-ctx-claims carries order-level context claims next to the user JWT. It is
+// a compact HS256 JWS signed with the mesh-shared CTX_CLAIMS_KEY, so shipping
+// and email can trust it without calling back into checkout. The claims name
+// the sub and jti of the verified user token the order is placed under, and
+// receivers ignore them on a call carrying any other token.
+const (
+	mdCtxClaims     = "x-ctx-claims"
+	ctxClaimsTTL    = 5 * time.Minute
+	ctxClaimsHeader = `{"alg":"HS256","typ":"ctx+jwt"}`
+)
+
+// OrderClaims are the order-level attributes added by the enrichment stage
+type OrderClaims struct {
+	OrderID         string `json:"order_id"`
+	CartValueBucket string `json:"cart_value_bucket"`
+	Currency        string `json:"currency"`
+	Subject         string `json:"sub"`
+	TokenID         string `json:"jti"`
+	IssuedAt        int64  `json:"iat"`
+	ExpiresAt       int64  `json:"exp"`
+}
+
+// Context key for the order claims of the order being placed
+type ctxKeyOrderClaims struct{}
+
+// ctxClaimsKey is the HMAC key; enrichment is disabled when it is empty
+var ctxClaimsKey = []byte(os.Getenv("CTX_CLAIMS_KEY"))
+
+// cartValueBucket coarsens an order total so downstream services can make
+// decisions (e.g. shipping tier) without seeing the exact amount
+func cartValueBucket(total *pb.Money) string {
+	switch units := total.GetUnits(); {
+	case units < 25:
+		return "lt25"
+	case units < 100:
+		return "25-100"
+	case units < 500:
+		return "100-500"
+	default:
+		return "gte500"
+	}
+}
+
+// withOrderClaims stores the order claims for the enrichment interceptor,
+// bound to the verified user token; without one there are none
+func withOrderClaims(ctx context.Context, orderID string, total *pb.Money) context.Context {
+	user, err := VerifiedUserClaims(ctx)
+	if err != nil {
+		return ctx
+	}
+	now := time.Now()
+	return context.WithValue(ctx, ctxKeyOrderClaims{}, &OrderClaims{
+		OrderID:         orderID,
+		CartValueBucket: cartValueBucket(total),
+		Currency:        total.GetCurrencyCode(),
+		Subject:         user.Subject,
+		TokenID:         user.ID,
+		IssuedAt:        now.Unix(),
+		ExpiresAt:       now.Add(ctxClaimsTTL).Unix(),
+	})
+}
+
+// signCtxClaims encodes and signs the claims as a compact JWS
+func signCtxClaims(claims *OrderClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode context claims: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(ctxClaimsHeader)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, ctxClaimsKey)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// shouldEnrich limits x-ctx-claims to the services that consume it
+func shouldEnrich(method string) bool {
+	return strings.Contains(method, "ShippingService") || strings.Contains(method, "EmailService")
+}
+
+// ctxClaimsUnaryClientInterceptor attaches the signed order claims to calls
+// made to shipping and email while an order is being placed
+func ctxClaimsUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	claims, ok := ctx.Value(ctxKeyOrderClaims{}).(*OrderClaims)
+	if !ok || len(ctxClaimsKey) == 0 || !shouldEnrich(method) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	signed, err := signCtxClaims(claims)
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] %v, calling %s without context claims", err, method)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, mdCtxClaims, signed)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/jwttest"
+)
+
+// TestCtxClaimsBinding checks that the signed order claims name the sub and
+// jti of the verified user token, and that there are none without one
+func TestCtxClaimsBinding(t *testing.T) {
+	iss := jwttest.RS256()
+	useTestIssuer(t, iss)
+	defer func(key []byte) { ctxClaimsKey = key }(ctxClaimsKey)
+	ctxClaimsKey = []byte("ctx-claims-key")
+
+	sent := func(ctx context.Context) string {
+		var md metadata.MD
+		invoker := func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+			md, _ = metadata.FromOutgoingContext(ctx)
+			return nil
+		}
+		if err := ctxClaimsUnaryClientInterceptor(ctx, "/hipstershop.ShippingService/ShipOrder", nil, nil, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+		if v := md.Get(mdCtxClaims); len(v) == 1 {
+			return v[0]
+		}
+		return ""
+	}
+	total := &pb.Money{CurrencyCode: "USD", Units: 42}
+
+	token := iss.Mint(jwttest.Claims{"sub": "alice", "jti": "jti-1"})
+	ctx := withClaimsMemo(context.WithValue(context.Background(), ctxKeyJWT{}, token))
+	signed := sent(withOrderClaims(ctx, "order-1", total))
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		t.Fatalf("x-ctx-claims = %q", signed)
+	}
+	if want, _ := signCtxClaims(decodeOrderClaims(t, parts[1])); want != signed {
+		t.Error("x-ctx-claims signature does not verify")
+	}
+	if claims := decodeOrderClaims(t, parts[1]); claims.Subject != "alice" || claims.TokenID != "jti-1" || claims.OrderID != "order-1" {
+		t.Errorf("order claims = %+v, want bound to alice's jti-1", claims)
+	}
+
+	unverified := withClaimsMemo(context.WithValue(context.Background(), ctxKeyJWT{}, jwttest.BadSignature(token)))
+	if got := sent(withOrderClaims(unverified, "order-2", total)); got != "" {
+		t.Errorf("order claims sent for an unverified token: %q", got)
+	}
+}
+
+func decodeOrderClaims(t *testing.T, payload string) *OrderClaims {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &OrderClaims{}
+	if err := json.Unmarshal(b, claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
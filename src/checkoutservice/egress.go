@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/keyring"
+)
+
+// Egress to third parties
+//
+// HTTP calls leaving the mesh (payment gateways, flag services) go through
+// newEgressClient. Its transport drops every header that can carry the
+// user's token or claims, refuses a call whose remaining headers or URL
+// still hold the token's signature, and attaches the credentials configured
+// for the host. The credentials are a JSON object of host to headers,
+//
+//	{"payments.example.com": {"Authorization": "Bearer sk_live_..."}}
+//
+// loaded like a JWT key from the source EGRESS_CREDENTIALS_SOURCE selects
+// (file, env, secret or vault, see keyring.FromEnv). Every call is logged
+// with what was stripped and attached, header names only.
+
+// egressStripped are dropped from every egress request; prefixes end in -
+var egressStripped = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"x-jwt-",
+	"x-ctx-claims",
+	"x-auth-timing",
+	"x-debug-auth-timing",
+	"x-request-priority",
+}
+
+// errEgressTokenLeak refuses a call that would carry the user's token
+var errEgressTokenLeak = errors.New("egress: request carries the user token")
+
+var (
+	// egressCredentials maps a host to the headers attached for it
+	egressCredentials map[string]map[string]string
+	egressCalls       = expvar.NewMap("egress_calls")
+)
+
+// loadEgressCredentials loads EGRESS_CREDENTIALS; none configured is fine
+func loadEgressCredentials(ctx context.Context) error {
+	loader, err := keyring.FromEnv("EGRESS_CREDENTIALS", "")
+	if err != nil || loader == nil {
+		return err
+	}
+	data, err := loader.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("EGRESS_CREDENTIALS from %s: %w", loader, err)
+	}
+	creds, err := parseEgressCredentials(data)
+	if err != nil {
+		return fmt.Errorf("EGRESS_CREDENTIALS from %s: %w", loader, err)
+	}
+	egressCredentials = creds
+	log.Infof("[EGRESS] credentials for %d hosts loaded from %s", len(creds), loader)
+	return nil
+}
+
+func parseEgressCredentials(data []byte) (map[string]map[string]string, error) {
+	var creds map[string]map[string]string
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, err
+	}
+	for host, headers := range creds {
+		for name := range headers {
+			if egressStrippedHeader(name) && !strings.EqualFold(name, "authorization") {
+				return nil, fmt.Errorf("%s: header %s would leak internal auth and is not allowed", host, name)
+			}
+		}
+	}
+	return creds, nil
+}
+
+// newEgressClient returns a client for third-party calls named name in the
+// audit log. Credentials are attached per host, so a redirect elsewhere
+// doesn't take them along.
+func newEgressClient(name string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &egressTransport{name: name, base: http.DefaultTransport},
+	}
+}
+
+type egressTransport struct {
+	name string
+	base http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	out := req.Clone(req.Context())
+	var stripped []string
+	for name := range out.Header {
+		if egressStrippedHeader(name) {
+			stripped = append(stripped, name)
+			out.Header.Del(name)
+		}
+	}
+	entry := log.WithField("egress", t.name).
+		WithField("method", out.Method).
+		WithField("host", out.URL.Host).
+		WithField("path", out.URL.Path)
+	if len(stripped) > 0 {
+		entry = entry.WithField("stripped", stripped)
+	}
+
+	if leaksUserToken(req.Context(), out) {
+		egressCalls.Add(t.name+" refused", 1)
+		entry.Warn("[EGRESS] refused: the request carries the user token")
+		return nil, errEgressTokenLeak
+	}
+
+	var attached []string
+	for name, value := range egressCredentials[out.URL.Hostname()] {
+		out.Header.Set(name, value)
+		attached = append(attached, name)
+	}
+	if len(attached) > 0 {
+		entry = entry.WithField("credentials", attached)
+	}
+
+	resp, err := t.base.RoundTrip(out)
+	entry = entry.WithField("duration_ms", time.Since(start).Milliseconds())
+	if err != nil {
+		egressCalls.Add(t.name+" error", 1)
+		entry.WithField("error", err).Warn("[EGRESS] call failed")
+		return nil, err
+	}
+	egressCalls.Add(t.name, 1)
+	entry.WithField("status", resp.StatusCode).Info("[EGRESS] call")
+	return resp, nil
+}
+
+func egressStrippedHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range egressStripped {
+		if name == s || strings.HasSuffix(s, "-") && strings.HasPrefix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaksUserToken reports whether the signature of the user token in ctx
+// appears in req's URL or headers, however it got there
+func leaksUserToken(ctx context.Context, req *http.Request) bool {
+	token, ok := UserJWTFromContext(ctx)
+	if !ok {
+		return false
+	}
+	sig := token[strings.LastIndexByte(token, '.')+1:]
+	if len(sig) < 16 {
+		return false
+	}
+	if strings.Contains(req.URL.String(), sig) {
+		return true
+	}
+	for _, values := range req.Header {
+		for _, v := range values {
+			if strings.Contains(v, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
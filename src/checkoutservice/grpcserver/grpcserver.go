@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcserver builds gRPC servers with limits suited to header-heavy
+// traffic. Split JWTs move most of a token's bytes into metadata, where a
+// large IdP token (hundreds of groups) runs into the 8KB header limits common
+// in HTTP/2 stacks. New advertises an explicit limit with room for such
+// tokens, enforces keepalive and caps streams around the service's
+// interceptor chain; every server of the service should start from it.
+package grpcserver
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/stats"
+)
+
+const (
+	// DefaultMaxHeaderListSize fits the largest golden token split or whole
+	// with room for HPACK overhead: 480KB of headers plus 32KB
+	DefaultMaxHeaderListSize = 512 << 10
+	// DefaultMaxConcurrentStreams bounds the streams one client connection
+	// can hold open, and with it the header memory it can pin
+	DefaultMaxConcurrentStreams = 1000
+	// MaxHeaderTableSize caps GRPC_HEADER_TABLE_SIZE. grpc-go decodes
+	// request headers with a fixed 4096-byte HPACK table whatever the server
+	// advertises, so a larger SETTINGS_HEADER_TABLE_SIZE would invite peers
+	// like Envoy to send table size updates the server then rejects.
+	MaxHeaderTableSize = 4096
+)
+
+// Keepalive enforcement: clients may ping every 10s, also between calls, so
+// idle connections (and their HPACK tables) survive without being killed for
+// too many pings; connections idle for 15 minutes are closed.
+var (
+	enforcement = keepalive.EnforcementPolicy{
+		MinTime:             10 * time.Second,
+		PermitWithoutStream: true,
+	}
+	parameters = keepalive.ServerParameters{
+		MaxConnectionIdle: 15 * time.Minute,
+		Time:              time.Minute,
+		Timeout:           20 * time.Second,
+	}
+)
+
+// Options are the service-specific parts of a server
+type Options struct {
+	// Unary and Stream are the interceptor chain, outermost first
+	Unary  []grpc.UnaryServerInterceptor
+	Stream []grpc.StreamServerInterceptor
+	// StatsHandler is optional
+	StatsHandler stats.Handler
+	// MaxHeaderListSize and MaxConcurrentStreams override the defaults when
+	// non-zero; GRPC_MAX_HEADER_LIST_SIZE overrides the header default too
+	MaxHeaderListSize    uint32
+	MaxConcurrentStreams uint32
+	// Extra is appended after the options New sets, so it can override them
+	Extra []grpc.ServerOption
+}
+
+// New returns a server configured from o
+func New(o Options) *grpc.Server {
+	headerList := uint32(DefaultMaxHeaderListSize)
+	if n, err := strconv.ParseUint(os.Getenv("GRPC_MAX_HEADER_LIST_SIZE"), 10, 32); err == nil && n > 0 {
+		headerList = uint32(n)
+	}
+	if o.MaxHeaderListSize != 0 {
+		headerList = o.MaxHeaderListSize
+	}
+	streams := uint32(DefaultMaxConcurrentStreams)
+	if o.MaxConcurrentStreams != 0 {
+		streams = o.MaxConcurrentStreams
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(o.Unary...),
+		grpc.ChainStreamInterceptor(o.Stream...),
+		grpc.MaxHeaderListSize(headerList),
+		grpc.MaxConcurrentStreams(streams),
+		grpc.KeepaliveEnforcementPolicy(enforcement),
+		grpc.KeepaliveParams(parameters),
+	}
+	if o.StatsHandler != nil {
+		opts = append(opts, grpc.StatsHandler(o.StatsHandler))
+	}
+	if size, ok := HeaderTableSize(); ok {
+		opts = append(opts, grpc.HeaderTableSize(size))
+	}
+	return grpc.NewServer(append(opts, o.Extra...)...)
+}
+
+// HeaderTableSize is the SETTINGS_HEADER_TABLE_SIZE set by
+// GRPC_HEADER_TABLE_SIZE, capped at MaxHeaderTableSize. It bounds the HPACK
+// table clients may use to compress request headers, so lowering it trades
+// the split JWT's repeat-request savings for memory per connection, and 0
+// turns indexing off. ok is false when unset: grpc-go then advertises
+// nothing and peers use the 4096-byte default. grpc-go clients have no
+// equivalent option; their encoders follow what the server advertises.
+func HeaderTableSize() (size uint32, ok bool) {
+	n, err := strconv.ParseUint(os.Getenv("GRPC_HEADER_TABLE_SIZE"), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(min(n, MaxHeaderTableSize)), true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/grpcserver"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/jwtcodec"
+)
+
+// Header list overflow
+//
+// A peer advertising a smaller SETTINGS_MAX_HEADER_LIST_SIZE than the split
+// headers need (a proxy, or a receiver with GRPC_MAX_HEADER_LIST_SIZE set
+// low) refuses the call before any handler runs. Such a unary call is
+// retried once with JWT_HEADER_OVERFLOW_FALLBACK:
+//
+//	bearer      the compact token in authorization (default)
+//	gzip-split  the gzip-split codec, falling back to bearer
+//	off         no retry
+//
+// The smallest token that overflowed is remembered per service, and later
+// calls with tokens at least that large go straight to the fallback. Sizes
+// are compact token sizes, so split pass-through isn't reassembled unless it
+// has to fall back. Streams report the failure only once open and aren't
+// retried.
+
+var headerOverflowFallback = loadHeaderOverflowFallback()
+
+func loadHeaderOverflowFallback() string {
+	if v := os.Getenv("JWT_HEADER_OVERFLOW_FALLBACK"); v != "" {
+		return v
+	}
+	return "bearer"
+}
+
+// headerOverflowTotal counts overflows by outcome: retried, retry_failed,
+// failed (fallback off) and avoided (sent in the fallback format directly)
+var headerOverflowTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jwt_header_overflow_total",
+	Help: "Calls whose split JWT headers exceeded the peer's header list limit.",
+}, []string{"service", "outcome"})
+
+// maxHeaderListSize is the header list limit advertised to servers,
+// GRPC_MAX_HEADER_LIST_SIZE bytes like checkout's own server
+func maxHeaderListSize() uint32 {
+	if n, err := strconv.ParseUint(os.Getenv("GRPC_MAX_HEADER_LIST_SIZE"), 10, 32); err == nil && n > 0 {
+		return uint32(n)
+	}
+	return grpcserver.DefaultMaxHeaderListSize
+}
+
+// isHeaderOverflow reports whether err is a peer refusing the request's
+// header list: gRPC's own check against the peer's advertised limit, a gRPC
+// server resetting the stream with FRAME_SIZE_ERROR, a proxy resetting it
+// with ENHANCE_YOUR_CALM or answering HTTP 431
+func isHeaderOverflow(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	msg := s.Message()
+	switch s.Code() {
+	case codes.Internal:
+		return strings.Contains(msg, "header list size") || strings.Contains(msg, "FRAME_SIZE_ERROR")
+	case codes.ResourceExhausted:
+		return strings.Contains(msg, "ENHANCE_YOUR_CALM")
+	case codes.Unknown, codes.Unavailable:
+		return strings.Contains(msg, "431")
+	}
+	return false
+}
+
+// overflowLimits remembers per service the smallest token that overflowed
+type overflowLimits struct {
+	mu     sync.RWMutex
+	limits map[string]int
+}
+
+var headerOverflows = &overflowLimits{limits: make(map[string]int)}
+
+func (l *overflowLimits) Exceeds(service string, size int) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	limit, ok := l.limits[service]
+	return ok && size >= limit
+}
+
+func (l *overflowLimits) Record(service string, size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit, ok := l.limits[service]; !ok || size < limit {
+		l.limits[service] = size
+	}
+}
+
+// splitJWTKeys are the metadata keys replaced by the fallback format
+var splitJWTKeys = []string{
+	"x-jwt-header", "x-jwt-payload", "x-jwt-sig",
+	"x-jwt-claims", "x-jwt-static", "x-jwt-static-sha", "x-jwt-session", "x-jwt-dynamic",
+	"x-jwt-payload-gz-bin", "x-jwt-cbor-bin", "x-jwt-pb-bin", "x-jwt-ref",
+}
+
+// carriesSplitJWT reports whether ctx's outgoing metadata sends the token in
+// a format other than authorization
+func carriesSplitJWT(ctx context.Context) bool {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, k := range splitJWTKeys {
+		if len(md.Get(k)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withOverflowFallback replaces the split headers of ctx with token in the
+// fallback format
+func withOverflowFallback(ctx context.Context, token string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, k := range splitJWTKeys {
+		delete(md, k)
+	}
+	if headerOverflowFallback == "gzip-split" {
+		if gz, err := jwtcodec.Encode("gzip-split", token); err == nil {
+			return metadata.NewOutgoingContext(ctx, metadata.Join(md, gz))
+		}
+	}
+	md.Set("authorization", "Bearer "+token)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// userJWTSize is the compact size of the user token in ctx, 0 without one
+func userJWTSize(ctx context.Context) int {
+	if token, ok := ctx.Value(ctxKeyJWT{}).(string); ok {
+		return len(token)
+	}
+	if payload, ok := ctx.Value(ctxKeyJWTPayload{}).(string); ok && payload != "" {
+		header, _ := ctx.Value(ctxKeyJWTHeader{}).(string)
+		sig, _ := ctx.Value(ctxKeyJWTSig{}).(string)
+		return encodedJWTSize(header, payload, sig)
+	}
+	return 0
+}
+
+// overflowInvoker wraps invoker so a call carrying the user token of
+// tokenCtx, size bytes compact, in split headers that the peer refuses is
+// retried in the fallback format
+func overflowInvoker(invoker grpc.UnaryInvoker, tokenCtx context.Context, size int) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		service := serviceFromMethod(method)
+		token, ok := "", false
+		if headerOverflowFallback != "off" && headerOverflows.Exceeds(service, size) && carriesSplitJWT(ctx) {
+			if token, ok = UserJWTFromContext(tokenCtx); ok {
+				headerOverflowTotal.WithLabelValues(service, "avoided").Inc()
+				return invoker(withOverflowFallback(ctx, token), method, req, reply, cc, opts...)
+			}
+		}
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if !isHeaderOverflow(err) || !carriesSplitJWT(ctx) {
+			return err
+		}
+		headerOverflows.Record(service, size)
+		if headerOverflowFallback == "off" {
+			headerOverflowTotal.WithLabelValues(service, "failed").Inc()
+			return err
+		}
+		if token, ok = UserJWTFromContext(tokenCtx); !ok {
+			return err
+		}
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] %s refused the split JWT headers, retrying with %s: %v", service, headerOverflowFallback, err)
+		if err = invoker(withOverflowFallback(ctx, token), method, req, reply, cc, opts...); err != nil {
+			headerOverflowTotal.WithLabelValues(service, "retry_failed").Inc()
+		} else {
+			headerOverflowTotal.WithLabelValues(service, "retried").Inc()
+		}
+		return err
+	}
+}
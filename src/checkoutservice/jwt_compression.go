@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -19,9 +20,12 @@ type JWTComponents struct {
 	Signature string // Original signature (base64url encoded, unchanged)
 }
 
+// jwtCompressionEnv is ENABLE_JWT_COMPRESSION, read once at startup
+var jwtCompressionEnv = os.Getenv("ENABLE_JWT_COMPRESSION") == "true"
+
 // IsJWTCompressionEnabled checks if JWT compression is enabled via environment variable
 func IsJWTCompressionEnabled() bool {
-	return os.Getenv("ENABLE_JWT_COMPRESSION") == "true"
+	return jwtCompressionEnv
 }
 
 // DecomposeJWT splits a JWT for optimized transmission
@@ -72,3 +76,82 @@ func GetJWTComponentSizes(components *JWTComponents) map[string]int {
 		"total":     len(components.Header) + len(components.Payload) + len(components.Signature),
 	}
 }
+
+// claimMember is one top-level member of a JSON object, value kept verbatim
+type claimMember struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// claimMembers parses a JSON object into its members in document order
+func claimMembers(obj string) ([]claimMember, error) {
+	dec := json.NewDecoder(strings.NewReader(obj))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("claims are not a JSON object")
+	}
+	var members []claimMember
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		members = append(members, claimMember{Key: key, Value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// encodeClaimMembers writes members as a compact JSON object
+func encodeClaimMembers(members []claimMember) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.Key)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(m.Value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// mergeClaimBlocks rebuilds the raw JSON payload from claim-classified
+// blocks: the members of all blocks, in the key order given by x-jwt-claims
+func mergeClaimBlocks(order string, blocks ...string) (string, error) {
+	var keys []string
+	if err := json.Unmarshal([]byte(order), &keys); err != nil {
+		return "", fmt.Errorf("invalid claim order: %w", err)
+	}
+	values := make(map[string]json.RawMessage, len(keys))
+	for _, block := range blocks {
+		if block == "" {
+			continue
+		}
+		members, err := claimMembers(block)
+		if err != nil {
+			return "", fmt.Errorf("invalid claim block: %w", err)
+		}
+		for _, m := range members {
+			values[m.Key] = m.Value
+		}
+	}
+	members := make([]claimMember, len(keys))
+	for i, k := range keys {
+		v, ok := values[k]
+		if !ok {
+			return "", fmt.Errorf("claim %q missing from claim blocks", k)
+		}
+		members[i] = claimMember{Key: k, Value: v}
+	}
+	return encodeClaimMembers(members), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
@@ -19,15 +20,48 @@ type ctxKeyJWTSig struct{}
 // jwtUnaryServerInterceptor extracts JWT from incoming metadata and stores in context
 func jwtUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
+	grpc.SetHeader(ctx, codecAdvertisement())
+	ctx = withRequestLogger(ctx, info.FullMethod, md)
+	ctx = withActorJWT(ctx, md)
 	if !ok {
 		// No metadata, continue without JWT
+		recordIncomingJWT(ctx, info.FullMethod, false)
 		return handler(ctx, req)
 	}
+	if err := checkDuplicateHeaders(ctx, info.FullMethod, md); err != nil {
+		return nil, err
+	}
 
 	var jwtToken string
 
-	// Check for compressed JWT format (x-jwt-payload header)
-	if payloadHeaders := md.Get("x-jwt-payload"); len(payloadHeaders) > 0 {
+	// Check for compressed JWT format (x-jwt-payload, or claim blocks)
+	start := time.Now()
+	payload, split, err := splitPayloadFromMetadata(md)
+	if split {
+		observeReassembly(md, start)
+		accessFromContext(ctx).reassembled(time.Since(start))
+	}
+	if isStaticBlockUnknown(err) {
+		// Not a failure: the sender resends the full block
+		return nil, err
+	}
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to merge JWT claim blocks: %v", err)
+		jwtSLO.RecordFailure(sloReasonReassembly)
+		if derr := reassemblyFailed(ctx, info.FullMethod); derr != nil {
+			return nil, derr
+		}
+	}
+	if split && err == nil {
+		useAuthorization, cerr := resolveHeaderConflict(md, payload)
+		if cerr != nil {
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, cerr)
+			jwtSLO.RecordFailure(sloReasonVerification)
+			return nil, cerr
+		}
+		split = !useAuthorization
+	}
+	if split && err == nil {
 		// Compressed format: pass through directly without reassembly!
 		// OPTIMIZATION: x-jwt-payload is raw JSON - can parse claims directly if needed
 		// No base64 decode required for claims access!
@@ -44,7 +78,7 @@ func jwtUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.
 		
 		// Store components directly for pass-through forwarding
 		ctx = context.WithValue(ctx, ctxKeyJWTHeader{}, header)
-		ctx = context.WithValue(ctx, ctxKeyJWTPayload{}, payloadHeaders[0])
+		ctx = context.WithValue(ctx, ctxKeyJWTPayload{}, payload)
 		ctx = context.WithValue(ctx, ctxKeyJWTSig{}, signature)
 
 	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
@@ -54,23 +88,124 @@ func jwtUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.
 		if jwtToken != "" {
 			ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
 		}
+	} else if token := codecJWTFromMetadata(ctx, md, start); token != "" {
+		accessFromContext(ctx).reassembled(time.Since(start))
+		jwtToken = token
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
+	}
+	ctx = withWireFormat(ctx, wireFormatFromMetadata(md, ctx.Value(ctxKeyJWTPayload{}) != nil))
+	recordIncomingJWT(ctx, info.FullMethod, ctx.Value(ctxKeyJWTPayload{}) != nil || jwtToken != "")
+	if err := checkRevocation(ctx); err != nil {
+		return nil, err
+	}
+	if tokenBindingEnabled || payloadValidationEnabled {
+		userJWT, _ := UserJWTFromContext(ctx)
+		if err := checkTokenBinding(ctx, userJWT); err != nil {
+			return nil, err
+		}
+		if err := checkJWTPayload(ctx, userJWT); err != nil {
+			return nil, err
+		}
+	}
+
+	return handler(withClaimsMemo(ctx), req)
+}
+
+// splitPayloadFromMetadata returns the raw JSON payload of a split JWT, sent
+// either whole in x-jwt-payload or as claim blocks listed by x-jwt-claims.
+// Claim blocks are merged and sealed claims opened on receipt, so checkout
+// forwards x-jwt-payload.
+func splitPayloadFromMetadata(md metadata.MD) (payload string, split bool, err error) {
+	if payloadHeaders := md.Get("x-jwt-payload"); len(payloadHeaders) > 0 {
+		payload, err = fieldSealer.Open(payloadHeaders[0])
+		return payload, true, err
+	}
+	order := md.Get("x-jwt-claims")
+	if len(order) == 0 {
+		return "", false, nil
+	}
+	block := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	static, err := staticBlockFromMetadata(md)
+	if err != nil {
+		return "", true, err
 	}
+	payload, err = mergeClaimBlocks(order[0], static, block("x-jwt-session"), block("x-jwt-dynamic"))
+	if err == nil {
+		payload, err = fieldSealer.Open(payload)
+	}
+	return payload, true, err
+}
 
-	return handler(ctx, req)
+// requiresJWT reports whether an incoming method must carry a JWT;
+// only infrastructure services (health, channelz, reflection) are exempt
+func requiresJWT(method string) bool {
+	return strings.HasPrefix(method, "/hipstershop.")
+}
+
+// recordIncomingJWT feeds the outcome of JWT extraction into the SLO tracker
+func recordIncomingJWT(ctx context.Context, method string, found bool) {
+	if !requiresJWT(method) {
+		return
+	}
+	if found {
+		jwtSLO.RecordSuccess()
+		loggerFromContext(ctx).Debugf("[JWT-FLOW] received JWT for %s", method)
+	} else {
+		jwtSLO.RecordFailure(sloReasonMissingJWT)
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] no JWT received for %s", method)
+	}
 }
 
 // jwtStreamServerInterceptor extracts JWT from incoming stream metadata
 func jwtStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 	ctx := ss.Context()
 	md, ok := metadata.FromIncomingContext(ctx)
+	ss.SetHeader(codecAdvertisement())
+	ctx = withRequestLogger(ctx, info.FullMethod, md)
+	ctx = withActorJWT(ctx, md)
 	if !ok {
-		return handler(srv, ss)
+		recordIncomingJWT(ctx, info.FullMethod, false)
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+	if err := checkDuplicateHeaders(ctx, info.FullMethod, md); err != nil {
+		return err
 	}
 
 	var jwtToken string
 
-	// Check for compressed JWT format (x-jwt-payload header)
-	if payloadHeaders := md.Get("x-jwt-payload"); len(payloadHeaders) > 0 {
+	// Check for compressed JWT format (x-jwt-payload, or claim blocks)
+	start := time.Now()
+	payload, split, err := splitPayloadFromMetadata(md)
+	if split {
+		observeReassembly(md, start)
+		accessFromContext(ctx).reassembled(time.Since(start))
+	}
+	if isStaticBlockUnknown(err) {
+		// Not a failure: the sender resends the full block
+		return err
+	}
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to merge JWT claim blocks in stream: %v", err)
+		jwtSLO.RecordFailure(sloReasonReassembly)
+		if derr := reassemblyFailed(ctx, info.FullMethod); derr != nil {
+			return derr
+		}
+	}
+	if split && err == nil {
+		useAuthorization, cerr := resolveHeaderConflict(md, payload)
+		if cerr != nil {
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, cerr)
+			jwtSLO.RecordFailure(sloReasonVerification)
+			return cerr
+		}
+		split = !useAuthorization
+	}
+	if split && err == nil {
 		// OPTIMIZATION: Pass through directly without reassembly
 		var header, signature string
 		
@@ -85,15 +220,34 @@ func jwtStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grp
 		
 		// Store components directly for pass-through
 		ctx = context.WithValue(ctx, ctxKeyJWTHeader{}, header)
-		ctx = context.WithValue(ctx, ctxKeyJWTPayload{}, payloadHeaders[0])
+		ctx = context.WithValue(ctx, ctxKeyJWTPayload{}, payload)
 		ctx = context.WithValue(ctx, ctxKeyJWTSig{}, signature)
 	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
 		jwtToken = strings.TrimPrefix(authHeaders[0], "Bearer ")
 		if jwtToken != "" {
 			ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
 		}
+	} else if token := codecJWTFromMetadata(ctx, md, start); token != "" {
+		accessFromContext(ctx).reassembled(time.Since(start))
+		jwtToken = token
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
+	}
+	ctx = withWireFormat(ctx, wireFormatFromMetadata(md, ctx.Value(ctxKeyJWTPayload{}) != nil))
+	recordIncomingJWT(ctx, info.FullMethod, ctx.Value(ctxKeyJWTPayload{}) != nil || jwtToken != "")
+	if err := checkRevocation(ctx); err != nil {
+		return err
 	}
 
+	// The token arrives once with the stream headers; bind it to the stream
+	userJWT, _ := UserJWTFromContext(ctx)
+	if err := checkTokenBinding(ctx, userJWT); err != nil {
+		return err
+	}
+	if err := checkJWTPayload(ctx, userJWT); err != nil {
+		return err
+	}
+	ctx, ss = bindStreamClaims(ctx, ss, userJWT)
+	ctx = withClaimsMemo(ctx)
 	return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
 }
 
@@ -107,16 +261,62 @@ func (w *wrappedServerStream) Context() context.Context {
 	return w.ctx
 }
 
+// appendDualWriteJWT adds the full token next to the split headers while the
+// jwt-dual-write flag is on, so receivers can be migrated one at a time
+func appendDualWriteJWT(ctx context.Context) context.Context {
+	if !jwtDualWriteEnabled(ctx) {
+		return ctx
+	}
+	token, ok := UserJWTFromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
 // jwtUnaryClientInterceptor forwards JWT from incoming request to outgoing gRPC calls
 func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	// Delegation: checkout (or the original caller) travels as the actor
+	ctx = appendActorJWT(ctx)
+
+	// Downstream auth timings, when asked for, see auth_timing.go
+	invoker = authTimingInvoker(invoker)
+
+	// A peer refusing the split headers gets the token again in the
+	// fallback format
+	if size := userJWTSize(ctx); size > 0 {
+		invoker = overflowInvoker(invoker, ctx, size)
+	}
+	// A receiver that can't reassemble them asks for the whole token instead
+	invoker = downgradeInvoker(invoker, ctx)
+
+	// Downstreams that only read authorization, or asked for it, get the
+	// whole token
+	if jwtCompressionEnabled(ctx) && (forcesAuthorizationHeader(method) || splitDowngraded(method)) {
+		if token, ok := UserJWTFromContext(ctx); ok {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
 	// OPTIMIZATION: Check for pre-decomposed components first (pass-through)
 	// This avoids the reassemble-then-decompose round-trip
-	if IsJWTCompressionEnabled() {
+	if jwtCompressionEnabled(ctx) {
 		header, _ := ctx.Value(ctxKeyJWTHeader{}).(string)
 		payload, payloadOk := ctx.Value(ctxKeyJWTPayload{}).(string)
 		sig, sigOk := ctx.Value(ctxKeyJWTSig{}).(string)
 		
 		if payloadOk && sigOk && payload != "" {
+			// Small tokens go whole: cheaper than three header names, and so
+			// do sealed claims to services without the field key
+			var splittable bool
+			payload, splittable = sealedPayloadFor(method, payload)
+			if !splittable || !shouldSplitJWT(method, encodedJWTSize(header, payload, sig)) {
+				if token, ok := UserJWTFromContext(ctx); ok {
+					ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+				}
+				return invoker(ctx, method, req, reply, cc, opts...)
+			}
 			// Direct pass-through - ZERO encode/decode operations!
 			// Forward all 3 headers: header + payload + signature
 			// Note: header may be empty if not provided, receiver will use default
@@ -130,6 +330,7 @@ func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply in
 					"x-jwt-payload", payload,
 					"x-jwt-sig", sig)
 			}
+			ctx = appendDualWriteJWT(ctx)
 			return invoker(ctx, method, req, reply, cc, opts...)
 		}
 	}
@@ -141,20 +342,24 @@ func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply in
 		return invoker(ctx, method, req, reply, cc, opts...)
 	}
 
-	// Check if compression is enabled
-	if IsJWTCompressionEnabled() {
+	// Check if compression is enabled and the token is worth splitting
+	if jwtCompressionEnabled(ctx) && shouldSplitJWT(method, len(jwtToken)) {
 		// Decompose JWT for optimized transmission (1 base64 decode)
 		components, err := DecomposeJWT(jwtToken)
 		if err != nil {
 			// Fallback to full JWT
-			log.Warnf("Failed to decompose JWT, using full token: %v", err)
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to decompose JWT, using full token: %v", err)
+			jwtSLO.RecordFailure(sloReasonReassembly)
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
+        } else if payload, ok := sealedPayloadFor(method, components.Payload); !ok {
 			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
         } else {
 			// Forward as compressed headers: header + raw JSON payload + signature
 			ctx = metadata.AppendToOutgoingContext(ctx,
 				"x-jwt-header", components.Header,
-				"x-jwt-payload", components.Payload,
+				"x-jwt-payload", payload,
 				"x-jwt-sig", components.Signature)
+			ctx = appendDualWriteJWT(ctx)
 		}
     } else {
 		// JWT COMPRESSION DISABLED: Forward as standard authorization header
@@ -164,15 +369,39 @@ func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply in
 	return invoker(ctx, method, req, reply, cc, opts...)
 }
 
-// jwtStreamClientInterceptor forwards JWT from incoming request to outgoing gRPC stream calls
+// jwtStreamClientInterceptor forwards JWT from incoming request to outgoing gRPC stream calls.
+// The metadata goes out once with the stream headers, never per message; the
+// receiver binds it to the stream (see stream_claims.go).
 func jwtStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	// Delegation: checkout (or the original caller) travels as the actor
+	ctx = appendActorJWT(ctx)
+
+	// Downstreams that only read authorization, or asked for it, get the
+	// whole token
+	if jwtCompressionEnabled(ctx) && (forcesAuthorizationHeader(method) || splitDowngraded(method)) {
+		if token, ok := UserJWTFromContext(ctx); ok {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
 	// OPTIMIZATION: Check for pre-decomposed components first (pass-through)
-	if IsJWTCompressionEnabled() {
+	if jwtCompressionEnabled(ctx) {
 		header, _ := ctx.Value(ctxKeyJWTHeader{}).(string)
 		payload, payloadOk := ctx.Value(ctxKeyJWTPayload{}).(string)
 		sig, sigOk := ctx.Value(ctxKeyJWTSig{}).(string)
 		
 		if payloadOk && sigOk && payload != "" {
+			// Small tokens go whole: cheaper than three header names, and so
+			// do sealed claims to services without the field key
+			var splittable bool
+			payload, splittable = sealedPayloadFor(method, payload)
+			if !splittable || !shouldSplitJWT(method, encodedJWTSize(header, payload, sig)) {
+				if token, ok := UserJWTFromContext(ctx); ok {
+					ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+				}
+				return streamer(ctx, desc, cc, method, opts...)
+			}
 			// Direct pass-through - ZERO encode/decode operations!
 			if header != "" {
 				ctx = metadata.AppendToOutgoingContext(ctx,
@@ -184,6 +413,7 @@ func jwtStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *
 					"x-jwt-payload", payload,
 					"x-jwt-sig", sig)
 			}
+			ctx = appendDualWriteJWT(ctx)
 			return streamer(ctx, desc, cc, method, opts...)
 		}
 	}
@@ -194,18 +424,22 @@ func jwtStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *
 		return streamer(ctx, desc, cc, method, opts...)
 	}
 
-	// Check if compression is enabled
-	if IsJWTCompressionEnabled() {
+	// Check if compression is enabled and the token is worth splitting
+	if jwtCompressionEnabled(ctx) && shouldSplitJWT(method, len(jwtToken)) {
 		components, err := DecomposeJWT(jwtToken)
 		if err != nil {
-			log.Warnf("Failed to decompose JWT for stream, using full token: %v", err)
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to decompose JWT for stream, using full token: %v", err)
+			jwtSLO.RecordFailure(sloReasonReassembly)
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
+        } else if payload, ok := sealedPayloadFor(method, components.Payload); !ok {
 			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
         } else {
 			// Forward as compressed headers: header + raw JSON payload + signature
 			ctx = metadata.AppendToOutgoingContext(ctx,
 				"x-jwt-header", components.Header,
-				"x-jwt-payload", components.Payload,
+				"x-jwt-payload", payload,
 				"x-jwt-sig", components.Signature)
+			ctx = appendDualWriteJWT(ctx)
 		}
     } else {
 		// JWT COMPRESSION DISABLED: Forward as standard authorization header
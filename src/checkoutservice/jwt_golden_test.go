@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// goldenJWTFile is shared by the frontend, checkout and shipping tests so the
+// service copies of the JWT codec cannot drift apart unnoticed.
+const goldenJWTFile = "../../test-suite/golden/jwt_golden.json"
+
+type goldenJWT struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	Header    string `json:"header"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func loadGoldenJWTs(t *testing.T) []goldenJWT {
+	t.Helper()
+	data, err := os.ReadFile(goldenJWTFile)
+	if err != nil {
+		t.Fatalf("failed to read golden JWTs: %v", err)
+	}
+	var golden []goldenJWT
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatalf("failed to parse golden JWTs: %v", err)
+	}
+	return golden
+}
+
+// TestGoldenDecompose checks this service's DecomposeJWT against the golden components.
+func TestGoldenDecompose(t *testing.T) {
+	for _, g := range loadGoldenJWTs(t) {
+		c, err := DecomposeJWT(g.Token)
+		if err != nil {
+			t.Errorf("%s: DecomposeJWT failed: %v", g.Name, err)
+			continue
+		}
+		if c.Header != g.Header || c.Payload != g.Payload || c.Signature != g.Signature {
+			t.Errorf("%s: DecomposeJWT = %+v, want header=%q payload=%q signature=%q", g.Name, c, g.Header, g.Payload, g.Signature)
+		}
+	}
+}
+
+// forwardThroughCheckout runs incoming metadata through the server interceptor
+// and returns the metadata the client interceptor attaches to a downstream call.
+func forwardThroughCheckout(t *testing.T, incoming metadata.MD) metadata.MD {
+	t.Helper()
+	ctx := metadata.NewIncomingContext(context.Background(), incoming)
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.CheckoutService/PlaceOrder"}
+
+	var outgoing metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		outgoing, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, jwtUnaryClientInterceptor(ctx, "/hipstershop.ShippingService/ShipOrder", nil, nil, nil, invoker)
+	}
+	if _, err := jwtUnaryServerInterceptor(ctx, nil, info, handler); err != nil {
+		t.Fatalf("interceptor chain failed: %v", err)
+	}
+	return outgoing
+}
+
+// TestGoldenForwardSplit checks that split components received from the
+// frontend are forwarded unchanged and reassemble to the original token.
+func TestGoldenForwardSplit(t *testing.T) {
+	// Golden tokens include deliberately tiny ones; split them all
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+	jwtSplitMinBytes = 0
+
+	defer func(v bool) { jwtCompressionEnv = v }(jwtCompressionEnv)
+	jwtCompressionEnv = true
+
+	for _, g := range loadGoldenJWTs(t) {
+		out := forwardThroughCheckout(t, metadata.Pairs(
+			"x-jwt-header", g.Header,
+			"x-jwt-payload", g.Payload,
+			"x-jwt-sig", g.Signature,
+		))
+		c := &JWTComponents{}
+		if v := out.Get("x-jwt-header"); len(v) == 1 {
+			c.Header = v[0]
+		}
+		if v := out.Get("x-jwt-payload"); len(v) == 1 {
+			c.Payload = v[0]
+		}
+		if v := out.Get("x-jwt-sig"); len(v) == 1 {
+			c.Signature = v[0]
+		}
+		got, err := ReassembleJWT(c)
+		if err != nil {
+			t.Errorf("%s: ReassembleJWT failed: %v", g.Name, err)
+		} else if got != g.Token {
+			t.Errorf("%s: forwarded components reassemble to %q, want %q", g.Name, got, g.Token)
+		}
+	}
+}
+
+// TestGoldenForwardFull checks that a full token is split on the way out when
+// compression is enabled, and forwarded verbatim when it is disabled.
+func TestGoldenForwardFull(t *testing.T) {
+	// Golden tokens include deliberately tiny ones; split them all
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+	jwtSplitMinBytes = 0
+	defer func(v bool) { jwtCompressionEnv = v }(jwtCompressionEnv)
+
+	for _, g := range loadGoldenJWTs(t) {
+		incoming := metadata.Pairs("authorization", "Bearer "+g.Token)
+
+		jwtCompressionEnv = true
+		out := forwardThroughCheckout(t, incoming)
+		if h, p, s := out.Get("x-jwt-header"), out.Get("x-jwt-payload"), out.Get("x-jwt-sig"); len(h) != 1 || len(p) != 1 || len(s) != 1 ||
+			h[0] != g.Header || p[0] != g.Payload || s[0] != g.Signature {
+			t.Errorf("%s: compressed forward = %v, want golden components", g.Name, out)
+		}
+
+		jwtCompressionEnv = false
+		out = forwardThroughCheckout(t, incoming)
+		if a := out.Get("authorization"); len(a) != 1 || a[0] != "Bearer "+g.Token {
+			t.Errorf("%s: uncompressed forward = %v, want authorization header", g.Name, out)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/jwttest"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/keyring"
+)
+
+// useTestIssuer makes iss's key the one user tokens are verified with
+func useTestIssuer(t *testing.T, iss *jwttest.Issuer) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(iss.RSAPublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.New(context.Background(), keyring.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := jwtKeys
+	t.Cleanup(func() { jwtKeys = prev })
+	jwtKeys = keys
+}
+
+func TestVerifyUserJWT(t *testing.T) {
+	iss := jwttest.RS256()
+	useTestIssuer(t, iss)
+	other, err := jwttest.NewIssuer("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := iss.Mint(jwttest.Claims{"email": "alice@example.com"})
+
+	claims, err := verifyUserJWTNow(valid)
+	if err != nil {
+		t.Fatalf("valid token refused: %v", err)
+	}
+	if claims.Email != "alice@example.com" || claims.SessionID != "session-1" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	refused := map[string]string{
+		"expired":        iss.Mint(nil, jwttest.TTL(-time.Minute)),
+		"no exp":         iss.Mint(jwttest.Claims{"exp": nil}),
+		"not yet valid":  iss.Mint(jwttest.Claims{"nbf": time.Now().Add(time.Hour).Unix()}),
+		"other issuer":   iss.Mint(jwttest.Claims{"iss": "https://evil.example"}),
+		"other audience": iss.Mint(jwttest.Claims{"aud": "urn:other"}),
+		"other key":      other.Mint(nil),
+		"ES256":          jwttest.ES256().Mint(nil),
+		"empty":          "",
+	}
+	for name, token := range jwttest.Corruptions(valid) {
+		refused[name] = token
+	}
+	for name, token := range refused {
+		if _, err := verifyUserJWTNow(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestConfirmationRecipient(t *testing.T) {
+	iss := jwttest.RS256()
+	useTestIssuer(t, iss)
+	defer func(v bool) { requireVerifiedEmail = v }(requireVerifiedEmail)
+	request := func(claims jwttest.Claims) context.Context {
+		return withClaimsMemo(context.WithValue(context.Background(), ctxKeyJWT{}, iss.Mint(claims)))
+	}
+
+	requireVerifiedEmail = true
+	got, err := confirmationRecipient(request(jwttest.Claims{"email": "alice@example.com"}), "mallory@example.com")
+	if err != nil || got != "alice@example.com" {
+		t.Errorf("with a verified email = %q, %v; want the claim", got, err)
+	}
+
+	// A burning SLO must not relax the requirement
+	slo := jwtSLO
+	defer func() { jwtSLO = slo }()
+	jwtSLO = newJWTSLOTracker()
+	for i := 0; i < 100; i++ {
+		jwtSLO.RecordFailure(sloReasonMissingJWT)
+	}
+	if !jwtSLO.Degraded() {
+		t.Fatal("SLO not degraded")
+	}
+	for name, ctx := range map[string]context.Context{
+		"no token":      context.Background(),
+		"no email":      request(nil),
+		"invalid token": withClaimsMemo(context.WithValue(context.Background(), ctxKeyJWT{}, jwttest.BadSignature(iss.Mint(nil)))),
+	} {
+		if got, err := confirmationRecipient(ctx, "mallory@example.com"); err == nil || strings.Contains(got, "mallory") {
+			t.Errorf("%s: recipient %q, %v; want an error", name, got, err)
+		}
+	}
+
+	requireVerifiedEmail = false
+	if got, err := confirmationRecipient(request(nil), "bob@example.com"); err != nil || got != "bob@example.com" {
+		t.Errorf("without the requirement = %q, %v; want the requested email", got, err)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtcodec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func init() {
+	Register(cborCodec{})
+}
+
+// cborCodec sends the whole token as one CBOR array (RFC 8949) in
+// x-jwt-cbor-bin: [header, payload, signature], with header and payload
+// transcoded from JSON in key order and the signature as raw bytes
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return "cbor" }
+
+func (cborCodec) Encode(token string) (metadata.MD, error) {
+	header, payload, sig, err := decodeSegments(token)
+	if err != nil {
+		return nil, err
+	}
+	out := []byte{0x83} // array of 3
+	if out, err = appendJSONAsCBOR(out, header); err != nil {
+		return nil, err
+	}
+	if out, err = appendJSONAsCBOR(out, payload); err != nil {
+		return nil, err
+	}
+	out = appendCBORHead(out, 2, uint64(len(sig)))
+	out = append(out, sig...)
+	return metadata.Pairs("x-jwt-cbor-bin", string(out)), nil
+}
+
+func (cborCodec) Decode(md metadata.MD) (string, bool, error) {
+	v, ok := first(md, "x-jwt-cbor-bin")
+	if !ok {
+		return "", false, nil
+	}
+	d := &cborDecoder{data: []byte(v)}
+	if b, err := d.byte(); err != nil || b != 0x83 {
+		return "", true, errors.New("jwtcodec: cbor token is not a 3-element array")
+	}
+	var header, payload bytes.Buffer
+	if err := d.json(&header, 0); err != nil {
+		return "", true, err
+	}
+	if err := d.json(&payload, 0); err != nil {
+		return "", true, err
+	}
+	major, n, err := d.head()
+	if err != nil || major != 2 || n > uint64(len(d.data)-d.pos) {
+		return "", true, errors.New("jwtcodec: cbor signature is not a byte string")
+	}
+	sig := d.data[d.pos : d.pos+int(n)]
+	return base64.RawURLEncoding.EncodeToString(header.Bytes()) + "." +
+		base64.RawURLEncoding.EncodeToString(payload.Bytes()) + "." +
+		base64.RawURLEncoding.EncodeToString(sig), true, nil
+}
+
+// decodeSegments returns the decoded header JSON, payload JSON and signature
+func decodeSegments(token string) (header, payload, sig []byte, err error) {
+	h, p, s, err := splitToken(token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if header, err = base64.RawURLEncoding.DecodeString(h); err == nil {
+		if payload, err = base64.RawURLEncoding.DecodeString(p); err == nil {
+			sig, err = base64.RawURLEncoding.DecodeString(s)
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("jwtcodec: token segment is not base64url: %w", err)
+	}
+	return header, payload, sig, nil
+}
+
+// appendCBORHead appends a major type and argument in the shortest form
+func appendCBORHead(out []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(out, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(out, m|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(out, m|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(out, m|27), n)
+}
+
+// appendJSONAsCBOR transcodes one JSON value, keeping object key order by
+// using indefinite-length maps and arrays
+func appendJSONAsCBOR(out, data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	out, err := appendJSONValue(out, dec)
+	if err != nil {
+		return nil, fmt.Errorf("jwtcodec: cbor: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("jwtcodec: cbor: trailing data after JSON value")
+	}
+	return out, nil
+}
+
+func appendJSONValue(out []byte, dec *json.Decoder) ([]byte, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		start, array := byte(0x9f), v == '['
+		if v == '{' {
+			start = 0xbf
+		}
+		out = append(out, start)
+		for dec.More() {
+			if !array {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				s, _ := key.(string)
+				out = append(appendCBORHead(out, 3, uint64(len(s))), s...)
+			}
+			if out, err = appendJSONValue(out, dec); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return append(out, 0xff), nil
+	case string:
+		return append(appendCBORHead(out, 3, uint64(len(v))), v...), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			if i >= 0 {
+				return appendCBORHead(out, 0, uint64(i)), nil
+			}
+			return appendCBORHead(out, 1, uint64(-1-i)), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(out, 0xfb), math.Float64bits(f)), nil
+	case bool:
+		if v {
+			return append(out, 0xf5), nil
+		}
+		return append(out, 0xf4), nil
+	case nil:
+		return append(out, 0xf6), nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
+
+// cborDecoder reads the CBOR subset appendJSONAsCBOR writes, plus definite
+// lengths, back into compact JSON
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// maxCBORDepth bounds nesting so a hostile header can't exhaust the stack
+const maxCBORDepth = 32
+
+func (d *cborDecoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.pos++
+	return d.data[d.pos-1], nil
+}
+
+// head reads an initial byte and its argument; n is -1 (as MaxUint64) for
+// indefinite lengths
+func (d *cborDecoder) head() (major byte, n uint64, err error) {
+	b, err := d.byte()
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b>>5, b&0x1f
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 31:
+		return major, math.MaxUint64, nil
+	case info > 27:
+		return 0, 0, fmt.Errorf("jwtcodec: cbor: reserved additional info %d", info)
+	}
+	size := 1 << (info - 24)
+	if d.pos+size > len(d.data) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	for _, b := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.pos += size
+	return major, n, nil
+}
+
+// atBreak consumes a break byte if one is next
+func (d *cborDecoder) atBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == 0xff {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) text(n uint64) (string, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s, nil
+}
+
+func (d *cborDecoder) json(out *bytes.Buffer, depth int) error {
+	if depth > maxCBORDepth {
+		return errors.New("jwtcodec: cbor: nesting too deep")
+	}
+	start := d.pos
+	major, n, err := d.head()
+	if err != nil {
+		return fmt.Errorf("jwtcodec: cbor: %w", err)
+	}
+	switch major {
+	case 0:
+		out.WriteString(strconv.FormatUint(n, 10))
+	case 1:
+		if n > math.MaxInt64 {
+			return errors.New("jwtcodec: cbor: negative integer out of range")
+		}
+		out.WriteString(strconv.FormatInt(-1-int64(n), 10))
+	case 3:
+		s, err := d.text(n)
+		if err != nil {
+			return fmt.Errorf("jwtcodec: cbor: %w", err)
+		}
+		b, _ := json.Marshal(s)
+		out.Write(b)
+	case 4, 5:
+		open, close := byte('['), byte(']')
+		if major == 5 {
+			open, close = '{', '}'
+		}
+		out.WriteByte(open)
+		for i := uint64(0); n == math.MaxUint64 || i < n; i++ {
+			if n == math.MaxUint64 && d.atBreak() {
+				break
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if major == 5 {
+				km, kn, err := d.head()
+				if err != nil || km != 3 {
+					return errors.New("jwtcodec: cbor: map key is not a text string")
+				}
+				key, err := d.text(kn)
+				if err != nil {
+					return fmt.Errorf("jwtcodec: cbor: %w", err)
+				}
+				b, _ := json.Marshal(key)
+				out.Write(b)
+				out.WriteByte(':')
+			}
+			if err := d.json(out, depth+1); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(close)
+	case 7:
+		switch d.data[start] {
+		case 0xf4:
+			out.WriteString("false")
+		case 0xf5:
+			out.WriteString("true")
+		case 0xf6:
+			out.WriteString("null")
+		case 0xfb:
+			b, err := json.Marshal(math.Float64frombits(n))
+			if err != nil {
+				return fmt.Errorf("jwtcodec: cbor: %w", err)
+			}
+			out.Write(b)
+		default:
+			return fmt.Errorf("jwtcodec: cbor: unsupported simple value 0x%x", d.data[start])
+		}
+	default:
+		return fmt.Errorf("jwtcodec: cbor: unsupported major type %d in JSON value", major)
+	}
+	return nil
+}
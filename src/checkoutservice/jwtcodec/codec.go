@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jwtcodec is a registry of wire formats for carrying a JWT in gRPC
+// metadata. Codecs register themselves by name; senders pick one by config or
+// by what the receiver advertises in its x-jwt-codecs response header, and
+// receivers decode whichever registered format arrives. Every codec must pass
+// the conformance tests in this package.
+package jwtcodec
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// AdvertiseHeader is the response header listing the codecs a receiver decodes
+const AdvertiseHeader = "x-jwt-codecs"
+
+// Codec carries a JWT in gRPC metadata
+type Codec interface {
+	Name() string
+	// Encode returns the metadata carrying token, or an error when this
+	// codec can't carry it; callers then fall back to another format
+	Encode(token string) (metadata.MD, error)
+	// Decode returns the token carried by md. ok is false when md holds none
+	// of this codec's keys.
+	Decode(md metadata.MD) (token string, ok bool, err error)
+}
+
+// contextDecoder is implemented by codecs whose decoding does I/O, such as
+// resolving a reference, so it can be bound to the call being served
+type contextDecoder interface {
+	DecodeContext(ctx context.Context, md metadata.MD) (token string, ok bool, err error)
+}
+
+// availability is implemented by codecs that depend on configuration, such
+// as a reference store
+type availability interface {
+	Available() bool
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = make(map[string]Codec)
+)
+
+// Register makes a codec available by name. It panics on a duplicate name,
+// which can only be a programming error.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := codecs[c.Name()]; dup {
+		panic("jwtcodec: Register called twice for " + c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// Lookup returns the codec registered under name
+func Lookup(name string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Names returns the registered codec names, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Available reports whether the codec can be used in this process
+func Available(c Codec) bool {
+	a, ok := c.(availability)
+	return !ok || a.Available()
+}
+
+// Encode encodes token with the named codec and checks that it decodes back
+// to the same token, so a lossy codec never puts an unverifiable token on the
+// wire
+func Encode(name, token string) (metadata.MD, error) {
+	c, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("jwtcodec: unknown codec %q", name)
+	}
+	if !Available(c) {
+		return nil, fmt.Errorf("jwtcodec: codec %q is not configured", name)
+	}
+	md, err := c.Encode(token)
+	if err != nil {
+		return nil, err
+	}
+	if got, ok, err := c.Decode(md); err != nil || !ok || got != token {
+		return nil, fmt.Errorf("jwtcodec: %s does not round-trip this token", name)
+	}
+	return md, nil
+}
+
+// Decode returns the token carried by md in any registered format, and the
+// name of the codec that carried it. name is "" when md carries no token.
+func Decode(md metadata.MD) (token, name string, err error) {
+	return DecodeContext(context.Background(), md)
+}
+
+// DecodeContext is Decode with any I/O a codec needs, such as resolving a
+// reference, bound to ctx. Receivers pass the context of the RPC.
+func DecodeContext(ctx context.Context, md metadata.MD) (token, name string, err error) {
+	for _, n := range Names() {
+		c, _ := Lookup(n)
+		var ok bool
+		if cd, isContext := c.(contextDecoder); isContext {
+			token, ok, err = cd.DecodeContext(ctx, md)
+		} else {
+			token, ok, err = c.Decode(md)
+		}
+		if ok {
+			return token, n, err
+		}
+	}
+	return "", "", nil
+}
+
+// Advertise returns the AdvertiseHeader value: the codecs this process can
+// decode
+func Advertise() string {
+	var names []string
+	for _, n := range Names() {
+		if c, _ := Lookup(n); Available(c) {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Choose returns the first codec of preference that the receiver advertised,
+// or "" when there is none
+func Choose(preference []string, advertised string) string {
+	offered := make(map[string]bool)
+	for _, n := range strings.Split(advertised, ",") {
+		offered[strings.TrimSpace(n)] = true
+	}
+	for _, n := range preference {
+		if c, ok := Lookup(n); ok && offered[n] && Available(c) {
+			return n
+		}
+	}
+	return ""
+}
+
+// first returns the first value of key in md
+func first(md metadata.MD, key string) (string, bool) {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0], true
+	}
+	return "", false
+}
+
+// splitToken returns the three segments of a compact JWS
+func splitToken(token string) (header, payload, sig string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("jwtcodec: token is not a compact JWS")
+	}
+	return parts[0], parts[1], parts[2], nil
+}
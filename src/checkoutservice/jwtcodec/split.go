@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtcodec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// maxPayloadBytes bounds decompressed and decoded payloads
+const maxPayloadBytes = 64 << 10
+
+func init() {
+	Register(fullCodec{})
+	Register(plainSplitCodec{})
+	Register(gzipSplitCodec{})
+}
+
+// fullCodec sends the token whole, as authorization: Bearer <jwt>
+type fullCodec struct{}
+
+func (fullCodec) Name() string { return "full" }
+
+func (fullCodec) Encode(token string) (metadata.MD, error) {
+	return metadata.Pairs("authorization", "Bearer "+token), nil
+}
+
+func (fullCodec) Decode(md metadata.MD) (string, bool, error) {
+	v, ok := first(md, "authorization")
+	if !ok {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(v, "Bearer ") {
+		return "", true, errors.New("jwtcodec: authorization is not a bearer token")
+	}
+	return strings.TrimPrefix(v, "Bearer "), true, nil
+}
+
+// plainSplitCodec is the original split format: base64url header and
+// signature, raw JSON payload
+type plainSplitCodec struct{}
+
+func (plainSplitCodec) Name() string { return "plain-split" }
+
+func (plainSplitCodec) Encode(token string) (metadata.MD, error) {
+	header, payload, sig, err := splitToken(token)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("jwtcodec: payload is not base64url: %w", err)
+	}
+	// Non-binary metadata must be printable ASCII
+	for _, b := range raw {
+		if b < 0x20 || b > 0x7e {
+			return nil, errors.New("jwtcodec: payload is not printable ASCII")
+		}
+	}
+	return metadata.Pairs("x-jwt-header", header, "x-jwt-payload", string(raw), "x-jwt-sig", sig), nil
+}
+
+func (plainSplitCodec) Decode(md metadata.MD) (string, bool, error) {
+	payload, ok := first(md, "x-jwt-payload")
+	if !ok {
+		return "", false, nil
+	}
+	return joinSplit(md, []byte(payload))
+}
+
+// gzipSplitCodec is the split format with a gzipped payload
+type gzipSplitCodec struct{}
+
+func (gzipSplitCodec) Name() string { return "gzip-split" }
+
+func (gzipSplitCodec) Encode(token string) (metadata.MD, error) {
+	header, payload, sig, err := splitToken(token)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("jwtcodec: payload is not base64url: %w", err)
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return metadata.Pairs("x-jwt-header", header, "x-jwt-payload-gz-bin", buf.String(), "x-jwt-sig", sig), nil
+}
+
+func (gzipSplitCodec) Decode(md metadata.MD) (string, bool, error) {
+	compressed, ok := first(md, "x-jwt-payload-gz-bin")
+	if !ok {
+		return "", false, nil
+	}
+	zr, err := gzip.NewReader(strings.NewReader(compressed))
+	if err != nil {
+		return "", true, fmt.Errorf("jwtcodec: invalid gzip payload: %w", err)
+	}
+	raw, err := io.ReadAll(io.LimitReader(zr, maxPayloadBytes+1))
+	if err != nil {
+		return "", true, fmt.Errorf("jwtcodec: invalid gzip payload: %w", err)
+	}
+	if len(raw) > maxPayloadBytes {
+		return "", true, errors.New("jwtcodec: gzip payload too large")
+	}
+	return joinSplit(md, raw)
+}
+
+// joinSplit rebuilds a token from x-jwt-header, x-jwt-sig and a raw payload
+func joinSplit(md metadata.MD, payload []byte) (string, bool, error) {
+	header, ok1 := first(md, "x-jwt-header")
+	sig, ok2 := first(md, "x-jwt-sig")
+	if !ok1 || !ok2 {
+		return "", true, errors.New("jwtcodec: split token without x-jwt-header or x-jwt-sig")
+	}
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + sig, true, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jwttest mints signed user tokens for unit tests: RS256 and ES256
+// tokens with chosen claims and clock skew, a JWKS server publishing the
+// issuer keys, and canned corruptions of a valid token. Tests build their
+// tokens here instead of pasting static token strings.
+package jwttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims are the claims of a token, marshalled as given
+type Claims map[string]interface{}
+
+// Issuer signs tokens with one key. Defaults are merged under the claims of
+// every token it mints; Now is the issuer's clock.
+type Issuer struct {
+	Alg      string
+	KeyID    string
+	Defaults Claims
+	Now      func() time.Time
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+// DefaultClaims are the claims the frontend puts in every user token
+func DefaultClaims() Claims {
+	return Claims{
+		"iss":        "https://auth.hipstershop.com",
+		"aud":        []string{"urn:hipstershop:api"},
+		"sub":        "urn:hipstershop:user:session-1",
+		"session_id": "session-1",
+		"name":       "Test User",
+		"currency":   "USD",
+	}
+}
+
+var (
+	sharedMu      sync.Mutex
+	sharedIssuers = map[string]*Issuer{}
+)
+
+// RS256 returns an issuer sharing one RSA key for the whole test binary, so
+// tests that don't care about the key don't each pay for generating one.
+// Callers must not modify the returned issuer; use With for other defaults.
+func RS256() *Issuer { return shared("RS256") }
+
+// ES256 is RS256 with a P-256 key
+func ES256() *Issuer { return shared("ES256") }
+
+func shared(alg string) *Issuer {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if iss, ok := sharedIssuers[alg]; ok {
+		return iss
+	}
+	iss, err := NewIssuer(alg)
+	if err != nil {
+		panic(err)
+	}
+	sharedIssuers[alg] = iss
+	return iss
+}
+
+// NewIssuer generates a fresh key for alg, RS256 or ES256
+func NewIssuer(alg string) (*Issuer, error) {
+	iss := &Issuer{Alg: alg, Defaults: DefaultClaims(), Now: time.Now}
+	var err error
+	switch alg {
+	case "RS256":
+		if iss.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, err
+		}
+	case "ES256":
+		if iss.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("jwttest: unsupported alg %q", alg)
+	}
+	iss.KeyID = thumbprint(iss.JWK())
+	return iss, nil
+}
+
+// With returns a copy of the issuer whose defaults are overridden by
+// defaults; a nil value drops a default
+func (iss *Issuer) With(defaults Claims) *Issuer {
+	c := *iss
+	c.Defaults = Claims{}
+	for k, v := range iss.Defaults {
+		c.Defaults[k] = v
+	}
+	for k, v := range defaults {
+		c.Defaults[k] = v
+	}
+	return &c
+}
+
+// PublicKey returns the *rsa.PublicKey or *ecdsa.PublicKey verifying the
+// issuer's tokens
+func (iss *Issuer) PublicKey() crypto.PublicKey {
+	if iss.rsaKey != nil {
+		return &iss.rsaKey.PublicKey
+	}
+	return &iss.ecKey.PublicKey
+}
+
+// RSAPublicKey returns the key of an RS256 issuer, nil for ES256
+func (iss *Issuer) RSAPublicKey() *rsa.PublicKey {
+	if iss.rsaKey == nil {
+		return nil
+	}
+	return &iss.rsaKey.PublicKey
+}
+
+// Option adjusts one minted token
+type Option func(*mintOptions)
+
+type mintOptions struct {
+	ttl    time.Duration
+	skew   time.Duration
+	header map[string]interface{}
+}
+
+// TTL sets the token lifetime, exp - iat; the default is an hour. A
+// negative TTL mints a token that has already expired.
+func TTL(d time.Duration) Option {
+	return func(o *mintOptions) { o.ttl = d }
+}
+
+// Skew runs the issuer's clock d ahead of Now (behind when negative), as
+// when the issuing replica's clock drifts from the verifier's
+func Skew(d time.Duration) Option {
+	return func(o *mintOptions) { o.skew = d }
+}
+
+// Header sets a protected header parameter, such as kid or typ
+func Header(key string, value interface{}) Option {
+	return func(o *mintOptions) { o.header[key] = value }
+}
+
+// Mint signs claims merged over the issuer's defaults. iat, nbf and exp are
+// set from the (skewed) clock and TTL unless claims sets them; a nil claim
+// value drops a default.
+func (iss *Issuer) Mint(claims Claims, opts ...Option) string {
+	o := mintOptions{ttl: time.Hour, header: map[string]interface{}{"alg": iss.Alg, "typ": "JWT", "kid": iss.KeyID}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	now := time.Now
+	if iss.Now != nil {
+		now = iss.Now
+	}
+	issued := now().Add(o.skew)
+	all := Claims{"iat": issued.Unix(), "nbf": issued.Unix(), "exp": issued.Add(o.ttl).Unix()}
+	for k, v := range iss.Defaults {
+		all[k] = v
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	for k, v := range all {
+		if v == nil {
+			delete(all, k)
+		}
+	}
+	return iss.Sign(mustJSON(o.header), mustJSON(all))
+}
+
+// Sign signs the raw JSON header and payload as given, for tokens Mint
+// can't express such as duplicate members or non-canonical encodings
+func (iss *Issuer) Sign(header, payload []byte) string {
+	input := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	var err error
+	if iss.rsaKey != nil {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, iss.rsaKey, crypto.SHA256, digest[:])
+	} else {
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, iss.ecKey, digest[:]); err == nil {
+			// JWS wants the fixed-size r || s, not ASN.1
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	return input + "." + encode(sig)
+}
+
+// Split returns the three parts of token as the split wire format carries
+// them: the encoded header, the decoded JSON payload and the encoded
+// signature, for the x-jwt-header, x-jwt-payload and x-jwt-sig headers
+func Split(token string) (header, payload, sig string) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return "", "", ""
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", ""
+	}
+	return parts[0], string(raw), parts[2]
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func mustJSON(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
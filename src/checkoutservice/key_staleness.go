@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rsa"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/keyring"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// JWKS outage tolerance
+//
+// A failed key refresh keeps the last loaded keys in use, so an IdP or JWKS
+// outage doesn't take the mesh's auth down with it. For up to
+// JWT_KEY_MAX_STALENESS (default 1h) since the last successful load the
+// stale keys verify tokens as usual. Past it the keys are degraded: a token
+// is only accepted when its kid header names a key this process has loaded
+// before, and only that key verifies it; tokens without a kid, or signed by
+// a key the outage kept us from seeing, are refused. The first successful
+// refresh ends degraded mode.
+//
+// Entering and leaving degraded mode is logged as an error and info, and
+// jwt_key_staleness_seconds and jwt_key_degraded expose the state for
+// alerting. JWT_KEY_MAX_STALENESS=0, or JWT_KEY_REFRESH_INTERVAL=0, tolerates
+// stale keys indefinitely as before.
+
+const defaultKeyMaxStaleness = time.Hour
+
+var (
+	jwtKeyStalenessSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jwt_key_staleness_seconds",
+		Help: "Time since the JWT verification keys were last loaded from their source.",
+	}, []string{"source"})
+	jwtKeyDegraded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jwt_key_degraded",
+		Help: "1 while the keys are staler than JWT_KEY_MAX_STALENESS and only previously seen kids are accepted.",
+	}, []string{"source"})
+	jwtKeyDegradedVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_key_degraded_verifications_total",
+		Help: "Tokens checked while the keys were degraded, by whether their kid had been seen.",
+	}, []string{"source", "outcome"})
+)
+
+// keyMaxStaleness is how long stale keys are trusted fully; 0 is forever
+var keyMaxStaleness = keyMaxStalenessFromEnv()
+
+// keyringDegraded holds the last degraded state of each keyring, so changes
+// are alerted once
+var keyringDegraded sync.Map
+
+// keyMaxStalenessFromEnv reads JWT_KEY_MAX_STALENESS; keys that are never
+// refreshed can't go stale
+func keyMaxStalenessFromEnv() time.Duration {
+	if os.Getenv("JWT_KEY_REFRESH_INTERVAL") == "0" {
+		return 0
+	}
+	v := os.Getenv("JWT_KEY_MAX_STALENESS")
+	if v == "" {
+		return defaultKeyMaxStaleness
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return defaultKeyMaxStaleness
+	}
+	return d
+}
+
+// keysDegraded reports whether keys are staler than keyMaxStaleness,
+// alerting when that changes
+func keysDegraded(keys *keyring.Keyring) bool {
+	if keyMaxStaleness <= 0 {
+		return false
+	}
+	stale := time.Since(keys.LoadedAt())
+	degraded := stale > keyMaxStaleness
+	jwtKeyStalenessSeconds.WithLabelValues(keys.Source()).Set(stale.Seconds())
+
+	was, _ := keyringDegraded.Swap(keys, degraded)
+	if wasDegraded, _ := was.(bool); wasDegraded == degraded {
+		return degraded
+	}
+	if degraded {
+		jwtKeyDegraded.WithLabelValues(keys.Source()).Set(1)
+		log.Errorf("[JWT-FLOW] Keys from %s not refreshed for %v (limit %v) - accepting previously seen kids only",
+			keys.Source(), stale.Round(time.Second), keyMaxStaleness)
+	} else {
+		jwtKeyDegraded.WithLabelValues(keys.Source()).Set(0)
+		log.Infof("[JWT-FLOW] Keys from %s refreshed - leaving degraded mode", keys.Source())
+	}
+	return degraded
+}
+
+// verificationKeys returns the keys a token with header kid may be verified
+// against: all of them normally, only the previously seen key named by kid
+// while degraded. ok is false when a degraded keyring can't vouch for kid.
+func verificationKeys(keys *keyring.Keyring, kid string) (_ []*rsa.PublicKey, ok bool) {
+	if !keysDegraded(keys) {
+		return keys.PublicKeys(), true
+	}
+	key, ok := keys.SeenKey(kid)
+	if !ok || kid == "" {
+		jwtKeyDegradedVerifications.WithLabelValues(keys.Source(), "unseen_kid").Inc()
+		return nil, false
+	}
+	jwtKeyDegradedVerifications.WithLabelValues(keys.Source(), "seen_kid").Inc()
+	return []*rsa.PublicKey{key}, true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Load shedding
+//
+// With LOAD_SHED_MAX_INFLIGHT set, requests are shed once that many are in
+// flight, lowest priority first: x-request-priority low from half the limit,
+// normal (or no header) from 80% of it and high only at the limit. The
+// frontend sets the priority from the user's claims and checkout forwards
+// it; like the rest of the mesh metadata it is trusted from peers. A shed
+// request fails with ResourceExhausted asking for a retry after
+// LOAD_SHED_PUSHBACK (default 200ms), both as RetryInfo and in the
+// grpc-retry-pushback-ms trailer.
+
+const (
+	requestPriorityHeader   = "x-request-priority"
+	priorityHigh            = "high"
+	priorityNormal          = "normal"
+	priorityLow             = "low"
+	defaultLoadShedPushback = 200 * time.Millisecond
+)
+
+// shedAt is the share of LOAD_SHED_MAX_INFLIGHT from which each priority is
+// shed
+var shedAt = map[string]float64{priorityLow: 0.5, priorityNormal: 0.8, priorityHigh: 1}
+
+type ctxKeyRequestPriority struct{}
+
+var (
+	loadShedMaxInflight = loadLoadShedMaxInflight()
+	loadShedPushback    = loadLoadShedPushback()
+	requestsInflight    atomic.Int64
+
+	requestsShedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_requests_shed_total",
+		Help: "Requests refused by the load shedder, by x-request-priority.",
+	}, []string{"priority"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grpc_requests_inflight",
+		Help: "Requests being handled, as counted by the load shedder.",
+	}, func() float64 { return float64(requestsInflight.Load()) })
+)
+
+func loadLoadShedMaxInflight() int64 {
+	n, _ := strconv.ParseInt(os.Getenv("LOAD_SHED_MAX_INFLIGHT"), 10, 64)
+	return max(n, 0)
+}
+
+func loadLoadShedPushback() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LOAD_SHED_PUSHBACK")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultLoadShedPushback
+}
+
+// requestPriority reads x-request-priority; missing or unknown values are
+// normal
+func requestPriority(md metadata.MD) string {
+	if v := md.Get(requestPriorityHeader); len(v) > 0 && (v[0] == priorityHigh || v[0] == priorityLow) {
+		return v[0]
+	}
+	return priorityNormal
+}
+
+// admit counts a request of priority in, or reports false when it is shed
+func admit(priority string) bool {
+	n := requestsInflight.Add(1)
+	if loadShedMaxInflight > 0 && float64(n) > shedAt[priority]*float64(loadShedMaxInflight) {
+		requestsInflight.Add(-1)
+		requestsShedTotal.WithLabelValues(priority).Inc()
+		return false
+	}
+	return true
+}
+
+// shedStatus is the pushback trailer and the error of a shed request
+func shedStatus(method, priority string) (metadata.MD, error) {
+	st := status.Newf(codes.ResourceExhausted, "overloaded, %s priority request to %s shed", priority, method)
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(loadShedPushback)}); err == nil {
+		st = detailed
+	}
+	return metadata.Pairs("grpc-retry-pushback-ms", strconv.FormatInt(loadShedPushback.Milliseconds(), 10)), st.Err()
+}
+
+// withRequestPriority keeps a priority the caller sent, for forwarding
+func withRequestPriority(ctx context.Context, md metadata.MD) context.Context {
+	if len(md.Get(requestPriorityHeader)) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyRequestPriority{}, requestPriority(md))
+}
+
+// loadShedUnaryServerInterceptor sheds requests under overload; health
+// checks and other infrastructure calls are never shed
+func loadShedUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = withRequestPriority(ctx, md)
+	if loadShedMaxInflight == 0 || !requiresJWT(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	priority := requestPriority(md)
+	if !admit(priority) {
+		trailer, err := shedStatus(info.FullMethod, priority)
+		grpc.SetTrailer(ctx, trailer)
+		return nil, err
+	}
+	defer requestsInflight.Add(-1)
+	return handler(ctx, req)
+}
+
+// loadShedStreamServerInterceptor sheds streams under overload; an admitted
+// stream counts as in flight until it ends
+func loadShedStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	ctx := withRequestPriority(ss.Context(), md)
+	if ctx != ss.Context() {
+		ss = &wrappedServerStream{ServerStream: ss, ctx: ctx}
+	}
+	if loadShedMaxInflight == 0 || !requiresJWT(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	priority := requestPriority(md)
+	if !admit(priority) {
+		trailer, err := shedStatus(info.FullMethod, priority)
+		ss.SetTrailer(trailer)
+		return err
+	}
+	defer requestsInflight.Add(-1)
+	return handler(srv, ss)
+}
+
+// priorityUnaryClientInterceptor forwards the caller's priority downstream
+func priorityUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if p, ok := ctx.Value(ctxKeyRequestPriority{}).(string); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestPriorityHeader, p)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// priorityStreamClientInterceptor forwards the caller's priority downstream
+func priorityStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if p, ok := ctx.Value(ctxKeyRequestPriority{}).(string); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestPriorityHeader, p)
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestLoadShedding checks that low priority requests are shed first, that
+// shed requests ask for a retry and that an admitted request's priority is
+// forwarded downstream
+func TestLoadShedding(t *testing.T) {
+	defer func(n int64) { loadShedMaxInflight = n; requestsInflight.Store(0) }(loadShedMaxInflight)
+	loadShedMaxInflight = 10
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.CheckoutService/PlaceOrder"}
+	var forwarded []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		priorityUnaryClientInterceptor(ctx, "/hipstershop.ShippingService/ShipOrder", nil, nil, nil,
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				md, _ := metadata.FromOutgoingContext(ctx)
+				forwarded = md.Get(requestPriorityHeader)
+				return nil
+			})
+		return nil, nil
+	}
+	call := func(inflight int64, priority string) error {
+		requestsInflight.Store(inflight)
+		ctx := context.Background()
+		if priority != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(requestPriorityHeader, priority))
+		}
+		_, err := loadShedUnaryServerInterceptor(ctx, nil, info, handler)
+		return err
+	}
+
+	for _, c := range []struct {
+		inflight int64
+		priority string
+		shed     bool
+	}{
+		{5, "low", true},
+		{4, "low", false},
+		{5, "", false},
+		{8, "", true},
+		{8, "high", false},
+		{10, "high", true},
+	} {
+		err := call(c.inflight, c.priority)
+		if shed := status.Code(err) == codes.ResourceExhausted; shed != c.shed {
+			t.Errorf("%d in flight, priority %q: shed %v, want %v", c.inflight, c.priority, shed, c.shed)
+		}
+		if !c.shed {
+			continue
+		}
+		hinted := false
+		for _, d := range status.Convert(err).Details() {
+			if info, ok := d.(*errdetails.RetryInfo); ok && info.GetRetryDelay().AsDuration() == loadShedPushback {
+				hinted = true
+			}
+		}
+		if !hinted {
+			t.Errorf("shed request carries no RetryInfo: %v", err)
+		}
+	}
+
+	if err := call(0, "high"); err != nil || len(forwarded) != 1 || forwarded[0] != "high" {
+		t.Errorf("forwarded priority %v, err %v; want high", forwarded, err)
+	}
+	if err := call(0, ""); err != nil || len(forwarded) != 0 {
+		t.Errorf("forwarded priority %v without one from the caller", forwarded)
+	}
+}
@@ -26,10 +26,12 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	channelzservice "google.golang.org/grpc/channelz/service"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/grpcserver"
 	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
@@ -81,10 +83,18 @@ type checkoutService struct {
 
 	paymentSvcAddr string
 	paymentSvcConn *grpc.ClientConn
+
+	// Optional: orders are recorded only when ORDER_HISTORY_SERVICE_ADDR is set
+	orderHistorySvcAddr string
+	orderHistorySvcConn *grpc.ClientConn
 }
 
 func main() {
 	ctx := context.Background()
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+
 	if os.Getenv("ENABLE_TRACING") == "1" {
 		log.Info("Tracing enabled.")
 		initTracing()
@@ -99,6 +109,7 @@ func main() {
 	} else {
 		log.Info("Profiling disabled.")
 	}
+	startPyroscope("checkoutservice")
 
 	port := listenPort
 	if os.Getenv("PORT") != "" {
@@ -112,6 +123,22 @@ func main() {
 	mustMapEnv(&svc.currencySvcAddr, "CURRENCY_SERVICE_ADDR")
 	mustMapEnv(&svc.emailSvcAddr, "EMAIL_SERVICE_ADDR")
 	mustMapEnv(&svc.paymentSvcAddr, "PAYMENT_SERVICE_ADDR")
+	svc.orderHistorySvcAddr = os.Getenv("ORDER_HISTORY_SERVICE_ADDR")
+
+	initCapture()
+	if err := loadJWTPublicKey(ctx); err != nil {
+		log.Fatalf("Failed to load JWT public key: %v", err)
+	}
+	if err := loadActorToken(); err != nil {
+		log.Fatalf("Failed to load actor token: %v", err)
+	}
+	if err := loadEgressCredentials(ctx); err != nil {
+		log.Fatalf("Failed to load egress credentials: %v", err)
+	}
+	initFeatureFlags()
+	if err := initOrderEvents(); err != nil {
+		log.Fatalf("Failed to set up order events: %v", err)
+	}
 
 	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
 	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
@@ -119,6 +146,9 @@ func main() {
 	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
 	mustConnGRPC(ctx, &svc.emailSvcConn, svc.emailSvcAddr)
 	mustConnGRPC(ctx, &svc.paymentSvcConn, svc.paymentSvcAddr)
+	if svc.orderHistorySvcAddr != "" {
+		mustConnGRPC(ctx, &svc.orderHistorySvcConn, svc.orderHistorySvcAddr)
+	}
 
 	log.Infof("service config: %+v", svc)
 
@@ -128,29 +158,50 @@ func main() {
 	}
 
 	var srv *grpc.Server
+	tlsOpts, err := serverTLSOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Propagate trace context always
 	otel.SetTextMapPropagator(
 		propagation.NewCompositeTextMapPropagator(
 			propagation.TraceContext{}, propagation.Baggage{}))
 	
-	// Chain interceptors: JWT server (receives/reassembles) -> OpenTelemetry
-	// Configure HPACK table size: 256KB total (224KB HPACK table + 32KB overhead)
-	// With JWT shredding, this allows caching 1052 user sessions simultaneously
-	srv = grpc.NewServer(
-		grpc.ChainUnaryInterceptor(
+	// Chain interceptors: panic recovery -> access log -> JWT server (receives/reassembles) -> OpenTelemetry -> span size attributes
+	// Header limits, keepalive and stream caps come from grpcserver
+	srv = grpcserver.New(grpcserver.Options{
+		Unary: []grpc.UnaryServerInterceptor{
+			recoveryUnaryServerInterceptor,
+			accessLogUnaryServerInterceptor,
+			loadShedUnaryServerInterceptor,
+			concurrencyLimitUnaryServerInterceptor,
+			captureUnaryServerInterceptor,
+			profileLabelUnaryServerInterceptor,
 			jwtUnaryServerInterceptor,
+			tokenFreshnessUnaryServerInterceptor,
 			otelgrpc.UnaryServerInterceptor(),
-		),
-		grpc.ChainStreamInterceptor(
+			wireStatsUnaryServerInterceptor,
+		},
+		Stream: []grpc.StreamServerInterceptor{
+			recoveryStreamServerInterceptor,
+			accessLogStreamServerInterceptor,
+			loadShedStreamServerInterceptor,
+			captureStreamServerInterceptor,
+			profileLabelStreamServerInterceptor,
 			jwtStreamServerInterceptor,
 			otelgrpc.StreamServerInterceptor(),
-		),
-		grpc.MaxHeaderListSize(524288), // 512KB (480KB HPACK table + 32KB overhead)
-	)
+			wireStatsStreamServerInterceptor,
+		},
+		StatsHandler: wireStats,
+		Extra:        tlsOpts,
+	})
 
 	pb.RegisterCheckoutServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
+	channelzservice.RegisterChannelzServiceToServer(srv)
+	startDebugServer()
+	startRESTGateway(port)
 	log.Infof("starting to listen on tcp: %q", lis.Addr().String())
 	err = srv.Serve(lis)
 	log.Fatal(err)
@@ -220,18 +271,24 @@ func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 	var err error
 	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
 	defer cancel()
-	// Configure HPACK table size: 256KB total for high concurrency
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
+	// The HPACK table for request headers is whatever the server advertises
+	// (GRPC_HEADER_TABLE_SIZE there, 4KB by default); grpc-go has no dial
+	// option for it, only for the header list size.
+	*conn, err = grpc.DialContext(ctx, dialTarget(addr),
+		dialCredentials(),
 		grpc.WithChainUnaryInterceptor(
 			jwtUnaryClientInterceptor,
+			ctxClaimsUnaryClientInterceptor,
+			priorityUnaryClientInterceptor,
 			otelgrpc.UnaryClientInterceptor(),
 		),
 		grpc.WithChainStreamInterceptor(
 			jwtStreamClientInterceptor,
+			priorityStreamClientInterceptor,
 			otelgrpc.StreamClientInterceptor(),
 		),
-		grpc.WithMaxHeaderListSize(524288), // 512KB (480KB HPACK table + 32KB overhead)
+		grpc.WithMaxHeaderListSize(maxHeaderListSize()), // 512KB (480KB HPACK table + 32KB overhead) unless GRPC_MAX_HEADER_LIST_SIZE
+		grpc.WithStatsHandler(wireStats),
 	)
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
@@ -247,16 +304,49 @@ func (cs *checkoutService) Watch(req *healthpb.HealthCheckRequest, ws healthpb.H
 }
 
 func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
-	log.Infof("[PlaceOrder] user_id=%q user_currency=%q", req.UserId, req.UserCurrency)
+	log := loggerFromContext(ctx)
+	log.Infof("[PlaceOrder] user_hash=%q user_currency=%q", pseudonym(req.UserId), req.UserCurrency)
 
-	orderID, err := uuid.NewUUID()
+	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, req.UserId, req.UserCurrency, req.Address)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate order uuid")
+		if aerr := downstreamAuthError(err); aerr != nil {
+			return nil, aerr
+		}
+		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, req.UserId, req.UserCurrency, req.Address)
+	// Duplicate submissions get the original order (see order_dedupe.go)
+	owner := dedupeOwner(ctx, req)
+	if len(prep.cartItems) == 0 {
+		if sub, ok := orderDedupes.Recent(owner); ok {
+			if resp, err := sub.Wait(ctx); err == nil {
+				orderDedupeHits.WithLabelValues("emptied_cart").Inc()
+				log.Infof("[PlaceOrder] duplicate of order %s after its cart was emptied", resp.GetOrder().GetOrderId())
+				return resp, nil
+			}
+		}
+	}
+	key := orderDedupeKey{orderDedupeOwner: owner, cart: cartHash(prep.cartItems, req.UserCurrency, req.Address)}
+	sub, first := orderDedupes.Claim(key)
+	if !first {
+		resp, err := sub.Wait(ctx)
+		if err == nil {
+			orderDedupeHits.WithLabelValues("duplicate").Inc()
+			log.Infof("[PlaceOrder] duplicate of order %s", resp.GetOrder().GetOrderId())
+		}
+		return resp, err
+	}
+	resp, err := cs.placeOrder(ctx, req, prep)
+	orderDedupes.Finish(key, sub, resp, err)
+	return resp, err
+}
+
+// placeOrder charges, ships and confirms the order of a prepared cart
+func (cs *checkoutService) placeOrder(ctx context.Context, req *pb.PlaceOrderRequest, prep orderPrep) (*pb.PlaceOrderResponse, error) {
+	log := loggerFromContext(ctx)
+	orderID, err := uuid.NewUUID()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+		return nil, status.Errorf(codes.Internal, "failed to generate order uuid")
 	}
 
 	total := pb.Money{CurrencyCode: req.UserCurrency,
@@ -268,16 +358,24 @@ func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderReq
 		total = money.Must(money.Sum(total, multPrice))
 	}
 
+	// Enrichment: shipping and email receive signed order-level claims
+	ctx = withOrderClaims(ctx, orderID.String(), &total)
+
 	txID, err := cs.chargeCard(ctx, &total, req.CreditCard)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to charge card: %+v", err)
 	}
 	log.Infof("payment went through (transaction_id: %s)", txID)
+	trackOrderStatus(ctx, orderID.String(), pb.OrderStatusUpdate_PAYMENT_CHARGED, "")
 
 	shippingTrackingID, err := cs.shipOrder(ctx, req.Address, prep.cartItems)
 	if err != nil {
+		if aerr := downstreamAuthError(err); aerr != nil {
+			return nil, aerr
+		}
 		return nil, status.Errorf(codes.Unavailable, "shipping error: %+v", err)
 	}
+	trackOrderStatus(ctx, orderID.String(), pb.OrderStatusUpdate_SHIPPED, shippingTrackingID)
 
 	_ = cs.emptyUserCart(ctx, req.UserId)
 
@@ -289,11 +387,20 @@ func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderReq
 		Items:              prep.orderItems,
 	}
 
-	if err := cs.sendOrderConfirmation(ctx, req.Email, orderResult); err != nil {
-		log.Warnf("failed to send order confirmation to %q: %+v", req.Email, err)
+	recipient, err := confirmationRecipient(ctx, req.Email)
+	if err != nil {
+		log.Warnf("not sending order confirmation: %v", err)
+	} else if err := cs.sendOrderConfirmation(ctx, recipient, orderResult); err != nil {
+		log.Warnf("failed to send order confirmation to %s: %+v", pseudonym(recipient), err)
 	} else {
-		log.Infof("order confirmation email sent to %q", req.Email)
+		log.Infof("order confirmation email sent to %s", pseudonym(recipient))
+	}
+	if err := cs.recordOrder(ctx, orderResult, &total); err != nil {
+		log.Warnf("failed to record order %s in order history: %+v", orderResult.OrderId, err)
 	}
+	publishOrderPlaced(ctx, orderResult, &total)
+	ordersPlacedTotal.WithLabelValues(WireFormatFromContext(ctx)).Inc()
+	trackOrderStatus(ctx, orderResult.OrderId, pb.OrderStatusUpdate_CONFIRMED, shippingTrackingID)
 	resp := &pb.PlaceOrderResponse{Order: orderResult}
 	return resp, nil
 }
@@ -316,7 +423,7 @@ func (cs *checkoutService) prepareOrderItemsAndShippingQuoteFromCart(ctx context
 	}
 	shippingUSD, err := cs.quoteShipping(ctx, address, cartItems)
 	if err != nil {
-		return out, fmt.Errorf("shipping quote failure: %+v", err)
+		return out, fmt.Errorf("shipping quote failure: %w", err)
 	}
 	shippingPrice, err := cs.convertCurrency(ctx, shippingUSD, userCurrency)
 	if err != nil {
@@ -335,7 +442,7 @@ func (cs *checkoutService) quoteShipping(ctx context.Context, address *pb.Addres
 			Address: address,
 			Items:   items})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get shipping quote: %+v", err)
+		return nil, fmt.Errorf("failed to get shipping quote: %w", err)
 	}
 	return shippingQuote.GetCostUsd(), nil
 }
@@ -402,12 +509,56 @@ func (cs *checkoutService) sendOrderConfirmation(ctx context.Context, email stri
 	return err
 }
 
+// recordOrder stores the order in the user's order history. The history is
+// keyed by the subject of the forwarded user token, not by anything in the
+// request, and the authorization snapshot is signed (see order_audit.go).
+func (cs *checkoutService) recordOrder(ctx context.Context, order *pb.OrderResult, total *pb.Money) error {
+	if cs.orderHistorySvcConn == nil {
+		return nil
+	}
+	snapshot := authorizationSnapshot(ctx)
+	ctx = withSnapshotSignature(ctx, order.GetOrderId(), snapshot)
+	_, err := pb.NewOrderHistoryServiceClient(cs.orderHistorySvcConn).RecordOrder(ctx, &pb.RecordOrderRequest{
+		Order:         order,
+		Total:         total,
+		Authorization: snapshot})
+	return err
+}
+
+// requireVerifiedEmail is REQUIRE_VERIFIED_EMAIL, read once at startup
+var requireVerifiedEmail = os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+
+// confirmationRecipient picks the confirmation email address from the verified
+// user claims so it cannot be redirected by editing the PlaceOrder request.
+// The request field is only used when no verified email is available, and
+// never with REQUIRE_VERIFIED_EMAIL=true.
+func confirmationRecipient(ctx context.Context, requested string) (string, error) {
+	log := loggerFromContext(ctx)
+
+	claims, err := VerifiedUserClaims(ctx)
+	if err == nil && claims.Email != "" {
+		if requested != "" && requested != claims.Email {
+			log.Warnf("[JWT-FLOW] ignoring request email, using verified claim for sub=%s", pseudonym(claims.Subject))
+		}
+		return claims.Email, nil
+	}
+	if err == nil {
+		err = errors.New("verified claims carry no email")
+	}
+
+	if requireVerifiedEmail {
+		return "", fmt.Errorf("no verified email: %v", err)
+	}
+	log.Debugf("[JWT-FLOW] using unverified request email: %v", err)
+	return requested, nil
+}
+
 func (cs *checkoutService) shipOrder(ctx context.Context, address *pb.Address, items []*pb.CartItem) (string, error) {
 	resp, err := pb.NewShippingServiceClient(cs.shippingSvcConn).ShipOrder(ctx, &pb.ShipOrderRequest{
 		Address: address,
 		Items:   items})
 	if err != nil {
-		return "", fmt.Errorf("shipment failed: %+v", err)
+		return "", fmt.Errorf("shipment failed: %w", err)
 	}
 	return resp.GetTrackingId(), nil
 }
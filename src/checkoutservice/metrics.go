@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/metadata"
+)
+
+// Prometheus histograms for JWT wire sizes, served in OpenMetrics format so
+// exemplars are exposed. Every observation carries the RPC's trace ID, taken
+// from its traceparent header, so a spike in a Grafana panel links to the
+// exact trace in Tempo.
+
+var (
+	jwtMetadataBytesHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jwt_metadata_bytes",
+		Help:    "Uncompressed key+value size of the JWT metadata of an RPC.",
+		Buckets: prometheus.ExponentialBuckets(128, 2, 9),
+	}, []string{"side", "jwt_mode"})
+	headerWireBytesHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_header_wire_bytes",
+		Help:    "HPACK-encoded size of the request headers received by a server.",
+		Buckets: prometheus.ExponentialBuckets(32, 2, 11),
+	}, []string{"jwt_mode"})
+	jwtReassemblySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jwt_reassembly_seconds",
+		Help:    "Time spent rebuilding a split JWT from incoming metadata.",
+		Buckets: prometheus.ExponentialBuckets(1e-6, 4, 9),
+	})
+)
+
+// metricsHandler serves the default registry with exemplars
+var metricsHandler = promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+// observeWithTrace records v, with traceID as exemplar when there is one.
+// Invalid exemplar labels panic, so a malformed trace ID is left out.
+func observeWithTrace(o prometheus.Observer, v float64, traceID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" && utf8.ValidString(traceID) {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
+}
+
+// observeReassembly records the time spent rebuilding a split JWT since start
+func observeReassembly(md metadata.MD, start time.Time) {
+	observeWithTrace(jwtReassemblySeconds, time.Since(start).Seconds(), traceIDFromMetadata(md))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tokenWithExp(exp time.Time) string {
+	payload := `{"sub":"u","exp":` + strconv.FormatInt(exp.Unix(), 10) + `}`
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".YmFk"
+}
+
+func TestNegativeCache(t *testing.T) {
+	c := newNegativeCache(2, time.Minute)
+	bad := tokenWithExp(time.Now().Add(time.Hour))
+	errBad := errors.New("invalid JWT signature")
+
+	if err := c.Lookup(bad); err != nil {
+		t.Fatalf("Lookup on empty cache = %v", err)
+	}
+	before := negativeCacheHits.Value()
+	c.Add(bad, errBad)
+	if err := c.Lookup(bad); err != errBad {
+		t.Fatalf("Lookup after Add = %v, want %v", err, errBad)
+	}
+	if hits := negativeCacheHits.Value() - before; hits != 1 {
+		t.Errorf("negative hits = %d, want 1", hits)
+	}
+
+	// Already expired tokens aren't cached: the exp check rejects them cheaply
+	expired := tokenWithExp(time.Now().Add(-time.Second))
+	c.Add(expired, errBad)
+	if err := c.Lookup(expired); err != nil {
+		t.Errorf("expired token was cached")
+	}
+
+	// Entries are evicted by the token's exp, not just the cache TTL
+	soon := tokenWithExp(time.Now().Add(time.Second))
+	c.Add(soon, errBad)
+	if e := c.entries; len(e) != 2 {
+		t.Fatalf("cache has %d entries, want 2", len(e))
+	}
+	for k, e := range c.entries {
+		if e.expires.After(time.Now().Add(2 * time.Second)) {
+			continue
+		}
+		e.expires = time.Now().Add(-time.Millisecond)
+		c.entries[k] = e
+	}
+	if err := c.Lookup(soon); err != nil {
+		t.Errorf("entry outlived the token's exp")
+	}
+
+	// A full cache doesn't grow past maxEntries
+	c.Add(tokenWithExp(time.Now().Add(time.Hour)), errBad)
+	c.Add(tokenWithExp(time.Now().Add(2*time.Hour)), errBad)
+	if len(c.entries) > 2 {
+		t.Errorf("cache grew to %d entries, max 2", len(c.entries))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	authorizationVerified   = "verified"
+	authorizationUnverified = "unverified"
+)
+
+// mdSnapshotSignature carries the signature of the snapshot on RecordOrder
+const mdSnapshotSignature = "x-authz-snapshot-sig"
+
+// orderSnapshotKey is ORDER_SNAPSHOT_KEY, shared with order history, which
+// stores only the snapshots checkout signed with it
+var orderSnapshotKey = []byte(os.Getenv("ORDER_SNAPSHOT_KEY"))
+
+// authorizationSnapshot is the redacted record of the claims the order of
+// ctx was placed under, stored with the order by order history for audits.
+// The subject is kept as its full keyed hash, which an auditor matches with
+// subjecthash.Sums across key rotations.
+func authorizationSnapshot(ctx context.Context) *pb.AuthorizationSnapshot {
+	claims, err := VerifiedUserClaims(ctx)
+	if err != nil {
+		return &pb.AuthorizationSnapshot{Verification: authorizationUnverified, VerificationError: err.Error()}
+	}
+	return &pb.AuthorizationSnapshot{
+		SubjectHash:  subjects.Sum(claims.Subject),
+		Issuer:       claims.Issuer,
+		Tenant:       claims.MarketID,
+		Roles:        append([]string(nil), claims.Roles...),
+		TokenId:      claims.ID,
+		Verification: authorizationVerified,
+	}
+}
+
+// withSnapshotSignature signs snapshot for the order orderID onto the
+// outgoing metadata of ctx; without ORDER_SNAPSHOT_KEY ctx is returned as is
+func withSnapshotSignature(ctx context.Context, orderID string, snapshot *pb.AuthorizationSnapshot) context.Context {
+	if len(orderSnapshotKey) == 0 || snapshot == nil {
+		return ctx
+	}
+	sig := base64.RawURLEncoding.EncodeToString(snapshotMAC(orderSnapshotKey, orderID, snapshot))
+	return metadata.AppendToOutgoingContext(ctx, mdSnapshotSignature, sig)
+}
+
+// snapshotMAC is the HMAC-SHA256 under key of the order ID and the
+// deterministic encoding of snapshot, so a signed snapshot can't be moved to
+// another order
+func snapshotMAC(key []byte, orderID string, snapshot *pb.AuthorizationSnapshot) []byte {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(snapshot)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(orderID))
+	mac.Write([]byte{0})
+	mac.Write(b)
+	return mac.Sum(nil)
+}
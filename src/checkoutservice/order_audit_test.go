@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// TestSnapshotSignature checks that the snapshot is signed for its order
+// when ORDER_SNAPSHOT_KEY is set, and sent unsigned otherwise
+func TestSnapshotSignature(t *testing.T) {
+	defer func(key []byte) { orderSnapshotKey = key }(orderSnapshotKey)
+	snapshot := &pb.AuthorizationSnapshot{SubjectHash: "ab12", Roles: []string{"customer"}, TokenId: "jti-1", Verification: authorizationVerified}
+
+	orderSnapshotKey = nil
+	md, _ := metadata.FromOutgoingContext(withSnapshotSignature(context.Background(), "order-1", snapshot))
+	if len(md.Get(mdSnapshotSignature)) != 0 {
+		t.Fatal("snapshot signed without a key")
+	}
+
+	orderSnapshotKey = []byte("snapshot-key")
+	md, _ = metadata.FromOutgoingContext(withSnapshotSignature(context.Background(), "order-1", snapshot))
+	sigs := md.Get(mdSnapshotSignature)
+	if len(sigs) != 1 {
+		t.Fatalf("signatures = %q", sigs)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hmac.Equal(sig, snapshotMAC(orderSnapshotKey, "order-1", snapshot)) {
+		t.Error("signature does not match the snapshot")
+	}
+	if hmac.Equal(sig, snapshotMAC(orderSnapshotKey, "order-2", snapshot)) {
+		t.Error("signature also matches another order")
+	}
+}
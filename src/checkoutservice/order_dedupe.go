@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Duplicate order detection
+//
+// The frontend's retry interceptor resends a PlaceOrder whose response was
+// lost, and under chaos runs that happens after the card was already
+// charged. Checkout remembers the orders of the last ORDER_DEDUPE_WINDOW
+// (default 2m, 0 disables) keyed by (session, cart, cart hash): a second
+// submission of the same cart joins the one in flight or gets the original
+// order back. A duplicate that arrives after the original emptied the cart
+// sees an empty cart, and gets the last order of that session and cart, in
+// flight or placed, instead.
+//
+// The session is the verified session_id claim and the cart the user ID the
+// frontend sends. They are the same for shoppers, but a partner's orders
+// share the session partner-<id> and each fill a cart of their own, so
+// concurrent orders of one partner are never mistaken for duplicates.
+
+const defaultOrderDedupeWindow = 2 * time.Minute
+
+// orderDedupes is the store consulted by PlaceOrder
+var orderDedupes = newOrderDedupe(10000, orderDedupeWindow())
+
+var orderDedupeHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "checkout_order_dedupe_hits_total",
+	Help: "PlaceOrder calls answered with the order of an earlier identical submission.",
+}, []string{"kind"})
+
+// orderDedupeWindow reads ORDER_DEDUPE_WINDOW
+func orderDedupeWindow() time.Duration {
+	v := os.Getenv("ORDER_DEDUPE_WINDOW")
+	if v == "" {
+		return defaultOrderDedupeWindow
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return defaultOrderDedupeWindow
+	}
+	return d
+}
+
+// orderDedupeOwner is the session and cart placing an order
+type orderDedupeOwner struct {
+	session string
+	userID  string
+}
+
+type orderDedupeKey struct {
+	orderDedupeOwner
+	cart [sha256.Size]byte
+}
+
+// orderSubmission is one PlaceOrder; done is closed once resp and err are set
+type orderSubmission struct {
+	done    chan struct{}
+	resp    *pb.PlaceOrderResponse
+	err     error
+	expires time.Time
+}
+
+// Wait returns the outcome of the submission, or ctx's error if that comes
+// first
+func (s *orderSubmission) Wait(ctx context.Context) (*pb.PlaceOrderResponse, error) {
+	select {
+	case <-s.done:
+		return s.resp, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type orderDedupe struct {
+	maxEntries int
+	window     time.Duration
+
+	mu      sync.Mutex
+	orders  map[orderDedupeKey]*orderSubmission
+	latest  map[orderDedupeOwner]*orderSubmission
+	nowFunc func() time.Time
+}
+
+func newOrderDedupe(maxEntries int, window time.Duration) *orderDedupe {
+	return &orderDedupe{
+		maxEntries: maxEntries,
+		window:     window,
+		orders:     make(map[orderDedupeKey]*orderSubmission),
+		latest:     make(map[orderDedupeOwner]*orderSubmission),
+		nowFunc:    time.Now,
+	}
+}
+
+// Claim registers a submission for key. When an earlier one is in flight or
+// succeeded within the window, it is returned with first false; otherwise
+// the caller places the order and reports it with Finish. A nil store, a
+// zero window or a full store always let the caller go ahead.
+func (d *orderDedupe) Claim(key orderDedupeKey) (s *orderSubmission, first bool) {
+	s = &orderSubmission{done: make(chan struct{})}
+	if d == nil || d.window == 0 {
+		return s, true
+	}
+	now := d.nowFunc()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if prev, ok := d.orders[key]; ok {
+		if prev.expires.IsZero() || now.Before(prev.expires) {
+			return prev, false
+		}
+		delete(d.orders, key)
+	}
+	if len(d.orders) >= d.maxEntries {
+		d.evictLocked(now)
+		if len(d.orders) >= d.maxEntries {
+			return s, true
+		}
+	}
+	d.orders[key] = s
+	d.latest[key.orderDedupeOwner] = s
+	return s, true
+}
+
+// Finish records the outcome of a submission returned by Claim with first
+// true. Failed submissions are forgotten, so the client's next retry places
+// the order again.
+func (d *orderDedupe) Finish(key orderDedupeKey, s *orderSubmission, resp *pb.PlaceOrderResponse, err error) {
+	s.resp, s.err = resp, err
+	if d == nil || d.window == 0 {
+		close(s.done)
+		return
+	}
+	d.mu.Lock()
+	if d.orders[key] == s {
+		if err != nil {
+			delete(d.orders, key)
+		} else {
+			s.expires = d.nowFunc().Add(d.window)
+		}
+	}
+	if err != nil && d.latest[key.orderDedupeOwner] == s {
+		delete(d.latest, key.orderDedupeOwner)
+	}
+	d.mu.Unlock()
+	close(s.done)
+}
+
+// Recent returns the last submission of owner, in flight or placed within
+// the window
+func (d *orderDedupe) Recent(owner orderDedupeOwner) (*orderSubmission, bool) {
+	if d == nil || d.window == 0 {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.latest[owner]
+	if !ok {
+		return nil, false
+	}
+	if !s.expires.IsZero() && !d.nowFunc().Before(s.expires) {
+		delete(d.latest, owner)
+		return nil, false
+	}
+	return s, true
+}
+
+// evictLocked drops expired orders; d.mu must be held
+func (d *orderDedupe) evictLocked(now time.Time) {
+	for k, s := range d.orders {
+		if !s.expires.IsZero() && !now.Before(s.expires) {
+			delete(d.orders, k)
+		}
+	}
+	for k, s := range d.latest {
+		if !s.expires.IsZero() && !now.Before(s.expires) {
+			delete(d.latest, k)
+		}
+	}
+}
+
+// dedupeOwner names the session and cart placing the order
+func dedupeOwner(ctx context.Context, req *pb.PlaceOrderRequest) orderDedupeOwner {
+	owner := orderDedupeOwner{session: req.UserId, userID: req.UserId}
+	if claims, err := VerifiedUserClaims(ctx); err == nil && claims.SessionID != "" {
+		owner.session = claims.SessionID
+	}
+	return owner
+}
+
+// cartHash digests what makes two submissions the same order: the cart
+// contents, in any order, the currency and the shipping address
+func cartHash(items []*pb.CartItem, currency string, address *pb.Address) [sha256.Size]byte {
+	lines := make([]string, 0, len(items))
+	for _, it := range items {
+		lines = append(lines, fmt.Sprintf("%s\x00%d", it.GetProductId(), it.GetQuantity()))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		fmt.Fprintf(h, "%s\n", l)
+	}
+	fmt.Fprintf(h, "%s\n%s\x00%s\x00%s\x00%s\x00%d\n", currency,
+		address.GetStreetAddress(), address.GetCity(), address.GetState(), address.GetCountry(), address.GetZipCode())
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestOrderDedupe(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := newOrderDedupe(10, time.Minute)
+	d.nowFunc = func() time.Time { return now }
+
+	cart := []*pb.CartItem{{ProductId: "A", Quantity: 1}, {ProductId: "B", Quantity: 2}}
+	reordered := []*pb.CartItem{cart[1], cart[0]}
+	addr := &pb.Address{City: "Paris", ZipCode: 75001}
+	owner := orderDedupeOwner{session: "s1", userID: "s1"}
+	key := orderDedupeKey{orderDedupeOwner: owner, cart: cartHash(cart, "EUR", addr)}
+	if got := cartHash(reordered, "EUR", addr); got != key.cart {
+		t.Fatal("cart hash depends on item order")
+	}
+	if got := cartHash(cart, "USD", addr); got == key.cart {
+		t.Fatal("cart hash ignores the currency")
+	}
+
+	first, ok := d.Claim(key)
+	if !ok {
+		t.Fatal("first Claim was not first")
+	}
+	// A concurrent duplicate joins the submission in flight
+	dup, ok := d.Claim(key)
+	if ok || dup != first {
+		t.Fatal("duplicate Claim did not join the submission in flight")
+	}
+	resp := &pb.PlaceOrderResponse{Order: &pb.OrderResult{OrderId: "order-1"}}
+	go d.Finish(key, first, resp, nil)
+	if got, err := dup.Wait(context.Background()); err != nil || got != resp {
+		t.Fatalf("Wait = %v, %v; want the original order", got, err)
+	}
+
+	// Later duplicates get the original order, also once the cart is empty
+	if s, ok := d.Claim(key); ok || s.resp != resp {
+		t.Fatal("duplicate within the window was not deduplicated")
+	}
+	if s, ok := d.Recent(owner); !ok || s.resp != resp {
+		t.Fatal("Recent did not return the session's order")
+	}
+	if _, ok := d.Recent(orderDedupeOwner{session: "s2", userID: "s2"}); ok {
+		t.Fatal("Recent returned another session's order")
+	}
+
+	// Another cart of the same session, as a partner's orders share one,
+	// is a different order even with the same contents
+	other := orderDedupeKey{orderDedupeOwner: orderDedupeOwner{session: "s1", userID: "s1-cart2"}, cart: key.cart}
+	if _, ok := d.Recent(other.orderDedupeOwner); ok {
+		t.Fatal("Recent returned the order of another cart of the session")
+	}
+	s2, ok := d.Claim(other)
+	if !ok {
+		t.Fatal("same contents in another cart of the session were deduplicated")
+	}
+	d.Finish(other, s2, &pb.PlaceOrderResponse{Order: &pb.OrderResult{OrderId: "order-2"}}, nil)
+	if s, ok := d.Recent(owner); !ok || s.resp != resp {
+		t.Fatal("another cart's order replaced the first cart's in Recent")
+	}
+
+	// Past the window the same cart is a new order
+	now = now.Add(time.Minute)
+	if _, ok := d.Recent(owner); ok {
+		t.Fatal("Recent returned an expired order")
+	}
+	next, ok := d.Claim(key)
+	if !ok {
+		t.Fatal("Claim after the window was deduplicated")
+	}
+
+	// Failed submissions are forgotten so the retry places the order
+	d.Finish(key, next, nil, errors.New("payment failed"))
+	if _, ok := d.Claim(key); !ok {
+		t.Fatal("Claim after a failed submission was deduplicated")
+	}
+
+	// A zero window disables deduplication
+	off := newOrderDedupe(10, 0)
+	s, _ := off.Claim(key)
+	off.Finish(key, s, resp, nil)
+	if _, ok := off.Claim(key); !ok {
+		t.Fatal("disabled store deduplicated")
+	}
+}
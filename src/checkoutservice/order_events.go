@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// Order events
+//
+// With ORDER_EVENTS_NATS_URL set, every placed order is published to NATS
+// (subject ORDER_EVENTS_SUBJECT) as an OrderPlaced event. Consumers run
+// long after the user token has expired and must never see it, so the event
+// carries the identity checkout verified (subject, issuer, tenant) instead,
+// and the whole event is signed: the message body is a compact JWS, HS256
+// with ORDER_EVENTS_KEY, whose kid names the key so consumers can rotate.
+// Events expire ORDER_EVENTS_TTL (default 24h) after they occurred. Orders
+// whose token didn't verify are not published. pkg/orderevents is the
+// consumer side.
+
+const (
+	orderPlacedEventType     = "hipstershop.order.placed"
+	orderEventsHeader        = `{"alg":"HS256","typ":"order-event+jws","kid":"%s"}`
+	defaultOrderEventSubject = "hipstershop.orders.placed"
+	defaultOrderEventTTL     = 24 * time.Hour
+)
+
+// orderEventStats counts published, unverified (skipped) and failed events
+var orderEventStats = expvar.NewMap("order_events")
+
+// orderEventPublisher sends a message body to a subject
+type orderEventPublisher interface {
+	Publish(subject string, msg *nats.Msg) error
+}
+
+var (
+	orderEvents       orderEventPublisher
+	orderEventSubject = envOrDefault("ORDER_EVENTS_SUBJECT", defaultOrderEventSubject)
+	orderEventsKey    = []byte(os.Getenv("ORDER_EVENTS_KEY"))
+	orderEventTTL     = orderEventsTTL()
+)
+
+// orderEventsTTL reads ORDER_EVENTS_TTL
+func orderEventsTTL() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("ORDER_EVENTS_TTL"))
+	if err != nil || d <= 0 {
+		return defaultOrderEventTTL
+	}
+	return d
+}
+
+// natsPublisher publishes on a connection that reconnects in the background
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+func (p natsPublisher) Publish(subject string, msg *nats.Msg) error {
+	msg.Subject = subject
+	return p.conn.PublishMsg(msg)
+}
+
+// initOrderEvents connects to NATS. Checkout starts even while NATS is down;
+// events published meanwhile are buffered by the client until it reconnects.
+func initOrderEvents() error {
+	url := os.Getenv("ORDER_EVENTS_NATS_URL")
+	if url == "" {
+		return nil
+	}
+	conn, err := nats.Connect(url,
+		nats.Name("checkoutservice"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warnf("[ORDER-EVENTS] disconnected from NATS: %v", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Infof("[ORDER-EVENTS] reconnected to NATS at %s", c.ConnectedUrl())
+		}))
+	if err != nil {
+		return fmt.Errorf("connecting to NATS at %s: %w", url, err)
+	}
+	orderEvents = natsPublisher{conn: conn}
+	log.Infof("[ORDER-EVENTS] publishing OrderPlaced to %s on %s", url, orderEventSubject)
+	return nil
+}
+
+// eventIdentity is the verified identity an event was produced for
+type eventIdentity struct {
+	Subject string `json:"sub"`
+	Issuer  string `json:"iss"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+// orderPlacedEvent is the signed payload of an OrderPlaced message
+type orderPlacedEvent struct {
+	Type               string        `json:"type"`
+	ID                 string        `json:"id"`
+	OccurredAt         int64         `json:"occurred_at"`
+	ExpiresAt          int64         `json:"exp"`
+	Identity           eventIdentity `json:"identity"`
+	OrderID            string        `json:"order_id"`
+	ShippingTrackingID string        `json:"shipping_tracking_id"`
+	Items              int           `json:"items"`
+	Total              eventMoney    `json:"total"`
+}
+
+type eventMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+}
+
+// publishOrderPlaced emits the OrderPlaced event of order; it never fails
+// the order
+func publishOrderPlaced(ctx context.Context, order *pb.OrderResult, total *pb.Money) {
+	if orderEvents == nil {
+		return
+	}
+	log := loggerFromContext(ctx)
+	claims, err := VerifiedUserClaims(ctx)
+	if err != nil {
+		orderEventStats.Add("unverified", 1)
+		log.Warnf("[ORDER-EVENTS] not publishing order %s without a verified identity: %v", order.GetOrderId(), err)
+		return
+	}
+	now := time.Now()
+	event := &orderPlacedEvent{
+		Type:               orderPlacedEventType,
+		ID:                 order.GetOrderId(),
+		OccurredAt:         now.Unix(),
+		ExpiresAt:          now.Add(orderEventTTL).Unix(),
+		Identity:           eventIdentity{Subject: claims.Subject, Issuer: claims.Issuer, Tenant: claims.MarketID},
+		OrderID:            order.GetOrderId(),
+		ShippingTrackingID: order.GetShippingTrackingId(),
+		Total:              eventMoney{CurrencyCode: total.GetCurrencyCode(), Units: total.GetUnits(), Nanos: total.GetNanos()},
+	}
+	for _, it := range order.GetItems() {
+		event.Items += int(it.GetItem().GetQuantity())
+	}
+	body, err := signOrderEvent(orderEventsKey, event)
+	if err == nil {
+		msg := nats.NewMsg(orderEventSubject)
+		msg.Data = []byte(body)
+		// Lets JetStream streams drop redelivered duplicates
+		msg.Header.Set(nats.MsgIdHdr, event.ID)
+		msg.Header.Set("Event-Type", event.Type)
+		err = orderEvents.Publish(orderEventSubject, msg)
+	}
+	if err != nil {
+		orderEventStats.Add("failed", 1)
+		log.Warnf("[ORDER-EVENTS] failed to publish order %s: %v", order.GetOrderId(), err)
+		return
+	}
+	orderEventStats.Add("published", 1)
+}
+
+// orderEventKeyID names key without revealing it: hex of the first 4 bytes
+// of its SHA-256
+func orderEventKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// signOrderEvent encodes event as a compact JWS signed with key
+func signOrderEvent(key []byte, event *orderPlacedEvent) (string, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode order event: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(orderEventsHeader, orderEventKeyID(key)))) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyOrderEvent is what a consumer does with a message body: check the
+// signature with the key its kid names, decode the event and reject it once
+// expired. keys maps key IDs to keys, so a consumer may hold the old and the
+// new key during a rotation. pkg/orderevents is the reusable version.
+func verifyOrderEvent(keys map[string][]byte, body string) (*orderPlacedEvent, error) {
+	parts := strings.Split(body, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("order event is not a compact JWS")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid order event header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("unexpected order event signing method %q", header.Alg)
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown order event key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid order event signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("order event signature does not match")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid order event payload: %w", err)
+	}
+	event := &orderPlacedEvent{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, fmt.Errorf("invalid order event payload: %w", err)
+	}
+	if event.ExpiresAt == 0 || time.Now().Unix() >= event.ExpiresAt {
+		return nil, fmt.Errorf("order event %s expired", event.ID)
+	}
+	return event, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+type recordingPublisher struct {
+	msgs []*nats.Msg
+}
+
+func (p *recordingPublisher) Publish(subject string, msg *nats.Msg) error {
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+// TestOrderPlacedEvent checks that an event is published only for a
+// verified identity, verifies with the key its kid names, and fails
+// verification once tampered with or expired.
+func TestOrderPlacedEvent(t *testing.T) {
+	pub := &recordingPublisher{}
+	orderEvents, orderEventsKey = pub, []byte(strings.Repeat("k", 32))
+	defer func() { orderEvents, orderEventsKey = nil, nil }()
+
+	order := &pb.OrderResult{OrderId: "o-1", Items: []*pb.OrderItem{{Item: &pb.CartItem{Quantity: 3}}}}
+	total := &pb.Money{CurrencyCode: "EUR", Units: 12}
+
+	publishOrderPlaced(context.Background(), order, total)
+	if len(pub.msgs) != 0 {
+		t.Fatal("published an event without a verified identity")
+	}
+
+	ctx := withClaimsMemo(context.Background())
+	memo := ctx.Value(ctxKeyClaimsMemo{}).(*claimsMemo)
+	memo.once.Do(func() {
+		memo.claims = &UserClaims{Subject: "urn:hipstershop:user:s1", Issuer: "https://auth.hipstershop.com", MarketID: "DE"}
+	})
+	publishOrderPlaced(ctx, order, total)
+	if len(pub.msgs) != 1 {
+		t.Fatalf("published %d events, want 1", len(pub.msgs))
+	}
+	msg := pub.msgs[0]
+	if got := msg.Header.Get(nats.MsgIdHdr); got != "o-1" {
+		t.Errorf("message ID %q, want the order ID", got)
+	}
+
+	keys := map[string][]byte{orderEventKeyID(orderEventsKey): orderEventsKey}
+	event, err := verifyOrderEvent(keys, string(msg.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Identity != (eventIdentity{Subject: "urn:hipstershop:user:s1", Issuer: "https://auth.hipstershop.com", Tenant: "DE"}) ||
+		event.Items != 3 || event.Total.Units != 12 || event.ExpiresAt <= event.OccurredAt {
+		t.Errorf("got event %+v", event)
+	}
+
+	parts := strings.Split(string(msg.Data), ".")
+	expired := *event
+	expired.ExpiresAt = expired.OccurredAt
+	stale, _ := signOrderEvent(orderEventsKey, &expired)
+	event.Identity.Subject = "urn:hipstershop:user:s2"
+	forged, _ := signOrderEvent([]byte(strings.Repeat("x", 32)), event)
+	for name, body := range map[string]string{
+		"payload swapped": parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2],
+		"other key":       forged,
+		"expired":         stale,
+	} {
+		if _, err := verifyOrderEvent(keys, body); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+}
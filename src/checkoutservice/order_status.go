@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// Order status streams
+//
+// PlaceOrder reports each step of an order (payment charged, shipped,
+// confirmed) under the subject of the verified user token, and
+// StreamOrderStatus streams those steps back to the same subject: first the
+// latest status of the subject's recent orders, then every change. The
+// stream is bound to the token it was opened with. Its metadata arrives
+// once, so the identity is verified once at open and can't change; when
+// the token expires the stream ends with UNAUTHENTICATED and JWT_EXPIRED,
+// and the client reopens it with a fresh token. Statuses live in memory
+// only, per replica.
+
+const (
+	orderStatusRecentOrders = 20    // latest statuses kept per subject
+	orderStatusMaxSubjects  = 10000 // subjects kept before evicting
+	orderStatusBuffer       = 16    // updates a slow stream may lag behind
+)
+
+var (
+	orderStatusStreamsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "order_status_streams_active",
+		Help: "Open StreamOrderStatus streams.",
+	})
+	orderStatusStreamSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "order_status_stream_seconds",
+		Help:    "Lifetime of a StreamOrderStatus stream, by how it ended.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"end"})
+	orderStatusStreamUpdates = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "order_status_stream_updates",
+		Help:    "Updates sent on a StreamOrderStatus stream, by how it ended.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	}, []string{"end"})
+	orderStatusStreamsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_status_streams_rejected_total",
+		Help: "StreamOrderStatus streams refused at open, by reason.",
+	}, []string{"reason"})
+	orderStatusUpdatesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "order_status_updates_dropped_total",
+		Help: "Updates not delivered to a stream that fell too far behind.",
+	})
+)
+
+// orderStatusBroker keeps the latest status of recent orders per subject and
+// fans changes out to the subject's streams
+type orderStatusBroker struct {
+	mu     sync.Mutex
+	recent map[string][]*pb.OrderStatusUpdate
+	subs   map[string]map[chan *pb.OrderStatusUpdate]struct{}
+}
+
+var orderStatuses = newOrderStatusBroker()
+
+func newOrderStatusBroker() *orderStatusBroker {
+	return &orderStatusBroker{
+		recent: make(map[string][]*pb.OrderStatusUpdate),
+		subs:   make(map[string]map[chan *pb.OrderStatusUpdate]struct{}),
+	}
+}
+
+// Publish records u for subject and sends it to the subject's streams
+func (b *orderStatusBroker) Publish(subject string, u *pb.OrderStatusUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recent, ok := b.recent[subject]
+	if !ok && len(b.recent) >= orderStatusMaxSubjects {
+		for s := range b.recent {
+			if len(b.subs[s]) == 0 {
+				delete(b.recent, s)
+				break
+			}
+		}
+	}
+	kept := recent[:0]
+	for _, r := range recent {
+		if r.GetOrderId() != u.GetOrderId() {
+			kept = append(kept, r)
+		}
+	}
+	kept = append(kept, u)
+	if len(kept) > orderStatusRecentOrders {
+		kept = kept[len(kept)-orderStatusRecentOrders:]
+	}
+	b.recent[subject] = kept
+	for ch := range b.subs[subject] {
+		select {
+		case ch <- u:
+		default:
+			orderStatusUpdatesDropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns the subject's recent statuses and a channel of changes;
+// cancel must be called when the stream ends
+func (b *orderStatusBroker) Subscribe(subject string) ([]*pb.OrderStatusUpdate, <-chan *pb.OrderStatusUpdate, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan *pb.OrderStatusUpdate, orderStatusBuffer)
+	if b.subs[subject] == nil {
+		b.subs[subject] = make(map[chan *pb.OrderStatusUpdate]struct{})
+	}
+	b.subs[subject][ch] = struct{}{}
+	snapshot := append([]*pb.OrderStatusUpdate(nil), b.recent[subject]...)
+	return snapshot, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[subject], ch)
+		if len(b.subs[subject]) == 0 {
+			delete(b.subs, subject)
+		}
+	}
+}
+
+// trackOrderStatus reports a step of order for the verified user; orders
+// without a verified identity have nobody to stream to
+func trackOrderStatus(ctx context.Context, orderID string, status pb.OrderStatusUpdate_Status, trackingID string) {
+	claims, err := VerifiedUserClaims(ctx)
+	if err != nil {
+		return
+	}
+	orderStatuses.Publish(claims.Subject, &pb.OrderStatusUpdate{
+		OrderId:            orderID,
+		Status:             status,
+		ShippingTrackingId: trackingID,
+		UpdatedAtUnix:      time.Now().Unix(),
+	})
+}
+
+func (cs *checkoutService) StreamOrderStatus(req *pb.StreamOrderStatusRequest, stream pb.CheckoutService_StreamOrderStatusServer) error {
+	ctx := stream.Context()
+	log := loggerFromContext(ctx)
+	token, _ := UserJWTFromContext(ctx)
+	if exp, ok := tokenExpiry(token); ok && time.Now().After(exp) {
+		orderStatusStreamsRejected.WithLabelValues("expired").Inc()
+		return authError(codes.Unauthenticated, reasonJWTExpired, "JWT expired, open the stream with a fresh token", nil)
+	}
+	claims, err := VerifiedUserClaims(ctx)
+	if err != nil {
+		orderStatusStreamsRejected.WithLabelValues("unverified").Inc()
+		return authError(codes.Unauthenticated, reasonJWTClaimsInvalid, "order status needs a verified user token: "+err.Error(), nil)
+	}
+	expires := time.Unix(claims.ExpiresAt, 0)
+	if !time.Now().Before(expires) {
+		orderStatusStreamsRejected.WithLabelValues("expired").Inc()
+		return authError(codes.Unauthenticated, reasonJWTExpired, "JWT expired, open the stream with a fresh token", nil)
+	}
+	wanted := make(map[string]bool, len(req.GetOrderIds()))
+	for _, id := range req.GetOrderIds() {
+		wanted[id] = true
+	}
+
+	opened, sent := time.Now(), 0
+	orderStatusStreamsActive.Inc()
+	end := "client"
+	defer func() {
+		orderStatusStreamsActive.Dec()
+		orderStatusStreamSeconds.WithLabelValues(end).Observe(time.Since(opened).Seconds())
+		orderStatusStreamUpdates.WithLabelValues(end).Observe(float64(sent))
+		log.Infof("[JWT-FLOW] order status stream of %s ended (%s) after %s, %d updates", pseudonym(claims.Subject), end, time.Since(opened).Round(time.Second), sent)
+	}()
+
+	snapshot, updates, cancel := orderStatuses.Subscribe(claims.Subject)
+	defer cancel()
+	send := func(u *pb.OrderStatusUpdate) error {
+		if len(wanted) > 0 && !wanted[u.GetOrderId()] {
+			return nil
+		}
+		if err := stream.Send(u); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	}
+	for _, u := range snapshot {
+		if err := send(u); err != nil {
+			end = "send_failed"
+			return err
+		}
+	}
+
+	expiry := time.NewTimer(time.Until(expires))
+	defer expiry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expiry.C:
+			end = "expired"
+			return authError(codes.Unauthenticated, reasonJWTExpired, "stream JWT expired, reopen the stream with a fresh token", nil)
+		case u := <-updates:
+			if err := send(u); err != nil {
+				end = "send_failed"
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+type recordingStatusStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan *pb.OrderStatusUpdate
+}
+
+func (s *recordingStatusStream) Context() context.Context { return s.ctx }
+
+func (s *recordingStatusStream) Send(u *pb.OrderStatusUpdate) error {
+	s.sent <- u
+	return nil
+}
+
+// verifiedContext is a request context whose user token verified as claims
+func verifiedContext(claims *UserClaims) context.Context {
+	ctx := withClaimsMemo(context.Background())
+	memo := ctx.Value(ctxKeyClaimsMemo{}).(*claimsMemo)
+	memo.once.Do(func() { memo.claims = claims })
+	return ctx
+}
+
+// TestStreamOrderStatus checks that a stream replays the subject's recent
+// statuses, only receives that subject's changes and ends with JWT_EXPIRED
+// when the token it was opened with expires.
+func TestStreamOrderStatus(t *testing.T) {
+	defer func(b *orderStatusBroker) { orderStatuses = b }(orderStatuses)
+	orderStatuses = newOrderStatusBroker()
+
+	alice := &UserClaims{Subject: "urn:hipstershop:user:a", ExpiresAt: time.Now().Add(2 * time.Second).Unix()}
+	bob := &UserClaims{Subject: "urn:hipstershop:user:b", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	trackOrderStatus(verifiedContext(alice), "o-1", pb.OrderStatusUpdate_PAYMENT_CHARGED, "")
+	trackOrderStatus(verifiedContext(alice), "o-1", pb.OrderStatusUpdate_SHIPPED, "T-1")
+
+	stream := &recordingStatusStream{ctx: verifiedContext(alice), sent: make(chan *pb.OrderStatusUpdate, 8)}
+	done := make(chan error, 1)
+	go func() { done <- (&checkoutService{}).StreamOrderStatus(&pb.StreamOrderStatusRequest{}, stream) }()
+
+	if u := <-stream.sent; u.GetOrderId() != "o-1" || u.GetStatus() != pb.OrderStatusUpdate_SHIPPED {
+		t.Errorf("replayed %v, want o-1 shipped", u)
+	}
+	trackOrderStatus(verifiedContext(bob), "o-2", pb.OrderStatusUpdate_CONFIRMED, "T-2")
+	trackOrderStatus(verifiedContext(alice), "o-1", pb.OrderStatusUpdate_CONFIRMED, "T-1")
+	if u := <-stream.sent; u.GetOrderId() != "o-1" || u.GetStatus() != pb.OrderStatusUpdate_CONFIRMED {
+		t.Errorf("got %v, want o-1 confirmed", u)
+	}
+
+	select {
+	case err := <-done:
+		st := status.Convert(err)
+		if st.Code() != codes.Unauthenticated || len(st.Details()) == 0 || st.Details()[0].(*errdetails.ErrorInfo).GetReason() != reasonJWTExpired {
+			t.Errorf("stream ended with %v, want JWT_EXPIRED", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream outlived its token")
+	}
+	if len(stream.sent) != 0 {
+		t.Errorf("sent %v, another subject's update", <-stream.sent)
+	}
+
+	expired := &recordingStatusStream{ctx: verifiedContext(&UserClaims{Subject: "urn:hipstershop:user:a", ExpiresAt: 1})}
+	if err := (&checkoutService{}).StreamOrderStatus(&pb.StreamOrderStatusRequest{}, expired); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expired token opened a stream: %v", err)
+	}
+}
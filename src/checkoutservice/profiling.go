@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	runtimepprof "runtime/pprof"
+
+	"github.com/grafana/pyroscope-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Profiling
+//
+// The debug server (DEBUG_PORT) serves net/http/pprof under /debug/pprof/,
+// which Parca or any other pprof scraper can pull. With
+// PYROSCOPE_SERVER_ADDRESS set, profiles are also pushed to Pyroscope. RPCs
+// run under a jwt_mode profiler label, so either backend can compare the CPU
+// spent on compressed, full and JWT-less requests.
+
+// registerPprof adds the pprof handlers to the debug mux
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// startPyroscope pushes continuous profiles when PYROSCOPE_SERVER_ADDRESS is set
+func startPyroscope(service string) {
+	addr := os.Getenv("PYROSCOPE_SERVER_ADDRESS")
+	if addr == "" {
+		return
+	}
+	_, err := pyroscope.Start(pyroscope.Config{
+		ApplicationName:   service,
+		ServerAddress:     addr,
+		BasicAuthUser:     os.Getenv("PYROSCOPE_BASIC_AUTH_USER"),
+		BasicAuthPassword: os.Getenv("PYROSCOPE_BASIC_AUTH_PASSWORD"),
+		Tags:              map[string]string{"pod": os.Getenv("HOSTNAME")},
+		ProfileTypes: []pyroscope.ProfileType{
+			pyroscope.ProfileCPU,
+			pyroscope.ProfileAllocObjects,
+			pyroscope.ProfileAllocSpace,
+			pyroscope.ProfileInuseObjects,
+			pyroscope.ProfileInuseSpace,
+			pyroscope.ProfileGoroutines,
+		},
+	})
+	if err != nil {
+		log.Warnf("failed to start pyroscope profiler: %v", err)
+		return
+	}
+	log.Infof("pushing profiles to pyroscope at %s", addr)
+}
+
+// profileLabelUnaryServerInterceptor runs the RPC under a jwt_mode profiler label
+func profileLabelUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	runtimepprof.Do(ctx, runtimepprof.Labels("jwt_mode", jwtModeFromMetadata(md)), func(ctx context.Context) {
+		resp, err = handler(ctx, req)
+	})
+	return resp, err
+}
+
+// profileLabelStreamServerInterceptor is the streaming counterpart
+func profileLabelStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	runtimepprof.Do(ss.Context(), runtimepprof.Labels("jwt_mode", jwtModeFromMetadata(md)), func(context.Context) {
+		err = handler(srv, ss)
+	})
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+)
+
+// Context key for the request-scoped logger
+type ctxKeyLog struct{}
+
+// withRequestLogger stores a logger carrying the request's correlation fields
+// (method, session hash, trace ID, JWT wire mode) in the context
+func withRequestLogger(ctx context.Context, method string, md metadata.MD) context.Context {
+	fields := redactedJWTFields(md)
+	fields["method"] = method
+	if traceID := traceIDFromMetadata(md); traceID != "" {
+		fields["trace_id"] = traceID
+	}
+	return context.WithValue(ctx, ctxKeyLog{}, log.WithFields(fields))
+}
+
+// loggerFromContext returns the request-scoped logger, or the process logger
+// outside of a request
+func loggerFromContext(ctx context.Context) logrus.FieldLogger {
+	if l, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		return l
+	}
+	return log
+}
+
+// traceIDFromMetadata reads the trace ID from the W3C traceparent header
+// ("00-<trace-id>-<span-id>-<flags>") so it is available before the
+// OpenTelemetry interceptor has started the server span
+func traceIDFromMetadata(md metadata.MD) string {
+	vals := md.Get("traceparent")
+	if len(vals) == 0 {
+		return ""
+	}
+	parts := strings.Split(vals[0], "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	return parts[1]
+}
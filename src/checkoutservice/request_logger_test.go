@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/jwttest"
+)
+
+func TestRequestLogger(t *testing.T) {
+	if loggerFromContext(context.Background()) != log {
+		t.Error("outside a request: not the process logger")
+	}
+
+	token := jwttest.RS256().Mint(jwttest.Claims{"session_id": "s1"})
+	md := metadata.Pairs("authorization", "Bearer "+token,
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	entry, ok := loggerFromContext(withRequestLogger(context.Background(), "/hipstershop.CheckoutService/PlaceOrder", md)).(*logrus.Entry)
+	if !ok {
+		t.Fatal("request logger is not an entry of the process logger")
+	}
+	want := logrus.Fields{
+		"method":       "/hipstershop.CheckoutService/PlaceOrder",
+		"jwt_mode":     jwtModeFull,
+		"session_hash": pseudonym("s1"),
+		"trace_id":     "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+	for k, v := range want {
+		if entry.Data[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry.Data[k], v)
+		}
+	}
+
+	for _, tp := range []string{"", "00-short-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"} {
+		if id := traceIDFromMetadata(metadata.Pairs("traceparent", tp)); id != "" {
+			t.Errorf("traceparent %q: got trace ID %q", tp, id)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// REST façade
+//
+// With REST_PORT set, checkout also answers
+//
+//	POST /v1/orders   body: PlaceOrderRequest as JSON, Authorization: Bearer <jwt>
+//
+// for integrations that can't speak gRPC. The façade is a client of this
+// service's own gRPC port, so an order placed over REST goes through the
+// same load shedding, verification and forwarding as one from the
+// frontend. The bearer token is sent in the split format the frontend uses,
+// or whole when its payload can't travel as a plain header value. Refusals
+// keep their ErrorInfo reason in the JSON error body and get the HTTP status
+// the frontend gives the same reason.
+//
+// The cart ordered from is the token's session, as it is for the frontend's
+// shoppers: user_id may be left out, and one naming another cart is refused
+// with 403 USER_ID_MISMATCH, so a caller can't order from, and empty, someone
+// else's cart. The claim is read before the gRPC server verifies the same
+// token.
+
+const restMaxBody = 1 << 20
+
+// restStatuses maps the reasons of auth_errors.go, and the ones shipping
+// passes through PlaceOrder, to HTTP statuses
+var restStatuses = map[string]int{
+	"JWT_MISSING":           http.StatusUnauthorized,
+	"JWT_EXPIRED":           http.StatusUnauthorized,
+	"JWT_REVOKED":           http.StatusUnauthorized,
+	"JWT_REASSEMBLY_FAILED": http.StatusUnauthorized,
+	"JWT_MALFORMED":         http.StatusUnauthorized,
+	"JWT_SIG_INVALID":       http.StatusUnauthorized,
+	"JWT_CLAIMS_INVALID":    http.StatusUnauthorized,
+	"JWT_HEADER_CONFLICT":   http.StatusUnauthorized,
+	"JWT_DUPLICATE_HEADER":  http.StatusUnauthorized,
+	"JWT_BINDING_MISMATCH":  http.StatusForbidden,
+	"JWT_MARKET_MISMATCH":   http.StatusForbidden,
+}
+
+// restCodeStatuses maps the codes of statuses without a known reason
+var restCodeStatuses = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Canceled:           499,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// restRequests counts façade responses by status class and reason
+var restRequests = expvar.NewMap("checkout_rest_requests")
+
+type restGateway struct {
+	client pb.CheckoutServiceClient
+}
+
+type restError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// startRESTGateway serves the façade on REST_PORT, calling the gRPC server
+// listening on grpcPort
+func startRESTGateway(grpcPort string) {
+	port := os.Getenv("REST_PORT")
+	if port == "" {
+		return
+	}
+	creds, err := clientTLSCredentials()
+	if err != nil {
+		log.Fatalf("REST gateway: %v", err)
+	}
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient("localhost:"+grpcPort,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithMaxHeaderListSize(maxHeaderListSize()),
+	)
+	if err != nil {
+		log.Fatalf("REST gateway: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/orders", &restGateway{client: pb.NewCheckoutServiceClient(conn)})
+	srv := &http.Server{Addr: ":" + port, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Infof("starting REST gateway on :%s", port)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Warnf("REST gateway stopped: %v", err)
+		}
+	}()
+}
+
+func (g *restGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeRESTError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "use POST")
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		writeRESTError(w, http.StatusUnauthorized, "JWT_MISSING", "an Authorization: Bearer token is required")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, restMaxBody))
+	if err != nil {
+		writeRESTError(w, http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", err.Error())
+		return
+	}
+	req := new(pb.PlaceOrderRequest)
+	if err := protojson.Unmarshal(body, req); err != nil {
+		writeRESTError(w, http.StatusBadRequest, "INVALID_BODY", err.Error())
+		return
+	}
+	session := restTokenSession(strings.TrimSpace(token))
+	if session == "" || (req.UserId != "" && req.UserId != session) {
+		writeRESTError(w, http.StatusForbidden, "USER_ID_MISMATCH", "user_id must be the token's session_id")
+		return
+	}
+	req.UserId = session
+
+	ctx := metadata.NewOutgoingContext(r.Context(), restMetadata(r, strings.TrimSpace(token)))
+	resp, err := g.client.PlaceOrder(ctx, req)
+	if err != nil {
+		code, reason := restStatus(err)
+		if code == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		writeRESTError(w, code, reason, status.Convert(err).Message())
+		return
+	}
+	out, err := protojson.Marshal(resp)
+	if err != nil {
+		writeRESTError(w, http.StatusInternalServerError, codes.Internal.String(), err.Error())
+		return
+	}
+	restRequests.Add("2xx", 1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// restTokenSession reads the session_id claim of token, empty when it has
+// none or can't be decoded
+func restTokenSession(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims UserClaims
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.SessionID
+}
+
+// restMetadata carries token in the split headers when its payload is a
+// valid header value, whole otherwise, along with the trace context
+func restMetadata(r *http.Request, token string) metadata.MD {
+	md := metadata.MD{}
+	if tp := r.Header.Get("traceparent"); tp != "" {
+		md.Set("traceparent", tp)
+	}
+	if components, err := DecomposeJWT(token); err == nil && printableHeaderValue(components.Payload) {
+		md.Set("x-jwt-header", components.Header)
+		md.Set("x-jwt-payload", components.Payload)
+		md.Set("x-jwt-sig", components.Signature)
+		return md
+	}
+	md.Set("authorization", "Bearer "+token)
+	return md
+}
+
+func printableHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// restStatus returns the HTTP status and error name for a PlaceOrder error
+func restStatus(err error) (int, string) {
+	st := status.Convert(err)
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == jwtErrorDomain {
+			if code, ok := restStatuses[info.GetReason()]; ok {
+				return code, info.GetReason()
+			}
+		}
+	}
+	if code, ok := restCodeStatuses[st.Code()]; ok {
+		return code, st.Code().String()
+	}
+	return http.StatusInternalServerError, st.Code().String()
+}
+
+func writeRESTError(w http.ResponseWriter, code int, name, msg string) {
+	restRequests.Add(fmt.Sprintf("%dxx %s", code/100, name), 1)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(restError{Error: name, Message: msg})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// fakeCheckoutClient answers PlaceOrder with err, recording the metadata
+type fakeCheckoutClient struct {
+	pb.CheckoutServiceClient
+	md  metadata.MD
+	req *pb.PlaceOrderRequest
+	err error
+}
+
+func (f *fakeCheckoutClient) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest, _ ...grpc.CallOption) (*pb.PlaceOrderResponse, error) {
+	f.md, _ = metadata.FromOutgoingContext(ctx)
+	f.req = req
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &pb.PlaceOrderResponse{Order: &pb.OrderResult{OrderId: "order-1"}}, nil
+}
+
+func TestRESTGateway(t *testing.T) {
+	token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1","session_id":"s1"}`)) + ".sig"
+	postAs := func(g *restGateway, auth, userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(`{"userId":"`+userID+`","userCurrency":"USD","email":"a@example.com"}`))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w
+	}
+	post := func(g *restGateway, auth string) *httptest.ResponseRecorder { return postAs(g, auth, "s1") }
+
+	client := &fakeCheckoutClient{}
+	g := &restGateway{client: client}
+	w := post(g, "Bearer "+token)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "order-1") {
+		t.Fatalf("PlaceOrder = %d %s", w.Code, w.Body)
+	}
+	if got := client.md.Get("x-jwt-payload"); len(got) != 1 || got[0] != `{"sub":"u1","session_id":"s1"}` {
+		t.Errorf("x-jwt-payload = %q", got)
+	}
+	if len(client.md.Get("authorization")) != 0 {
+		t.Error("split token also sent whole")
+	}
+	if client.req.GetUserCurrency() != "USD" || client.req.GetUserId() != "s1" {
+		t.Errorf("request = %v", client.req)
+	}
+
+	// The cart is the token's session; another one is refused
+	if w := postAs(g, "Bearer "+token, ""); w.Code != http.StatusOK || client.req.GetUserId() != "s1" {
+		t.Errorf("no user_id = %d, ordered from %q", w.Code, client.req.GetUserId())
+	}
+	client.req = nil
+	if w := postAs(g, "Bearer "+token, "someone-else"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "USER_ID_MISMATCH") || client.req != nil {
+		t.Errorf("another user's cart = %d %s", w.Code, w.Body)
+	}
+	noSession := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1"}`)) + ".sig"
+	if w := postAs(g, "Bearer "+noSession, ""); w.Code != http.StatusForbidden || client.req != nil {
+		t.Errorf("token without session_id = %d %s", w.Code, w.Body)
+	}
+
+	if w := post(g, ""); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "JWT_MISSING") {
+		t.Errorf("no token = %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		err    error
+		status int
+		name   string
+	}{
+		{authError(codes.Unauthenticated, reasonJWTExpired, "expired", nil), http.StatusUnauthorized, reasonJWTExpired},
+		{authError(codes.PermissionDenied, "JWT_MARKET_MISMATCH", "market", nil), http.StatusForbidden, "JWT_MARKET_MISMATCH"},
+		{status.Error(codes.ResourceExhausted, "shed"), http.StatusTooManyRequests, "ResourceExhausted"},
+		{status.Error(codes.Internal, "boom"), http.StatusInternalServerError, "Internal"},
+	}
+	for _, tc := range tests {
+		client.err = tc.err
+		w := post(g, "Bearer "+token)
+		var body restError
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != tc.status || body.Error != tc.name {
+			t.Errorf("%v: got %d %q, want %d %q", tc.err, w.Code, body.Error, tc.status, tc.name)
+		}
+	}
+}
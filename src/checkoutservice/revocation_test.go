@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRevocationHandlerSignature checks that only notices signed with
+// JWT_REVOCATION_KEY revoke anything
+func TestRevocationHandlerSignature(t *testing.T) {
+	defer func(key []byte) { revocationKey = key }(revocationKey)
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	sign := func(key, body string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(body))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	post := func(body, sig string) int {
+		r := httptest.NewRequest(http.MethodPost, "/jwt/revoke", strings.NewReader(body))
+		if sig != "" {
+			r.Header.Set("X-Revocation-Signature", sig)
+		}
+		rec := httptest.NewRecorder()
+		revocationHandler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		name, key, jti, sig string
+		want                int
+	}{
+		{"no key configured", "", "unsigned-no-key", "", http.StatusForbidden},
+		{"no key configured, signed with empty key", "", "signed-no-key", sign("", `{"jti":"signed-no-key","exp":`+exp+`}`), http.StatusForbidden},
+		{"unsigned", "shared", "unsigned", "", http.StatusForbidden},
+		{"other key", "shared", "other-key", sign("other", `{"jti":"other-key","exp":`+exp+`}`), http.StatusForbidden},
+		{"not base64", "shared", "garbled", "!!!", http.StatusForbidden},
+		{"signed", "shared", "signed", sign("shared", `{"jti":"signed","exp":`+exp+`}`), http.StatusNoContent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			revocationKey = []byte(tc.key)
+			body := `{"jti":"` + tc.jti + `","exp":` + exp + `}`
+			if got := post(body, tc.sig); got != tc.want {
+				t.Fatalf("status = %d, want %d", got, tc.want)
+			}
+			if revoked := revocations.Revoked(tc.jti, ""); revoked != (tc.want == http.StatusNoContent) {
+				t.Errorf("revoked = %v after status %d", revoked, tc.want)
+			}
+		})
+	}
+
+	// A signature does not carry over to a different body
+	revocationKey = []byte("shared")
+	sig := sign("shared", `{"jti":"original","exp":`+exp+`}`)
+	if got := post(`{"kid":"original","exp":`+exp+`}`, sig); got != http.StatusForbidden {
+		t.Errorf("replayed signature on another body = %d, want %d", got, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Split downgrade
+//
+// A caller whose split headers keep failing to reassemble (it sends a format
+// version this receiver can't read) is asked to send the whole token instead.
+// After JWT_DOWNGRADE_THRESHOLD failures (default 5, 0 turns this off) from
+// one peer address within a minute, its failing calls are refused with
+// FailedPrecondition and an ErrorInfo of reason JWT_SPLIT_DOWNGRADE whose
+// cooldown_seconds metadata is JWT_DOWNGRADE_COOLDOWN (default 5m).
+//
+// As a caller, checkout retries such a unary call once with authorization
+// and sends the whole token to that service until the cooldown ends; streams
+// follow a downgrade but, like header overflows, can't trigger one.
+
+const splitDowngradeReason = "JWT_SPLIT_DOWNGRADE"
+
+const (
+	splitDowngradeWindow      = time.Minute
+	defaultDowngradeCooldown  = 5 * time.Minute
+	maxDowngradeCooldown      = time.Hour
+	maxReassemblyFailurePeers = 1024
+)
+
+var (
+	downgradeThreshold = loadDowngradeThreshold()
+	downgradeCooldown  = loadDowngradeCooldown()
+)
+
+func loadDowngradeThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("JWT_DOWNGRADE_THRESHOLD")); err == nil && n >= 0 {
+		return n
+	}
+	return 5
+}
+
+func loadDowngradeCooldown() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("JWT_DOWNGRADE_COOLDOWN")); err == nil && d > 0 {
+		return min(d, maxDowngradeCooldown)
+	}
+	return defaultDowngradeCooldown
+}
+
+// splitDowngradeTotal counts receiver side reassembly failures (tolerated,
+// downgrade_requested) and caller side downgrades (downgraded, retried,
+// retry_failed, avoided)
+var splitDowngradeTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jwt_split_downgrade_total",
+	Help: "Split JWT reassembly failures and the full-JWT downgrades they caused.",
+}, []string{"service", "outcome"})
+
+// reassemblyFailures counts failures per peer in fixed windows
+type reassemblyFailures struct {
+	mu    sync.Mutex
+	peers map[string]*failureWindow
+}
+
+type failureWindow struct {
+	start time.Time
+	count int
+}
+
+var peerReassemblyFailures = &reassemblyFailures{peers: make(map[string]*failureWindow)}
+
+// Record counts a failure from peer and reports whether it reached threshold
+func (f *reassemblyFailures) Record(peer string, threshold int, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := f.peers[peer]
+	if w == nil || now.Sub(w.start) >= splitDowngradeWindow {
+		if w == nil && len(f.peers) >= maxReassemblyFailurePeers {
+			f.peers = make(map[string]*failureWindow)
+		}
+		w = &failureWindow{start: now}
+		f.peers[peer] = w
+	}
+	w.count++
+	return w.count >= threshold
+}
+
+// peerHost is the address of the calling peer without its port
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// reassemblyFailed records a failed reassembly of the call's split headers
+// and returns the downgrade request to send back once the peer has failed
+// too often, nil while the failure is tolerated
+func reassemblyFailed(ctx context.Context, method string) error {
+	if downgradeThreshold == 0 {
+		return nil
+	}
+	host := peerHost(ctx)
+	service := serviceFromMethod(method)
+	if !peerReassemblyFailures.Record(host, downgradeThreshold, time.Now()) {
+		splitDowngradeTotal.WithLabelValues(service, "tolerated").Inc()
+		return nil
+	}
+	splitDowngradeTotal.WithLabelValues(service, "downgrade_requested").Inc()
+	loggerFromContext(ctx).Warnf("[JWT-FLOW] %s keeps sending split JWTs that can't be reassembled, asking it to send whole tokens for %s", host, downgradeCooldown)
+	return authError(codes.FailedPrecondition, splitDowngradeReason,
+		"split JWT headers could not be reassembled, resend the token in authorization",
+		map[string]string{"cooldown_seconds": strconv.Itoa(int(downgradeCooldown / time.Second))})
+}
+
+// splitDowngradeCooldown returns how long a receiver asked to be sent whole
+// tokens, or false when err isn't a downgrade request
+func splitDowngradeCooldown(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return 0, false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.GetDomain() != jwtErrorDomain || info.GetReason() != splitDowngradeReason {
+			continue
+		}
+		if s, err := strconv.Atoi(info.GetMetadata()["cooldown_seconds"]); err == nil && s > 0 {
+			return min(time.Duration(s)*time.Second, maxDowngradeCooldown), true
+		}
+		return defaultDowngradeCooldown, true
+	}
+	return 0, false
+}
+
+// downgradedTargets remembers until when each service gets whole tokens
+type downgradedTargets struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var splitDowngrades = &downgradedTargets{until: make(map[string]time.Time)}
+
+// Active reports whether service is downgraded, ending expired downgrades
+func (d *downgradedTargets) Active(service string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.until[service]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(d.until, service)
+	log.Infof("[JWT-FLOW] Downgrade of %s ended, splitting JWTs again", service)
+	return false
+}
+
+// Downgrade sends service whole tokens for cooldown
+func (d *downgradedTargets) Downgrade(service string, cooldown time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.until[service] = time.Now().Add(cooldown)
+}
+
+// withWholeJWT replaces the split headers of ctx with token in authorization
+func withWholeJWT(ctx context.Context, token string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for _, k := range splitJWTKeys {
+		delete(md, k)
+	}
+	md.Set("authorization", "Bearer "+token)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// downgradeInvoker wraps invoker so a call whose receiver asks for the whole
+// user token of tokenCtx downgrades that service and is retried once
+func downgradeInvoker(invoker grpc.UnaryInvoker, tokenCtx context.Context) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		cooldown, ok := splitDowngradeCooldown(err)
+		if !ok || !carriesSplitJWT(ctx) {
+			return err
+		}
+		token, ok := UserJWTFromContext(tokenCtx)
+		if !ok {
+			return err
+		}
+		service := serviceFromMethod(method)
+		splitDowngrades.Downgrade(service, cooldown)
+		splitDowngradeTotal.WithLabelValues(service, "downgraded").Inc()
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] %s can't reassemble our split JWTs, sending it whole tokens for %s", service, cooldown)
+		if err = invoker(withWholeJWT(ctx, token), method, req, reply, cc, opts...); err != nil {
+			splitDowngradeTotal.WithLabelValues(service, "retry_failed").Inc()
+		} else {
+			splitDowngradeTotal.WithLabelValues(service, "retried").Inc()
+		}
+		return err
+	}
+}
+
+// splitDowngraded reports whether method's service is downgraded, and
+// records the whole token sent because of it
+func splitDowngraded(method string) bool {
+	service := serviceFromMethod(method)
+	if !splitDowngrades.Active(service) {
+		return false
+	}
+	splitDowngradeTotal.WithLabelValues(service, "avoided").Inc()
+	return true
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+func TestReassemblyFailuresRequestDowngrade(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 41000}})
+	peerReassemblyFailures = &reassemblyFailures{peers: make(map[string]*failureWindow)}
+	const method = "/hipstershop.CheckoutService/PlaceOrder"
+
+	for i := 1; i < downgradeThreshold; i++ {
+		if err := reassemblyFailed(ctx, method); err != nil {
+			t.Fatalf("failure %d: got %v, want it tolerated", i, err)
+		}
+	}
+	err := reassemblyFailed(ctx, method)
+	cooldown, ok := splitDowngradeCooldown(err)
+	if !ok || cooldown != downgradeCooldown {
+		t.Fatalf("failure %d: got %v (cooldown %s), want a downgrade request for %s", downgradeThreshold, err, cooldown, downgradeCooldown)
+	}
+	if downstreamAuthError(err) != nil {
+		t.Error("a downgrade request would be passed on to checkout's caller")
+	}
+
+	// A new window starts over
+	later := time.Now().Add(splitDowngradeWindow)
+	if peerReassemblyFailures.Record("10.0.0.7", downgradeThreshold, later) {
+		t.Error("failures from an earlier window counted towards the threshold")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Senders may replace the static claim block by x-jwt-static-sha, the first
+// 8 bytes of its SHA-256, once this process has stored the block. Blocks are
+// stored whenever both headers arrive; an unknown reference fails the RPC with
+// FailedPrecondition and an ErrorInfo detail asking the sender to resend.
+
+const (
+	staticBlockUnknownReason = "JWT_STATIC_BLOCK_UNKNOWN"
+	jwtErrorDomain           = "jwt-split.hipstershop"
+)
+
+// staticDictionaryEvents counts stored blocks, lookups and misses
+var staticDictionaryEvents = expvar.NewMap("jwt_static_dictionary")
+
+var staticDictionary = newStaticBlockDictionary(1024)
+
+// staticBlockDictionary maps references to static blocks, evicting the
+// oldest entry when full
+type staticBlockDictionary struct {
+	mu     sync.Mutex
+	max    int
+	blocks map[string]string
+	order  []string
+}
+
+func newStaticBlockDictionary(max int) *staticBlockDictionary {
+	return &staticBlockDictionary{max: max, blocks: make(map[string]string)}
+}
+
+func (d *staticBlockDictionary) Get(sha string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	block, ok := d.blocks[sha]
+	return block, ok
+}
+
+func (d *staticBlockDictionary) Put(sha, block string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.blocks[sha]; ok {
+		return
+	}
+	if len(d.order) >= d.max {
+		delete(d.blocks, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.blocks[sha] = block
+	d.order = append(d.order, sha)
+	staticDictionaryEvents.Add("stored", 1)
+}
+
+// staticBlockSHA is the reference of a static block
+func staticBlockSHA(block string) string {
+	sum := sha256.Sum256([]byte(block))
+	return hex.EncodeToString(sum[:8])
+}
+
+// staticBlockUnknownError asks the sender for the full static block
+type staticBlockUnknownError struct {
+	sha string
+}
+
+func (e *staticBlockUnknownError) Error() string {
+	return fmt.Sprintf("unknown static claim block %s", e.sha)
+}
+
+func (e *staticBlockUnknownError) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   staticBlockUnknownReason,
+		Domain:   jwtErrorDomain,
+		Metadata: map[string]string{"sha": e.sha},
+	}); err == nil {
+		return detailed
+	}
+	return st
+}
+
+// isStaticBlockUnknown reports whether err asks the sender to resend the block
+func isStaticBlockUnknown(err error) bool {
+	var unknown *staticBlockUnknownError
+	return errors.As(err, &unknown)
+}
+
+// staticBlockFromMetadata returns the static claim block sent in full or by
+// reference, storing blocks that arrive with their reference
+func staticBlockFromMetadata(md metadata.MD) (string, error) {
+	var block, sha string
+	if v := md.Get("x-jwt-static"); len(v) > 0 {
+		block = v[0]
+	}
+	if v := md.Get("x-jwt-static-sha"); len(v) > 0 {
+		sha = v[0]
+	}
+	switch {
+	case sha == "":
+		return block, nil
+	case block != "":
+		if staticBlockSHA(block) != sha {
+			return "", fmt.Errorf("x-jwt-static-sha %s does not match x-jwt-static", sha)
+		}
+		staticDictionary.Put(sha, block)
+		return block, nil
+	}
+	if block, ok := staticDictionary.Get(sha); ok {
+		staticDictionaryEvents.Add("hits", 1)
+		return block, nil
+	}
+	staticDictionaryEvents.Add("misses", 1)
+	return "", &staticBlockUnknownError{sha: sha}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Stream-bound claims
+//
+// A gRPC stream carries metadata once, in its initial headers, so the JWT of a
+// stream is sent and reassembled once no matter how many messages follow.
+// With JWT_STREAM_BOUND_CLAIMS=true the stream interceptor turns that token
+// into a StreamClaims object bound to the stream:
+//
+//   - the claims are parsed once at stream open and are immutable afterwards;
+//     every message on the stream is handled under the same identity, there is
+//     no per-message token and no way to switch identity mid-stream
+//   - the token's expiry is checked on every received message, so a long-lived
+//     stream can't outlive the token that opened it; the client must open a new
+//     stream with a fresh token
+//   - claims are not re-verified per message: whatever verification applies to
+//     the token happens once, against the same bytes the claims came from
+
+// StreamClaims is the identity a stream was opened with
+type StreamClaims struct {
+	Subject   string
+	SessionID string
+	ExpiresAt time.Time
+	OpenedAt  time.Time
+
+	token  string
+	claims map[string]interface{}
+}
+
+// Context key for the claims bound to the current stream
+type ctxKeyStreamClaims struct{}
+
+// streamBoundClaimsEnabled turns on stream-bound claims
+var streamBoundClaimsEnabled = os.Getenv("JWT_STREAM_BOUND_CLAIMS") == "true"
+
+// newStreamClaims parses the payload of the token a stream was opened with
+func newStreamClaims(token string) (*StreamClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWT format: expected 3 parts, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse JWT claims: %w", err)
+	}
+
+	sc := &StreamClaims{OpenedAt: time.Now(), token: token, claims: claims}
+	sc.Subject, _ = claims["sub"].(string)
+	sc.SessionID, _ = claims["session_id"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		sc.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return sc, nil
+}
+
+// Claim returns a single claim from the token the stream was opened with
+func (c *StreamClaims) Claim(name string) (interface{}, bool) {
+	v, ok := c.claims[name]
+	return v, ok
+}
+
+// Token returns the token the stream was opened with
+func (c *StreamClaims) Token() string {
+	return c.token
+}
+
+// Expired reports whether the token has expired; tokens without exp never do
+func (c *StreamClaims) Expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt)
+}
+
+// StreamClaimsFromContext returns the claims bound to the current stream;
+// handlers can call it for every message with the stream's context
+func StreamClaimsFromContext(ctx context.Context) (*StreamClaims, bool) {
+	claims, ok := ctx.Value(ctxKeyStreamClaims{}).(*StreamClaims)
+	return claims, ok
+}
+
+// bindStreamClaims attaches the stream's claims to ctx and wraps ss so its
+// messages are rejected once the token expires
+func bindStreamClaims(ctx context.Context, ss grpc.ServerStream, token string) (context.Context, grpc.ServerStream) {
+	if !streamBoundClaimsEnabled || token == "" {
+		return ctx, ss
+	}
+	claims, err := newStreamClaims(token)
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Stream opened with unparseable JWT: %v", err)
+		return ctx, ss
+	}
+	return context.WithValue(ctx, ctxKeyStreamClaims{}, claims), &claimsBoundServerStream{ServerStream: ss, claims: claims}
+}
+
+// claimsBoundServerStream enforces the expiry of the stream-bound token
+type claimsBoundServerStream struct {
+	grpc.ServerStream
+	claims *StreamClaims
+}
+
+func (s *claimsBoundServerStream) RecvMsg(m interface{}) error {
+	if s.claims.Expired(time.Now()) {
+		return authError(codes.Unauthenticated, reasonJWTExpired, "stream JWT expired, reopen the stream with a fresh token", nil)
+	}
+	return s.ServerStream.RecvMsg(m)
+}
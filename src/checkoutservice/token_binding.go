@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// tokenBindingEnabled turns on proof-of-possession checks: a token whose
+// issuer embedded a cnf claim (RFC 8705 certificate thumbprint) is only
+// accepted from the workload holding that certificate, so split headers
+// captured from one connection can't be replayed from another. Peers present
+// certificates over mutual TLS, which GRPC_TLS_* turns on.
+var tokenBindingEnabled = os.Getenv("JWT_TOKEN_BINDING") == "true"
+
+// bindingRelays holds the certificate thumbprints (x5t#S256), listed in
+// JWT_BINDING_RELAYS, of workloads that forward the bound tokens they
+// receive. A relay checks the binding on its own hop, as checkout does for
+// the frontend's tokens, so a bound token it presents further down is
+// accepted although the cnf names the first caller.
+var bindingRelays = parseBindingRelays(os.Getenv("JWT_BINDING_RELAYS"))
+
+// parseBindingRelays reads a comma-separated list of base64url SHA-256
+// thumbprints
+func parseBindingRelays(v string) map[string]bool {
+	relays := make(map[string]bool)
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			relays[t] = true
+		}
+	}
+	return relays
+}
+
+// validBindingRelay reports whether t looks like an x5t#S256 thumbprint
+func validBindingRelay(t string) bool {
+	sum, err := base64.RawURLEncoding.DecodeString(t)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// cnfThumbprint returns the x5t#S256 confirmation of a token, if any
+func cnfThumbprint(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	var claims struct {
+		Cnf struct {
+			X5tS256 string `json:"x5t#S256"`
+		} `json:"cnf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Cnf.X5tS256 == "" {
+		return "", false
+	}
+	return claims.Cnf.X5tS256, true
+}
+
+// peerCertThumbprint returns the base64url SHA-256 of the peer's TLS leaf
+// certificate, as used by x5t#S256
+func peerCertThumbprint(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return "", false
+	}
+	sum := sha256.Sum256(tlsInfo.State.PeerCertificates[0].Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), true
+}
+
+// checkTokenBinding rejects a bound token unless the peer holds the
+// certificate it is bound to or is one of the bindingRelays; tokens without
+// a cnf claim are unaffected
+func checkTokenBinding(ctx context.Context, token string) error {
+	if !tokenBindingEnabled || token == "" {
+		return nil
+	}
+	want, bound := cnfThumbprint(token)
+	if !bound {
+		return nil
+	}
+	got, ok := peerCertThumbprint(ctx)
+	if !ok {
+		loggerFromContext(ctx).Warn("[JWT-FLOW] Rejecting bound JWT received without a TLS client certificate")
+		jwtSLO.RecordFailure(sloReasonVerification)
+		return authError(codes.Unauthenticated, reasonJWTBindingMismatch, "JWT is bound to a client certificate but the peer presented none", nil)
+	}
+	if got != want && !bindingRelays[got] {
+		loggerFromContext(ctx).Warn("[JWT-FLOW] Rejecting bound JWT presented by a different peer")
+		jwtSLO.RecordFailure(sloReasonVerification)
+		return authError(codes.Unauthenticated, reasonJWTBindingMismatch, "JWT is bound to a different client certificate", nil)
+	}
+	return nil
+}
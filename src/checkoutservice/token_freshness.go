@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+)
+
+// Token freshness
+//
+// The age (now - iat) of the user tokens reaching checkoutservice and the share of
+// their lifetime already used, under the names the frontend uses for its
+// own hop. The frontend generates the recording and alerting rules for all
+// hops, see docs/token-freshness-rules.yaml.
+
+var (
+	tokenAgeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jwt_token_age_seconds",
+		Help:    "Age (now - iat) of the user tokens seen at a hop.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"hop"})
+	tokenLifetimeUsed = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jwt_token_lifetime_used_ratio",
+		Help:    "Share of the lifetime (exp - iat) of the user tokens seen at a hop already used.",
+		Buckets: []float64{0.1, 0.25, 0.5, 0.75, 0.8, 0.85, 0.9, 0.95, 0.99, 1},
+	}, []string{"hop"})
+)
+
+// tokenFreshnessUnaryServerInterceptor observes the user token of each call;
+// it runs after jwtUnaryServerInterceptor has read the token into ctx
+func tokenFreshnessUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if iat, exp, ok := tokenTimes(ctx); ok {
+		observeTokenFreshness(iat, exp)
+	}
+	return handler(ctx, req)
+}
+
+// observeTokenFreshness records a token issued at iat and expiring at exp,
+// both Unix seconds
+func observeTokenFreshness(iat, exp int64) {
+	if iat <= 0 || exp <= iat {
+		return
+	}
+	age := float64(time.Now().Unix() - iat)
+	if age < 0 {
+		age = 0
+	}
+	tokenAgeSeconds.WithLabelValues("checkoutservice").Observe(age)
+	tokenLifetimeUsed.WithLabelValues("checkoutservice").Observe(age / float64(exp-iat))
+}
+
+// tokenTimes reads iat and exp from the user token in ctx, from the split
+// payload when it arrived split
+func tokenTimes(ctx context.Context) (iat, exp int64, ok bool) {
+	payload, _ := ctx.Value(ctxKeyJWTPayload{}).(string)
+	if payload == "" {
+		token, _ := ctx.Value(ctxKeyJWT{}).(string)
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return 0, 0, false
+		}
+		b, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return 0, 0, false
+		}
+		payload = string(b)
+	}
+	var times struct {
+		IssuedAt  int64 `json:"iat"`
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal([]byte(payload), &times); err != nil {
+		return 0, 0, false
+	}
+	return times.IssuedAt, times.ExpiresAt, times.IssuedAt > 0
+}
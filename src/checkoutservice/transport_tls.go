@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Mutual TLS
+//
+// GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE name the certificate checkout
+// serves and presents to its downstreams; GRPC_TLS_CA_FILE holds the CA that
+// signs the certificates of the other services. With the three set the gRPC
+// server only speaks TLS and verifies the client certificates it is shown,
+// and outgoing calls present checkout's own certificate. Those are the
+// certificates JWT_TOKEN_BINDING compares cnf-bound tokens against; without
+// TLS every connection stays plaintext and bound tokens are refused. The
+// REST gateway dials the server on localhost, so with REST_PORT set the
+// certificate has to be valid for localhost too.
+
+var (
+	tlsCertFile = os.Getenv("GRPC_TLS_CERT_FILE")
+	tlsKeyFile  = os.Getenv("GRPC_TLS_KEY_FILE")
+	tlsCAFile   = os.Getenv("GRPC_TLS_CA_FILE")
+)
+
+// loadTLSConfig returns the TLS configuration of both sides of checkout's
+// connections, nil when TLS is off
+func loadTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("GRPC_TLS_CERT_FILE: %w", err)
+	}
+	caPEM, err := os.ReadFile(tlsCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("GRPC_TLS_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("GRPC_TLS_CA_FILE %s holds no certificates", tlsCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		// Health probes come without a certificate; bound tokens don't
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// serverTLSOptions returns the server option that turns on TLS, none when
+// TLS is off
+func serverTLSOptions() ([]grpc.ServerOption, error) {
+	cfg, err := loadTLSConfig()
+	if cfg == nil || err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(cfg))}, nil
+}
+
+// clientTLSCredentials returns the credentials of outgoing connections, nil
+// when TLS is off
+func clientTLSCredentials() (credentials.TransportCredentials, error) {
+	cfg, err := loadTLSConfig()
+	if cfg == nil || err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha256"
+	"expvar"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// verifyFlight coalesces concurrent verifications of the same token: under
+// a burst, every request of a session arrives with identical bytes, and only
+// the first runs the RSA verification while the rest wait for its result.
+// Callers share the returned claims and must not modify them.
+var verifyFlight singleflight.Group
+
+// verifyFlightEvents counts verifications run and callers that joined one
+// already in flight
+var verifyFlightEvents = expvar.NewMap("jwt_verify_singleflight")
+
+// verifyUserJWT verifies token, sharing the work with concurrent callers
+// presenting the same token
+func verifyUserJWT(token string) (*UserClaims, error) {
+	key := sha256.Sum256([]byte(token))
+	ran := false
+	v, err, _ := verifyFlight.Do(string(key[:]), func() (interface{}, error) {
+		ran = true
+		verifyFlightEvents.Add("verifications", 1)
+		return verifyUserJWTNow(token)
+	})
+	if !ran {
+		verifyFlightEvents.Add("coalesced", 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*UserClaims), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/jwtcodec"
+)
+
+// Wire codecs
+//
+// Besides the x-jwt-* split headers and authorization, tokens may arrive in
+// any format registered in jwtcodec (cbor, protobuf, gzip-split, ...). They
+// are decoded to the full token and forwarded as such. Every response
+// advertises the decodable formats in x-jwt-codecs so senders can negotiate
+// one. reference-token is decodable once JWT_REFERENCE_RESOLVER_URL points
+// at the sender's /jwt/ref/ endpoint. References are resolved within the
+// RPC's context, and ones the sender didn't know are refused for a while
+// without asking again.
+
+func init() {
+	if url := os.Getenv("JWT_REFERENCE_RESOLVER_URL"); url != "" {
+		jwtcodec.SetReferenceStore(&jwtcodec.HTTPStore{URL: url})
+	}
+}
+
+// codecAdvertisement is the response header listing the decodable codecs
+func codecAdvertisement() metadata.MD {
+	return metadata.Pairs(jwtcodec.AdvertiseHeader, jwtcodec.Advertise())
+}
+
+// codecJWTFromMetadata decodes a token sent through a jwtcodec codec. It
+// returns "" when md carries none or it doesn't decode.
+func codecJWTFromMetadata(ctx context.Context, md metadata.MD, start time.Time) string {
+	token, name, err := jwtcodec.DecodeContext(ctx, md)
+	if name == "" {
+		return ""
+	}
+	observeReassembly(md, start)
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to decode %s JWT: %v", name, err)
+		jwtSLO.RecordFailure(sloReasonReassembly)
+		return ""
+	}
+	return token
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/metadata"
+)
+
+// Wire formats
+//
+// The JWT interceptor records the format the user token arrived in, after
+// header conflicts are resolved, so handlers, logs and business metrics can
+// segment by auth transport without looking at the metadata again:
+//
+//	full       authorization: Bearer <jwt>
+//	split-v1   x-jwt-header, x-jwt-payload (raw JSON), x-jwt-sig
+//	split-v2   claim blocks x-jwt-claims, x-jwt-static, x-jwt-session, x-jwt-dynamic
+//	split-v3   claim blocks with the static block sent as x-jwt-static-sha
+//	reference  x-jwt-ref, resolved through the reference store
+//
+// The binary jwtcodec codecs report their codec name (gzip-split, cbor,
+// protobuf), and calls without a token "none".
+
+const (
+	wireFormatNone      = "none"
+	wireFormatFull      = "full"
+	wireFormatSplitV1   = "split-v1"
+	wireFormatSplitV2   = "split-v2"
+	wireFormatSplitV3   = "split-v3"
+	wireFormatReference = "reference"
+)
+
+type ctxKeyWireFormat struct{}
+
+var ordersPlacedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "checkout_orders_placed_total",
+	Help: "Orders placed, by the wire format of the user token.",
+}, []string{"wire_format"})
+
+// WireFormatFromContext returns the format the call's user token arrived in,
+// "none" outside the JWT interceptor or without a token
+func WireFormatFromContext(ctx context.Context) string {
+	if f, ok := ctx.Value(ctxKeyWireFormat{}).(string); ok {
+		return f
+	}
+	return wireFormatNone
+}
+
+// withWireFormat records f on ctx and on its request logger
+func withWireFormat(ctx context.Context, f string) context.Context {
+	ctx = context.WithValue(ctx, ctxKeyWireFormat{}, f)
+	accessFromContext(ctx).arrivedAs(f)
+	return context.WithValue(ctx, ctxKeyLog{}, loggerFromContext(ctx).WithField("wire_format", f))
+}
+
+// wireFormatFromMetadata names the format of md's token; split tells whether
+// the interceptor used the split headers
+func wireFormatFromMetadata(md metadata.MD, split bool) string {
+	switch {
+	case split && len(md.Get("x-jwt-payload")) > 0:
+		return wireFormatSplitV1
+	case split && len(md.Get("x-jwt-static-sha")) > 0 && len(md.Get("x-jwt-static")) == 0:
+		return wireFormatSplitV3
+	case split:
+		return wireFormatSplitV2
+	case len(md.Get("authorization")) > 0:
+		return wireFormatFull
+	case len(md.Get("x-jwt-ref")) > 0:
+		return wireFormatReference
+	case len(md.Get("x-jwt-payload-gz-bin")) > 0:
+		return "gzip-split"
+	case len(md.Get("x-jwt-cbor-bin")) > 0:
+		return "cbor"
+	case len(md.Get("x-jwt-pb-bin")) > 0:
+		return "protobuf"
+	}
+	return wireFormatNone
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestWireFormatFromContext(t *testing.T) {
+	components, _ := DecomposeJWT(benchJWT)
+	for _, tc := range []struct {
+		md   metadata.MD
+		want string
+	}{
+		{metadata.MD{}, wireFormatNone},
+		{metadata.Pairs("authorization", "Bearer "+benchJWT), wireFormatFull},
+		{metadata.Pairs("x-jwt-header", components.Header, "x-jwt-payload", components.Payload, "x-jwt-sig", components.Signature), wireFormatSplitV1},
+		{metadata.Pairs("x-jwt-ref", "r1"), wireFormatReference},
+	} {
+		var got string
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			got = WireFormatFromContext(ctx)
+			return nil, nil
+		}
+		ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+		_, _ = jwtUnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: benchMethod}, handler)
+		if got != tc.want {
+			t.Errorf("%v: WireFormatFromContext = %q, want %q", tc.md, got, tc.want)
+		}
+	}
+
+	blocks := metadata.Pairs("x-jwt-claims", "sub", "x-jwt-static-sha", "abc")
+	if got := wireFormatFromMetadata(blocks, true); got != wireFormatSplitV3 {
+		t.Errorf("static block reference = %q, want %q", got, wireFormatSplitV3)
+	}
+	blocks.Set("x-jwt-static", `{"iss":"x"}`)
+	if got := wireFormatFromMetadata(blocks, true); got != wireFormatSplitV2 {
+		t.Errorf("inline static block = %q, want %q", got, wireFormatSplitV2)
+	}
+	if got := WireFormatFromContext(context.Background()); got != wireFormatNone {
+		t.Errorf("outside the interceptor = %q, want %q", got, wireFormatNone)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	xdscreds "google.golang.org/grpc/credentials/xds"
+	_ "google.golang.org/grpc/xds" // registers the xds:/// resolver and balancers
+)
+
+// Proxyless xDS
+//
+// With GRPC_XDS=true the gRPC clients resolve their backends through an xDS
+// control plane (Traffic Director, Istio proxyless, ...) instead of DNS: each
+// service address is dialed as xds:///<addr>, and GRPC_XDS_BOOTSTRAP or
+// GRPC_XDS_BOOTSTRAP_CONFIG tells the client where the control plane is. No
+// sidecar re-encodes the headers, so the JWT metadata reaches the backend with
+// the HPACK state this client built, which keeps compression measurements free
+// of Envoy's own header table. Credentials come from xDS when the control
+// plane configures mTLS and fall back to GRPC_TLS_* or plaintext otherwise.
+
+var xdsEnabled = os.Getenv("GRPC_XDS") == "true"
+
+// dialTarget returns the target to dial for a service address
+func dialTarget(addr string) string {
+	if !xdsEnabled || strings.Contains(addr, ":///") {
+		return addr
+	}
+	return "xds:///" + addr
+}
+
+// dialCredentials returns the transport credentials for service connections:
+// mutual TLS when GRPC_TLS_* is set (see transport_tls.go), which xDS falls
+// back to as well
+func dialCredentials() grpc.DialOption {
+	tlsCreds, err := clientTLSCredentials()
+	if err != nil {
+		panic(errors.Wrap(err, "grpc: failed to load TLS credentials"))
+	}
+	fallback := insecure.NewCredentials()
+	if tlsCreds != nil {
+		fallback = tlsCreds
+	}
+	if !xdsEnabled {
+		if tlsCreds != nil {
+			return grpc.WithTransportCredentials(tlsCreds)
+		}
+		return grpc.WithInsecure()
+	}
+	creds, err := xdscreds.NewClientCredentials(xdscreds.ClientOptions{FallbackCreds: fallback})
+	if err != nil {
+		panic(errors.Wrap(err, "grpc: failed to create xDS credentials"))
+	}
+	return grpc.WithTransportCredentials(creds)
+}
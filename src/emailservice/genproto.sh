@@ -16,6 +16,6 @@
 
 # [START gke_emailservice_genproto]
 
-python -m grpc_tools.protoc -I../../protos --python_out=. --grpc_python_out=. ../../protos/demo.proto
+python -m grpc_tools.protoc -I../../protos --python_out=. --grpc_python_out=. ../../protos/auth_options.proto ../../protos/demo.proto
 
 # [END gke_emailservice_genproto]
\ No newline at end of file
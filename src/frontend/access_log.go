@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Access log
+//
+// With ACCESS_LOG_SAMPLE=N, one request in N is logged as a single
+// "[ACCESS]" line with its auth outcome: where the token came from (cookie,
+// issued, renewed, oidc, partner), whether it verified, a hash of its
+// subject, the modes it was sent downstream in, and how long verifying it,
+// encoding it for downstream calls and the rest of the handler took. Failed
+// requests, and those slower than ACCESS_LOG_SLOW, are always logged, so
+// auth traffic can be analysed without debug logging.
+
+// accessLogSampleEvery is ACCESS_LOG_SAMPLE; 0 turns the access log off
+var (
+	accessLogSampleEvery = loadAccessLogSample()
+	accessLogSlow        = loadAccessLogSlow()
+	accessLogCount       atomic.Uint64
+)
+
+func loadAccessLogSample() uint64 {
+	n, _ := strconv.ParseUint(knobs.Value("ACCESS_LOG_SAMPLE"), 10, 64)
+	return n
+}
+
+func loadAccessLogSlow() time.Duration {
+	d, _ := time.ParseDuration(knobs.Value("ACCESS_LOG_SLOW"))
+	return d
+}
+
+type ctxKeyAccess struct{}
+
+// accessRecord collects the auth outcome of one request
+type accessRecord struct {
+	mu          sync.Mutex
+	source      string
+	verified    bool
+	subjectHash string
+	verify      time.Duration
+	decompose   time.Duration
+	modes       map[string]int
+}
+
+// accessFromContext returns the request's record, nil outside the access log
+func accessFromContext(ctx context.Context) *accessRecord {
+	a, _ := ctx.Value(ctxKeyAccess{}).(*accessRecord)
+	return a
+}
+
+// token records where the request's token came from and how long verifying
+// it took
+func (a *accessRecord) token(source string, claims *JWTClaims, verified bool, verify time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.source, a.verified = source, verified
+	a.verify += verify
+	if claims != nil && claims.Subject != "" {
+		a.subjectHash = pseudonym(claims.Subject)
+	}
+	if claims != nil && verified && claims.IssuedAt != nil && claims.ExpiresAt != nil {
+		observeTokenFreshness("frontend", claims.IssuedAt.Unix(), claims.ExpiresAt.Unix())
+	}
+}
+
+// call records the mode a downstream call was sent in and the time spent
+// encoding the token for it
+func (a *accessRecord) call(mode string, decompose time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.modes == nil {
+		a.modes = make(map[string]int)
+	}
+	a.modes[mode]++
+	a.decompose += decompose
+}
+
+// accessLogged reports whether a request is logged: failures and slow
+// requests always, the rest one in accessLogSampleEvery
+func accessLogged(failed bool, took time.Duration) bool {
+	if accessLogSampleEvery == 0 {
+		return false
+	}
+	if failed || (accessLogSlow > 0 && took >= accessLogSlow) {
+		return true
+	}
+	return accessLogCount.Add(1)%accessLogSampleEvery == 0
+}
+
+// accessLogMiddleware writes the access log line of each request
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The record also feeds the Server-Timing trailer, see auth_timing.go
+		timing := authTimingRequested(r)
+		if accessLogSampleEvery == 0 && !timing {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		a := &accessRecord{source: "none"}
+		rr := &responseRecorder{w: w}
+		ctx := context.WithValue(r.Context(), ctxKeyAccess{}, a)
+		var t *authTiming
+		if timing {
+			t = &authTiming{}
+			ctx = context.WithValue(ctx, ctxKeyAuthTiming{}, t)
+			w.Header().Add("Trailer", "Server-Timing")
+		}
+		next.ServeHTTP(rr, r.WithContext(ctx))
+		if timing {
+			sendAuthTiming(w, r, a, t)
+		}
+		took := time.Since(start)
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+		if !accessLogged(rr.status >= 400, took) {
+			return
+		}
+
+		a.mu.Lock()
+		fields := logrus.Fields{
+			"http.req.method":      r.Method,
+			"http.req.path":        r.URL.Path,
+			"http.resp.status":     rr.status,
+			"http.resp.bytes":      rr.b,
+			"auth.source":          a.source,
+			"auth.verified":        a.verified,
+			"auth.modes":           a.modes,
+			"latency.total_us":     took.Microseconds(),
+			"latency.verify_us":    a.verify.Microseconds(),
+			"latency.decompose_us": a.decompose.Microseconds(),
+			"latency.handler_us":   (took - a.verify - a.decompose).Microseconds(),
+		}
+		if a.subjectHash != "" {
+			fields["auth.subject_hash"] = a.subjectHash
+		}
+		a.mu.Unlock()
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		log.WithFields(fields).Info("[ACCESS]")
+	})
+}
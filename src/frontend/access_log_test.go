@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAccessLogLine(t *testing.T) {
+	defer func(n uint64) { accessLogSampleEvery = n }(accessLogSampleEvery)
+	accessLogSampleEvery = 1
+	var buf bytes.Buffer
+	out, formatter := log.Out, log.Formatter
+	log.Out, log.Formatter = &buf, &logrus.JSONFormatter{}
+	defer func() { log.Out, log.Formatter = out, formatter }()
+
+	h := accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := accessFromContext(r.Context())
+		a.token("cookie", &JWTClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: "user-1"}}, true, 2*time.Millisecond)
+		a.call(decisionModeSplit, time.Millisecond)
+		a.call(decisionModeSplit, time.Millisecond)
+		a.call(decisionModeAuthorization, 0)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cart", nil))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log line %q: %v", buf.String(), err)
+	}
+	if line["msg"] != "[ACCESS]" || line["http.resp.status"] != float64(http.StatusAccepted) {
+		t.Errorf("line = %v", line)
+	}
+	if line["auth.source"] != "cookie" || line["auth.verified"] != true || line["auth.subject_hash"] != pseudonym("user-1") {
+		t.Errorf("auth fields = %v", line)
+	}
+	modes, _ := line["auth.modes"].(map[string]interface{})
+	if modes[decisionModeSplit] != float64(2) || modes[decisionModeAuthorization] != float64(1) {
+		t.Errorf("auth.modes = %v", line["auth.modes"])
+	}
+	if line["latency.verify_us"] != float64(2000) || line["latency.decompose_us"] != float64(2000) {
+		t.Errorf("latency fields = %v", line)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	defer func(n uint64, slow time.Duration) { accessLogSampleEvery, accessLogSlow = n, slow }(accessLogSampleEvery, accessLogSlow)
+	accessLogSampleEvery, accessLogSlow = 1000, time.Second
+
+	if !accessLogged(true, 0) {
+		t.Error("failed requests must always be logged")
+	}
+	if !accessLogged(false, 2*time.Second) {
+		t.Error("slow requests must always be logged")
+	}
+	logged := 0
+	for i := 0; i < 1000; i++ {
+		if accessLogged(false, time.Millisecond) {
+			logged++
+		}
+	}
+	if logged != 1 {
+		t.Errorf("logged %d of 1000 requests, want 1", logged)
+	}
+}
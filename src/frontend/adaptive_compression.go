@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveEWMAAlpha  = 0.2
+	adaptiveMinSamples = 50
+	// adaptiveMinDwell stops a downstream from flapping between modes
+	adaptiveMinDwell = 30 * time.Second
+)
+
+// adaptiveCompression decides per downstream whether splitting is worth it,
+// configured by ADAPTIVE_COMPRESSION, ADAPTIVE_COMPRESSION_MARGIN and
+// ADAPTIVE_COMPRESSION_PROBE_RATE
+var adaptiveCompression = newAdaptiveCompressionController()
+
+// adaptiveCompressionController is a feedback loop over observed RPC
+// latencies. While compression is on it keeps a latency average for split and
+// whole calls to each downstream (a small probe fraction is always sent in
+// the other mode so both stay fresh) and stops splitting when the split calls
+// aren't at least margin faster. Connection RTT is approximated by the fastest
+// call seen, since gRPC doesn't expose HTTP/2 ping times.
+type adaptiveCompressionController struct {
+	enabled   bool
+	margin    float64
+	probeRate float64
+
+	mu      sync.Mutex
+	targets map[string]*compressionTarget
+}
+
+// compressionTarget is the controller's state for one downstream service
+type compressionTarget struct {
+	Split          bool      `json:"split"`
+	SplitLatencyMs float64   `json:"split_latency_ms"`
+	WholeLatencyMs float64   `json:"whole_latency_ms"`
+	SplitSamples   int       `json:"split_samples"`
+	WholeSamples   int       `json:"whole_samples"`
+	RTTMs          float64   `json:"rtt_ms"`
+	Benefit        float64   `json:"benefit"`
+	Reason         string    `json:"reason"`
+	ChangedAt      time.Time `json:"changed_at"`
+	ObservedAt     time.Time `json:"observed_at"`
+}
+
+func newAdaptiveCompressionController() *adaptiveCompressionController {
+	c := &adaptiveCompressionController{
+		enabled:   knobs.Value("ADAPTIVE_COMPRESSION") == "true",
+		margin:    0.05,
+		probeRate: 0.05,
+		targets:   make(map[string]*compressionTarget),
+	}
+	if v, err := strconv.ParseFloat(knobs.Value("ADAPTIVE_COMPRESSION_MARGIN"), 64); err == nil && v >= 0 && v < 1 {
+		c.margin = v
+	}
+	if v, err := strconv.ParseFloat(knobs.Value("ADAPTIVE_COMPRESSION_PROBE_RATE"), 64); err == nil && v >= 0 && v <= 0.5 {
+		c.probeRate = v
+	}
+	return c
+}
+
+func (c *adaptiveCompressionController) target(svc string) *compressionTarget {
+	t, ok := c.targets[svc]
+	if !ok {
+		t = &compressionTarget{Split: true, Reason: "initial", ChangedAt: time.Now()}
+		c.targets[svc] = t
+	}
+	return t
+}
+
+// Allow reports whether the call to method should split its JWT
+func (c *adaptiveCompressionController) Allow(method string) bool {
+	if !c.enabled {
+		return true
+	}
+	c.mu.Lock()
+	split := c.target(serviceFromMethod(method)).Split
+	c.mu.Unlock()
+	if rand.Float64() < c.probeRate {
+		return !split
+	}
+	return split
+}
+
+// Observe feeds the latency of a completed call back into the controller
+func (c *adaptiveCompressionController) Observe(method string, split bool, latency time.Duration, err error) {
+	if !c.enabled || err != nil {
+		return
+	}
+	ms := float64(latency) / float64(time.Millisecond)
+	svc := serviceFromMethod(method)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.target(svc)
+	t.ObservedAt = time.Now()
+	if t.RTTMs == 0 || ms < t.RTTMs {
+		t.RTTMs = ms
+	}
+	if split {
+		t.SplitLatencyMs = ewma(t.SplitLatencyMs, ms, t.SplitSamples)
+		t.SplitSamples++
+	} else {
+		t.WholeLatencyMs = ewma(t.WholeLatencyMs, ms, t.WholeSamples)
+		t.WholeSamples++
+	}
+	if t.SplitSamples < adaptiveMinSamples || t.WholeSamples < adaptiveMinSamples || t.WholeLatencyMs == 0 {
+		return
+	}
+
+	t.Benefit = (t.WholeLatencyMs - t.SplitLatencyMs) / t.WholeLatencyMs
+	if time.Since(t.ChangedAt) < adaptiveMinDwell {
+		return
+	}
+	// Re-enabling needs twice the margin so a benefit hovering around the
+	// margin doesn't toggle the mode every dwell period
+	switch {
+	case t.Split && t.Benefit < c.margin:
+		t.Split, t.Reason, t.ChangedAt = false, "benefit below margin", time.Now()
+		log.Infof("[ADAPTIVE] Splitting disabled for %s: benefit %.1f%% < %.1f%% (rtt %.1fms)", svc, t.Benefit*100, c.margin*100, t.RTTMs)
+	case !t.Split && t.Benefit >= 2*c.margin:
+		t.Split, t.Reason, t.ChangedAt = true, "benefit above margin", time.Now()
+		log.Infof("[ADAPTIVE] Splitting enabled for %s: benefit %.1f%% >= %.1f%% (rtt %.1fms)", svc, t.Benefit*100, 2*c.margin*100, t.RTTMs)
+	}
+}
+
+func ewma(avg, sample float64, n int) float64 {
+	if n == 0 {
+		return sample
+	}
+	return avg + adaptiveEWMAAlpha*(sample-avg)
+}
+
+// ServeHTTP exposes the controller's per-downstream decisions
+func (c *adaptiveCompressionController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	targets := make(map[string]compressionTarget, len(c.targets))
+	for svc, t := range c.targets {
+		targets[svc] = *t
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":    c.enabled,
+		"margin":     c.margin,
+		"probe_rate": c.probeRate,
+		"targets":    targets,
+	})
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveCompressionController(t *testing.T) {
+	c := &adaptiveCompressionController{
+		enabled: true,
+		margin:  0.05,
+		targets: make(map[string]*compressionTarget),
+	}
+	const method = "/hipstershop.CartService/GetCart"
+	c.target("hipstershop.CartService").ChangedAt = time.Now().Add(-time.Hour)
+
+	// Split calls are no faster than whole ones: splitting gets switched off
+	for i := 0; i < adaptiveMinSamples; i++ {
+		c.Observe(method, true, 10*time.Millisecond, nil)
+		c.Observe(method, false, 10*time.Millisecond, nil)
+	}
+	if c.Allow(method) {
+		t.Fatalf("splitting still allowed with no benefit: %+v", c.targets["hipstershop.CartService"])
+	}
+
+	// Split calls become clearly faster: splitting comes back after the dwell
+	c.target("hipstershop.CartService").ChangedAt = time.Now().Add(-time.Hour)
+	for i := 0; i < 3*adaptiveMinSamples; i++ {
+		c.Observe(method, true, 5*time.Millisecond, nil)
+		c.Observe(method, false, 10*time.Millisecond, nil)
+	}
+	if !c.Allow(method) {
+		t.Fatalf("splitting not re-enabled: %+v", c.targets["hipstershop.CartService"])
+	}
+	if rtt := c.targets["hipstershop.CartService"].RTTMs; rtt != 5 {
+		t.Errorf("RTT estimate = %vms, want 5ms", rtt)
+	}
+}
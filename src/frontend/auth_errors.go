@@ -0,0 +1,154 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Downstream auth failures
+//
+// Checkout and shipping refuse a request over its user token with
+// Unauthenticated or PermissionDenied and a google.rpc.ErrorInfo in
+// jwtErrorDomain naming the reason. renderHTTPError turns those into a 401 or
+// 403 with a message the user can act on instead of the generic 500 page.
+// When the token expired, was revoked or went missing on the way, the JWT
+// cookie (or IdP session) is dropped and the browser is sent to log in again;
+// cookieRelogin stops a downstream that keeps refusing fresh tokens from
+// causing a redirect loop.
+
+const cookieRelogin = cookiePrefix + "relogin"
+
+type authFailure struct {
+	status  int
+	message string
+	relogin bool
+}
+
+var authFailures = map[string]authFailure{
+	"JWT_MISSING":           {http.StatusUnauthorized, "Your session has ended. Please sign in again.", true},
+	"JWT_EXPIRED":           {http.StatusUnauthorized, "Your session has expired. Please sign in again.", true},
+	"JWT_REVOKED":           {http.StatusUnauthorized, "You have been signed out. Please sign in again.", true},
+	"JWT_REASSEMBLY_FAILED": {http.StatusUnauthorized, "We could not read your session. Please try again.", false},
+	"JWT_MALFORMED":         {http.StatusUnauthorized, "We could not read your session. Please try again.", false},
+	"JWT_SIG_INVALID":       {http.StatusUnauthorized, "Your session could not be verified.", false},
+	"JWT_CLAIMS_INVALID":    {http.StatusUnauthorized, "Your session is not valid for this shop.", false},
+	"JWT_HEADER_CONFLICT":   {http.StatusUnauthorized, "Your session could not be verified.", false},
+	"JWT_DUPLICATE_HEADER":  {http.StatusUnauthorized, "Your session could not be verified.", false},
+	"JWT_BINDING_MISMATCH":  {http.StatusForbidden, "Your session is bound to a different client.", false},
+	"JWT_MARKET_MISMATCH":   {http.StatusForbidden, "We cannot ship to this address from your market.", false},
+}
+
+// downstreamAuthFailures counts mapped failures by reason
+var downstreamAuthFailures = expvar.NewMap("jwt_downstream_auth_failures")
+
+// downstreamAuthFailure maps err to an auth failure when a downstream refused
+// the user token; reason is empty when the status carried no ErrorInfo
+func downstreamAuthFailure(err error) (f authFailure, reason string, ok bool) {
+	st, isStatus := status.FromError(err)
+	if !isStatus || err == nil {
+		return f, "", false
+	}
+	for _, d := range st.Details() {
+		if info, isInfo := d.(*errdetails.ErrorInfo); isInfo && info.Domain == jwtErrorDomain {
+			if f, ok = authFailures[info.Reason]; ok {
+				return f, info.Reason, true
+			}
+		}
+	}
+	switch st.Code() {
+	case codes.Unauthenticated:
+		return authFailure{http.StatusUnauthorized, "Your session could not be verified.", false}, "", true
+	case codes.PermissionDenied:
+		return authFailure{http.StatusForbidden, "You are not allowed to do that.", false}, "", true
+	}
+	return f, "", false
+}
+
+// renderAuthFailure answers a request a downstream refused over its token
+func renderAuthFailure(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, f authFailure, reason string) {
+	log.WithField("error", err).WithField("reason", reason).Warn("[JWT-FLOW] downstream refused user token")
+	if reason == "" {
+		downstreamAuthFailures.Add("unspecified", 1)
+	} else {
+		downstreamAuthFailures.Add(reason, 1)
+	}
+
+	_, cerr := r.Cookie(cookieRelogin)
+	relogin := f.relogin && cerr == http.ErrNoCookie
+	if f.relogin {
+		// Drop the token so the next request mints or fetches a new one
+		oidcSessions.Delete(sessionID(r))
+		http.SetCookie(w, &http.Cookie{Name: cookieJWT, MaxAge: -1, Expires: time.Unix(0, 0)})
+	}
+	if relogin {
+		http.SetCookie(w, &http.Cookie{Name: cookieRelogin, Value: "1", MaxAge: 60, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		downstreamAuthFailures.Add("relogin", 1)
+	}
+	if f.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+
+	if wantsJSON(r) {
+		body := map[string]string{"error": reason, "message": f.message}
+		if relogin {
+			body["login_url"] = reloginURL(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.status)
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+	if relogin {
+		http.Redirect(w, r, reloginURL(r), http.StatusSeeOther)
+		return
+	}
+
+	w.WriteHeader(f.status)
+	if templateErr := templates.ExecuteTemplate(w, "error", injectCommonTemplateData(r, map[string]interface{}{
+		"error":        err.Error(),
+		"auth_message": f.message,
+		"status_code":  f.status,
+		"status":       http.StatusText(f.status),
+	})); templateErr != nil {
+		log.Println(templateErr)
+	}
+}
+
+// reloginURL is where a user whose token was refused signs in again: the IdP
+// login when OIDC is enabled, otherwise the page itself (or the home page
+// after a form post), which mints a fresh token on the way
+func reloginURL(r *http.Request) string {
+	if oidc != nil {
+		return baseUrl + "/login"
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r.URL.RequestURI()
+	}
+	return baseUrl + "/"
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func downstreamError(t *testing.T, code codes.Code, reason string) error {
+	t.Helper()
+	st, err := status.New(code, "refused").WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: jwtErrorDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return errors.Wrap(st.Err(), "failed to complete the order")
+}
+
+func TestDownstreamAuthFailureMapping(t *testing.T) {
+	log := logrus.New()
+
+	// An expired token sends a browser back to the page for a fresh one
+	r := httptest.NewRequest(http.MethodGet, "/cart", nil)
+	w := httptest.NewRecorder()
+	renderHTTPError(log, r, w, downstreamError(t, codes.Unauthenticated, "JWT_EXPIRED"), http.StatusInternalServerError)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/cart" {
+		t.Fatalf("expired: got %d to %q, want 303 to /cart", w.Code, w.Header().Get("Location"))
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if c := cookies[cookieJWT]; c == nil || c.MaxAge >= 0 {
+		t.Errorf("expired: JWT cookie not cleared: %v", c)
+	}
+	if cookies[cookieRelogin] == nil {
+		t.Errorf("expired: relogin guard cookie not set")
+	}
+
+	// Once the guard is set, the refusal is reported instead of redirecting again
+	r = httptest.NewRequest(http.MethodPost, "/cart/checkout", nil)
+	r.Header.Set("Accept", "application/json")
+	r.AddCookie(&http.Cookie{Name: cookieRelogin, Value: "1"})
+	w = httptest.NewRecorder()
+	renderHTTPError(log, r, w, downstreamError(t, codes.Unauthenticated, "JWT_EXPIRED"), http.StatusInternalServerError)
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusUnauthorized || body["error"] != "JWT_EXPIRED" || body["login_url"] != "" {
+		t.Errorf("expired after relogin: got %d %v, want 401 JWT_EXPIRED without login_url", w.Code, body)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("401 without WWW-Authenticate")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/cart/checkout", nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	renderHTTPError(log, r, w, downstreamError(t, codes.FailedPrecondition, "JWT_MARKET_MISMATCH"), http.StatusInternalServerError)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("market mismatch: got %d, want 403", w.Code)
+	}
+
+	if _, _, ok := downstreamAuthFailure(errors.Wrap(status.Error(codes.Internal, "boom"), "x")); ok {
+		t.Errorf("internal error mapped as an auth failure")
+	}
+}
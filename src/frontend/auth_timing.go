@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Auth timing
+//
+// A request with an x-debug-auth-timing header from a caller in
+// AUTH_TIMING_ALLOW (a list of CIDRs, off when empty) gets a Server-Timing
+// trailer breaking down the auth pipeline: how long verifying the cookie
+// token and encoding it for downstream calls took here, then what the
+// downstream services report in their x-auth-timing trailers, reassembly and
+// verification at each hop. The header is passed on to unary downstream
+// calls only for such requests; the services check their own allowlist.
+
+const (
+	authTimingHeader  = "x-debug-auth-timing"
+	authTimingTrailer = "x-auth-timing"
+	authTimingHop     = "frontend"
+)
+
+var authTimingAllow, authTimingAllowErr = parseAuthTimingAllow(knobs.Value("AUTH_TIMING_ALLOW"))
+
+// parseAuthTimingAllow reads a comma separated list of CIDRs
+func parseAuthTimingAllow(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_TIMING_ALLOW: %q is not a CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// authTiming collects the entries of the downstream calls of one request
+type authTiming struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+type ctxKeyAuthTiming struct{}
+
+func authTimingFromContext(ctx context.Context) *authTiming {
+	t, _ := ctx.Value(ctxKeyAuthTiming{}).(*authTiming)
+	return t
+}
+
+func (t *authTiming) add(entries ...string) {
+	if t == nil || len(entries) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, entries...)
+}
+
+// authTimingRequested reports whether the caller asked for the timings of
+// this request and may see them
+func authTimingRequested(r *http.Request) bool {
+	if len(authTimingAllow) == 0 || r.Header.Get(authTimingHeader) == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range authTimingAllow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func authTimingEntry(step string, d time.Duration, desc string) string {
+	return fmt.Sprintf("%s-%s;dur=%.3f;desc=%q", authTimingHop, step, float64(d.Microseconds())/1000, desc)
+}
+
+// sendAuthTiming sets the Server-Timing trailer, declared before the
+// response was written, from the request's access record and the entries its
+// downstream calls returned
+func sendAuthTiming(w http.ResponseWriter, r *http.Request, a *accessRecord, t *authTiming) {
+	desc := r.Method + " " + r.URL.Path
+	a.mu.Lock()
+	entries := []string{authTimingEntry("verify", a.verify, desc), authTimingEntry("decompose", a.decompose, desc)}
+	a.mu.Unlock()
+	t.mu.Lock()
+	entries = append(entries, t.entries...)
+	t.mu.Unlock()
+	w.Header().Set("Server-Timing", strings.Join(entries, ", "))
+}
+
+// authTimingInvoker asks the downstream for its timings when the request
+// being served asked for them
+func authTimingInvoker(invoker grpc.UnaryInvoker) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		t := authTimingFromContext(ctx)
+		if t == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		var trailer metadata.MD
+		ctx = metadata.AppendToOutgoingContext(ctx, authTimingHeader, "1")
+		err := invoker(ctx, method, req, reply, cc, append(opts[:len(opts):len(opts)], grpc.Trailer(&trailer))...)
+		t.add(trailer.Get(authTimingTrailer)...)
+		return err
+	}
+}
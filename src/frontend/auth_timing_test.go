@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAuthTimingTrailer(t *testing.T) {
+	defer func(allow []*net.IPNet) { authTimingAllow = allow }(authTimingAllow)
+
+	checkout := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		if md, _ := metadata.FromOutgoingContext(ctx); len(md.Get(authTimingHeader)) == 0 {
+			return nil
+		}
+		for _, o := range opts {
+			if tr, ok := o.(grpc.TrailerCallOption); ok {
+				*tr.TrailerAddr = metadata.Pairs(authTimingTrailer, `checkoutservice-verify;dur=0.800;desc="PlaceOrder"`)
+			}
+		}
+		return nil
+	}
+	srv := httptest.NewServer(accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessFromContext(r.Context()).token("cookie", nil, true, 300*time.Microsecond)
+		accessFromContext(r.Context()).call(decisionModeSplit, 20*time.Microsecond)
+		authTimingInvoker(checkout)(r.Context(), "/hipstershop.CheckoutService/PlaceOrder", nil, nil, nil)
+		io.WriteString(w, "ok")
+	})))
+	defer srv.Close()
+
+	get := func(header bool) http.Header {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/cart", nil)
+		if header {
+			req.Header.Set(authTimingHeader, "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		io.ReadAll(resp.Body)
+		return resp.Trailer
+	}
+
+	authTimingAllow, _ = parseAuthTimingAllow("127.0.0.0/8, ::1/128")
+	want := `frontend-verify;dur=0.300;desc="GET /cart", frontend-decompose;dur=0.020;desc="GET /cart", checkoutservice-verify;dur=0.800;desc="PlaceOrder"`
+	if got := get(true).Get("Server-Timing"); got != want {
+		t.Errorf("Server-Timing = %s\nwant %s", got, want)
+	}
+	if got := get(false).Get("Server-Timing"); got != "" {
+		t.Errorf("Server-Timing without the header = %s", got)
+	}
+	authTimingAllow, _ = parseAuthTimingAllow("10.0.0.0/8")
+	if got := get(true).Get("Server-Timing"); got != "" {
+		t.Errorf("Server-Timing for a caller outside AUTH_TIMING_ALLOW = %s", got)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Chaos scenarios
+//
+// A scenario is a YAML file of timed phases layered on top of the static
+// error injection configuration, for resilience demos that play the same way
+// every time. The optional claims selector of a phase (see claim_selector.go)
+// limits it to matching users:
+//
+//	name: cart-then-shipping
+//	loop: false
+//	phases:
+//	  - name: cart outage
+//	    start: 0m
+//	    end: 5m
+//	    target: CartService
+//	    error_rate: 0.1
+//	    error_type: unavailable
+//	    claims: tenant_id=tenant_test
+//	  - name: slow shipping
+//	    start: 5m
+//	    end: 10m
+//	    target: ShippingService
+//	    latency: 300ms
+//
+// CHAOS_SCENARIO_FILE loads a scenario at startup and CHAOS_SCENARIO_AUTOSTART
+// runs it straight away. On DEBUG_PORT, GET /chaos reports the running
+// scenario, POST /chaos/start runs the scenario in the request body (or the
+// loaded file when the body is empty) and POST /chaos/stop ends it. Both
+// POSTs need the DEBUG_ADMIN_TOKEN bearer token.
+
+type chaosPhase struct {
+	Name      string        `yaml:"name"`
+	Start     time.Duration `yaml:"start"`
+	End       time.Duration `yaml:"end"`
+	Target    string        `yaml:"target"`
+	ErrorRate float64       `yaml:"error_rate"`
+	ErrorType string        `yaml:"error_type"`
+	Latency   time.Duration `yaml:"latency"`
+	Claims    string        `yaml:"claims"`
+
+	selector claimSelector
+}
+
+type chaosScenario struct {
+	Name   string       `yaml:"name"`
+	Loop   bool         `yaml:"loop"`
+	Phases []chaosPhase `yaml:"phases"`
+}
+
+// length is the end of the last phase
+func (s *chaosScenario) length() time.Duration {
+	var end time.Duration
+	for _, p := range s.Phases {
+		if p.End > end {
+			end = p.End
+		}
+	}
+	return end
+}
+
+// parseChaosScenario decodes and validates a scenario
+func parseChaosScenario(data []byte) (*chaosScenario, error) {
+	s := &chaosScenario{}
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("parse chaos scenario: %w", err)
+	}
+	if len(s.Phases) == 0 {
+		return nil, errors.New("chaos scenario has no phases")
+	}
+	for i := range s.Phases {
+		p := &s.Phases[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("phase %d", i+1)
+		}
+		if p.ErrorType == "" {
+			p.ErrorType = "unavailable"
+		}
+		p.ErrorType = strings.ToLower(p.ErrorType)
+		switch {
+		case p.Start < 0 || p.End <= p.Start:
+			return nil, fmt.Errorf("%s: end must be after start", p.Name)
+		case p.Target == "":
+			return nil, fmt.Errorf("%s: no target", p.Name)
+		case p.ErrorRate < 0 || p.ErrorRate > 1:
+			return nil, fmt.Errorf("%s: error_rate must be between 0 and 1", p.Name)
+		case !injectableErrorTypes[p.ErrorType]:
+			return nil, fmt.Errorf("%s: unknown error_type %q", p.Name, p.ErrorType)
+		case p.Latency < 0:
+			return nil, fmt.Errorf("%s: negative latency", p.Name)
+		}
+		selector, err := parseClaimSelector(p.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
+		}
+		p.selector = selector
+		if p.Target != "all" {
+			for _, t := range strings.Split(p.Target, ",") {
+				if t = strings.TrimSpace(t); !isDownstreamService(t) {
+					return nil, fmt.Errorf("%s: unknown service %q", p.Name, t)
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+func loadChaosScenario(path string) (*chaosScenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseChaosScenario(data)
+}
+
+// chaosEvents counts scenario starts, stops and the faults they inject
+var chaosEvents = expvar.NewMap("chaos_scenario")
+
+// chaosRunner runs one scenario at a time
+type chaosRunner struct {
+	mu       sync.Mutex
+	loaded   *chaosScenario // CHAOS_SCENARIO_FILE, started when no body is given
+	scenario *chaosScenario
+	started  time.Time
+	stop     chan struct{}
+}
+
+var chaosScenarios = &chaosRunner{}
+
+// initChaosScenarios loads CHAOS_SCENARIO_FILE and starts it when
+// CHAOS_SCENARIO_AUTOSTART is "true"
+func initChaosScenarios() error {
+	path := knobs.Value("CHAOS_SCENARIO_FILE")
+	if path == "" {
+		return nil
+	}
+	s, err := loadChaosScenario(path)
+	if err != nil {
+		return err
+	}
+	chaosScenarios.mu.Lock()
+	chaosScenarios.loaded = s
+	chaosScenarios.mu.Unlock()
+	if knobs.Value("CHAOS_SCENARIO_AUTOSTART") == "true" {
+		chaosScenarios.Start(s)
+	}
+	return nil
+}
+
+// Start runs s from now, replacing any running scenario
+func (c *chaosRunner) Start(s *chaosScenario) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopLocked()
+	c.scenario, c.started, c.stop = s, time.Now(), make(chan struct{})
+	chaosEvents.Add("started", 1)
+	log.Infof("[CHAOS] Scenario %q started: %d phases over %s", s.Name, len(s.Phases), s.length())
+	go c.run(s, c.started, c.stop)
+}
+
+// Stop ends the running scenario and reports whether there was one
+func (c *chaosRunner) Stop() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopLocked()
+}
+
+func (c *chaosRunner) stopLocked() bool {
+	if c.scenario == nil {
+		return false
+	}
+	close(c.stop)
+	log.Infof("[CHAOS] Scenario %q stopped", c.scenario.Name)
+	chaosEvents.Add("stopped", 1)
+	c.scenario, c.stop = nil, nil
+	return true
+}
+
+// run logs phase transitions and retires a scenario that does not loop once
+// its last phase ends
+func (c *chaosRunner) run(s *chaosScenario, started time.Time, stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var previous []chaosPhase
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(started)
+			if !s.Loop && elapsed >= s.length() {
+				c.mu.Lock()
+				if c.stop == stop {
+					log.Infof("[CHAOS] Scenario %q finished", s.Name)
+					chaosEvents.Add("finished", 1)
+					c.scenario, c.stop = nil, nil
+				}
+				c.mu.Unlock()
+				return
+			}
+			current := s.phasesAt(elapsed)
+			if phaseNames(current) != phaseNames(previous) {
+				log.Infof("[CHAOS] Scenario %q at %s: active phases [%s]", s.Name, elapsed.Round(time.Second), phaseNames(current))
+			}
+			previous = current
+		}
+	}
+}
+
+// phasesAt returns the phases active elapsed into the scenario
+func (s *chaosScenario) phasesAt(elapsed time.Duration) []chaosPhase {
+	if s.Loop {
+		elapsed %= s.length()
+	}
+	var active []chaosPhase
+	for _, p := range s.Phases {
+		if elapsed >= p.Start && elapsed < p.End {
+			active = append(active, p)
+		}
+	}
+	return active
+}
+
+func phaseNames(phases []chaosPhase) string {
+	names := make([]string, len(phases))
+	for i, p := range phases {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// active returns the phases of the running scenario active at now
+func (c *chaosRunner) active(now time.Time) []chaosPhase {
+	c.mu.Lock()
+	s, started := c.scenario, c.started
+	c.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.phasesAt(now.Sub(started))
+}
+
+// chaosFault applies the active phases targeting method: it waits out their
+// latency and applies the fault of the first phase that fires
+func chaosFault(ctx context.Context, method string) (context.Context, error) {
+	for _, p := range chaosScenarios.active(time.Now()) {
+		if !matchesTarget(p.Target, method) || !p.selector.MatchesContext(ctx) {
+			continue
+		}
+		if p.Latency > 0 {
+			chaosEvents.Add("latency", 1)
+			select {
+			case <-time.After(p.Latency):
+			case <-ctx.Done():
+				return ctx, status.FromContextError(ctx.Err()).Err()
+			}
+		}
+		if p.ErrorRate > 0 && randSource.Float64() < p.ErrorRate {
+			chaosEvents.Add("errors", 1)
+			return injectFault(ctx, method, p.ErrorType)
+		}
+	}
+	return ctx, nil
+}
+
+type chaosStatus struct {
+	Running bool     `json:"running"`
+	Name    string   `json:"name,omitempty"`
+	Elapsed string   `json:"elapsed,omitempty"`
+	Length  string   `json:"length,omitempty"`
+	Loop    bool     `json:"loop,omitempty"`
+	Active  []string `json:"active_phases,omitempty"`
+}
+
+func (c *chaosRunner) status() chaosStatus {
+	c.mu.Lock()
+	s, started := c.scenario, c.started
+	c.mu.Unlock()
+	if s == nil {
+		return chaosStatus{}
+	}
+	elapsed := time.Since(started)
+	st := chaosStatus{Running: true, Name: s.Name, Elapsed: elapsed.Round(time.Second).String(), Length: s.length().String(), Loop: s.Loop}
+	for _, p := range s.phasesAt(elapsed) {
+		st.Active = append(st.Active, p.Name)
+	}
+	return st
+}
+
+// registerChaosHandler serves the scenario API on the debug mux
+func registerChaosHandler(mux *http.ServeMux) {
+	writeStatus := func(w http.ResponseWriter, code int) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(chaosScenarios.status())
+	}
+	mux.HandleFunc("/chaos", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusOK)
+	})
+	mux.HandleFunc("/chaos/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !debugAdmin(r) {
+			http.Error(w, "DEBUG_ADMIN_TOKEN bearer token required", http.StatusForbidden)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var s *chaosScenario
+		if len(strings.TrimSpace(string(body))) == 0 {
+			chaosScenarios.mu.Lock()
+			s = chaosScenarios.loaded
+			chaosScenarios.mu.Unlock()
+			if s == nil {
+				http.Error(w, "no scenario in the request and no CHAOS_SCENARIO_FILE loaded", http.StatusBadRequest)
+				return
+			}
+		} else if s, err = parseChaosScenario(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chaosScenarios.Start(s)
+		writeStatus(w, http.StatusAccepted)
+	})
+	mux.HandleFunc("/chaos/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !debugAdmin(r) {
+			http.Error(w, "DEBUG_ADMIN_TOKEN bearer token required", http.StatusForbidden)
+			return
+		}
+		if !chaosScenarios.Stop() {
+			http.Error(w, "no scenario running", http.StatusNotFound)
+			return
+		}
+		writeStatus(w, http.StatusOK)
+	})
+}
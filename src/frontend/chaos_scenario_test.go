@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testChaosScenario = `
+name: demo
+phases:
+  - name: cart outage
+    start: 0s
+    end: 5m
+    target: CartService
+    error_rate: 1
+  - name: slow shipping
+    start: 5m
+    end: 10m
+    target: ShippingService
+    latency: 20ms
+`
+
+func TestChaosScenario(t *testing.T) {
+	s, err := parseChaosScenario([]byte(testChaosScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := phaseNames(s.phasesAt(time.Minute)); got != "cart outage" {
+		t.Errorf("phases at 1m = %q, want cart outage", got)
+	}
+	if got := phaseNames(s.phasesAt(7 * time.Minute)); got != "slow shipping" {
+		t.Errorf("phases at 7m = %q, want slow shipping", got)
+	}
+	if got := s.phasesAt(11 * time.Minute); len(got) != 0 {
+		t.Errorf("phases after the end = %v, want none", got)
+	}
+	for _, bad := range []string{
+		"phases: []",
+		"phases: [{start: 1m, end: 1m, target: CartService}]",
+		"phases: [{start: 0s, end: 1m, target: NoSuchService}]",
+		"phases: [{start: 0s, end: 1m, target: CartService, error_type: gremlins}]",
+		"phases: [{start: 0s, end: 1m, target: CartService, typo: 1}]",
+	} {
+		if _, err := parseChaosScenario([]byte(bad)); err == nil {
+			t.Errorf("parseChaosScenario(%q) accepted an invalid scenario", bad)
+		}
+	}
+
+	defer func(l *logrus.Logger) { errInjLog = l }(errInjLog)
+	errInjLog = logrus.New()
+	defer func(token string) { debugAdminToken = token }(debugAdminToken)
+	debugAdminToken = "chaos-admin"
+	mux := http.NewServeMux()
+	registerChaosHandler(mux)
+	defer chaosScenarios.Stop()
+	post := func(path string, body io.Reader, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, body)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("/chaos/start", strings.NewReader(testChaosScenario), ""); w.Code != http.StatusForbidden {
+		t.Fatalf("start without the admin token: got %d, want 403", w.Code)
+	}
+	w := post("/chaos/start", strings.NewReader(testChaosScenario), debugAdminToken)
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"cart outage"`) {
+		t.Fatalf("start: got %d %s", w.Code, w.Body)
+	}
+	_, err = chaosFault(context.Background(), "/hipstershop.CartService/GetCart")
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("cart call during outage: got %v, want Unavailable", err)
+	}
+	if _, err := chaosFault(context.Background(), "/hipstershop.ShippingService/GetQuote"); err != nil {
+		t.Errorf("shipping call during cart outage: got %v", err)
+	}
+
+	if w := post("/chaos/stop", nil, "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("stop with a wrong token: got %d, want 403", w.Code)
+	}
+	if w := post("/chaos/stop", nil, debugAdminToken); w.Code != http.StatusOK {
+		t.Errorf("stop: got %d", w.Code)
+	}
+	if _, err := chaosFault(context.Background(), "/hipstershop.CartService/GetCart"); err != nil {
+		t.Errorf("cart call after stop: got %v", err)
+	}
+}
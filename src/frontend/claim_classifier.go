@@ -0,0 +1,273 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Claim classification
+//
+// With JWT_CLAIM_CLASSIFIER set, split JWTs carry their payload as three JSON
+// objects instead of one, grouped by how often the claims change:
+//
+//	x-jwt-static   same for every token from this issuer (iss, aud, ...)
+//	x-jwt-session  same for every token of a session (sub, session_id, ...)
+//	x-jwt-dynamic  new on every renewal (exp, iat, jti, ...)
+//	x-jwt-claims   the payload's key order, so receivers rebuild the signed bytes
+//
+// HPACK then indexes the static and session blocks once per connection and
+// only the dynamic block is resent in full. Static and session blocks are
+// written with sorted keys, so tokens whose issuer serialises claims from a
+// map in varying order still produce the same block bytes; x-jwt-claims keeps
+// the original order for reassembly. Which claim goes where depends on
+// the IdP, so the classifier is a strategy: standard, auth0, azure, or custom
+// with JWT_CLAIM_CLASSIFIER_PATHS listing claims per class as JSON paths,
+// e.g. {"static":["$.iss"],"dynamic":["$.exp","$.rh"]}. Claims a strategy
+// doesn't list are session claims.
+//
+// Tokens from several issuers (the frontend's own and an external IdP) can
+// use different strategies: JWT_ISSUERS, the issuer list the downstream
+// verifiers share, picks one per iss with its classifier field, e.g.
+// [{"iss":"https://tenant.eu.auth0.com/","keys":"AUTH0_JWT_PUBLIC_KEY","classifier":"auth0"}].
+// "none" sends that issuer's payload whole; other issuers use
+// JWT_CLAIM_CLASSIFIER.
+//
+// Every token is rebuilt locally before it is sent; one that doesn't come back
+// byte-identical (whitespace, unusual escaping) goes out as x-jwt-payload.
+
+type claimClass int
+
+const (
+	claimStatic claimClass = iota
+	claimSession
+	claimDynamic
+)
+
+// ClaimClassifier decides which block a top-level claim travels in
+type ClaimClassifier interface {
+	Name() string
+	Classify(claim string) claimClass
+}
+
+// claimSetClassifier classifies by listed claim names, defaulting to session
+type claimSetClassifier struct {
+	name    string
+	static  map[string]bool
+	dynamic map[string]bool
+}
+
+func (c *claimSetClassifier) Name() string { return c.name }
+
+func (c *claimSetClassifier) Classify(claim string) claimClass {
+	switch {
+	case c.static[claim]:
+		return claimStatic
+	case c.dynamic[claim]:
+		return claimDynamic
+	}
+	return claimSession
+}
+
+func claimSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set
+}
+
+var (
+	standardStaticClaims  = []string{"iss", "aud", "azp", "typ", "scope"}
+	standardDynamicClaims = []string{"exp", "iat", "nbf", "jti", "auth_time", "nonce", "at_hash", "c_hash", "random_value"}
+)
+
+// builtinClaimClassifiers are the strategies selectable by name
+var builtinClaimClassifiers = map[string]ClaimClassifier{
+	"standard": &claimSetClassifier{
+		name:    "standard",
+		static:  claimSet(standardStaticClaims...),
+		dynamic: claimSet(standardDynamicClaims...),
+	},
+	// Auth0 adds the grant type; namespaced custom claims stay per session
+	"auth0": &claimSetClassifier{
+		name:    "auth0",
+		static:  claimSet(append(standardStaticClaims, "gty")...),
+		dynamic: claimSet(standardDynamicClaims...),
+	},
+	// Azure AD stamps every token with fresh aio/uti/rh values
+	"azure": &claimSetClassifier{
+		name:    "azure",
+		static:  claimSet(append(standardStaticClaims, "ver", "tid", "idp", "appid", "appidacr", "azpacr")...),
+		dynamic: claimSet(append(standardDynamicClaims, "aio", "uti", "rh")...),
+	},
+}
+
+// claimClassifier is the configured strategy; nil sends x-jwt-payload as before
+var claimClassifier, _ = newClaimClassifier(knobs.Value("JWT_CLAIM_CLASSIFIER"), knobs.Value("JWT_CLAIM_CLASSIFIER_PATHS"))
+
+// issuerClaimClassifiers are the JWT_ISSUERS strategies by iss
+var issuerClaimClassifiers, _ = parseIssuerClaimClassifiers(knobs.Value("JWT_ISSUERS"), knobs.Value("JWT_CLAIM_CLASSIFIER_PATHS"))
+
+// parseIssuerClaimClassifiers reads the classifier of each JWT_ISSUERS
+// entry; entries without one are left to JWT_CLAIM_CLASSIFIER
+func parseIssuerClaimClassifiers(issuers, paths string) (map[string]ClaimClassifier, error) {
+	if issuers == "" {
+		return nil, nil
+	}
+	var list []struct {
+		Issuer     string `json:"iss"`
+		Classifier string `json:"classifier"`
+	}
+	if err := json.Unmarshal([]byte(issuers), &list); err != nil {
+		return nil, fmt.Errorf("JWT_ISSUERS must be a JSON list of issuers: %v", err)
+	}
+	classifiers := make(map[string]ClaimClassifier)
+	for _, i := range list {
+		switch i.Classifier {
+		case "":
+			continue
+		case "none":
+			classifiers[i.Issuer] = nil
+			continue
+		}
+		c, err := newClaimClassifier(i.Classifier, paths)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_ISSUERS issuer %q: %v", i.Issuer, err)
+		}
+		classifiers[i.Issuer] = c
+	}
+	return classifiers, nil
+}
+
+// claimClassifierFor picks the strategy for a payload by its iss claim
+func claimClassifierFor(payload string) ClaimClassifier {
+	if len(issuerClaimClassifiers) > 0 {
+		var claims struct {
+			Issuer string `json:"iss"`
+		}
+		if json.Unmarshal([]byte(payload), &claims) == nil {
+			if c, ok := issuerClaimClassifiers[claims.Issuer]; ok {
+				return c
+			}
+		}
+	}
+	return claimClassifier
+}
+
+// newClaimClassifier returns the named strategy, nil for ""
+func newClaimClassifier(name, paths string) (ClaimClassifier, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "custom":
+		return customClaimClassifier(paths)
+	}
+	if c, ok := builtinClaimClassifiers[name]; ok {
+		return c, nil
+	}
+	names := []string{"custom"}
+	for n := range builtinClaimClassifiers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("JWT_CLAIM_CLASSIFIER=%q must be one of %s", name, strings.Join(names, ", "))
+}
+
+// topLevelClaim resolves a JSON path naming a top-level claim: "$.claim",
+// "claim", or "$['claim']" for names with dots such as Auth0 namespaces
+func topLevelClaim(path string) (string, bool) {
+	if strings.HasPrefix(path, "$[") && strings.HasSuffix(path, "]") && len(path) > 5 {
+		quoted := path[2 : len(path)-1]
+		if (quoted[0] == '\'' || quoted[0] == '"') && quoted[len(quoted)-1] == quoted[0] {
+			return quoted[1 : len(quoted)-1], true
+		}
+		return "", false
+	}
+	claim := strings.TrimPrefix(path, "$.")
+	return claim, claim != "" && !strings.ContainsAny(claim, ".[]$")
+}
+
+// customClaimClassifier parses JWT_CLAIM_CLASSIFIER_PATHS. Only top-level
+// claims can be split, so every path must name one.
+func customClaimClassifier(paths string) (ClaimClassifier, error) {
+	var spec map[string][]string
+	if err := json.Unmarshal([]byte(paths), &spec); err != nil {
+		return nil, fmt.Errorf("JWT_CLAIM_CLASSIFIER_PATHS must be a JSON object of path lists: %v", err)
+	}
+	c := &claimSetClassifier{name: "custom", static: map[string]bool{}, dynamic: map[string]bool{}}
+	for class, list := range spec {
+		for _, path := range list {
+			claim, ok := topLevelClaim(path)
+			if !ok {
+				return nil, fmt.Errorf("JWT_CLAIM_CLASSIFIER_PATHS: %q is not a top-level claim path", path)
+			}
+			switch class {
+			case "static":
+				c.static[claim] = true
+			case "dynamic":
+				c.dynamic[claim] = true
+			case "session":
+			default:
+				return nil, fmt.Errorf("JWT_CLAIM_CLASSIFIER_PATHS: unknown class %q", class)
+			}
+		}
+	}
+	return c, nil
+}
+
+// claimBlocks is a payload split by class
+type claimBlocks struct {
+	Static  string
+	Session string
+	Dynamic string
+	Order   string // JSON array of the payload's keys in document order
+}
+
+// sortedClaimMembers orders members by key, so a block's bytes depend only on
+// its claims and not on how the issuer happened to order them. Values are kept
+// verbatim, they are part of the signed bytes.
+func sortedClaimMembers(members []claimMember) []claimMember {
+	sort.SliceStable(members, func(i, j int) bool { return members[i].Key < members[j].Key })
+	return members
+}
+
+// classifyPayload splits a raw JSON payload into claim blocks. ok is false
+// when the blocks would not rebuild the payload byte for byte.
+func classifyPayload(c ClaimClassifier, payload string) (blocks claimBlocks, ok bool) {
+	members, err := claimMembers(payload)
+	if err != nil {
+		return claimBlocks{}, false
+	}
+	var byClass [3][]claimMember
+	order := make([]string, len(members))
+	for i, m := range members {
+		class := c.Classify(m.Key)
+		byClass[class] = append(byClass[class], m)
+		order[i] = m.Key
+	}
+	orderJSON, _ := json.Marshal(order)
+	blocks = claimBlocks{
+		Static:  encodeClaimMembers(sortedClaimMembers(byClass[claimStatic])),
+		Session: encodeClaimMembers(sortedClaimMembers(byClass[claimSession])),
+		Dynamic: encodeClaimMembers(byClass[claimDynamic]),
+		Order:   string(orderJSON),
+	}
+	merged, err := mergeClaimBlocks(blocks.Order, blocks.Static, blocks.Session, blocks.Dynamic)
+	return blocks, err == nil && merged == payload
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+// TestClaimClassifierStableBlocks checks that every strategy splits every
+// golden token into blocks that rebuild it, and that a renewal only changes
+// the dynamic block, so HPACK keeps the static and session blocks indexed.
+func TestClaimClassifierStableBlocks(t *testing.T) {
+	custom, err := newClaimClassifier("custom", `{"static":["$.iss","$['https://hipstershop.com/tenant']"],"dynamic":["$.exp","$.iat","$.jti","random_value"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classifiers := []ClaimClassifier{custom}
+	for _, name := range []string{"standard", "auth0", "azure"} {
+		c, _ := newClaimClassifier(name, "")
+		classifiers = append(classifiers, c)
+	}
+	if _, err := newClaimClassifier("custom", `{"static":["$.ext.tenant"]}`); err == nil {
+		t.Error("custom classifier accepted a nested claim path")
+	}
+
+	for _, c := range classifiers {
+		for _, g := range loadGoldenJWTs(t) {
+			first, ok := classifyPayload(c, g.Payload)
+			if !ok {
+				t.Errorf("%s/%s: blocks do not rebuild the payload", c.Name(), g.Name)
+				continue
+			}
+			if again, _ := classifyPayload(c, g.Payload); again != first {
+				t.Errorf("%s/%s: repeated classification changed the blocks", c.Name(), g.Name)
+			}
+		}
+	}
+
+	payload := `{"iss":"https://auth.hipstershop.com","sub":"u1","session_id":"s1","exp":100,"iat":0,"jti":"a","random_value":"x"}`
+	renewed := `{"iss":"https://auth.hipstershop.com","sub":"u1","session_id":"s1","exp":200,"iat":100,"jti":"b","random_value":"y"}`
+	for _, c := range classifiers {
+		before, _ := classifyPayload(c, payload)
+		after, _ := classifyPayload(c, renewed)
+		if before.Static != after.Static || before.Session != after.Session || before.Order != after.Order {
+			t.Errorf("%s: renewal changed a block HPACK should keep indexed: %+v -> %+v", c.Name(), before, after)
+		}
+		if before.Dynamic == after.Dynamic {
+			t.Errorf("%s: renewal left the dynamic block unchanged", c.Name())
+		}
+	}
+
+	// An issuer marshalling a map may order claims differently per token; the
+	// static and session blocks must not change with it
+	reordered := `{"session_id":"s1","random_value":"x","sub":"u1","jti":"a","iss":"https://auth.hipstershop.com","iat":0,"exp":100}`
+	for _, c := range classifiers {
+		want, _ := classifyPayload(c, payload)
+		for i := 0; i < 10; i++ {
+			got, ok := classifyPayload(c, reordered)
+			if !ok || got.Static != want.Static || got.Session != want.Session {
+				t.Errorf("%s: reordered claims changed the blocks: %+v, want %+v", c.Name(), got, want)
+			}
+			if merged, _ := mergeClaimBlocks(got.Order, got.Static, got.Session, got.Dynamic); merged != reordered {
+				t.Errorf("%s: merged %s, want %s", c.Name(), merged, reordered)
+			}
+		}
+	}
+
+	// Whitespace can't be rebuilt from blocks; such tokens go out whole
+	if _, ok := classifyPayload(classifiers[1], `{"sub": "u1"}`); ok {
+		t.Error("payload with whitespace was classified")
+	}
+}
+
+func TestClaimClassifierByIssuer(t *testing.T) {
+	defer func(c ClaimClassifier, m map[string]ClaimClassifier) {
+		claimClassifier, issuerClaimClassifiers = c, m
+	}(claimClassifier, issuerClaimClassifiers)
+
+	var err error
+	claimClassifier = builtinClaimClassifiers["standard"]
+	issuerClaimClassifiers, err = parseIssuerClaimClassifiers(`[
+		{"iss":"https://tenant.eu.auth0.com/","keys":"AUTH0_KEY","classifier":"auth0"},
+		{"iss":"https://legacy.example/","keys":"LEGACY_KEY","classifier":"none"},
+		{"iss":"https://plain.example/","keys":"PLAIN_KEY"}]`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for payload, want := range map[string]string{
+		`{"iss":"https://tenant.eu.auth0.com/","sub":"u"}`: "auth0",
+		`{"iss":"https://plain.example/","sub":"u"}`:       "standard",
+		`{"iss":"https://auth.hipstershop.com","sub":"u"}`: "standard",
+		`{"iss":"https://legacy.example/","sub":"u"}`:      "",
+	} {
+		got := ""
+		if c := claimClassifierFor(payload); c != nil {
+			got = c.Name()
+		}
+		if got != want {
+			t.Errorf("claimClassifierFor(%s) = %q, want %q", payload, got, want)
+		}
+	}
+
+	if _, err := parseIssuerClaimClassifiers(`[{"iss":"x","classifier":"okta"}]`, ""); err == nil {
+		t.Error("unknown classifier accepted")
+	}
+}
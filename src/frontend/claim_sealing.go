@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Claim sealing
+//
+// The split format sends the payload as raw JSON, which proxies and header
+// dumps show in the clear where a Bearer token at least needs decoding. With
+// JWT_FIELD_KEY_FILE set to a key shared by the mesh (32 bytes, base64, e.g.
+// openssl rand -base64 32), the claims listed in JWT_ENCRYPTED_CLAIMS
+// (default email,name) are sealed with AES-GCM before a payload is split:
+// each value becomes the string "enc:v1:<base64url nonce and ciphertext>"
+// and receivers holding the key open it back into the exact signed bytes.
+// Only the services in JWT_PII_SERVICES (default checkout,shipping) hold the
+// key; the others are sent tokens carrying those claims whole, as before.
+// The nonce is derived from the claim and its value, so a session's sealed
+// blocks stay the same across tokens and keep their HPACK and static
+// dictionary savings.
+
+const (
+	sealedClaimPrefix       = "enc:v1:"
+	defaultEncryptedClaims  = "email,name"
+	defaultPIIServices      = "checkout,shipping"
+	splitDecisionPIIRefused = "whole_pii"
+)
+
+var errPayloadNotCompact = errors.New("payload isn't compact JSON, claims can't be sealed in place")
+
+// claimSealer seals claim values with the mesh field key
+type claimSealer struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	claims   map[string]bool
+}
+
+var (
+	fieldSealer, _ = loadFieldSealer()
+	piiServices    = loadPIIServices()
+)
+
+// loadFieldSealer reads JWT_FIELD_KEY_FILE; without it claims aren't sealed
+func loadFieldSealer() (*claimSealer, error) {
+	path := knobs.Value("JWT_FIELD_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold 32 base64-encoded bytes", path)
+	}
+	v, ok := knobs.Lookup("JWT_ENCRYPTED_CLAIMS")
+	if !ok {
+		v = defaultEncryptedClaims
+	}
+	return newClaimSealer(key, splitList(v))
+}
+
+func loadPIIServices() map[string]bool {
+	v, ok := knobs.Lookup("JWT_PII_SERVICES")
+	if !ok {
+		v = defaultPIIServices
+	}
+	services := make(map[string]bool)
+	for _, s := range splitList(v) {
+		services[strings.ToLower(s)] = true
+	}
+	return services
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newClaimSealer derives the cipher and nonce keys from key
+func newClaimSealer(key []byte, claims []string) (*claimSealer, error) {
+	derive := func(label string) []byte {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(label))
+		return m.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("claim-seal"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &claimSealer{aead: aead, nonceKey: derive("claim-nonce"), claims: make(map[string]bool)}
+	for _, c := range claims {
+		s.claims[c] = true
+	}
+	return s, nil
+}
+
+// Covers reports whether payload carries a claim to seal
+func (s *claimSealer) Covers(payload string) bool {
+	for c := range s.claims {
+		if strings.Contains(payload, `"`+c+`":`) {
+			return true
+		}
+	}
+	return false
+}
+
+// Seal returns payload with the configured claims sealed
+func (s *claimSealer) Seal(payload string) (string, error) {
+	members, err := claimMembers(payload)
+	if err != nil {
+		return "", err
+	}
+	if encodeClaimMembers(members) != payload {
+		return "", errPayloadNotCompact
+	}
+	for i, m := range members {
+		if !s.claims[m.Key] {
+			continue
+		}
+		mac := hmac.New(sha256.New, s.nonceKey)
+		mac.Write([]byte(m.Key))
+		mac.Write([]byte{0})
+		mac.Write(m.Value)
+		nonce := mac.Sum(nil)[:s.aead.NonceSize()]
+		sealed := s.aead.Seal(nonce, nonce, m.Value, []byte(m.Key))
+		members[i].Value, _ = json.Marshal(sealedClaimPrefix + base64.RawURLEncoding.EncodeToString(sealed))
+	}
+	return encodeClaimMembers(members), nil
+}
+
+// piiSplit refines a decision to split the token: with sealing on, one
+// carrying sealed claims is split, with them sealed, only for services in
+// JWT_PII_SERVICES, and sent whole to the others
+func piiSplit(ctx context.Context, method, token string) (split, seal bool, reason string) {
+	if fieldSealer == nil {
+		return true, false, splitDecisionSplit
+	}
+	components, err := decomposeJWTFor(ctx, token)
+	if err != nil || !fieldSealer.Covers(components.Payload) {
+		return true, false, splitDecisionSplit
+	}
+	service := serviceFromMethod(method)
+	short := strings.TrimSuffix(service[strings.LastIndex(service, ".")+1:], "Service")
+	if !piiServices[strings.ToLower(service)] && !piiServices[strings.ToLower(short)] {
+		jwtSplitDecisions.Add(service+" "+splitDecisionPIIRefused, 1)
+		return false, false, splitDecisionPIIRefused
+	}
+	return true, true, splitDecisionSplit
+}
+
+// sealedComponents returns a copy of components with their claims sealed
+func sealedComponents(components *JWTComponents) (*JWTComponents, error) {
+	payload, err := fieldSealer.Seal(components.Payload)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *components
+	sealed.Payload = payload
+	return &sealed, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// sealedClaimVector is a payload sealed with a key of 32 sevens; checkout
+// and shipping open the same vector
+const sealedClaimVector = `{"sub":"u1","email":"enc:v1:MdivyZjLoX0WTcwIMRHcGDSwS0AdCRGYkkNUNvUwq38-hL6jLrJD6A3OUg"}`
+
+// TestClaimSealing checks the sealed wire format and that tokens carrying
+// sealed claims only split for services holding the key
+func TestClaimSealing(t *testing.T) {
+	s, err := newClaimSealer(bytes.Repeat([]byte{7}, 32), []string{"email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"sub":"u1","email":"a@example.com"}`
+	sealed, err := s.Seal(payload)
+	if err != nil || sealed != sealedClaimVector {
+		t.Fatalf("Seal = %s, %v, want %s", sealed, err, sealedClaimVector)
+	}
+	if _, err := s.Seal(`{"sub": "u1"}`); err != errPayloadNotCompact {
+		t.Errorf("sealing a non-compact payload = %v, want errPayloadNotCompact", err)
+	}
+
+	defer func(f *claimSealer) { fieldSealer = f }(fieldSealer)
+	fieldSealer = s
+	token := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	if split, seal, reason := piiSplit(context.Background(), "/hipstershop.CartService/GetCart", token); split || seal || reason != splitDecisionPIIRefused {
+		t.Errorf("CartService: split %v seal %v reason %s, want the whole token", split, seal, reason)
+	}
+	if split, seal, _ := piiSplit(context.Background(), "/hipstershop.ShippingService/GetQuote", token); !split || !seal {
+		t.Errorf("ShippingService: split %v seal %v, want sealed claims split", split, seal)
+	}
+	plain := "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1"}`)) + ".sig"
+	if split, seal, _ := piiSplit(context.Background(), "/hipstershop.CartService/GetCart", plain); !split || seal {
+		t.Errorf("token without sealed claims: split %v seal %v, want a plain split", split, seal)
+	}
+	if strings.Contains(sealed, "example.com") {
+		t.Error("sealed payload holds the email")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Claim selectors
+//
+// ERROR_INJECTION_CLAIMS (and the claims field of a chaos scenario phase)
+// scope injected faults to requests whose user token matches, so chaos can be
+// aimed at test tenants in a shared environment. A selector is a comma
+// separated list of terms that must all hold:
+//
+//	tenant_id=tenant_abc123      claim equals value
+//	market_id!=EU                claim missing or different
+//	roles contains canary        array claim has value, or string claim contains it
+//
+// Claim names may use dots to reach into nested objects (org.tenant=abc).
+// Claims are read from the outgoing token without verification: the frontend
+// minted it or has verified it already.
+
+type claimTerm struct {
+	path  []string
+	op    string
+	value string
+}
+
+type claimSelector []claimTerm
+
+const (
+	claimOpEquals    = "="
+	claimOpNotEquals = "!="
+	claimOpContains  = "contains"
+)
+
+// parseClaimSelector parses a selector; an empty string selects every request
+func parseClaimSelector(s string) (claimSelector, error) {
+	var sel claimSelector
+	for _, raw := range strings.Split(s, ",") {
+		term := strings.TrimSpace(raw)
+		if term == "" {
+			continue
+		}
+		var t claimTerm
+		var name string
+		if fields := strings.Fields(term); len(fields) == 3 && fields[1] == claimOpContains {
+			name, t.op, t.value = fields[0], claimOpContains, fields[2]
+		} else if i := strings.Index(term, claimOpNotEquals); i > 0 {
+			name, t.op, t.value = term[:i], claimOpNotEquals, term[i+2:]
+		} else if i := strings.Index(term, claimOpEquals); i > 0 {
+			name, t.op, t.value = term[:i], claimOpEquals, term[i+1:]
+		} else {
+			return nil, fmt.Errorf("claim selector term %q is not name=value, name!=value or name contains value", term)
+		}
+		name, t.value = strings.TrimSpace(name), strings.TrimSpace(t.value)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("claim selector term %q has an invalid claim name", term)
+		}
+		t.path = strings.Split(name, ".")
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+// Matches reports whether claims satisfy every term
+func (s claimSelector) Matches(claims map[string]interface{}) bool {
+	for _, t := range s {
+		if !t.matches(claims) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t claimTerm) matches(claims map[string]interface{}) bool {
+	var v interface{} = claims
+	for _, key := range t.path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			v = nil
+			break
+		}
+		v = obj[key]
+	}
+	switch t.op {
+	case claimOpEquals:
+		s, ok := claimString(v)
+		return ok && s == t.value
+	case claimOpNotEquals:
+		s, ok := claimString(v)
+		return !ok || s != t.value
+	case claimOpContains:
+		switch c := v.(type) {
+		case []interface{}:
+			for _, e := range c {
+				if s, ok := claimString(e); ok && s == t.value {
+					return true
+				}
+			}
+		case string:
+			return strings.Contains(c, t.value)
+		}
+	}
+	return false
+}
+
+// claimString formats scalar claim values for comparison
+func claimString(v interface{}) (string, bool) {
+	switch c := v.(type) {
+	case string:
+		return c, true
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(c), true
+	}
+	return "", false
+}
+
+// MatchesContext applies the selector to the user token of an outgoing call;
+// calls without a readable token only match an empty selector
+func (s claimSelector) MatchesContext(ctx context.Context) bool {
+	if len(s) == 0 {
+		return true
+	}
+	token, _ := ctx.Value(ctxKeyJWTToken{}).(string)
+	if token == "" {
+		return false
+	}
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		return false
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(components.Payload), &claims); err != nil {
+		return false
+	}
+	return s.Matches(claims)
+}
+
+func (s claimSelector) String() string {
+	terms := make([]string, len(s))
+	for i, t := range s {
+		name := strings.Join(t.path, ".")
+		if t.op == claimOpContains {
+			terms[i] = name + " contains " + t.value
+		} else {
+			terms[i] = name + t.op + t.value
+		}
+	}
+	return strings.Join(terms, ",")
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestClaimSelector(t *testing.T) {
+	payload := `{"tenant_id":"tenant_abc123","roles":["user","canary"],"org":{"tier":2},"beta":true}`
+	token := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"tenant_id=tenant_abc123", true},
+		{"tenant_id=tenant_other", false},
+		{"tenant_id!=tenant_other", true},
+		{"missing!=x", true},
+		{"roles contains canary", true},
+		{"roles contains admin", false},
+		{"tenant_id contains abc", true},
+		{"org.tier=2", true},
+		{"beta=true", true},
+		{"tenant_id=tenant_abc123, roles contains canary", true},
+		{"tenant_id=tenant_abc123, roles contains admin", false},
+	}
+	for _, tc := range tests {
+		sel, err := parseClaimSelector(tc.selector)
+		if err != nil {
+			t.Fatalf("parseClaimSelector(%q): %v", tc.selector, err)
+		}
+		if got := sel.MatchesContext(ctx); got != tc.want {
+			t.Errorf("%q matched = %v, want %v", tc.selector, got, tc.want)
+		}
+	}
+
+	sel, _ := parseClaimSelector("tenant_id=tenant_abc123")
+	if sel.MatchesContext(context.Background()) {
+		t.Error("selector matched a call without a token")
+	}
+	for _, bad := range []string{"tenant_id", "=x", "a b=c"} {
+		if _, err := parseClaimSelector(bad); err == nil {
+			t.Errorf("parseClaimSelector(%q) accepted an invalid term", bad)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Claims audit
+//
+// With CLAIMS_AUDIT_FILE set, the frontend records which claims each
+// downstream service was sent for each subject, to answer data-subject
+// access requests. Every outgoing RPC delivers the token's claims whatever
+// the wire format, so one JSON line is appended the first time a day sees a
+// subject, service and claim set together. Subjects are stored hashed with
+// the subject hash key (subjecthash), so the file alone doesn't list users.
+// Lines older than CLAIMS_AUDIT_RETENTION (default 720h) are dropped at
+// startup and daily. On DEBUG_PORT, GET
+// /claims-export?subject=<sub>[&since=<RFC3339>] reports, per service, the
+// claims it received within the window and on which days. Exports need the
+// DEBUG_ADMIN_TOKEN bearer token and are logged with the caller's address
+// and the X-Requested-By header, which should name the operator and the
+// request being answered.
+//
+// Only the frontend's own calls are recorded. Checkout forwards the token to
+// the services it calls (shipping, payment, email, order history, ...) and
+// those hops are not in the file, so the export lists only services the
+// frontend called directly and flags the ones known to pass the token on
+// with forwards_unrecorded: what they forwarded has to be answered from
+// their logs.
+
+const (
+	defaultClaimsAuditRetention = 30 * 24 * time.Hour
+	claimsAuditMaxSeen          = 100000
+)
+
+// claimsAuditEvents counts records written, write_errors, pruned lines and
+// exports
+var claimsAuditEvents = expvar.NewMap("claims_audit")
+
+var claimsAudit *claimsAuditLog
+
+type claimsAuditRecord struct {
+	Day       string    `json:"day"`          // UTC, 2006-01-02
+	Subject   string    `json:"subject_hash"` // subjects.Sum
+	Service   string    `json:"service"`
+	Claims    []string  `json:"claims"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+type claimsAuditKey struct{ token, service string }
+
+// claimsAuditForwarders are the services that forward the token they
+// receive to further services the audit doesn't see
+var claimsAuditForwarders = map[string]bool{"hipstershop.CheckoutService": true}
+
+type claimsAuditLog struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	day     string
+	tokens  map[claimsAuditKey]struct{} // sent today, already recorded
+	written map[string]struct{}         // records written today
+}
+
+func loadClaimsAuditRetention() time.Duration {
+	if d, err := time.ParseDuration(knobs.Value("CLAIMS_AUDIT_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultClaimsAuditRetention
+}
+
+// initClaimsAudit opens CLAIMS_AUDIT_FILE and prunes it daily
+func initClaimsAudit() {
+	path := knobs.Value("CLAIMS_AUDIT_FILE")
+	if path == "" {
+		return
+	}
+	l := &claimsAuditLog{path: path, retention: loadClaimsAuditRetention()}
+	if err := l.prune(time.Now()); err != nil {
+		log.Warnf("[JWT-FLOW] Claims audit disabled, %s: %v", path, err)
+		return
+	}
+	claimsAudit = l
+	go func() {
+		for range time.Tick(24 * time.Hour) {
+			if err := l.prune(time.Now()); err != nil {
+				log.Warnf("[JWT-FLOW] Failed to prune claims audit: %v", err)
+			}
+		}
+	}()
+}
+
+// Record notes that service was sent the claims of token; a nil log does
+// nothing
+func (l *claimsAuditLog) Record(token, service string) {
+	if l == nil {
+		return
+	}
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+	key := claimsAuditKey{token, service}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if day != l.day || len(l.written) >= claimsAuditMaxSeen {
+		l.day, l.written = day, make(map[string]struct{})
+		l.tokens = make(map[claimsAuditKey]struct{})
+	} else if len(l.tokens) >= claimsAuditMaxSeen {
+		l.tokens = make(map[claimsAuditKey]struct{})
+	}
+	if _, ok := l.tokens[key]; ok {
+		return
+	}
+	l.tokens[key] = struct{}{}
+
+	c, err := DecomposeJWT(token)
+	if err != nil {
+		return
+	}
+	var claims map[string]json.RawMessage
+	var subject string
+	if json.Unmarshal([]byte(c.Payload), &claims) != nil || json.Unmarshal(claims["sub"], &subject) != nil || subject == "" {
+		return
+	}
+	rec := claimsAuditRecord{Day: day, Subject: subjects.Sum(subject), Service: service, FirstSeen: now}
+	for name := range claims {
+		rec.Claims = append(rec.Claims, name)
+	}
+	sort.Strings(rec.Claims)
+	id := rec.Subject + " " + service + " " + strings.Join(rec.Claims, ",")
+	if _, ok := l.written[id]; ok {
+		return
+	}
+	l.written[id] = struct{}{}
+	line, _ := json.Marshal(rec)
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		claimsAuditEvents.Add("write_errors", 1)
+		return
+	}
+	claimsAuditEvents.Add("records", 1)
+}
+
+// prune rewrites the file without the lines older than the retention and
+// reopens it for appending
+func (l *claimsAuditLog) prune(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := now.UTC().Add(-l.retention).Format(time.DateOnly)
+	var kept []byte
+	dropped := 0
+	err := readClaimsAudit(l.path, func(rec claimsAuditRecord, line []byte) {
+		if rec.Day < cutoff {
+			dropped++
+			return
+		}
+		kept = append(append(kept, line...), '\n')
+	})
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(kept); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), l.path); err != nil {
+			return err
+		}
+		claimsAuditEvents.Add("pruned", int64(dropped))
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+// readClaimsAudit calls fn with every record of the file at path; a missing
+// file has none and malformed lines are skipped
+func readClaimsAudit(path string, fn func(rec claimsAuditRecord, line []byte)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec claimsAuditRecord
+		if json.Unmarshal(s.Bytes(), &rec) == nil {
+			fn(rec, s.Bytes())
+		}
+	}
+	return s.Err()
+}
+
+// claimsExport is the report of one subject
+type claimsExport struct {
+	Subject  string                `json:"subject"`
+	Since    time.Time             `json:"since"`
+	Services []serviceClaimsExport `json:"services"`
+}
+
+type serviceClaimsExport struct {
+	Service   string    `json:"service"`
+	Claims    []string  `json:"claims"`
+	FirstSeen time.Time `json:"first_seen"`
+	Days      []string  `json:"days"`
+	// ForwardsUnrecorded marks a service that passed the claims on to
+	// services missing from the export
+	ForwardsUnrecorded bool `json:"forwards_unrecorded,omitempty"`
+}
+
+// Export reports what each service received of subject's claims since then
+func (l *claimsAuditLog) Export(subject string, since time.Time) (claimsExport, error) {
+	report := claimsExport{Subject: subject, Since: since, Services: []serviceClaimsExport{}}
+	// Records written before a key rotation hash the subject under an old key
+	hashes := make(map[string]bool)
+	for _, h := range subjects.Sums(subject) {
+		hashes[h] = true
+	}
+	from := since.UTC().Format(time.DateOnly)
+	byService := make(map[string]*serviceClaimsExport)
+	claims := make(map[string]map[string]bool)
+	days := make(map[string]map[string]bool)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := readClaimsAudit(l.path, func(rec claimsAuditRecord, _ []byte) {
+		if !hashes[rec.Subject] || rec.Day < from {
+			return
+		}
+		s := byService[rec.Service]
+		if s == nil {
+			s = &serviceClaimsExport{Service: rec.Service, FirstSeen: rec.FirstSeen, ForwardsUnrecorded: claimsAuditForwarders[rec.Service]}
+			byService[rec.Service] = s
+			claims[rec.Service], days[rec.Service] = make(map[string]bool), make(map[string]bool)
+		}
+		if rec.FirstSeen.Before(s.FirstSeen) {
+			s.FirstSeen = rec.FirstSeen
+		}
+		for _, c := range rec.Claims {
+			claims[rec.Service][c] = true
+		}
+		days[rec.Service][rec.Day] = true
+	})
+	if err != nil {
+		return report, err
+	}
+	sortedKeys := func(m map[string]bool) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	for svc, s := range byService {
+		s.Claims, s.Days = sortedKeys(claims[svc]), sortedKeys(days[svc])
+		report.Services = append(report.Services, *s)
+	}
+	sort.Slice(report.Services, func(i, j int) bool { return report.Services[i].Service < report.Services[j].Service })
+	return report, nil
+}
+
+// registerClaimsAuditHandler serves data-subject exports on the debug mux
+func registerClaimsAuditHandler(mux *http.ServeMux) {
+	mux.HandleFunc("/claims-export", func(w http.ResponseWriter, r *http.Request) {
+		if !debugAdmin(r) {
+			http.Error(w, "DEBUG_ADMIN_TOKEN bearer token required", http.StatusForbidden)
+			return
+		}
+		if claimsAudit == nil {
+			http.Error(w, "claims audit is off, set CLAIMS_AUDIT_FILE", http.StatusNotFound)
+			return
+		}
+		subject := r.URL.Query().Get("subject")
+		if subject == "" {
+			http.Error(w, "subject is required", http.StatusBadRequest)
+			return
+		}
+		since := time.Now().Add(-claimsAudit.retention)
+		if v := r.URL.Query().Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			since = t
+		}
+		report, err := claimsAudit.Export(subject, since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"remote_addr":  r.RemoteAddr,
+			"requested_by": r.Header.Get("X-Requested-By"),
+		}).Infof("[JWT-FLOW] Claims export for subject %s: %d services", pseudonym(subject), len(report.Services))
+		claimsAuditEvents.Add("exports", 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClaimsAuditExport checks that claims sent downstream are recorded once
+// a day per service and claim set, exported per subject, and pruned after
+// the retention
+func TestClaimsAuditExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "claims.jsonl")
+	token := func(payload string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	old, _ := json.Marshal(claimsAuditRecord{Day: "2000-01-01", Subject: subjects.Sum("alice"), Service: "hipstershop.AdService", Claims: []string{"sub"}})
+	if err := os.WriteFile(path, append(old, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l := &claimsAuditLog{path: path, retention: 24 * time.Hour}
+	if err := l.prune(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	defer l.file.Close()
+
+	alice := token(`{"sub":"alice","email":"a@example.com","exp":1}`)
+	l.Record(alice, "hipstershop.CartService")
+	l.Record(alice, "hipstershop.CartService")
+	l.Record(token(`{"sub":"alice","email":"a@example.com","exp":2}`), "hipstershop.CartService")
+	l.Record(token(`{"sub":"alice","currency":"EUR"}`), "hipstershop.CheckoutService")
+	l.Record(token(`{"sub":"bob","email":"b@example.com"}`), "hipstershop.CartService")
+	l.Record("not-a-token", "hipstershop.CartService")
+
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("audit file has %d records, want 3:\n%s", n, data)
+	}
+	if strings.Contains(string(data), "alice") {
+		t.Error("audit file holds a plain subject")
+	}
+
+	report, err := l.Export("alice", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Services) != 2 {
+		t.Fatalf("export lists %d services, want Cart and Checkout: %+v", len(report.Services), report.Services)
+	}
+	cart, checkout := report.Services[0], report.Services[1]
+	if cart.Service != "hipstershop.CartService" || strings.Join(cart.Claims, ",") != "email,exp,sub" || len(cart.Days) != 1 || cart.ForwardsUnrecorded {
+		t.Errorf("CartService export = %+v", cart)
+	}
+	if checkout.Service != "hipstershop.CheckoutService" || strings.Join(checkout.Claims, ",") != "currency,sub" || !checkout.ForwardsUnrecorded {
+		t.Errorf("CheckoutService export = %+v", checkout)
+	}
+
+	defer func(l *claimsAuditLog, token string) { claimsAudit, debugAdminToken = l, token }(claimsAudit, debugAdminToken)
+	claimsAudit, debugAdminToken = l, "export-admin"
+	mux := http.NewServeMux()
+	registerClaimsAuditHandler(mux)
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{{"", http.StatusForbidden}, {"wrong", http.StatusForbidden}, {"export-admin", http.StatusOK}} {
+		r := httptest.NewRequest(http.MethodGet, "/claims-export?subject=alice", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		r.Header.Set("X-Requested-By", "dpo@example.com DSAR-42")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("export with token %q: got %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+}
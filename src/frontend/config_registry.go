@@ -0,0 +1,454 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration registry
+//
+// Every setting the frontend reads is declared in frontendKnobs with its
+// type, default and description, and read through knobs rather than
+// os.Getenv. A setting's value comes from, in order of precedence:
+//
+//	-set NAME=value    the command line, repeatable
+//	NAME=value         the environment
+//	-config PATH|URL   a YAML map of NAME: value, or CONFIG_FILE; an http(s)
+//	                   URL is fetched once at startup
+//	default            declared in frontendKnobs
+//
+// The registry is the frontend's alone: checkout, shipping and order history
+// still read their environment directly, have no -set or -config and no
+// /debug/config, so their knobs are not listed here.
+//
+// Names a file or flag sets must be declared, so typos fail validateConfig.
+// GET /debug/config on the debug server (DEBUG_PORT) dumps the effective
+// value and source of every setting with secrets redacted, and -config-docs prints docs/frontend-configuration.md
+// (-token-freshness-rules likewise prints docs/token-freshness-rules.yaml).
+
+const (
+	groupService       = "Service"
+	groupDownstream    = "Downstream services"
+	groupSigning       = "JWT signing keys"
+	groupForwarding    = "JWT forwarding"
+	groupClaims        = "Claim classification"
+	groupCodecs        = "Wire codecs"
+	groupSessions      = "Sessions and login"
+	groupRollout       = "Rollout and feature flags"
+	groupFaults        = "Fault injection"
+	groupObservability = "Observability and debugging"
+)
+
+// knob declares one setting
+type knob struct {
+	Name        string
+	Group       string
+	Type        string
+	Default     string
+	Description string
+	Secret      bool // redacted in /debug/config
+	EnvOnly     bool // read from the process environment by a library
+}
+
+var frontendKnobs = []knob{
+	{Name: "CONFIG_FILE", Group: groupService, Type: "path", Description: "YAML file or http(s) URL of settings, overridden by -config", EnvOnly: true},
+	{Name: "PORT", Group: groupService, Type: "int", Default: port, Description: "Port of the storefront listener"},
+	{Name: "LISTEN_ADDR", Group: groupService, Type: "string", Description: "Address of the storefront listener, all interfaces when empty"},
+	{Name: "BASE_URL", Group: groupService, Type: "string", Description: "Path prefix of every storefront route"},
+	{Name: "ENV_PLATFORM", Group: groupService, Type: "string", Default: "local", Description: "Platform shown in the footer: local, gcp, azure, aws, onprem or alibaba"},
+	{Name: "FRONTEND_MESSAGE", Group: groupService, Type: "string", Description: "Banner message shown on every page"},
+	{Name: "BANNER_COLOR", Group: groupService, Type: "string", Description: "Banner colour, to tell canary deployments apart"},
+	{Name: "CYMBAL_BRANDING", Group: groupService, Type: "bool", Default: "false", Description: "Use the Cymbal Shops branding"},
+	{Name: "ENABLE_ASSISTANT", Group: groupService, Type: "bool", Default: "false", Description: "Show the shopping assistant page"},
+	{Name: "ENABLE_GRAPHQL", Group: groupService, Type: "bool", Default: "false", Description: "Serve the GraphQL API on /graphql"},
+	{Name: "ENABLE_ORDER_STATUS_WS", Group: groupService, Type: "bool", Default: "false", Description: "Stream order status to the browser over a WebSocket"},
+	{Name: "ORDER_STATUS_WS_POLL", Group: groupService, Type: "duration", Default: "5s", Description: "How often the order status socket polls checkout"},
+	{Name: "PARTNER_API_KEYS_FILE", Group: groupService, Type: "path", Description: "API keys of the partner gateway; the gateway is off when empty"},
+
+	{Name: "PRODUCT_CATALOG_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Product catalog service, required"},
+	{Name: "CURRENCY_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Currency service, required"},
+	{Name: "CART_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Cart service, required"},
+	{Name: "RECOMMENDATION_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Recommendation service, required"},
+	{Name: "CHECKOUT_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Checkout service, required"},
+	{Name: "SHIPPING_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Shipping service, required"},
+	{Name: "AD_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Ad service, required"},
+	{Name: "SHOPPING_ASSISTANT_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Shopping assistant service, required"},
+	{Name: "ORDER_HISTORY_SERVICE_ADDR", Group: groupDownstream, Type: "addr", Description: "Order history service; the orders page is off when empty"},
+	{Name: "PACKAGING_SERVICE_URL", Group: groupDownstream, Type: "url", Description: "Packaging info service; product pages skip packaging when empty"},
+	{Name: "GRPC_XDS", Group: groupDownstream, Type: "bool", Default: "false", Description: "Dial downstream services through xDS"},
+	{Name: "GRPC_XDS_BOOTSTRAP", Group: groupDownstream, Type: "path", Description: "xDS bootstrap file, read by grpc-go", EnvOnly: true},
+	{Name: "GRPC_XDS_BOOTSTRAP_CONFIG", Group: groupDownstream, Type: "json", Description: "Inline xDS bootstrap, read by grpc-go", EnvOnly: true},
+	{Name: "GRPC_TLS_CERT_FILE", Group: groupDownstream, Type: "path", Description: "Client certificate presented to downstream services; plaintext when empty"},
+	{Name: "GRPC_TLS_KEY_FILE", Group: groupDownstream, Type: "path", Description: "Private key of GRPC_TLS_CERT_FILE"},
+	{Name: "GRPC_TLS_CA_FILE", Group: groupDownstream, Type: "path", Description: "CA the certificates of downstream services are checked against"},
+	{Name: "GRPC_MAX_HEADER_LIST_SIZE", Group: groupDownstream, Type: "int", Default: "524288", Description: "Largest header list in bytes sent to a downstream"},
+
+	{Name: "JWT_PRIVATE_KEY_SOURCE", Group: groupSigning, Type: "string", Description: "Where the signing key comes from: file, env, secret, vault or jwks"},
+	{Name: "JWT_PRIVATE_KEY_FILE", Group: groupSigning, Type: "path", Default: "jwt_private_key.pem", Description: "PEM file of the signing key"},
+	{Name: "JWT_PRIVATE_KEY", Group: groupSigning, Type: "string", Description: "PEM of the signing key when the source is env", Secret: true},
+	{Name: "JWT_PRIVATE_KEY_SECRET_DIR", Group: groupSigning, Type: "path", Description: "Mounted Kubernetes Secret holding the signing key"},
+	{Name: "JWT_PRIVATE_KEY_SECRET_KEY", Group: groupSigning, Type: "string", Default: "key.pem", Description: "Key of the signing key in the mounted Secret"},
+	{Name: "JWT_PRIVATE_KEY_VAULT_PATH", Group: groupSigning, Type: "string", Description: "Vault KV path of the signing key"},
+	{Name: "JWT_PRIVATE_KEY_VAULT_FIELD", Group: groupSigning, Type: "string", Default: "key", Description: "Field of the signing key at the Vault path"},
+	{Name: "JWT_PRIVATE_KEY_JWKS_URL", Group: groupSigning, Type: "url", Description: "JWKS the signing key is loaded from"},
+	{Name: "VAULT_ADDR", Group: groupSigning, Type: "url", Description: "Vault server of the vault key source"},
+	{Name: "VAULT_TOKEN", Group: groupSigning, Type: "string", Description: "Vault token of the vault key source", Secret: true},
+	{Name: "JWT_KEY_REFRESH_INTERVAL", Group: groupSigning, Type: "duration", Default: "1m", Description: "How often the signing key is reloaded, 0 to never reload"},
+
+	{Name: "ENABLE_JWT_COMPRESSION", Group: groupForwarding, Type: "bool", Default: "false", Description: "Send user JWTs to downstream services as split x-jwt-* headers"},
+	{Name: "JWT_TOKEN_BINDING", Group: groupForwarding, Type: "bool", Default: "false", Description: "Bind signed tokens to the GRPC_TLS_CERT_FILE certificate with a cnf claim"},
+	{Name: "JWT_SPLIT_MIN_BYTES", Group: groupForwarding, Type: "int", Default: "400", Description: "Tokens smaller than this are sent whole in authorization"},
+	{Name: "JWT_FORCE_AUTHORIZATION_FOR", Group: groupForwarding, Type: "list", Default: defaultForceAuthorizationFor, Description: "Services always sent the whole token in authorization; empty for none"},
+	{Name: "JWT_METHOD_AUTH_FILE", Group: groupForwarding, Type: "path", Description: "YAML overrides of which methods get the user token"},
+	{Name: "JWT_CONTRACT_REPORT", Group: groupForwarding, Type: "path", Description: "Contract test report of the formats each downstream accepts"},
+	{Name: "JWT_HEADER_OVERFLOW_FALLBACK", Group: groupForwarding, Type: "string", Default: "bearer", Description: "Format retried when split headers overflow: bearer, gzip-split or off"},
+	{Name: "ADAPTIVE_COMPRESSION", Group: groupForwarding, Type: "bool", Default: "false", Description: "Pick split or whole tokens per target from measured header bytes"},
+	{Name: "ADAPTIVE_COMPRESSION_MARGIN", Group: groupForwarding, Type: "float", Default: "0.05", Description: "Fraction by which split must beat whole tokens to be kept"},
+	{Name: "ADAPTIVE_COMPRESSION_PROBE_RATE", Group: groupForwarding, Type: "float", Default: "0.05", Description: "Fraction of calls sent in the losing format to keep measuring it"},
+	{Name: "JWT_TARGET_MEMORY_FILE", Group: groupForwarding, Type: "path", Description: "File the per-target compression decisions are kept in across restarts"},
+	{Name: "JWT_TARGET_MEMORY_TTL", Group: groupForwarding, Type: "duration", Default: "24h", Description: "Age after which remembered decisions are dropped"},
+	{Name: "CLAIMS_AUDIT_FILE", Group: groupForwarding, Type: "path", Description: "File recording which claims each service the frontend calls received per subject, for data-subject exports"},
+	{Name: "CLAIMS_AUDIT_RETENTION", Group: groupForwarding, Type: "duration", Default: "720h", Description: "Age after which claims audit records are dropped"},
+	{Name: "JWT_REVOCATION_URLS", Group: groupForwarding, Type: "list", Description: "Endpoints notified of tokens revoked at logout"},
+	{Name: "JWT_REVOCATION_KEY", Group: groupForwarding, Type: "string", Description: "Key shared with the revocation endpoints that signs each notice", Secret: true},
+
+	{Name: "JWT_CLAIM_CLASSIFIER", Group: groupClaims, Type: "string", Description: "Split payloads by claim volatility: standard, auth0, azure or custom"},
+	{Name: "JWT_CLAIM_CLASSIFIER_PATHS", Group: groupClaims, Type: "json", Description: "Claim paths per class for the custom classifier"},
+	{Name: "JWT_ISSUERS", Group: groupClaims, Type: "json", Description: "Issuers shared with the verifiers, with a classifier per issuer"},
+	{Name: "REQUEST_PRIORITY_HIGH", Group: groupClaims, Type: "string", Description: "Claim selector of the sessions whose calls are sent with x-request-priority high"},
+	{Name: "REQUEST_PRIORITY_LOW", Group: groupClaims, Type: "string", Description: "Claim selector of the sessions whose calls are sent with x-request-priority low"},
+	{Name: "JWT_FIELD_KEY_FILE", Group: groupClaims, Type: "path", Description: "Mesh-shared key sealing sensitive claims in split payloads"},
+	{Name: "JWT_ENCRYPTED_CLAIMS", Group: groupClaims, Type: "list", Default: defaultEncryptedClaims, Description: "Claims sealed with the field key"},
+	{Name: "JWT_PII_SERVICES", Group: groupClaims, Type: "list", Default: defaultPIIServices, Description: "Services holding the field key; the others get tokens with sealed claims whole"},
+	{Name: "JWT_STATIC_DICTIONARY", Group: groupClaims, Type: "bool", Default: "false", Description: "Send a reference instead of a static block the downstream already holds"},
+
+	{Name: "JWT_WIRE_CODEC", Group: groupCodecs, Type: "string", Description: "jwtcodec codec for split tokens, or negotiate; the built-in split format when empty"},
+	{Name: "JWT_WIRE_CODEC_PREFERENCE", Group: groupCodecs, Type: "list", Default: defaultWireCodecPreference, Description: "Codecs tried in order when negotiating"},
+	{Name: "JWT_REFERENCE_TTL", Group: groupCodecs, Type: "duration", Description: "Lifetime of reference-token references; the codec is off when empty"},
+
+	{Name: "CSRF_KEY", Group: groupSessions, Type: "string", Description: "Key of the CSRF tokens, random per process when empty", Secret: true},
+	{Name: "ENABLE_SINGLE_SHARED_SESSION", Group: groupSessions, Type: "bool", Default: "false", Description: "Give every visitor the same session"},
+	{Name: "OIDC_ISSUER", Group: groupSessions, Type: "url", Description: "OpenID Connect provider to log in with; login is off when empty"},
+	{Name: "OIDC_CLIENT_ID", Group: groupSessions, Type: "string", Description: "Client ID registered with the OIDC provider"},
+	{Name: "OIDC_CLIENT_SECRET", Group: groupSessions, Type: "string", Description: "Client secret registered with the OIDC provider", Secret: true},
+	{Name: "OIDC_REDIRECT_URL", Group: groupSessions, Type: "url", Description: "Callback URL registered with the OIDC provider"},
+	{Name: "OIDC_SCOPES", Group: groupSessions, Type: "string", Default: "openid profile email", Description: "Scopes requested at login"},
+	{Name: "OIDC_CURRENCY_CLAIM", Group: groupSessions, Type: "string", Default: "currency", Description: "IdP token claim holding the user's preferred currency"},
+	{Name: "GROUPS_OVERFLOW_RESOLVE", Group: groupSessions, Type: "bool", Default: "false", Description: "Resolve group claims the IdP left out of oversized tokens"},
+	{Name: "GROUPS_OVERFLOW_ENDPOINT", Group: groupSessions, Type: "url", Description: "Endpoint overflowed groups are resolved from, the token's claim source when empty"},
+	{Name: "GROUPS_OVERFLOW_CACHE_TTL", Group: groupSessions, Type: "duration", Default: "10m", Description: "How long resolved groups are cached"},
+
+	{Name: "OFREP_ENDPOINT", Group: groupRollout, Type: "url", Description: "OFREP feature flag service; flags fall back to the settings below when empty"},
+	{Name: "JWT_DUAL_WRITE", Group: groupRollout, Type: "bool", Default: "false", Description: "Also send the authorization header with split tokens"},
+	{Name: "PAGE_PREFETCH", Group: groupRollout, Type: "bool", Default: "false", Description: "Prefetch the calls of the next page"},
+	{Name: "PAGE_PREFETCH_CLAIMS", Group: groupRollout, Type: "string", Description: "Claim selector of the sessions that prefetch"},
+	{Name: "FEATURE_GATES", Group: groupRollout, Type: "string", Description: "name:claim selector pairs, separated by semicolons, of the UI features shown to matching sessions"},
+
+	{Name: "ENABLE_ERROR_INJECTION", Group: groupFaults, Type: "bool", Default: "false", Description: "Fail a fraction of downstream calls on purpose"},
+	{Name: "ERROR_INJECTION_RATE", Group: groupFaults, Type: "float", Default: "0.1", Description: "Fraction of calls failed"},
+	{Name: "ERROR_INJECTION_TYPE", Group: groupFaults, Type: "string", Default: "unavailable", Description: "Kind of failure injected"},
+	{Name: "ERROR_INJECTION_TARGET", Group: groupFaults, Type: "string", Default: "CartService", Description: "Service whose calls are failed"},
+	{Name: "ERROR_INJECTION_PUSHBACK", Group: groupFaults, Type: "duration", Description: "Retry delay injected Unavailable and ResourceExhausted errors ask for, as RetryInfo and grpc-retry-pushback-ms"},
+	{Name: "ERROR_INJECTION_CLAIMS", Group: groupFaults, Type: "string", Description: "Claim selector of the sessions whose calls are failed"},
+	{Name: "CHAOS_SCENARIO_FILE", Group: groupFaults, Type: "path", Description: "Chaos scenario loaded at startup"},
+	{Name: "CHAOS_SCENARIO_AUTOSTART", Group: groupFaults, Type: "bool", Default: "false", Description: "Start the loaded chaos scenario straight away"},
+	{Name: "LINK_SHAPING_BANDWIDTH", Group: groupFaults, Type: "string", Description: "Bandwidth of the simulated downstream link, e.g. 1mbit"},
+	{Name: "LINK_SHAPING_RTT", Group: groupFaults, Type: "duration", Description: "Round trip time of the simulated downstream link"},
+	{Name: "LINK_SHAPING_BURST", Group: groupFaults, Type: "int", Description: "Bytes sent before the simulated link starts shaping"},
+
+	{Name: "ENABLE_TRACING", Group: groupObservability, Type: "string", Description: "Export OpenTelemetry traces when \"1\""},
+	{Name: "COLLECTOR_SERVICE_ADDR", Group: groupObservability, Type: "addr", Description: "OpenTelemetry collector, required with tracing"},
+	{Name: "ENABLE_PROFILER", Group: groupObservability, Type: "string", Description: "Run the Cloud Profiler agent when \"1\""},
+	{Name: "PYROSCOPE_SERVER_ADDRESS", Group: groupObservability, Type: "url", Description: "Pyroscope server continuous profiles are pushed to"},
+	{Name: "PYROSCOPE_BASIC_AUTH_USER", Group: groupObservability, Type: "string", Description: "Pyroscope basic auth user"},
+	{Name: "PYROSCOPE_BASIC_AUTH_PASSWORD", Group: groupObservability, Type: "string", Description: "Pyroscope basic auth password", Secret: true},
+	{Name: "HOSTNAME", Group: groupObservability, Type: "string", Description: "Pod name profiles are tagged with"},
+	{Name: "SUBJECT_HASH_KEY_FILE", Group: groupObservability, Type: "path", Description: "Base64 keys, one per line with the current first, user identifiers are hashed with in logs and audit records"},
+	{Name: "JWT_SLO_TARGET", Group: groupObservability, Type: "float", Default: "0.999", Description: "Fraction of JWT forwarding that must succeed"},
+	{Name: "JWT_SLO_WINDOW", Group: groupObservability, Type: "duration", Default: "5m", Description: "Window the SLO burn rate is measured over"},
+	{Name: "JWT_SLO_BURN_RATE", Group: groupObservability, Type: "float", Default: "10", Description: "Burn rate that marks the SLO as breached, reported by the jwt_slo_degraded gauge for alerting"},
+	{Name: "JWT_DECISION_LOG_SAMPLE", Group: groupObservability, Type: "int", Default: "0", Description: "Log how one call in N sent its token, 0 to log none"},
+	{Name: "ACCESS_LOG_SAMPLE", Group: groupObservability, Type: "int", Default: "0", Description: "Log one request in N with its auth outcome, 0 to turn the access log off"},
+	{Name: "ACCESS_LOG_SLOW", Group: groupObservability, Type: "duration", Description: "Always log requests slower than this"},
+	{Name: "JWT_H2_CAPTURE_FILE", Group: groupObservability, Type: "path", Description: "File the raw HTTP/2 frames of downstream connections are written to"},
+	{Name: "AUTH_TIMING_ALLOW", Group: groupObservability, Type: "list", Description: "CIDRs of callers whose x-debug-auth-timing header gets a Server-Timing trailer; off when empty"},
+	{Name: "JWT_FLOW_PEERS", Group: groupObservability, Type: "list", Description: "name=url of the /debug/grpcstats of other services merged into /debug/jwtflow"},
+	{Name: "DEBUG_PORT", Group: groupObservability, Type: "int", Description: "Port of the pprof and debug server, off when empty"},
+	{Name: "DEBUG_LISTEN_ADDR", Group: groupObservability, Type: "string", Default: "127.0.0.1", Description: "Address of the debug server; set it to reach the server from outside the pod"},
+	{Name: "DEBUG_ADMIN_TOKEN", Group: groupObservability, Type: "string", Description: "Bearer token required to rotate or revoke signing keys, start or stop chaos scenarios and export audited claims on the debug server; all are refused when empty", Secret: true},
+	{Name: "CHANNELZ_PORT", Group: groupObservability, Type: "int", Description: "Port of the channelz service, off when empty"},
+}
+
+// knobs holds the settings of this process
+var knobs = loadKnobs(frontendKnobs, os.Args[1:])
+
+type knobRegistry struct {
+	defs       []knob
+	byName     map[string]knob
+	flags      map[string]string
+	file       map[string]string
+	fileSource string
+	docs       bool
+	problems   []string
+
+	freshnessRules bool
+}
+
+// loadKnobs parses the command line and reads the settings file it or
+// CONFIG_FILE names
+func loadKnobs(defs []knob, args []string) *knobRegistry {
+	r := &knobRegistry{defs: defs, byName: make(map[string]knob), flags: make(map[string]string)}
+	for _, k := range defs {
+		r.byName[k.Name] = k
+	}
+	r.fileSource = os.Getenv("CONFIG_FILE")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || strings.HasPrefix(name, "test.") {
+			continue
+		}
+		if (name == "set" || name == "config") && !hasValue {
+			if i+1 == len(args) {
+				r.problemf("-%s needs a value", name)
+				continue
+			}
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "set":
+			k, v, ok := strings.Cut(value, "=")
+			if !ok {
+				r.problemf("-set %q must be NAME=value", value)
+				continue
+			}
+			r.flags[k] = v
+		case "config":
+			r.fileSource = value
+		case "config-docs":
+			r.docs = true
+		case "token-freshness-rules":
+			r.freshnessRules = true
+		default:
+			r.problemf("unknown flag %s", arg)
+		}
+	}
+	if r.fileSource != "" {
+		file, err := readKnobFile(r.fileSource)
+		if err != nil {
+			r.problemf("config %s: %v", r.fileSource, err)
+		}
+		r.file = file
+	}
+	r.checkNames("-set", r.flags)
+	r.checkNames(r.fileSource, r.file)
+	return r
+}
+
+func (r *knobRegistry) problemf(format string, args ...interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+// checkNames flags settings that aren't declared or can't be set from src
+func (r *knobRegistry) checkNames(src string, values map[string]string) {
+	for name := range values {
+		k, ok := r.byName[name]
+		switch {
+		case !ok:
+			r.problemf("%s sets %s, which is not a frontend setting", src, name)
+		case k.EnvOnly:
+			r.problemf("%s sets %s, which is only read from the environment", src, name)
+		}
+	}
+}
+
+// readKnobFile reads a YAML map of settings from a file or an http(s) URL.
+// Lists and maps, such as JWT_ISSUERS, may be written as YAML and are passed
+// on as JSON.
+func readKnobFile(src string) (map[string]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		data, err = fetchKnobFile(src)
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case nil:
+			values[name] = ""
+		case string:
+			values[name] = v
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			values[name] = string(b)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+func fetchKnobFile(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Lookup returns the value of name and whether any source sets it
+func (r *knobRegistry) Lookup(name string) (string, bool) {
+	v, src := r.lookup(name)
+	return v, src != "default"
+}
+
+// Value returns the value of name, empty when no source sets it
+func (r *knobRegistry) Value(name string) string {
+	v, _ := r.Lookup(name)
+	return v
+}
+
+// Get returns the value of name, or its declared default when it is unset
+// or empty
+func (r *knobRegistry) Get(name string) string {
+	if v := r.Value(name); v != "" {
+		return v
+	}
+	return r.byName[name].Default
+}
+
+// lookup returns the value of name and the source it came from. It is the
+// one place the frontend reads its environment.
+//
+//svcvet:config
+func (r *knobRegistry) lookup(name string) (string, string) {
+	if v, ok := r.flags[name]; ok {
+		return v, "flag"
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, "env"
+	}
+	if v, ok := r.file[name]; ok {
+		return v, "file"
+	}
+	return "", "default"
+}
+
+// knobValue is one setting in /debug/config
+type knobValue struct {
+	Name    string `json:"name"`
+	Group   string `json:"group"`
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+	Value   string `json:"value"`
+	Source  string `json:"source"`
+}
+
+// Effective returns every declared setting with the value in force
+func (r *knobRegistry) Effective() []knobValue {
+	values := make([]knobValue, 0, len(r.defs))
+	for _, k := range r.defs {
+		v, src := r.lookup(k.Name)
+		if src == "default" || v == "" {
+			v = k.Default
+		}
+		if k.Secret && src != "default" {
+			v = "<redacted>"
+		}
+		values = append(values, knobValue{Name: k.Name, Group: k.Group, Type: k.Type, Default: k.Default, Value: v, Source: src})
+	}
+	return values
+}
+
+// configDebugHandler serves GET /debug/config
+func configDebugHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		File     string      `json:"config_file,omitempty"`
+		Settings []knobValue `json:"settings"`
+	}{knobs.fileSource, knobs.Effective()})
+}
+
+// Markdown documents every declared setting by group
+func (r *knobRegistry) Markdown() string {
+	var b strings.Builder
+	b.WriteString("# Frontend configuration\n\n")
+	b.WriteString("<!-- Generated by `go run . -config-docs` in src/frontend, do not edit. -->\n\n")
+	b.WriteString("Each setting is read from, in order of precedence, a `-set NAME=value` flag,\n")
+	b.WriteString("the environment, the YAML file or http(s) URL named by `-config` or\n")
+	b.WriteString("`CONFIG_FILE`, and its default. Settings marked *environment only* are read\n")
+	b.WriteString("by libraries and can't come from flags or the file. `GET /debug/config` on\n")
+	b.WriteString("the debug server (`DEBUG_PORT`) shows the values in force.\n\n")
+	b.WriteString("Only the frontend reads its settings this way. Checkout, shipping and order\n")
+	b.WriteString("history read theirs from the environment alone and aren't listed here.\n")
+	group := ""
+	for _, k := range r.defs {
+		if k.Group != group {
+			group = k.Group
+			fmt.Fprintf(&b, "\n## %s\n\n| Name | Type | Default | Description |\n|---|---|---|---|\n", group)
+		}
+		def := ""
+		if k.Default != "" {
+			def = "`" + k.Default + "`"
+		}
+		desc := k.Description
+		if k.EnvOnly {
+			desc += " (environment only)"
+		}
+		if k.Secret {
+			desc += " (secret)"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", k.Name, k.Type, def, desc)
+	}
+	return b.String()
+}
+
+func init() {
+	keyring.Getenv = knobs.Value
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestKnobPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "frontend.yaml")
+	if err := os.WriteFile(file, []byte("JWT_SPLIT_MIN_BYTES: 100\nJWT_SLO_TARGET: 0.99\nJWT_ISSUERS:\n  - iss: https://idp/\n    classifier: none\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := loadKnobs(frontendKnobs, []string{"-config", file, "-set", "JWT_SPLIT_MIN_BYTES=200", "-test.v"})
+	t.Setenv("JWT_SPLIT_MIN_BYTES", "300")
+	t.Setenv("JWT_SLO_TARGET", "0.9")
+
+	if v, src := r.lookup("JWT_SPLIT_MIN_BYTES"); v != "200" || src != "flag" {
+		t.Errorf("flag: got %q from %s", v, src)
+	}
+	if v, src := r.lookup("JWT_SLO_TARGET"); v != "0.9" || src != "env" {
+		t.Errorf("env: got %q from %s", v, src)
+	}
+	if v, src := r.lookup("JWT_ISSUERS"); v != `[{"classifier":"none","iss":"https://idp/"}]` || src != "file" {
+		t.Errorf("file: got %q from %s", v, src)
+	}
+	if v := r.Get("JWT_WIRE_CODEC_PREFERENCE"); v != defaultWireCodecPreference {
+		t.Errorf("default: got %q", v)
+	}
+	if len(r.problems) != 0 {
+		t.Errorf("problems: %v", r.problems)
+	}
+}
+
+func TestKnobProblems(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "frontend.yaml")
+	if err := os.WriteFile(file, []byte("JWT_SPLIT_MIN_BYTE: 100\nGRPC_XDS_BOOTSTRAP: /xds.json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := loadKnobs(frontendKnobs, []string{"-config=" + file, "-set", "NOPE", "-verbose"})
+	got := strings.Join(r.problems, "\n")
+	for _, want := range []string{"JWT_SPLIT_MIN_BYTE, which is not", "GRPC_XDS_BOOTSTRAP, which is only read", `-set "NOPE"`, "unknown flag -verbose"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("problems missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestKnobsDeclared(t *testing.T) {
+	use := regexp.MustCompile(`(?:knobs\.(?:Value|Lookup|Get)|mustMapEnv\([^,]+,|c\.check(?:Bool|Float|Duration))\(?\s*"([A-Z0-9_]+)"`)
+	files, _ := filepath.Glob("*.go")
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range use.FindAllStringSubmatch(string(src), -1) {
+			if _, ok := knobs.byName[m[1]]; !ok {
+				t.Errorf("%s reads %s, which is not declared in frontendKnobs", f, m[1])
+			}
+		}
+	}
+}
+
+func TestConfigDocsUpToDate(t *testing.T) {
+	docs, err := os.ReadFile("../../docs/frontend-configuration.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(docs) != knobs.Markdown() {
+		t.Error("docs/frontend-configuration.md is stale, regenerate it with go run . -config-docs")
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/subjecthash"
+)
+
+// injectableErrorTypes are the ERROR_INJECTION_TYPE values injectFault understands
+var injectableErrorTypes = map[string]bool{
+	"unavailable":        true,
+	"timeout":            true,
+	"internal":           true,
+	"deadline_exceeded":  true,
+	"resource_exhausted": true,
+	"connection_refused": true,
+	"packet_loss":        true,
+	"random":             true,
+
+	// Corrupt the JWT metadata instead of failing, see jwt_chaos.go
+	jwtCorruptTruncateSignature: true,
+	jwtCorruptDropSession:       true,
+	jwtCorruptFlipPayload:       true,
+	jwtCorruptRandom:            true,
+}
+
+// configReport collects every configuration problem so they can be reported
+// together rather than one restart at a time
+type configReport struct {
+	problems []string
+}
+
+func (c *configReport) addf(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *configReport) err() error {
+	if len(c.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration (%d problems):\n  - %s",
+		len(c.problems), strings.Join(c.problems, "\n  - "))
+}
+
+// checkBool flags values other than "true"/"false", which would otherwise be
+// silently read as false
+func (c *configReport) checkBool(key string) {
+	if v := knobs.Value(key); v != "" && v != "true" && v != "false" {
+		c.addf("%s=%q must be \"true\" or \"false\"", key, v)
+	}
+}
+
+// checkFloat flags values that don't parse or fall outside [min, max]
+func (c *configReport) checkFloat(key string, min, max float64) {
+	v := knobs.Value(key)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || f > max {
+		c.addf("%s=%q must be a number between %g and %g", key, v, min, max)
+	}
+}
+
+// checkDuration flags values that are not positive Go durations
+func (c *configReport) checkDuration(key string) {
+	v := knobs.Value(key)
+	if v == "" {
+		return
+	}
+	if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+		c.addf("%s=%q must be a positive duration such as 5m", key, v)
+	}
+}
+
+// checkFile flags paths that can't be read
+func (c *configReport) checkFile(what, path string) {
+	if _, err := os.Stat(path); err != nil {
+		c.addf("%s %s is not readable: %v", what, path, err)
+	}
+}
+
+// validateConfig checks the JWT, error injection and SLO settings for
+// consistency before the server starts
+func validateConfig() error {
+	c := &configReport{}
+	c.problems = append(c.problems, knobs.problems...)
+
+	// JWT signing keys are always needed to mint tokens, and compression can't
+	// split a token that was never issued
+	c.checkBool("ENABLE_JWT_COMPRESSION")
+	c.checkBool("JWT_DUAL_WRITE")
+	if v := knobs.Value("JWT_SPLIT_MIN_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			c.addf("JWT_SPLIT_MIN_BYTES=%q must be a non-negative integer", v)
+		}
+	}
+	if _, err := newClaimClassifier(knobs.Value("JWT_CLAIM_CLASSIFIER"), knobs.Value("JWT_CLAIM_CLASSIFIER_PATHS")); err != nil {
+		c.addf("%v", err)
+	}
+	if _, err := parseIssuerClaimClassifiers(knobs.Value("JWT_ISSUERS"), knobs.Value("JWT_CLAIM_CLASSIFIER_PATHS")); err != nil {
+		c.addf("%v", err)
+	}
+	if _, err := subjecthash.Load(knobs.Value("SUBJECT_HASH_KEY_FILE")); err != nil {
+		c.addf("SUBJECT_HASH_KEY_FILE: %v", err)
+	}
+	for _, key := range []string{"REQUEST_PRIORITY_HIGH", "REQUEST_PRIORITY_LOW"} {
+		if _, err := parseClaimSelector(knobs.Value(key)); err != nil {
+			c.addf("%s: %v", key, err)
+		}
+	}
+	if _, err := loadFieldSealer(); err != nil {
+		c.addf("JWT_FIELD_KEY_FILE: %v", err)
+	}
+	c.checkBool("JWT_STATIC_DICTIONARY")
+	if knobs.Value("JWT_STATIC_DICTIONARY") == "true" && knobs.Value("JWT_CLAIM_CLASSIFIER") == "" {
+		c.addf("JWT_STATIC_DICTIONARY=true needs JWT_CLAIM_CLASSIFIER, there is no static block without it")
+	}
+	if v := knobs.Value("GRPC_MAX_HEADER_LIST_SIZE"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil || n == 0 {
+			c.addf("GRPC_MAX_HEADER_LIST_SIZE=%q must be a positive number of bytes", v)
+		}
+	}
+	switch v := knobs.Value("JWT_HEADER_OVERFLOW_FALLBACK"); v {
+	case "", "bearer", "gzip-split", "off":
+	default:
+		c.addf("JWT_HEADER_OVERFLOW_FALLBACK=%q must be bearer, gzip-split or off", v)
+	}
+	if err := checkWireCodec(wireCodec, wireCodecPreference); err != nil {
+		c.addf("%v", err)
+	}
+	c.checkDuration("JWT_REFERENCE_TTL")
+	for _, u := range revocationURLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			c.addf("JWT_REVOCATION_URLS: %q must be an http(s) URL", u)
+		}
+	}
+	if len(revocationURLs) > 0 && len(revocationKey) == 0 {
+		c.addf("JWT_REVOCATION_URLS requires JWT_REVOCATION_KEY")
+	}
+	if authTimingAllowErr != nil {
+		c.addf("%v", authTimingAllowErr)
+	}
+	if flowPeersErr != nil {
+		c.addf("JWT_FLOW_PEERS: %v", flowPeersErr)
+	}
+	if contractReportErr != nil {
+		c.addf("JWT_CONTRACT_REPORT: %v", contractReportErr)
+	}
+	if wireCodec == "reference-token" && knobs.Value("JWT_REFERENCE_TTL") == "" {
+		c.addf("JWT_WIRE_CODEC=reference-token needs JWT_REFERENCE_TTL")
+	}
+	if knobs.Value("JWT_REFERENCE_TTL") != "" && knobs.Value("DEBUG_PORT") == "" {
+		c.addf("JWT_REFERENCE_TTL is set but DEBUG_PORT is not, receivers couldn't resolve references")
+	} else if knobs.Value("JWT_REFERENCE_TTL") != "" && isLoopbackHost(knobs.Get("DEBUG_LISTEN_ADDR")) {
+		c.addf("JWT_REFERENCE_TTL is set but the debug server only listens on loopback, set DEBUG_LISTEN_ADDR so receivers can resolve references")
+	}
+	if v := knobs.Value("OFREP_ENDPOINT"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("OFREP_ENDPOINT=%q must be an http(s) URL", v)
+	}
+	if loader, err := keyring.FromEnv("JWT_PRIVATE_KEY", "jwt_private_key.pem"); err != nil {
+		c.addf("%v", err)
+	} else if file, ok := loader.(keyring.File); ok {
+		c.checkFile("JWT private key", string(file))
+	}
+	if v := knobs.Value("JWT_KEY_REFRESH_INTERVAL"); v != "0" {
+		c.checkDuration("JWT_KEY_REFRESH_INTERVAL")
+	}
+	if issuer := knobs.Value("OIDC_ISSUER"); issuer != "" {
+		for _, key := range []string{"OIDC_ISSUER", "OIDC_REDIRECT_URL"} {
+			if v := knobs.Value(key); !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+				c.addf("%s=%q must be an http(s) URL when OIDC login is enabled", key, v)
+			}
+		}
+		if knobs.Value("OIDC_CLIENT_ID") == "" {
+			c.addf("OIDC_ISSUER is set but OIDC_CLIENT_ID is not")
+		}
+	}
+	c.checkBool("GROUPS_OVERFLOW_RESOLVE")
+	c.checkDuration("GROUPS_OVERFLOW_CACHE_TTL")
+	if v := knobs.Value("GROUPS_OVERFLOW_ENDPOINT"); v != "" && !strings.HasPrefix(v, "https://") && !strings.HasPrefix(v, "http://") {
+		c.addf("GROUPS_OVERFLOW_ENDPOINT=%q must be an http(s) URL", v)
+	}
+	c.checkBool("GRPC_XDS")
+	if knobs.Value("GRPC_XDS") == "true" {
+		if path := knobs.Value("GRPC_XDS_BOOTSTRAP"); path != "" {
+			c.checkFile("GRPC_XDS_BOOTSTRAP", path)
+		} else if knobs.Value("GRPC_XDS_BOOTSTRAP_CONFIG") == "" {
+			c.addf("GRPC_XDS=true needs GRPC_XDS_BOOTSTRAP or GRPC_XDS_BOOTSTRAP_CONFIG")
+		}
+	}
+	tlsFiles := 0
+	for _, key := range []string{"GRPC_TLS_CERT_FILE", "GRPC_TLS_KEY_FILE", "GRPC_TLS_CA_FILE"} {
+		if path := knobs.Value(key); path != "" {
+			c.checkFile(key, path)
+			tlsFiles++
+		}
+	}
+	if tlsFiles != 0 && tlsFiles != 3 {
+		c.addf("GRPC_TLS_CERT_FILE, GRPC_TLS_KEY_FILE and GRPC_TLS_CA_FILE must be set together")
+	} else if _, err := loadClientTLSConfig(); err != nil {
+		c.addf("%v", err)
+	}
+	c.checkBool("JWT_TOKEN_BINDING")
+	if knobs.Value("JWT_TOKEN_BINDING") == "true" && tlsFiles == 0 {
+		c.addf("JWT_TOKEN_BINDING=true needs GRPC_TLS_*: tokens are bound to the client certificate")
+	}
+	if v := knobs.Value("CSRF_KEY"); v != "" && len(v) < 16 {
+		c.addf("CSRF_KEY must be at least 16 bytes, got %d", len(v))
+	}
+	c.checkBool("ADAPTIVE_COMPRESSION")
+	c.checkFloat("ADAPTIVE_COMPRESSION_MARGIN", 0, 0.99)
+	c.checkFloat("ADAPTIVE_COMPRESSION_PROBE_RATE", 0, 0.5)
+
+	if v := knobs.Value("PYROSCOPE_SERVER_ADDRESS"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("PYROSCOPE_SERVER_ADDRESS=%q must be an http(s) URL", v)
+	}
+
+	c.checkFloat("JWT_SLO_TARGET", 0, 1)
+	if v := knobs.Value("JWT_SLO_TARGET"); v == "0" || v == "1" {
+		c.addf("JWT_SLO_TARGET=%q must be strictly between 0 and 1", v)
+	}
+	c.checkDuration("JWT_SLO_WINDOW")
+	c.checkFloat("JWT_SLO_BURN_RATE", 0, 1000)
+
+	c.checkBool("ENABLE_ERROR_INJECTION")
+	injection := knobs.Value("ENABLE_ERROR_INJECTION") == "true"
+	for _, key := range []string{"ERROR_INJECTION_RATE", "ERROR_INJECTION_TYPE", "ERROR_INJECTION_TARGET"} {
+		if !injection && knobs.Value(key) != "" {
+			c.addf("%s is set but ENABLE_ERROR_INJECTION is not \"true\"", key)
+		}
+	}
+	c.checkFloat("ERROR_INJECTION_RATE", 0, 1)
+	c.checkDuration("ERROR_INJECTION_PUSHBACK")
+	if v := knobs.Value("ERROR_INJECTION_TYPE"); v != "" && !injectableErrorTypes[strings.ToLower(v)] {
+		c.addf("ERROR_INJECTION_TYPE=%q is not a known error type", v)
+	}
+	if v := knobs.Value("ERROR_INJECTION_CLAIMS"); v != "" {
+		if !injection {
+			c.addf("ERROR_INJECTION_CLAIMS is set but ENABLE_ERROR_INJECTION is not \"true\"")
+		}
+		if _, err := parseClaimSelector(v); err != nil {
+			c.addf("ERROR_INJECTION_CLAIMS: %v", err)
+		}
+	}
+	c.checkBool("ENABLE_GRAPHQL")
+	c.checkBool("ENABLE_ORDER_STATUS_WS")
+	c.checkDuration("ORDER_STATUS_WS_POLL")
+	c.checkBool("PAGE_PREFETCH")
+	if featureGatesErr != nil {
+		c.addf("FEATURE_GATES: %v", featureGatesErr)
+	}
+	if v := knobs.Value("PAGE_PREFETCH_CLAIMS"); v != "" {
+		if _, err := parseClaimSelector(v); err != nil {
+			c.addf("PAGE_PREFETCH_CLAIMS: %v, prefetching is disabled", err)
+		}
+	}
+	if v := knobs.Value("LINK_SHAPING_BANDWIDTH"); v != "" {
+		if _, err := parseBandwidth(v); err != nil {
+			c.addf("LINK_SHAPING_BANDWIDTH: %v", err)
+		}
+	}
+	if v := knobs.Value("LINK_SHAPING_RTT"); v != "" {
+		if _, err := time.ParseDuration(v); err != nil {
+			c.addf("LINK_SHAPING_RTT=%q is not a duration", v)
+		}
+	}
+	if v := knobs.Value("LINK_SHAPING_BURST"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			c.addf("LINK_SHAPING_BURST=%q must be a number of bytes", v)
+		}
+	}
+	if knobs.Value("JWT_H2_CAPTURE_FILE") != "" && xdsEnabled {
+		c.addf("JWT_H2_CAPTURE_FILE is ignored when xDS is enabled: connections may be encrypted")
+	}
+	if v := knobs.Value("JWT_DECISION_LOG_SAMPLE"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.addf("JWT_DECISION_LOG_SAMPLE=%q must be a non-negative integer (1 in N calls)", v)
+		}
+	}
+	if v := knobs.Value("ACCESS_LOG_SAMPLE"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.addf("ACCESS_LOG_SAMPLE=%q must be a non-negative integer (1 in N requests)", v)
+		}
+	}
+	c.checkDuration("ACCESS_LOG_SLOW")
+	if path := knobs.Value("PARTNER_API_KEYS_FILE"); path != "" {
+		if _, err := loadPartnerKeys(path); err != nil {
+			c.addf("PARTNER_API_KEYS_FILE: %v", err)
+		}
+	}
+	if path := knobs.Value("JWT_METHOD_AUTH_FILE"); path != "" {
+		overrides, err := loadMethodAuthOverrides(path)
+		if err == nil {
+			_, err = buildMethodAuth(pb.MethodAuthPolicies, overrides)
+		}
+		if err != nil {
+			c.addf("JWT_METHOD_AUTH_FILE: %v", err)
+		}
+	}
+	if path := knobs.Value("JWT_TARGET_MEMORY_FILE"); path != "" {
+		c.checkFile("JWT_TARGET_MEMORY_FILE directory", filepath.Dir(path))
+	}
+	c.checkDuration("JWT_TARGET_MEMORY_TTL")
+	if path := knobs.Value("CLAIMS_AUDIT_FILE"); path != "" {
+		c.checkFile("CLAIMS_AUDIT_FILE directory", filepath.Dir(path))
+	}
+	c.checkDuration("CLAIMS_AUDIT_RETENTION")
+	c.checkBool("CHAOS_SCENARIO_AUTOSTART")
+	if path := knobs.Value("CHAOS_SCENARIO_FILE"); path != "" {
+		if _, err := loadChaosScenario(path); err != nil {
+			c.addf("CHAOS_SCENARIO_FILE: %v", err)
+		}
+	} else if knobs.Value("CHAOS_SCENARIO_AUTOSTART") == "true" {
+		c.addf("CHAOS_SCENARIO_AUTOSTART is set but CHAOS_SCENARIO_FILE is not")
+	}
+	if v := knobs.Value("ERROR_INJECTION_TARGET"); v != "" && v != "all" {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); !isDownstreamService(t) {
+				c.addf("ERROR_INJECTION_TARGET names unknown service %q", t)
+			}
+		}
+	}
+
+	return c.err()
+}
+
+// isDownstreamService reports whether name (e.g. "CartService") is a service
+// the frontend actually calls
+func isDownstreamService(name string) bool {
+	for _, svc := range downstreamServices {
+		if name != "" && strings.HasSuffix(svc, "."+name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigReportsAllProblems(t *testing.T) {
+	t.Setenv("ENABLE_JWT_COMPRESSION", "yes")
+	t.Setenv("ENABLE_ERROR_INJECTION", "true")
+	t.Setenv("ERROR_INJECTION_RATE", "1.5")
+	t.Setenv("ERROR_INJECTION_TYPE", "explode")
+	t.Setenv("ERROR_INJECTION_TARGET", "CartService, WarehouseService")
+	t.Setenv("GRPC_XDS", "true")
+	t.Setenv("JWT_REFERENCE_TTL", "1m")
+	t.Setenv("DEBUG_PORT", "9090")
+
+	err := validateConfig()
+	if err == nil {
+		t.Fatal("validateConfig() = nil, want error")
+	}
+	for _, want := range []string{
+		"ENABLE_JWT_COMPRESSION",
+		"ERROR_INJECTION_RATE",
+		"ERROR_INJECTION_TYPE",
+		`unknown service "WarehouseService"`,
+		"GRPC_XDS_BOOTSTRAP",
+		"DEBUG_LISTEN_ADDR",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error report missing %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"CartService"`) {
+		t.Errorf("CartService is a valid target, got:\n%v", err)
+	}
+}
+
+func TestValidateConfigErrorInjectionDisabled(t *testing.T) {
+	t.Setenv("ENABLE_ERROR_INJECTION", "")
+	t.Setenv("ERROR_INJECTION_RATE", "0.5")
+
+	err := validateConfig()
+	if err == nil || !strings.Contains(err.Error(), "ENABLE_ERROR_INJECTION is not") {
+		t.Errorf("validateConfig() = %v, want error about rate set without injection enabled", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/jwtcodec"
+)
+
+// Contract reports
+//
+// JWT_CONTRACT_REPORT points at the JSON written by the contract tests in
+// test-suite/integration (go test -tags contract). A downstream whose verdict
+// is "authorization" gets the Bearer header as if it were listed in
+// JWT_FORCE_AUTHORIZATION_FOR, and the codecs a downstream advertised seed
+// negotiation until it answers a call itself.
+
+const (
+	contractVerdictSplit         = "split"
+	contractVerdictAuthorization = "authorization"
+	contractVerdictBroken        = "broken"
+)
+
+// contractReport is the file format shared with the contract tests
+type contractReport struct {
+	Services map[string]contractResult `json:"services"`
+}
+
+type contractResult struct {
+	Method   string            `json:"method"`
+	Outcomes map[string]string `json:"outcomes"` // header mode -> gRPC code
+	Codecs   string            `json:"codecs,omitempty"`
+	Verdict  string            `json:"verdict"`
+}
+
+var contractServices, contractReportErr = loadContractReport(knobs.Value("JWT_CONTRACT_REPORT"))
+
+func init() {
+	for service, r := range contractServices {
+		if r.Codecs != "" {
+			downstreamCodecs.Observe(service, metadata.Pairs(jwtcodec.AdvertiseHeader, r.Codecs))
+		}
+	}
+}
+
+// loadContractReport reads the report at path; no path means no report
+func loadContractReport(path string) (map[string]contractResult, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report contractReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for service, r := range report.Services {
+		switch r.Verdict {
+		case contractVerdictSplit, contractVerdictAuthorization, contractVerdictBroken:
+		default:
+			return nil, fmt.Errorf("%s: unknown verdict %q for %s", path, r.Verdict, service)
+		}
+	}
+	return report.Services, nil
+}
+
+// contractRequiresAuthorization reports whether the contract tests found
+// that service rejects the split headers but accepts the Bearer header
+func contractRequiresAuthorization(service string) bool {
+	return contractServices[service].Verdict == contractVerdictAuthorization
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// csrfKey derives per-session CSRF tokens. Set CSRF_KEY when running more than
+// one frontend replica so tokens stay valid across replicas; otherwise a
+// random key is generated at startup.
+var csrfKey = loadCSRFKey()
+
+// csrfProtectedPaths lists the state-changing routes, relative to BASE_URL,
+// that require a CSRF token: every form the pages post. The other POST
+// routes are exempt: /graphql is read-only and only takes application/json
+// bodies, /bot only relays a question to the shopping assistant, and the
+// partner API authenticates with its own bearer tokens rather than cookies.
+var csrfProtectedPaths = map[string]bool{
+	"/cart":          true,
+	"/cart/empty":    true,
+	"/cart/checkout": true,
+	"/setCurrency":   true,
+	"/logout":        true,
+}
+
+func loadCSRFKey() []byte {
+	if v := knobs.Value("CSRF_KEY"); v != "" {
+		return []byte(v)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// csrfTokenForClaims binds a CSRF token to the JWT session. The token only
+// depends on the session and subject claims, so it survives routine JWT
+// renewal but rotates whenever a new session is established (e.g. after
+// logging out and back in).
+func csrfTokenForClaims(claims *JWTClaims) string {
+	if claims == nil || claims.SessionID == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(claims.Subject + "|" + claims.SessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfToken returns the CSRF token for the current request's session
+func csrfToken(r *http.Request) string {
+	claims, _ := getJWTFromContext(r.Context())
+	return csrfTokenForClaims(claims)
+}
+
+// isCSRFProtected selects the requests csrfMiddleware applies to
+func isCSRFProtected(r *http.Request) bool {
+	return isStateChanging(r) && csrfProtectedPaths[strings.TrimPrefix(r.URL.Path, baseUrl)]
+}
+
+// csrfMiddleware rejects protected requests whose token does not match the
+// JWT session. Must run after ensureJWT.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := loggerFromContext(r.Context())
+		expected := csrfToken(r)
+		provided := r.Header.Get(csrfHeader)
+		if provided == "" {
+			provided = r.FormValue(csrfFormField)
+		}
+		if expected == "" || !hmac.Equal([]byte(provided), []byte(expected)) {
+			renderHTTPError(log, r, w, errors.New("invalid or missing CSRF token"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	claims := &JWTClaims{
+		SessionID:        "session-a",
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "urn:hipstershop:user:session-a"},
+	}
+	other := &JWTClaims{
+		SessionID:        "session-b",
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "urn:hipstershop:user:session-b"},
+	}
+	if csrfTokenForClaims(claims) == csrfTokenForClaims(other) {
+		t.Fatal("CSRF tokens of different sessions must differ")
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	h := csrfMiddleware(ok)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid token", csrfTokenForClaims(claims), http.StatusNoContent},
+		{"missing token", "", http.StatusForbidden},
+		{"token of another session", csrfTokenForClaims(other), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{csrfFormField: {tt.token}}
+			r := httptest.NewRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyJWT{}, claims))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFProtectedRoutes(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{http.MethodPost, "/cart", true},
+		{http.MethodPost, "/cart/empty", true},
+		{http.MethodPost, "/cart/checkout", true},
+		{http.MethodPost, "/setCurrency", true},
+		{http.MethodPost, "/logout", true},
+		{http.MethodGet, "/cart", false},
+		{http.MethodPost, "/graphql", false},
+	}
+	for _, tt := range tests {
+		if got := isCSRFProtected(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s: protected = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// downstreamServices lists the gRPC services the frontend calls, by full
+// service name
+var downstreamServices = []string{
+	"hipstershop.AdService",
+	"hipstershop.CartService",
+	"hipstershop.CheckoutService",
+	"hipstershop.CurrencyService",
+	"hipstershop.ProductCatalogService",
+	"hipstershop.RecommendationService",
+	"hipstershop.ShippingService",
+}
+
+// debugTokenView is the JSON response of the /debug/token endpoint
+type debugTokenView struct {
+	Claims         map[string]interface{} `json:"claims"`
+	ComponentSizes map[string]int         `json:"component_sizes"`
+	FullSize       int                    `json:"full_size"`
+	ExpiresAt      time.Time              `json:"expires_at"`
+	ExpiresIn      string                 `json:"expires_in"`
+	Downstream     map[string]string      `json:"downstream"`
+}
+
+// registerDebugTokenHandler serves /debug/token and /debug/config on the
+// debug mux, which listens on loopback unless DEBUG_LISTEN_ADDR says
+// otherwise. The session_id cookie picks the session.
+func registerDebugTokenHandler(mux *http.ServeMux) {
+	mux.Handle("/debug/token", ensureSessionID(ensureJWT(http.HandlerFunc(debugTokenHandler))))
+	mux.HandleFunc("/debug/config", configDebugHandler)
+}
+
+// debugTokenHandler shows the current session's JWT decoded, with component
+// sizes, time to expiry and the wire format each downstream service receives
+func debugTokenHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+
+	claims, ok := getJWTFromContext(r.Context())
+	tokenStr, _ := r.Context().Value(ctxKeyJWTToken{}).(string)
+	if !ok || claims == nil || tokenStr == "" {
+		http.Error(w, "no valid session JWT", http.StatusUnauthorized)
+		return
+	}
+
+	components, err := DecomposeJWT(tokenStr)
+	if err != nil {
+		http.Error(w, "failed to decompose session JWT", http.StatusInternalServerError)
+		return
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(components.Payload), &decoded); err != nil {
+		http.Error(w, "failed to decode session JWT claims", http.StatusInternalServerError)
+		return
+	}
+
+	view := debugTokenView{
+		Claims:         decoded,
+		ComponentSizes: GetJWTComponentSizes(components),
+		FullSize:       len(tokenStr),
+		Downstream:     make(map[string]string, len(downstreamServices)),
+	}
+	if claims.ExpiresAt != nil {
+		view.ExpiresAt = claims.ExpiresAt.Time
+		view.ExpiresIn = time.Until(claims.ExpiresAt.Time).Round(time.Second).String()
+	}
+	for _, svc := range downstreamServices {
+		view.Downstream[svc] = downstreamJWTFormat(r.Context(), "/"+svc+"/", len(tokenStr))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(view); err != nil {
+		log.Warnf("failed to encode debug token view: %v", err)
+	}
+}
+
+// downstreamJWTFormat describes how a token of size bytes is sent on calls to method
+func downstreamJWTFormat(ctx context.Context, method string, size int) string {
+	if shouldSkipJWT(method) {
+		return "none"
+	}
+	if jwtCompressionEnabled(ctx) && jwtSplitsAt(size) {
+		format := "x-jwt-header + x-jwt-payload + x-jwt-sig"
+		if claimClassifier != nil {
+			format = "x-jwt-header + x-jwt-claims + x-jwt-static/session/dynamic (" + claimClassifier.Name() + ") + x-jwt-sig"
+			if staticDictionaryEnabled {
+				format += " + x-jwt-static-sha"
+			}
+		}
+		if jwtDualWriteEnabled(ctx) {
+			format += " + authorization: Bearer"
+		}
+		return format
+	}
+	return "authorization: Bearer"
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// TestDebugTokenHandler checks that the debug mux shows the token of the
+// session named by the cookie, and the effective configuration
+func TestDebugTokenHandler(t *testing.T) {
+	keys, err := keyring.New(context.Background(), keyring.File("jwt_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring) { signingKeys = k }(signingKeys)
+	signingKeys = keys
+
+	mux := http.NewServeMux()
+	registerDebugTokenHandler(mux)
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/token", nil)
+	r.RemoteAddr = "10.0.0.7:4321"
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: "debug-token-session"})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/debug/token = %d %s", w.Code, w.Body)
+	}
+	var view debugTokenView
+	if err := json.NewDecoder(w.Body).Decode(&view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Claims["session_id"] != "debug-token-session" || view.FullSize == 0 || len(view.Downstream) != len(downstreamServices) {
+		t.Errorf("view = %+v", view)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+	var config struct {
+		Settings []knobValue `json:"settings"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&config); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("/debug/config = %d, %v", w.Code, err)
+	}
+	if len(config.Settings) != len(frontendKnobs) {
+		t.Errorf("/debug/config lists %d settings, want %d", len(config.Settings), len(frontendKnobs))
+	}
+}
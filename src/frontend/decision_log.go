@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/jwtcodec"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Decision log
+//
+// With JWT_DECISION_LOG_SAMPLE=N, one outgoing RPC in N records how its token
+// was sent: the mode and why, the codec, token and header sizes, session and
+// static block cache outcomes, the codecs the downstream advertised back and
+// the flags in force. Each record is logged as a structured "[JWT-DECISION]"
+// event and the latest are served on /debug/decisions, so the adaptive
+// controller and the rollout flags can be audited after the fact.
+
+const (
+	decisionModeCodec                 = "codec"
+	decisionModeSession               = "session"
+	decisionModeSplit                 = "split"
+	decisionModeAuthorization         = "authorization"
+	decisionModeAuthorizationFallback = "authorization_fallback"
+
+	decisionLogSize = 256
+)
+
+type jwtDecision struct {
+	Time         time.Time `json:"time"`
+	Method       string    `json:"method"`
+	Stream       bool      `json:"stream,omitempty"`
+	Mode         string    `json:"mode"`
+	Reason       string    `json:"reason"`
+	Codec        string    `json:"codec,omitempty"`
+	TokenBytes   int       `json:"token_bytes"`
+	HeaderBytes  int       `json:"header_bytes"`
+	SessionCache string    `json:"session_cache,omitempty"`
+	StaticBlock  string    `json:"static_block,omitempty"`
+	Negotiated   string    `json:"negotiated,omitempty"`
+	Compression  bool      `json:"compression"`
+	DualWrite    bool      `json:"dual_write"`
+	Code         string    `json:"code,omitempty"`
+	LatencyMS    float64   `json:"latency_ms,omitempty"`
+}
+
+type ctxKeyDecision struct{}
+
+var (
+	decisionSampleEvery = loadDecisionSampleEvery()
+	decisionCalls       atomic.Uint64
+	decisionLog         = &decisionRing{}
+)
+
+func loadDecisionSampleEvery() uint64 {
+	n, err := strconv.ParseUint(knobs.Value("JWT_DECISION_LOG_SAMPLE"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// sampleDecision starts a record for one call in decisionSampleEvery and
+// carries it in the returned context; the record is nil otherwise, and every
+// method of a nil record does nothing
+func sampleDecision(ctx context.Context, method string, stream bool, tokenBytes int) (context.Context, *jwtDecision) {
+	if decisionSampleEvery == 0 || decisionCalls.Add(1)%decisionSampleEvery != 0 {
+		return ctx, nil
+	}
+	d := &jwtDecision{Time: time.Now(), Method: method, Stream: stream, TokenBytes: tokenBytes}
+	return context.WithValue(ctx, ctxKeyDecision{}, d), d
+}
+
+func decisionFromContext(ctx context.Context) *jwtDecision {
+	d, _ := ctx.Value(ctxKeyDecision{}).(*jwtDecision)
+	return d
+}
+
+// choose records the split policy outcome
+func (d *jwtDecision) choose(compression bool, reason string) {
+	if d == nil {
+		return
+	}
+	d.Compression, d.Reason = compression, reason
+}
+
+// sent records the format the token left in
+func (d *jwtDecision) sent(ctx context.Context, mode string) {
+	if d == nil {
+		return
+	}
+	d.Mode = mode
+	d.DualWrite = jwtDualWriteEnabled(ctx)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if sha := md.Get("x-jwt-static-sha"); len(sha) > 0 {
+		d.StaticBlock = "referenced"
+		if len(md.Get("x-jwt-static")) > 0 {
+			d.StaticBlock = "sent"
+		}
+	}
+}
+
+// finish completes the record with the outcome of the call and publishes it
+func (d *jwtDecision) finish(ctx context.Context, header metadata.MD, err error) {
+	if d == nil {
+		return
+	}
+	d.HeaderBytes = outgoingHeaderBytes(ctx, d.Method)
+	d.Negotiated = strings.Join(header.Get(jwtcodec.AdvertiseHeader), ",")
+	d.Code = status.Code(err).String()
+	if !d.Stream {
+		d.LatencyMS = float64(time.Since(d.Time).Microseconds()) / 1000
+	}
+	decisionLog.add(*d)
+	loggerFromContext(ctx).WithFields(logrus.Fields{
+		"method":        d.Method,
+		"mode":          d.Mode,
+		"reason":        d.Reason,
+		"codec":         d.Codec,
+		"token_bytes":   d.TokenBytes,
+		"header_bytes":  d.HeaderBytes,
+		"session_cache": d.SessionCache,
+		"static_block":  d.StaticBlock,
+		"negotiated":    d.Negotiated,
+		"compression":   d.Compression,
+		"dual_write":    d.DualWrite,
+		"code":          d.Code,
+		"latency_ms":    d.LatencyMS,
+	}).Info("[JWT-DECISION]")
+}
+
+// decisionRing keeps the latest records for /debug/decisions
+type decisionRing struct {
+	mu      sync.Mutex
+	entries []jwtDecision
+	next    int
+}
+
+func (r *decisionRing) add(d jwtDecision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < decisionLogSize {
+		r.entries = append(r.entries, d)
+		return
+	}
+	r.entries[r.next] = d
+	r.next = (r.next + 1) % decisionLogSize
+}
+
+// snapshot returns the records oldest first
+func (r *decisionRing) snapshot() []jwtDecision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]jwtDecision, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+func (r *decisionRing) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.snapshot())
+}
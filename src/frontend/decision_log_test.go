@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestDecisionLogSampling(t *testing.T) {
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	defer func(n uint64, v int) { decisionSampleEvery, jwtSplitMinBytes = n, v }(decisionSampleEvery, jwtSplitMinBytes)
+	decisionSampleEvery, jwtSplitMinBytes = 2, 0
+	decisionCalls.Store(0)
+	decisionLog = &decisionRing{}
+
+	token := "eyJhbGciOiJIUzI1NiJ9.eyJhIjoieCJ9.c2ln"
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return nil
+	}
+	for _, method := range []string{"/hipstershop.CartService/GetCart", "/hipstershop.CartService/AddItem", "/hipstershop.CartService/EmptyCart", "/hipstershop.PaymentService/Charge"} {
+		if err := jwtUnaryClientInterceptor()(ctx, method, nil, nil, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	decisionLog.ServeHTTP(w, httptest.NewRequest("GET", "/debug/decisions", nil))
+	var got []jwtDecision
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("sampled %d of 4 calls, want 2: %+v", len(got), got)
+	}
+	if d := got[0]; d.Method != "/hipstershop.CartService/AddItem" || d.Mode != decisionModeSplit || d.Reason != splitDecisionSplit || !d.Compression || d.TokenBytes != len(token) || d.HeaderBytes == 0 || d.Code != "OK" {
+		t.Errorf("split call recorded as %+v", d)
+	}
+	if d := got[1]; d.Method != "/hipstershop.PaymentService/Charge" || d.Mode != decisionModeAuthorization || d.Reason != splitDecisionForcedAuthorization {
+		t.Errorf("forced authorization call recorded as %+v", d)
+	}
+}
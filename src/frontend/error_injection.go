@@ -18,23 +18,27 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // ErrorInjectionConfig holds configuration for error injection
 type ErrorInjectionConfig struct {
 	Enabled       bool
-	ErrorRate     float64 // 0.0 to 1.0 (0% to 100%)
-	ErrorType     string  // "unavailable", "timeout", "internal", "deadline_exceeded", "random"
-	TargetService string  // "CartService", "all", or comma-separated list
+	ErrorRate     float64       // 0.0 to 1.0 (0% to 100%)
+	ErrorType     string        // "unavailable", "timeout", "internal", "deadline_exceeded", "random"
+	TargetService string        // "CartService", "all", or comma-separated list
+	Claims        claimSelector // only requests whose token matches, see claim_selector.go
+	Pushback      time.Duration // retry delay asked for with Unavailable and ResourceExhausted errors
 }
 
 var (
@@ -64,8 +68,11 @@ func loadErrorInjectionConfig() *ErrorInjectionConfig {
 		TargetService: "CartService",
 	}
 
+	// Pushback also applies to the errors of chaos scenarios
+	config.Pushback, _ = time.ParseDuration(knobs.Value("ERROR_INJECTION_PUSHBACK"))
+
 	// Check if error injection is enabled
-	if os.Getenv("ENABLE_ERROR_INJECTION") == "true" {
+	if knobs.Value("ENABLE_ERROR_INJECTION") == "true" {
 		config.Enabled = true
 		errInjLog.Info("[ERROR-INJECTION] Error injection is ENABLED")
 	} else {
@@ -74,7 +81,7 @@ func loadErrorInjectionConfig() *ErrorInjectionConfig {
 	}
 
 	// Parse error rate (default 10% if not specified)
-	if rateStr := os.Getenv("ERROR_INJECTION_RATE"); rateStr != "" {
+	if rateStr := knobs.Value("ERROR_INJECTION_RATE"); rateStr != "" {
 		if rate, err := strconv.ParseFloat(rateStr, 64); err == nil {
 			if rate >= 0.0 && rate <= 1.0 {
 				config.ErrorRate = rate
@@ -91,24 +98,34 @@ func loadErrorInjectionConfig() *ErrorInjectionConfig {
 	}
 
 	// Parse error type
-	if errType := os.Getenv("ERROR_INJECTION_TYPE"); errType != "" {
+	if errType := knobs.Value("ERROR_INJECTION_TYPE"); errType != "" {
 		config.ErrorType = strings.ToLower(errType)
 	}
 
 	// Parse target service
-	if target := os.Getenv("ERROR_INJECTION_TARGET"); target != "" {
+	if target := knobs.Value("ERROR_INJECTION_TARGET"); target != "" {
 		config.TargetService = target
 	}
 
-	errInjLog.Infof("[ERROR-INJECTION] Configuration loaded - Rate: %.1f%%, Type: %s, Target: %s",
-		config.ErrorRate*100, config.ErrorType, config.TargetService)
+	// Parse claim selector; a broken one must not widen injection to everyone
+	selector, err := parseClaimSelector(knobs.Value("ERROR_INJECTION_CLAIMS"))
+	if err != nil {
+		errInjLog.Errorf("[ERROR-INJECTION] Invalid ERROR_INJECTION_CLAIMS, disabling error injection: %v", err)
+		config.Enabled = false
+		return config
+	}
+	config.Claims = selector
+
+	errInjLog.Infof("[ERROR-INJECTION] Configuration loaded - Rate: %.1f%%, Type: %s, Target: %s, Claims: %q",
+		config.ErrorRate*100, config.ErrorType, config.TargetService, config.Claims)
 
 	return config
 }
 
-// shouldInjectError determines if an error should be injected for this call
-func shouldInjectError(method string) bool {
-	if !errorInjectionConfig.Enabled {
+// shouldInjectError determines if an error should be injected for this call;
+// the error-injection flags can turn it on or off without a redeploy
+func shouldInjectError(ctx context.Context, method string) bool {
+	if !errorInjectionEnabled(ctx) {
 		return false
 	}
 
@@ -117,14 +134,22 @@ func shouldInjectError(method string) bool {
 		return false
 	}
 
+	// Check if the user token is targeted
+	if !errorInjectionConfig.Claims.MatchesContext(ctx) {
+		return false
+	}
+
 	// Random chance based on error rate
-	return randSource.Float64() < errorInjectionConfig.ErrorRate
+	return randSource.Float64() < errorInjectionRate(ctx)
 }
 
 // isTargetService checks if the method belongs to a targeted service
 func isTargetService(method string) bool {
-	target := errorInjectionConfig.TargetService
+	return matchesTarget(errorInjectionConfig.TargetService, method)
+}
 
+// matchesTarget checks if the method belongs to one of the services in target
+func matchesTarget(target, method string) bool {
 	// If target is "all", inject errors for all services
 	if target == "all" {
 		return true
@@ -142,10 +167,17 @@ func isTargetService(method string) bool {
 	return false
 }
 
-// getInjectedError returns the appropriate gRPC error based on configuration
-func getInjectedError(method string) error {
-	errorType := errorInjectionConfig.ErrorType
+// injectFault applies errorType to a call: the jwt_* types mark it for
+// corruption (see jwt_chaos.go) and the others fail it
+func injectFault(ctx context.Context, method, errorType string) (context.Context, error) {
+	if isJWTCorruption(errorType) {
+		return withJWTCorruption(ctx, errorType), nil
+	}
+	return ctx, injectedError(method, errorType)
+}
 
+// injectedError returns the gRPC error simulating errorType
+func injectedError(method, errorType string) error {
 	// If random error type, pick one randomly
 	if errorType == "random" {
 		errorTypes := []string{"unavailable", "timeout", "internal", "deadline_exceeded"}
@@ -164,6 +196,8 @@ func getInjectedError(method string) error {
 		err = status.Error(codes.Internal, "INJECTED_ERROR: simulated internal error (error injection)")
 	case "deadline_exceeded":
 		err = status.Error(codes.DeadlineExceeded, "INJECTED_ERROR: simulated deadline exceeded (error injection)")
+	case "resource_exhausted":
+		err = status.Error(codes.ResourceExhausted, "INJECTED_ERROR: simulated overload (error injection)")
 	case "connection_refused":
 		err = status.Error(codes.Unavailable, "INJECTED_ERROR: simulated connection refused (error injection)")
 	case "packet_loss":
@@ -186,9 +220,17 @@ func errorInjectionUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 		invoker grpc.UnaryInvoker,
 		opts ...grpc.CallOption,
 	) error {
+		// Scenario phases apply on top of the static configuration
+		ctx, err := chaosFault(ctx, method)
+		if err != nil {
+			return withPushback(err, opts)
+		}
+
 		// Check if we should inject an error
-		if shouldInjectError(method) {
-			return getInjectedError(method)
+		if shouldInjectError(ctx, method) {
+			if ctx, err = injectFault(ctx, method, errorInjectionConfig.ErrorType); err != nil {
+				return withPushback(err, opts)
+			}
 		}
 
 		// No error injection, proceed normally
@@ -196,6 +238,29 @@ func errorInjectionUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 	}
 }
 
+// withPushback makes an injected Unavailable or ResourceExhausted error ask
+// for ERROR_INJECTION_PUSHBACK before a retry, the way an overloaded server
+// would: as a RetryInfo detail and as the grpc-retry-pushback-ms trailer
+func withPushback(err error, opts []grpc.CallOption) error {
+	if errorInjectionConfig == nil || errorInjectionConfig.Pushback <= 0 {
+		return err
+	}
+	st := status.Convert(err)
+	if c := st.Code(); c != codes.Unavailable && c != codes.ResourceExhausted {
+		return err
+	}
+	pushback := errorInjectionConfig.Pushback
+	if detailed, derr := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(pushback)}); derr == nil {
+		st = detailed
+	}
+	for _, o := range opts {
+		if t, ok := o.(grpc.TrailerCallOption); ok {
+			*t.TrailerAddr = metadata.Pairs("grpc-retry-pushback-ms", strconv.FormatInt(pushback.Milliseconds(), 10))
+		}
+	}
+	return st.Err()
+}
+
 // errorInjectionStreamClientInterceptor injects errors into streaming gRPC calls
 func errorInjectionStreamClientInterceptor() grpc.StreamClientInterceptor {
 	return func(
@@ -206,9 +271,17 @@ func errorInjectionStreamClientInterceptor() grpc.StreamClientInterceptor {
 		streamer grpc.Streamer,
 		opts ...grpc.CallOption,
 	) (grpc.ClientStream, error) {
+		// Scenario phases apply on top of the static configuration
+		ctx, err := chaosFault(ctx, method)
+		if err != nil {
+			return nil, err
+		}
+
 		// Check if we should inject an error
-		if shouldInjectError(method) {
-			return nil, getInjectedError(method)
+		if shouldInjectError(ctx, method) {
+			if ctx, err = injectFault(ctx, method, errorInjectionConfig.ErrorType); err != nil {
+				return nil, err
+			}
 		}
 
 		// No error injection, proceed normally
@@ -223,5 +296,7 @@ func GetErrorInjectionStats() map[string]interface{} {
 		"error_rate":     errorInjectionConfig.ErrorRate,
 		"error_type":     errorInjectionConfig.ErrorType,
 		"target_service": errorInjectionConfig.TargetService,
+		"claims":         errorInjectionConfig.Claims.String(),
+		"pushback":       errorInjectionConfig.Pushback.String(),
 	}
 }
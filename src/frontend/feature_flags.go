@@ -0,0 +1,267 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/open-feature/go-sdk/openfeature"
+)
+
+// Flag keys. Every flag falls back to its environment variable when no
+// provider is configured or the provider can't answer.
+const (
+	flagJWTCompression     = "jwt-compression"      // ENABLE_JWT_COMPRESSION
+	flagJWTDualWrite       = "jwt-dual-write"       // JWT_DUAL_WRITE
+	flagErrorInjection     = "error-injection"      // ENABLE_ERROR_INJECTION
+	flagErrorInjectionRate = "error-injection-rate" // ERROR_INJECTION_RATE
+	flagPagePrefetch       = "page-prefetch"        // PAGE_PREFETCH
+)
+
+var featureFlags = openfeature.NewClient("frontend")
+
+// initFeatureFlags registers the OFREP provider when OFREP_ENDPOINT is set;
+// otherwise the SDK's no-op provider returns the env defaults
+func initFeatureFlags() {
+	endpoint := knobs.Value("OFREP_ENDPOINT")
+	if endpoint == "" {
+		log.Info("[FLAGS] No OFREP_ENDPOINT, feature flags come from the environment")
+		return
+	}
+	if err := openfeature.SetProvider(newOFREPProvider(endpoint)); err != nil {
+		log.Warnf("[FLAGS] Failed to register OFREP provider, using environment: %v", err)
+		return
+	}
+	log.Infof("[FLAGS] Evaluating feature flags against %s", endpoint)
+}
+
+// flagEvalContext targets flags per environment and tenant (market)
+func flagEvalContext(ctx context.Context) openfeature.EvaluationContext {
+	attrs := map[string]interface{}{
+		"service":     "frontend",
+		"environment": knobs.Value("ENV_PLATFORM"),
+	}
+	if claims, ok := getJWTFromContext(ctx); ok && claims != nil {
+		attrs["tenant"] = claims.MarketID
+	}
+	return openfeature.NewTargetlessEvaluationContext(attrs)
+}
+
+// jwtCompressionEnabled decides whether outgoing calls carry the split headers
+func jwtCompressionEnabled(ctx context.Context) bool {
+	v, _ := featureFlags.BooleanValue(ctx, flagJWTCompression, IsJWTCompressionEnabled(), flagEvalContext(ctx))
+	return v
+}
+
+// pagePrefetchEnabled decides whether pages fetch their data in parallel,
+// see prefetch.go
+func pagePrefetchEnabled(ctx context.Context) bool {
+	v, _ := featureFlags.BooleanValue(ctx, flagPagePrefetch, knobs.Value("PAGE_PREFETCH") == "true", flagEvalContext(ctx))
+	return v
+}
+
+// jwtDualWriteEnabled decides whether split headers are accompanied by the
+// full authorization header, so receivers can be migrated one at a time
+func jwtDualWriteEnabled(ctx context.Context) bool {
+	v, _ := featureFlags.BooleanValue(ctx, flagJWTDualWrite, knobs.Value("JWT_DUAL_WRITE") == "true", flagEvalContext(ctx))
+	return v
+}
+
+// errorInjectionEnabled and errorInjectionRate override the static error
+// injection config loaded at startup
+func errorInjectionEnabled(ctx context.Context) bool {
+	v, _ := featureFlags.BooleanValue(ctx, flagErrorInjection, errorInjectionConfig.Enabled, flagEvalContext(ctx))
+	return v
+}
+
+func errorInjectionRate(ctx context.Context) float64 {
+	v, _ := featureFlags.FloatValue(ctx, flagErrorInjectionRate, errorInjectionConfig.ErrorRate, flagEvalContext(ctx))
+	if v < 0 || v > 1 {
+		return errorInjectionConfig.ErrorRate
+	}
+	return v
+}
+
+// ofrepCacheTTL bounds how long an evaluation is reused; flags are read on
+// every RPC so they can't each cost an HTTP round trip
+var ofrepCacheTTL = 10 * time.Second
+
+// ofrepProvider evaluates flags over the OpenFeature Remote Evaluation
+// Protocol (POST /ofrep/v1/evaluate/flags/{key}), which flagd and most flag
+// services expose
+type ofrepProvider struct {
+	endpoint string
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]ofrepCacheEntry
+}
+
+type ofrepCacheEntry struct {
+	result  ofrepResult
+	expires time.Time
+}
+
+type ofrepResult struct {
+	Value        interface{} `json:"value"`
+	Variant      string      `json:"variant"`
+	Reason       string      `json:"reason"`
+	ErrorCode    string      `json:"errorCode"`
+	ErrorDetails string      `json:"errorDetails"`
+}
+
+func newOFREPProvider(endpoint string) *ofrepProvider {
+	return &ofrepProvider{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 500 * time.Millisecond},
+		cache:    make(map[string]ofrepCacheEntry),
+	}
+}
+
+func (p *ofrepProvider) Metadata() openfeature.Metadata {
+	return openfeature.Metadata{Name: "ofrep"}
+}
+
+func (p *ofrepProvider) Hooks() []openfeature.Hook { return nil }
+
+// evaluate fetches a flag, serving it from cache while fresh
+func (p *ofrepProvider) evaluate(ctx context.Context, flag string, evalCtx openfeature.FlattenedContext) (ofrepResult, bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"context": evalCtx})
+	if err != nil {
+		return ofrepResult{}, false, err
+	}
+	key := flag + "|" + string(body)
+
+	p.mu.Lock()
+	entry, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.result, true, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		p.endpoint+"/ofrep/v1/evaluate/flags/"+url.PathEscape(flag), bytes.NewReader(body))
+	if err != nil {
+		return ofrepResult{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return ofrepResult{}, false, err
+	}
+	defer resp.Body.Close()
+
+	var result ofrepResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ofrepResult{}, false, fmt.Errorf("failed to decode OFREP response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result, false, fmt.Errorf("OFREP %s: %s %s", resp.Status, result.ErrorCode, result.ErrorDetails)
+	}
+
+	p.mu.Lock()
+	p.cache[key] = ofrepCacheEntry{result: result, expires: time.Now().Add(ofrepCacheTTL)}
+	p.mu.Unlock()
+	return result, false, nil
+}
+
+// resolve evaluates a flag and maps transport and protocol errors onto
+// OpenFeature resolution errors; callers fall back to their default
+func (p *ofrepProvider) resolve(ctx context.Context, flag string, evalCtx openfeature.FlattenedContext) (interface{}, openfeature.ProviderResolutionDetail, bool) {
+	result, cached, err := p.evaluate(ctx, flag, evalCtx)
+	if err != nil {
+		resErr := openfeature.NewGeneralResolutionError(err.Error())
+		if result.ErrorCode == string(openfeature.FlagNotFoundCode) {
+			resErr = openfeature.NewFlagNotFoundResolutionError(result.ErrorDetails)
+		}
+		return nil, openfeature.ProviderResolutionDetail{ResolutionError: resErr, Reason: openfeature.ErrorReason}, false
+	}
+	reason := openfeature.Reason(result.Reason)
+	if cached {
+		reason = openfeature.CachedReason
+	}
+	return result.Value, openfeature.ProviderResolutionDetail{Reason: reason, Variant: result.Variant}, true
+}
+
+func typeMismatch(flag string, value interface{}) openfeature.ProviderResolutionDetail {
+	return openfeature.ProviderResolutionDetail{
+		ResolutionError: openfeature.NewTypeMismatchResolutionError(fmt.Sprintf("flag %s has type %T", flag, value)),
+		Reason:          openfeature.ErrorReason,
+	}
+}
+
+func (p *ofrepProvider) BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, evalCtx openfeature.FlattenedContext) openfeature.BoolResolutionDetail {
+	value, detail, ok := p.resolve(ctx, flag, evalCtx)
+	if !ok {
+		return openfeature.BoolResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	v, ok := value.(bool)
+	if !ok {
+		return openfeature.BoolResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag, value)}
+	}
+	return openfeature.BoolResolutionDetail{Value: v, ProviderResolutionDetail: detail}
+}
+
+func (p *ofrepProvider) StringEvaluation(ctx context.Context, flag string, defaultValue string, evalCtx openfeature.FlattenedContext) openfeature.StringResolutionDetail {
+	value, detail, ok := p.resolve(ctx, flag, evalCtx)
+	if !ok {
+		return openfeature.StringResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	v, ok := value.(string)
+	if !ok {
+		return openfeature.StringResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag, value)}
+	}
+	return openfeature.StringResolutionDetail{Value: v, ProviderResolutionDetail: detail}
+}
+
+func (p *ofrepProvider) FloatEvaluation(ctx context.Context, flag string, defaultValue float64, evalCtx openfeature.FlattenedContext) openfeature.FloatResolutionDetail {
+	value, detail, ok := p.resolve(ctx, flag, evalCtx)
+	if !ok {
+		return openfeature.FloatResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	v, ok := value.(float64)
+	if !ok {
+		return openfeature.FloatResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag, value)}
+	}
+	return openfeature.FloatResolutionDetail{Value: v, ProviderResolutionDetail: detail}
+}
+
+func (p *ofrepProvider) IntEvaluation(ctx context.Context, flag string, defaultValue int64, evalCtx openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	value, detail, ok := p.resolve(ctx, flag, evalCtx)
+	if !ok {
+		return openfeature.IntResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	// JSON numbers decode as float64
+	v, ok := value.(float64)
+	if !ok || v != float64(int64(v)) {
+		return openfeature.IntResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag, value)}
+	}
+	return openfeature.IntResolutionDetail{Value: int64(v), ProviderResolutionDetail: detail}
+}
+
+func (p *ofrepProvider) ObjectEvaluation(ctx context.Context, flag string, defaultValue interface{}, evalCtx openfeature.FlattenedContext) openfeature.InterfaceResolutionDetail {
+	value, detail, ok := p.resolve(ctx, flag, evalCtx)
+	if !ok {
+		return openfeature.InterfaceResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	return openfeature.InterfaceResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
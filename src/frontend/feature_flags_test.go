@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/open-feature/go-sdk/openfeature"
+)
+
+func TestOFREPProvider(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var body struct {
+			Context map[string]interface{} `json:"context"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/ofrep/v1/evaluate/flags/" + flagJWTCompression:
+			// compression only for the EU tenant
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"value": body.Context["tenant"] == "EU", "reason": "TARGETING_MATCH",
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"errorCode": "FLAG_NOT_FOUND"})
+		}
+	}))
+	defer srv.Close()
+
+	p := newOFREPProvider(srv.URL)
+	ctx := context.Background()
+
+	eu := openfeature.FlattenedContext{"tenant": "EU"}
+	if got := p.BooleanEvaluation(ctx, flagJWTCompression, false, eu); !got.Value || got.Reason != openfeature.TargetingMatchReason {
+		t.Errorf("EU tenant: got %+v, want true via targeting", got)
+	}
+	if got := p.BooleanEvaluation(ctx, flagJWTCompression, false, eu); !got.Value || got.Reason != openfeature.CachedReason {
+		t.Errorf("EU tenant (repeat): got %+v, want cached true", got)
+	}
+	if calls != 1 {
+		t.Errorf("provider made %d requests, want 1 (second evaluation cached)", calls)
+	}
+	if got := p.BooleanEvaluation(ctx, flagJWTCompression, true, openfeature.FlattenedContext{"tenant": "US"}); got.Value {
+		t.Errorf("US tenant: got %+v, want false", got)
+	}
+
+	// Unknown flags and type mismatches fall back to the env default
+	if got := p.BooleanEvaluation(ctx, flagJWTDualWrite, true, eu); !got.Value || got.Reason != openfeature.ErrorReason {
+		t.Errorf("missing flag: got %+v, want default with error", got)
+	}
+	if got := p.FloatEvaluation(ctx, flagJWTCompression, 0.25, eu); got.Value != 0.25 {
+		t.Errorf("type mismatch: got %v, want default 0.25", got.Value)
+	}
+}
+
+func TestOFREPProviderUnreachable(t *testing.T) {
+	p := newOFREPProvider("http://127.0.0.1:1")
+	got := p.BooleanEvaluation(context.Background(), flagJWTCompression, true, openfeature.FlattenedContext{})
+	if !got.Value || got.Reason != openfeature.ErrorReason {
+		t.Errorf("got %+v, want env default with error reason", got)
+	}
+}
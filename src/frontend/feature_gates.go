@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Feature gates
+//
+// FEATURE_GATES turns parts of the UI on for the sessions whose verified
+// claims match a claim selector (claim_selector.go). Gates are name:selector
+// pairs separated by semicolons:
+//
+//	admin_banner:roles contains admin;beta_checkout:custom_claims.beta=true
+//
+// Pages get the gates open for the session as .features, and templates test
+// them with {{ if .features.On "admin_banner" }}. Sessions whose token did
+// not verify see no gated feature, whatever their token claims.
+
+type featureGate struct {
+	name     string
+	selector claimSelector
+}
+
+var validGateName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// featureGates is FEATURE_GATES; an invalid value opens no gate, config
+// validation reports it
+var featureGates, featureGatesErr = parseFeatureGates(knobs.Value("FEATURE_GATES"))
+
+func parseFeatureGates(s string) ([]featureGate, error) {
+	var gates []featureGate
+	seen := make(map[string]bool)
+	for _, raw := range strings.Split(s, ";") {
+		entry := strings.TrimSpace(raw)
+		if entry == "" {
+			continue
+		}
+		name, sel, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || !validGateName.MatchString(name) {
+			return nil, fmt.Errorf("feature gate %q is not name:selector with a lower case name", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("feature gate %q is declared twice", name)
+		}
+		seen[name] = true
+		selector, err := parseClaimSelector(sel)
+		if err != nil {
+			return nil, fmt.Errorf("feature gate %s: %v", name, err)
+		}
+		gates = append(gates, featureGate{name: name, selector: selector})
+	}
+	return gates, nil
+}
+
+// featureSet holds the gates open for one session
+type featureSet map[string]bool
+
+// On reports whether gate name is open; unknown gates are closed
+func (f featureSet) On(name string) bool {
+	return f[name]
+}
+
+// featuresFor returns the gates open for the session of ctx
+func featuresFor(ctx context.Context) featureSet {
+	if featureGatesErr != nil || len(featureGates) == 0 {
+		return nil
+	}
+	if claims, _ := getJWTFromContext(ctx); claims == nil {
+		return nil
+	}
+	token, _ := ctx.Value(ctxKeyJWTToken{}).(string)
+	components, err := decomposeJWTFor(ctx, token)
+	if err != nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(components.Payload), &claims); err != nil {
+		return nil
+	}
+	open := make(featureSet)
+	for _, g := range featureGates {
+		if g.selector.Matches(claims) {
+			open[g.name] = true
+		}
+	}
+	return open
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestFeatureGates(t *testing.T) {
+	gates, err := parseFeatureGates("admin_banner:roles contains admin; beta_checkout:custom_claims.beta=true;everyone:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(g []featureGate) { featureGates = g }(featureGates)
+	featureGates = gates
+
+	payload := `{"roles":["user","admin"],"custom_claims":{"beta":false}}`
+	token := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+
+	if f := featuresFor(ctx); f.On("admin_banner") {
+		t.Error("gate opened for a session whose token was not verified")
+	}
+	ctx = context.WithValue(ctx, ctxKeyJWT{}, &JWTClaims{})
+	f := featuresFor(ctx)
+	if !f.On("admin_banner") || f.On("beta_checkout") || !f.On("everyone") || f.On("unknown") {
+		t.Errorf("features = %v, want admin_banner and everyone", f)
+	}
+
+	var buf bytes.Buffer
+	data := map[string]interface{}{"baseUrl": "", "features": f}
+	if err := templates.ExecuteTemplate(&buf, "header", data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("admin-banner")) {
+		t.Error("header did not render the admin banner")
+	}
+
+	for _, bad := range []string{"admin_banner", "Admin:roles contains admin", "a:x;a:y", "a:roles"} {
+		if _, err := parseFeatureGates(bad); err == nil {
+			t.Errorf("parseFeatureGates(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWT flow graph
+//
+// /debug/jwtflow folds the client side of the gRPC wire statistics into a
+// service graph: one node per service, one edge per caller, callee and JWT
+// mode, annotated with the calls and the average header bytes. The frontend
+// contributes its own calls; JWT_FLOW_PEERS adds the calls of other services
+// from their /debug/grpcstats, so checkout to shipping shows up as well. The
+// graph is served as JSON, as DOT with ?format=dot, and drawn on
+// /debug/jwtflow/view for demos.
+
+const (
+	flowGraphSelf        = "frontend"
+	flowGraphPeerTimeout = 2 * time.Second
+)
+
+// flowPeer is a service whose wire statistics are merged into the graph
+type flowPeer struct {
+	Name string
+	URL  string
+}
+
+// flowEdge is the traffic from one service to another in one JWT mode
+type flowEdge struct {
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	Mode           string  `json:"mode"`
+	Calls          int64   `json:"calls"`
+	Errors         int64   `json:"errors"`
+	AvgHeaderBytes float64 `json:"avg_header_bytes"`
+	AvgJWTBytes    float64 `json:"avg_jwt_bytes"`
+
+	headerBytes, jwtBytes int64
+}
+
+type flowGraph struct {
+	Nodes []string          `json:"nodes"`
+	Edges []flowEdge        `json:"edges"`
+	Peers map[string]string `json:"peer_errors,omitempty"`
+}
+
+var (
+	flowPeers, flowPeersErr = parseFlowPeers(knobs.Value("JWT_FLOW_PEERS"))
+	jwtFlow                 = &flowGraphHandler{peers: flowPeers, client: &http.Client{Timeout: flowGraphPeerTimeout}}
+)
+
+// parseFlowPeers reads a list of name=url entries
+func parseFlowPeers(v string) ([]flowPeer, error) {
+	var peers []flowPeer
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, u, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not name=url", entry)
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("%q must be an http(s) URL", u)
+		}
+		peers = append(peers, flowPeer{Name: name, URL: u})
+	}
+	return peers, nil
+}
+
+// flowNode names the service of a full gRPC method the way the services name
+// themselves: /hipstershop.CheckoutService/PlaceOrder is checkoutservice
+func flowNode(method string) string {
+	svc := serviceFromMethod(method)
+	if i := strings.LastIndex(svc, "."); i >= 0 {
+		svc = svc[i+1:]
+	}
+	return strings.ToLower(svc)
+}
+
+// buildFlowGraph turns the wire statistics of each service into the graph
+func buildFlowGraph(sources map[string][]rpcWireStats) flowGraph {
+	nodes := make(map[string]bool)
+	edges := make(map[[3]string]*flowEdge)
+	for from, stats := range sources {
+		nodes[from] = true
+		for _, s := range stats {
+			if s.Side != "client" || s.JWTMode == jwtModeNone || s.Calls == 0 {
+				continue
+			}
+			to := flowNode(s.Method)
+			nodes[to] = true
+			key := [3]string{from, to, s.JWTMode}
+			e, ok := edges[key]
+			if !ok {
+				e = &flowEdge{From: from, To: to, Mode: s.JWTMode}
+				edges[key] = e
+			}
+			e.Calls += s.Calls
+			e.Errors += s.Errors
+			e.headerBytes += s.MetadataBytes
+			e.jwtBytes += s.JWTMetadataBytes
+		}
+	}
+
+	g := flowGraph{Nodes: make([]string, 0, len(nodes)), Edges: make([]flowEdge, 0, len(edges))}
+	for n := range nodes {
+		g.Nodes = append(g.Nodes, n)
+	}
+	sort.Strings(g.Nodes)
+	for _, e := range edges {
+		e.AvgHeaderBytes = math.Round(float64(e.headerBytes)/float64(e.Calls)*10) / 10
+		e.AvgJWTBytes = math.Round(float64(e.jwtBytes)/float64(e.Calls)*10) / 10
+		g.Edges = append(g.Edges, *e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Mode < b.Mode
+	})
+	return g
+}
+
+// dot renders the graph for Graphviz
+func (g flowGraph) dot(w io.Writer) {
+	fmt.Fprintln(w, "digraph jwtflow {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "  %q;\n", n)
+	}
+	for _, e := range g.Edges {
+		style := "solid"
+		if e.Mode == jwtModeFull {
+			style = "dashed"
+		}
+		fmt.Fprintf(w, "  %q -> %q [label=%q, style=%s];\n",
+			e.From, e.To, fmt.Sprintf("%s\n%d calls, %.0f B", e.Mode, e.Calls, e.AvgHeaderBytes), style)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// flowGraphHandler serves the graph of this process and its peers
+type flowGraphHandler struct {
+	peers  []flowPeer
+	client *http.Client
+}
+
+// collect gathers the wire statistics of this process and, concurrently, of
+// every peer; a peer that can't be reached is reported and left out
+func (h *flowGraphHandler) collect() flowGraph {
+	sources := map[string][]rpcWireStats{flowGraphSelf: wireStats.Snapshot()}
+	peerErrors := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range h.peers {
+		wg.Add(1)
+		go func(p flowPeer) {
+			defer wg.Done()
+			stats, err := h.fetch(p.URL)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				peerErrors[p.Name] = err.Error()
+				return
+			}
+			sources[p.Name] = stats
+		}(p)
+	}
+	wg.Wait()
+
+	g := buildFlowGraph(sources)
+	if len(peerErrors) > 0 {
+		g.Peers = peerErrors
+	}
+	return g
+}
+
+func (h *flowGraphHandler) fetch(u string) ([]rpcWireStats, error) {
+	resp, err := h.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var stats []rpcWireStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (h *flowGraphHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g := h.collect()
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		g.dot(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(g); err != nil {
+		log.Warnf("failed to encode jwt flow graph: %v", err)
+	}
+}
+
+// flowView positions the nodes of a graph on a circle for the SVG view
+type flowView struct {
+	flowGraph
+	Pos map[string][2]float64
+}
+
+const flowViewSize = 560
+
+// view serves the graph drawn as SVG, refreshed every few seconds
+func (h *flowGraphHandler) view(w http.ResponseWriter, _ *http.Request) {
+	g := h.collect()
+	v := flowView{flowGraph: g, Pos: make(map[string][2]float64, len(g.Nodes))}
+	c, radius := flowViewSize/2.0, flowViewSize/2.0-60
+	for i, n := range g.Nodes {
+		a := 2 * math.Pi * float64(i) / float64(len(g.Nodes))
+		v.Pos[n] = [2]float64{c + radius*math.Cos(a), c + radius*math.Sin(a)}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := flowViewTemplate.Execute(w, v); err != nil {
+		log.Warnf("failed to render jwt flow graph: %v", err)
+	}
+}
+
+var flowViewTemplate = template.Must(template.New("jwtflow").Funcs(template.FuncMap{
+	"x":   func(p [2]float64) float64 { return p[0] },
+	"y":   func(p [2]float64) float64 { return p[1] },
+	"mid": func(a, b float64) float64 { return (a + b) / 2 },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="5"><title>JWT flow</title>
+<style>body{font-family:sans-serif} td,th{padding:2px 8px;text-align:left} .full{stroke-dasharray:6 4}</style>
+</head><body>
+<h1>JWT flow</h1>
+<svg width="560" height="560" viewBox="0 0 560 560">
+<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto"><path d="M0,0 L10,5 L0,10 z"/></marker></defs>
+{{range .Edges}}{{$a := index $.Pos .From}}{{$b := index $.Pos .To}}
+<line x1="{{x $a}}" y1="{{y $a}}" x2="{{x $b}}" y2="{{y $b}}" stroke="#555" marker-end="url(#arrow)"{{if eq .Mode "full"}} class="full"{{end}}/>
+<text x="{{mid (x $a) (x $b)}}" y="{{mid (y $a) (y $b)}}" font-size="11">{{.Mode}} {{printf "%.0f" .AvgHeaderBytes}} B</text>
+{{end}}
+{{range .Nodes}}{{$p := index $.Pos .}}
+<circle cx="{{x $p}}" cy="{{y $p}}" r="6" fill="#1f6feb"/>
+<text x="{{x $p}}" y="{{y $p}}" dy="-10" text-anchor="middle" font-weight="bold">{{.}}</text>
+{{end}}
+</svg>
+<table><tr><th>from</th><th>to</th><th>mode</th><th>calls</th><th>errors</th><th>avg header bytes</th><th>avg JWT bytes</th></tr>
+{{range .Edges}}<tr><td>{{.From}}</td><td>{{.To}}</td><td>{{.Mode}}</td><td>{{.Calls}}</td><td>{{.Errors}}</td><td>{{printf "%.1f" .AvgHeaderBytes}}</td><td>{{printf "%.1f" .AvgJWTBytes}}</td></tr>
+{{end}}</table>
+{{range $name, $err := .Peers}}<p>{{$name}} unreachable: {{$err}}</p>{{end}}
+<p><a href="../jwtflow?format=dot">DOT</a> · <a href="../jwtflow">JSON</a></p>
+</body></html>
+`))
@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildFlowGraph(t *testing.T) {
+	g := buildFlowGraph(map[string][]rpcWireStats{
+		"frontend": {
+			{Side: "client", Method: "/hipstershop.CheckoutService/PlaceOrder", JWTMode: jwtModeCompressed, Calls: 2, MetadataBytes: 900, JWTMetadataBytes: 700},
+			{Side: "client", Method: "/hipstershop.CartService/GetCart", JWTMode: jwtModeFull, Calls: 1, MetadataBytes: 1200, JWTMetadataBytes: 1100},
+			{Side: "client", Method: "/hipstershop.CartService/AddItem", JWTMode: jwtModeFull, Calls: 3, MetadataBytes: 3600, JWTMetadataBytes: 3300},
+			{Side: "client", Method: "/hipstershop.AdService/GetAds", JWTMode: jwtModeNone, Calls: 5},
+		},
+		"checkoutservice": {
+			{Side: "server", Method: "/hipstershop.CheckoutService/PlaceOrder", JWTMode: jwtModeCompressed, Calls: 2},
+			{Side: "client", Method: "/hipstershop.ShippingService/ShipOrder", JWTMode: jwtModeCompressed, Calls: 2, Errors: 1, MetadataBytes: 1000, JWTMetadataBytes: 800},
+		},
+	})
+
+	if want := "cartservice,checkoutservice,frontend,shippingservice"; strings.Join(g.Nodes, ",") != want {
+		t.Errorf("nodes = %v, want %s", g.Nodes, want)
+	}
+	want := []flowEdge{
+		{From: "checkoutservice", To: "shippingservice", Mode: jwtModeCompressed, Calls: 2, Errors: 1, AvgHeaderBytes: 500, AvgJWTBytes: 400},
+		{From: "frontend", To: "cartservice", Mode: jwtModeFull, Calls: 4, AvgHeaderBytes: 1200, AvgJWTBytes: 1100},
+		{From: "frontend", To: "checkoutservice", Mode: jwtModeCompressed, Calls: 2, AvgHeaderBytes: 450, AvgJWTBytes: 350},
+	}
+	if len(g.Edges) != len(want) {
+		t.Fatalf("edges = %+v", g.Edges)
+	}
+	for i, e := range g.Edges {
+		e.headerBytes, e.jwtBytes = 0, 0
+		if e != want[i] {
+			t.Errorf("edge %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	var dot strings.Builder
+	g.dot(&dot)
+	if !strings.Contains(dot.String(), `"frontend" -> "cartservice" [label="full\n4 calls, 1200 B", style=dashed];`) {
+		t.Errorf("dot = %s", dot.String())
+	}
+}
+
+func TestFlowGraphPeers(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode([]rpcWireStats{
+			{Side: "client", Method: "/hipstershop.ShippingService/GetQuote", JWTMode: jwtModeCompressed, Calls: 1, MetadataBytes: 300},
+		})
+	}))
+	defer peer.Close()
+
+	peers, err := parseFlowPeers("checkoutservice=" + peer.URL + ", shippingservice=http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &flowGraphHandler{peers: peers, client: peer.Client()}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/jwtflow", nil))
+
+	var g flowGraph
+	if err := json.NewDecoder(rec.Body).Decode(&g); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range g.Edges {
+		found = found || e.From == "checkoutservice" && e.To == "shippingservice"
+	}
+	if !found {
+		t.Errorf("edges = %+v, want checkoutservice -> shippingservice", g.Edges)
+	}
+	if g.Peers["shippingservice"] == "" {
+		t.Errorf("peer errors = %v, want shippingservice unreachable", g.Peers)
+	}
+
+	rec = httptest.NewRecorder()
+	h.view(rec, httptest.NewRequest(http.MethodGet, "/debug/jwtflow/view", nil))
+	if !strings.Contains(rec.Body.String(), "<svg") || !strings.Contains(rec.Body.String(), "shippingservice") {
+		t.Errorf("view = %s", rec.Body.String())
+	}
+}
+
+func TestParseFlowPeers(t *testing.T) {
+	for _, v := range []string{"checkout", "=http://x", "checkout=ftp://x"} {
+		if _, err := parseFlowPeers(v); err == nil {
+			t.Errorf("parseFlowPeers(%q) succeeded", v)
+		}
+	}
+}
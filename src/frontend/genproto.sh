@@ -20,6 +20,9 @@ PATH=$PATH:$(go env GOPATH)/bin
 protodir=../../protos
 outdir=./genproto
 
-protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative $protodir/demo.proto
+protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative --authpolicy_out=./$outdir --authpolicy_opt=paths=source_relative $protodir/auth_options.proto $protodir/demo.proto
+# No auth table for orderhistory.proto: it would clash with demo.proto's, and
+# its methods fall back to requiring the user token
+protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative $protodir/orderhistory.proto
 
 # [END gke_frontend_genproto]
\ No newline at end of file
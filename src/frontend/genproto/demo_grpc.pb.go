@@ -975,7 +975,8 @@ var EmailService_ServiceDesc = grpc.ServiceDesc{
 }
 
 const (
-	CheckoutService_PlaceOrder_FullMethodName = "/hipstershop.CheckoutService/PlaceOrder"
+	CheckoutService_PlaceOrder_FullMethodName        = "/hipstershop.CheckoutService/PlaceOrder"
+	CheckoutService_StreamOrderStatus_FullMethodName = "/hipstershop.CheckoutService/StreamOrderStatus"
 )
 
 // CheckoutServiceClient is the client API for CheckoutService service.
@@ -983,6 +984,10 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CheckoutServiceClient interface {
 	PlaceOrder(ctx context.Context, in *PlaceOrderRequest, opts ...grpc.CallOption) (*PlaceOrderResponse, error)
+	// Streams status changes of the caller's orders. The stream is bound to
+	// the token it was opened with and ends with UNAUTHENTICATED when that
+	// token expires; reopen it with a fresh token.
+	StreamOrderStatus(ctx context.Context, in *StreamOrderStatusRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[OrderStatusUpdate], error)
 }
 
 type checkoutServiceClient struct {
@@ -1003,11 +1008,34 @@ func (c *checkoutServiceClient) PlaceOrder(ctx context.Context, in *PlaceOrderRe
 	return out, nil
 }
 
+func (c *checkoutServiceClient) StreamOrderStatus(ctx context.Context, in *StreamOrderStatusRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[OrderStatusUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &CheckoutService_ServiceDesc.Streams[0], CheckoutService_StreamOrderStatus_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamOrderStatusRequest, OrderStatusUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type CheckoutService_StreamOrderStatusClient = grpc.ServerStreamingClient[OrderStatusUpdate]
+
 // CheckoutServiceServer is the server API for CheckoutService service.
 // All implementations must embed UnimplementedCheckoutServiceServer
 // for forward compatibility.
 type CheckoutServiceServer interface {
 	PlaceOrder(context.Context, *PlaceOrderRequest) (*PlaceOrderResponse, error)
+	// Streams status changes of the caller's orders. The stream is bound to
+	// the token it was opened with and ends with UNAUTHENTICATED when that
+	// token expires; reopen it with a fresh token.
+	StreamOrderStatus(*StreamOrderStatusRequest, grpc.ServerStreamingServer[OrderStatusUpdate]) error
 	mustEmbedUnimplementedCheckoutServiceServer()
 }
 
@@ -1021,6 +1049,9 @@ type UnimplementedCheckoutServiceServer struct{}
 func (UnimplementedCheckoutServiceServer) PlaceOrder(context.Context, *PlaceOrderRequest) (*PlaceOrderResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PlaceOrder not implemented")
 }
+func (UnimplementedCheckoutServiceServer) StreamOrderStatus(*StreamOrderStatusRequest, grpc.ServerStreamingServer[OrderStatusUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamOrderStatus not implemented")
+}
 func (UnimplementedCheckoutServiceServer) mustEmbedUnimplementedCheckoutServiceServer() {}
 func (UnimplementedCheckoutServiceServer) testEmbeddedByValue()                         {}
 
@@ -1060,6 +1091,17 @@ func _CheckoutService_PlaceOrder_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CheckoutService_StreamOrderStatus_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamOrderStatusRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CheckoutServiceServer).StreamOrderStatus(m, &grpc.GenericServerStream[StreamOrderStatusRequest, OrderStatusUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type CheckoutService_StreamOrderStatusServer = grpc.ServerStreamingServer[OrderStatusUpdate]
+
 // CheckoutService_ServiceDesc is the grpc.ServiceDesc for CheckoutService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -1072,7 +1114,13 @@ var CheckoutService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _CheckoutService_PlaceOrder_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamOrderStatus",
+			Handler:       _CheckoutService_StreamOrderStatus_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "demo.proto",
 }
 
@@ -0,0 +1,779 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GraphQL subset
+//
+// The /graphql endpoint (see graphql_schema.go) needs only part of GraphQL,
+// implemented here: one query operation with variables, aliases, arguments
+// and nested selections, plus __typename. Fragments, directives, mutations,
+// subscriptions and introspection are rejected. Every field is nullable; a
+// failing resolver nulls its field and adds an error with the field's path.
+// The fields of an object, and the elements of an object list, resolve
+// concurrently, as the spec allows for queries, so one query fans out to
+// all the services it touches at once. Queries are bounded before they run,
+// in depth and in the number of fields they select, aliases included, and
+// at most gqlMaxConcurrentResolvers resolvers of a query run at a time, so
+// a single request can't open an unbounded fan-out to the backends.
+
+const (
+	gqlMaxDepth  = 8   // nesting of a query
+	gqlMaxFields = 200 // fields selected by a query, counted once per selection
+
+	// gqlMaxConcurrentResolvers bounds the resolvers of one query running at
+	// once; the rest wait for a slot
+	gqlMaxConcurrentResolvers = 16
+)
+
+// gqlResolver resolves a field of parent
+type gqlResolver func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error)
+
+type gqlField struct {
+	resolve gqlResolver
+	args    []string   // accepted argument names
+	object  *gqlObject // type of object and object list results; nil for scalars
+}
+
+type gqlObject struct {
+	name   string
+	fields map[string]*gqlField
+}
+
+type gqlSelection struct {
+	alias      string // response key, the name unless aliased
+	name       string
+	args       map[string]interface{} // literals and gqlVariable references
+	selections []*gqlSelection
+}
+
+type gqlVariable string
+
+type gqlVariableDef struct {
+	name       string
+	required   bool
+	defaultVal interface{}
+	hasDefault bool
+}
+
+type gqlOperation struct {
+	name       string
+	variables  []gqlVariableDef
+	selections []*gqlSelection
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// parseGraphQL parses a document and picks the operation to run
+func parseGraphQL(query, operationName string) (*gqlOperation, error) {
+	p := &gqlParser{lex: gqlLexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var ops []*gqlOperation
+	for p.tok.kind != gqlEOF {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	switch {
+	case len(ops) == 0:
+		return nil, fmt.Errorf("document has no operation")
+	case operationName == "" && len(ops) > 1:
+		return nil, fmt.Errorf("operationName is required for a document with %d operations", len(ops))
+	case operationName == "":
+		return ops[0], nil
+	}
+	for _, op := range ops {
+		if op.name == operationName {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", operationName)
+}
+
+// variableValues applies defaults to the request's variables and checks
+// required ones are present
+func (op *gqlOperation) variableValues(provided map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(op.variables))
+	for _, def := range op.variables {
+		v, ok := provided[def.name]
+		switch {
+		case ok && v != nil:
+			values[def.name] = v
+		case def.hasDefault:
+			values[def.name] = def.defaultVal
+		case def.required:
+			return nil, fmt.Errorf("variable $%s is required", def.name)
+		default:
+			values[def.name] = nil
+		}
+	}
+	return values, nil
+}
+
+// validateGraphQL checks selections against the schema before anything runs
+func validateGraphQL(obj *gqlObject, sels []*gqlSelection, vars map[string]interface{}, depth int) error {
+	if depth > gqlMaxDepth {
+		return fmt.Errorf("query is nested deeper than %d levels", gqlMaxDepth)
+	}
+	if depth == 1 {
+		if n := countGraphQLFields(sels); n > gqlMaxFields {
+			return fmt.Errorf("query selects %d fields, more than %d", n, gqlMaxFields)
+		}
+	}
+	seen := make(map[string]bool, len(sels))
+	for _, sel := range sels {
+		if seen[sel.alias] {
+			return fmt.Errorf("%s.%s is selected twice", obj.name, sel.alias)
+		}
+		seen[sel.alias] = true
+		if sel.name == "__typename" {
+			if sel.selections != nil || len(sel.args) > 0 {
+				return fmt.Errorf("__typename takes no arguments or selections")
+			}
+			continue
+		}
+		if strings.HasPrefix(sel.name, "__") {
+			return fmt.Errorf("introspection (%s) is not supported", sel.name)
+		}
+		field, ok := obj.fields[sel.name]
+		if !ok {
+			return fmt.Errorf("type %s has no field %q", obj.name, sel.name)
+		}
+		for name, v := range sel.args {
+			if !stringinSlice(field.args, name) {
+				return fmt.Errorf("%s.%s has no argument %q", obj.name, sel.name, name)
+			}
+			if err := checkGraphQLVariables(v, vars); err != nil {
+				return err
+			}
+		}
+		switch {
+		case field.object == nil && sel.selections != nil:
+			return fmt.Errorf("%s.%s is a scalar and takes no selections", obj.name, sel.name)
+		case field.object != nil && sel.selections == nil:
+			return fmt.Errorf("%s.%s needs a selection of %s fields", obj.name, sel.name, field.object.name)
+		case field.object != nil:
+			if err := validateGraphQL(field.object, sel.selections, vars, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// countGraphQLFields returns the number of fields in sels and their
+// selections
+func countGraphQLFields(sels []*gqlSelection) int {
+	n := len(sels)
+	for _, sel := range sels {
+		n += countGraphQLFields(sel.selections)
+	}
+	return n
+}
+
+func checkGraphQLVariables(v interface{}, vars map[string]interface{}) error {
+	switch c := v.(type) {
+	case gqlVariable:
+		if _, ok := vars[string(c)]; !ok {
+			return fmt.Errorf("variable $%s is not defined by the operation", c)
+		}
+	case []interface{}:
+		for _, e := range c {
+			if err := checkGraphQLVariables(e, vars); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range c {
+			if err := checkGraphQLVariables(e, vars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gqlExecution runs one validated operation
+type gqlExecution struct {
+	vars map[string]interface{}
+	sem  chan struct{} // one slot per running resolver
+
+	mu     sync.Mutex
+	errors []gqlError
+}
+
+func newGraphQLExecution(vars map[string]interface{}) *gqlExecution {
+	return &gqlExecution{vars: vars, sem: make(chan struct{}, gqlMaxConcurrentResolvers)}
+}
+
+func (e *gqlExecution) fail(path []interface{}, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errors = append(e.errors, gqlError{Message: err.Error(), Path: path})
+}
+
+// selectObject resolves sels on parent, concurrently
+func (e *gqlExecution) selectObject(ctx context.Context, obj *gqlObject, parent interface{}, sels []*gqlSelection, path []interface{}) *gqlResult {
+	res := &gqlResult{keys: make([]string, len(sels)), values: make([]interface{}, len(sels))}
+	var wg sync.WaitGroup
+	for i, sel := range sels {
+		res.keys[i] = sel.alias
+		if sel.name == "__typename" {
+			res.values[i] = obj.name
+			continue
+		}
+		wg.Add(1)
+		go func(i int, sel *gqlSelection) {
+			defer wg.Done()
+			res.values[i] = e.resolveField(ctx, obj.fields[sel.name], parent, sel, appendPath(path, sel.alias))
+		}(i, sel)
+	}
+	wg.Wait()
+	return res
+}
+
+func (e *gqlExecution) resolveField(ctx context.Context, field *gqlField, parent interface{}, sel *gqlSelection, path []interface{}) (out interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.fail(path, fmt.Errorf("resolver panicked: %v", r))
+			out = nil
+		}
+	}()
+	args := make(map[string]interface{}, len(sel.args))
+	for name, v := range sel.args {
+		args[name] = e.argValue(v)
+	}
+	// The slot is held by the resolver only, not while its selections
+	// resolve, or nested lists could take every slot and wait on each other
+	select {
+	case e.sem <- struct{}{}:
+	case <-ctx.Done():
+		e.fail(path, ctx.Err())
+		return nil
+	}
+	v, err := func() (interface{}, error) {
+		defer func() { <-e.sem }()
+		return field.resolve(ctx, parent, args)
+	}()
+	if err != nil {
+		e.fail(path, err)
+		return nil
+	}
+	if field.object == nil || isNilValue(v) {
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return e.selectObject(ctx, field.object, v, sel.selections, path)
+	}
+	list := make([]interface{}, rv.Len())
+	var wg sync.WaitGroup
+	for i := range list {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			item := rv.Index(i).Interface()
+			if !isNilValue(item) {
+				list[i] = e.selectObject(ctx, field.object, item, sel.selections, appendPath(path, i))
+			}
+		}(i)
+	}
+	wg.Wait()
+	return list
+}
+
+// argValue substitutes variables into an argument
+func (e *gqlExecution) argValue(v interface{}) interface{} {
+	switch c := v.(type) {
+	case gqlVariable:
+		return e.vars[string(c)]
+	case []interface{}:
+		out := make([]interface{}, len(c))
+		for i, item := range c {
+			out[i] = e.argValue(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(c))
+		for k, item := range c {
+			out[k] = e.argValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+	return append(path[:len(path):len(path)], elem)
+}
+
+func isNilValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// gqlResult is an object in the response, keeping the selection order
+type gqlResult struct {
+	keys   []string
+	values []interface{}
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+		v, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Argument accessors for resolvers. Variables arrive as JSON values, so
+// numbers may be float64.
+
+func argString(args map[string]interface{}, name string) (string, bool) {
+	s, ok := args[name].(string)
+	return s, ok
+}
+
+func argStrings(args map[string]interface{}, name string) ([]string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		// Input coercion: a single value stands for a list of one
+		list = []interface{}{v}
+	}
+	out := make([]string, len(list))
+	for i, e := range list {
+		s, ok := e.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %q must be a list of strings", name)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// Lexer and parser
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	pos   int
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	// Whitespace, commas and comments are insignificant
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.pos++
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlPunct, value: "...", pos: start}, nil
+	case strings.IndexByte("!$()::=@[]{}|", c) >= 0:
+		l.pos++
+		return gqlToken{kind: gqlPunct, value: string(c), pos: start}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.src) && isGraphQLNameByte(l.src[l.pos]) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlName, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		l.pos++
+		kind := gqlInt
+		for l.pos < len(l.src) {
+			d := l.src[l.pos]
+			if d == '.' || d == 'e' || d == 'E' || d == '+' || (d == '-' && kind == gqlFloat) {
+				kind = gqlFloat
+			} else if d < '0' || d > '9' {
+				break
+			}
+			l.pos++
+		}
+		return gqlToken{kind: kind, value: l.src[start:l.pos], pos: start}, nil
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return gqlToken{}, fmt.Errorf("block strings are not supported (offset %d)", start)
+		}
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			if l.pos < len(l.src) && l.src[l.pos] == '\n' {
+				break
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+			return gqlToken{}, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		l.pos++
+		// GraphQL string escapes are a subset of JSON's
+		var s string
+		if err := json.Unmarshal([]byte(l.src[start:l.pos]), &s); err != nil {
+			return gqlToken{}, fmt.Errorf("invalid string at offset %d: %v", start, err)
+		}
+		return gqlToken{kind: gqlString, value: s, pos: start}, nil
+	}
+	return gqlToken{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+func isGraphQLNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+type gqlParser struct {
+	lex gqlLexer
+	tok gqlToken
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) is(punct string) bool {
+	return p.tok.kind == gqlPunct && p.tok.value == punct
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.is(punct) {
+		return p.unexpected("%q", punct)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected("a name")
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *gqlParser) unexpected(format string, args ...interface{}) error {
+	found := p.tok.value
+	if p.tok.kind == gqlEOF {
+		found = "end of document"
+	}
+	return fmt.Errorf("expected %s at offset %d, found %q", fmt.Sprintf(format, args...), p.tok.pos, found)
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{}
+	if p.tok.kind == gqlName {
+		switch p.tok.value {
+		case "query":
+		case "mutation", "subscription":
+			return nil, fmt.Errorf("%s operations are not supported", p.tok.value)
+		case "fragment":
+			return nil, fmt.Errorf("fragments are not supported")
+		default:
+			return nil, p.unexpected("an operation")
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == gqlName {
+			op.name = p.tok.value
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if p.is("(") {
+			vars, err := p.variableDefinitions()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = vars
+		}
+	}
+	if p.is("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sels
+	return op, nil
+}
+
+func (p *gqlParser) variableDefinitions() ([]gqlVariableDef, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var defs []gqlVariableDef
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		required, err := p.skipType()
+		if err != nil {
+			return nil, err
+		}
+		def := gqlVariableDef{name: name, required: required}
+		if p.is("=") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if def.defaultVal, err = p.value(true); err != nil {
+				return nil, err
+			}
+			def.hasDefault = true
+		}
+		defs = append(defs, def)
+	}
+	return defs, p.advance()
+}
+
+// skipType reads a variable's type; only whether it is non-null matters
+func (p *gqlParser) skipType() (required bool, err error) {
+	if p.is("[") {
+		if err := p.advance(); err != nil {
+			return false, err
+		}
+		if _, err := p.skipType(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.is("!") {
+		return true, p.advance()
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.is("}") {
+		if p.is("...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		sel, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection set at offset %d", p.tok.pos)
+	}
+	return sels, p.advance()
+}
+
+func (p *gqlParser) field() (*gqlSelection, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	sel := &gqlSelection{alias: name, name: name}
+	if p.is(":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		sel.args = make(map[string]interface{})
+		for !p.is(")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if sel.args[arg], err = p.value(false); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	if p.is("{") {
+		if sel.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// value parses a literal, or a variable unless constant is set
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch {
+	case p.is("$") && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case p.is("["):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.is("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.advance()
+	case p.is("{"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.advance()
+	case tok.kind == gqlString:
+		return tok.value, p.advance()
+	case tok.kind == gqlInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q at offset %d", tok.value, tok.pos)
+		}
+		return n, p.advance()
+	case tok.kind == gqlFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok.value, tok.pos)
+		}
+		return f, p.advance()
+	case tok.kind == gqlName:
+		var v interface{}
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = tok.value // enum value
+		}
+		return v, p.advance()
+	}
+	return nil, p.unexpected("a value")
+}
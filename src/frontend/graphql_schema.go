@@ -0,0 +1,289 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// GraphQL gateway
+//
+// With ENABLE_GRAPHQL=true, /graphql serves read-only queries against:
+//
+//	type Query {
+//	  products: [Product]
+//	  product(id: ID!): Product
+//	  recommendations(productIds: [ID]): [Product]
+//	  cart: Cart
+//	  currencies: [String]
+//	  session: Session
+//	}
+//	type Product { id name description picture categories price(currency: String): Money }
+//	type Money   { currencyCode units nanos formatted }
+//	type Cart    { size items: [CartItem] }
+//	type CartItem { quantity product: Product }
+//	type Session { id name currency marketId groups }
+//
+// Resolvers call the backends with the request's context, so every call
+// carries the user's JWT through the same split-forwarding interceptors as
+// page requests, decomposed once per query. A single query for a cart with
+// priced products and recommendations fans out to dozens of calls, which is
+// where the static/session block caching pays off; compare
+// graphql.downstream_calls with /debug/grpcstats.
+
+const graphqlMaxBody = 64 << 10
+
+var graphqlStats = expvar.NewMap("graphql")
+
+type ctxKeyGraphQLCurrency struct{}
+
+// graphqlCurrency is the default for Product.price
+func graphqlCurrency(r *http.Request) string {
+	return currentCurrency(r)
+}
+
+type graphqlCart struct {
+	items []*pb.CartItem
+}
+
+// newGraphQLSchema builds the query root with resolvers bound to fe
+func newGraphQLSchema(fe *frontendServer) *gqlObject {
+	call := func() { graphqlStats.Add("downstream_calls", 1) }
+
+	money := &gqlObject{name: "Money", fields: map[string]*gqlField{
+		"currencyCode": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Money).GetCurrencyCode(), nil
+		}},
+		"units": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Money).GetUnits(), nil
+		}},
+		"nanos": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Money).GetNanos(), nil
+		}},
+		"formatted": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			m := p.(*pb.Money)
+			return renderCurrencyLogo(m.GetCurrencyCode()) + fmt.Sprintf("%d.%02d", m.GetUnits(), m.GetNanos()/10000000), nil
+		}},
+	}}
+
+	product := &gqlObject{name: "Product", fields: map[string]*gqlField{
+		"id": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Product).GetId(), nil
+		}},
+		"name": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Product).GetName(), nil
+		}},
+		"description": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Product).GetDescription(), nil
+		}},
+		"picture": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Product).GetPicture(), nil
+		}},
+		"categories": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.Product).GetCategories(), nil
+		}},
+		"price": {args: []string{"currency"}, object: money, resolve: func(ctx context.Context, p interface{}, args map[string]interface{}) (interface{}, error) {
+			currency, ok := argString(args, "currency")
+			if !ok {
+				currency, _ = ctx.Value(ctxKeyGraphQLCurrency{}).(string)
+			}
+			price := p.(*pb.Product).GetPriceUsd()
+			if currency == "" || currency == price.GetCurrencyCode() {
+				return price, nil
+			}
+			call()
+			return fe.convertCurrency(ctx, price, currency)
+		}},
+	}}
+
+	cartItem := &gqlObject{name: "CartItem", fields: map[string]*gqlField{
+		"quantity": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*pb.CartItem).GetQuantity(), nil
+		}},
+		"product": {object: product, resolve: func(ctx context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			call()
+			return fe.getProduct(ctx, p.(*pb.CartItem).GetProductId())
+		}},
+	}}
+
+	cart := &gqlObject{name: "Cart", fields: map[string]*gqlField{
+		"items": {object: cartItem, resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*graphqlCart).items, nil
+		}},
+		"size": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return cartSize(p.(*graphqlCart).items), nil
+		}},
+	}}
+
+	session := &gqlObject{name: "Session", fields: map[string]*gqlField{
+		"id": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*JWTClaims).SessionID, nil
+		}},
+		"name": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*JWTClaims).Name, nil
+		}},
+		"currency": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*JWTClaims).Currency, nil
+		}},
+		"marketId": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*JWTClaims).MarketID, nil
+		}},
+		"groups": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(*JWTClaims).Groups, nil
+		}},
+	}}
+
+	return &gqlObject{name: "Query", fields: map[string]*gqlField{
+		"products": {object: product, resolve: func(ctx context.Context, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			call()
+			return fe.getProducts(ctx)
+		}},
+		"product": {args: []string{"id"}, object: product, resolve: func(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			id, ok := argString(args, "id")
+			if !ok || id == "" {
+				return nil, fmt.Errorf("argument \"id\" is required")
+			}
+			call()
+			return fe.getProduct(ctx, id)
+		}},
+		"recommendations": {args: []string{"productIds"}, object: product, resolve: func(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			ids, err := argStrings(args, "productIds")
+			if err != nil {
+				return nil, err
+			}
+			call()
+			return fe.getRecommendations(ctx, graphqlSessionID(ctx), ids)
+		}},
+		"cart": {object: cart, resolve: func(ctx context.Context, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			call()
+			items, err := fe.getCart(ctx, graphqlSessionID(ctx))
+			if err != nil {
+				return nil, err
+			}
+			return &graphqlCart{items: items}, nil
+		}},
+		"currencies": {resolve: func(ctx context.Context, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			call()
+			return fe.getCurrencies(ctx)
+		}},
+		"session": {object: session, resolve: func(ctx context.Context, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			claims, _ := getJWTFromContext(ctx)
+			return claims, nil
+		}},
+	}}
+}
+
+func graphqlSessionID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeySessionID{}).(string)
+	return id
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// graphqlHandler serves GET ?query=... and POST application/json requests.
+// Requests that don't parse or validate get 400 and no data; field errors
+// come back with 200 next to the data that did resolve.
+func (fe *frontendServer) graphqlHandler(schema *gqlObject) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		graphqlStats.Add("queries", 1)
+		req, err := readGraphQLRequest(w, r)
+		if err == nil {
+			err = fe.executeGraphQL(w, r, schema, req)
+		}
+		if err != nil {
+			graphqlStats.Add("rejected", 1)
+			writeGraphQLResponse(w, http.StatusBadRequest, graphqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+		}
+	}
+}
+
+func readGraphQLRequest(w http.ResponseWriter, r *http.Request) (*graphqlRequest, error) {
+	req := &graphqlRequest{}
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return nil, fmt.Errorf("variables: %v", err)
+			}
+		}
+		return req, nil
+	}
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return nil, fmt.Errorf("content type must be application/json, got %q", ct)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, graphqlMaxBody))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %v", err)
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, fmt.Errorf("body: %v", err)
+	}
+	return req, nil
+}
+
+func (fe *frontendServer) executeGraphQL(w http.ResponseWriter, r *http.Request, schema *gqlObject, req *graphqlRequest) error {
+	if req.Query == "" {
+		return fmt.Errorf("query is required")
+	}
+	op, err := parseGraphQL(req.Query, req.OperationName)
+	if err != nil {
+		return err
+	}
+	vars, err := op.variableValues(req.Variables)
+	if err != nil {
+		return err
+	}
+	if err := validateGraphQL(schema, op.selections, vars, 1); err != nil {
+		return err
+	}
+
+	ctx := context.WithValue(r.Context(), ctxKeyGraphQLCurrency{}, graphqlCurrency(r))
+	if token, ok := ctx.Value(ctxKeyJWTToken{}).(string); ok && token != "" {
+		ctx = withJWTComponentsMemo(ctx, token)
+	}
+	exec := newGraphQLExecution(vars)
+	data := exec.selectObject(ctx, schema, nil, op.selections, nil)
+	if len(exec.errors) > 0 {
+		graphqlStats.Add("field_errors", int64(len(exec.errors)))
+		log.WithField("errors", len(exec.errors)).Warnf("[GRAPHQL] query %q resolved with errors: %s", op.name, exec.errors[0].Message)
+	}
+	writeGraphQLResponse(w, http.StatusOK, graphqlResponse{Data: data, Errors: exec.errors})
+	return nil
+}
+
+func writeGraphQLResponse(w http.ResponseWriter, status int, resp graphqlResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Warnf("[GRAPHQL] writing response: %v", err)
+	}
+}
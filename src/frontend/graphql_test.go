@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestGraphQL runs queries against a small schema: aliases, arguments from
+// variables, nested lists, field errors with paths, and rejected documents.
+func TestGraphQL(t *testing.T) {
+	item := &gqlObject{name: "Item", fields: map[string]*gqlField{
+		"n": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			return p.(int), nil
+		}},
+		"fail": {resolve: func(context.Context, interface{}, map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("boom")
+		}},
+	}}
+	root := &gqlObject{name: "Query", fields: map[string]*gqlField{
+		"echo": {args: []string{"s"}, resolve: func(_ context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			s, _ := argString(args, "s")
+			return s, nil
+		}},
+		"items": {args: []string{"ids"}, object: item, resolve: func(_ context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			ids, err := argStrings(args, "ids")
+			out := make([]int, len(ids))
+			for i := range ids {
+				out[i] = i
+			}
+			return out, err
+		}},
+	}}
+
+	run := func(query string, vars map[string]interface{}) (string, error) {
+		op, err := parseGraphQL(query, "")
+		if err != nil {
+			return "", err
+		}
+		values, err := op.variableValues(vars)
+		if err != nil {
+			return "", err
+		}
+		if err := validateGraphQL(root, op.selections, values, 1); err != nil {
+			return "", err
+		}
+		exec := newGraphQLExecution(values)
+		b, _ := json.Marshal(graphqlResponse{Data: exec.selectObject(context.Background(), root, nil, op.selections, nil), Errors: exec.errors})
+		return string(b), nil
+	}
+
+	got, err := run(`query Q($s: String = "dflt", $ids: [ID!]!) {
+		b: echo(s: $s) # comment
+		a: echo(s: "x\"y")
+		items(ids: $ids) { __typename n }
+	}`, map[string]interface{}{"ids": []interface{}{"p", "q"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"data":{"b":"dflt","a":"x\"y","items":[{"__typename":"Item","n":0},{"__typename":"Item","n":1}]}}`; got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	got, err = run(`{ items(ids: "p") { fail } }`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"data":{"items":[{"fail":null}]},"errors":[{"message":"boom","path":["items",0,"fail"]}]}`; got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	for query, want := range map[string]string{
+		`{ nope }`:                              "has no field",
+		`{ items }`:                             "needs a selection",
+		`{ echo { n } }`:                        "is a scalar",
+		`{ echo(t: 1) }`:                        "has no argument",
+		`{ echo(s: $v) }`:                       "not defined",
+		`query($v: String!) { echo(s: $v) }`:    "is required",
+		`{ ...F } fragment F on Query { echo }`: "fragments",
+		`mutation { echo }`:                     "mutation operations",
+		`{ __schema { types } }`:                "introspection",
+		`{ echo echo }`:                         "selected twice",
+		`{ echo(s: "open) }`:                    "unterminated",
+		"{" + strings.Repeat(" e: echo", gqlMaxFields+1) + " }": "more than",
+	} {
+		if _, err := run(query, nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", query, err, want)
+		}
+	}
+}
+
+// TestGraphQLResolverConcurrency checks a query fanning out over a long
+// list never runs more than gqlMaxConcurrentResolvers resolvers at once
+func TestGraphQLResolverConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	item := &gqlObject{name: "Item", fields: map[string]*gqlField{
+		"n": {resolve: func(_ context.Context, p interface{}, _ map[string]interface{}) (interface{}, error) {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return p.(int), nil
+		}},
+	}}
+	root := &gqlObject{name: "Query", fields: map[string]*gqlField{
+		"items": {object: item, resolve: func(context.Context, interface{}, map[string]interface{}) (interface{}, error) {
+			return make([]int, 10*gqlMaxConcurrentResolvers), nil
+		}},
+	}}
+	op, err := parseGraphQL(`{ items { n } }`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := newGraphQLExecution(nil)
+	exec.selectObject(context.Background(), root, nil, op.selections, nil)
+	if len(exec.errors) > 0 {
+		t.Fatalf("errors: %v", exec.errors)
+	}
+	if peak > gqlMaxConcurrentResolvers {
+		t.Errorf("%d resolvers ran at once, want at most %d", peak, gqlMaxConcurrentResolvers)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Azure AD group overflow
+//
+// Azure AD inlines at most 200 groups in a JWT (6 in implicit flow tokens);
+// beyond that it drops the groups claim and points at a Graph endpoint
+// instead, either with _claim_names/_claim_sources or with hasgroups=true.
+// Tokens below the limit still carry up to 200 GUIDs and easily exceed 4KB.
+//
+// Overflow is always detected and counted. With GROUPS_OVERFLOW_RESOLVE=true
+// the groups are fetched from the endpoint named by the token, or from
+// GROUPS_OVERFLOW_ENDPOINT when set (e.g. a Microsoft Graph getMemberObjects
+// URL, since the graph.windows.net endpoint Azure still names is retired),
+// using the session's access token, and cached per subject for
+// GROUPS_OVERFLOW_CACHE_TTL (default 10m). The forwarded IdP token is never
+// modified: resolved groups only live in the frontend's session claims.
+
+// groupsOverflowEvents counts overflow handling by outcome
+var groupsOverflowEvents = expvar.NewMap("jwt_groups_overflow")
+
+// groupsOverflowClaims are the claims Azure AD uses to signal overflow
+type groupsOverflowClaims struct {
+	Subject      string            `json:"sub"`
+	Groups       []string          `json:"groups"`
+	HasGroups    bool              `json:"hasgroups"`
+	ClaimNames   map[string]string `json:"_claim_names"`
+	ClaimSources map[string]struct {
+		Endpoint string `json:"endpoint"`
+	} `json:"_claim_sources"`
+}
+
+// groupsOverflow reports whether claims signal group overflow, and the
+// endpoint the token names for the full list, if any
+func (c *groupsOverflowClaims) groupsOverflow() (endpoint string, overflow bool) {
+	if src, ok := c.ClaimNames["groups"]; ok {
+		return c.ClaimSources[src].Endpoint, true
+	}
+	return "", c.HasGroups
+}
+
+type groupResolver struct {
+	enabled  bool
+	endpoint string
+	ttl      time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedGroups
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+var groupsResolver = newGroupResolver()
+
+func newGroupResolver() *groupResolver {
+	ttl := 10 * time.Minute
+	if d, err := time.ParseDuration(knobs.Value("GROUPS_OVERFLOW_CACHE_TTL")); err == nil && d > 0 {
+		ttl = d
+	}
+	return &groupResolver{
+		enabled:  knobs.Value("GROUPS_OVERFLOW_RESOLVE") == "true",
+		endpoint: knobs.Value("GROUPS_OVERFLOW_ENDPOINT"),
+		ttl:      ttl,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		cache:    make(map[string]cachedGroups),
+	}
+}
+
+// Groups returns the groups of a token, following overflow when resolution is
+// enabled. A failed lookup yields no groups rather than failing the login.
+func (g *groupResolver) Groups(ctx context.Context, rawClaims []byte, accessToken string) []string {
+	var claims groupsOverflowClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil
+	}
+	endpoint, overflow := claims.groupsOverflow()
+	if !overflow {
+		return claims.Groups
+	}
+	groupsOverflowEvents.Add("detected", 1)
+	log.Infof("[JWT-FLOW] Groups overflow for %s, groups not in token", pseudonym(claims.Subject))
+	if !g.enabled {
+		return nil
+	}
+	if g.endpoint != "" {
+		endpoint = g.endpoint
+	}
+	if endpoint == "" || accessToken == "" {
+		groupsOverflowEvents.Add("unresolvable", 1)
+		return nil
+	}
+
+	if groups, ok := g.cached(claims.Subject); ok {
+		groupsOverflowEvents.Add("cache_hits", 1)
+		return groups
+	}
+	groups, err := g.fetch(ctx, endpoint, accessToken)
+	if err != nil {
+		groupsOverflowEvents.Add("failed", 1)
+		log.Warnf("[JWT-FLOW] Failed to resolve overflowed groups for %s: %v", pseudonym(claims.Subject), err)
+		return nil
+	}
+	groupsOverflowEvents.Add("resolved", 1)
+	g.mu.Lock()
+	g.cache[claims.Subject] = cachedGroups{groups: groups, expires: time.Now().Add(g.ttl)}
+	g.mu.Unlock()
+	return groups
+}
+
+func (g *groupResolver) cached(subject string) ([]string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.cache[subject]
+	if !ok || time.Now().After(c.expires) {
+		delete(g.cache, subject)
+		return nil, false
+	}
+	return c.groups, true
+}
+
+// fetch calls a getMemberObjects style endpoint: POST, bearer access token,
+// {"value": [...]} in response
+func (g *groupResolver) fetch(ctx context.Context, endpoint, accessToken string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(`{"securityEnabledOnly":false}`))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("groups endpoint returned %s", resp.Status)
+	}
+	var body struct {
+		Value []string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode groups response: %w", err)
+	}
+	return body.Value, nil
+}
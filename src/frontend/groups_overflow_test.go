@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGroupsOverflow(t *testing.T) {
+	payloads := map[string][]byte{}
+	for _, g := range loadGoldenJWTs(t) {
+		payloads[g.Name] = []byte(g.Payload)
+	}
+
+	calls := 0
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"value":["g1","g2"]}`))
+	}))
+	defer graph.Close()
+
+	g := newGroupResolver()
+	if groups := g.Groups(context.Background(), payloads["azure_ad_150_groups"], ""); len(groups) != 150 {
+		t.Errorf("inline groups = %d, want 150", len(groups))
+	}
+	if groups := g.Groups(context.Background(), payloads["azure_ad_groups_overflow"], "access"); groups != nil {
+		t.Errorf("overflow resolved while resolution is disabled: %v", groups)
+	}
+
+	g.enabled, g.endpoint = true, graph.URL
+	for i := 0; i < 2; i++ {
+		if groups := g.Groups(context.Background(), payloads["azure_ad_groups_overflow"], "access"); len(groups) != 2 {
+			t.Fatalf("resolved groups = %v, want [g1 g2]", groups)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("groups endpoint called %d times, want 1 (second lookup cached)", calls)
+	}
+}
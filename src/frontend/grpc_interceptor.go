@@ -16,31 +16,59 @@ package main
 
 import (
 	"context"
-	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
-// shouldSkipJWT checks if the method doesn't need JWT (public/anonymous services)
+// shouldSkipJWT checks if the method doesn't need JWT (public/anonymous
+// services), see method_auth.go
 func shouldSkipJWT(method string) bool {
-	// Product Catalog Service - public product data, no user context needed
-	if strings.Contains(method, "ProductCatalogService") {
-		return true
+	requires, ok := methodAuth.requiresUserAuth(method)
+	return ok && !requires
+}
+
+// splitJWTMetadata builds the headers of a split JWT: the original base64url
+// header and signature plus the payload, either as raw JSON in x-jwt-payload
+// or, with a claim classifier configured, as claim blocks (claim_classifier.go)
+func splitJWTMetadata(ctx context.Context, components *JWTComponents, tokenStr string) metadata.MD {
+	md, perToken := splitMetadataParts(components)
+	for i := 0; i < len(perToken); i += 2 {
+		md.Set(perToken[i], perToken[i+1])
+	}
+	// Dual-write: also send the full token while receivers migrate
+	if jwtDualWriteEnabled(ctx) {
+		md.Set("authorization", "Bearer "+tokenStr)
+	}
+	return md
+}
+
+// splitMetadataParts separates the split headers into those that stay the
+// same for a session (header, claim order, static and session blocks) and
+// the key/value pairs that change with every token
+func splitMetadataParts(components *JWTComponents) (stable metadata.MD, perToken []string) {
+	stable = metadata.Pairs("x-jwt-header", components.Header)
+	var blocks claimBlocks
+	classified := false
+	if classifier := claimClassifierFor(components.Payload); classifier != nil {
+		blocks, classified = classifyPayload(classifier, components.Payload)
 	}
-	// Currency Service - pure conversion, no user context needed
-	if strings.Contains(method, "CurrencyService") {
-		return true
+	if !classified {
+		return stable, []string{"x-jwt-payload", components.Payload, "x-jwt-sig", components.Signature}
 	}
-	// Ad Service - public ads, no user-specific targeting needed
-	if strings.Contains(method, "AdService") {
-		return true
+	stable.Set("x-jwt-claims", blocks.Order)
+	// Receivers read a missing block as empty
+	if blocks.Static != "{}" {
+		stable.Set("x-jwt-static", blocks.Static)
 	}
-	// Recommendation Service - can work with anonymous users
-	if strings.Contains(method, "RecommendationService") {
-		return true
+	if blocks.Session != "{}" {
+		stable.Set("x-jwt-session", blocks.Session)
 	}
-	return false
+	if blocks.Dynamic != "{}" {
+		perToken = append(perToken, "x-jwt-dynamic", blocks.Dynamic)
+	}
+	return stable, append(perToken, "x-jwt-sig", components.Signature)
 }
 
 // jwtUnaryClientInterceptor adds JWT to outgoing gRPC calls
@@ -65,42 +93,119 @@ func jwtUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 				var err error
 				tokenStr, err = generateJWTFromClaims(claims)
 				if err != nil {
-					log.Warnf("No JWT token string in context and failed to regenerate from claims for method %s. Proceeding without JWT.", method)
+					loggerFromContext(ctx).Warnf("[JWT-FLOW] No JWT token string in context and failed to regenerate from claims for method %s. Proceeding without JWT.", method)
+					jwtSLO.RecordFailure(sloReasonMissingJWT)
 					return invoker(ctx, method, req, reply, cc, opts...)
 				}
 			} else {
-				log.Warnf("No JWT token string or claims in context for method %s. Proceeding without JWT.", method)
+				loggerFromContext(ctx).Warnf("[JWT-FLOW] No JWT token string or claims in context for method %s. Proceeding without JWT.", method)
+				jwtSLO.RecordFailure(sloReasonMissingJWT)
 				return invoker(ctx, method, req, reply, cc, opts...)
 			}
 		}
 
-		// Check if JWT compression is enabled.
-		if IsJWTCompressionEnabled() {
+		prep := time.Now()
+		// Check if JWT compression is enabled, understood by this downstream,
+		// worthwhile for this token size and, with the adaptive controller
+		// on, for this downstream
+		ctx, decision := sampleDecision(ctx, method, false, len(tokenStr))
+		compress := jwtCompressionEnabled(ctx)
+		split, reason := splitDecision(method, compress, len(tokenStr))
+		seal := false
+		if split {
+			// Tokens with sealed claims only split for services holding the key
+			split, seal, reason = piiSplit(ctx, method, tokenStr)
+		}
+		decision.choose(compress, reason)
+		mode := decisionModeAuthorization
+		var staticSHA, staticBlock string
+		var codecMD metadata.MD
+		var sessionCtx context.Context
+		if split && !seal {
+			if codecMD = wireCodecMetadata(ctx, method, tokenStr); codecMD == nil {
+				sessionCtx = sessionSplitContext(ctx, tokenStr)
+			}
+		}
+		if codecMD != nil {
+			ctx = metadata.NewOutgoingContext(ctx, codecMD)
+			mode = decisionModeCodec
+			jwtSLO.RecordSuccess()
+		} else if sessionCtx != nil {
+			ctx = sessionCtx
+			mode = decisionModeSession
+			jwtSLO.RecordSuccess()
+		} else if split {
 			// JWT COMPRESSION ENABLED: Decompose JWT (1 base64 decode operation)
-			components, err := DecomposeJWT(tokenStr)
+			components, err := decomposeJWTFor(ctx, tokenStr)
+			if err == nil && seal {
+				components, err = sealedComponents(components)
+			}
 			if err != nil {
 				// Fallback to full JWT if decomposition fails
-				log.Warnf("Failed to decompose JWT, using full token: %v", err)
+				loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to decompose JWT, using full token: %v", err)
+				jwtSLO.RecordFailure(sloReasonReassembly)
 				md := metadata.Pairs("authorization", "Bearer "+tokenStr)
 				ctx = metadata.NewOutgoingContext(ctx, md)
+				mode = decisionModeAuthorizationFallback
 			} else {
-                // Send as 3 headers: header + raw JSON payload + signature
-				// x-jwt-header is base64url (original, for IdP compatibility)
-				// x-jwt-payload is raw JSON (~25% smaller than base64)
-				// x-jwt-sig is base64url (original signature format)
-				md := metadata.Pairs(
-					"x-jwt-header", components.Header,
-					"x-jwt-payload", components.Payload,
-					"x-jwt-sig", components.Signature,
-				)
+				md := splitJWTMetadata(ctx, components, tokenStr)
+				staticSHA, staticBlock = offerStaticBlockRef(md, serviceFromMethod(method))
 				ctx = metadata.NewOutgoingContext(ctx, md)
+				mode = decisionModeSplit
+				jwtSLO.RecordSuccess()
 			}
 		} else {
 			// JWT COMPRESSION DISABLED: Send full JWT in authorization header
 			md := metadata.Pairs("authorization", "Bearer "+tokenStr)
 			ctx = metadata.NewOutgoingContext(ctx, md)
-		}		// Invoke the RPC with the modified context
-		return invoker(ctx, method, req, reply, cc, opts...)
+			jwtSLO.RecordSuccess()
+		}
+
+		if priority := requestPriority(ctx, tokenStr); priority != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestPriorityHeader, priority)
+		}
+		decision.sent(ctx, mode)
+		accessFromContext(ctx).call(mode, time.Since(prep))
+		claimsAudit.Record(tokenStr, serviceFromMethod(method))
+
+		// Invoke the RPC with the modified context; a peer refusing the
+		// split headers gets the token again in the fallback format, one
+		// unable to reassemble them gets it whole; see auth_timing.go for
+		// the downstream timings and token_renewal.go for renewal requests
+		invoker = downgradeInvoker(overflowInvoker(authTimingInvoker(renewalInvoker(invoker)), tokenStr), tokenStr)
+		start := time.Now()
+		var header metadata.MD
+		callOpts := append(opts[:len(opts):len(opts)], negotiationCallOption(&header)...)
+		if decision != nil && wireCodec != "negotiate" {
+			// Record what the downstream advertises even when not negotiating
+			callOpts = append(callOpts, grpc.Header(&header))
+		}
+		err := invoker(ctx, method, req, reply, cc, callOpts...)
+		if err == nil && wireCodec == "negotiate" {
+			downstreamCodecs.Observe(serviceFromMethod(method), header)
+		}
+		if staticSHA != "" {
+			if isStaticBlockUnknown(err) {
+				// The receiver lost the block; resend it in full, once
+				knownStaticBlocks.Forget(serviceFromMethod(method), staticSHA)
+				staticDictionaryEvents.Add("resent", 1)
+				md, _ := metadata.FromOutgoingContext(ctx)
+				md = md.Copy()
+				md.Set("x-jwt-static", staticBlock)
+				if decision != nil {
+					decision.StaticBlock = "resent"
+				}
+				err = invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+			}
+			if err == nil {
+				knownStaticBlocks.Learn(serviceFromMethod(method), staticSHA)
+			}
+		}
+		if compress {
+			adaptiveCompression.Observe(method, split, time.Since(start), err)
+		}
+		decision.finish(ctx, header, err)
+		return err
 	}
 }
 
@@ -121,36 +226,74 @@ func jwtStreamClientInterceptor() grpc.StreamClientInterceptor {
 
 		tokenStr, ok := ctx.Value(ctxKeyJWTToken{}).(string)
 		if !ok || tokenStr == "" {
-			log.Warnf("No JWT token string in context for stream method %s. Proceeding without JWT.", method)
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] No JWT token string in context for stream method %s. Proceeding without JWT.", method)
+			jwtSLO.RecordFailure(sloReasonMissingJWT)
 			return streamer(ctx, desc, cc, method, opts...)
 		}
 
-		// Check if JWT compression is enabled
-		if IsJWTCompressionEnabled() {
+		prep := time.Now()
+		// Check if JWT compression is enabled; streams follow the adaptive
+		// decision but aren't sampled, their lifetime isn't a latency
+		ctx, decision := sampleDecision(ctx, method, true, len(tokenStr))
+		compress := jwtCompressionEnabled(ctx)
+		split, reason := splitDecision(method, compress, len(tokenStr))
+		seal := false
+		if split {
+			// Tokens with sealed claims only split for services holding the key
+			split, seal, reason = piiSplit(ctx, method, tokenStr)
+		}
+		decision.choose(compress, reason)
+		mode := decisionModeAuthorization
+		var codecMD metadata.MD
+		var sessionCtx context.Context
+		if split && !seal {
+			if codecMD = wireCodecMetadata(ctx, method, tokenStr); codecMD == nil {
+				sessionCtx = sessionSplitContext(ctx, tokenStr)
+			}
+		}
+		if codecMD != nil {
+			ctx = metadata.NewOutgoingContext(ctx, codecMD)
+			mode = decisionModeCodec
+			jwtSLO.RecordSuccess()
+		} else if sessionCtx != nil {
+			ctx = sessionCtx
+			mode = decisionModeSession
+			jwtSLO.RecordSuccess()
+		} else if split {
 			// Decompose JWT (1 base64 decode operation)
-			components, err := DecomposeJWT(tokenStr)
+			components, err := decomposeJWTFor(ctx, tokenStr)
+			if err == nil && seal {
+				components, err = sealedComponents(components)
+			}
 			if err != nil {
 				// Fallback to full JWT if decomposition fails
-				log.Warnf("Failed to decompose JWT for stream, using full token: %v", err)
+				loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to decompose JWT for stream, using full token: %v", err)
+				jwtSLO.RecordFailure(sloReasonReassembly)
 				md := metadata.Pairs("authorization", "Bearer "+tokenStr)
 				ctx = metadata.NewOutgoingContext(ctx, md)
+				mode = decisionModeAuthorizationFallback
 			} else {
-                // Send as 3 headers: header + raw JSON payload + signature
-				// x-jwt-header is base64url (original, for IdP compatibility)
-				// x-jwt-payload is raw JSON (~25% smaller than base64)
-				// x-jwt-sig is base64url (original signature format)
-				md := metadata.Pairs(
-					"x-jwt-header", components.Header,
-					"x-jwt-payload", components.Payload,
-					"x-jwt-sig", components.Signature,
-				)
-				ctx = metadata.NewOutgoingContext(ctx, md)
+				ctx = metadata.NewOutgoingContext(ctx, splitJWTMetadata(ctx, components, tokenStr))
+				mode = decisionModeSplit
+				jwtSLO.RecordSuccess()
 			}
 		} else {
 			// JWT COMPRESSION DISABLED: Send full JWT in authorization header
 			md := metadata.Pairs("authorization", "Bearer "+tokenStr)
 			ctx = metadata.NewOutgoingContext(ctx, md)
-		}		// Invoke the streaming RPC with the modified context
-		return streamer(ctx, desc, cc, method, opts...)
+			jwtSLO.RecordSuccess()
+		}
+		if priority := requestPriority(ctx, tokenStr); priority != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestPriorityHeader, priority)
+		}
+		decision.sent(ctx, mode)
+		accessFromContext(ctx).call(mode, time.Since(prep))
+		claimsAudit.Record(tokenStr, serviceFromMethod(method))
+
+		// Invoke the streaming RPC with the modified context; the decision
+		// is published when the stream opens
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		decision.finish(ctx, nil, err)
+		return cs, err
 	}
 }
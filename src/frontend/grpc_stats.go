@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	channelzservice "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+)
+
+// JWT wire modes recorded per RPC, derived from the metadata actually sent/received
+const (
+	jwtModeCompressed = "compressed" // x-jwt-header + x-jwt-payload + x-jwt-sig
+	jwtModeFull       = "full"       // authorization: Bearer <jwt>
+	jwtModeNone       = "none"       // no JWT metadata on the RPC
+)
+
+// wireStats is the process-wide stats handler shared by all clients and servers
+var wireStats = newWireStatsHandler()
+
+// rpcWireStats holds cumulative wire statistics for one side/method/mode combination
+type rpcWireStats struct {
+	Side             string `json:"side"` // "client" or "server"
+	Method           string `json:"method"`
+	JWTMode          string `json:"jwt_mode"`
+	Calls            int64  `json:"calls"`
+	Errors           int64  `json:"errors"`
+	HeaderWireBytes  int64  `json:"header_wire_bytes"`  // HPACK-encoded size (inbound server headers only)
+	MetadataBytes    int64  `json:"metadata_bytes"`     // Uncompressed key+value size of all metadata
+	JWTMetadataBytes int64  `json:"jwt_metadata_bytes"` // Uncompressed key+value size of JWT metadata only
+	PayloadWireIn    int64  `json:"payload_wire_bytes_in"`
+	PayloadWireOut   int64  `json:"payload_wire_bytes_out"`
+}
+
+// rpcStatsTag accumulates the statistics of a single RPC until it ends
+type rpcStatsTag struct {
+	mu      sync.Mutex
+	stats   rpcWireStats
+	traceID string
+}
+
+type ctxKeyRPCStatsTag struct{}
+
+// wireStatsHandler is a grpc stats.Handler recording per-RPC wire sizes,
+// metadata sizes and the JWT compression mode in use
+type wireStatsHandler struct {
+	mu      sync.Mutex
+	entries map[string]*rpcWireStats
+}
+
+func newWireStatsHandler() *wireStatsHandler {
+	return &wireStatsHandler{entries: make(map[string]*rpcWireStats)}
+}
+
+// TagRPC attaches a per-RPC accumulator to the context
+func (h *wireStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	tag := &rpcStatsTag{}
+	tag.stats.Method = info.FullMethodName
+	tag.stats.JWTMode = jwtModeNone
+	return context.WithValue(ctx, ctxKeyRPCStatsTag{}, tag)
+}
+
+// HandleRPC records header, payload and completion events for the tagged RPC
+func (h *wireStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	tag, ok := ctx.Value(ctxKeyRPCStatsTag{}).(*rpcStatsTag)
+	if !ok {
+		return
+	}
+
+	tag.mu.Lock()
+	defer tag.mu.Unlock()
+
+	switch ev := s.(type) {
+	case *stats.OutHeader:
+		// Only the client's request headers carry the JWT
+		if ev.Client {
+			tag.recordMetadata(ev.Header)
+		}
+	case *stats.InHeader:
+		if !ev.Client {
+			tag.stats.HeaderWireBytes += int64(ev.WireLength)
+			tag.recordMetadata(ev.Header)
+		}
+	case *stats.InPayload:
+		tag.stats.PayloadWireIn += int64(ev.WireLength)
+	case *stats.OutPayload:
+		tag.stats.PayloadWireOut += int64(ev.WireLength)
+	case *stats.End:
+		tag.stats.Side = "server"
+		if ev.Client {
+			tag.stats.Side = "client"
+		}
+		tag.stats.Calls = 1
+		if ev.Error != nil {
+			tag.stats.Errors = 1
+		}
+		h.commit(&tag.stats)
+		tag.observe()
+		if ev.Client {
+			tag.annotateSpan(ctx)
+		}
+	}
+}
+
+// TagConn is a no-op; statistics are kept per RPC
+func (h *wireStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn is a no-op; statistics are kept per RPC
+func (h *wireStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// recordMetadata adds the metadata sizes and detects the JWT wire mode
+func (t *rpcStatsTag) recordMetadata(md metadata.MD) {
+	for k, vals := range md {
+		for _, v := range vals {
+			size := int64(len(k) + len(v))
+			t.stats.MetadataBytes += size
+			if isJWTMetadataKey(k) {
+				t.stats.JWTMetadataBytes += size
+			}
+		}
+	}
+	t.stats.JWTMode = jwtModeFromMetadata(md)
+	if id := traceIDFromMetadata(md); id != "" {
+		t.traceID = id
+	}
+}
+
+// observe feeds a finished RPC that carried a JWT into the histograms
+func (t *rpcStatsTag) observe() {
+	if t.stats.JWTMode == jwtModeNone {
+		return
+	}
+	observeWithTrace(jwtMetadataBytesHistogram.WithLabelValues(t.stats.Side, t.stats.JWTMode), float64(t.stats.JWTMetadataBytes), t.traceID)
+	if t.stats.Side == "server" {
+		observeWithTrace(headerWireBytesHistogram.WithLabelValues(t.stats.JWTMode), float64(t.stats.HeaderWireBytes), t.traceID)
+	}
+}
+
+// Span attributes carrying an RPC's header sizes, so jwtsplit trace-report can
+// sum them per hop from a trace export
+const (
+	spanAttrJWTMode          = "jwt.mode"
+	spanAttrJWTMetadataBytes = "jwt.metadata_bytes"
+	spanAttrMetadataBytes    = "rpc.metadata_bytes"
+	spanAttrHeaderWireBytes  = "rpc.header_wire_bytes"
+)
+
+// annotateSpan copies the RPC's header sizes onto the span in ctx
+func (t *rpcStatsTag) annotateSpan(ctx context.Context) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String(spanAttrJWTMode, t.stats.JWTMode),
+		attribute.Int64(spanAttrJWTMetadataBytes, t.stats.JWTMetadataBytes),
+		attribute.Int64(spanAttrMetadataBytes, t.stats.MetadataBytes),
+	}
+	if t.stats.HeaderWireBytes > 0 {
+		attrs = append(attrs, attribute.Int64(spanAttrHeaderWireBytes, t.stats.HeaderWireBytes))
+	}
+	span.SetAttributes(attrs...)
+}
+
+// commit folds a finished RPC into the aggregated statistics
+func (h *wireStatsHandler) commit(rpc *rpcWireStats) {
+	key := rpc.Side + "|" + rpc.Method + "|" + rpc.JWTMode
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	agg, ok := h.entries[key]
+	if !ok {
+		agg = &rpcWireStats{Side: rpc.Side, Method: rpc.Method, JWTMode: rpc.JWTMode}
+		h.entries[key] = agg
+	}
+	agg.Calls += rpc.Calls
+	agg.Errors += rpc.Errors
+	agg.HeaderWireBytes += rpc.HeaderWireBytes
+	agg.MetadataBytes += rpc.MetadataBytes
+	agg.JWTMetadataBytes += rpc.JWTMetadataBytes
+	agg.PayloadWireIn += rpc.PayloadWireIn
+	agg.PayloadWireOut += rpc.PayloadWireOut
+}
+
+// Snapshot returns a copy of the aggregated statistics, sorted by side and method
+func (h *wireStatsHandler) Snapshot() []rpcWireStats {
+	h.mu.Lock()
+	out := make([]rpcWireStats, 0, len(h.entries))
+	for _, e := range h.entries {
+		out = append(out, *e)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Side != out[j].Side {
+			return out[i].Side < out[j].Side
+		}
+		if out[i].Method != out[j].Method {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].JWTMode < out[j].JWTMode
+	})
+	return out
+}
+
+// ServeHTTP renders the aggregated statistics as JSON
+func (h *wireStatsHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(h.Snapshot()); err != nil {
+		log.Warnf("failed to encode grpc stats: %v", err)
+	}
+}
+
+// isJWTMetadataKey reports whether a metadata key carries (part of) the JWT
+func isJWTMetadataKey(key string) bool {
+	switch key {
+	case "authorization", "x-jwt-header", "x-jwt-payload", "x-jwt-sig",
+		"x-jwt-claims", "x-jwt-static", "x-jwt-static-sha", "x-jwt-session", "x-jwt-dynamic",
+		"x-jwt-actor", "x-jwt-actor-header", "x-jwt-actor-payload", "x-jwt-actor-sig",
+		"x-jwt-payload-gz-bin", "x-jwt-cbor-bin", "x-jwt-pb-bin", "x-jwt-ref":
+		return true
+	}
+	return false
+}
+
+// jwtModeFromMetadata determines how the JWT was transmitted on an RPC
+func jwtModeFromMetadata(md metadata.MD) string {
+	if len(md.Get("x-jwt-payload")) > 0 || len(md.Get("x-jwt-claims")) > 0 {
+		return jwtModeCompressed
+	}
+	// Tokens sent through a jwtcodec codec other than full or plain-split
+	if len(md.Get("x-jwt-payload-gz-bin")) > 0 || len(md.Get("x-jwt-cbor-bin")) > 0 ||
+		len(md.Get("x-jwt-pb-bin")) > 0 || len(md.Get("x-jwt-ref")) > 0 {
+		return jwtModeCompressed
+	}
+	if len(md.Get("authorization")) > 0 {
+		return jwtModeFull
+	}
+	return jwtModeNone
+}
+
+// startChannelzServer serves the channelz service on CHANNELZ_PORT when set, since
+// the frontend has no gRPC server of its own to register it on
+func startChannelzServer() {
+	port := knobs.Value("CHANNELZ_PORT")
+	if port == "" {
+		return
+	}
+
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Warnf("failed to listen for channelz on :%s: %v", port, err)
+		return
+	}
+	srv := grpc.NewServer()
+	channelzservice.RegisterChannelzServiceToServer(srv)
+
+	go func() {
+		log.Infof("starting channelz server on :%s", port)
+		if err := srv.Serve(lis); err != nil {
+			log.Warnf("channelz server stopped: %v", err)
+		}
+	}()
+}
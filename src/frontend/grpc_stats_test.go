@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+)
+
+// TestWireStatsHandler runs RPCs through the stats handler events and checks
+// the aggregation per side, method and JWT mode
+func TestWireStatsHandler(t *testing.T) {
+	h := newWireStatsHandler()
+	rpc := func(method string, client bool, md metadata.MD, err error) {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: method})
+		if client {
+			h.HandleRPC(ctx, &stats.OutHeader{Client: true, Header: md})
+		} else {
+			h.HandleRPC(ctx, &stats.InHeader{Header: md, WireLength: 100})
+		}
+		h.HandleRPC(ctx, &stats.OutPayload{Client: client, WireLength: 10})
+		h.HandleRPC(ctx, &stats.InPayload{Client: client, WireLength: 20})
+		h.HandleRPC(ctx, &stats.End{Client: client, Error: err})
+	}
+	split := metadata.Pairs("x-jwt-header", "h", "x-jwt-payload", "{}", "x-jwt-sig", "s", "x-other", "v")
+	full := metadata.Pairs("authorization", "Bearer h.p.s")
+	// Sizes are key plus value: split is 38 bytes of JWT and 8 of x-other,
+	// full 25 bytes
+
+	rpc("/hipstershop.CheckoutService/PlaceOrder", true, split, nil)
+	rpc("/hipstershop.CheckoutService/PlaceOrder", true, split, errors.New("unavailable"))
+	rpc("/hipstershop.CheckoutService/PlaceOrder", true, full, nil)
+	rpc("/hipstershop.CartService/GetCart", false, metadata.MD{}, nil)
+	// Events of an RPC that was never tagged are ignored
+	h.HandleRPC(context.Background(), &stats.End{Client: true})
+
+	want := []rpcWireStats{
+		{Side: "client", Method: "/hipstershop.CheckoutService/PlaceOrder", JWTMode: jwtModeCompressed, Calls: 2, Errors: 1,
+			MetadataBytes: 2 * 46, JWTMetadataBytes: 2 * 38, PayloadWireIn: 40, PayloadWireOut: 20},
+		{Side: "client", Method: "/hipstershop.CheckoutService/PlaceOrder", JWTMode: jwtModeFull, Calls: 1,
+			MetadataBytes: 25, JWTMetadataBytes: 25, PayloadWireIn: 20, PayloadWireOut: 10},
+		{Side: "server", Method: "/hipstershop.CartService/GetCart", JWTMode: jwtModeNone, Calls: 1,
+			HeaderWireBytes: 100, PayloadWireIn: 20, PayloadWireOut: 10},
+	}
+	got := h.Snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d:\ngot  %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/grpcstats", nil))
+	var served []rpcWireStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || len(served) != len(want) {
+		t.Errorf("served %d entries, err %v: %s", len(served), err, rec.Body)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// HTTP/2 header capture
+//
+// With JWT_H2_CAPTURE_FILE set, every downstream connection is dialed through
+// a net.Conn wrapper that picks the HEADERS and CONTINUATION frames out of
+// what the client writes and appends their header block fragments to that
+// file. The blocks are the HPACK bytes as sent, so `jwtsplit hpack-analyze`
+// can replay each connection's dynamic table and report how well every
+// header key compressed over a run; capture one run per JWT mode to compare
+// them. The file holds live tokens: it is for test deployments only.
+// Plaintext connections only, so capture is off when xDS (and possibly mTLS)
+// is enabled.
+//
+// File format: the magic h2CaptureMagic, then one record per frame:
+//
+//	conn id  uint32   big endian, in dial order
+//	time     int64    unix nanoseconds
+//	stream   uint32
+//	type     uint8    0x1 HEADERS, 0x9 CONTINUATION
+//	flags    uint8    as sent; padding and priority are already stripped
+//	length   uint32
+//	fragment [length]byte
+
+const h2CaptureMagic = "H2HCAP1\n"
+
+const (
+	h2FrameHeaders      = 0x1
+	h2FrameContinuation = 0x9
+
+	h2FlagPadded   = 0x8
+	h2FlagPriority = 0x20
+)
+
+// h2ClientPreface is written once before the first frame of a connection
+const h2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+type h2CaptureWriter struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	f     *os.File
+	conns atomic.Uint32
+}
+
+// h2Capture is nil unless JWT_H2_CAPTURE_FILE is set
+var h2Capture *h2CaptureWriter
+
+// initH2Capture opens JWT_H2_CAPTURE_FILE; it must run before the
+// downstream connections are dialed
+func initH2Capture() {
+	h2Capture = newH2CaptureWriter(knobs.Value("JWT_H2_CAPTURE_FILE"))
+}
+
+func newH2CaptureWriter(path string) *h2CaptureWriter {
+	if path == "" {
+		return nil
+	}
+	if xdsEnabled {
+		log.Warn("[JWT-FLOW] HTTP/2 header capture disabled: connections may be encrypted with xDS")
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		log.Warnf("[JWT-FLOW] HTTP/2 header capture disabled: %v", err)
+		return nil
+	}
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(h2CaptureMagic); err != nil {
+		log.Warnf("[JWT-FLOW] HTTP/2 header capture disabled: %v", err)
+		f.Close()
+		return nil
+	}
+	log.Infof("[JWT-FLOW] Capturing HTTP/2 header blocks to %s", path)
+	return &h2CaptureWriter{w: w, f: f}
+}
+
+// h2CaptureDialOption dials through the capture wrapper when enabled
+func h2CaptureDialOption() grpc.DialOption {
+	if h2Capture == nil {
+		return grpc.EmptyDialOption{}
+	}
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return h2Capture.wrap(conn), nil
+	})
+}
+
+func (c *h2CaptureWriter) wrap(conn net.Conn) net.Conn {
+	return &h2CaptureConn{Conn: conn, capture: c, id: c.conns.Add(1), preface: len(h2ClientPreface)}
+}
+
+// record appends one frame's fragment and flushes, so a capture survives the
+// process being killed at the end of a run
+func (c *h2CaptureWriter) record(conn uint32, stream uint32, typ, flags byte, fragment []byte) {
+	var hdr [22]byte
+	binary.BigEndian.PutUint32(hdr[0:], conn)
+	binary.BigEndian.PutUint64(hdr[4:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[12:], stream)
+	hdr[16], hdr[17] = typ, flags
+	binary.BigEndian.PutUint32(hdr[18:], uint32(len(fragment)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Write(hdr[:])
+	c.w.Write(fragment)
+	if err := c.w.Flush(); err != nil {
+		log.Warnf("[JWT-FLOW] Failed to write HTTP/2 header capture: %v", err)
+	}
+}
+
+// h2CaptureConn parses the frames written to a client connection. Only frame
+// headers and header frames are buffered; other payloads are skipped.
+type h2CaptureConn struct {
+	net.Conn
+	capture *h2CaptureWriter
+	id      uint32
+
+	mu      sync.Mutex
+	preface int    // preface bytes still to skip
+	skip    int    // payload bytes of an uninteresting frame still to skip
+	buf     []byte // partial frame header or header frame
+}
+
+func (c *h2CaptureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	c.parse(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *h2CaptureConn) parse(p []byte) {
+	if c.preface > 0 {
+		k := min(c.preface, len(p))
+		c.preface -= k
+		p = p[k:]
+	}
+	for len(p) > 0 {
+		if c.skip > 0 {
+			k := min(c.skip, len(p))
+			c.skip -= k
+			p = p[k:]
+			continue
+		}
+		if len(c.buf) < 9 {
+			k := min(9-len(c.buf), len(p))
+			c.buf = append(c.buf, p[:k]...)
+			p = p[k:]
+			if len(c.buf) < 9 {
+				return
+			}
+			if typ := c.buf[3]; typ != h2FrameHeaders && typ != h2FrameContinuation {
+				c.skip = h2FrameLength(c.buf)
+				c.buf = c.buf[:0]
+			}
+			continue
+		}
+		want := 9 + h2FrameLength(c.buf)
+		k := min(want-len(c.buf), len(p))
+		c.buf = append(c.buf, p[:k]...)
+		p = p[k:]
+		if len(c.buf) == want {
+			c.emit(c.buf)
+			c.buf = c.buf[:0]
+		}
+	}
+	// A zero-length header frame is complete with its header
+	if len(c.buf) == 9 && h2FrameLength(c.buf) == 0 {
+		c.emit(c.buf)
+		c.buf = c.buf[:0]
+	}
+}
+
+func h2FrameLength(hdr []byte) int {
+	return int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+}
+
+// emit records a complete HEADERS or CONTINUATION frame
+func (c *h2CaptureConn) emit(frame []byte) {
+	typ, flags := frame[3], frame[4]
+	stream := binary.BigEndian.Uint32(frame[5:9]) & 0x7fffffff
+	fragment := frame[9:]
+	if typ == h2FrameHeaders {
+		pad := 0
+		if flags&h2FlagPadded != 0 && len(fragment) > 0 {
+			pad = int(fragment[0])
+			fragment = fragment[1:]
+		}
+		if flags&h2FlagPriority != 0 && len(fragment) >= 5 {
+			fragment = fragment[5:]
+		}
+		if pad > len(fragment) {
+			return
+		}
+		fragment = fragment[:len(fragment)-pad]
+		flags &^= h2FlagPadded | h2FlagPriority
+	}
+	c.capture.record(c.id, stream, typ, flags, fragment)
+}
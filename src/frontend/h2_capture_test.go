@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func h2Frame(typ, flags byte, stream uint32, payload []byte) []byte {
+	f := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(f[5:], stream)
+	return append(f, payload...)
+}
+
+func TestH2CaptureRecordsHeaderFrames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "h2.cap")
+	capture := newH2CaptureWriter(path)
+	if capture == nil {
+		t.Fatal("capture not enabled")
+	}
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	conn := capture.wrap(client)
+
+	var wire []byte
+	wire = append(wire, h2ClientPreface...)
+	wire = append(wire, h2Frame(0x4, 0, 0, make([]byte, 12))...) // SETTINGS
+	// HEADERS with 2 bytes of padding and a priority block
+	wire = append(wire, h2Frame(h2FrameHeaders, h2FlagPadded|h2FlagPriority, 1, append([]byte{2, 0, 0, 0, 0, 16}, 'a', 'b', 0, 0))...)
+	wire = append(wire, h2Frame(h2FrameContinuation, 0x4, 1, []byte("cd"))...)
+	wire = append(wire, h2Frame(0x0, 0x1, 1, make([]byte, 100))...) // DATA
+	wire = append(wire, h2Frame(h2FrameHeaders, 0x4|0x1, 3, []byte("ef"))...)
+
+	// Split writes across frame boundaries
+	for len(wire) > 0 {
+		n := min(7, len(wire))
+		if _, err := conn.Write(wire[:n]); err != nil {
+			t.Fatal(err)
+		}
+		wire = wire[n:]
+	}
+	conn.Close()
+	capture.f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(h2CaptureMagic)) {
+		t.Fatalf("capture starts with %q", data[:min(8, len(data))])
+	}
+	data = data[len(h2CaptureMagic):]
+	type rec struct {
+		stream   uint32
+		typ      byte
+		fragment string
+	}
+	var got []rec
+	for len(data) >= 22 {
+		if id := binary.BigEndian.Uint32(data); id != 1 {
+			t.Errorf("conn id %d, want 1", id)
+		}
+		n := binary.BigEndian.Uint32(data[18:])
+		got = append(got, rec{binary.BigEndian.Uint32(data[12:]), data[16], string(data[22 : 22+n])})
+		data = data[22+n:]
+	}
+	want := []rec{{1, h2FrameHeaders, "ab"}, {1, h2FrameContinuation, "cd"}, {3, h2FrameHeaders, "ef"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records %+v, want %+v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -43,9 +42,9 @@ type platformDetails struct {
 }
 
 var (
-	frontendMessage  = strings.TrimSpace(os.Getenv("FRONTEND_MESSAGE"))
-	isCymbalBrand    = "true" == strings.ToLower(os.Getenv("CYMBAL_BRANDING"))
-	assistantEnabled = "true" == strings.ToLower(os.Getenv("ENABLE_ASSISTANT"))
+	frontendMessage  = strings.TrimSpace(knobs.Value("FRONTEND_MESSAGE"))
+	isCymbalBrand    = "true" == strings.ToLower(knobs.Value("CYMBAL_BRANDING"))
+	assistantEnabled = "true" == strings.ToLower(knobs.Value("ENABLE_ASSISTANT"))
 	templates        = template.Must(template.New("").
 				Funcs(template.FuncMap{
 			"renderMoney":        renderMoney,
@@ -57,19 +56,27 @@ var (
 var validEnvs = []string{"local", "gcp", "azure", "aws", "onprem", "alibaba"}
 
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.WithField("currency", currentCurrency(r)).Info("home")
-	currencies, err := fe.getCurrencies(r.Context())
+	pf := fe.startPrefetch(r)
+	defer pf.Stop()
+	getCurrencies := prefetch(pf, r.Context(), fe.getCurrencies)
+	getProducts := prefetch(pf, r.Context(), fe.getProducts)
+	getCart := prefetch(pf, r.Context(), func(ctx context.Context) ([]*pb.CartItem, error) {
+		return fe.getCart(ctx, sessionID(r))
+	})
+
+	currencies, err := getCurrencies()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	products, err := fe.getProducts(r.Context())
+	products, err := getProducts()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	cart, err := getCart()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
@@ -90,7 +97,7 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set ENV_PLATFORM (default to local if not set; use env var if set; otherwise detect GCP, which overrides env)_
-	var env = os.Getenv("ENV_PLATFORM")
+	var env = knobs.Value("ENV_PLATFORM")
 	// Only override from env variable if set + valid env
 	if env == "" || stringinSlice(validEnvs, env) == false {
 		fmt.Println("env platform is either empty or invalid")
@@ -112,7 +119,7 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 		"currencies":    currencies,
 		"products":      ps,
 		"cart_size":     cartSize(cart),
-		"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
+		"banner_color":  knobs.Value("BANNER_COLOR"), // illustrates canary deployments
 		"ad":            fe.chooseAd(r.Context(), []string{}, log),
 	})); err != nil {
 		log.Error(err)
@@ -142,7 +149,7 @@ func (plat *platformDetails) setPlatformDetails(env string) {
 }
 
 func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	id := mux.Vars(r)["id"]
 	if id == "" {
 		renderHTTPError(log, r, w, errors.New("product id not specified"), http.StatusBadRequest)
@@ -151,18 +158,28 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 	log.WithField("id", id).WithField("currency", currentCurrency(r)).
 		Debug("serving product page")
 
+	pf := fe.startPrefetch(r)
+	defer pf.Stop()
+	getCurrencies := prefetch(pf, r.Context(), fe.getCurrencies)
+	getCart := prefetch(pf, r.Context(), func(ctx context.Context) ([]*pb.CartItem, error) {
+		return fe.getCart(ctx, sessionID(r))
+	})
+	getRecommendations := prefetch(pf, r.Context(), func(ctx context.Context) ([]*pb.Product, error) {
+		return fe.getRecommendations(ctx, sessionID(r), []string{id})
+	})
+
 	p, err := fe.getProduct(r.Context(), id)
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
 	}
-	currencies, err := fe.getCurrencies(r.Context())
+	currencies, err := getCurrencies()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
 
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	cart, err := getCart()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
@@ -175,7 +192,7 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// ignores the error retrieving recommendations since it is not critical
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), []string{id})
+	recommendations, err := getRecommendations()
 	if err != nil {
 		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
@@ -209,7 +226,7 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
 	productID := r.FormValue("product_id")
 	payload := validator.AddToCartPayload{
@@ -237,7 +254,7 @@ func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("emptying cart")
 
 	if err := fe.emptyCart(r.Context(), sessionID(r)); err != nil {
@@ -249,14 +266,21 @@ func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("view user cart")
-	currencies, err := fe.getCurrencies(r.Context())
+	pf := fe.startPrefetch(r)
+	defer pf.Stop()
+	getCurrencies := prefetch(pf, r.Context(), fe.getCurrencies)
+	getCart := prefetch(pf, r.Context(), func(ctx context.Context) ([]*pb.CartItem, error) {
+		return fe.getCart(ctx, sessionID(r))
+	})
+
+	currencies, err := getCurrencies()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	cart, err := getCart()
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
@@ -318,7 +342,7 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("placing order")
 
 	var (
@@ -416,8 +440,11 @@ func (fe *frontendServer) assistantHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (fe *frontendServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("logging out")
+	oidcSessions.Delete(sessionID(r))
+	claims, _ := getJWTFromContext(r.Context())
+	revokeSession(r.Context(), sessionID(r), claims)
 	for _, c := range r.Cookies() {
 		c.Expires = time.Now().Add(-time.Hour * 24 * 365)
 		c.MaxAge = -1
@@ -449,7 +476,7 @@ func (fe *frontendServer) getProductByID(w http.ResponseWriter, r *http.Request)
 }
 
 func (fe *frontendServer) chatBotHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	type Response struct {
 		Message string `json:"message"`
 	}
@@ -497,7 +524,7 @@ func (fe *frontendServer) chatBotHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	cur := r.FormValue("currency_code")
 	payload := validator.SetCurrencyPayload{Currency: cur}
 	if err := payload.Validate(); err != nil {
@@ -534,6 +561,10 @@ func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string, log lo
 }
 
 func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
+	if f, reason, ok := downstreamAuthFailure(err); ok {
+		renderAuthFailure(log, r, w, err, f, reason)
+		return
+	}
 	log.WithField("error", err).Error("request error")
 	errMsg := fmt.Sprintf("%+v", err)
 
@@ -550,17 +581,23 @@ func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWri
 
 func injectCommonTemplateData(r *http.Request, payload map[string]interface{}) map[string]interface{} {
 	data := map[string]interface{}{
-		"session_id":        sessionID(r),
-		"request_id":        r.Context().Value(ctxKeyRequestID{}),
-		"user_currency":     currentCurrency(r),
-		"platform_css":      plat.css,
-		"platform_name":     plat.provider,
-		"is_cymbal_brand":   isCymbalBrand,
-		"assistant_enabled": assistantEnabled,
-		"deploymentDetails": deploymentDetailsMap,
-		"frontendMessage":   frontendMessage,
-		"currentYear":       time.Now().Year(),
-		"baseUrl":           baseUrl,
+		"session_id":            sessionID(r),
+		"request_id":            r.Context().Value(ctxKeyRequestID{}),
+		"user_currency":         currentCurrency(r),
+		"locale":                currentLocale(r),
+		"platform_css":          plat.css,
+		"platform_name":         plat.provider,
+		"is_cymbal_brand":       isCymbalBrand,
+		"assistant_enabled":     assistantEnabled,
+		"order_history_enabled": orderHistoryEnabled,
+		"deploymentDetails":     deploymentDetailsMap,
+		"frontendMessage":       frontendMessage,
+		"currentYear":           time.Now().Year(),
+		"baseUrl":               baseUrl,
+		"csrf_token":            csrfToken(r),
+		"oidc_enabled":          oidc != nil,
+		"user_name":             oidcUserName(r),
+		"features":              featuresFor(r.Context()),
 	}
 
 	for k, v := range payload {
@@ -570,14 +607,6 @@ func injectCommonTemplateData(r *http.Request, payload map[string]interface{}) m
 	return data
 }
 
-func currentCurrency(r *http.Request) string {
-	c, _ := r.Cookie(cookieCurrency)
-	if c != nil {
-		return c.Value
-	}
-	return defaultCurrency
-}
-
 func sessionID(r *http.Request) string {
 	v := r.Context().Value(ctxKeySessionID{})
 	if v != nil {
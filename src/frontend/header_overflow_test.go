@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestHeaderOverflowFallback checks that a call refused for its split
+// headers is retried with the Bearer token, and that the next call with a
+// token as large skips the split headers altogether
+func TestHeaderOverflowFallback(t *testing.T) {
+	const token = "eyJhbGciOiJIUzI1NiJ9.eyJhIjoieCJ9.c2ln"
+	var sent []metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		sent = append(sent, md)
+		if len(md.Get("x-jwt-payload")) > 0 {
+			return status.Error(codes.Internal, "header list size to send violates the maximum size (1024 bytes) set by server")
+		}
+		return nil
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(
+		"x-jwt-header", "eyJhbGciOiJIUzI1NiJ9", "x-jwt-payload", `{"a":"x"}`, "x-jwt-sig", "c2ln", "traceparent", "t"))
+	call := overflowInvoker(invoker, token)
+	const method = "/hipstershop.OverflowService/Get"
+
+	if err := call(ctx, method, nil, nil, nil); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("sent %d calls, want the split call and one retry", len(sent))
+	}
+	retry := sent[1]
+	if a := retry.Get("authorization"); len(a) != 1 || a[0] != "Bearer "+token || len(retry.Get("x-jwt-sig")) != 0 || len(retry.Get("traceparent")) != 1 {
+		t.Errorf("retry metadata = %v, want authorization and the other headers kept", retry)
+	}
+
+	sent = nil
+	if err := call(ctx, method, nil, nil, nil); err != nil || len(sent) != 1 || len(sent[0].Get("authorization")) != 1 {
+		t.Errorf("second call: err=%v sent=%v, want one call with authorization", err, sent)
+	}
+
+	if isHeaderOverflow(status.Error(codes.ResourceExhausted, "quota exceeded")) {
+		t.Error("an application RESOURCE_EXHAUSTED was taken for a header overflow")
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// jwksMaxAge bounds how long verifiers cache the key set; shorter than the
+// keyring refresh so a rotated key reaches them before tokens signed with it
+// are common
+const jwksMaxAge = "max-age=300"
+
+// jwksHandler publishes the public signing keys at /.well-known/jwks.json:
+// the current key first, then the one it replaced, so verifiers accept
+// tokens issued just before a rotation
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set := keyring.JSONWebKeySet{Keys: []keyring.JSONWebKey{}}
+	for _, pub := range signingKeys.PublicKeys() {
+		set.Keys = append(set.Keys, keyring.NewJWK(pub))
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", jwksMaxAge)
+	if err := json.NewEncoder(w).Encode(set); err != nil {
+		log.Warnf("[JWT-FLOW] Failed to write JWKS: %v", err)
+	}
+}
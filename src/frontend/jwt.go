@@ -17,66 +17,85 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
 )
 
 const (
 	cookieJWT = cookiePrefix + "jwt"
+	demoUserEmail = "someone@example.com"
 	jwtIssuer = "https://auth.hipstershop.com"
 	jwtAudience = "urn:hipstershop:api"
 )
 
-var (
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-)
+// signingKeys signs issued tokens and verifies returning ones; tokens signed
+// with the key it rotated away from keep verifying until they expire
+var signingKeys *keyring.Keyring
 
 type JWTClaims struct {
-	SessionID   string `json:"session_id"`
-	Name        string `json:"name"`
-	MarketID    string `json:"market_id"`
-	Currency    string `json:"currency"`
-	CartID      string `json:"cart_id"`
-	RandomValue string `json:"random_value"` // Added random value to ensure uniqueness
+	SessionID   string   `json:"session_id"`
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	MarketID    string   `json:"market_id"`
+	Currency    string   `json:"currency"`
+	CartID      string   `json:"cart_id"`
+	RandomValue string   `json:"random_value"`     // Added random value to ensure uniqueness
+	Groups      []string `json:"groups,omitempty"` // IdP sessions only, see groups_overflow.go
+	Locale      string   `json:"locale,omitempty"` // IdP sessions only, see locale.go
 	jwt.RegisteredClaims
+	Cnf *jwtConfirmation `json:"cnf,omitempty"` // JWT_TOKEN_BINDING only, see transport_tls.go
 }
 
 type ctxKeyJWT struct{}
 type ctxKeyJWTToken struct{}
 
-// loadRSAKeys loads the RSA private and public keys from PEM files
-func loadRSAKeys() error {
-	// Load private key
-	privateKeyData, err := os.ReadFile("jwt_private_key.pem")
+// loadRSAKeys loads the RSA signing key from the source selected by
+// JWT_PRIVATE_KEY_SOURCE (jwt_private_key.pem by default) and refreshes it
+// every JWT_KEY_REFRESH_INTERVAL
+func loadRSAKeys(ctx context.Context) error {
+	loader, err := keyring.FromEnv("JWT_PRIVATE_KEY", "jwt_private_key.pem")
 	if err != nil {
-		return fmt.Errorf("failed to read private key: %w", err)
+		return err
 	}
-
-	privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(privateKeyData)
+	keys, err := keyring.New(ctx, loader)
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return err
+	}
+	if keys.PrivateKey() == nil {
+		return fmt.Errorf("%s holds a public key, the frontend needs a private key to sign tokens", keys.Source())
 	}
+	keys.OnRotate(func(k *keyring.Keyring) {
+		log.Infof("[JWT-FLOW] JWT signing key rotated from %s", k.Source())
+	})
+	signingKeys = keys
 
-	// Load public key
-	publicKeyData, err := os.ReadFile("jwt_public_key.pem")
-	if err != nil {
-		return fmt.Errorf("failed to read public key: %w", err)
+	if interval := keyRefreshInterval(); interval > 0 {
+		go keys.Watch(ctx, interval, func(err error) {
+			log.Warnf("[JWT-FLOW] Failed to refresh JWT signing key: %v", err)
+		})
 	}
+	return nil
+}
 
-	publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
+// keyRefreshInterval reads JWT_KEY_REFRESH_INTERVAL; 0 disables refreshing
+func keyRefreshInterval() time.Duration {
+	v := knobs.Value("JWT_KEY_REFRESH_INTERVAL")
+	if v == "" {
+		return time.Minute
+	}
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		return fmt.Errorf("failed to parse public key: %w", err)
+		return time.Minute
 	}
-
-	return nil
+	return d
 }
 
 // generateJWT creates a new JWT token with the given session ID and currency
@@ -98,6 +117,7 @@ func generateJWT(sessionID, currency string) (string, error) {
 	claims := JWTClaims{
 		SessionID:   sessionID,  // Stable: matches shop_session-id cookie
 		Name:        "Jane Doe",
+		Email:       demoUserEmail, // Checkout sends confirmations here, not to the form value
 		MarketID:    "US",
 		Currency:    currency,
 		CartID:      fmt.Sprintf("cart-%s", sessionID), // Stable: derived from session ID
@@ -110,10 +130,10 @@ func generateJWT(sessionID, currency string) (string, error) {
 			IssuedAt:  jwt.NewNumericDate(now),
 			ID:        jti.String(),
 		},
+		Cnf: tokenConfirmation,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(privateKey)
+	tokenString, err := signJWT(claims)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
@@ -121,21 +141,45 @@ func generateJWT(sessionID, currency string) (string, error) {
 	return tokenString, nil
 }
 
+// signJWT signs claims with the current key, naming it in the kid header so
+// verifiers using the JWKS can pick the right key across a rotation
+func signJWT(claims jwt.Claims) (string, error) {
+	key := signingKeys.PrivateKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyring.KeyID(&key.PublicKey)
+	return token.SignedString(key)
+}
+
 // validateJWT validates a JWT token and returns the claims if valid
 func validateJWT(tokenString string) (*JWTClaims, error) {
+	if err := verifyNegativeCache.Lookup(tokenString); err != nil {
+		return nil, err
+	}
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		// Verify the signing method
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return publicKey, nil
+		var keys jwt.VerificationKeySet
+		for _, k := range signingKeys.PublicKeys() {
+			keys.Keys = append(keys.Keys, k)
+		}
+		return keys, nil
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse token: %w", err)
+		err = fmt.Errorf("failed to parse token: %w", err)
+		// Expiry is routine renewal, only bad tokens are worth remembering
+		if !errors.Is(err, jwt.ErrTokenExpired) {
+			verifyNegativeCache.Add(tokenString, err)
+		}
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
+		if revocations.Revoked(claims.ID, claims.SessionID) {
+			return nil, errTokenRevoked
+		}
 		return claims, nil
 	}
 
@@ -144,8 +188,7 @@ func validateJWT(tokenString string) (*JWTClaims, error) {
 
 // generateJWTFromClaims regenerates a JWT token from existing claims
 func generateJWTFromClaims(claims *JWTClaims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(privateKey)
+	tokenString, err := signJWT(claims)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
@@ -155,24 +198,49 @@ func generateJWTFromClaims(claims *JWTClaims) (string, error) {
 // ensureJWT middleware ensures that a valid JWT exists for the request
 func ensureJWT(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Sessions logged in through the IdP forward its token instead
+		if idpToken, idpClaims, ok := oidcClaimsFor(r); ok {
+			ctx := context.WithValue(r.Context(), ctxKeyJWTToken{}, idpToken)
+			ctx = context.WithValue(ctx, ctxKeyJWT{}, idpClaims)
+			accessFromContext(ctx).token("oidc", idpClaims, true, 0)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		var tokenString string
 		var claims *JWTClaims
 		var needNewToken bool = false
+		source := "cookie"
+		var verify time.Duration
 
 		// Try to get JWT from cookie
 		c, err := r.Cookie(cookieJWT)
 		if err == http.ErrNoCookie {
 			needNewToken = true
+			source = "issued"
 		} else if err != nil {
 			http.Error(w, "Error reading JWT cookie", http.StatusInternalServerError)
 			return
 		} else {
 			tokenString = c.Value
 			// Validate existing token
+			start := time.Now()
 			claims, err = validateJWT(tokenString)
-			if err != nil {
+			verify = time.Since(start)
+			if err == nil && renewalRequests.Take(claims.SessionID) {
+				// A downstream found it expired (token_renewal.go)
+				needNewToken = true
+				source = "renewed"
+				tokenRenewals.Add("renewed", 1)
+			} else if err != nil {
 				// Token is invalid or expired, need new one
 				needNewToken = true
+				source = "renewed"
+				// Expiry is routine renewal and a revoked token a logged
+				// out user; anything else burns the error budget
+				if !errors.Is(err, jwt.ErrTokenExpired) && !errors.Is(err, errTokenRevoked) {
+					jwtSLO.RecordFailure(sloReasonVerification)
+				}
 			}
 		}
 
@@ -191,6 +259,7 @@ func ensureJWT(next http.Handler) http.HandlerFunc {
 			
 			// Validate to get claims
 			claims, _ = validateJWT(tokenString)
+			notifyTokenMinted(sessionID, tokenString, claims)
 
 			// Set JWT cookie
 			http.SetCookie(w, &http.Cookie{
@@ -206,6 +275,7 @@ func ensureJWT(next http.Handler) http.HandlerFunc {
 		ctx := context.WithValue(r.Context(), ctxKeyJWTToken{}, tokenString)
 		ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
 		r = r.WithContext(ctx)
+		accessFromContext(ctx).token(source, claims, claims != nil, verify)
 
 		next.ServeHTTP(w, r)
 	}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Malformed JWT metadata
+//
+// The jwt_* error types corrupt the JWT headers of a call instead of failing
+// it, to check that receivers refuse or degrade gracefully and that their
+// reassembly metrics and SLO alerts fire:
+//
+//	jwt_truncate_signature  cut x-jwt-sig (or the signature of the token) in half
+//	jwt_drop_session        remove the x-jwt-session claim block
+//	jwt_flip_payload        flip a bit in the payload
+//	jwt_corrupt             one of the above at random
+//
+// They follow ERROR_INJECTION_RATE, ERROR_INJECTION_TARGET and
+// ERROR_INJECTION_CLAIMS like the other types and can be used in chaos
+// scenario phases. The error injection interceptor only marks the call; the
+// headers are corrupted after jwtUnaryClientInterceptor has written them.
+
+const (
+	jwtCorruptTruncateSignature = "jwt_truncate_signature"
+	jwtCorruptDropSession       = "jwt_drop_session"
+	jwtCorruptFlipPayload       = "jwt_flip_payload"
+	jwtCorruptRandom            = "jwt_corrupt"
+)
+
+var jwtCorruptionModes = []string{jwtCorruptTruncateSignature, jwtCorruptDropSession, jwtCorruptFlipPayload}
+
+// jwtCorruptions counts corrupted calls by mode; "skipped" counts calls that
+// carried nothing the mode could corrupt
+var jwtCorruptions = expvar.NewMap("jwt_chaos_corruptions")
+
+type ctxKeyJWTCorruption struct{}
+
+func isJWTCorruption(errorType string) bool {
+	return strings.HasPrefix(errorType, "jwt_")
+}
+
+// withJWTCorruption marks the call for corruption by mode
+func withJWTCorruption(ctx context.Context, mode string) context.Context {
+	if mode == jwtCorruptRandom {
+		mode = jwtCorruptionModes[randSource.Intn(len(jwtCorruptionModes))]
+	}
+	return context.WithValue(ctx, ctxKeyJWTCorruption{}, mode)
+}
+
+// corruptOutgoingJWT applies the corruption the call was marked for
+func corruptOutgoingJWT(ctx context.Context, method string) context.Context {
+	mode, _ := ctx.Value(ctxKeyJWTCorruption{}).(string)
+	if mode == "" {
+		return ctx
+	}
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		jwtCorruptions.Add("skipped", 1)
+		return ctx
+	}
+	md = md.Copy()
+	if !corruptJWTMetadata(md, mode) {
+		jwtCorruptions.Add("skipped", 1)
+		return ctx
+	}
+	jwtCorruptions.Add(mode, 1)
+	errInjLog.Warnf("[ERROR-INJECTION] 🔴 Injecting %s into JWT metadata for method: %s", mode, method)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// corruptJWTMetadata corrupts md in place and reports whether it found
+// something to corrupt
+func corruptJWTMetadata(md metadata.MD, mode string) bool {
+	switch mode {
+	case jwtCorruptTruncateSignature:
+		if sig := md.Get("x-jwt-sig"); len(sig) > 0 {
+			md.Set("x-jwt-sig", sig[0][:len(sig[0])/2])
+			return true
+		}
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			i := strings.LastIndex(auth[0], ".")
+			sig := auth[0][i+1:]
+			md.Set("authorization", auth[0][:i+1]+sig[:len(sig)/2])
+			return true
+		}
+		return corruptBinaryCodec(md, func(v string) string { return v[:len(v)/2] })
+	case jwtCorruptDropSession:
+		if len(md.Get("x-jwt-session")) == 0 {
+			return false
+		}
+		md.Delete("x-jwt-session")
+		return true
+	case jwtCorruptFlipPayload:
+		for _, key := range []string{"x-jwt-payload", "x-jwt-dynamic", "x-jwt-session", "x-jwt-claims"} {
+			if v := md.Get(key); len(v) > 0 && v[0] != "" {
+				md.Set(key, flipByte(v[0], len(v[0])/2))
+				return true
+			}
+		}
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			parts := strings.Split(auth[0], ".")
+			if len(parts) == 3 && parts[1] != "" {
+				// Swap a base64url character so the payload still decodes
+				i := len(parts[1]) / 2
+				c := byte('A')
+				if parts[1][i] == 'A' {
+					c = 'B'
+				}
+				parts[1] = parts[1][:i] + string(c) + parts[1][i+1:]
+				md.Set("authorization", strings.Join(parts, "."))
+				return true
+			}
+		}
+		return corruptBinaryCodec(md, func(v string) string { return flipByte(v, len(v)/2) })
+	}
+	return false
+}
+
+// corruptBinaryCodec applies corrupt to the token carried by a wire codec
+func corruptBinaryCodec(md metadata.MD, corrupt func(string) string) bool {
+	for key, v := range md {
+		if strings.HasPrefix(key, "x-jwt-") && strings.HasSuffix(key, "-bin") && len(v) > 0 && v[0] != "" {
+			md.Set(key, corrupt(v[0]))
+			return true
+		}
+	}
+	return false
+}
+
+func flipByte(s string, i int) string {
+	b := []byte(s)
+	b[i] ^= 0x01
+	return string(b)
+}
+
+// jwtCorruptionUnaryClientInterceptor runs between the JWT interceptor and
+// the transport
+func jwtCorruptionUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(corruptOutgoingJWT(ctx, method), method, req, reply, cc, opts...)
+	}
+}
+
+// jwtCorruptionStreamClientInterceptor runs between the JWT interceptor and
+// the transport
+func jwtCorruptionStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(corruptOutgoingJWT(ctx, method), desc, cc, method, opts...)
+	}
+}
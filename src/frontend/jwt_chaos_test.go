@@ -0,0 +1,63 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJWTCorruption(t *testing.T) {
+	defer func(l *logrus.Logger) { errInjLog = l }(errInjLog)
+	errInjLog = logrus.New()
+
+	split := func() metadata.MD {
+		return metadata.Pairs("x-jwt-header", "eyJhbGciOiJSUzI1NiJ9", "x-jwt-payload", `{"sub":"u"}`,
+			"x-jwt-session", `{"session_id":"s"}`, "x-jwt-sig", "c2lnbmF0dXJl")
+	}
+
+	ctx := withJWTCorruption(metadata.NewOutgoingContext(context.Background(), split()), jwtCorruptTruncateSignature)
+	md, _ := metadata.FromOutgoingContext(corruptOutgoingJWT(ctx, "/hipstershop.ShippingService/GetQuote"))
+	if got := md.Get("x-jwt-sig")[0]; got != "c2lnbm" {
+		t.Errorf("truncated signature = %q, want c2lnbm", got)
+	}
+
+	md = split()
+	if !corruptJWTMetadata(md, jwtCorruptDropSession) || len(md.Get("x-jwt-session")) != 0 {
+		t.Errorf("x-jwt-session not dropped: %v", md)
+	}
+
+	md = split()
+	if !corruptJWTMetadata(md, jwtCorruptFlipPayload) || md.Get("x-jwt-payload")[0] == `{"sub":"u"}` {
+		t.Errorf("payload not flipped: %v", md.Get("x-jwt-payload"))
+	}
+
+	md = metadata.Pairs("authorization", "Bearer aaa.bbbb.cccc")
+	if !corruptJWTMetadata(md, jwtCorruptTruncateSignature) || md.Get("authorization")[0] != "Bearer aaa.bbbb.cc" {
+		t.Errorf("authorization signature not truncated: %v", md.Get("authorization"))
+	}
+	if corruptJWTMetadata(md, jwtCorruptDropSession) {
+		t.Error("drop session reported a corruption without x-jwt-session")
+	}
+
+	// Unmarked calls pass through untouched
+	ctx = metadata.NewOutgoingContext(context.Background(), split())
+	if got := corruptOutgoingJWT(ctx, "/hipstershop.ShippingService/GetQuote"); got != ctx {
+		t.Error("unmarked call was rewritten")
+	}
+}
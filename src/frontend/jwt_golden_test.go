@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// goldenJWTFile is shared by the frontend, checkout and shipping tests so the
+// service copies of the JWT codec cannot drift apart unnoticed.
+const goldenJWTFile = "../../test-suite/golden/jwt_golden.json"
+
+type goldenJWT struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	Header    string `json:"header"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func loadGoldenJWTs(t *testing.T) []goldenJWT {
+	t.Helper()
+	data, err := os.ReadFile(goldenJWTFile)
+	if err != nil {
+		t.Fatalf("failed to read golden JWTs: %v", err)
+	}
+	var golden []goldenJWT
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatalf("failed to parse golden JWTs: %v", err)
+	}
+	return golden
+}
+
+// TestGoldenDecompose checks this service's DecomposeJWT against the golden components.
+func TestGoldenDecompose(t *testing.T) {
+	for _, g := range loadGoldenJWTs(t) {
+		c, err := DecomposeJWT(g.Token)
+		if err != nil {
+			t.Errorf("%s: DecomposeJWT failed: %v", g.Name, err)
+			continue
+		}
+		if c.Header != g.Header || c.Payload != g.Payload || c.Signature != g.Signature {
+			t.Errorf("%s: DecomposeJWT = %+v, want header=%q payload=%q signature=%q", g.Name, c, g.Header, g.Payload, g.Signature)
+		}
+	}
+}
+
+// TestGoldenClientInterceptor checks that the frontend sends exactly the golden
+// components when compression is enabled and the full token otherwise.
+func TestGoldenClientInterceptor(t *testing.T) {
+	// Golden tokens include deliberately tiny ones; split them all
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+	jwtSplitMinBytes = 0
+
+	for _, g := range loadGoldenJWTs(t) {
+		ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, g.Token)
+		var out metadata.MD
+		invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			out, _ = metadata.FromOutgoingContext(ctx)
+			return nil
+		}
+
+		t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+		if err := jwtUnaryClientInterceptor()(ctx, "/hipstershop.CartService/GetCart", nil, nil, nil, invoker); err != nil {
+			t.Fatalf("%s: interceptor failed: %v", g.Name, err)
+		}
+		if h, p, s := out.Get("x-jwt-header"), out.Get("x-jwt-payload"), out.Get("x-jwt-sig"); len(h) != 1 || len(p) != 1 || len(s) != 1 ||
+			h[0] != g.Header || p[0] != g.Payload || s[0] != g.Signature {
+			t.Errorf("%s: compressed metadata = %v, want golden components", g.Name, out)
+		}
+
+		t.Setenv("ENABLE_JWT_COMPRESSION", "false")
+		if err := jwtUnaryClientInterceptor()(ctx, "/hipstershop.CartService/GetCart", nil, nil, nil, invoker); err != nil {
+			t.Fatalf("%s: interceptor failed: %v", g.Name, err)
+		}
+		if a := out.Get("authorization"); len(a) != 1 || a[0] != "Bearer "+g.Token {
+			t.Errorf("%s: uncompressed metadata = %v, want authorization header", g.Name, out)
+		}
+	}
+}
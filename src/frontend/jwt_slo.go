@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Failure reasons tracked against the JWT error budget
+const (
+	sloReasonReassembly   = "reassembly"   // Decompose/reassemble of split JWT failed
+	sloReasonVerification = "verification" // Signature or claims verification failed
+	sloReasonMissingJWT   = "missing_jwt"  // Method requires a JWT but none was present
+)
+
+const (
+	sloBuckets       = 60 // Sliding window resolution
+	sloMinEvents     = 20 // Don't judge the burn rate on fewer events than this
+	defaultSLOTarget = 0.999
+	defaultSLOWindow = 5 * time.Minute
+	defaultSLOBurn   = 10.0
+)
+
+// jwtSLO is the process-wide tracker for JWT pipeline failures
+var jwtSLO = newJWTSLOTracker()
+
+// Degraded mode only raises the alert: nothing is shed or bypassed while it
+// lasts. Failing JWTs are already refused one by one, and taking the replica
+// out of rotation would only move the same traffic to its peers. Alert on
+// jwt_slo_degraded and use /debug/jwtslo to see which reason is burning.
+var (
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jwt_slo_degraded",
+		Help: "1 while the JWT error budget burns faster than JWT_SLO_BURN_RATE, 0 otherwise.",
+	}, func() float64 {
+		if jwtSLO.Degraded() {
+			return 1
+		}
+		return 0
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jwt_slo_burn_rate",
+		Help: "JWT failure ratio over JWT_SLO_WINDOW divided by the error budget.",
+	}, func() float64 {
+		return jwtSLO.Status().BurnRate
+	})
+)
+
+type sloBucket struct {
+	start    time.Time
+	total    int64
+	failures map[string]int64
+}
+
+// jwtSLOTracker measures the auth pipeline failure rate over a sliding window and
+// flips into degraded mode when the error budget burns faster than allowed
+type jwtSLOTracker struct {
+	mu        sync.Mutex
+	target    float64       // Success ratio objective, e.g. 0.999
+	window    time.Duration // Evaluation window
+	burnLimit float64       // Burn rate (failure ratio / budget) that triggers degradation
+	buckets   [sloBuckets]sloBucket
+	degraded  bool
+	since     time.Time
+}
+
+// jwtSLOStatus is the JSON view of the tracker state
+type jwtSLOStatus struct {
+	Target    float64          `json:"target"`
+	Window    string           `json:"window"`
+	BurnLimit float64          `json:"burn_limit"`
+	Total     int64            `json:"total"`
+	Failures  map[string]int64 `json:"failures"`
+	BurnRate  float64          `json:"burn_rate"`
+	Degraded  bool             `json:"degraded"`
+	Since     time.Time        `json:"since"`
+}
+
+// newJWTSLOTracker creates a tracker configured from JWT_SLO_TARGET,
+// JWT_SLO_WINDOW and JWT_SLO_BURN_RATE
+func newJWTSLOTracker() *jwtSLOTracker {
+	t := &jwtSLOTracker{
+		target:    defaultSLOTarget,
+		window:    defaultSLOWindow,
+		burnLimit: defaultSLOBurn,
+	}
+	if v, err := strconv.ParseFloat(knobs.Value("JWT_SLO_TARGET"), 64); err == nil && v > 0 && v < 1 {
+		t.target = v
+	}
+	if v, err := time.ParseDuration(knobs.Value("JWT_SLO_WINDOW")); err == nil && v > 0 {
+		t.window = v
+	}
+	if v, err := strconv.ParseFloat(knobs.Value("JWT_SLO_BURN_RATE"), 64); err == nil && v > 0 {
+		t.burnLimit = v
+	}
+	return t
+}
+
+// RecordSuccess counts a successfully handled JWT
+func (t *jwtSLOTracker) RecordSuccess() {
+	t.record("")
+}
+
+// RecordFailure counts a JWT pipeline failure with the given reason
+func (t *jwtSLOTracker) RecordFailure(reason string) {
+	t.record(reason)
+}
+
+// Degraded reports whether the error budget is currently burning too fast
+func (t *jwtSLOTracker) Degraded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.degraded
+}
+
+func (t *jwtSLOTracker) record(reason string) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(now)
+	b.total++
+	if reason != "" {
+		b.failures[reason]++
+	}
+	t.evaluate(now)
+}
+
+// bucketFor returns the bucket covering now, recycling it if it is stale
+func (t *jwtSLOTracker) bucketFor(now time.Time) *sloBucket {
+	width := t.window / sloBuckets
+	start := now.Truncate(width)
+	b := &t.buckets[(start.UnixNano()/int64(width))%sloBuckets]
+	if !b.start.Equal(start) {
+		b.start = start
+		b.total = 0
+		b.failures = make(map[string]int64)
+	}
+	return b
+}
+
+// totals sums the buckets that fall inside the window
+func (t *jwtSLOTracker) totals(now time.Time) (int64, map[string]int64) {
+	var total int64
+	failures := make(map[string]int64)
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if b.start.IsZero() || now.Sub(b.start) >= t.window {
+			continue
+		}
+		total += b.total
+		for r, n := range b.failures {
+			failures[r] += n
+		}
+	}
+	return total, failures
+}
+
+// burnRate is the failure ratio divided by the allowed failure ratio
+func (t *jwtSLOTracker) burnRate(total int64, failures map[string]int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	var failed int64
+	for _, n := range failures {
+		failed += n
+	}
+	return (float64(failed) / float64(total)) / (1 - t.target)
+}
+
+// evaluate flips the degradation flag; enter at the burn limit, leave once
+// the burn rate is back within budget
+func (t *jwtSLOTracker) evaluate(now time.Time) {
+	total, failures := t.totals(now)
+	if total < sloMinEvents {
+		return
+	}
+	burn := t.burnRate(total, failures)
+
+	if !t.degraded && burn >= t.burnLimit {
+		t.degraded = true
+		t.since = now
+		log.Errorf("[JWT-SLO] error budget burning at %.1fx (limit %.1fx) over %v: %v - entering degraded mode",
+			burn, t.burnLimit, t.window, failures)
+	} else if t.degraded && burn < 1 {
+		t.degraded = false
+		log.Infof("[JWT-SLO] burn rate back to %.2fx after %v - leaving degraded mode", burn, now.Sub(t.since))
+		t.since = time.Time{}
+	}
+}
+
+// Status returns the current tracker state
+func (t *jwtSLOTracker) Status() jwtSLOStatus {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total, failures := t.totals(now)
+	return jwtSLOStatus{
+		Target:    t.target,
+		Window:    t.window.String(),
+		BurnLimit: t.burnLimit,
+		Total:     total,
+		Failures:  failures,
+		BurnRate:  t.burnRate(total, failures),
+		Degraded:  t.degraded,
+		Since:     t.since,
+	}
+}
+
+// ServeHTTP renders the tracker state as JSON
+func (t *jwtSLOTracker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t.Status()); err != nil {
+		log.Warnf("failed to encode JWT SLO status: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestJWTSLOBurnRate checks that the tracker enters degraded mode at the burn
+// limit, only once enough events were seen, and leaves it once the burn rate
+// is back within budget
+func TestJWTSLOBurnRate(t *testing.T) {
+	// A 25% error budget: half the calls failing burns it at 2x
+	slo := &jwtSLOTracker{target: 0.75, window: time.Minute, burnLimit: 2}
+	for i := 0; i < sloMinEvents/2-1; i++ {
+		slo.RecordSuccess()
+		slo.RecordFailure(sloReasonVerification)
+	}
+	if slo.Degraded() {
+		t.Fatalf("degraded after %d events, fewer than %d", sloMinEvents-2, sloMinEvents)
+	}
+	slo.RecordSuccess()
+	slo.RecordFailure(sloReasonMissingJWT)
+	if !slo.Degraded() {
+		t.Fatalf("not degraded at burn rate %.2f", slo.Status().BurnRate)
+	}
+
+	// 10 failures in 40 calls is exactly the budget, still degraded; one
+	// more success brings the burn rate below 1
+	for i := 0; i < 20; i++ {
+		slo.RecordSuccess()
+	}
+	if st := slo.Status(); !st.Degraded || st.Total != 40 || st.BurnRate != 1 {
+		t.Fatalf("at the budget: got %+v, want degraded with 40 events at 1x", st)
+	}
+	slo.RecordSuccess()
+	st := slo.Status()
+	if st.Degraded || st.Failures[sloReasonVerification] != 9 || st.Failures[sloReasonMissingJWT] != 1 {
+		t.Errorf("below the budget: got %+v, want recovered with 9 verification and 1 missing_jwt failures", st)
+	}
+
+	// Buckets older than the window no longer count
+	slo.mu.Lock()
+	total, _ := slo.totals(time.Now().Add(slo.window))
+	slo.mu.Unlock()
+	if total != 0 {
+		t.Errorf("%d events counted a window later, want 0", total)
+	}
+}
+
+// TestJWTSLOGauges checks the process-wide tracker is exported for alerting
+func TestJWTSLOGauges(t *testing.T) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		if m := f.GetMetric(); len(m) == 1 && m[0].GetGauge() != nil {
+			got[f.GetName()] = m[0].GetGauge().GetValue()
+		}
+	}
+	want := 0.0
+	if jwtSLO.Degraded() {
+		want = 1
+	}
+	if v, ok := got["jwt_slo_degraded"]; !ok || v != want {
+		t.Errorf("jwt_slo_degraded = %v (exported %v), want %v", v, ok, want)
+	}
+	if _, ok := got["jwt_slo_burn_rate"]; !ok {
+		t.Error("jwt_slo_burn_rate is not exported")
+	}
+}
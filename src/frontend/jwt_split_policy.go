@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Small tokens aren't worth splitting: the three header names cost more than
+// the base64 overhead saved on the payload. Tokens below JWT_SPLIT_MIN_BYTES
+// are sent whole even when compression is enabled; 0 always splits.
+const defaultJWTSplitMinBytes = 400
+
+var jwtSplitMinBytes = loadJWTSplitMinBytes()
+
+// Split decisions per downstream service and token sizes in 128-byte buckets,
+// served on /debug/vars for tuning the threshold
+var (
+	jwtSplitDecisions = expvar.NewMap("jwt_split_decisions")
+	jwtTokenBytes     = expvar.NewMap("jwt_token_bytes")
+)
+
+const (
+	splitDecisionSplit          = "split"
+	splitDecisionBelowThreshold = "whole_below_threshold"
+	splitDecisionCompressionOff = "whole_compression_off"
+	splitDecisionAdaptive       = "whole_adaptive"
+	jwtSizeBucketBytes          = 128
+)
+
+func loadJWTSplitMinBytes() int {
+	if v, err := strconv.Atoi(knobs.Value("JWT_SPLIT_MIN_BYTES")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultJWTSplitMinBytes
+}
+
+// jwtSplitsAt reports whether a token of size bytes is large enough to split
+func jwtSplitsAt(size int) bool {
+	return size >= jwtSplitMinBytes
+}
+
+// shouldSplitJWT applies the size heuristic to a call with compression
+// enabled and records the decision
+func shouldSplitJWT(method string, size int) bool {
+	split := jwtSplitsAt(size)
+	decision := splitDecisionBelowThreshold
+	if split {
+		decision = splitDecisionSplit
+	}
+	jwtSplitDecisions.Add(serviceFromMethod(method)+" "+decision, 1)
+	lo := size / jwtSizeBucketBytes * jwtSizeBucketBytes
+	jwtTokenBytes.Add(fmt.Sprintf("%d-%d", lo, lo+jwtSizeBucketBytes-1), 1)
+	return split
+}
+
+// splitDecision applies the split policy to a call in order and names the
+// step that decided: splitDecisionSplit, or why the token stays whole
+func splitDecision(method string, compress bool, size int) (split bool, reason string) {
+	switch {
+	case !compress:
+		return false, splitDecisionCompressionOff
+	case forcesAuthorizationHeader(method):
+		return false, splitDecisionForcedAuthorization
+	case splitDowngraded(method):
+		return false, splitDecisionDowngraded
+	case !adaptiveCompression.Allow(method):
+		return false, splitDecisionAdaptive
+	case !shouldSplitJWT(method, size):
+		return false, splitDecisionBelowThreshold
+	}
+	return true, splitDecisionSplit
+}
+
+// Services known not to read the split format get the Bearer header even
+// with compression on, instead of arriving without auth context.
+// JWT_FORCE_AUTHORIZATION_FOR lists them by short ("payment") or full
+// ("hipstershop.PaymentService") name; set it empty to split for all.
+// Services a contract report (contract_report.go) marks are added to it.
+const defaultForceAuthorizationFor = "payment,email,currency"
+
+const splitDecisionForcedAuthorization = "whole_forced_authorization"
+
+var forceAuthorizationFor = loadForceAuthorizationFor()
+
+func loadForceAuthorizationFor() map[string]bool {
+	v, ok := knobs.Lookup("JWT_FORCE_AUTHORIZATION_FOR")
+	if !ok {
+		v = defaultForceAuthorizationFor
+	}
+	targets := make(map[string]bool)
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets[strings.ToLower(t)] = true
+		}
+	}
+	return targets
+}
+
+// forcesAuthorizationHeader reports whether method's service only reads the
+// authorization header, and records the decision
+func forcesAuthorizationHeader(method string) bool {
+	service := serviceFromMethod(method)
+	short := strings.TrimSuffix(service[strings.LastIndex(service, ".")+1:], "Service")
+	if !forceAuthorizationFor[strings.ToLower(service)] && !forceAuthorizationFor[strings.ToLower(short)] && !contractRequiresAuthorization(service) {
+		return false
+	}
+	jwtSplitDecisions.Add(service+" "+splitDecisionForcedAuthorization, 1)
+	return true
+}
+
+// serviceFromMethod extracts "hipstershop.CartService" from a full method name
+func serviceFromMethod(method string) string {
+	method = strings.TrimPrefix(method, "/")
+	if i := strings.Index(method, "/"); i >= 0 {
+		return method[:i]
+	}
+	return method
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSmallJWTSentWhole(t *testing.T) {
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+
+	token := "eyJhbGciOiJIUzI1NiJ9.eyJhIjoieCJ9.c2ln"
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+	var out metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	const method = "/hipstershop.CartService/GetCart"
+
+	jwtSplitMinBytes = len(token) + 1
+	before := jwtSplitDecisions.Get("hipstershop.CartService " + splitDecisionBelowThreshold)
+	if err := jwtUnaryClientInterceptor()(ctx, method, nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Get("authorization"); len(got) != 1 || !strings.HasSuffix(got[0], token) || len(out.Get("x-jwt-payload")) != 0 {
+		t.Errorf("below threshold: metadata = %v, want whole token", out)
+	}
+	if after := jwtSplitDecisions.Get("hipstershop.CartService " + splitDecisionBelowThreshold); after == nil || (before != nil && after.String() == before.String()) {
+		t.Errorf("below-threshold decision not recorded")
+	}
+
+	jwtSplitMinBytes = len(token)
+	if err := jwtUnaryClientInterceptor()(ctx, method, nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Get("x-jwt-payload")) != 1 || len(out.Get("authorization")) != 0 {
+		t.Errorf("at threshold: metadata = %v, want split token", out)
+	}
+}
+
+func TestForcedAuthorizationHeader(t *testing.T) {
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+	jwtSplitMinBytes = 0
+
+	token := "eyJhbGciOiJIUzI1NiJ9.eyJhIjoieCJ9.c2ln"
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+	var out metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+
+	for method, wantSplit := range map[string]bool{
+		"/hipstershop.PaymentService/Charge":              false,
+		"/hipstershop.EmailService/SendOrderConfirmation": false,
+		"/hipstershop.CartService/GetCart":                true,
+	} {
+		if err := jwtUnaryClientInterceptor()(ctx, method, nil, nil, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+		if split := len(out.Get("x-jwt-payload")) == 1; split != wantSplit || split == (len(out.Get("authorization")) == 1) {
+			t.Errorf("%s: metadata = %v, want split=%v", method, out, wantSplit)
+		}
+	}
+}
+
+func TestContractReportForcesAuthorization(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	report := `{"services": {
+		"hipstershop.CartService": {"method": "/hipstershop.CartService/GetCart", "verdict": "authorization"},
+		"hipstershop.AdService": {"method": "/hipstershop.AdService/GetAds", "verdict": "split"}
+	}}`
+	if err := os.WriteFile(path, []byte(report), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	services, err := loadContractReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s map[string]contractResult) { contractServices = s }(contractServices)
+	contractServices = services
+
+	if !forcesAuthorizationHeader("/hipstershop.CartService/GetCart") {
+		t.Error("CartService: want the authorization header from the contract report")
+	}
+	if forcesAuthorizationHeader("/hipstershop.AdService/GetAds") {
+		t.Error("AdService: split verdict forced the authorization header")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"services": {"hipstershop.CartService": {"verdict": "maybe"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadContractReport(path); err == nil {
+		t.Error("unknown verdict was accepted")
+	}
+}
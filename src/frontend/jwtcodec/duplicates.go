@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtcodec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Duplicate values
+//
+// Proxies sometimes repeat a header. A JWT key repeated with the same value
+// is harmless, and readers keep taking the first one; repeated with
+// different values nobody can tell which one the sender meant, so the
+// request has to be refused. The policy covers authorization and every
+// x-jwt-* key.
+
+// DuplicateError reports a JWT key sent with differing values
+type DuplicateError struct {
+	Key    string
+	Values int
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("jwtcodec: %s sent %d times with conflicting values", e.Key, e.Values)
+}
+
+// CheckDuplicates applies the duplicate policy to md. observe, when not nil,
+// is called for every JWT key with more than one value, with the number of
+// values and whether they conflict. The error is a *DuplicateError for the
+// first conflicting key, in key order.
+func CheckDuplicates(md metadata.MD, observe func(key string, values int, conflicting bool)) error {
+	keys := make([]string, 0, len(md))
+	for k, v := range md {
+		if len(v) > 1 && isJWTKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var err error
+	for _, k := range keys {
+		values := md[k]
+		conflicting := false
+		for _, v := range values[1:] {
+			if v != values[0] {
+				conflicting = true
+				break
+			}
+		}
+		if observe != nil {
+			observe(k, len(values), conflicting)
+		}
+		if conflicting && err == nil {
+			err = &DuplicateError{Key: k, Values: len(values)}
+		}
+	}
+	return err
+}
+
+// isJWTKey reports whether key carries a JWT or part of one
+func isJWTKey(key string) bool {
+	return key == "authorization" || strings.HasPrefix(key, "x-jwt-")
+}
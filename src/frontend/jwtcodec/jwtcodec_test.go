@@ -0,0 +1,233 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtcodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// goldenTokens returns the shared corpus, which covers RSA and ECDSA keys,
+// unicode and escaped claims, nested claims and large Azure AD tokens
+func goldenTokens(t *testing.T) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile("../../../test-suite/golden/jwt_golden.json")
+	if err != nil {
+		t.Fatalf("failed to read golden JWTs: %v", err)
+	}
+	var golden []struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatalf("failed to parse golden JWTs: %v", err)
+	}
+	tokens := make(map[string]string, len(golden))
+	for _, g := range golden {
+		tokens[g.Name] = g.Token
+	}
+	return tokens
+}
+
+// TestConformance is the contract every registered codec has to meet
+func TestConformance(t *testing.T) {
+	SetReferenceStore(NewMemoryStore(time.Minute))
+	defer SetReferenceStore(nil)
+	tokens := goldenTokens(t)
+
+	encoded := map[string]metadata.MD{}
+	for _, name := range Names() {
+		c, _ := Lookup(name)
+		t.Run(name, func(t *testing.T) {
+			if _, ok, _ := c.Decode(metadata.MD{}); ok {
+				t.Error("claims empty metadata")
+			}
+			accepted := 0
+			for tokenName, token := range tokens {
+				md, err := c.Encode(token)
+				if err != nil {
+					if name == "full" {
+						t.Errorf("%s: full must carry every token: %v", tokenName, err)
+					}
+					continue
+				}
+				accepted++
+				encoded[name] = md
+
+				// Exact round trip: the signature covers these bytes
+				if got, ok, err := c.Decode(md); err != nil || !ok || got != token {
+					t.Errorf("%s: Decode(Encode(token)) = %q, %v, %v; want the token", tokenName, got, ok, err)
+				}
+				// Deterministic, so HPACK can index repeated tokens
+				if again, _ := c.Encode(token); !reflect.DeepEqual(again, md) {
+					t.Errorf("%s: encoding is not deterministic", tokenName)
+				}
+				for key, vals := range md {
+					if key != strings.ToLower(key) {
+						t.Errorf("%s: metadata key %q is not lowercase", tokenName, key)
+					}
+					if strings.HasSuffix(key, "-bin") {
+						continue
+					}
+					for _, v := range vals {
+						if strings.IndexFunc(v, func(r rune) bool { return r < 0x20 || r > 0x7e }) >= 0 {
+							t.Errorf("%s: %s is not printable ASCII and not a -bin key", tokenName, key)
+						}
+					}
+				}
+				// Corrupt input must fail cleanly
+				for key, vals := range md {
+					for _, cut := range []int{0, len(vals[0]) / 2, len(vals[0]) - 1} {
+						if cut < 0 {
+							continue
+						}
+						bad := md.Copy()
+						bad.Set(key, vals[0][:cut])
+						func() {
+							defer func() {
+								if r := recover(); r != nil {
+									t.Errorf("%s: Decode panicked on truncated %s: %v", tokenName, key, r)
+								}
+							}()
+							c.Decode(bad)
+						}()
+					}
+				}
+			}
+			t.Logf("carries %d of %d golden tokens", accepted, len(tokens))
+			if accepted == 0 {
+				t.Error("carries none of the golden tokens")
+			}
+		})
+	}
+
+	// Codecs only claim their own metadata
+	for name, md := range encoded {
+		for _, other := range Names() {
+			if other == name {
+				continue
+			}
+			c, _ := Lookup(other)
+			if _, ok, _ := c.Decode(md); ok {
+				t.Errorf("%s claims metadata encoded by %s", other, name)
+			}
+		}
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	defer SetReferenceStore(nil)
+	if strings.Contains(Advertise(), "reference-token") {
+		t.Errorf("Advertise() = %q lists reference-token without a store", Advertise())
+	}
+	if got := Choose([]string{"reference-token", "protobuf", "gzip-split"}, "gzip-split,protobuf"); got != "protobuf" {
+		t.Errorf("Choose = %q, want protobuf", got)
+	}
+	if got := Choose([]string{"cbor"}, "full,plain-split"); got != "" {
+		t.Errorf("Choose = %q, want none", got)
+	}
+
+	SetReferenceStore(NewMemoryStore(time.Minute))
+	md, err := Encode("reference-token", "a.b.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, name, err := Decode(md); token != "a.b.c" || name != "reference-token" || err != nil {
+		t.Errorf("Decode = %q, %q, %v", token, name, err)
+	}
+	if _, err := Encode("plain-split", "not-a-jwt"); err == nil {
+		t.Error("Encode accepted a token that isn't a JWS")
+	}
+}
+
+// TestHTTPStore checks that references resolve over HTTP within the caller's
+// context, and that malformed or recently unknown references are refused
+// without asking the resolver
+func TestHTTPStore(t *testing.T) {
+	mem := NewMemoryStore(time.Minute)
+	ref, err := mem.Put("a.b.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lookups int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		ReferenceHandler(mem).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	s := &HTTPStore{URL: srv.URL + "/jwt/ref/"}
+	ctx := context.Background()
+
+	if token, err := s.Get(ctx, ref); token != "a.b.c" || err != nil {
+		t.Errorf("Get(known) = %q, %v", token, err)
+	}
+	unknown := strings.Repeat("A", len(ref))
+	for i := 0; i < 3; i++ {
+		if _, err := s.Get(ctx, unknown); !errors.Is(err, ErrUnknownReference) {
+			t.Errorf("Get(unknown) = %v, want ErrUnknownReference", err)
+		}
+	}
+	for _, bad := range []string{"", "short", ref + "A", "../../admin"} {
+		if _, err := s.Get(ctx, bad); !errors.Is(err, ErrUnknownReference) {
+			t.Errorf("Get(%q) = %v, want ErrUnknownReference", bad, err)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("resolver asked %d times, want once for the known and once for the unknown reference", lookups)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	other, _ := mem.Put("d.e.f")
+	if _, err := s.Get(cancelled, other); err == nil || lookups != 2 {
+		t.Errorf("Get with a cancelled context = %v after %d lookups, want an error and no lookup", err, lookups)
+	}
+}
+
+func TestCheckDuplicates(t *testing.T) {
+	var seen []string
+	observe := func(key string, values int, conflicting bool) {
+		seen = append(seen, fmt.Sprintf("%s/%d/%v", key, values, conflicting))
+	}
+	md := metadata.Pairs(
+		"x-jwt-header", "h", "x-jwt-header", "h",
+		"x-jwt-sig", "s1", "x-jwt-sig", "s2", "x-jwt-sig", "s1",
+		"x-trace", "a", "x-trace", "b",
+		"x-jwt-payload", "{}")
+	err := CheckDuplicates(md, observe)
+	var dup *DuplicateError
+	if !errors.As(err, &dup) || dup.Key != "x-jwt-sig" || dup.Values != 3 {
+		t.Fatalf("CheckDuplicates = %v, want a conflict on x-jwt-sig", err)
+	}
+	if want := []string{"x-jwt-header/2/false", "x-jwt-sig/3/true"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("observed %v, want %v", seen, want)
+	}
+
+	md.Set("x-jwt-sig", "s1", "s1")
+	if err := CheckDuplicates(md, nil); err != nil {
+		t.Errorf("identical duplicates refused: %v", err)
+	}
+}
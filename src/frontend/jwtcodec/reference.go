@@ -0,0 +1,271 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtcodec
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func init() {
+	Register(referenceCodec{})
+}
+
+// Store keeps tokens behind opaque references. Get is called before the
+// token is verified, on behalf of the RPC ctx belongs to.
+type Store interface {
+	Put(token string) (ref string, err error)
+	Get(ctx context.Context, ref string) (token string, err error)
+}
+
+// ErrUnknownReference is returned for references a store doesn't hold
+var ErrUnknownReference = errors.New("jwtcodec: unknown token reference")
+
+var (
+	refMu      sync.RWMutex
+	references Store
+)
+
+// SetReferenceStore configures where reference-token keeps and resolves
+// tokens; the codec is unavailable until one is set
+func SetReferenceStore(s Store) {
+	refMu.Lock()
+	defer refMu.Unlock()
+	references = s
+}
+
+func referenceStore() Store {
+	refMu.RLock()
+	defer refMu.RUnlock()
+	return references
+}
+
+// referenceCodec sends only x-jwt-ref, a random handle the receiver resolves
+// through its Store: the sender's MemoryStore, reached over HTTP
+type referenceCodec struct{}
+
+func (referenceCodec) Name() string { return "reference-token" }
+
+func (referenceCodec) Available() bool { return referenceStore() != nil }
+
+func (referenceCodec) Encode(token string) (metadata.MD, error) {
+	s := referenceStore()
+	if s == nil {
+		return nil, errors.New("jwtcodec: no reference store configured")
+	}
+	ref, err := s.Put(token)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Pairs("x-jwt-ref", ref), nil
+}
+
+func (c referenceCodec) Decode(md metadata.MD) (string, bool, error) {
+	return c.DecodeContext(context.Background(), md)
+}
+
+func (referenceCodec) DecodeContext(ctx context.Context, md metadata.MD) (string, bool, error) {
+	ref, ok := first(md, "x-jwt-ref")
+	if !ok {
+		return "", false, nil
+	}
+	s := referenceStore()
+	if s == nil {
+		return "", true, errors.New("jwtcodec: no reference store configured")
+	}
+	token, err := s.Get(ctx, ref)
+	return token, true, err
+}
+
+// MemoryStore holds tokens in memory for ttl. The same token always gets the
+// same reference while it is held, so HPACK can index it.
+type MemoryStore struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	byRef  map[string]memoryEntry
+	byTok  map[string]string
+	sweeps int
+}
+
+type memoryEntry struct {
+	token   string
+	expires time.Time
+}
+
+// NewMemoryStore returns a store keeping each token for ttl
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{ttl: ttl, byRef: make(map[string]memoryEntry), byTok: make(map[string]string)}
+}
+
+func (s *MemoryStore) Put(token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if ref, ok := s.byTok[token]; ok && now.Before(s.byRef[ref].expires) {
+		return ref, nil
+	}
+	if s.sweeps++; s.sweeps%1024 == 0 {
+		for ref, e := range s.byRef {
+			if now.After(e.expires) {
+				delete(s.byRef, ref)
+				delete(s.byTok, e.token)
+			}
+		}
+	}
+	b := make([]byte, refBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ref := base64.RawURLEncoding.EncodeToString(b)
+	s.byRef[ref] = memoryEntry{token: token, expires: now.Add(s.ttl)}
+	s.byTok[token] = ref
+	return ref, nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, ref string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.byRef[ref]
+	if !ok || time.Now().After(e.expires) {
+		return "", ErrUnknownReference
+	}
+	return e.token, nil
+}
+
+// refBytes is the size of the random references MemoryStore hands out
+const refBytes = 16
+
+// Resolver lookups happen before the token is verified, so anyone can make
+// a receiver send them. HTTPStore only asks about references shaped like the
+// ones MemoryStore hands out, and remembers for DefaultNegativeTTL the ones
+// the resolver didn't know, up to maxUnknownRefs of them.
+const (
+	DefaultNegativeTTL = 30 * time.Second
+	maxUnknownRefs     = 4096
+)
+
+// HTTPStore resolves references against a ReferenceHandler; it can't store
+type HTTPStore struct {
+	URL    string
+	Client *http.Client
+	// NegativeTTL is how long an unknown reference is refused without asking
+	// the resolver again, DefaultNegativeTTL when zero
+	NegativeTTL time.Duration
+
+	mu      sync.Mutex
+	unknown map[string]time.Time // reference -> refused until
+}
+
+func (s *HTTPStore) Put(string) (string, error) {
+	return "", errors.New("jwtcodec: HTTP reference store is read-only")
+}
+
+func (s *HTTPStore) Get(ctx context.Context, ref string) (string, error) {
+	if b, err := base64.RawURLEncoding.DecodeString(ref); err != nil || len(b) != refBytes {
+		return "", ErrUnknownReference
+	}
+	if s.knownUnknown(ref) {
+		return "", ErrUnknownReference
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.URL, "/")+"/"+url.PathEscape(ref), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("jwtcodec: resolving token reference: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		s.rememberUnknown(ref)
+		return "", ErrUnknownReference
+	default:
+		return "", fmt.Errorf("jwtcodec: reference resolver returned %s", resp.Status)
+	}
+	token, err := io.ReadAll(io.LimitReader(resp.Body, maxPayloadBytes))
+	return string(token), err
+}
+
+// knownUnknown reports whether the resolver recently didn't know ref
+func (s *HTTPStore) knownUnknown(ref string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.unknown[ref]
+	if ok && time.Now().After(until) {
+		delete(s.unknown, ref)
+		return false
+	}
+	return ok
+}
+
+// rememberUnknown refuses ref for NegativeTTL
+func (s *HTTPStore) rememberUnknown(ref string) {
+	ttl := s.NegativeTTL
+	if ttl <= 0 {
+		ttl = DefaultNegativeTTL
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unknown == nil {
+		s.unknown = make(map[string]time.Time)
+	}
+	if len(s.unknown) >= maxUnknownRefs {
+		for r, until := range s.unknown {
+			if now.After(until) {
+				delete(s.unknown, r)
+			}
+		}
+		if len(s.unknown) >= maxUnknownRefs {
+			s.unknown = make(map[string]time.Time)
+		}
+	}
+	s.unknown[ref] = now.Add(ttl)
+}
+
+// ReferenceHandler serves the tokens of s by reference, the last path
+// element of the request. It hands out bearer tokens, so mount it on an
+// internal port only.
+func ReferenceHandler(s Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := s.Get(r.Context(), path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, token)
+	})
+}
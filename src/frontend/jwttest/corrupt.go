@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwttest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// Canned corruptions of a valid compact token. Each keeps the token
+// well-formed enough to reach the step it is meant to fail.
+
+// BadSignature flips a bit of the signature
+func BadSignature(token string) string {
+	i := strings.LastIndexByte(token, '.')
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || len(sig) == 0 {
+		return token + "x"
+	}
+	sig[len(sig)/2] ^= 0x01
+	return token[:i+1] + encode(sig)
+}
+
+// TamperClaim rewrites one claim of the payload and keeps the original
+// signature, which no longer matches; a nil value removes the claim
+func TamperClaim(token, claim string, value interface{}) string {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return token
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return token
+	}
+	claims := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return token
+	}
+	if value == nil {
+		delete(claims, claim)
+	} else {
+		claims[claim] = mustJSON(value)
+	}
+	return parts[0] + "." + encode(mustJSON(claims)) + "." + parts[2]
+}
+
+// AlgNone swaps the header for an unsigned "none" one and drops the
+// signature
+func AlgNone(token string) string {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return token
+	}
+	return encode([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."
+}
+
+// Unsigned drops the signature segment, leaving two parts
+func Unsigned(token string) string {
+	if i := strings.LastIndexByte(token, '.'); i >= 0 {
+		return token[:i]
+	}
+	return token
+}
+
+// NotBase64 breaks the base64url encoding of the payload
+func NotBase64(token string) string {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return token
+	}
+	return parts[0] + ".*" + parts[1] + "." + parts[2]
+}
+
+// NotJSON replaces the payload with validly encoded bytes that aren't JSON,
+// keeping the signature
+func NotJSON(token string) string {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return token
+	}
+	return parts[0] + "." + encode([]byte("not json")) + "." + parts[2]
+}
+
+// Corruptions returns every canned corruption of token by name, for table
+// tests that expect all of them to be refused
+func Corruptions(token string) map[string]string {
+	return map[string]string{
+		"bad_signature": BadSignature(token),
+		"tampered_sub":  TamperClaim(token, "sub", "urn:hipstershop:user:mallory"),
+		"alg_none":      AlgNone(token),
+		"unsigned":      Unsigned(token),
+		"not_base64":    NotBase64(token),
+		"not_json":      NotJSON(token),
+		"empty":         "",
+		"garbage":       "not-a-jwt",
+	}
+}
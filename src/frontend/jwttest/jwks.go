@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwttest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// JWK is the RFC 7517 form of an issuer's public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWK describes the issuer's public key
+func (iss *Issuer) JWK() JWK {
+	if iss.rsaKey != nil {
+		pub := iss.rsaKey.PublicKey
+		return JWK{Kty: "RSA", Use: "sig", Alg: "RS256", Kid: iss.KeyID,
+			N: encode(pub.N.Bytes()), E: encode(big.NewInt(int64(pub.E)).Bytes())}
+	}
+	pub := iss.ecKey.PublicKey
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return JWK{Kty: "EC", Use: "sig", Alg: "ES256", Kid: iss.KeyID, Crv: "P-256", X: encode(x), Y: encode(y)}
+}
+
+// thumbprint is the RFC 7638 thumbprint of k, the kid keyring.KeyID gives
+// RSA keys
+func thumbprint(k JWK) string {
+	// Required members in lexicographic order, no whitespace
+	var canonical string
+	if k.Kty == "RSA" {
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Crv, k.X, k.Y)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return encode(sum[:])
+}
+
+// JWKS is a JWKS server for tests. It serves the current key set at every
+// path, /.well-known/jwks.json included, and counts the fetches.
+type JWKS struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []JWK
+	fetches int
+	status  int
+}
+
+// NewJWKSServer starts a JWKS server publishing the keys of issuers and
+// closes it when the test ends
+func NewJWKSServer(t testing.TB, issuers ...*Issuer) *JWKS {
+	t.Helper()
+	j := &JWKS{}
+	j.SetIssuers(issuers...)
+	j.Server = httptest.NewServer(http.HandlerFunc(j.serve))
+	t.Cleanup(j.Close)
+	return j
+}
+
+// URL of the key set
+func (j *JWKS) URL() string {
+	return j.Server.URL + "/.well-known/jwks.json"
+}
+
+// SetIssuers replaces the published keys, as a key rotation does
+func (j *JWKS) SetIssuers(issuers ...*Issuer) {
+	keys := make([]JWK, 0, len(issuers))
+	for _, iss := range issuers {
+		keys = append(keys, iss.JWK())
+	}
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+}
+
+// Fail makes the server answer status to every fetch; 0 restores it
+func (j *JWKS) Fail(status int) {
+	j.mu.Lock()
+	j.status = status
+	j.mu.Unlock()
+}
+
+// Fetches counts the requests served so far
+func (j *JWKS) Fetches() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fetches
+}
+
+func (j *JWKS) serve(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	j.fetches++
+	keys, status := j.keys, j.status
+	j.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	json.NewEncoder(w).Encode(struct {
+		Keys []JWK `json:"keys"`
+	}{keys})
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// verify checks token against iss's public key the way the services do
+func verify(iss *Issuer, token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := iss.PublicKey().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		return len(sig) == 64 && ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	return false
+}
+
+func TestMint(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, iss := range []*Issuer{RS256(), ES256()} {
+		iss := iss.With(Claims{"currency": nil})
+		iss.Now = func() time.Time { return now }
+		token := iss.Mint(Claims{"sub": "urn:hipstershop:user:a"}, Skew(-time.Minute), TTL(10*time.Minute))
+		if !verify(iss, token) {
+			t.Fatalf("%s: minted token does not verify", iss.Alg)
+		}
+		header, payload, _ := Split(token)
+		var claims struct {
+			Sub      string `json:"sub"`
+			Iss      string `json:"iss"`
+			Currency *string
+			Iat, Exp int64
+		}
+		if err := json.Unmarshal([]byte(payload), &claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims.Sub != "urn:hipstershop:user:a" || claims.Iss != "https://auth.hipstershop.com" || claims.Currency != nil {
+			t.Errorf("%s: claims %s, want sub overridden, iss defaulted, currency dropped", iss.Alg, payload)
+		}
+		if claims.Iat != now.Add(-time.Minute).Unix() || claims.Exp != claims.Iat+600 {
+			t.Errorf("%s: iat %d exp %d, want the skewed clock and a 10m TTL", iss.Alg, claims.Iat, claims.Exp)
+		}
+		raw, _ := base64.RawURLEncoding.DecodeString(header)
+		if !strings.Contains(string(raw), `"alg":"`+iss.Alg+`"`) {
+			t.Errorf("header %s lacks alg %s", raw, iss.Alg)
+		}
+
+		for name, bad := range Corruptions(token) {
+			if verify(iss, bad) {
+				t.Errorf("%s: corruption %s still verifies", iss.Alg, name)
+			}
+		}
+	}
+}
+
+// TestJWKSServer checks that the served RSA keys are the ones keyring
+// fetches, under the kid keyring computes
+func TestJWKSServer(t *testing.T) {
+	iss := RS256()
+	srv := NewJWKSServer(t, iss, ES256())
+	if iss.KeyID != keyring.KeyID(iss.RSAPublicKey()) {
+		t.Errorf("kid %q, keyring computes %q", iss.KeyID, keyring.KeyID(iss.RSAPublicKey()))
+	}
+
+	resp, err := http.Get(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set keyring.JSONWebKeySet
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	resp.Body.Close()
+	if err != nil || len(set.Keys) != 2 {
+		t.Fatalf("key set %+v, %v; want 2 keys", set, err)
+	}
+	pub, err := set.Keys[0].PublicKey()
+	if err != nil || !pub.Equal(iss.PublicKey()) {
+		t.Errorf("served RSA key %v, %v; want the issuer's", pub, err)
+	}
+
+	srv.Fail(http.StatusServiceUnavailable)
+	resp, err = http.Get(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || srv.Fetches() != 2 {
+		t.Errorf("status %d after %d fetches, want 503 after 2", resp.StatusCode, srv.Fetches())
+	}
+}
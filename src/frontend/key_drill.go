@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// Key compromise drill
+//
+// The debug server lets `jwtsplit key-drill` rehearse a signing key
+// compromise: /debug/keys reports the KeyIDs the frontend signs and verifies
+// with, /debug/keys/rotate writes a fresh key to the key source and loads it,
+// and /debug/keys/revoke?kid= stops the frontend publishing and accepting a
+// key and passes the revocation on to JWT_REVOCATION_URLS. Checkout and
+// shipping serve the same /debug/keys, so the drill can see which verifiers
+// pick up the new key in time. Rotating needs a key source this process can
+// write, i.e. a file. Rotating and revoking take DEBUG_ADMIN_TOKEN as a
+// bearer token and are refused while it is unset.
+
+var debugAdminToken = knobs.Value("DEBUG_ADMIN_TOKEN")
+
+// keysStatus is the JSON view of a keyring on /debug/keys
+type keysStatus struct {
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Current  string    `json:"current"`
+	KeyIDs   []string  `json:"kids"`
+	Revoked  []string  `json:"revoked"`
+}
+
+func newKeysStatus(k *keyring.Keyring) keysStatus {
+	return keysStatus{
+		Source:   k.Source(),
+		LoadedAt: k.LoadedAt(),
+		Current:  keyring.KeyID(k.PublicKey()),
+		KeyIDs:   k.KeyIDs(),
+		Revoked:  k.Revoked(),
+	}
+}
+
+// registerKeyDrillHandler serves the signing keys on the debug mux
+func registerKeyDrillHandler(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newKeysStatus(signingKeys))
+	})
+	mux.HandleFunc("/debug/keys/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !debugAdmin(r) {
+			http.Error(w, "DEBUG_ADMIN_TOKEN bearer token required", http.StatusForbidden)
+			return
+		}
+		previous := keyring.KeyID(signingKeys.PublicKey())
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if _, err := signingKeys.Rotate(r.Context(), data); err != nil {
+			log.Warnf("[JWT-FLOW] Signing key rotation failed: %v", err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Infof("[JWT-FLOW] Signing key rotated on request, %s replaced by %s", previous, keyring.KeyID(&key.PublicKey))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newKeysStatus(signingKeys))
+	})
+	mux.HandleFunc("/debug/keys/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !debugAdmin(r) {
+			http.Error(w, "DEBUG_ADMIN_TOKEN bearer token required", http.StatusForbidden)
+			return
+		}
+		kid := r.URL.Query().Get("kid")
+		switch kid {
+		case "":
+			http.Error(w, "kid is required", http.StatusBadRequest)
+			return
+		case keyring.KeyID(signingKeys.PublicKey()):
+			http.Error(w, "kid is the current signing key, rotate it first", http.StatusConflict)
+			return
+		}
+		signingKeys.Revoke(kid)
+		log.Infof("[JWT-FLOW] Signing key %s revoked", kid)
+		revocationEvents.Add("keys", 1)
+		if len(revocationURLs) > 0 {
+			go notifyRevocation(revocationNotice{Kid: kid, Expires: time.Now().Unix()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newKeysStatus(signingKeys))
+	})
+}
+
+// debugAdmin reports whether r carries DEBUG_ADMIN_TOKEN as its bearer token
+func debugAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && debugAdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(debugAdminToken)) == 1
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+func TestKeyDrillRotateAndRevoke(t *testing.T) {
+	pem, err := os.ReadFile("jwt_private_key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.New(context.Background(), keyring.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring) { signingKeys = k }(signingKeys)
+	signingKeys = keys
+
+	notices := make(chan revocationNotice, 1)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n revocationNotice
+		json.NewDecoder(r.Body).Decode(&n)
+		notices <- n
+	}))
+	defer downstream.Close()
+	defer func(urls []string) { revocationURLs = urls }(revocationURLs)
+	revocationURLs = []string{downstream.URL}
+
+	defer func(token string) { debugAdminToken = token }(debugAdminToken)
+	debugAdminToken = "drill-admin"
+
+	mux := http.NewServeMux()
+	registerKeyDrillHandler(mux)
+	postAs := func(token, path string) (int, keysStatus) {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		var status keysStatus
+		json.NewDecoder(rec.Body).Decode(&status)
+		return rec.Code, status
+	}
+	post := func(path string) (int, keysStatus) { return postAs(debugAdminToken, path) }
+
+	old := keyring.KeyID(keys.PublicKey())
+	for _, token := range []string{"", "wrong"} {
+		for _, path := range []string{"/debug/keys/rotate", "/debug/keys/revoke?kid=" + old} {
+			if code, _ := postAs(token, path); code != http.StatusForbidden {
+				t.Errorf("%s with token %q = %d, want %d", path, token, code, http.StatusForbidden)
+			}
+		}
+	}
+	if keyring.KeyID(signingKeys.PublicKey()) != old || len(signingKeys.Revoked()) != 0 {
+		t.Fatal("an unauthenticated request changed the signing keys")
+	}
+	code, status := post("/debug/keys/rotate")
+	if code != http.StatusOK || status.Current == old || len(status.KeyIDs) != 2 {
+		t.Fatalf("rotate = %d %+v", code, status)
+	}
+	if code, _ := post("/debug/keys/revoke?kid=" + status.Current); code != http.StatusConflict {
+		t.Errorf("revoking the current key = %d, want %d", code, http.StatusConflict)
+	}
+	code, status = post("/debug/keys/revoke?kid=" + old)
+	if code != http.StatusOK || len(status.KeyIDs) != 1 || len(status.Revoked) != 1 || status.Revoked[0] != old {
+		t.Fatalf("revoke = %d %+v", code, status)
+	}
+
+	select {
+	case n := <-notices:
+		if n.Kid != old {
+			t.Errorf("notice = %+v, want kid %s", n, old)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("downstream was not told of the revoked key")
+	}
+}
+
+// TestKeyDrillWithoutAdminToken checks that rotating and revoking stay off
+// while DEBUG_ADMIN_TOKEN is unset, whatever bearer token is sent
+func TestKeyDrillWithoutAdminToken(t *testing.T) {
+	defer func(token string) { debugAdminToken = token }(debugAdminToken)
+	debugAdminToken = ""
+
+	mux := http.NewServeMux()
+	registerKeyDrillHandler(mux)
+	for _, path := range []string{"/debug/keys/rotate", "/debug/keys/revoke?kid=x"} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set("Authorization", "Bearer ")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s = %d, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+}
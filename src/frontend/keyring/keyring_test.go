@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyring
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKey(t *testing.T, path string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRefreshRotatesAndKeepsPreviousKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	first := writeKey(t, path)
+
+	k, err := New(context.Background(), File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotations int
+	k.OnRotate(func(*Keyring) { rotations++ })
+
+	if changed, err := k.Refresh(context.Background()); err != nil || changed {
+		t.Fatalf("Refresh() of unchanged key = %v, %v", changed, err)
+	}
+
+	second := writeKey(t, path)
+	if changed, err := k.Refresh(context.Background()); err != nil || !changed {
+		t.Fatalf("Refresh() of rotated key = %v, %v", changed, err)
+	}
+	if rotations != 1 {
+		t.Errorf("rotation callbacks = %d, want 1", rotations)
+	}
+	if !k.PrivateKey().Equal(second) {
+		t.Error("private key was not rotated")
+	}
+	keys := k.PublicKeys()
+	if len(keys) != 2 || !keys[0].Equal(&second.PublicKey) || !keys[1].Equal(&first.PublicKey) {
+		t.Error("PublicKeys() should return the new key followed by the previous one")
+	}
+
+	loadedAt := k.LoadedAt()
+
+	// A bad key at the source leaves the current one in place
+	os.WriteFile(path, []byte("not a key"), 0600)
+	if _, err := k.Refresh(context.Background()); err == nil {
+		t.Error("Refresh() accepted an unparseable key")
+	}
+	if !k.PrivateKey().Equal(second) {
+		t.Error("failed refresh replaced the current key")
+	}
+	if !k.LoadedAt().Equal(loadedAt) {
+		t.Error("failed refresh moved LoadedAt")
+	}
+	for _, key := range []*rsa.PrivateKey{first, second} {
+		if seen, ok := k.SeenKey(KeyID(&key.PublicKey)); !ok || !seen.Equal(&key.PublicKey) {
+			t.Errorf("SeenKey() lost a key loaded before")
+		}
+	}
+}
+
+func TestJWKSRoundTrip(t *testing.T) {
+	current, _ := rsa.GenerateKey(rand.Reader, 2048)
+	previous, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{NewJWK(&current.PublicKey), NewJWK(&previous.PublicKey)}})
+	}))
+	defer srv.Close()
+
+	k, err := New(context.Background(), JWKS{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := k.PublicKeys()
+	if len(keys) != 2 || !keys[0].Equal(&current.PublicKey) || !keys[1].Equal(&previous.PublicKey) {
+		t.Error("JWKS keys were not loaded in order")
+	}
+	if KeyID(keys[0]) != NewJWK(&current.PublicKey).Kid {
+		t.Error("kid does not match the key's thumbprint")
+	}
+}
+
+func TestRotateAndRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	first := writeKey(t, path)
+	k, err := New(context.Background(), File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(second)})
+	if changed, err := k.Rotate(context.Background(), data); err != nil || !changed {
+		t.Fatalf("Rotate() = %v, %v", changed, err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(data) {
+		t.Error("Rotate() didn't write the new key to the file")
+	}
+	oldKid, newKid := KeyID(&first.PublicKey), KeyID(&second.PublicKey)
+	if kids := k.KeyIDs(); len(kids) != 2 || kids[0] != newKid || kids[1] != oldKid {
+		t.Fatalf("KeyIDs() = %v, want [%s %s]", kids, newKid, oldKid)
+	}
+
+	k.Revoke(oldKid)
+	if kids := k.KeyIDs(); len(kids) != 1 || kids[0] != newKid {
+		t.Errorf("KeyIDs() after revoking the old key = %v", kids)
+	}
+	if _, ok := k.SeenKey(oldKid); ok {
+		t.Error("SeenKey() returned a revoked key")
+	}
+	if revoked := k.Revoked(); len(revoked) != 1 || revoked[0] != oldKid {
+		t.Errorf("Revoked() = %v", revoked)
+	}
+
+	if _, err := (&Keyring{loader: Env("UNUSED")}).Rotate(context.Background(), data); err == nil {
+		t.Error("Rotate() of an env key succeeded")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Link shaping
+//
+// LINK_SHAPING_BANDWIDTH (e.g. 100Mbps, 1Gbps, 512kbps) and LINK_SHAPING_RTT
+// make every downstream call pay for a simulated link: request and response
+// bytes are paced through one token bucket shared by all calls, and each call
+// waits one RTT. The bytes counted are what the JWT interceptor actually
+// wrote, so the network-speed table of the benchmark (bytes saved divided by
+// link speed) can be checked against the real gRPC stack. Header bytes are
+// counted before HPACK, like the benchmark does. LINK_SHAPING_BURST sets the
+// bucket size in bytes (default 0: pure pacing).
+
+// grpcFrameOverhead is the length-prefix of every gRPC message
+const grpcFrameOverhead = 5
+
+type linkShaper struct {
+	bytesPerSec float64
+	burst       float64
+	rtt         time.Duration
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	nowFunc func() time.Time // time.Now when nil
+}
+
+// linkShaping is nil unless LINK_SHAPING_BANDWIDTH or LINK_SHAPING_RTT is set
+var linkShaping = newLinkShaperFromEnv()
+
+// linkShapingStats counts shaped bytes and the delay they cost
+var linkShapingStats = expvar.NewMap("link_shaping")
+
+func newLinkShaperFromEnv() *linkShaper {
+	bw, rtt := knobs.Value("LINK_SHAPING_BANDWIDTH"), knobs.Value("LINK_SHAPING_RTT")
+	if bw == "" && rtt == "" {
+		return nil
+	}
+	l := &linkShaper{}
+	if bw != "" {
+		rate, err := parseBandwidth(bw)
+		if err != nil {
+			return nil
+		}
+		l.bytesPerSec = rate
+	}
+	if rtt != "" {
+		d, err := time.ParseDuration(rtt)
+		if err != nil {
+			return nil
+		}
+		l.rtt = d
+	}
+	if v := knobs.Value("LINK_SHAPING_BURST"); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil || b < 0 {
+			return nil
+		}
+		l.burst = float64(b)
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// parseBandwidth reads a link speed in bits per second with an optional
+// k, M or G prefix and returns it in bytes per second
+func parseBandwidth(s string) (float64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "bps")
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(v, "k"):
+		scale, v = 1e3, strings.TrimSuffix(v, "k")
+	case strings.HasSuffix(v, "m"):
+		scale, v = 1e6, strings.TrimSuffix(v, "m")
+	case strings.HasSuffix(v, "g"):
+		scale, v = 1e9, strings.TrimSuffix(v, "g")
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, want e.g. 100Mbps", s)
+	}
+	return n * scale / 8, nil
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller has
+// to wait for them to be on the wire; a bucket in debt delays later callers
+func (l *linkShaper) reserve(n int) time.Duration {
+	if l.bytesPerSec == 0 || n == 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.nowFunc != nil {
+		now = l.nowFunc()
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSec
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.bytesPerSec * float64(time.Second))
+}
+
+// transmit waits until n bytes have crossed the link
+func (l *linkShaper) transmit(ctx context.Context, direction string, n int) error {
+	linkShapingStats.Add(direction+"_bytes", int64(n))
+	return l.wait(ctx, l.reserve(n))
+}
+
+func (l *linkShaper) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	linkShapingStats.Add("delay_us", d.Microseconds())
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// messageBytes is the framed size of a message
+func messageBytes(m interface{}) int {
+	if pm, ok := m.(proto.Message); ok {
+		return proto.Size(pm) + grpcFrameOverhead
+	}
+	return grpcFrameOverhead
+}
+
+// outgoingHeaderBytes is the size of the custom metadata of a call before
+// HPACK, with the method path standing in for the pseudo-headers
+func outgoingHeaderBytes(ctx context.Context, method string) int {
+	n := len(method)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for k, vs := range md {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+// linkShapingUnaryClientInterceptor paces the request, waits one RTT and
+// paces the response. It has to run after the JWT interceptor to see the
+// headers that are actually sent.
+func linkShapingUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		l := linkShaping
+		if l == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		if err := l.transmit(ctx, "sent", outgoingHeaderBytes(ctx, method)+messageBytes(req)); err != nil {
+			return err
+		}
+		if err := l.wait(ctx, l.rtt); err != nil {
+			return err
+		}
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		return l.transmit(ctx, "received", messageBytes(reply))
+	}
+}
+
+// linkShapingStreamClientInterceptor paces the headers and the RTT when the
+// stream opens, then every message in either direction
+func linkShapingStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		l := linkShaping
+		if l == nil {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		if err := l.transmit(ctx, "sent", outgoingHeaderBytes(ctx, method)); err != nil {
+			return nil, err
+		}
+		if err := l.wait(ctx, l.rtt); err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &shapedClientStream{ClientStream: cs, link: l}, nil
+	}
+}
+
+type shapedClientStream struct {
+	grpc.ClientStream
+	link *linkShaper
+}
+
+func (s *shapedClientStream) SendMsg(m interface{}) error {
+	if err := s.link.transmit(s.Context(), "sent", messageBytes(m)); err != nil {
+		return err
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *shapedClientStream) RecvMsg(m interface{}) error {
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.link.transmit(s.Context(), "received", messageBytes(m))
+}
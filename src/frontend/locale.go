@@ -0,0 +1,83 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/language"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// User locale and currency
+//
+// A session's locale and currency default to the claims of its token. At
+// OIDC login the IdP's standard locale claim and the currency claim named by
+// OIDC_CURRENCY_CLAIM are copied onto the session. A currency the visitor
+// picks in the header is kept in a cookie and wins over the claim. Pages are
+// rendered in the claimed locale, and the currency reaches downstream calls
+// (conversion, shipping quotes, checkout) through currentCurrency.
+
+const defaultLocale = "en"
+
+// currencyCookie is the currency the visitor picked, empty if none
+func currencyCookie(r *http.Request) string {
+	if c, _ := r.Cookie(cookieCurrency); c != nil {
+		return c.Value
+	}
+	return ""
+}
+
+// currentCurrency is the currency picked by the visitor, else the session's
+// currency claim, else defaultCurrency
+func currentCurrency(r *http.Request) string {
+	if c := currencyCookie(r); c != "" {
+		return c
+	}
+	if claims, ok := getJWTFromContext(r.Context()); ok && claims != nil && claims.Currency != "" {
+		return claims.Currency
+	}
+	return defaultCurrency
+}
+
+// currentLocale is the session's locale claim as a BCP 47 tag, defaultLocale
+// without a valid one
+func currentLocale(r *http.Request) string {
+	if claims, ok := getJWTFromContext(r.Context()); ok && claims != nil && claims.Locale != "" {
+		if tag, err := language.Parse(claims.Locale); err == nil {
+			return tag.String()
+		}
+	}
+	return defaultLocale
+}
+
+// oidcPreferences reads the locale and currency claims of an IdP token
+// payload; a currency that isn't an ISO 4217 code is ignored
+func oidcPreferences(payload []byte) (locale, currency string) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", ""
+	}
+	locale, _ = claims["locale"].(string)
+	currency, _ = claims[knobs.Get("OIDC_CURRENCY_CLAIM")].(string)
+	currency = strings.ToUpper(currency)
+	if (&validator.SetCurrencyPayload{Currency: currency}).Validate() != nil {
+		currency = ""
+	}
+	return locale, currency
+}
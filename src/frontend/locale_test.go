@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestClaimBackedPreferences checks that the currency cookie wins over the
+// currency claim, which wins over the default, and that the locale comes
+// from the claims
+func TestClaimBackedPreferences(t *testing.T) {
+	request := func(claims *JWTClaims, cookie string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: cookie})
+		}
+		return r.WithContext(context.WithValue(r.Context(), ctxKeyJWT{}, claims))
+	}
+	for _, tt := range []struct {
+		name           string
+		claims         *JWTClaims
+		cookie         string
+		currency, lang string
+	}{
+		{"anonymous", nil, "", defaultCurrency, defaultLocale},
+		{"claims", &JWTClaims{Currency: "JPY", Locale: "ja_JP"}, "", "JPY", "ja-JP"},
+		{"cookie", &JWTClaims{Currency: "JPY", Locale: "ja"}, "EUR", "EUR", "ja"},
+		{"bad locale", &JWTClaims{Locale: "not a locale"}, "", defaultCurrency, defaultLocale},
+	} {
+		r := request(tt.claims, tt.cookie)
+		if got := currentCurrency(r); got != tt.currency {
+			t.Errorf("%s: currency = %q, want %q", tt.name, got, tt.currency)
+		}
+		if got := currentLocale(r); got != tt.lang {
+			t.Errorf("%s: locale = %q, want %q", tt.name, got, tt.lang)
+		}
+	}
+
+	if locale, currency := oidcPreferences([]byte(`{"locale":"fr-CA","currency":"cad"}`)); locale != "fr-CA" || currency != "CAD" {
+		t.Errorf("oidcPreferences = %q, %q", locale, currency)
+	}
+	if _, currency := oidcPreferences([]byte(`{"currency":"dollars"}`)); currency != "" {
+		t.Errorf("invalid currency claim %q was kept", currency)
+	}
+}
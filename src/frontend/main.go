@@ -26,7 +26,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
@@ -85,9 +84,21 @@ type frontendServer struct {
 	collectorConn *grpc.ClientConn
 
 	shoppingAssistantSvcAddr string
+
+	// Optional, see order_history.go
+	orderHistorySvcAddr string
+	orderHistorySvcConn *grpc.ClientConn
 }
 
 func main() {
+	if knobs.docs {
+		fmt.Print(knobs.Markdown())
+		return
+	}
+	if knobs.freshnessRules {
+		fmt.Print(tokenFreshnessRules())
+		return
+	}
 	ctx := context.Background()
 	log := logrus.New()
 	log.Level = logrus.DebugLevel
@@ -107,27 +118,33 @@ func main() {
 		propagation.NewCompositeTextMapPropagator(
 			propagation.TraceContext{}, propagation.Baggage{}))
 
-	baseUrl = os.Getenv("BASE_URL")
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	baseUrl = knobs.Value("BASE_URL")
+	initH2Capture()
 
-	if os.Getenv("ENABLE_TRACING") == "1" {
+	if knobs.Value("ENABLE_TRACING") == "1" {
 		log.Info("Tracing enabled.")
 		initTracing(log, ctx, svc)
 	} else {
 		log.Info("Tracing disabled.")
 	}
 
-	if os.Getenv("ENABLE_PROFILER") == "1" {
+	if knobs.Value("ENABLE_PROFILER") == "1" {
 		log.Info("Profiling enabled.")
 		go initProfiling(log, "frontend", "1.0.0")
 	} else {
 		log.Info("Profiling disabled.")
 	}
+	startPyroscope("frontend")
 
 	srvPort := port
-	if os.Getenv("PORT") != "" {
-		srvPort = os.Getenv("PORT")
+	if knobs.Value("PORT") != "" {
+		srvPort = knobs.Value("PORT")
 	}
-	addr := os.Getenv("LISTEN_ADDR")
+	addr := knobs.Value("LISTEN_ADDR")
 	mustMapEnv(&svc.productCatalogSvcAddr, "PRODUCT_CATALOG_SERVICE_ADDR")
 	mustMapEnv(&svc.currencySvcAddr, "CURRENCY_SERVICE_ADDR")
 	mustMapEnv(&svc.cartSvcAddr, "CART_SERVICE_ADDR")
@@ -136,16 +153,35 @@ func main() {
 	mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
 	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
 	mustMapEnv(&svc.shoppingAssistantSvcAddr, "SHOPPING_ASSISTANT_SERVICE_ADDR")
+	svc.orderHistorySvcAddr = knobs.Value("ORDER_HISTORY_SERVICE_ADDR")
 
 	// Load RSA keys for JWT
 	log.Info("Loading RSA keys for JWT...")
-	if err := loadRSAKeys(); err != nil {
+	if err := loadRSAKeys(ctx); err != nil {
 		log.Fatalf("Failed to load RSA keys: %v", err)
 	}
 	log.Info("RSA keys loaded successfully")
+	if err := initOIDC(ctx); err != nil {
+		log.Fatalf("Failed to initialize OIDC login: %v", err)
+	}
+	if err := initPartnerGateway(); err != nil {
+		log.Fatalf("Failed to load partner API keys: %v", err)
+	}
+	if err := initMethodAuth(); err != nil {
+		log.Fatalf("Failed to load method classification: %v", err)
+	}
 
 	// Initialize error injection
 	InitErrorInjection(log)
+	initFeatureFlags()
+	if err := initChaosScenarios(); err != nil {
+		log.Fatalf("Failed to load chaos scenario: %v", err)
+	}
+	initTargetMemory()
+	initClaimsAudit()
+	if linkShaping != nil {
+		log.Infof("Shaping downstream calls to %.0f bytes/s with %s RTT", linkShaping.bytesPerSec, linkShaping.rtt)
+	}
 
 	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
 	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
@@ -154,6 +190,9 @@ func main() {
 	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
 	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
 	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	if orderHistoryEnabled {
+		mustConnGRPC(ctx, &svc.orderHistorySvcConn, svc.orderHistorySvcAddr)
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc(baseUrl + "/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
@@ -162,20 +201,42 @@ func main() {
 	r.HandleFunc(baseUrl + "/cart", svc.addToCartHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/cart/empty", svc.emptyCartHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/setCurrency", svc.setCurrencyHandler).Methods(http.MethodPost)
-	r.HandleFunc(baseUrl + "/logout", svc.logoutHandler).Methods(http.MethodGet)
+	r.HandleFunc(baseUrl + "/logout", svc.logoutHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/assistant", svc.assistantHandler).Methods(http.MethodGet)
+	if orderHistoryEnabled {
+		r.HandleFunc(baseUrl + "/orders", svc.ordersHandler).Methods(http.MethodGet, http.MethodHead)
+	}
 	r.PathPrefix(baseUrl + "/static/").Handler(http.StripPrefix(baseUrl + "/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc(baseUrl + "/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
+	if oidc != nil {
+		r.HandleFunc(baseUrl + "/login", oidc.loginHandler).Methods(http.MethodGet)
+		r.HandleFunc(baseUrl + "/oidc/callback", oidc.callbackHandler).Methods(http.MethodGet)
+	}
+	if partnerGateway != nil {
+		r.HandleFunc(baseUrl + partnerAPIPrefix + "v1/orders", svc.partnerOrderHandler).Methods(http.MethodPost)
+	}
+	if orderStatusWSEnabled {
+		src := wsOrderSources{statuses: svc.streamOrderStatus}
+		if orderHistoryEnabled {
+			src.list = svc.getOrderHistory
+		}
+		r.HandleFunc(baseUrl + orderStatusWSPath, svc.orderStatusWSHandler(src)).Methods(http.MethodGet)
+	}
+	if knobs.Value("ENABLE_GRAPHQL") == "true" {
+		r.Handle(baseUrl + "/graphql", svc.graphqlHandler(newGraphQLSchema(svc))).Methods(http.MethodGet, http.MethodPost)
+	}
+	r.HandleFunc(baseUrl + "/.well-known/jwks.json", jwksHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl + "/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
 	r.HandleFunc(baseUrl + "/product-meta/{ids}", svc.getProductByID).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl + "/bot", svc.chatBotHandler).Methods(http.MethodPost)
 
-	var handler http.Handler = r
-	handler = &logHandler{log: log, next: handler}     // add logging
-	handler = ensureJWT(handler)                       // add JWT (after sessionID)
-	handler = ensureSessionID(handler)                 // add session ID (first)
-	handler = otelhttp.NewHandler(handler, "frontend") // add OTel tracing
+	startChannelzServer()
+	startDebugServer()
+
+	stack := defaultMiddlewareStack()
+	log.Infof("HTTP middleware chain: %v", stack.Names())
+	handler := stack.Then(r)
 
 	log.Infof("starting server on " + addr + ":" + srvPort)
 	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
@@ -225,9 +286,9 @@ func initProfiling(log logrus.FieldLogger, service, version string) {
 }
 
 func mustMapEnv(target *string, envKey string) {
-	v := os.Getenv(envKey)
+	v := knobs.Value(envKey)
 	if v == "" {
-		panic(fmt.Sprintf("environment variable %q not set", envKey))
+		panic(fmt.Sprintf("setting %q not set", envKey))
 	}
 	*target = v
 }
@@ -255,9 +316,17 @@ func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 				// JWT
 				jwtInterceptor := jwtUnaryClientInterceptor()
 				return jwtInterceptor(ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
-					// OTel
-					otelInterceptor := otelgrpc.UnaryClientInterceptor()
-					return otelInterceptor(ctx, method, req, reply, cc, invoker, opts...)
+					// Malformed JWT metadata chaos, after the headers are written
+					corruptionInterceptor := jwtCorruptionUnaryClientInterceptor()
+					return corruptionInterceptor(ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+						// Simulated link, paced on the headers as sent
+						shapingInterceptor := linkShapingUnaryClientInterceptor()
+						return shapingInterceptor(ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+							// OTel
+							otelInterceptor := otelgrpc.UnaryClientInterceptor()
+							return otelInterceptor(ctx, method, req, reply, cc, invoker, opts...)
+						}, opts...)
+					}, opts...)
 				}, opts...)
 			}, opts...)
 		}, opts...)
@@ -278,26 +347,35 @@ func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 			// Then apply JWT interceptor
 			jwtInterceptor := jwtStreamClientInterceptor()
 			return jwtInterceptor(ctx, desc, cc, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-				// Finally apply OTel interceptor
-				otelInterceptor := otelgrpc.StreamClientInterceptor()
-				return otelInterceptor(ctx, desc, cc, method, streamer, opts...)
+				// Corrupt the JWT metadata when chaos asks for it
+				corruptionInterceptor := jwtCorruptionStreamClientInterceptor()
+				return corruptionInterceptor(ctx, desc, cc, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+					// Simulated link
+					shapingInterceptor := linkShapingStreamClientInterceptor()
+					return shapingInterceptor(ctx, desc, cc, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+						// Finally apply OTel interceptor
+						otelInterceptor := otelgrpc.StreamClientInterceptor()
+						return otelInterceptor(ctx, desc, cc, method, streamer, opts...)
+					}, opts...)
+				}, opts...)
 			}, opts...)
 		}, opts...)
 	}
 	
-	// Configure HPACK table size: 256KB total (224KB HPACK table + 32KB overhead)
-	// Default is 4KB (~18 users), increased 64x for high-concurrency scenarios
-	// With JWT shredding + indexing control, 256KB supports:
-	//   - 1 static header (156 bytes, shared by all)
-	//   - 1052 session headers (213 bytes each)
-	//   - Dynamic/signature headers are NOT cached (0 bytes in table)
-	*conn, err = grpc.DialContext(ctx, addr,
-	grpc.WithInsecure(),
+	// The HPACK table for request headers is whatever each server advertises
+	// (GRPC_HEADER_TABLE_SIZE there, 4KB by default, at most 4KB with
+	// grpc-go); grpc-go has no dial option for it. Within 4KB the static
+	// header (156 bytes, shared by all users) stays indexed next to ~18
+	// session headers; dynamic and signature headers are never indexed.
+	*conn, err = grpc.DialContext(ctx, dialTarget(addr),
+	dialCredentials(),
+	h2CaptureDialOption(),
 	grpc.WithUnaryInterceptor(unaryChain),
 	grpc.WithStreamInterceptor(streamChain),
 	grpc.WithInitialWindowSize(65535),
 	grpc.WithInitialConnWindowSize(65535),
-	grpc.WithMaxHeaderListSize(524288)) // 512KB (480KB HPACK table + 32KB overhead)
+	grpc.WithMaxHeaderListSize(maxHeaderListSize()), // 512KB (480KB HPACK table + 32KB overhead) unless GRPC_MAX_HEADER_LIST_SIZE
+	grpc.WithStatsHandler(wireStats))
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
 	}
@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// Method classification
+//
+// Whether a downstream call carries the user's JWT comes from the
+// (auth.required) options in protos/demo.proto, which protoc-gen-authpolicy
+// compiles into genproto's MethodAuthPolicies. The catalog, currency, ad and
+// recommendation methods are public there. JWT_METHOD_AUTH_FILE overrides the
+// classification per service or per method with a YAML map:
+//
+//	hipstershop.RecommendationService: true    # personalised, send the token
+//	hipstershop.CartService/GetCart: true
+//
+// Method entries win over service entries. An entry must name a service or
+// method in the generated table, so a typo fails at startup instead of
+// silently sending or withholding tokens. Methods outside the table (health
+// checks, other packages) get the token.
+
+// methodAuthTable says whether methods require the user's token
+type methodAuthTable struct {
+	methods  map[string]bool // "/hipstershop.CartService/GetCart"
+	services map[string]bool // "hipstershop.CartService", true if any method requires it
+}
+
+// methodAuth is the generated table until initMethodAuth applies
+// JWT_METHOD_AUTH_FILE
+var methodAuth, _ = buildMethodAuth(pb.MethodAuthPolicies, nil)
+
+// initMethodAuth applies JWT_METHOD_AUTH_FILE
+func initMethodAuth() error {
+	path := knobs.Value("JWT_METHOD_AUTH_FILE")
+	if path == "" {
+		return nil
+	}
+	overrides, err := loadMethodAuthOverrides(path)
+	if err != nil {
+		return err
+	}
+	table, err := buildMethodAuth(pb.MethodAuthPolicies, overrides)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	methodAuth = table
+	log.Infof("[JWT-FLOW] Method classification: %d overrides from %s", len(overrides), path)
+	return nil
+}
+
+func loadMethodAuthOverrides(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]bool
+	if err := yaml.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: must map services or methods to true or false: %v", path, err)
+	}
+	return overrides, nil
+}
+
+// buildMethodAuth applies service overrides, then method overrides, to the
+// generated policies
+func buildMethodAuth(policies map[string]pb.MethodAuthPolicy, overrides map[string]bool) (*methodAuthTable, error) {
+	t := &methodAuthTable{methods: make(map[string]bool), services: make(map[string]bool)}
+	for method, p := range policies {
+		t.methods[method] = p.Required
+	}
+
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.Contains(k, "/") {
+			continue
+		}
+		found := false
+		for method := range t.methods {
+			if strings.HasPrefix(method, "/"+k+"/") {
+				t.methods[method] = overrides[k]
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown service %q", k)
+		}
+	}
+	for _, k := range keys {
+		if !strings.Contains(k, "/") {
+			continue
+		}
+		full := "/" + strings.TrimPrefix(k, "/")
+		if _, ok := t.methods[full]; !ok {
+			return nil, fmt.Errorf("unknown method %q", k)
+		}
+		t.methods[full] = overrides[k]
+	}
+
+	for method, requires := range t.methods {
+		svc, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+		t.services[svc] = t.services[svc] || requires
+	}
+	return t, nil
+}
+
+// requiresUserAuth looks up a full method name; "/service/" asks for the
+// service-wide setting. ok is false for methods outside the table.
+func (t *methodAuthTable) requiresUserAuth(method string) (requires, ok bool) {
+	if requires, ok = t.methods[method]; ok {
+		return requires, true
+	}
+	svc, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	requires, ok = t.services[svc]
+	return requires, ok
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// TestMethodAuthClassification checks the built-in classification and that
+// method overrides win over service overrides.
+func TestMethodAuthClassification(t *testing.T) {
+	for method, skip := range map[string]bool{
+		"/hipstershop.ProductCatalogService/GetProduct": true,
+		"/hipstershop.CurrencyService/Convert":          true,
+		"/hipstershop.RecommendationService/":           true,
+		"/hipstershop.CartService/GetCart":              false,
+		"/hipstershop.CheckoutService/PlaceOrder":       false,
+		"/grpc.health.v1.Health/Check":                  false,
+		// substring matching used to skip this
+		"/hipstershop.CartService/AdServiceLookalike": false,
+	} {
+		if got := shouldSkipJWT(method); got != skip {
+			t.Errorf("shouldSkipJWT(%q) = %v, want %v", method, got, skip)
+		}
+	}
+
+	table, err := buildMethodAuth(pb.MethodAuthPolicies, map[string]bool{
+		"hipstershop.RecommendationService":                true,
+		"hipstershop.ProductCatalogService/SearchProducts": true,
+		"/hipstershop.CartService/EmptyCart":               false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]bool{
+		"/hipstershop.RecommendationService/ListRecommendations": true,
+		"/hipstershop.ProductCatalogService/SearchProducts":      true,
+		"/hipstershop.ProductCatalogService/GetProduct":          false,
+		"/hipstershop.CartService/EmptyCart":                     false,
+		"/hipstershop.CartService/AddItem":                       true,
+	} {
+		if got, _ := table.requiresUserAuth(method); got != want {
+			t.Errorf("requiresUserAuth(%q) = %v, want %v", method, got, want)
+		}
+	}
+
+	for _, bad := range []string{"hipstershop.NoSuchService", "hipstershop.CartService/NoSuchMethod"} {
+		if _, err := buildMethodAuth(pb.MethodAuthPolicies, map[string]bool{bad: true}); err == nil {
+			t.Errorf("override %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/metadata"
+)
+
+// Prometheus histograms for JWT wire sizes, served in OpenMetrics format so
+// exemplars are exposed. Every observation carries the RPC's trace ID, taken
+// from its traceparent header, so a spike in a Grafana panel links to the
+// exact trace in Tempo.
+
+var (
+	jwtMetadataBytesHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jwt_metadata_bytes",
+		Help:    "Uncompressed key+value size of the JWT metadata of an RPC.",
+		Buckets: prometheus.ExponentialBuckets(128, 2, 9),
+	}, []string{"side", "jwt_mode"})
+	headerWireBytesHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_header_wire_bytes",
+		Help:    "HPACK-encoded size of the request headers received by a server.",
+		Buckets: prometheus.ExponentialBuckets(32, 2, 11),
+	}, []string{"jwt_mode"})
+)
+
+// metricsHandler serves the default registry with exemplars
+var metricsHandler = promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+// traceIDFromMetadata reads the trace ID from the W3C traceparent header
+// ("00-<trace-id>-<span-id>-<flags>") the OpenTelemetry interceptor injected
+func traceIDFromMetadata(md metadata.MD) string {
+	vals := md.Get("traceparent")
+	if len(vals) == 0 {
+		return ""
+	}
+	parts := strings.Split(vals[0], "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	return parts[1]
+}
+
+// observeWithTrace records v, with traceID as exemplar when there is one.
+// Invalid exemplar labels panic, so a malformed trace ID is left out.
+func observeWithTrace(o prometheus.Observer, v float64, traceID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" && utf8.ValidString(traceID) {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
+}
@@ -15,13 +15,16 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"net"
 	"net/http"
 	"time"
-	"os"
 
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/subjecthash"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ctxKeyLog struct{}
@@ -54,6 +57,16 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.w.WriteHeader(statusCode)
 }
 
+// Hijack hands the connection to WebSocket upgrades (order_status_ws.go),
+// recording the 101 they answer with
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.w).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	requestID, _ := uuid.NewRandom()
@@ -67,7 +80,18 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"http.req.id":     requestID.String(),
 	})
 	if v, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
-		log = log.WithField("session", v)
+		log = log.WithFields(logrus.Fields{
+			"session":      v,
+			"session_hash": pseudonym(v),
+		})
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		log = log.WithField("trace_id", sc.TraceID().String())
+	}
+	if jwtCompressionEnabled(ctx) {
+		log = log.WithField("jwt_mode", jwtModeCompressed)
+	} else {
+		log = log.WithField("jwt_mode", jwtModeFull)
 	}
 	log.Debug("request started")
 	defer func() {
@@ -82,12 +106,46 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	lh.next.ServeHTTP(rr, r)
 }
 
+// loggerFromContext returns the request-scoped logger set up by logHandler, or
+// the process logger outside of a request
+func loggerFromContext(ctx context.Context) logrus.FieldLogger {
+	if l, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		return l
+	}
+	return log
+}
+
+// subjects hashes the user and session identifiers written to logs and audit
+// records, under the keys in SUBJECT_HASH_KEY_FILE
+var subjects = loadSubjectHasher()
+
+// loadSubjectHasher falls back to hashing without a key when the key file
+// can't be read; config validation refuses to start with it
+func loadSubjectHasher() *subjecthash.Hasher {
+	h, err := subjecthash.Load(knobs.Value("SUBJECT_HASH_KEY_FILE"))
+	if err != nil {
+		return subjecthash.New()
+	}
+	return h
+}
+
+// pseudonym returns the short hash logged in place of a user or session
+// identifier; backends sharing the key file log the same hash, so lines can
+// be correlated across services
+func pseudonym(id string) string {
+	if id == "" {
+		return ""
+	}
+	return subjects.Short(id)
+}
+
 func ensureSessionID(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var sessionID string
 		c, err := r.Cookie(cookieSessionID)
-		if err == http.ErrNoCookie {
-			if os.Getenv("ENABLE_SINGLE_SHARED_SESSION") == "true" {
+		// A session revoked by logout starts over with a new ID
+		if err == http.ErrNoCookie || (err == nil && revocations.SessionRevoked(c.Value)) {
+			if knobs.Value("ENABLE_SINGLE_SHARED_SESSION") == "true" {
 				// Hard coded user id, shared across sessions
 				sessionID = "12345678-1234-1234-1234-123456789123"
 			} else {
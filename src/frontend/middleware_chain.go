@@ -0,0 +1,154 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Middleware positions; lower runs first (outermost). Leave gaps so new
+// middlewares can be slotted in between existing ones.
+const (
+	orderTracing = 100 // OTel span for the whole request
+	orderAccess  = 150 // access log line (needs the trace ID)
+	orderSession = 200 // shop_session-id cookie
+	orderJWT     = 300 // JWT issuance/renewal (needs the session ID)
+	orderProfile = 350 // jwt_mode profiler label (needs JWT for flag targeting)
+	orderLogging = 400 // request-scoped logger (needs session + JWT)
+	orderMetrics = 500 // per-status request counters
+	orderCSRF    = 600 // state-changing route protection (needs JWT claims)
+)
+
+// httpMiddleware wraps a handler with cross-cutting behavior
+type httpMiddleware func(http.Handler) http.Handler
+
+type middlewareEntry struct {
+	name  string
+	order int
+	match func(*http.Request) bool // nil applies to every request
+	mw    httpMiddleware
+}
+
+// middlewareStack is an ordered registry of HTTP middlewares wrapped around the router
+type middlewareStack struct {
+	entries []middlewareEntry
+}
+
+// Use registers mw for every request at the given position
+func (s *middlewareStack) Use(name string, order int, mw httpMiddleware) {
+	s.entries = append(s.entries, middlewareEntry{name: name, order: order, mw: mw})
+}
+
+// UseWhen registers mw for the requests selected by match; other requests
+// skip it and go straight to the next middleware
+func (s *middlewareStack) UseWhen(name string, order int, match func(*http.Request) bool, mw httpMiddleware) {
+	s.entries = append(s.entries, middlewareEntry{name: name, order: order, match: match, mw: mw})
+}
+
+// Names returns the registered middleware names in execution order
+func (s *middlewareStack) Names() []string {
+	entries := s.sorted()
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.name
+	}
+	return names
+}
+
+// Then wraps h with all registered middlewares in order
+func (s *middlewareStack) Then(h http.Handler) http.Handler {
+	entries := s.sorted()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		wrapped := e.mw(h)
+		if e.match != nil {
+			wrapped = conditional(e.match, wrapped, h)
+		}
+		h = wrapped
+	}
+	return h
+}
+
+func (s *middlewareStack) sorted() []middlewareEntry {
+	entries := append([]middlewareEntry(nil), s.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].order < entries[j].order })
+	return entries
+}
+
+// defaultMiddlewareStack returns the frontend's standard chain:
+// tracing → access log → session → JWT (or partner API key) → profile →
+// logging → metrics → CSRF → router
+func defaultMiddlewareStack() *middlewareStack {
+	s := &middlewareStack{}
+	s.Use("otel", orderTracing, func(next http.Handler) http.Handler {
+		return otelhttp.NewHandler(next, "frontend")
+	})
+	s.Use("access", orderAccess, accessLogMiddleware)
+	s.UseWhen("session", orderSession, isBrowserRequest, func(next http.Handler) http.Handler {
+		return ensureSessionID(next)
+	})
+	s.UseWhen("jwt", orderJWT, isBrowserRequest, func(next http.Handler) http.Handler {
+		return ensureJWT(next)
+	})
+	s.UseWhen("partner", orderJWT, isPartnerRequest, partnerMiddleware)
+	s.Use("profile", orderProfile, profileLabels)
+	s.Use("logging", orderLogging, func(next http.Handler) http.Handler {
+		return &logHandler{log: log, next: next}
+	})
+	s.Use("metrics", orderMetrics, metricsMiddleware)
+	s.UseWhen("csrf", orderCSRF, isCSRFProtected, csrfMiddleware)
+	return s
+}
+
+// conditional dispatches to with or without depending on match
+func conditional(match func(*http.Request) bool, with, without http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if match(r) {
+			with.ServeHTTP(w, r)
+			return
+		}
+		without.ServeHTTP(w, r)
+	})
+}
+
+// isStateChanging selects requests that modify server-side state
+func isStateChanging(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// httpRequestsTotal counts completed requests per status code
+var httpRequestsTotal = expvar.NewMap("http_requests_total")
+
+// metricsMiddleware counts requests by response status
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr := &responseRecorder{w: w}
+		next.ServeHTTP(rr, r)
+		status := rr.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequestsTotal.Add(strconv.Itoa(status), 1)
+	})
+}
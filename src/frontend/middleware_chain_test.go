@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func tagMiddleware(trace *[]string, tag string) httpMiddleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*trace = append(*trace, tag)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestMiddlewareStackOrder(t *testing.T) {
+	var trace []string
+	s := &middlewareStack{}
+	s.Use("c", 300, tagMiddleware(&trace, "c"))
+	s.Use("a", 100, tagMiddleware(&trace, "a"))
+	s.UseWhen("post-only", 150, isStateChanging, tagMiddleware(&trace, "post-only"))
+	s.Use("b", 200, tagMiddleware(&trace, "b"))
+
+	if got, want := s.Names(), []string{"a", "post-only", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Names() = %v, want %v", got, want)
+	}
+
+	h := s.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace = append(trace, "handler")
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := []string{"a", "b", "c", "handler"}; !reflect.DeepEqual(trace, want) {
+		t.Errorf("GET trace = %v, want %v", trace, want)
+	}
+
+	trace = nil
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	if want := []string{"a", "post-only", "b", "c", "handler"}; !reflect.DeepEqual(trace, want) {
+		t.Errorf("POST trace = %v, want %v", trace, want)
+	}
+}
+
+func TestDefaultMiddlewareStackOrder(t *testing.T) {
+	want := []string{"otel", "access", "session", "jwt", "partner", "profile", "logging", "metrics", "csrf"}
+	if got := defaultMiddlewareStack().Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("defaultMiddlewareStack().Names() = %v, want %v", got, want)
+	}
+}
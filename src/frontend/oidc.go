@@ -0,0 +1,381 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// OIDC login
+//
+// With OIDC_ISSUER set the frontend is an OpenID Connect relying party:
+// /login starts an authorization code flow with PKCE against the IdP and
+// /oidc/callback finishes it. The IdP's own token then replaces the synthetic
+// demo JWT for that session and travels through the split pipeline unchanged,
+// so compression is exercised with real Auth0/Keycloak tokens, kid headers and
+// group claims included. Visitors who don't log in keep the synthetic token.
+//
+//	OIDC_ISSUER         IdP issuer URL, used for discovery
+//	OIDC_CLIENT_ID      client registered with the IdP
+//	OIDC_CLIENT_SECRET  optional; public clients rely on PKCE alone
+//	OIDC_REDIRECT_URL   absolute URL of /oidc/callback as the IdP sees it
+//	OIDC_SCOPES         defaults to "openid profile email"
+//	OIDC_CURRENCY_CLAIM claim with the user's preferred currency, see locale.go
+//
+// The access token is forwarded when the IdP issues it as a JWT, otherwise the
+// ID token is. Downstream verifiers need JWT_PUBLIC_KEY_SOURCE=jwks pointed at
+// the IdP and JWT_ISSUER/JWT_AUDIENCE matching its tokens.
+
+const cookieOIDCLogin = cookiePrefix + "oidc-login"
+
+// oidc is the configured IdP; nil when OIDC login is disabled
+var oidc *oidcProvider
+
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+
+	authEndpoint  string
+	tokenEndpoint string
+	keys          *keyring.Keyring
+	client        *http.Client
+}
+
+// initOIDC discovers the IdP named by OIDC_ISSUER and loads its signing keys
+func initOIDC(ctx context.Context) error {
+	issuer := strings.TrimRight(knobs.Value("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil
+	}
+	p := &oidcProvider{
+		issuer:       issuer,
+		clientID:     knobs.Value("OIDC_CLIENT_ID"),
+		clientSecret: knobs.Value("OIDC_CLIENT_SECRET"),
+		redirectURL:  knobs.Value("OIDC_REDIRECT_URL"),
+		scopes:       knobs.Value("OIDC_SCOPES"),
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+	if p.scopes == "" {
+		p.scopes = "openid profile email"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC discovery returned %s", resp.Status)
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return fmt.Errorf("failed to decode OIDC discovery document: %w", err)
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != issuer {
+		return fmt.Errorf("OIDC discovery issuer %q does not match OIDC_ISSUER", discovery.Issuer)
+	}
+	// Keep the issuer exactly as the IdP spells it; tokens carry that form
+	p.issuer = discovery.Issuer
+	p.authEndpoint, p.tokenEndpoint = discovery.AuthorizationEndpoint, discovery.TokenEndpoint
+
+	p.keys, err = keyring.New(ctx, keyring.JWKS{URL: discovery.JWKSURI, Client: p.client})
+	if err != nil {
+		return err
+	}
+	if interval := keyRefreshInterval(); interval > 0 {
+		go p.keys.Watch(ctx, interval, func(err error) {
+			log.Warnf("[JWT-FLOW] Failed to refresh OIDC signing keys: %v", err)
+		})
+	}
+	oidc = p
+	log.Infof("[JWT-FLOW] OIDC login enabled against %s", p.issuer)
+	return nil
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pkceChallenge is the S256 code challenge for verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// loginHandler redirects to the IdP. state, nonce and the PKCE verifier are
+// kept in a short-lived cookie scoped to the callback, so any replica can
+// finish the flow.
+func (p *oidcProvider) loginHandler(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := randomToken(16), randomToken(16), randomToken(32)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieOIDCLogin,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     baseUrl + "/oidc/callback",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// Lax, not Strict: the cookie must come back on the IdP's redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {p.scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, p.authEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+// callbackHandler exchanges the authorization code and starts the session
+func (p *oidcProvider) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if e := r.URL.Query().Get("error"); e != "" {
+		renderHTTPError(log, r, w, fmt.Errorf("login failed: %s", e), http.StatusUnauthorized)
+		return
+	}
+	c, err := r.Cookie(cookieOIDCLogin)
+	if err != nil {
+		renderHTTPError(log, r, w, errors.New("login expired, please try again"), http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 || r.URL.Query().Get("state") != parts[0] {
+		renderHTTPError(log, r, w, errors.New("login state mismatch"), http.StatusBadRequest)
+		return
+	}
+	nonce, verifier := parts[1], parts[2]
+	http.SetCookie(w, &http.Cookie{Name: cookieOIDCLogin, Path: baseUrl + "/oidc/callback", MaxAge: -1})
+
+	sess, err := p.exchange(r.Context(), r.URL.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		log.Warnf("[JWT-FLOW] OIDC code exchange failed: %v", err)
+		renderHTTPError(log, r, w, errors.New("login failed"), http.StatusUnauthorized)
+		return
+	}
+	id := sessionID(r)
+	if id == "" {
+		renderHTTPError(log, r, w, errors.New("no session to log in"), http.StatusBadRequest)
+		return
+	}
+	oidcSessions.Put(id, sess)
+	log.Infof("[JWT-FLOW] OIDC login for %s, forwarding a %d byte IdP token", pseudonym(sess.claims.Subject), len(sess.token))
+	http.Redirect(w, r, baseUrl+"/", http.StatusFound)
+}
+
+// exchange redeems the code and verifies the ID token it returns
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier, nonce string) (oidcSession, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcSession{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return oidcSession{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oidcSession{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return oidcSession{}, fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken, nonce)
+	if err != nil {
+		return oidcSession{}, err
+	}
+	if c, err := DecomposeJWT(tokens.IDToken); err == nil {
+		claims.Groups = groupsResolver.Groups(ctx, []byte(c.Payload), tokens.AccessToken)
+		claims.Locale, claims.Currency = oidcPreferences([]byte(c.Payload))
+	}
+	sess := oidcSession{token: tokens.IDToken, claims: claims, expires: claims.ExpiresAt.Time}
+	if strings.Count(tokens.AccessToken, ".") == 2 {
+		sess.token = tokens.AccessToken
+		if exp, ok := tokenExpiry(tokens.AccessToken); ok && exp.Before(sess.expires) {
+			sess.expires = exp
+		}
+	}
+	return sess, nil
+}
+
+// oidcIDClaims are the ID token claims mapped onto the session
+type oidcIDClaims struct {
+	Nonce string `json:"nonce"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and
+// nonce. An unknown kid triggers one key refresh, in case the IdP rotated.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, idToken, nonce string) (*JWTClaims, error) {
+	parse := func() (*oidcIDClaims, error) {
+		claims := &oidcIDClaims{}
+		_, err := jwt.ParseWithClaims(idToken, claims, func(*jwt.Token) (interface{}, error) {
+			var keys jwt.VerificationKeySet
+			for _, k := range p.keys.PublicKeys() {
+				keys.Keys = append(keys.Keys, k)
+			}
+			return keys, nil
+		}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(p.issuer), jwt.WithAudience(p.clientID), jwt.WithExpirationRequired())
+		return claims, err
+	}
+	idClaims, err := parse()
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		if changed, _ := p.keys.Refresh(ctx); changed {
+			idClaims, err = parse()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idClaims.Nonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return &JWTClaims{
+		Name:             idClaims.Name,
+		Email:            idClaims.Email,
+		RegisteredClaims: idClaims.RegisteredClaims,
+	}, nil
+}
+
+// oidcSession is the IdP token a session logged in with
+type oidcSession struct {
+	token   string
+	claims  *JWTClaims
+	expires time.Time
+}
+
+// oidcSessions maps frontend session IDs to IdP tokens. IdP tokens with large
+// group claims don't fit in a cookie, so they stay server side; a session
+// that lands on another replica simply continues with the synthetic token.
+var oidcSessions = &oidcSessionStore{sessions: make(map[string]oidcSession)}
+
+type oidcSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]oidcSession
+}
+
+// Get returns the session's IdP token until it expires
+func (s *oidcSessionStore) Get(sessionID string) (oidcSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if ok && time.Now().After(sess.expires) {
+		delete(s.sessions, sessionID)
+		return oidcSession{}, false
+	}
+	return sess, ok
+}
+
+func (s *oidcSessionStore) Put(sessionID string, sess oidcSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, old := range s.sessions {
+		if now.After(old.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sessionID] = sess
+}
+
+func (s *oidcSessionStore) Delete(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionID)
+}
+
+// oidcClaimsFor returns the IdP token and claims of a logged in session. The
+// claims are copied so per-request fields don't leak between requests.
+func oidcClaimsFor(r *http.Request) (string, *JWTClaims, bool) {
+	if oidc == nil {
+		return "", nil, false
+	}
+	id := sessionID(r)
+	sess, ok := oidcSessions.Get(id)
+	if !ok {
+		return "", nil, false
+	}
+	claims := *sess.claims
+	claims.SessionID = id
+	if c := currencyCookie(r); c != "" {
+		claims.Currency = c
+	} else if claims.Currency == "" {
+		claims.Currency = defaultCurrency
+	}
+	return sess.token, &claims, true
+}
+
+// oidcUserName is shown in the header for logged in sessions
+func oidcUserName(r *http.Request) string {
+	if _, claims, ok := oidcClaimsFor(r); ok {
+		if claims.Name != "" {
+			return claims.Name
+		}
+		return claims.Email
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+func TestOIDCLoginWithPKCE(t *testing.T) {
+	idpKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var challenge, nonce string
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 idp.URL,
+				"authorization_endpoint": idp.URL + "/authorize",
+				"token_endpoint":         idp.URL + "/token",
+				"jwks_uri":               idp.URL + "/jwks",
+			})
+		case "/jwks":
+			json.NewEncoder(w).Encode(keyring.JSONWebKeySet{Keys: []keyring.JSONWebKey{keyring.NewJWK(&idpKey.PublicKey)}})
+		case "/token":
+			if pkceChallenge(r.PostFormValue("code_verifier")) != challenge || r.PostFormValue("code") != "the-code" {
+				http.Error(w, "invalid_grant", http.StatusBadRequest)
+				return
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+				"iss": idp.URL, "aud": "shop", "sub": "auth0|42", "nonce": nonce,
+				"name": "Ada", "exp": time.Now().Add(time.Hour).Unix(),
+				"groups": []string{"admins", "engineering"},
+			})
+			token.Header["kid"] = keyring.KeyID(&idpKey.PublicKey)
+			idToken, _ := token.SignedString(idpKey)
+			json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "access_token": "opaque"})
+		}
+	}))
+	defer idp.Close()
+
+	t.Setenv("OIDC_ISSUER", idp.URL)
+	t.Setenv("OIDC_CLIENT_ID", "shop")
+	t.Setenv("OIDC_REDIRECT_URL", "http://shop/oidc/callback")
+	if err := initOIDC(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { oidc = nil }()
+
+	rec := httptest.NewRecorder()
+	oidc.loginHandler(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	challenge, nonce = location.Query().Get("code_challenge"), location.Query().Get("nonce")
+	loginCookie := rec.Result().Cookies()[0]
+
+	callback := func(state string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=the-code&state="+state, nil)
+		req.AddCookie(loginCookie)
+		return req.WithContext(context.WithValue(req.Context(), ctxKeySessionID{}, "sess-1"))
+	}
+
+	rec = httptest.NewRecorder()
+	oidc.callbackHandler(rec, callback("forged"))
+	if _, ok := oidcSessions.Get("sess-1"); ok {
+		t.Fatal("callback with a forged state started a session")
+	}
+
+	rec = httptest.NewRecorder()
+	req := callback(location.Query().Get("state"))
+	oidc.callbackHandler(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback status = %d, want 302", rec.Code)
+	}
+	token, claims, ok := oidcClaimsFor(req)
+	if !ok {
+		t.Fatal("no OIDC session after a successful callback")
+	}
+	// The access token is opaque, so the ID token is the one forwarded
+	if token == "opaque" {
+		t.Error("forwarded the opaque access token instead of the ID token")
+	}
+	if claims.Subject != "auth0|42" || claims.SessionID != "sess-1" {
+		t.Errorf("unexpected session: subject %q, session %q", claims.Subject, claims.SessionID)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// Order history
+//
+// With ORDER_HISTORY_SERVICE_ADDR set, checkout records placed orders in the
+// order history service and /orders lists them. The service keys orders by
+// the sub claim of the verified user token, so the page sends no user ID: the
+// token travels through the usual split-forwarding interceptors.
+
+var orderHistoryEnabled = knobs.Value("ORDER_HISTORY_SERVICE_ADDR") != ""
+
+// pastOrder is one row of the orders page
+type pastOrder struct {
+	Order    *pb.OrderResult
+	Total    *pb.Money
+	PlacedAt time.Time
+	Items    int
+}
+
+func (fe *frontendServer) getOrderHistory(ctx context.Context) ([]pastOrder, error) {
+	resp, err := pb.NewOrderHistoryServiceClient(fe.orderHistorySvcConn).
+		ListOrders(ctx, &pb.ListOrdersRequest{Limit: 20})
+	if err != nil {
+		return nil, err
+	}
+	orders := make([]pastOrder, len(resp.GetOrders()))
+	for i, o := range resp.GetOrders() {
+		orders[i] = pastOrder{Order: o.GetOrder(), Total: o.GetTotal(), PlacedAt: time.Unix(o.GetPlacedAtUnix(), 0)}
+		for _, it := range o.GetOrder().GetItems() {
+			orders[i].Items += int(it.GetItem().GetQuantity())
+		}
+	}
+	return orders, nil
+}
+
+func (fe *frontendServer) ordersHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	orders, err := fe.getOrderHistory(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve order history"), http.StatusInternalServerError)
+		return
+	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+	if err := templates.ExecuteTemplate(w, "orders", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency":   false,
+		"currencies":      currencies,
+		"orders":          orders,
+		"order_status_ws": orderStatusWSEnabled,
+	})); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,481 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// Order status over WebSocket
+//
+// With ENABLE_ORDER_STATUS_WS=true, /ws/orders upgrades to a WebSocket that
+// pushes the session's orders whenever they change. The upgrade request
+// carries the JWT, in the session cookie or, for non-browser clients, as a
+// bearer token; the handler validates it and binds its claims to the
+// connection, and every downstream call made for the socket uses that
+// binding. A socket outlives the 2 minute tokens, so before the bound token
+// expires the frontend mints its successor for the same session, rebinds
+// and pushes it as a "token" message. IdP tokens can't be minted here: the
+// socket picks up the session's newer IdP token if there is one, otherwise
+// it sends "token_expiring" and closes when the token expires unless the
+// client sends a fresh token for the same subject first. Logging out closes
+// the session's sockets.
+//
+// Status changes come from checkout's StreamOrderStatus, opened with the
+// socket's binding. Checkout ends that stream when the token it was opened
+// with expires; by then the socket has renewed its binding, so the stream is
+// reopened with the new token.
+
+const (
+	orderStatusWSPath = "/ws/orders"
+	wsRenewBefore     = 30 * time.Second
+	wsWriteTimeout    = 10 * time.Second
+	wsMaxMessage      = 16 << 10
+	wsStreamBackoff   = 5 * time.Second
+
+	// Application close codes (4000-4999)
+	wsCloseTokenExpired = 4001
+	wsCloseBadToken     = 4002
+	wsCloseRevoked      = 4003
+)
+
+var orderStatusWSEnabled = knobs.Value("ENABLE_ORDER_STATUS_WS") == "true"
+
+// wsStats counts connections, rejected upgrades, tokens renewed by the
+// server and sent by clients, order updates pushed, failed polls, status
+// streams opened and ended by expiry or error, status updates pushed, and
+// closes by reason
+var wsStats = expvar.NewMap("order_status_ws")
+
+// The default origin check refuses cross-site upgrades, which would
+// otherwise ride on the session cookie
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// wsPollInterval reads ORDER_STATUS_WS_POLL
+func wsPollInterval() time.Duration {
+	d, err := time.ParseDuration(knobs.Value("ORDER_STATUS_WS_POLL"))
+	if err != nil || d <= 0 {
+		return 5 * time.Second
+	}
+	return d
+}
+
+// wsMessage is every message on the socket, in both directions
+type wsMessage struct {
+	Type      string    `json:"type"`
+	Subject   string    `json:"sub,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt int64     `json:"expires_at,omitempty"`
+	Orders    []wsOrder `json:"orders,omitempty"`
+	Status    *wsStatus `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type wsStatus struct {
+	OrderID    string `json:"order_id"`
+	Status     string `json:"status"`
+	TrackingID string `json:"tracking_id,omitempty"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+type wsOrder struct {
+	OrderID    string `json:"order_id"`
+	TrackingID string `json:"tracking_id"`
+	Items      int    `json:"items"`
+	Total      string `json:"total"`
+	PlacedAt   int64  `json:"placed_at"`
+}
+
+// wsBinding is the credential a socket currently acts with
+type wsBinding struct {
+	token  string
+	claims *JWTClaims
+	idp    bool // an IdP token, which the frontend can't mint
+}
+
+func (b *wsBinding) expires() time.Time {
+	if b.claims.ExpiresAt == nil {
+		return time.Now().Add(time.Hour)
+	}
+	return b.claims.ExpiresAt.Time
+}
+
+// context carries the binding the way ensureJWT carries a request's token,
+// so the gRPC interceptors forward it
+func (b *wsBinding) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, ctxKeyJWTToken{}, b.token)
+	return context.WithValue(ctx, ctxKeyJWT{}, b.claims)
+}
+
+// wsCredentials validates the JWT the upgrade request carries. ensureJWT
+// mints a token for cookie-less requests, but a token minted for the
+// upgrade itself never reached the client, so it doesn't count.
+func wsCredentials(r *http.Request) (*wsBinding, error) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		claims, err := validateJWT(bearer)
+		if err != nil {
+			return nil, err
+		}
+		return &wsBinding{token: bearer, claims: claims}, nil
+	}
+	if token, claims, ok := oidcClaimsFor(r); ok {
+		return &wsBinding{token: token, claims: claims, idp: true}, nil
+	}
+	token, _ := r.Context().Value(ctxKeyJWTToken{}).(string)
+	claims, ok := getJWTFromContext(r.Context())
+	if !ok || claims == nil || token == "" || token != getJWTToken(r) {
+		return nil, errors.New("the upgrade request carries no valid JWT")
+	}
+	return &wsBinding{token: token, claims: claims}, nil
+}
+
+// wsConn is one open socket
+type wsConn struct {
+	conn      *websocket.Conn
+	sessionID string
+	revoked   chan struct{}
+	once      sync.Once
+}
+
+func (c *wsConn) revoke() { c.once.Do(func() { close(c.revoked) }) }
+
+func (c *wsConn) send(m wsMessage) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(m)
+}
+
+func (c *wsConn) close(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
+
+// wsSessions indexes open sockets by session, so logout can close them
+var wsSessions = struct {
+	sync.Mutex
+	conns map[string]map[*wsConn]struct{}
+}{conns: make(map[string]map[*wsConn]struct{})}
+
+func init() {
+	onSessionRevoked(func(sessionID string) {
+		wsSessions.Lock()
+		defer wsSessions.Unlock()
+		for c := range wsSessions.conns[sessionID] {
+			c.revoke()
+		}
+	})
+}
+
+func registerWSConn(c *wsConn) {
+	wsSessions.Lock()
+	defer wsSessions.Unlock()
+	if wsSessions.conns[c.sessionID] == nil {
+		wsSessions.conns[c.sessionID] = make(map[*wsConn]struct{})
+	}
+	wsSessions.conns[c.sessionID][c] = struct{}{}
+}
+
+func unregisterWSConn(c *wsConn) {
+	wsSessions.Lock()
+	defer wsSessions.Unlock()
+	delete(wsSessions.conns[c.sessionID], c)
+	if len(wsSessions.conns[c.sessionID]) == 0 {
+		delete(wsSessions.conns, c.sessionID)
+	}
+}
+
+// wsOrderSources feed a socket; either may be nil
+type wsOrderSources struct {
+	// list returns the orders of the identity in ctx; it is polled
+	list func(ctx context.Context) ([]pastOrder, error)
+	// statuses streams status changes to send until the stream ends
+	statuses func(ctx context.Context, send func(*pb.OrderStatusUpdate) bool) error
+}
+
+// streamOrderStatus runs checkout's StreamOrderStatus for the identity in ctx
+func (fe *frontendServer) streamOrderStatus(ctx context.Context, send func(*pb.OrderStatusUpdate) bool) error {
+	stream, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).StreamOrderStatus(ctx, &pb.StreamOrderStatusRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		u, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if !send(u) {
+			return nil
+		}
+	}
+}
+
+// orderStatusWSHandler serves /ws/orders
+func (fe *frontendServer) orderStatusWSHandler(src wsOrderSources) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := loggerFromContext(r.Context())
+		b, err := wsCredentials(r)
+		if err != nil {
+			wsStats.Add("rejected", 1)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already answered
+			wsStats.Add("rejected", 1)
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(wsMaxMessage)
+
+		c := &wsConn{conn: conn, sessionID: b.claims.SessionID, revoked: make(chan struct{})}
+		registerWSConn(c)
+		defer unregisterWSConn(c)
+		wsStats.Add("connections", 1)
+		log.Infof("[JWT-FLOW] order status socket bound to %s until %s", pseudonym(b.claims.Subject), b.expires().Format(time.RFC3339))
+
+		reason := c.serve(context.WithoutCancel(r.Context()), b, src, wsPollInterval())
+		wsStats.Add("closed_"+reason, 1)
+		log.Infof("[JWT-FLOW] order status socket of %s closed: %s", pseudonym(b.claims.Subject), reason)
+	}
+}
+
+// serve runs the socket until it closes and returns why
+func (c *wsConn) serve(ctx context.Context, b *wsBinding, src wsOrderSources, poll time.Duration) string {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	incoming, readErr := make(chan wsMessage), make(chan error, 1)
+	go func() {
+		for {
+			var m wsMessage
+			if err := c.conn.ReadJSON(&m); err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case incoming <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := c.send(wsMessage{Type: "bound", Subject: b.claims.Subject, ExpiresAt: b.expires().Unix()}); err != nil {
+		return "write_failed"
+	}
+	var lastOrders string
+	pushOrders := func() error {
+		if src.list == nil {
+			return nil
+		}
+		callCtx, cancel := context.WithTimeout(b.context(ctx), poll)
+		defer cancel()
+		orders, err := src.list(callCtx)
+		if err != nil {
+			// The next poll retries; the client keeps what it has
+			wsStats.Add("poll_failed", 1)
+			return nil
+		}
+		msg := wsMessage{Type: "orders", Orders: make([]wsOrder, len(orders))}
+		sum := sha256.New()
+		for i, o := range orders {
+			msg.Orders[i] = wsOrder{
+				OrderID:    o.Order.GetOrderId(),
+				TrackingID: o.Order.GetShippingTrackingId(),
+				Items:      o.Items,
+				PlacedAt:   o.PlacedAt.Unix(),
+			}
+			if o.Total != nil {
+				msg.Orders[i].Total = renderMoney(*o.Total)
+			}
+			fmt.Fprintf(sum, "%s\n", msg.Orders[i].OrderID)
+		}
+		if fp := hex.EncodeToString(sum.Sum(nil)); fp != lastOrders {
+			lastOrders = fp
+			wsStats.Add("order_updates", 1)
+			return c.send(msg)
+		}
+		return nil
+	}
+	if err := pushOrders(); err != nil {
+		return "write_failed"
+	}
+
+	// The status stream runs with the binding current when it is opened
+	statuses, streamEnded := make(chan *pb.OrderStatusUpdate), make(chan error, 1)
+	var streamToken string
+	openStream := func() {
+		if src.statuses == nil {
+			return
+		}
+		streamToken = b.token
+		wsStats.Add("status_streams", 1)
+		go func(ctx context.Context) {
+			streamEnded <- src.statuses(ctx, func(u *pb.OrderStatusUpdate) bool {
+				select {
+				case statuses <- u:
+					return true
+				case <-done:
+					return false
+				}
+			})
+		}(b.context(ctx))
+	}
+	openStream()
+	var reopen <-chan time.Time
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	warned := false
+	for {
+		deadline := b.expires()
+		if !warned {
+			deadline = deadline.Add(-wsRenewBefore)
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		var err error
+		select {
+		case <-c.revoked:
+			timer.Stop()
+			c.close(wsCloseRevoked, "session logged out")
+			return "revoked"
+		case <-readErr:
+			timer.Stop()
+			return "client_closed"
+		case m := <-incoming:
+			timer.Stop()
+			if m.Type != "token" {
+				continue
+			}
+			nb, rerr := rebindWS(b, m.Token)
+			if rerr != nil {
+				c.send(wsMessage{Type: "error", Error: rerr.Error()})
+				c.close(wsCloseBadToken, "token rejected")
+				return "bad_token"
+			}
+			b, warned = nb, false
+			wsStats.Add("client_tokens", 1)
+			err = c.send(wsMessage{Type: "bound", Subject: b.claims.Subject, ExpiresAt: b.expires().Unix()})
+		case <-ticker.C:
+			timer.Stop()
+			err = pushOrders()
+		case u := <-statuses:
+			timer.Stop()
+			wsStats.Add("status_updates", 1)
+			err = c.send(wsMessage{Type: "status", Status: &wsStatus{
+				OrderID:    u.GetOrderId(),
+				Status:     u.GetStatus().String(),
+				TrackingID: u.GetShippingTrackingId(),
+				UpdatedAt:  u.GetUpdatedAtUnix(),
+			}})
+		case serr := <-streamEnded:
+			timer.Stop()
+			if _, reason, ok := downstreamAuthFailure(serr); ok && reason == "JWT_EXPIRED" {
+				// Expected once per token; reopen with the renewed binding,
+				// or wait for one
+				wsStats.Add("status_stream_expired", 1)
+				if b.token != streamToken {
+					openStream()
+				} else {
+					reopen = time.After(wsStreamBackoff)
+				}
+			} else if status.Code(serr) != codes.Unimplemented {
+				wsStats.Add("status_stream_failed", 1)
+				reopen = time.After(wsStreamBackoff)
+			}
+		case <-reopen:
+			timer.Stop()
+			reopen = nil
+			openStream()
+		case <-timer.C:
+			if warned {
+				c.close(wsCloseTokenExpired, "token expired")
+				return "expired"
+			}
+			nb, rerr := renewWS(b)
+			if errors.Is(rerr, errTokenRevoked) {
+				c.close(wsCloseRevoked, "session logged out")
+				return "revoked"
+			}
+			if rerr != nil {
+				warned = true
+				err = c.send(wsMessage{Type: "token_expiring", ExpiresAt: b.expires().Unix()})
+				break
+			}
+			b = nb
+			wsStats.Add("renewed", 1)
+			msg := wsMessage{Type: "token", Subject: b.claims.Subject, ExpiresAt: b.expires().Unix()}
+			if !b.idp {
+				// The IdP's token stays server side, as in oidc.go
+				msg.Token = b.token
+			}
+			err = c.send(msg)
+		}
+		if err != nil {
+			return "write_failed"
+		}
+	}
+}
+
+// renewWS returns the binding's successor: a newly minted token for the
+// same session, or the session's newer IdP token
+func renewWS(b *wsBinding) (*wsBinding, error) {
+	if b.idp {
+		sess, ok := oidcSessions.Get(b.claims.SessionID)
+		if !ok || sess.token == b.token {
+			return nil, errors.New("no newer IdP token for the session")
+		}
+		claims := *sess.claims
+		claims.SessionID, claims.Currency = b.claims.SessionID, b.claims.Currency
+		return &wsBinding{token: sess.token, claims: &claims, idp: true}, nil
+	}
+	token, err := generateJWT(b.claims.SessionID, b.claims.Currency)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := validateJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	notifyTokenMinted(b.claims.SessionID, token, claims)
+	return &wsBinding{token: token, claims: claims}, nil
+}
+
+// rebindWS validates a token the client sent; it must be for the subject
+// the socket is bound to
+func rebindWS(b *wsBinding, token string) (*wsBinding, error) {
+	claims, err := validateJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject != b.claims.Subject {
+		return nil, fmt.Errorf("token is for %q, the socket is bound to %q", claims.Subject, b.claims.Subject)
+	}
+	return &wsBinding{token: token, claims: claims}, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// TestOrderStatusWS checks that the socket only upgrades with a valid token,
+// pushes order changes with the bound identity, renews the token before it
+// expires, reopens the status stream with the renewed token once the old one
+// expires, and closes when the session logs out.
+func TestOrderStatusWS(t *testing.T) {
+	keys, err := keyring.New(context.Background(), keyring.File("jwt_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring) { signingKeys = k }(signingKeys)
+	signingKeys = keys
+	t.Setenv("ORDER_STATUS_WS_POLL", "20ms")
+
+	var mu sync.Mutex
+	var orders []pastOrder
+	var seenSubjects []string
+	fetch := func(ctx context.Context) ([]pastOrder, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		claims, _ := getJWTFromContext(ctx)
+		seenSubjects = append(seenSubjects, claims.Subject)
+		return append([]pastOrder(nil), orders...), nil
+	}
+	// The first status stream ends the way checkout ends it when its token
+	// expires; the second must be opened with the renewed token
+	var streamTokens []string
+	statuses := func(ctx context.Context, send func(*pb.OrderStatusUpdate) bool) error {
+		mu.Lock()
+		token, _ := ctx.Value(ctxKeyJWTToken{}).(string)
+		streamTokens = append(streamTokens, token)
+		first := len(streamTokens) == 1
+		mu.Unlock()
+		if !first {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		send(&pb.OrderStatusUpdate{OrderId: "o-1", Status: pb.OrderStatusUpdate_SHIPPED, ShippingTrackingId: "T-1"})
+		time.Sleep(1500 * time.Millisecond)
+		st, _ := status.New(codes.Unauthenticated, "stream JWT expired").WithDetails(&errdetails.ErrorInfo{Reason: "JWT_EXPIRED", Domain: jwtErrorDomain})
+		return st.Err()
+	}
+	srv := httptest.NewServer((&frontendServer{}).orderStatusWSHandler(wsOrderSources{list: fetch, statuses: statuses}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("upgrade without a token: %v", err)
+	}
+
+	// Expires a second past wsRenewBefore, truncated to the second, so the
+	// renewal is due up to a second after binding and its token message can
+	// arrive before or between the order messages
+	claims := JWTClaims{SessionID: "ws-session", Currency: "EUR", RegisteredClaims: jwt.RegisteredClaims{
+		Issuer: jwtIssuer, Subject: "urn:hipstershop:user:ws-session", Audience: jwt.ClaimStrings{jwtAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(wsRenewBefore + time.Second)), ID: "ws-jti",
+	}}
+	token, err := signJWT(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// read returns the next message of type want, keeping the messages of
+	// other types it reads past for later calls
+	var skipped []wsMessage
+	read := func(want string) wsMessage {
+		t.Helper()
+		for i, m := range skipped {
+			if m.Type == want {
+				skipped = append(skipped[:i], skipped[i+1:]...)
+				return m
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var m wsMessage
+			if err := conn.ReadJSON(&m); err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if m.Type == want {
+				return m
+			}
+			skipped = append(skipped, m)
+		}
+	}
+
+	if m := read("bound"); m.Subject != claims.Subject {
+		t.Errorf("bound to %q", m.Subject)
+	}
+	read("orders")
+	mu.Lock()
+	orders = append(orders, pastOrder{Order: &pb.OrderResult{OrderId: "o-1"}, Total: &pb.Money{CurrencyCode: "EUR", Units: 3}, Items: 2})
+	mu.Unlock()
+	if m := read("status"); m.Status.OrderID != "o-1" || m.Status.Status != "SHIPPED" {
+		t.Errorf("got status %+v", m.Status)
+	}
+	if m := read("orders"); len(m.Orders) != 1 || m.Orders[0].OrderID != "o-1" || m.Orders[0].Items != 2 {
+		t.Errorf("got orders %+v", m.Orders)
+	}
+
+	m := read("token")
+	renewed, err := validateJWT(m.Token)
+	if err != nil {
+		t.Fatalf("renewed token: %v", err)
+	}
+	if renewed.Subject != claims.Subject || renewed.Currency != "EUR" || !renewed.ExpiresAt.After(claims.ExpiresAt.Time) {
+		t.Errorf("renewed claims %+v", renewed)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(streamTokens)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if len(streamTokens) != 2 || streamTokens[0] != token || streamTokens[1] != m.Token {
+		t.Errorf("status streams opened with %d tokens, want the bound then the renewed one", len(streamTokens))
+	}
+	for _, s := range seenSubjects {
+		if s != claims.Subject {
+			t.Errorf("fetched orders for %q", s)
+		}
+	}
+	mu.Unlock()
+
+	notifySessionRevoked("ws-session")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, wsCloseRevoked) {
+		t.Errorf("after logout: %v, want close %d", err, wsCloseRevoked)
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 )
 
 /*
@@ -40,7 +39,7 @@ type PackagingInfo struct {
 
 // init() is a special function in Golang that will run when this package is imported.
 func init() {
-	packagingServiceUrl = os.Getenv("PACKAGING_SERVICE_URL")
+	packagingServiceUrl = knobs.Value("PACKAGING_SERVICE_URL")
 }
 
 func isPackagingServiceConfigured() bool {
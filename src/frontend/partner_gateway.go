@@ -0,0 +1,463 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// Partner API gateway
+//
+// With PARTNER_API_KEYS_FILE set, machine-to-machine callers place orders
+// over REST (POST /api/partner/v1/orders) instead of going through the
+// browser session flow. A partner authenticates with its API key in
+// X-API-Key; the gateway mints an internal JWT for it and the order's
+// downstream calls carry that token through the same split pipeline as a
+// browser session. The token is reused until shortly before it expires, so
+// a partner's static and session blocks stay indexed on the downstream
+// connections. Every response returns it in X-Partner-Token, and until it
+// expires the partner may send it back as Authorization: Bearer instead of
+// the key.
+//
+// The keys file is a JSON list. Keys are stored as SHA-256 hex digests, and
+// each has its own rate limit (defaults 5/s, burst 10) and counters under
+// the partner_api expvar:
+//
+//	[{"id":"acme","name":"Acme Corp","key_sha256":"<hex>","email":"orders@acme.example",
+//	  "market_id":"US","currency":"USD","rate_per_second":5,"burst":10}]
+
+const (
+	partnerAPIPrefix = "/api/partner/"
+	partnerKeyHeader = "X-API-Key"
+
+	// partnerTokenTTL is the lifetime of minted partner tokens; one with less
+	// than partnerTokenRenewBefore left is replaced
+	partnerTokenTTL         = 5 * time.Minute
+	partnerTokenRenewBefore = time.Minute
+
+	partnerSubjectPrefix = "urn:hipstershop:partner:"
+	maxPartnerOrderBytes = 64 << 10
+	maxPartnerOrderItems = 50
+	// maxPartnerItemQuantity is the bound validator.AddToCartPayload puts
+	// on a cart line; totals are computed by repeated addition per unit
+	maxPartnerItemQuantity = 10
+)
+
+// partnerKey is one entry of the keys file
+type partnerKey struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	KeySHA256     string  `json:"key_sha256"`
+	Email         string  `json:"email,omitempty"`
+	MarketID      string  `json:"market_id,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	RatePerSecond float64 `json:"rate_per_second,omitempty"`
+	Burst         int     `json:"burst,omitempty"`
+}
+
+// partner is a configured API key with its limiter, counters and the token
+// currently minted for it
+type partner struct {
+	partnerKey
+	limiter *rate.Limiter
+	stats   *expvar.Map
+
+	mu     sync.Mutex
+	token  string
+	claims *JWTClaims
+}
+
+type partnerGatewayConfig struct {
+	byDigest map[[sha256.Size]byte]*partner
+	byID     map[string]*partner
+}
+
+type ctxKeyPartner struct{}
+
+// partnerGateway is nil unless PARTNER_API_KEYS_FILE is set
+var partnerGateway *partnerGatewayConfig
+
+// partnerAPIStats holds a counter map per partner id, plus requests
+// refused before a partner was known
+var partnerAPIStats = expvar.NewMap("partner_api")
+
+// initPartnerGateway loads PARTNER_API_KEYS_FILE
+func initPartnerGateway() error {
+	path := knobs.Value("PARTNER_API_KEYS_FILE")
+	if path == "" {
+		return nil
+	}
+	keys, err := loadPartnerKeys(path)
+	if err != nil {
+		return err
+	}
+	partnerGateway = newPartnerGateway(keys)
+	log.Infof("[JWT-FLOW] Partner API enabled for %d keys", len(keys))
+	return nil
+}
+
+// loadPartnerKeys reads and validates a keys file, filling in defaults
+func loadPartnerKeys(path string) ([]partnerKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []partnerKey
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	seenID := make(map[string]bool)
+	seenKey := make(map[string]bool)
+	for i := range keys {
+		k := &keys[i]
+		digest, err := hex.DecodeString(k.KeySHA256)
+		switch {
+		case k.ID == "":
+			return nil, fmt.Errorf("%s: key %d has no id", path, i)
+		case seenID[k.ID]:
+			return nil, fmt.Errorf("%s: id %q is listed twice", path, k.ID)
+		case err != nil || len(digest) != sha256.Size:
+			return nil, fmt.Errorf("%s: key %q: key_sha256 must be a hex SHA-256 digest", path, k.ID)
+		case seenKey[strings.ToLower(k.KeySHA256)]:
+			return nil, fmt.Errorf("%s: key %q reuses another partner's key", path, k.ID)
+		case k.RatePerSecond < 0 || k.Burst < 0:
+			return nil, fmt.Errorf("%s: key %q: rate_per_second and burst must not be negative", path, k.ID)
+		}
+		seenID[k.ID], seenKey[strings.ToLower(k.KeySHA256)] = true, true
+		if k.Name == "" {
+			k.Name = k.ID
+		}
+		if k.MarketID == "" {
+			k.MarketID = "US"
+		}
+		if k.Currency == "" {
+			k.Currency = defaultCurrency
+		}
+		if k.RatePerSecond == 0 {
+			k.RatePerSecond = 5
+		}
+		if k.Burst == 0 {
+			k.Burst = 10
+		}
+	}
+	return keys, nil
+}
+
+func newPartnerGateway(keys []partnerKey) *partnerGatewayConfig {
+	g := &partnerGatewayConfig{
+		byDigest: make(map[[sha256.Size]byte]*partner, len(keys)),
+		byID:     make(map[string]*partner, len(keys)),
+	}
+	for _, k := range keys {
+		p := &partner{partnerKey: k, limiter: rate.NewLimiter(rate.Limit(k.RatePerSecond), k.Burst), stats: new(expvar.Map)}
+		partnerAPIStats.Set(k.ID, p.stats)
+		var digest [sha256.Size]byte
+		hex.Decode(digest[:], []byte(k.KeySHA256))
+		g.byDigest[digest] = p
+		g.byID[k.ID] = p
+	}
+	return g
+}
+
+// isPartnerRequest selects requests for the partner API; they skip the
+// browser session and JWT cookie middlewares
+func isPartnerRequest(r *http.Request) bool {
+	return partnerGateway != nil && strings.HasPrefix(r.URL.Path, baseUrl+partnerAPIPrefix)
+}
+
+func isBrowserRequest(r *http.Request) bool { return !isPartnerRequest(r) }
+
+// authenticate finds the partner by API key, or by a token it was given
+func (g *partnerGatewayConfig) authenticate(r *http.Request) (*partner, error) {
+	if key := r.Header.Get(partnerKeyHeader); key != "" {
+		if p, ok := g.byDigest[sha256.Sum256([]byte(key))]; ok {
+			return p, nil
+		}
+		return nil, errors.New("unknown API key")
+	}
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errors.New("missing " + partnerKeyHeader + " or bearer token")
+	}
+	claims, err := validateJWT(bearer)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := strings.CutPrefix(claims.Subject, partnerSubjectPrefix); ok {
+		if p, ok := g.byID[id]; ok {
+			return p, nil
+		}
+	}
+	return nil, errors.New("token was not issued to a partner")
+}
+
+// currentToken returns the partner's token, minting a new one when the
+// current one is close to expiry
+func (p *partner) currentToken() (string, *JWTClaims, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.claims != nil && time.Until(p.claims.ExpiresAt.Time) > partnerTokenRenewBefore {
+		return p.token, p.claims, nil
+	}
+
+	now := time.Now()
+	jti, _ := uuid.NewRandom()
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", nil, fmt.Errorf("failed to generate random value: %w", err)
+	}
+	sessionID := "partner-" + p.ID
+	claims := &JWTClaims{
+		SessionID:   sessionID,
+		Name:        p.Name,
+		Email:       p.Email,
+		MarketID:    p.MarketID,
+		Currency:    p.Currency,
+		CartID:      "cart-" + sessionID,
+		RandomValue: base64.StdEncoding.EncodeToString(randomBytes),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   partnerSubjectPrefix + p.ID,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(partnerTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti.String(),
+		},
+		Cnf: tokenConfirmation,
+	}
+	token, err := generateJWTFromClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	p.token, p.claims = token, claims
+	p.stats.Add("tokens_minted", 1)
+	notifyTokenMinted(sessionID, token, claims)
+	return token, claims, nil
+}
+
+// partnerMiddleware authenticates and rate limits partner requests and puts
+// the partner's token in the context where ensureJWT would
+func partnerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := partnerGateway.authenticate(r)
+		if err != nil {
+			accessFromContext(r.Context()).token("partner", nil, false, 0)
+			partnerAPIStats.Add("unauthenticated", 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="partner"`)
+			writePartnerError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		p.stats.Add("requests", 1)
+		if res := p.limiter.Reserve(); res.Delay() > 0 {
+			res.Cancel()
+			p.stats.Add("rate_limited", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.Delay().Seconds()))))
+			writePartnerError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		token, claims, err := p.currentToken()
+		if err != nil {
+			writePartnerError(w, http.StatusInternalServerError, "failed to issue token")
+			return
+		}
+		w.Header().Set("X-Partner-Token", token)
+
+		ctx := context.WithValue(r.Context(), ctxKeySessionID{}, claims.SessionID)
+		ctx = context.WithValue(ctx, ctxKeyJWTToken{}, token)
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
+		ctx = context.WithValue(ctx, ctxKeyPartner{}, p)
+		accessFromContext(ctx).token("partner", claims, true, 0)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func writePartnerError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+type partnerOrderItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int32  `json:"quantity"`
+}
+
+type partnerOrderRequest struct {
+	Items    []partnerOrderItem `json:"items"`
+	Email    string             `json:"email"`
+	Currency string             `json:"currency"`
+	Address  struct {
+		StreetAddress string `json:"street_address"`
+		City          string `json:"city"`
+		State         string `json:"state"`
+		Country       string `json:"country"`
+		ZipCode       int64  `json:"zip_code"`
+	} `json:"address"`
+	CreditCard struct {
+		Number          string `json:"number"`
+		ExpirationMonth int64  `json:"expiration_month"`
+		ExpirationYear  int64  `json:"expiration_year"`
+		CVV             int64  `json:"cvv"`
+	} `json:"credit_card"`
+}
+
+type partnerOrderResponse struct {
+	OrderID    string             `json:"order_id"`
+	TrackingID string             `json:"shipping_tracking_id"`
+	Items      []partnerOrderItem `json:"items"`
+	Shipping   *pb.Money          `json:"shipping_cost"`
+	Total      *pb.Money          `json:"total"`
+}
+
+// partnerOrderHandler places an order for the authenticated partner. Each
+// order fills a cart of its own, so a partner's concurrent orders don't mix.
+func (fe *frontendServer) partnerOrderHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	p := r.Context().Value(ctxKeyPartner{}).(*partner)
+
+	var req partnerOrderRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPartnerOrderBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writePartnerError(w, http.StatusBadRequest, "invalid order: "+err.Error())
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxPartnerOrderItems {
+		writePartnerError(w, http.StatusUnprocessableEntity, fmt.Sprintf("an order needs 1 to %d items", maxPartnerOrderItems))
+		return
+	}
+	for _, it := range req.Items {
+		if it.ProductID == "" || it.Quantity < 1 || it.Quantity > maxPartnerItemQuantity {
+			writePartnerError(w, http.StatusUnprocessableEntity, fmt.Sprintf("every item needs a product_id and a quantity of 1 to %d", maxPartnerItemQuantity))
+			return
+		}
+	}
+	if req.Email == "" {
+		req.Email = p.Email
+	}
+	if req.Currency == "" {
+		req.Currency = p.Currency
+	}
+	if _, ok := whitelistedCurrencies[req.Currency]; !ok {
+		writePartnerError(w, http.StatusUnprocessableEntity, fmt.Sprintf("currency %q is not supported", req.Currency))
+		return
+	}
+	payload := validator.PlaceOrderPayload{
+		Email:         req.Email,
+		StreetAddress: req.Address.StreetAddress,
+		ZipCode:       req.Address.ZipCode,
+		City:          req.Address.City,
+		State:         req.Address.State,
+		Country:       req.Address.Country,
+		CcNumber:      req.CreditCard.Number,
+		CcMonth:       req.CreditCard.ExpirationMonth,
+		CcYear:        req.CreditCard.ExpirationYear,
+		CcCVV:         req.CreditCard.CVV,
+	}
+	if err := payload.Validate(); err != nil {
+		writePartnerError(w, http.StatusUnprocessableEntity, validator.ValidationErrorResponse(err).Error())
+		return
+	}
+
+	cartID := sessionID(r) + "-" + uuid.NewString()
+	for _, it := range req.Items {
+		if err := fe.insertCart(r.Context(), cartID, it.ProductID, it.Quantity); err != nil {
+			fe.failPartnerOrder(w, r, p, cartID, err)
+			return
+		}
+	}
+	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
+		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
+			Email: payload.Email,
+			CreditCard: &pb.CreditCardInfo{
+				CreditCardNumber:          payload.CcNumber,
+				CreditCardExpirationMonth: int32(payload.CcMonth),
+				CreditCardExpirationYear:  int32(payload.CcYear),
+				CreditCardCvv:             int32(payload.CcCVV)},
+			UserId:       cartID,
+			UserCurrency: req.Currency,
+			Address: &pb.Address{
+				StreetAddress: payload.StreetAddress,
+				City:          payload.City,
+				State:         payload.State,
+				ZipCode:       int32(payload.ZipCode),
+				Country:       payload.Country},
+		})
+	if err != nil {
+		fe.failPartnerOrder(w, r, p, cartID, err)
+		return
+	}
+	p.stats.Add("orders", 1)
+	log.WithField("order", order.GetOrder().GetOrderId()).WithField("partner", p.ID).Info("partner order placed")
+
+	resp := partnerOrderResponse{
+		OrderID:    order.GetOrder().GetOrderId(),
+		TrackingID: order.GetOrder().GetShippingTrackingId(),
+		Shipping:   order.GetOrder().GetShippingCost(),
+	}
+	total := *order.GetOrder().GetShippingCost()
+	for _, v := range order.GetOrder().GetItems() {
+		resp.Items = append(resp.Items, partnerOrderItem{ProductID: v.GetItem().GetProductId(), Quantity: v.GetItem().GetQuantity()})
+		total = money.Must(money.Sum(total, money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))))
+	}
+	resp.Total = &total
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// failPartnerOrder answers a failed order and empties its cart
+func (fe *frontendServer) failPartnerOrder(w http.ResponseWriter, r *http.Request, p *partner, cartID string, err error) {
+	p.stats.Add("order_failures", 1)
+	loggerFromContext(r.Context()).WithField("partner", p.ID).WithField("error", err).Warn("partner order failed")
+	if cerr := fe.emptyCart(context.WithoutCancel(r.Context()), cartID); cerr != nil {
+		loggerFromContext(r.Context()).WithField("error", cerr).Warn("failed to empty partner cart")
+	}
+	if f, _, ok := downstreamAuthFailure(err); ok {
+		writePartnerError(w, f.status, f.message)
+		return
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.FailedPrecondition:
+		writePartnerError(w, http.StatusUnprocessableEntity, status.Convert(err).Message())
+	default:
+		writePartnerError(w, http.StatusBadGateway, "failed to complete the order")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+func TestPartnerMiddleware(t *testing.T) {
+	keys, err := keyring.New(context.Background(), keyring.File("jwt_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, g *partnerGatewayConfig) { signingKeys, partnerGateway = k, g }(signingKeys, partnerGateway)
+	signingKeys = keys
+
+	digest := sha256.Sum256([]byte("acme-secret"))
+	partnerGateway = newPartnerGateway([]partnerKey{{
+		ID: "acme", Name: "Acme", KeySHA256: hex.EncodeToString(digest[:]),
+		MarketID: "US", Currency: "USD", RatePerSecond: 0.001, Burst: 3,
+	}})
+
+	var seen *JWTClaims
+	h := partnerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = getJWTFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	call := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, partnerAPIPrefix+"v1/orders", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call(partnerKeyHeader, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key: status %d, want 401", w.Code)
+	}
+	if w := call("", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials: status %d, want 401", w.Code)
+	}
+
+	w := call(partnerKeyHeader, "acme-secret")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("valid key: status %d, want 204", w.Code)
+	}
+	token := w.Header().Get("X-Partner-Token")
+	if token == "" || seen == nil || seen.Subject != partnerSubjectPrefix+"acme" || seen.SessionID != "partner-acme" {
+		t.Fatalf("minted token %q with claims %+v", token, seen)
+	}
+
+	// The minted token authenticates on its own and is reused, not reminted
+	if w := call("Authorization", "Bearer "+token); w.Code != http.StatusNoContent || w.Header().Get("X-Partner-Token") != token {
+		t.Errorf("bearer token: status %d, token reused %v", w.Code, w.Header().Get("X-Partner-Token") == token)
+	}
+
+	// Burst of 3 is spent; the limiter refills far slower than the test runs
+	if w := call(partnerKeyHeader, "acme-secret"); w.Code != http.StatusNoContent {
+		t.Errorf("third call: status %d, want 204", w.Code)
+	}
+	w = call(partnerKeyHeader, "acme-secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	stats := partnerAPIStats.Get("acme").String()
+	for _, want := range []string{`"rate_limited": 1`, `"tokens_minted": 1`, `"requests": 4`} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("partner stats %s lack %s", stats, want)
+		}
+	}
+}
+
+// TestPartnerOrderQuantity checks that item quantities outside the cart's
+// bounds are refused before anything is placed
+func TestPartnerOrderQuantity(t *testing.T) {
+	p := &partner{partnerKey: partnerKey{ID: "acme", Currency: "USD"}}
+	for _, q := range []int{0, -1, maxPartnerItemQuantity + 1, 1 << 30} {
+		body := fmt.Sprintf(`{"items":[{"product_id":"OLJCESPC7Z","quantity":%d}]}`, q)
+		r := httptest.NewRequest(http.MethodPost, partnerAPIPrefix+"v1/orders", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyPartner{}, p))
+		w := httptest.NewRecorder()
+		new(frontendServer).partnerOrderHandler(w, r)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("quantity %d: status %d, want 422", q, w.Code)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Speculative prefetch
+//
+// Page handlers call currency, catalog, cart and recommendation services one
+// after another although most of the calls only depend on the request. With
+// the page-prefetch flag on (PAGE_PREFETCH) and the session's claims matching
+// PAGE_PREFETCH_CLAIMS, a claim selector such as "groups contains beta" or
+// "currency=EUR" (empty matches every session), a handler starts those calls
+// in parallel up front and collects each result where it used to make the
+// call.
+//
+// The calls run under one context derived from the request and cancelled
+// when the handler returns, so a page that fails early abandons what is still
+// in flight. The context also carries a memo of the user token's split
+// components, so parallel calls decompose the JWT once instead of once each.
+// With prefetching off every call is made inline, exactly as before.
+
+// prefetchSelector limits prefetching to sessions whose claims match; an
+// invalid PAGE_PREFETCH_CLAIMS disables prefetching rather than widening it
+var prefetchSelector, prefetchSelectorErr = parseClaimSelector(knobs.Value("PAGE_PREFETCH_CLAIMS"))
+
+// prefetchEvents counts prefetched calls and those the page never collected
+var prefetchEvents = expvar.NewMap("page_prefetch")
+
+// prefetcher coordinates the prefetched calls of one page
+type prefetcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	pending int
+}
+
+// startPrefetch returns the page's coordinator, or nil when the session
+// doesn't prefetch. The caller must Stop it.
+func (fe *frontendServer) startPrefetch(r *http.Request) *prefetcher {
+	ctx := r.Context()
+	if prefetchSelectorErr != nil || !pagePrefetchEnabled(ctx) || !prefetchSelector.MatchesContext(ctx) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if token, ok := ctx.Value(ctxKeyJWTToken{}).(string); ok && token != "" {
+		ctx = withJWTComponentsMemo(ctx, token)
+	}
+	return &prefetcher{ctx: ctx, cancel: cancel}
+}
+
+// Stop cancels the calls the page didn't wait for
+func (p *prefetcher) Stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending > 0 {
+		prefetchEvents.Add("unused", int64(p.pending))
+	}
+}
+
+// prefetch starts fetch in the background when p is prefetching and returns
+// a function that waits for its result. Without a prefetcher the returned
+// function makes the call itself, under ctx.
+func prefetch[T any](p *prefetcher, ctx context.Context, fetch func(context.Context) (T, error)) func() (T, error) {
+	if p == nil {
+		return func() (T, error) { return fetch(ctx) }
+	}
+
+	var (
+		v    T
+		err  error
+		done = make(chan struct{})
+	)
+	p.mu.Lock()
+	p.pending++
+	p.mu.Unlock()
+	prefetchEvents.Add("started", 1)
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("prefetch panicked: %v", r)
+			}
+		}()
+		v, err = fetch(p.ctx)
+	}()
+
+	var once sync.Once
+	return func() (T, error) {
+		once.Do(func() {
+			p.mu.Lock()
+			p.pending--
+			p.mu.Unlock()
+		})
+		select {
+		case <-done:
+			return v, err
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// Context key for the split components of the request's user token
+type ctxKeyJWTComponents struct{}
+
+// jwtComponentsMemo decomposes one token once for every call sharing it
+type jwtComponentsMemo struct {
+	token      string
+	once       sync.Once
+	components *JWTComponents
+	err        error
+}
+
+func withJWTComponentsMemo(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, ctxKeyJWTComponents{}, &jwtComponentsMemo{token: token})
+}
+
+// decomposeJWTFor decomposes token, reusing the request's memo when it holds
+// the same token. The components are shared and must not be modified.
+func decomposeJWTFor(ctx context.Context, token string) (*JWTComponents, error) {
+	memo, ok := ctx.Value(ctxKeyJWTComponents{}).(*jwtComponentsMemo)
+	if !ok || memo.token != token {
+		return DecomposeJWT(token)
+	}
+	memo.once.Do(func() {
+		memo.components, memo.err = DecomposeJWT(token)
+	})
+	return memo.components, memo.err
+}
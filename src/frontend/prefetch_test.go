@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestPrefetch checks that prefetched calls run in parallel, that Stop
+// cancels the ones the page never collected, and that calls sharing the
+// prefetch context decompose the user token once.
+func TestPrefetch(t *testing.T) {
+	inline := 0
+	get := prefetch(nil, context.Background(), func(context.Context) (int, error) { inline++; return 1, nil })
+	if inline != 0 {
+		t.Fatal("prefetch without a prefetcher called before its result was needed")
+	}
+	if v, err := get(); v != 1 || err != nil || inline != 1 {
+		t.Fatalf("inline call = %d, %v after %d calls", v, err, inline)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetcher{ctx: ctx, cancel: cancel}
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	slow := func(ctx context.Context) (string, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return "done", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	getA := prefetch(p, context.Background(), slow)
+	getB := prefetch(p, context.Background(), func(ctx context.Context) (string, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("prefetched calls did not start in parallel")
+		}
+	}
+	close(release)
+	if v, err := getA(); v != "done" || err != nil {
+		t.Errorf("collected result = %q, %v", v, err)
+	}
+
+	unused := func() int64 {
+		if v, ok := prefetchEvents.Get("unused").(interface{ Value() int64 }); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := unused()
+	p.Stop()
+	if got := unused() - before; got != 1 {
+		t.Errorf("unused prefetches after Stop = %d, want 1", got)
+	}
+	if _, err := getB(); !errors.Is(err, context.Canceled) {
+		t.Errorf("uncollected call after Stop = %v, want %v", err, context.Canceled)
+	}
+
+	token := "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ1In0.c2ln"
+	memoCtx := withJWTComponentsMemo(context.Background(), token)
+	first, err := decomposeJWTFor(memoCtx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := decomposeJWTFor(memoCtx, token); again != first {
+		t.Error("calls sharing the memo decomposed the token again")
+	}
+	if other, _ := decomposeJWTFor(memoCtx, "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ2In0.c2ln"); other == first {
+		t.Error("memo answered for a different token")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/grafana/pyroscope-go"
+)
+
+// Profiling
+//
+// The debug server (DEBUG_PORT) serves net/http/pprof under /debug/pprof/,
+// which Parca or any other pprof scraper can pull. With
+// PYROSCOPE_SERVER_ADDRESS set, profiles are also pushed to Pyroscope.
+// Requests run under a jwt_mode profiler label, so either backend can compare
+// the CPU spent with compression on and off.
+//
+// The statistics and state of the JWT pipeline are served on the debug
+// server too, never on the public listener: /debug/grpcstats,
+// /debug/jwtslo, /debug/vars (expvar), /debug/metrics (Prometheus, with
+// exemplars), /debug/compression, /debug/decisions, /debug/jwtflow and
+// /debug/jwtflow/view.
+//
+// The debug server listens on loopback only, so its session and config
+// views are reachable from inside the pod alone. DEBUG_LISTEN_ADDR opts in
+// to other addresses, for scrapers, probes and receivers resolving token
+// references from another pod.
+
+// registerPprof adds the pprof handlers to the debug mux
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// registerStatsHandlers adds the JWT pipeline statistics to the debug mux
+func registerStatsHandlers(mux *http.ServeMux) {
+	mux.Handle("/debug/grpcstats", wireStats)
+	mux.Handle("/debug/jwtslo", jwtSLO)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/debug/metrics", metricsHandler)
+	mux.Handle("/debug/compression", adaptiveCompression)
+	mux.Handle("/debug/decisions", decisionLog)
+	mux.Handle("/debug/jwtflow", jwtFlow)
+	mux.HandleFunc("/debug/jwtflow/view", jwtFlow.view)
+}
+
+// startPyroscope pushes continuous profiles when PYROSCOPE_SERVER_ADDRESS is set
+func startPyroscope(service string) {
+	addr := knobs.Value("PYROSCOPE_SERVER_ADDRESS")
+	if addr == "" {
+		return
+	}
+	_, err := pyroscope.Start(pyroscope.Config{
+		ApplicationName:   service,
+		ServerAddress:     addr,
+		BasicAuthUser:     knobs.Value("PYROSCOPE_BASIC_AUTH_USER"),
+		BasicAuthPassword: knobs.Value("PYROSCOPE_BASIC_AUTH_PASSWORD"),
+		Tags:              map[string]string{"pod": knobs.Value("HOSTNAME")},
+		ProfileTypes: []pyroscope.ProfileType{
+			pyroscope.ProfileCPU,
+			pyroscope.ProfileAllocObjects,
+			pyroscope.ProfileAllocSpace,
+			pyroscope.ProfileInuseObjects,
+			pyroscope.ProfileInuseSpace,
+			pyroscope.ProfileGoroutines,
+		},
+	})
+	if err != nil {
+		log.Warnf("failed to start pyroscope profiler: %v", err)
+		return
+	}
+	log.Infof("pushing profiles to pyroscope at %s", addr)
+}
+
+// profileLabels runs the request under a jwt_mode profiler label, which the
+// outgoing RPCs inherit; the label is the mode the flag selects, not whether
+// a given token ended up split
+func profileLabels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := jwtModeFull
+		if jwtCompressionEnabled(r.Context()) {
+			mode = jwtModeCompressed
+		}
+		runtimepprof.Do(r.Context(), runtimepprof.Labels("jwt_mode", mode), func(ctx context.Context) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
+
+// startDebugServer serves pprof and the debug handlers on DEBUG_PORT, away
+// from the public listener
+func startDebugServer() {
+	port := knobs.Value("DEBUG_PORT")
+	if port == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	registerStatsHandlers(mux)
+	registerReferenceHandler(mux)
+	registerChaosHandler(mux)
+	registerTargetMemoryHandler(mux)
+	registerClaimsAuditHandler(mux)
+	registerKeyDrillHandler(mux)
+	registerDebugTokenHandler(mux)
+
+	addr := net.JoinHostPort(knobs.Get("DEBUG_LISTEN_ADDR"), port)
+	go func() {
+		log.Infof("starting debug server on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Warnf("debug server stopped: %v", err)
+		}
+	}()
+}
+
+// isLoopbackHost reports whether the debug server host only accepts
+// connections from inside the pod
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
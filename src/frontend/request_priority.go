@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Request priority
+//
+// REQUEST_PRIORITY_HIGH and REQUEST_PRIORITY_LOW are claim selectors
+// (claim_selector.go), e.g. "groups contains premium", picking the sessions
+// whose downstream calls carry x-request-priority high or low next to the
+// JWT headers. Overloaded checkout and shipping servers shed low priority
+// requests first, see load_shedding.go there. Calls matching neither are
+// sent without the header, which receivers read as normal.
+
+const requestPriorityHeader = "x-request-priority"
+
+var (
+	highPrioritySessions = loadPrioritySelector("REQUEST_PRIORITY_HIGH")
+	lowPrioritySessions  = loadPrioritySelector("REQUEST_PRIORITY_LOW")
+)
+
+// loadPrioritySelector parses the selector in key; an unset or invalid one
+// selects no session, config validation reports the latter
+func loadPrioritySelector(key string) claimSelector {
+	sel, err := parseClaimSelector(knobs.Value(key))
+	if err != nil {
+		return nil
+	}
+	return sel
+}
+
+// requestPriority returns the priority of a call sent with token, "" for
+// normal
+func requestPriority(ctx context.Context, token string) string {
+	if len(highPrioritySessions) == 0 && len(lowPrioritySessions) == 0 {
+		return ""
+	}
+	components, err := decomposeJWTFor(ctx, token)
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(components.Payload), &claims); err != nil {
+		return ""
+	}
+	switch {
+	case len(highPrioritySessions) > 0 && highPrioritySessions.Matches(claims):
+		return "high"
+	case len(lowPrioritySessions) > 0 && lowPrioritySessions.Matches(claims):
+		return "low"
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestRequestPriority(t *testing.T) {
+	defer func(high, low claimSelector) { highPrioritySessions, lowPrioritySessions = high, low }(highPrioritySessions, lowPrioritySessions)
+	token := func(payload string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	ctx := context.Background()
+	if p := requestPriority(ctx, token(`{"groups":["premium"]}`)); p != "" {
+		t.Errorf("priority without selectors = %q, want none", p)
+	}
+
+	highPrioritySessions, _ = parseClaimSelector("groups contains premium")
+	lowPrioritySessions, _ = parseClaimSelector("market_id=TEST")
+	for payload, want := range map[string]string{
+		`{"groups":["premium"],"market_id":"TEST"}`: "high",
+		`{"groups":["basic"],"market_id":"TEST"}`:   "low",
+		`{"groups":["basic"],"market_id":"US"}`:     "",
+	} {
+		if p := requestPriority(ctx, token(payload)); p != want {
+			t.Errorf("priority of %s = %q, want %q", payload, p, want)
+		}
+	}
+}
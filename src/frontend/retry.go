@@ -16,18 +16,50 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"strconv"
 	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 const (
 	maxRetries = 3
 	retryDelay = 100 * time.Millisecond
+
+	// maxRetryPushback caps the wait a server can ask for
+	maxRetryPushback = 5 * time.Second
 )
 
+// retryEvents counts retries paced by server pushback, calls the server
+// asked not to retry and retries given up because the deadline comes first
+var retryEvents = expvar.NewMap("grpc_retries")
+
+// retryPushback reads the backpressure hint of a failed call: the
+// grpc-retry-pushback-ms trailer, or else a RetryInfo detail of the status.
+// A negative or malformed trailer asks the client not to retry.
+func retryPushback(err error, trailer metadata.MD) (delay time.Duration, hinted, stop bool) {
+	if v := trailer.Get("grpc-retry-pushback-ms"); len(v) > 0 {
+		ms, perr := strconv.ParseInt(v[0], 10, 64)
+		if perr != nil || ms < 0 {
+			return 0, true, true
+		}
+		return min(time.Duration(ms)*time.Millisecond, maxRetryPushback), true, false
+	}
+	if st, ok := status.FromError(err); ok {
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+				return min(info.GetRetryDelay().AsDuration(), maxRetryPushback), true, false
+			}
+		}
+	}
+	return 0, false, false
+}
+
 // shouldRetry checks if the error is retryable
 func shouldRetry(err error) bool {
 	if err == nil {
@@ -61,23 +93,45 @@ func retryUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 		var err error
 		
 		for attempt := 0; attempt <= maxRetries; attempt++ {
-			err = invoker(ctx, method, req, reply, cc, opts...)
+			var trailer metadata.MD
+			err = invoker(ctx, method, req, reply, cc, append(opts[:len(opts):len(opts)], grpc.Trailer(&trailer))...)
 			
 			if err == nil {
 				return nil
 			}
 			
-			if !shouldRetry(err) {
+			// A server pushing back sets the wait, and makes an exhausted
+			// resource worth retrying
+			delay, hinted, stop := retryPushback(err, trailer)
+			if stop {
+				retryEvents.Add("pushback_stop", 1)
 				return err
 			}
+			if !shouldRetry(err) && !(hinted && status.Code(err) == codes.ResourceExhausted) {
+				return err
+			}
+			if !hinted {
+				delay = retryDelay * time.Duration(attempt+1)
+			}
 			
 			if attempt < maxRetries {
-				log.Warnf("[RETRY] Attempt %d/%d failed for %s: %v", attempt+1, maxRetries+1, method, err)
-				time.Sleep(retryDelay * time.Duration(attempt+1))
+				if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+					retryEvents.Add("deadline", 1)
+					return err
+				}
+				if hinted {
+					retryEvents.Add("pushback", 1)
+				}
+				loggerFromContext(ctx).Warnf("[RETRY] Attempt %d/%d failed for %s, retrying in %v: %v", attempt+1, maxRetries+1, method, delay, err)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return err
+				}
 			}
 		}
 		
-		log.Errorf("[RETRY] All %d attempts failed for %s", maxRetries+1, method)
+		loggerFromContext(ctx).Errorf("[RETRY] All %d attempts failed for %s", maxRetries+1, method)
 		return err
 	}
 }
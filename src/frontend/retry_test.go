@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestRetryPushback checks that the retry interceptor waits as long as an
+// injected error asks, retries an exhausted resource only when asked to and
+// stops when the server says not to retry
+func TestRetryPushback(t *testing.T) {
+	defer func(c *ErrorInjectionConfig) { errorInjectionConfig = c }(errorInjectionConfig)
+	errorInjectionConfig = &ErrorInjectionConfig{Pushback: 50 * time.Millisecond}
+	retry := retryUnaryClientInterceptor()
+	call := func(fail func(attempt int, opts []grpc.CallOption) error) (attempts int, took time.Duration, err error) {
+		start := time.Now()
+		err = retry(context.Background(), "/hipstershop.CartService/GetCart", nil, nil, nil,
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				attempts++
+				return fail(attempts, opts)
+			})
+		return attempts, time.Since(start), err
+	}
+
+	attempts, took, err := call(func(attempt int, opts []grpc.CallOption) error {
+		if attempt == 1 {
+			return withPushback(status.Error(codes.ResourceExhausted, "overloaded"), opts)
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 || took < 50*time.Millisecond {
+		t.Errorf("pushback: %d attempts in %v, err %v; want a retry after 50ms", attempts, took, err)
+	}
+
+	attempts, _, err = call(func(int, []grpc.CallOption) error {
+		return status.Error(codes.ResourceExhausted, "overloaded")
+	})
+	if status.Code(err) != codes.ResourceExhausted || attempts != 1 {
+		t.Errorf("ResourceExhausted without pushback: %d attempts, want 1", attempts)
+	}
+
+	attempts, _, _ = call(func(_ int, opts []grpc.CallOption) error {
+		for _, o := range opts {
+			if tr, ok := o.(grpc.TrailerCallOption); ok {
+				*tr.TrailerAddr = metadata.Pairs("grpc-retry-pushback-ms", "-1")
+			}
+		}
+		return status.Error(codes.Unavailable, "draining")
+	})
+	if attempts != 1 {
+		t.Errorf("negative pushback: %d attempts, want no retry", attempts)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logout revocation
+//
+// Logging out revokes the session and the jti of its current token. The
+// frontend stops accepting either, the session's derived caches are purged
+// through the onSessionRevoked hooks (token_hooks.go), and every URL in
+// JWT_REVOCATION_URLS, normally /jwt/revoke on the DEBUG_PORT of checkout
+// and shipping, is sent the revocation so their interceptors refuse the
+// token's split components if they are replayed from a warm cache. Entries
+// are kept until the revoked token would have expired, and sessions for at
+// least revokedSessionTTL, covering tokens minted just before logout.
+//
+// Each notice is signed with HMAC-SHA256 over its body under
+// JWT_REVOCATION_KEY, sent as X-Revocation-Signature (base64url), and the
+// endpoints refuse notices whose signature does not verify.
+
+const revokedSessionTTL = 10 * time.Minute
+
+var errTokenRevoked = errors.New("token has been revoked")
+
+// revocationNotice is the JSON body POSTed to JWT_REVOCATION_URLS
+type revocationNotice struct {
+	JTI       string `json:"jti,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	Kid       string `json:"kid,omitempty"` // a revoked signing key, see key_drill.go
+	Expires   int64  `json:"exp"`
+}
+
+type revocationList struct {
+	maxEntries int
+
+	mu       sync.Mutex
+	jtis     map[string]time.Time
+	sessions map[string]time.Time
+}
+
+var revocations = newRevocationList(100000)
+
+var (
+	revocationURLs = parseRevocationURLs(knobs.Value("JWT_REVOCATION_URLS"))
+	revocationKey  = []byte(knobs.Value("JWT_REVOCATION_KEY"))
+
+	// revocationEvents counts sessions and signing keys revoked,
+	// downstream notifications sent or failed and revocations shed from a
+	// full list
+	revocationEvents = expvar.NewMap("jwt_revocations")
+)
+
+func newRevocationList(maxEntries int) *revocationList {
+	return &revocationList{maxEntries: maxEntries, jtis: make(map[string]time.Time), sessions: make(map[string]time.Time)}
+}
+
+func parseRevocationURLs(v string) []string {
+	var urls []string
+	for _, u := range strings.Split(v, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// Add revokes jti until it expires and session for at least
+// revokedSessionTTL; either may be empty
+func (l *revocationList) Add(jti, session string, expires time.Time) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.jtis)+len(l.sessions) >= l.maxEntries {
+		l.sweep(now)
+		// Still full of live revocations: make room for a burst of them
+		if len(l.jtis)+len(l.sessions) >= l.maxEntries {
+			l.shed(max(2, l.maxEntries/10))
+		}
+	}
+	if jti != "" {
+		l.jtis[jti] = expires
+	}
+	if session != "" {
+		if min := now.Add(revokedSessionTTL); expires.Before(min) {
+			expires = min
+		}
+		l.sessions[session] = expires
+	}
+}
+
+// Revoked reports whether the token's jti or its session was revoked
+func (l *revocationList) Revoked(jti, session string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if exp, ok := l.jtis[jti]; ok && jti != "" && now.Before(exp) {
+		return true
+	}
+	exp, ok := l.sessions[session]
+	return ok && session != "" && now.Before(exp)
+}
+
+// SessionRevoked reports whether session was revoked
+func (l *revocationList) SessionRevoked(session string) bool {
+	return l.Revoked("", session)
+}
+
+func (l *revocationList) sweep(now time.Time) {
+	for k, exp := range l.jtis {
+		if now.After(exp) {
+			delete(l.jtis, k)
+		}
+	}
+	for k, exp := range l.sessions {
+		if now.After(exp) {
+			delete(l.sessions, k)
+		}
+	}
+}
+
+// shed drops the n revocations closest to expiry, which a replay could use
+// for the shortest time, so a flood of logouts can't grow the list past
+// maxEntries
+func (l *revocationList) shed(n int) {
+	type entry struct {
+		m       map[string]time.Time
+		key     string
+		expires time.Time
+	}
+	entries := make([]entry, 0, len(l.jtis)+len(l.sessions))
+	for k, exp := range l.jtis {
+		entries = append(entries, entry{l.jtis, k, exp})
+	}
+	for k, exp := range l.sessions {
+		entries = append(entries, entry{l.sessions, k, exp})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].expires.Before(entries[j].expires) })
+	n = min(n, len(entries))
+	for _, e := range entries[:n] {
+		delete(e.m, e.key)
+	}
+	revocationEvents.Add("shed", int64(n))
+}
+
+// revokeSession ends a session on logout: its token and the session itself
+// are refused from now on, the caches built from them are purged and
+// downstreams are told. A shared demo session is never revoked as a whole,
+// every visitor would lose it.
+func revokeSession(ctx context.Context, sessionID string, claims *JWTClaims) {
+	notice := revocationNotice{Expires: time.Now().Unix()}
+	if claims != nil {
+		notice.JTI = claims.ID
+		if claims.ExpiresAt != nil {
+			notice.Expires = claims.ExpiresAt.Unix()
+		}
+	}
+	if knobs.Value("ENABLE_SINGLE_SHARED_SESSION") != "true" {
+		notice.SessionID = sessionID
+	}
+	if notice.JTI == "" && notice.SessionID == "" {
+		return
+	}
+	revocations.Add(notice.JTI, notice.SessionID, time.Unix(notice.Expires, 0))
+	revocationEvents.Add("revoked", 1)
+	notifySessionRevoked(sessionID)
+	loggerFromContext(ctx).Infof("[JWT-FLOW] revoked session %s on logout", pseudonym(sessionID))
+
+	if len(revocationURLs) > 0 {
+		go notifyRevocation(notice)
+	}
+}
+
+// notifyRevocation POSTs notice to every downstream revocation endpoint
+func notifyRevocation(notice revocationNotice) {
+	body, _ := json.Marshal(notice)
+	client := &http.Client{Timeout: 2 * time.Second}
+	for _, u := range revocationURLs {
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			log.Warnf("[JWT-FLOW] failed to send revocation to %s: %v", u, err)
+			revocationEvents.Add("notify_failed", 1)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(revocationSignatureHeader, signRevocation(body))
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = errors.New(resp.Status)
+			}
+		}
+		if err != nil {
+			log.Warnf("[JWT-FLOW] failed to send revocation to %s: %v", u, err)
+			revocationEvents.Add("notify_failed", 1)
+			continue
+		}
+		revocationEvents.Add("notified", 1)
+	}
+}
+
+// revocationSignatureHeader carries the HMAC of a revocation notice
+const revocationSignatureHeader = "X-Revocation-Signature"
+
+// signRevocation signs a notice body with JWT_REVOCATION_KEY
+func signRevocation(body []byte) string {
+	mac := hmac.New(sha256.New, revocationKey)
+	mac.Write(body)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestLogoutRevokesSession checks that logout purges the session's prebuilt
+// metadata, refuses its token and session afterwards and tells downstreams
+func TestLogoutRevokesSession(t *testing.T) {
+	notices := make(chan revocationNotice, 1)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(revocationSignatureHeader) != signRevocation(body) {
+			t.Errorf("notice signature %q does not match its body", r.Header.Get(revocationSignatureHeader))
+		}
+		var n revocationNotice
+		json.Unmarshal(body, &n)
+		notices <- n
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+	defer func(urls []string, key []byte) { revocationURLs, revocationKey = urls, key }(revocationURLs, revocationKey)
+	revocationURLs = []string{downstream.URL}
+	revocationKey = []byte("test-revocation-key")
+
+	g := loadGoldenJWTs(t)[0]
+	claims := &JWTClaims{SessionID: "logout-session", RegisteredClaims: jwt.RegisteredClaims{
+		ID:        "logout-jti",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}}
+	e, err := sessionMetadataStore.build(claims.SessionID, g.Token, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionMetadataStore.Swap(claims.SessionID, e)
+
+	ctx := context.WithValue(context.Background(), ctxKeySessionID{}, claims.SessionID)
+	ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
+	r := httptest.NewRequest(http.MethodGet, "/logout", nil).WithContext(ctx)
+	new(frontendServer).logoutHandler(httptest.NewRecorder(), r)
+
+	if _, ok := sessionMetadataStore.Get(claims.SessionID); ok {
+		t.Error("session metadata survived logout")
+	}
+	if !revocations.Revoked(claims.ID, "") || !revocations.SessionRevoked(claims.SessionID) {
+		t.Error("token or session not revoked")
+	}
+	select {
+	case n := <-notices:
+		if n.JTI != claims.ID || n.SessionID != claims.SessionID || n.Expires != claims.ExpiresAt.Unix() {
+			t.Errorf("downstream got %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("downstream was not notified")
+	}
+}
+
+// TestRevocationListBound checks that a list full of live revocations sheds
+// those closest to expiry instead of growing
+func TestRevocationListBound(t *testing.T) {
+	l := newRevocationList(10)
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		l.Add(strconv.Itoa(i), "", now.Add(time.Duration(i+1)*time.Hour))
+	}
+	if n := len(l.jtis); n > 10 {
+		t.Fatalf("list holds %d entries, bound is 10", n)
+	}
+	if !l.Revoked("24", "") {
+		t.Error("latest revocation was shed")
+	}
+	if l.Revoked("0", "") {
+		t.Error("revocation closest to expiry was kept")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Prebuilt session metadata
+//
+// metadata.Pairs allocates a map and a slice per header on every call, yet
+// most split headers never change within a session: x-jwt-header and, with
+// a claim classifier, x-jwt-claims, x-jwt-static and x-jwt-session. The
+// split path keeps those in one read-only metadata.MD per session, attaches
+// it with NewOutgoingContext and appends only the per-token values with
+// AppendToOutgoingContext, which gRPC joins on send without copying the map.
+// While the token is unchanged the per-token values are reused as well; a
+// renewal rebuilds them and keeps the session's MD if it still matches.
+// ensureJWT's refresh hook (token_hooks.go) swaps the new token's entry in
+// as it is minted, and entries are dropped once their token expires or the
+// session logs out.
+//
+// The shared MD must never be modified: code editing outgoing metadata works
+// on the copy metadata.FromOutgoingContext returns. JWT_STATIC_DICTIONARY
+// varies the headers per downstream, so it bypasses the cache.
+
+// sessionMetadata is a session's prebuilt headers; entries are replaced,
+// never modified, so readers need no lock
+type sessionMetadata struct {
+	token    string
+	expires  time.Time   // the token's exp; zero if it has none
+	stable   metadata.MD // read-only
+	perToken []string    // key/value pairs appended per call
+}
+
+func (e *sessionMetadata) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+type sessionMetadataCache struct {
+	maxEntries int
+
+	mu       sync.Mutex
+	sessions map[string]*sessionMetadata
+}
+
+var sessionMetadataStore = newSessionMetadataCache(10000)
+
+// sessionMetadataEvents counts cache hits, renewals, rebuilds, entries
+// swapped in by a token refresh, expired entries dropped and entries purged
+// on logout
+var sessionMetadataEvents = expvar.NewMap("jwt_session_metadata")
+
+func init() {
+	onTokenMinted(func(sessionID, token string, claims *JWTClaims) {
+		if staticDictionaryEnabled || sessionID == "" {
+			return
+		}
+		if e, err := sessionMetadataStore.build(sessionID, token, claims); err == nil && sessionMetadataStore.Swap(sessionID, e) {
+			sessionMetadataEvents.Add("refreshed", 1)
+		}
+	})
+	onSessionRevoked(func(sessionID string) {
+		if sessionMetadataStore.Delete(sessionID) {
+			sessionMetadataEvents.Add("purged", 1)
+		}
+	})
+}
+
+func newSessionMetadataCache(maxEntries int) *sessionMetadataCache {
+	return &sessionMetadataCache{maxEntries: maxEntries, sessions: make(map[string]*sessionMetadata)}
+}
+
+// Get returns the session's entry unless its token has expired
+func (c *sessionMetadataCache) Get(session string) (*sessionMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sessions[session]
+	if ok && e.expired(time.Now()) {
+		delete(c.sessions, session)
+		sessionMetadataEvents.Add("expired", 1)
+		return nil, false
+	}
+	return e, ok
+}
+
+// Swap stores e unless the session already holds a token that expires
+// later: a request still carrying the previous token must not replace the
+// entry a refresh just swapped in. It evicts an arbitrary session when full.
+func (c *sessionMetadataCache) Swap(session string, e *sessionMetadata) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.sessions[session]
+	if ok && old.expires.After(e.expires) {
+		return false
+	}
+	if !ok && len(c.sessions) >= c.maxEntries {
+		for k := range c.sessions {
+			delete(c.sessions, k)
+			break
+		}
+	}
+	c.sessions[session] = e
+	return true
+}
+
+// Delete drops the session's entry, reporting whether there was one
+func (c *sessionMetadataCache) Delete(session string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.sessions[session]
+	delete(c.sessions, session)
+	return ok
+}
+
+// build prebuilds token's headers, sharing the session's stable MD when the
+// new token leaves it unchanged
+func (c *sessionMetadataCache) build(session, token string, claims *JWTClaims) (*sessionMetadata, error) {
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	e := &sessionMetadata{token: token}
+	if claims != nil && claims.ExpiresAt != nil {
+		e.expires = claims.ExpiresAt.Time
+	}
+	e.stable, e.perToken = splitMetadataParts(components)
+	if old, ok := c.Get(session); ok && sameMetadata(old.stable, e.stable) {
+		e.stable = old.stable
+		sessionMetadataEvents.Add("renewed", 1)
+	} else {
+		sessionMetadataEvents.Add("built", 1)
+	}
+	return e, nil
+}
+
+// sessionSplitContext attaches tokenStr's split headers to ctx from its
+// session's prebuilt metadata. It returns nil when the request has no
+// session, the token doesn't decompose or the static dictionary is on.
+func sessionSplitContext(ctx context.Context, tokenStr string) context.Context {
+	claims, ok := getJWTFromContext(ctx)
+	if !ok || claims == nil || claims.SessionID == "" || staticDictionaryEnabled {
+		return nil
+	}
+	e, ok := sessionMetadataStore.Get(claims.SessionID)
+	hit := ok && e.token == tokenStr
+	if d := decisionFromContext(ctx); d != nil {
+		d.SessionCache = "miss"
+		if hit {
+			d.SessionCache = "hit"
+		}
+	}
+	if hit {
+		sessionMetadataEvents.Add("hit", 1)
+	} else {
+		var err error
+		if e, err = sessionMetadataStore.build(claims.SessionID, tokenStr, claims); err != nil {
+			return nil
+		}
+		sessionMetadataStore.Swap(claims.SessionID, e)
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, e.stable)
+	kv := e.perToken
+	// Dual-write: also send the full token while receivers migrate
+	if jwtDualWriteEnabled(ctx) {
+		kv = append(kv[:len(kv):len(kv)], "authorization", "Bearer "+tokenStr)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// sameMetadata reports whether a and b hold the same keys and values
+func sameMetadata(a, b metadata.MD) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if av[i] != bv[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/jwttest"
+)
+
+// sessionInterceptorCall runs the unary client interceptor once with a no-op
+// invoker and returns the metadata the call would send
+func sessionInterceptorCall(ctx context.Context) metadata.MD {
+	var out metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	jwtUnaryClientInterceptor()(ctx, "/hipstershop.CartService/GetCart", nil, nil, nil, invoker)
+	return out
+}
+
+// TestSessionMetadataReuse checks that prebuilt session metadata sends the
+// same headers as building them per call, with fewer allocations
+func TestSessionMetadataReuse(t *testing.T) {
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+	jwtSplitMinBytes = 0
+	defer func(c ClaimClassifier) { claimClassifier = c }(claimClassifier)
+
+	for _, name := range []string{"", "standard"} {
+		claimClassifier, _ = newClaimClassifier(name, "")
+		for _, g := range loadGoldenJWTs(t) {
+			perCall := context.WithValue(context.Background(), ctxKeyJWTToken{}, g.Token)
+			session := context.WithValue(perCall, ctxKeyJWT{}, &JWTClaims{SessionID: "session-" + name + g.Name})
+			want := sessionInterceptorCall(perCall)
+			for i := 0; i < 2; i++ { // build, then hit
+				if got := sessionInterceptorCall(session); !reflect.DeepEqual(got, want) {
+					t.Errorf("%q/%s: session metadata = %v, want %v", name, g.Name, got, want)
+				}
+			}
+
+			invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+				return nil
+			}
+			interceptor := jwtUnaryClientInterceptor()
+			const method = "/hipstershop.CartService/GetCart"
+			built := testing.AllocsPerRun(50, func() { interceptor(perCall, method, nil, nil, nil, invoker) })
+			reused := testing.AllocsPerRun(50, func() { interceptor(session, method, nil, nil, nil, invoker) })
+			if reused >= built {
+				t.Errorf("%q/%s: %v allocs with session metadata, %v without", name, g.Name, reused, built)
+			}
+		}
+	}
+}
+
+// TestSessionMetadataRefresh checks that a minted token swaps the session's
+// entry, that requests still carrying the old token don't swap it back, and
+// that expired entries aren't served
+func TestSessionMetadataRefresh(t *testing.T) {
+	iss := jwttest.RS256().With(jwttest.Claims{"session_id": "refresh"})
+	mint := func(jti string, ttl time.Duration) (string, *JWTClaims) {
+		token := iss.Mint(jwttest.Claims{"jti": jti}, jwttest.TTL(ttl))
+		exp := jwt.NewNumericDate(time.Now().Add(ttl))
+		return token, &JWTClaims{SessionID: "refresh", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: exp}}
+	}
+	oldToken, oldClaims := mint("1", time.Minute)
+	newToken, newClaims := mint("2", 2*time.Minute)
+
+	ctx := context.WithValue(context.WithValue(context.Background(), ctxKeyJWTToken{}, oldToken), ctxKeyJWT{}, oldClaims)
+	sessionSplitContext(ctx, oldToken)
+	notifyTokenMinted("refresh", newToken, newClaims)
+	if e, _ := sessionMetadataStore.Get("refresh"); e == nil || e.token != newToken {
+		t.Fatalf("minted token was not swapped in")
+	}
+	// An in-flight request with the old token still sends its own headers
+	out, _ := metadata.FromOutgoingContext(sessionSplitContext(ctx, oldToken))
+	if _, payload, _ := jwttest.Split(oldToken); len(out.Get("x-jwt-payload")) != 1 || out.Get("x-jwt-payload")[0] != payload {
+		t.Errorf("old token sent %v", out)
+	}
+	if e, _ := sessionMetadataStore.Get("refresh"); e.token != newToken {
+		t.Errorf("request with the previous token replaced the refreshed entry")
+	}
+
+	expiredToken, expiredClaims := mint("3", -time.Second)
+	sessionMetadataStore.Swap("expired", &sessionMetadata{token: expiredToken, expires: expiredClaims.ExpiresAt.Time})
+	if _, ok := sessionMetadataStore.Get("expired"); ok {
+		t.Errorf("expired entry was served")
+	}
+}
+
+// BenchmarkSessionMetadata compares the split path building metadata per
+// call with the prebuilt session metadata for a token reused across calls
+//
+//	go test -run '^$' -bench SessionMetadata -benchmem
+func BenchmarkSessionMetadata(b *testing.B) {
+	b.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	defer func(v int) { jwtSplitMinBytes = v }(jwtSplitMinBytes)
+	jwtSplitMinBytes = 0
+	defer func(c ClaimClassifier) { claimClassifier = c }(claimClassifier)
+	claimClassifier, _ = newClaimClassifier("standard", "")
+
+	token := jwttest.RS256().Mint(jwttest.Claims{"jti": "a"})
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return nil
+	}
+	interceptor := jwtUnaryClientInterceptor()
+	perCall := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+	for name, ctx := range map[string]context.Context{
+		"per-call": perCall,
+		"session":  context.WithValue(perCall, ctxKeyJWT{}, &JWTClaims{SessionID: "bench"}),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				interceptor(ctx, "/hipstershop.CartService/GetCart", nil, nil, nil, invoker)
+			}
+		})
+	}
+}
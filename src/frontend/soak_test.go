@@ -0,0 +1,216 @@
+//go:build soak
+
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/keyring"
+)
+
+// Soak test
+//
+// TestSoak drives distinct synthetic sessions through the session and JWT
+// middlewares and the gRPC client interceptor, and checks that the caches
+// they fill stay within their bounds and that the heap stops growing once
+// every cache is full. It is run by cmd/soak, or:
+//
+//	go test -tags soak -run TestSoak -timeout 0 . -args -soak.sessions=2000000
+
+var (
+	soakSessions = flag.Int("soak.sessions", 1000000, "distinct sessions to drive")
+	soakWorkers  = flag.Int("soak.workers", runtime.GOMAXPROCS(0), "sessions driven concurrently")
+	soakProfiles = flag.String("soak.profiles", "", "directory to write heap profiles to")
+)
+
+// soakCache is a bounded cache the soak test watches
+type soakCache struct {
+	name string
+	len  func() int
+	max  int
+}
+
+func soakCaches() []soakCache {
+	return []soakCache{
+		{"session_metadata", func() int {
+			sessionMetadataStore.mu.Lock()
+			defer sessionMetadataStore.mu.Unlock()
+			return len(sessionMetadataStore.sessions)
+		}, sessionMetadataStore.maxEntries},
+		{"negative", func() int {
+			verifyNegativeCache.mu.Lock()
+			defer verifyNegativeCache.mu.Unlock()
+			return len(verifyNegativeCache.entries)
+		}, verifyNegativeCache.maxEntries},
+		{"revocations", func() int {
+			revocations.mu.Lock()
+			defer revocations.mu.Unlock()
+			return len(revocations.jtis) + len(revocations.sessions)
+		}, revocations.maxEntries},
+	}
+}
+
+func TestSoak(t *testing.T) {
+	// 1024 bits keeps signing cheap; the key size doesn't change what's cached
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "private.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.New(context.Background(), keyring.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, out io.Writer, n int) { signingKeys, log.Out, jwtSplitMinBytes = k, out, n }(signingKeys, log.Out, jwtSplitMinBytes)
+	signingKeys = keys
+	log.Out = io.Discard
+	jwtSplitMinBytes = 0
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	badSig := base64.RawURLEncoding.EncodeToString(make([]byte, key.Size()))
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return nil
+	}
+	interceptor := jwtUnaryClientInterceptor()
+
+	// Every session calls a downstream once; one in 4 arrives with a
+	// tampered token, and every other session logs out
+	session := func(i int) {
+		id := "soak-" + strconv.Itoa(i)
+		r := httptest.NewRequest(http.MethodGet, "/cart", nil)
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: id})
+		if i%4 == 1 {
+			payload := `{"iss":"` + jwtIssuer + `","aud":"` + jwtAudience + `","session_id":"` + id + `","exp":` + exp + `}`
+			r.AddCookie(&http.Cookie{Name: cookieJWT, Value: header + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + badSig})
+		}
+		ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			interceptor(ctx, "/hipstershop.CartService/GetCart", nil, nil, nil, invoker)
+			if i%2 == 0 {
+				claims, _ := getJWTFromContext(ctx)
+				revokeSession(ctx, id, claims)
+			}
+		})))(httptest.NewRecorder(), r)
+	}
+
+	// Sessions it takes to fill every cache at the rates above; logging out
+	// purges a session's metadata
+	fill := max(sessionMetadataStore.maxEntries*2, verifyNegativeCache.maxEntries*4, revocations.maxEntries)
+	runSoak(t, session, fill)
+}
+
+// runSoak drives *soakSessions sessions in ten batches and checks the cache
+// bounds after each. Maps don't shrink, so a cache's maps settle at their
+// working size only after its entries have turned over a few times: heap
+// growth is checked over the second half of the run, and not before the
+// caches have filled twice. Heap profiles are written at the start and the
+// end of that stretch.
+func runSoak(t *testing.T, session func(i int), fill int) {
+	const checkpoints = 10
+	settled := max(2*fill, *soakSessions/2)
+	var baseline uint64
+	for c := 1; c <= checkpoints; c++ {
+		from, to := *soakSessions*(c-1)/checkpoints, *soakSessions*c/checkpoints
+		var next atomic.Int64
+		next.Store(int64(from))
+		var wg sync.WaitGroup
+		for w := 0; w < *soakWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := int(next.Add(1) - 1); i < to; i = int(next.Add(1) - 1) {
+					session(i)
+				}
+			}()
+		}
+		wg.Wait()
+
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		sizes := ""
+		for _, cache := range soakCaches() {
+			n := cache.len()
+			sizes += fmt.Sprintf(" %s=%d/%d", cache.name, n, cache.max)
+			if n > cache.max {
+				t.Errorf("after %d sessions the %s cache holds %d entries, bound is %d", to, cache.name, n, cache.max)
+			}
+		}
+		t.Logf("%d sessions: heap %.1f MiB,%s", to, float64(m.HeapAlloc)/(1<<20), sizes)
+
+		if to < settled {
+			continue
+		}
+		if baseline == 0 {
+			baseline = m.HeapAlloc
+			writeSoakProfile(t, "heap-saturated.pb.gz")
+			continue
+		}
+		if limit := baseline + baseline/10 + 2<<20; m.HeapAlloc > limit {
+			t.Errorf("heap grew from %d to %d bytes after the caches filled", baseline, m.HeapAlloc)
+		}
+	}
+	if baseline == 0 {
+		t.Logf("the caches fill after about %d sessions; run at least %d to check heap growth", fill, 4*fill)
+		return
+	}
+	writeSoakProfile(t, "heap-final.pb.gz")
+}
+
+func writeSoakProfile(t *testing.T, name string) {
+	if *soakProfiles == "" {
+		return
+	}
+	if err := os.MkdirAll(*soakProfiles, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(*soakProfiles, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("wrote %s", f.Name())
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Split downgrade
+//
+// A receiver that keeps failing to reassemble our split headers (version
+// skew) refuses calls with FailedPrecondition and an ErrorInfo of reason
+// JWT_SPLIT_DOWNGRADE. Such a unary call is retried once with the whole
+// token in authorization, and that service gets whole tokens for the
+// cooldown_seconds the receiver asked for (5m by default, at most an hour).
+// Streams follow a downgrade but, like header overflows, can't trigger one.
+
+const splitDowngradeReason = "JWT_SPLIT_DOWNGRADE"
+
+const (
+	splitDecisionDowngraded  = "whole_downgraded"
+	defaultDowngradeCooldown = 5 * time.Minute
+	maxDowngradeCooldown     = time.Hour
+)
+
+// splitDowngradeTotal counts downgrades by outcome: downgraded, retried,
+// retry_failed and avoided (sent whole during a downgrade)
+var splitDowngradeTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jwt_split_downgrade_total",
+	Help: "Calls sent whole because the receiver could not reassemble split JWTs.",
+}, []string{"service", "outcome"})
+
+// splitDowngradeCooldown returns how long a receiver asked to be sent whole
+// tokens, or false when err isn't a downgrade request
+func splitDowngradeCooldown(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return 0, false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != jwtErrorDomain || info.Reason != splitDowngradeReason {
+			continue
+		}
+		if s, err := strconv.Atoi(info.Metadata["cooldown_seconds"]); err == nil && s > 0 {
+			return min(time.Duration(s)*time.Second, maxDowngradeCooldown), true
+		}
+		return defaultDowngradeCooldown, true
+	}
+	return 0, false
+}
+
+// downgradedTargets remembers until when each service gets whole tokens
+type downgradedTargets struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var splitDowngrades = &downgradedTargets{until: make(map[string]time.Time)}
+
+// Active reports whether service is downgraded, ending expired downgrades
+func (d *downgradedTargets) Active(service string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.until[service]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(d.until, service)
+	log.Infof("[JWT-FLOW] Downgrade of %s ended, splitting JWTs again", service)
+	return false
+}
+
+// Downgrade sends service whole tokens for cooldown
+func (d *downgradedTargets) Downgrade(service string, cooldown time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.until[service] = time.Now().Add(cooldown)
+}
+
+// splitDowngraded reports whether method's service is downgraded, and
+// records the whole token sent because of it
+func splitDowngraded(method string) bool {
+	service := serviceFromMethod(method)
+	if !splitDowngrades.Active(service) {
+		return false
+	}
+	splitDowngradeTotal.WithLabelValues(service, "avoided").Inc()
+	return true
+}
+
+// withWholeJWT replaces the split headers of ctx with token in authorization
+func withWholeJWT(ctx context.Context, token string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for _, k := range splitJWTKeys {
+		delete(md, k)
+	}
+	md.Set("authorization", "Bearer "+token)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// downgradeInvoker wraps invoker so a call whose receiver asks for the whole
+// token downgrades that service and is retried once with it
+func downgradeInvoker(invoker grpc.UnaryInvoker, token string) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		cooldown, ok := splitDowngradeCooldown(err)
+		if !ok || !carriesSplitJWT(ctx) {
+			return err
+		}
+		service := serviceFromMethod(method)
+		splitDowngrades.Downgrade(service, cooldown)
+		splitDowngradeTotal.WithLabelValues(service, "downgraded").Inc()
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] %s can't reassemble our split JWTs, sending it whole tokens for %s", service, cooldown)
+		if err = invoker(withWholeJWT(ctx, token), method, req, reply, cc, opts...); err != nil {
+			splitDowngradeTotal.WithLabelValues(service, "retry_failed").Inc()
+		} else {
+			splitDowngradeTotal.WithLabelValues(service, "retried").Inc()
+		}
+		return err
+	}
+}
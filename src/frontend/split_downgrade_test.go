@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestSplitDowngrade checks that a receiver asking for whole tokens gets the
+// call again with authorization, and that later calls to it aren't split
+// until the cooldown it asked for ends
+func TestSplitDowngrade(t *testing.T) {
+	const token = "eyJhbGciOiJIUzI1NiJ9.eyJhIjoieCJ9.c2ln"
+	const method = "/hipstershop.DowngradeService/Get"
+	st, _ := status.New(codes.FailedPrecondition, "split JWT headers could not be reassembled").WithDetails(&errdetails.ErrorInfo{
+		Reason:   splitDowngradeReason,
+		Domain:   jwtErrorDomain,
+		Metadata: map[string]string{"cooldown_seconds": "60"},
+	})
+	var sent []metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		sent = append(sent, md)
+		if len(md.Get("x-jwt-payload")) > 0 {
+			return st.Err()
+		}
+		return nil
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(
+		"x-jwt-header", "eyJhbGciOiJIUzI1NiJ9", "x-jwt-payload", `{"a":"x"}`, "x-jwt-sig", "c2ln", "traceparent", "t"))
+
+	if err := downgradeInvoker(invoker, token)(ctx, method, nil, nil, nil); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("sent %d calls, want the split call and one retry", len(sent))
+	}
+	if a := sent[1].Get("authorization"); len(a) != 1 || a[0] != "Bearer "+token || len(sent[1].Get("x-jwt-payload")) != 0 || len(sent[1].Get("traceparent")) != 1 {
+		t.Errorf("retry metadata = %v, want authorization and the other headers kept", sent[1])
+	}
+
+	if split, reason := splitDecision(method, true, len(token)); split || reason != splitDecisionDowngraded {
+		t.Errorf("splitDecision after downgrade = %v, %q, want whole_downgraded", split, reason)
+	}
+	splitDowngrades.Downgrade(serviceFromMethod(method), -time.Second)
+	if splitDowngraded(method) {
+		t.Error("downgrade still active after its cooldown")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Content-addressed static block
+//
+// With JWT_STATIC_DICTIONARY=true (and a claim classifier), the static claim
+// block is sent by reference once a downstream has seen it: x-jwt-static-sha
+// carries the first 8 bytes of its SHA-256 and x-jwt-static is left out. This
+// saves the bytes without relying on the connection's HPACK table, so it also
+// holds across reconnects and through proxies that re-encode headers.
+//
+// The first unary call to a service sends both the block and its reference,
+// and the receiver stores the block. A receiver that doesn't know a reference
+// (restarted, evicted) fails the call with FailedPrecondition and an ErrorInfo
+// detail of reason JWT_STATIC_BLOCK_UNKNOWN; the client then retries once with
+// the full block. Streams always carry the full block, since that error would
+// only surface after the stream is open.
+
+const (
+	staticBlockUnknownReason = "JWT_STATIC_BLOCK_UNKNOWN"
+	jwtErrorDomain           = "jwt-split.hipstershop"
+)
+
+var staticDictionaryEnabled = knobs.Value("JWT_STATIC_DICTIONARY") == "true"
+
+// staticDictionaryEvents counts references sent and blocks resent
+var staticDictionaryEvents = expvar.NewMap("jwt_static_dictionary")
+
+// staticBlockSHA is the reference of a static block: hex of the first 8
+// bytes of its SHA-256. A colliding block would still fail signature checks.
+func staticBlockSHA(block string) string {
+	sum := sha256.Sum256([]byte(block))
+	return hex.EncodeToString(sum[:8])
+}
+
+// staticBlockCache remembers which static blocks each service has stored
+type staticBlockCache struct {
+	mu    sync.Mutex
+	known map[string]map[string]bool // service -> sha
+}
+
+var knownStaticBlocks = &staticBlockCache{known: make(map[string]map[string]bool)}
+
+// maxStaticBlocksPerService bounds the cache; a service sees one block per
+// issuer and classifier, so this only matters across key or config churn
+const maxStaticBlocksPerService = 64
+
+func (c *staticBlockCache) Known(service, sha string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.known[service][sha]
+}
+
+func (c *staticBlockCache) Learn(service, sha string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shas := c.known[service]
+	if shas == nil || len(shas) >= maxStaticBlocksPerService {
+		shas = make(map[string]bool)
+		c.known[service] = shas
+	}
+	shas[sha] = true
+}
+
+func (c *staticBlockCache) Forget(service, sha string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.known[service], sha)
+}
+
+// offerStaticBlockRef adds x-jwt-static-sha to split metadata and drops the
+// full block when service already has it. It returns the reference and the
+// block for a retry, or "" when the metadata carries no static block.
+func offerStaticBlockRef(md metadata.MD, service string) (sha, block string) {
+	if !staticDictionaryEnabled {
+		return "", ""
+	}
+	static := md.Get("x-jwt-static")
+	if len(static) == 0 {
+		return "", ""
+	}
+	sha = staticBlockSHA(static[0])
+	md.Set("x-jwt-static-sha", sha)
+	if knownStaticBlocks.Known(service, sha) {
+		md.Delete("x-jwt-static")
+		staticDictionaryEvents.Add("referenced", 1)
+	}
+	return sha, static[0]
+}
+
+// isStaticBlockUnknown reports whether err is a receiver asking for the full
+// static block
+func isStaticBlockUnknown(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == staticBlockUnknownReason && info.Domain == jwtErrorDomain {
+			return true
+		}
+	}
+	return false
+}
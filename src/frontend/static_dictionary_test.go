@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestStaticBlockByReference(t *testing.T) {
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	defer func(v int, c ClaimClassifier, e bool) {
+		jwtSplitMinBytes, claimClassifier, staticDictionaryEnabled = v, c, e
+	}(jwtSplitMinBytes, claimClassifier, staticDictionaryEnabled)
+	jwtSplitMinBytes, claimClassifier, staticDictionaryEnabled = 0, builtinClaimClassifiers["standard"], true
+
+	// A receiver that stores blocks sent with their reference and rejects
+	// references it doesn't know, as checkout and shipping do
+	stored := map[string]string{}
+	var sent []metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		sent = append(sent, md)
+		sha := md.Get("x-jwt-static-sha")[0]
+		if block := md.Get("x-jwt-static"); len(block) > 0 {
+			stored[sha] = block[0]
+			return nil
+		}
+		if _, ok := stored[sha]; ok {
+			return nil
+		}
+		st, _ := status.New(codes.FailedPrecondition, "unknown static block").WithDetails(&errdetails.ErrorInfo{
+			Reason: staticBlockUnknownReason, Domain: jwtErrorDomain,
+		})
+		return st.Err()
+	}
+
+	var token string
+	for _, g := range loadGoldenJWTs(t) {
+		if blocks, ok := classifyPayload(claimClassifier, g.Payload); ok && blocks.Static != "{}" {
+			token = g.Token
+			break
+		}
+	}
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+	call := func() {
+		sent = nil
+		if err := jwtUnaryClientInterceptor()(ctx, "/hipstershop.ShippingService/GetQuote", nil, nil, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call()
+	if len(sent) != 1 || len(sent[0].Get("x-jwt-static")) != 1 {
+		t.Fatalf("first call: sent %v, want the full block once", sent)
+	}
+	call()
+	if len(sent) != 1 || len(sent[0].Get("x-jwt-static")) != 0 {
+		t.Fatalf("second call: sent %v, want the reference only", sent)
+	}
+
+	// Receiver restarted: the reference misses and the block is resent once
+	stored = map[string]string{}
+	call()
+	if len(sent) != 2 || len(sent[0].Get("x-jwt-static")) != 0 || len(sent[1].Get("x-jwt-static")) != 1 {
+		t.Fatalf("after receiver restart: sent %v, want reference then full block", sent)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subjecthash pseudonymizes user identifiers, subjects and session
+// IDs, wherever they would otherwise appear in logs, metrics or audit
+// records. An identifier is replaced by its HMAC-SHA256 under a key local to
+// the service, so the hashes can't be reversed by hashing guessed
+// identifiers, and by a short prefix of it where only correlation matters.
+//
+// Keys are rotated by listing the new key first and keeping the old ones
+// after it: new hashes use the first key, and Sums gives the hashes under
+// every key for looking up records written before the rotation. Without a
+// key, identifiers are hashed with plain SHA-256 as before.
+package subjecthash
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// ShortLen is the length in hex characters of Short hashes
+const ShortLen = 12
+
+// Hasher hashes identifiers under a list of keys, the current one first
+type Hasher struct {
+	keys [][]byte
+}
+
+// New returns a Hasher for keys, the current one first; with none it hashes
+// without a key
+func New(keys ...[]byte) *Hasher {
+	return &Hasher{keys: keys}
+}
+
+// Load reads the keys of a Hasher from path, one base64 key per line with
+// the current one first. Blank lines and lines starting with # are skipped.
+// An empty path gives a Hasher without a key.
+func Load(path string) (*Hasher, error) {
+	if path == "" {
+		return New(), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("%s:%d: want a base64 key of at least 16 bytes", path, n)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no key", path)
+	}
+	return New(keys...), nil
+}
+
+// Keyed reports whether identifiers are hashed under a key
+func (h *Hasher) Keyed() bool {
+	return len(h.keys) > 0
+}
+
+// Sum returns the hex hash of id under the current key
+func (h *Hasher) Sum(id string) string {
+	if len(h.keys) == 0 {
+		sum := sha256.Sum256([]byte(id))
+		return hex.EncodeToString(sum[:])
+	}
+	return sumWith(h.keys[0], id)
+}
+
+// Short returns the first ShortLen characters of Sum, for correlating log
+// lines
+func (h *Hasher) Short(id string) string {
+	return h.Sum(id)[:ShortLen]
+}
+
+// Sums returns the hashes of id under every key, the current one first
+func (h *Hasher) Sums(id string) []string {
+	if len(h.keys) == 0 {
+		return []string{h.Sum(id)}
+	}
+	sums := make([]string, len(h.keys))
+	for i, key := range h.keys {
+		sums[i] = sumWith(key, id)
+	}
+	return sums
+}
+
+func sumWith(key []byte, id string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(id))
+	return hex.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subjecthash
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	oldKeys := "# current\nb2xkLXN1YmplY3QtaGFzaC1rZXk=\n"
+	if err := os.WriteFile(path, []byte(oldKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("bmV3LXN1YmplY3QtaGFzaC1rZXk=\n"+oldKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	after, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.Sum("user-1") == before.Sum("user-1") {
+		t.Error("the new key hashes like the old one")
+	}
+	if sums := after.Sums("user-1"); len(sums) != 2 || sums[0] != after.Sum("user-1") || sums[1] != before.Sum("user-1") {
+		t.Errorf("Sums = %v, want the hash under the new key then under the old one", sums)
+	}
+	if s := after.Short("user-1"); len(s) != ShortLen || s != after.Sum("user-1")[:ShortLen] {
+		t.Errorf("Short = %q", s)
+	}
+	// Without a key hashes stay plain SHA-256
+	if got := New().Short("user-1"); got != "c6c289e49e9c" {
+		t.Errorf("unkeyed Short = %q", got)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loaded a missing key file")
+	}
+	if err := os.WriteFile(path, []byte("c2hvcnQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("loaded a key shorter than 16 bytes")
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Per-target memory
+//
+// What the frontend learns about each downstream (the codecs it advertises,
+// the downgrades it asked for, the adaptive controller's split decision) is
+// otherwise lost on restart, so every deploy starts by learning it again.
+// With JWT_TARGET_MEMORY_FILE set it is saved there every 30s and loaded at
+// startup; entries learned more than JWT_TARGET_MEMORY_TTL ago (default 24h)
+// are dropped, so a downstream that changed meanwhile is learned afresh. The
+// file needs a volume that outlives the pod. On DEBUG_PORT, GET /targets
+// shows the memory and POST /targets/reset forgets it, or only what was
+// learned about one service with ?service=hipstershop.CartService.
+
+const (
+	defaultTargetMemoryTTL = 24 * time.Hour
+	targetMemorySaveEvery  = 30 * time.Second
+)
+
+var (
+	targetMemoryFile = knobs.Value("JWT_TARGET_MEMORY_FILE")
+	targetMemoryTTL  = loadTargetMemoryTTL()
+)
+
+// targetMemoryEvents counts restored, expired, saved, save_errors and resets
+var targetMemoryEvents = expvar.NewMap("jwt_target_memory")
+
+func loadTargetMemoryTTL() time.Duration {
+	if d, err := time.ParseDuration(knobs.Value("JWT_TARGET_MEMORY_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultTargetMemoryTTL
+}
+
+// targetMemory is the saved state, keyed by service
+type targetMemory struct {
+	SavedAt    time.Time                    `json:"saved_at"`
+	Codecs     map[string]rememberedCodecs  `json:"codecs,omitempty"`
+	Downgrades map[string]time.Time         `json:"downgrades,omitempty"` // until
+	Adaptive   map[string]compressionTarget `json:"adaptive,omitempty"`
+}
+
+type rememberedCodecs struct {
+	Advertised string    `json:"advertised"`
+	ObservedAt time.Time `json:"observed_at"`
+}
+
+// snapshotTargets copies what has been learned about every downstream
+func snapshotTargets() targetMemory {
+	m := targetMemory{
+		SavedAt:    time.Now(),
+		Codecs:     make(map[string]rememberedCodecs),
+		Downgrades: make(map[string]time.Time),
+		Adaptive:   make(map[string]compressionTarget),
+	}
+	downstreamCodecs.mu.RLock()
+	for svc, v := range downstreamCodecs.advertised {
+		m.Codecs[svc] = rememberedCodecs{Advertised: v, ObservedAt: downstreamCodecs.observed[svc]}
+	}
+	downstreamCodecs.mu.RUnlock()
+
+	splitDowngrades.mu.Lock()
+	for svc, until := range splitDowngrades.until {
+		m.Downgrades[svc] = until
+	}
+	splitDowngrades.mu.Unlock()
+
+	adaptiveCompression.mu.Lock()
+	for svc, t := range adaptiveCompression.targets {
+		m.Adaptive[svc] = *t
+	}
+	adaptiveCompression.mu.Unlock()
+	return m
+}
+
+// restoreTargets adopts the entries of m learned within ttl of now, keeping
+// anything learned since startup, and returns how many it adopted and dropped
+func restoreTargets(m targetMemory, ttl time.Duration, now time.Time) (restored, expired int) {
+	fresh := func(t time.Time) bool {
+		if !t.IsZero() && now.Sub(t) <= ttl {
+			restored++
+			return true
+		}
+		expired++
+		return false
+	}
+
+	downstreamCodecs.mu.Lock()
+	for svc, c := range m.Codecs {
+		if _, known := downstreamCodecs.advertised[svc]; !known && fresh(c.ObservedAt) {
+			downstreamCodecs.advertised[svc] = c.Advertised
+			downstreamCodecs.observed[svc] = c.ObservedAt
+		}
+	}
+	downstreamCodecs.mu.Unlock()
+
+	splitDowngrades.mu.Lock()
+	for svc, until := range m.Downgrades {
+		if _, known := splitDowngrades.until[svc]; known {
+			continue
+		}
+		// A downgrade is fresh until its cooldown ends
+		if until.After(now) {
+			splitDowngrades.until[svc] = until
+			restored++
+		} else {
+			expired++
+		}
+	}
+	splitDowngrades.mu.Unlock()
+
+	adaptiveCompression.mu.Lock()
+	for svc, t := range m.Adaptive {
+		if _, known := adaptiveCompression.targets[svc]; !known && fresh(t.ObservedAt) {
+			t := t
+			adaptiveCompression.targets[svc] = &t
+		}
+	}
+	adaptiveCompression.mu.Unlock()
+	return restored, expired
+}
+
+// resetTargets forgets what was learned about service, or everything for ""
+func resetTargets(service string) {
+	forget := func(svc string) bool { return service == "" || svc == service }
+
+	downstreamCodecs.mu.Lock()
+	for svc := range downstreamCodecs.advertised {
+		if forget(svc) {
+			delete(downstreamCodecs.advertised, svc)
+			delete(downstreamCodecs.observed, svc)
+		}
+	}
+	downstreamCodecs.mu.Unlock()
+
+	splitDowngrades.mu.Lock()
+	for svc := range splitDowngrades.until {
+		if forget(svc) {
+			delete(splitDowngrades.until, svc)
+		}
+	}
+	splitDowngrades.mu.Unlock()
+
+	adaptiveCompression.mu.Lock()
+	for svc := range adaptiveCompression.targets {
+		if forget(svc) {
+			delete(adaptiveCompression.targets, svc)
+		}
+	}
+	adaptiveCompression.mu.Unlock()
+	targetMemoryEvents.Add("resets", 1)
+}
+
+// saveTargetMemory writes the memory to path, replacing it atomically
+func saveTargetMemory(path string) error {
+	data, err := json.MarshalIndent(snapshotTargets(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadTargetMemory restores the memory saved at path; a missing file is a
+// first start
+func loadTargetMemory(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var m targetMemory
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	restored, expired := restoreTargets(m, targetMemoryTTL, time.Now())
+	targetMemoryEvents.Add("restored", int64(restored))
+	targetMemoryEvents.Add("expired", int64(expired))
+	log.Infof("[JWT-FLOW] Restored %d per-target decisions saved %s, dropped %d older than %s",
+		restored, m.SavedAt.Format(time.RFC3339), expired, targetMemoryTTL)
+	return nil
+}
+
+// initTargetMemory loads JWT_TARGET_MEMORY_FILE and keeps it up to date. A
+// file that can't be read only costs the relearning it was meant to save.
+func initTargetMemory() {
+	if targetMemoryFile == "" {
+		return
+	}
+	if err := loadTargetMemory(targetMemoryFile); err != nil {
+		log.Warnf("[JWT-FLOW] Ignoring per-target memory %s: %v", targetMemoryFile, err)
+	}
+	go func() {
+		for range time.Tick(targetMemorySaveEvery) {
+			persistTargetMemory()
+		}
+	}()
+}
+
+func persistTargetMemory() {
+	if targetMemoryFile == "" {
+		return
+	}
+	if err := saveTargetMemory(targetMemoryFile); err != nil {
+		targetMemoryEvents.Add("save_errors", 1)
+		log.Warnf("[JWT-FLOW] Failed to save per-target memory: %v", err)
+		return
+	}
+	targetMemoryEvents.Add("saved", 1)
+}
+
+// registerTargetMemoryHandler serves the memory on the debug mux
+func registerTargetMemoryHandler(mux *http.ServeMux) {
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshotTargets())
+	})
+	mux.HandleFunc("/targets/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		service := r.URL.Query().Get("service")
+		resetTargets(service)
+		persistTargetMemory()
+		if service == "" {
+			log.Info("[JWT-FLOW] Per-target memory reset")
+		} else {
+			log.Infof("[JWT-FLOW] Per-target memory of %s reset", service)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshotTargets())
+	})
+}
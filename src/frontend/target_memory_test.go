@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTargetMemoryRoundTrip checks that learned decisions survive a save and
+// load, that stale ones are dropped and that a reset forgets one service
+func TestTargetMemoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	now := time.Now()
+	resetTargets("")
+	downstreamCodecs.mu.Lock()
+	downstreamCodecs.advertised["hipstershop.CartService"] = "cbor,gzip-split"
+	downstreamCodecs.observed["hipstershop.CartService"] = now
+	downstreamCodecs.advertised["hipstershop.AdService"] = "gzip-split"
+	downstreamCodecs.observed["hipstershop.AdService"] = now.Add(-2 * targetMemoryTTL)
+	downstreamCodecs.mu.Unlock()
+	splitDowngrades.Downgrade("hipstershop.ShippingService", time.Minute)
+	splitDowngrades.Downgrade("hipstershop.PaymentService", -time.Minute)
+	if err := saveTargetMemory(path); err != nil {
+		t.Fatal(err)
+	}
+
+	resetTargets("")
+	if err := loadTargetMemory(path); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := downstreamCodecs.Get("hipstershop.CartService"); !ok || v != "cbor,gzip-split" {
+		t.Errorf("CartService codecs = %q, %v after restart, want them restored", v, ok)
+	}
+	if _, ok := downstreamCodecs.Get("hipstershop.AdService"); ok {
+		t.Error("AdService codecs older than the TTL were restored")
+	}
+	if !splitDowngrades.Active("hipstershop.ShippingService") || splitDowngrades.Active("hipstershop.PaymentService") {
+		t.Error("want only the downgrade still cooling down restored")
+	}
+
+	resetTargets("hipstershop.CartService")
+	if _, ok := downstreamCodecs.Get("hipstershop.CartService"); ok || !splitDowngrades.Active("hipstershop.ShippingService") {
+		t.Error("reset of CartService didn't forget just CartService")
+	}
+	resetTargets("")
+}
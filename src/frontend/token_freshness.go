@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Token freshness
+//
+// Every hop that reads the user token observes its age (now - iat) and the
+// share of its lifetime (exp - iat) already used. Tokens are refreshed well
+// before they expire, so a p99 creeping towards the whole lifetime means
+// the refresh flow is broken somewhere upstream: sessions are riding their
+// tokens to expiry. The recording and alerting rules watching this are
+// generated from the same names and thresholds, see tokenFreshnessRules;
+// -token-freshness-rules prints docs/token-freshness-rules.yaml. Checkout
+// and shipping observe under the same names with their own hop label.
+
+const (
+	tokenAgeMetric       = "jwt_token_age_seconds"
+	tokenLifetimeMetric  = "jwt_token_lifetime_used_ratio"
+	tokenFreshnessAlert  = 0.9 // p99 share of the lifetime used before alerting
+	tokenFreshnessWindow = "5m"
+	tokenFreshnessFor    = "10m"
+)
+
+var (
+	tokenAgeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    tokenAgeMetric,
+		Help:    "Age (now - iat) of the user tokens seen at a hop.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"hop"})
+	tokenLifetimeUsed = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    tokenLifetimeMetric,
+		Help:    "Share of the lifetime (exp - iat) of the user tokens seen at a hop already used.",
+		Buckets: []float64{0.1, 0.25, 0.5, 0.75, 0.8, 0.85, 0.9, 0.95, 0.99, 1},
+	}, []string{"hop"})
+)
+
+// observeTokenFreshness records a token issued at iat and expiring at exp,
+// both Unix seconds; tokens without either are skipped
+func observeTokenFreshness(hop string, iat, exp int64) {
+	if iat <= 0 || exp <= iat {
+		return
+	}
+	age := float64(time.Now().Unix() - iat)
+	if age < 0 {
+		age = 0
+	}
+	tokenAgeSeconds.WithLabelValues(hop).Observe(age)
+	tokenLifetimeUsed.WithLabelValues(hop).Observe(age / float64(exp-iat))
+}
+
+// tokenFreshnessRules returns a Prometheus rule file with per-hop p99
+// recording rules for both histograms, ready to chart, and an alert on the
+// lifetime share
+func tokenFreshnessRules() string {
+	var b strings.Builder
+	b.WriteString("# Generated by `go run . -token-freshness-rules` in src/frontend, do not edit.\n")
+	b.WriteString("groups:\n")
+	b.WriteString("  - name: jwt-token-freshness\n")
+	b.WriteString("    rules:\n")
+	for _, metric := range []string{tokenAgeMetric, tokenLifetimeMetric} {
+		fmt.Fprintf(&b, "      - record: hop:%s:p99\n", metric)
+		fmt.Fprintf(&b, "        expr: histogram_quantile(0.99, sum by (hop, le) (rate(%s_bucket[%s])))\n", metric, tokenFreshnessWindow)
+	}
+	b.WriteString("      - alert: JWTTokensNearExpiry\n")
+	fmt.Fprintf(&b, "        expr: hop:%s:p99 > %g\n", tokenLifetimeMetric, tokenFreshnessAlert)
+	fmt.Fprintf(&b, "        for: %s\n", tokenFreshnessFor)
+	b.WriteString("        labels:\n")
+	b.WriteString("          severity: warning\n")
+	b.WriteString("        annotations:\n")
+	fmt.Fprintf(&b, "          summary: \"p99 of the user tokens at {{ $labels.hop }} have used over %g%% of their lifetime\"\n", tokenFreshnessAlert*100)
+	b.WriteString("          description: \"Tokens are not refreshed before they expire; check the refresh flow upstream of {{ $labels.hop }}.\"\n")
+	return b.String()
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenFreshness(t *testing.T) {
+	now := time.Now().Unix()
+	observeTokenFreshness("test", now-90, now+30)
+	observeTokenFreshness("test", 0, now) // no iat, skipped
+
+	w := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`jwt_token_lifetime_used_ratio_bucket{hop="test",le="0.5"} 0`,
+		`jwt_token_lifetime_used_ratio_bucket{hop="test",le="0.75"} 1`,
+		`jwt_token_age_seconds_count{hop="test"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestTokenFreshnessRulesUpToDate(t *testing.T) {
+	rules, err := os.ReadFile("../../docs/token-freshness-rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rules) != tokenFreshnessRules() {
+		t.Error("docs/token-freshness-rules.yaml is stale, regenerate it with go run . -token-freshness-rules")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// Token refresh hooks
+//
+// Caches derived from a session's token (session_metadata.go) register here
+// and are told when ensureJWT mints a replacement, so they swap in the new
+// token's state before the first request that carries it, and when logout
+// revokes the session (revocation.go), so they drop it.
+
+// tokenMintedHook receives the session, the new token and its claims
+type tokenMintedHook func(sessionID, token string, claims *JWTClaims)
+
+var (
+	tokenHooksMu     sync.RWMutex
+	tokenMintedHooks []tokenMintedHook
+)
+
+// onTokenMinted registers a hook, normally from init
+func onTokenMinted(hook tokenMintedHook) {
+	tokenHooksMu.Lock()
+	defer tokenHooksMu.Unlock()
+	tokenMintedHooks = append(tokenMintedHooks, hook)
+}
+
+// notifyTokenMinted runs the hooks for a newly minted token
+func notifyTokenMinted(sessionID, token string, claims *JWTClaims) {
+	tokenHooksMu.RLock()
+	defer tokenHooksMu.RUnlock()
+	for _, hook := range tokenMintedHooks {
+		hook(sessionID, token, claims)
+	}
+}
+
+// sessionRevokedHook receives a session ended by logout
+type sessionRevokedHook func(sessionID string)
+
+var sessionRevokedHooks []sessionRevokedHook
+
+// onSessionRevoked registers a hook, normally from init
+func onSessionRevoked(hook sessionRevokedHook) {
+	tokenHooksMu.Lock()
+	defer tokenHooksMu.Unlock()
+	sessionRevokedHooks = append(sessionRevokedHooks, hook)
+}
+
+// notifySessionRevoked runs the hooks for a revoked session
+func notifySessionRevoked(sessionID string) {
+	tokenHooksMu.RLock()
+	defer tokenHooksMu.RUnlock()
+	for _, hook := range sessionRevokedHooks {
+		hook(sessionID)
+	}
+}
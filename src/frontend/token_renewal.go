@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Token renewal requests
+//
+// A downstream accepting a just-expired token for a read-only call, within
+// its JWT_EXPIRY_GRACE, answers with a google.rpc.ErrorInfo (reason
+// JWT_REFRESH_REQUIRED) in the x-jwt-refresh-bin trailer. The call itself
+// succeeded, so the page renders; the session is noted, and ensureJWT mints
+// a fresh token on its next request even when the cookie's token still
+// looks valid here, as it does when the downstream's clock runs ahead.
+
+const (
+	refreshTrailer           = "x-jwt-refresh-bin"
+	reasonJWTRefreshRequired = "JWT_REFRESH_REQUIRED"
+	renewalRequestTTL        = 10 * time.Minute
+)
+
+// tokenRenewals counts renewals requested by downstreams and performed
+var tokenRenewals = expvar.NewMap("jwt_renewal_requests")
+
+// renewalRequests holds the sessions whose next request gets a new token
+var renewalRequests = &renewalSet{maxEntries: 10000, sessions: make(map[string]time.Time)}
+
+type renewalSet struct {
+	maxEntries int
+
+	mu       sync.Mutex
+	sessions map[string]time.Time
+}
+
+func init() {
+	onSessionRevoked(func(session string) { renewalRequests.Take(session) })
+}
+
+// Request marks session for renewal
+func (s *renewalSet) Request(session string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[session]; !ok && len(s.sessions) >= s.maxEntries {
+		for k, at := range s.sessions {
+			if now.Sub(at) > renewalRequestTTL {
+				delete(s.sessions, k)
+			}
+		}
+		if len(s.sessions) >= s.maxEntries {
+			return
+		}
+	}
+	s.sessions[session] = now
+}
+
+// Take reports whether session was marked for renewal, and clears the mark
+func (s *renewalSet) Take(session string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.sessions[session]
+	delete(s.sessions, session)
+	return ok && time.Since(at) <= renewalRequestTTL
+}
+
+// renewalInvoker notes the session of a call whose downstream asked for a
+// fresh token
+func renewalInvoker(invoker grpc.UnaryInvoker) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		var trailer metadata.MD
+		err := invoker(ctx, method, req, reply, cc, append(opts[:len(opts):len(opts)], grpc.Trailer(&trailer))...)
+		if !refreshRequested(trailer) {
+			return err
+		}
+		tokenRenewals.Add("requested", 1)
+		if claims, ok := getJWTFromContext(ctx); ok && claims != nil && claims.SessionID != "" {
+			loggerFromContext(ctx).Infof("[JWT-FLOW] %s accepted an expired token within its grace window, renewing", serviceFromMethod(method))
+			renewalRequests.Request(claims.SessionID)
+		}
+		return err
+	}
+}
+
+// refreshRequested reports whether trailer carries a renewal request
+func refreshRequested(trailer metadata.MD) bool {
+	for _, v := range trailer.Get(refreshTrailer) {
+		info := &errdetails.ErrorInfo{}
+		if proto.Unmarshal([]byte(v), info) == nil && info.Domain == jwtErrorDomain && info.Reason == reasonJWTRefreshRequired {
+			return true
+		}
+	}
+	return false
+}
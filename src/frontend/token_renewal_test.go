@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRenewalInvoker(t *testing.T) {
+	signal, _ := proto.Marshal(&errdetails.ErrorInfo{Reason: reasonJWTRefreshRequired, Domain: jwtErrorDomain})
+	other, _ := proto.Marshal(&errdetails.ErrorInfo{Reason: reasonJWTRefreshRequired, Domain: "example.com"})
+	downstream := func(trailer metadata.MD) grpc.UnaryInvoker {
+		return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			for _, o := range opts {
+				if tr, ok := o.(grpc.TrailerCallOption); ok {
+					*tr.TrailerAddr = trailer
+				}
+			}
+			return nil
+		}
+	}
+	ctx := context.WithValue(context.Background(), ctxKeyJWT{}, &JWTClaims{SessionID: "renewal-session"})
+	call := func(trailer metadata.MD) {
+		if err := renewalInvoker(downstream(trailer))(ctx, "/hipstershop.ShippingService/GetQuote", nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call(metadata.Pairs(refreshTrailer, string(other)))
+	call(nil)
+	if renewalRequests.Take("renewal-session") {
+		t.Fatal("renewal requested without a JWT_REFRESH_REQUIRED trailer")
+	}
+	call(metadata.Pairs(refreshTrailer, string(signal)))
+	if !renewalRequests.Take("renewal-session") {
+		t.Fatal("JWT_REFRESH_REQUIRED trailer did not request a renewal")
+	}
+	if renewalRequests.Take("renewal-session") {
+		t.Error("renewal request was not cleared once taken")
+	}
+}
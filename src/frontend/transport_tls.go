@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// Mutual TLS and token binding
+//
+// GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE name the client certificate the
+// frontend presents to its downstreams and GRPC_TLS_CA_FILE the CA their
+// certificates are checked against; with the three set every downstream is
+// dialed over TLS. With JWT_TOKEN_BINDING=true as well, the tokens the
+// frontend signs carry a cnf claim holding the thumbprint of that
+// certificate (x5t#S256, RFC 8705). Checkout and shipping then accept them
+// only from the frontend, or from a relay listed in their JWT_BINDING_RELAYS,
+// so split headers captured on one connection can't be replayed on another.
+// IdP tokens are forwarded as issued and stay unbound.
+
+var (
+	tlsCertFile = knobs.Value("GRPC_TLS_CERT_FILE")
+	tlsKeyFile  = knobs.Value("GRPC_TLS_KEY_FILE")
+	tlsCAFile   = knobs.Value("GRPC_TLS_CA_FILE")
+)
+
+// jwtConfirmation is the cnf claim of a bound token
+type jwtConfirmation struct {
+	X5tS256 string `json:"x5t#S256"`
+}
+
+// tokenConfirmation is set on every token the frontend signs; nil unless
+// JWT_TOKEN_BINDING is on and a client certificate is configured
+var tokenConfirmation = loadTokenConfirmation()
+
+// loadClientTLSConfig returns the TLS configuration of downstream
+// connections, nil when TLS is off
+func loadClientTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("GRPC_TLS_CERT_FILE: %w", err)
+	}
+	caPEM, err := os.ReadFile(tlsCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("GRPC_TLS_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("GRPC_TLS_CA_FILE %s holds no certificates", tlsCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// clientTLSCredentials returns the credentials of downstream connections,
+// nil when TLS is off
+func clientTLSCredentials() (credentials.TransportCredentials, error) {
+	cfg, err := loadClientTLSConfig()
+	if cfg == nil || err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// loadTokenConfirmation derives the cnf claim from the client certificate.
+// Load errors leave tokens unbound; validateConfig reports them.
+func loadTokenConfirmation() *jwtConfirmation {
+	if knobs.Value("JWT_TOKEN_BINDING") != "true" {
+		return nil
+	}
+	cfg, err := loadClientTLSConfig()
+	if cfg == nil || err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(cfg.Certificates[0].Certificate[0])
+	return &jwtConfirmation{X5tS256: base64.RawURLEncoding.EncodeToString(sum[:])}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/jwtcodec"
+)
+
+// Wire codecs
+//
+// JWT_WIRE_CODEC sends split-eligible tokens through a jwtcodec codec instead
+// of the built-in x-jwt-* headers:
+//
+//	""         the built-in split format (default)
+//	<name>     always this codec, e.g. cbor or gzip-split
+//	negotiate  the first codec of JWT_WIRE_CODEC_PREFERENCE that the
+//	           downstream advertised in its x-jwt-codecs response header
+//
+// Until a downstream has answered once, and for tokens a codec can't carry,
+// the built-in format is used. reference-token needs JWT_REFERENCE_TTL > 0;
+// tokens are then resolved by receivers from /jwt/ref/ on DEBUG_PORT.
+
+const defaultWireCodecPreference = "protobuf,cbor,gzip-split,plain-split"
+
+var (
+	wireCodec           = knobs.Value("JWT_WIRE_CODEC")
+	wireCodecPreference = strings.Split(knobs.Get("JWT_WIRE_CODEC_PREFERENCE"), ",")
+
+	// referenceStore backs reference-token; nil unless JWT_REFERENCE_TTL is set
+	referenceStore *jwtcodec.MemoryStore
+
+	// wireCodecUsage counts tokens sent per codec
+	wireCodecUsage = expvar.NewMap("jwt_wire_codec")
+)
+
+func init() {
+	if ttl, err := time.ParseDuration(knobs.Value("JWT_REFERENCE_TTL")); err == nil && ttl > 0 {
+		referenceStore = jwtcodec.NewMemoryStore(ttl)
+		jwtcodec.SetReferenceStore(referenceStore)
+	}
+}
+
+// codecAdvertisements caches each downstream's x-jwt-codecs
+type codecAdvertisements struct {
+	mu         sync.RWMutex
+	advertised map[string]string    // service -> header value
+	observed   map[string]time.Time // service -> when last seen
+}
+
+var downstreamCodecs = &codecAdvertisements{advertised: make(map[string]string), observed: make(map[string]time.Time)}
+
+func (a *codecAdvertisements) Get(service string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	v, ok := a.advertised[service]
+	return v, ok
+}
+
+// Observe records a response header; a downstream that stops advertising
+// (rolled back) falls back to the built-in format
+func (a *codecAdvertisements) Observe(service string, header metadata.MD) {
+	value := strings.Join(header.Get(jwtcodec.AdvertiseHeader), ",")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.advertised[service] = value
+	a.observed[service] = time.Now()
+}
+
+// wireCodecFor returns the codec to send method's token with, "" for the
+// built-in format
+func wireCodecFor(method string) string {
+	if wireCodec != "negotiate" {
+		return wireCodec
+	}
+	advertised, ok := downstreamCodecs.Get(serviceFromMethod(method))
+	if !ok {
+		return ""
+	}
+	return jwtcodec.Choose(wireCodecPreference, advertised)
+}
+
+// wireCodecMetadata encodes tokenStr with the codec chosen for method. It
+// returns nil when the built-in format should be used instead.
+func wireCodecMetadata(ctx context.Context, method, tokenStr string) metadata.MD {
+	name := wireCodecFor(method)
+	if name == "" {
+		return nil
+	}
+	md, err := jwtcodec.Encode(name, tokenStr)
+	if err != nil {
+		loggerFromContext(ctx).Debugf("[JWT-FLOW] %v, using the split format", err)
+		wireCodecUsage.Add("fallback", 1)
+		return nil
+	}
+	wireCodecUsage.Add(name, 1)
+	if d := decisionFromContext(ctx); d != nil {
+		d.Codec = name
+	}
+	if jwtDualWriteEnabled(ctx) {
+		md.Set("authorization", "Bearer "+tokenStr)
+	}
+	return md
+}
+
+// negotiationCallOption captures the response header into hdr when codecs
+// are negotiated, so the next call to the service can use one
+func negotiationCallOption(hdr *metadata.MD) []grpc.CallOption {
+	if wireCodec != "negotiate" {
+		return nil
+	}
+	return []grpc.CallOption{grpc.Header(hdr)}
+}
+
+// registerReferenceHandler serves reference-token lookups on the debug mux
+func registerReferenceHandler(mux *http.ServeMux) {
+	if referenceStore != nil {
+		mux.Handle("/jwt/ref/", jwtcodec.ReferenceHandler(referenceStore))
+	}
+}
+
+// checkWireCodec validates JWT_WIRE_CODEC and its preference list
+func checkWireCodec(name string, preference []string) error {
+	known := func(n string) bool { _, ok := jwtcodec.Lookup(n); return ok }
+	if name != "" && name != "negotiate" && !known(name) {
+		return fmt.Errorf("JWT_WIRE_CODEC=%q must be negotiate or one of %s", name, strings.Join(jwtcodec.Names(), ", "))
+	}
+	for _, n := range preference {
+		if !known(n) {
+			return fmt.Errorf("JWT_WIRE_CODEC_PREFERENCE: unknown codec %q", n)
+		}
+	}
+	return nil
+}
@@ -15,6 +15,7 @@
 # limitations under the License.
 
 import random
+import re
 from locust import FastHttpUser, TaskSet, between
 from faker import Faker
 import datetime
@@ -31,13 +32,20 @@ products = [
     'LS4PSXUNUM',
     'OLJCESPC7Z']
 
+# every form post is CSRF protected; the token is rendered into the pages
+# and stays the same for the whole session
+def csrf_token(response):
+    match = re.search(r'name="csrf_token" value="([^"]*)"', response.text or "")
+    return match.group(1) if match else ''
+
 def index(l):
-    l.client.get("/")
+    l.csrf_token = csrf_token(l.client.get("/"))
 
 def setCurrency(l):
     currencies = ['EUR', 'USD', 'JPY', 'CAD', 'GBP', 'TRY']
     l.client.post("/setCurrency",
-        {'currency_code': random.choice(currencies)})
+        {'csrf_token': l.csrf_token,
+        'currency_code': random.choice(currencies)})
 
 def browseProduct(l):
     l.client.get("/product/" + random.choice(products))
@@ -47,18 +55,21 @@ def viewCart(l):
 
 def addToCart(l):
     product = random.choice(products)
-    l.client.get("/product/" + product)
+    page = l.client.get("/product/" + product)
     l.client.post("/cart", {
+        'csrf_token': csrf_token(page),
         'product_id': product,
         'quantity': random.randint(1,10)})
     
 def empty_cart(l):
-    l.client.post('/cart/empty')
+    l.client.post('/cart/empty', {'csrf_token': l.csrf_token})
 
 def checkout(l):
     addToCart(l)
+    cart = l.client.get("/cart")
     current_year = datetime.datetime.now().year+1
     l.client.post("/cart/checkout", {
+        'csrf_token': csrf_token(cart),
         'email': fake.email(),
         'street_address': fake.street_address(),
         'zip_code': fake.zipcode(),
@@ -72,7 +83,7 @@ def checkout(l):
     })
     
 def logout(l):
-    l.client.get('/logout')  
+    l.client.post('/logout', {'csrf_token': l.csrf_token})  
 
 
 class UserBehavior(TaskSet):
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Expired-token grace
+//
+// With JWT_EXPIRY_GRACE set (off by default) ListOrders accepts a token
+// that expired less than that long ago and otherwise verifies, so a page
+// load straddling the expiry doesn't fail halfway. The response carries a
+// google.rpc.ErrorInfo, reason JWT_REFRESH_REQUIRED, in the
+// x-jwt-refresh-bin trailer, and the frontend renews the session's token.
+// RecordOrder still refuses the token.
+
+const (
+	refreshTrailer           = "x-jwt-refresh-bin"
+	reasonJWTRefreshRequired = "JWT_REFRESH_REQUIRED"
+)
+
+// graceMethods are the read-only methods the grace applies to
+var graceMethods = map[string]bool{
+	"/hipstershop.OrderHistoryService/ListOrders": true,
+}
+
+var jwtExpiryGrace = expiryGrace()
+
+// expiryGraceAccepted counts expired tokens accepted within the grace window
+var expiryGraceAccepted = expvar.NewInt("jwt_expiry_grace_accepted")
+
+// expiryGrace reads JWT_EXPIRY_GRACE
+func expiryGrace() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("JWT_EXPIRY_GRACE"))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// verifyWithGrace is verifySplitToken with the current keys, except that a
+// read-only method accepts a token expired within the grace window and asks
+// the caller to renew it
+func verifyWithGrace(ctx context.Context, method string, token *splitToken) (*UserClaims, error) {
+	keys := jwtKeys.PublicKeys()
+	claims, err := verifySplitToken(keys, token)
+	if !errors.Is(err, errJWTExpired) || jwtExpiryGrace <= 0 || !graceMethods[method] {
+		return claims, err
+	}
+	claims, gerr := verifySplitTokenWithin(keys, token, jwtExpiryGrace)
+	if gerr != nil {
+		return nil, err
+	}
+	expiryGraceAccepted.Add(1)
+	log.Infof("[JWT-FLOW] accepting %s with a token expired %v ago", method, time.Since(time.Unix(claims.ExpiresAt, 0)).Round(time.Second))
+	b, merr := proto.Marshal(&errdetails.ErrorInfo{
+		Reason:   reasonJWTRefreshRequired,
+		Domain:   jwtErrorDomain,
+		Metadata: map[string]string{"expired_at": strconv.FormatInt(claims.ExpiresAt, 10)},
+	})
+	if merr == nil {
+		grpc.SetTrailer(ctx, metadata.Pairs(refreshTrailer, string(b)))
+	}
+	return claims, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/keyring"
+)
+
+// Orders are keyed by the sub claim, so unlike the other services order
+// history never serves a request whose token it hasn't verified, and it
+// refuses to start without a JWT_PUBLIC_KEY source.
+
+var (
+	jwtIssuer   = envOrDefault("JWT_ISSUER", "https://auth.hipstershop.com")
+	jwtAudience = envOrDefault("JWT_AUDIENCE", "urn:hipstershop:api")
+)
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+var jwtKeys *keyring.Keyring
+
+// UserClaims is the subset of the frontend JWT claims order history relies on
+type UserClaims struct {
+	SessionID string      `json:"session_id"`
+	Name      string      `json:"name"`
+	Currency  string      `json:"currency"`
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  interface{} `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	ID        string      `json:"jti,omitempty"`
+}
+
+const (
+	reasonJWTMissing       = "JWT_MISSING"
+	reasonJWTMalformed     = "JWT_MALFORMED"
+	reasonJWTExpired       = "JWT_EXPIRED"
+	reasonJWTSigInvalid    = "JWT_SIG_INVALID"
+	reasonJWTClaimsInvalid = "JWT_CLAIMS_INVALID"
+	reasonJWTDuplicate     = "JWT_DUPLICATE_HEADER"
+)
+
+var (
+	errJWTMissing       = errors.New("no user JWT")
+	errJWTMalformed     = errors.New("invalid JWT format")
+	errJWTExpired       = errors.New("token is expired")
+	errJWTSigInvalid    = errors.New("invalid JWT signature")
+	errJWTClaimsInvalid = errors.New("invalid JWT claims")
+	errJWTDuplicate     = errors.New("conflicting JWT metadata")
+)
+
+// loadJWTPublicKey loads the keys from the JWT_PUBLIC_KEY source, usually
+// the frontend's JWKS, and refreshes them every JWT_KEY_REFRESH_INTERVAL
+func loadJWTPublicKey(ctx context.Context) error {
+	loader, err := keyring.FromEnv("JWT_PUBLIC_KEY", "")
+	if err != nil {
+		return err
+	}
+	if loader == nil {
+		return errors.New("no JWT_PUBLIC_KEY source configured")
+	}
+	keys, err := keyring.New(ctx, loader)
+	if err != nil {
+		return err
+	}
+	keys.OnRotate(func(k *keyring.Keyring) {
+		log.Infof("[JWT-FLOW] JWT public key rotated from %s", k.Source())
+	})
+	jwtKeys = keys
+	if interval := keyRefreshInterval(); interval > 0 {
+		go keys.Watch(ctx, interval, func(err error) {
+			log.Warnf("[JWT-FLOW] Failed to refresh JWT public key: %v", err)
+		})
+	}
+	return nil
+}
+
+// keyRefreshInterval reads JWT_KEY_REFRESH_INTERVAL; 0 disables refreshing
+func keyRefreshInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("JWT_KEY_REFRESH_INTERVAL"))
+	if err != nil {
+		return time.Minute
+	}
+	return d
+}
+
+// verifySplitToken checks the RS256 signature, expiry, issuer and audience
+// of a token and returns its claims
+func verifySplitToken(keys []*rsa.PublicKey, t *splitToken) (*UserClaims, error) {
+	return verifySplitTokenWithin(keys, t, 0)
+}
+
+// verifySplitTokenWithin is verifySplitToken accepting tokens expired up to
+// leeway ago (see expiry_grace.go)
+func verifySplitTokenWithin(keys []*rsa.PublicKey, t *splitToken, leeway time.Duration) (*UserClaims, error) {
+	if t == nil {
+		return nil, errJWTMissing
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(t.header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode header: %v", errJWTMalformed, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unexpected signing method %q", errJWTSigInvalid, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(t.signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode signature: %v", errJWTMalformed, err)
+	}
+	digest := sha256.Sum256([]byte(t.signingInput()))
+	verified := false
+	for _, key := range keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errJWTSigInvalid
+	}
+
+	claims := &UserClaims{}
+	if err := json.Unmarshal([]byte(t.payload), claims); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse claims: %v", errJWTMalformed, err)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: no exp claim", errJWTClaimsInvalid)
+	}
+	if time.Now().Add(-leeway).Unix() > claims.ExpiresAt {
+		return nil, errJWTExpired
+	}
+	if claims.Issuer != jwtIssuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errJWTClaimsInvalid, claims.Issuer)
+	}
+	if !claims.hasAudience(jwtAudience) {
+		return nil, fmt.Errorf("%w: not issued for this audience", errJWTClaimsInvalid)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no sub claim", errJWTClaimsInvalid)
+	}
+	return claims, nil
+}
+
+// hasAudience handles both the string and array forms of the aud claim
+func (c *UserClaims) hasAudience(aud string) bool {
+	switch v := c.Audience.(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type ctxKeyClaims struct{}
+
+// ClaimsFromContext returns the verified claims of the caller
+func ClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(ctxKeyClaims{}).(*UserClaims)
+	return claims, ok
+}
+
+// jwtUnaryServerInterceptor verifies the user token of every hipstershop
+// call; health checks and reflection pass without one
+func jwtUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/hipstershop.") {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token, err := tokenFromMetadata(md)
+	if isStaticBlockUnknown(err) {
+		// Not a failure: the sender resends the full block
+		return nil, err
+	}
+	var claims *UserClaims
+	if err == nil {
+		claims, err = verifyWithGrace(ctx, info.FullMethod, token)
+	}
+	if err != nil {
+		log.Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, err)
+		return nil, authError(err)
+	}
+	jwtFormats.Add(token.format, 1)
+	return handler(context.WithValue(ctx, ctxKeyClaims{}, claims), req)
+}
+
+// authError is the Unauthenticated status for a verification failure, with
+// an ErrorInfo giving the reason
+func authError(err error) error {
+	reason := reasonJWTMalformed
+	switch {
+	case errors.Is(err, errJWTMissing):
+		reason = reasonJWTMissing
+	case errors.Is(err, errJWTExpired):
+		reason = reasonJWTExpired
+	case errors.Is(err, errJWTSigInvalid):
+		reason = reasonJWTSigInvalid
+	case errors.Is(err, errJWTClaimsInvalid):
+		reason = reasonJWTClaimsInvalid
+	case errors.Is(err, errJWTDuplicate):
+		reason = reasonJWTDuplicate
+	}
+	st := status.New(codes.Unauthenticated, err.Error())
+	if detailed, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: jwtErrorDomain}); derr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keyring holds the RSA keys used to sign and verify user JWTs and
+// keeps them current as they are rotated at their source.
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Loader fetches the current PEM encoded key from wherever it is stored
+type Loader interface {
+	Load(ctx context.Context) ([]byte, error)
+	// String describes the source for logs, without any secret material
+	String() string
+}
+
+// Storer is a Loader whose source this process can write, so the key can be
+// rotated from here
+type Storer interface {
+	Store(ctx context.Context, data []byte) error
+}
+
+// Keyring is the key loaded from a Loader. A private key also provides its
+// public half; a public key only verifies. Any further PEM blocks, such as the
+// remaining keys of a JWKS, are accepted for verification too. After a
+// rotation the previous public key is kept so tokens signed just before it
+// still verify. Every key ever loaded stays known by its KeyID, so a verifier
+// that can't refresh can still match tokens to keys it has seen. A revoked
+// KeyID verifies nothing, whatever the source still holds.
+type Keyring struct {
+	loader Loader
+
+	mu       sync.RWMutex
+	raw      []byte
+	private  *rsa.PrivateKey
+	public   *rsa.PublicKey
+	extra    []*rsa.PublicKey
+	previous *rsa.PublicKey
+	seen     map[string]*rsa.PublicKey
+	revoked  map[string]bool
+	loadedAt time.Time
+	onRotate []func(*Keyring)
+}
+
+// New loads the key from loader, failing if it can't be loaded or parsed
+func New(ctx context.Context, loader Loader) (*Keyring, error) {
+	k := &Keyring{loader: loader, seen: make(map[string]*rsa.PublicKey), revoked: make(map[string]bool)}
+	if _, err := k.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Source describes where the key is loaded from
+func (k *Keyring) Source() string {
+	return k.loader.String()
+}
+
+// PrivateKey returns the current private key, nil for a public-only keyring
+func (k *Keyring) PrivateKey() *rsa.PrivateKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.private
+}
+
+// PublicKey returns the current public key
+func (k *Keyring) PublicKey() *rsa.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.public
+}
+
+// PublicKeys returns the keys a token may be verified against: the current
+// one first, then any extra keys from the source, then the one it replaced,
+// leaving out revoked keys
+func (k *Keyring) PublicKeys() []*rsa.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := append([]*rsa.PublicKey{k.public}, k.extra...)
+	if k.previous != nil {
+		known := false
+		for _, key := range keys {
+			known = known || key.Equal(k.previous)
+		}
+		if !known {
+			keys = append(keys, k.previous)
+		}
+	}
+	if len(k.revoked) == 0 {
+		return keys
+	}
+	kept := keys[:0]
+	for _, key := range keys {
+		if !k.revoked[KeyID(key)] {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+// KeyIDs returns the KeyIDs of PublicKeys
+func (k *Keyring) KeyIDs() []string {
+	keys := k.PublicKeys()
+	kids := make([]string, len(keys))
+	for i, key := range keys {
+		kids[i] = KeyID(key)
+	}
+	return kids
+}
+
+// Revoke refuses the key with KeyID kid from now on, for the life of the
+// process, even while its source still holds it
+func (k *Keyring) Revoke(kid string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.revoked[kid] = true
+}
+
+// Revoked returns the revoked KeyIDs, sorted
+func (k *Keyring) Revoked() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	kids := make([]string, 0, len(k.revoked))
+	for kid := range k.revoked {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
+
+// LoadedAt is when the key was last loaded successfully, changed or not
+func (k *Keyring) LoadedAt() time.Time {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.loadedAt
+}
+
+// SeenKey returns the key with KeyID kid if this keyring ever loaded it and
+// it wasn't revoked
+func (k *Keyring) SeenKey(kid string) (*rsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.seen[kid]
+	if k.revoked[kid] {
+		return nil, false
+	}
+	return key, ok
+}
+
+// OnRotate registers fn to run after every rotation. Callbacks run on the
+// goroutine that called Refresh, outside the keyring's lock.
+func (k *Keyring) OnRotate(fn func(*Keyring)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onRotate = append(k.onRotate, fn)
+}
+
+// Refresh reloads the key and reports whether it changed. On error the
+// current key stays in use.
+func (k *Keyring) Refresh(ctx context.Context) (bool, error) {
+	data, err := k.loader.Load(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to load key from %s: %w", k.loader, err)
+	}
+	now := time.Now()
+	k.mu.Lock()
+	unchanged := bytes.Equal(data, k.raw)
+	if unchanged {
+		k.loadedAt = now
+	}
+	k.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	private, public, extra, err := parseKeys(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse key from %s: %w", k.loader, err)
+	}
+
+	k.mu.Lock()
+	rotated := k.public != nil
+	if rotated {
+		k.previous = k.public
+	}
+	k.raw, k.private, k.public, k.extra = data, private, public, extra
+	k.loadedAt = now
+	for _, key := range append([]*rsa.PublicKey{public}, extra...) {
+		k.seen[KeyID(key)] = key
+	}
+	callbacks := append([]func(*Keyring){}, k.onRotate...)
+	k.mu.Unlock()
+
+	if rotated {
+		for _, fn := range callbacks {
+			fn(k)
+		}
+	}
+	return rotated, nil
+}
+
+// Rotate writes data, a new PEM encoded key, to the source and loads it. It
+// fails for sources this process can't write, see Storer.
+func (k *Keyring) Rotate(ctx context.Context, data []byte) (bool, error) {
+	s, ok := k.loader.(Storer)
+	if !ok {
+		return false, fmt.Errorf("%s can't be written, rotate the key at its source", k.loader)
+	}
+	if _, _, _, err := parseKeys(data); err != nil {
+		return false, err
+	}
+	if err := s.Store(ctx, data); err != nil {
+		return false, fmt.Errorf("failed to store key to %s: %w", k.loader, err)
+	}
+	return k.Refresh(ctx)
+}
+
+// Watch refreshes the key every interval until ctx is done, passing refresh
+// failures to onError
+func (k *Keyring) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := k.Refresh(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// parseKeys parses the first PEM block as the current key and any following
+// blocks as extra public keys
+func parseKeys(data []byte) (*rsa.PrivateKey, *rsa.PublicKey, []*rsa.PublicKey, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, nil, nil, errors.New("no PEM block found")
+	}
+	private, public, err := parseKey(block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var extra []*rsa.PublicKey
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return private, public, extra, nil
+		}
+		_, key, err := parseKey(block)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		extra = append(extra, key)
+	}
+}
+
+// parseKey accepts PKCS#1 and PKCS#8 private keys and PKIX and PKCS#1
+// public keys
+func parseKey(block *pem.Block) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("private key is not an RSA key")
+		}
+		return rsaKey, &rsaKey.PublicKey, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, errors.New("public key is not an RSA key")
+		}
+		return nil, rsaKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, key, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/grpcserver"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/subjecthash"
+)
+
+const (
+	defaultPort             = "7070"
+	defaultMaxOrdersPerUser = 50
+)
+
+var log *logrus.Logger
+
+func init() {
+	log = logrus.New()
+	log.Level = logrus.DebugLevel
+	log.Formatter = &logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "severity",
+			logrus.FieldKeyMsg:   "message",
+		},
+		TimestampFormat: time.RFC3339Nano,
+	}
+	log.Out = os.Stdout
+}
+
+func main() {
+	if _, err := subjecthash.Load(os.Getenv("SUBJECT_HASH_KEY_FILE")); err != nil {
+		log.Fatalf("SUBJECT_HASH_KEY_FILE: %v", err)
+	}
+	if err := loadJWTPublicKey(context.Background()); err != nil {
+		log.Fatalf("Failed to load JWT public key: %v", err)
+	}
+
+	maxOrders := defaultMaxOrdersPerUser
+	if v, err := strconv.Atoi(os.Getenv("ORDER_HISTORY_MAX_PER_USER")); err == nil && v > 0 {
+		maxOrders = v
+	}
+	store, err := newOrderStore(os.Getenv("ORDER_HISTORY_FILE"), maxOrders)
+	if err != nil {
+		log.Fatalf("Failed to open order history: %v", err)
+	}
+
+	port := defaultPort
+	if value, ok := os.LookupEnv("PORT"); ok {
+		port = value
+	}
+	port = fmt.Sprintf(":%s", port)
+
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	srv := grpcserver.New(grpcserver.Options{
+		Unary:  []grpc.UnaryServerInterceptor{recoveryUnaryServerInterceptor, jwtUnaryServerInterceptor},
+		Stream: []grpc.StreamServerInterceptor{recoveryStreamServerInterceptor},
+	})
+	svc := &server{store: store}
+	pb.RegisterOrderHistoryServiceServer(srv, svc)
+	healthpb.RegisterHealthServer(srv, svc)
+	reflection.Register(srv)
+
+	if addr := os.Getenv("DEBUG_ADDR"); addr != "" {
+		go func() {
+			log.Infof("Debug server listening on %s", addr)
+			if err := http.ListenAndServe(addr, expvar.Handler()); err != nil {
+				log.Warnf("debug server stopped: %v", err)
+			}
+		}()
+	}
+
+	log.Infof("Order History Service listening on port %s", port)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
+
+// server controls RPC service responses.
+type server struct {
+	pb.UnimplementedOrderHistoryServiceServer
+	store *orderStore
+}
+
+// Check is for health checking.
+func (s *server) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *server) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Health_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "health check via Watch not implemented")
+}
+
+// RecordOrder stores a placed order under the caller's subject
+func (s *server) RecordOrder(ctx context.Context, in *pb.RecordOrderRequest) (*pb.Empty, error) {
+	claims, _ := ClaimsFromContext(ctx)
+	if in.GetOrder().GetOrderId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "order_id is required")
+	}
+	// The snapshot is checkout's account of the authorization; it must at
+	// least be about the token this call carries
+	if id := in.GetAuthorization().GetTokenId(); id != "" && id != claims.ID {
+		return nil, status.Error(codes.InvalidArgument, "authorization snapshot is for another token")
+	}
+	snapshot := in.GetAuthorization()
+	if snapshot != nil && !snapshotSigned(ctx, in.GetOrder().GetOrderId(), snapshot) {
+		log.Warnf("[RecordOrder] order_id=%s: dropping an authorization snapshot checkout did not sign", in.GetOrder().GetOrderId())
+		snapshot = nil
+	}
+	err := s.store.Record(claims.Subject, &pb.HistoricalOrder{
+		Order:         in.GetOrder(),
+		Total:         in.GetTotal(),
+		PlacedAtUnix:  time.Now().Unix(),
+		Authorization: snapshot,
+	})
+	if err != nil {
+		log.Errorf("[RecordOrder] storing order %s: %v", in.GetOrder().GetOrderId(), err)
+		return nil, status.Error(codes.Internal, "failed to store order")
+	}
+	log.Infof("[RecordOrder] order_id=%s sub=%s", in.GetOrder().GetOrderId(), pseudonym(claims.Subject))
+	return &pb.Empty{}, nil
+}
+
+// ListOrders returns the caller's orders, newest first
+func (s *server) ListOrders(ctx context.Context, in *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	claims, _ := ClaimsFromContext(ctx)
+	return &pb.ListOrdersResponse{Orders: s.store.List(claims.Subject, int(in.GetLimit()))}, nil
+}
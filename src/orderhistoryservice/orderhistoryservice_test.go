@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/jwttest"
+)
+
+// TestSplitFormats checks that all three formats of one token verify to the
+// same subject, and that a tampered claim block or an unknown static block
+// reference doesn't.
+func TestSplitFormats(t *testing.T) {
+	iss := jwttest.RS256()
+	keys := []*rsa.PublicKey{iss.RSAPublicKey()}
+	exp := time.Now().Add(time.Minute).Unix()
+	payload := `{"session_id":"s1","sub":"urn:hipstershop:user:s1","iss":"https://auth.hipstershop.com","aud":["urn:hipstershop:api"],"exp":` + strconv.FormatInt(exp, 10) + `}`
+	header, _, sig := jwttest.Split(iss.Sign([]byte(`{"alg":"RS256","typ":"JWT"}`), []byte(payload)))
+	static := `{"iss":"https://auth.hipstershop.com","aud":["urn:hipstershop:api"]}`
+	blocks := func(session string) metadata.MD {
+		return metadata.Pairs("x-jwt-header", header, "x-jwt-sig", sig,
+			"x-jwt-claims", `["session_id","sub","iss","aud","exp"]`,
+			"x-jwt-static", static, "x-jwt-static-sha", staticBlockSHA(static),
+			"x-jwt-session", session, "x-jwt-dynamic", `{"exp":`+strconv.FormatInt(exp, 10)+`}`)
+	}
+
+	for name, md := range map[string]metadata.MD{
+		formatAuthorization: metadata.Pairs("authorization", "Bearer "+header+"."+base64.RawURLEncoding.EncodeToString([]byte(payload))+"."+sig),
+		formatSplitPayload:  metadata.Pairs("x-jwt-header", header, "x-jwt-payload", payload, "x-jwt-sig", sig),
+		formatClaimBlocks:   blocks(`{"session_id":"s1","sub":"urn:hipstershop:user:s1"}`),
+	} {
+		token, err := tokenFromMetadata(md)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		claims, err := verifySplitToken(keys, token)
+		if err != nil || token.format != name || claims.Subject != "urn:hipstershop:user:s1" {
+			t.Errorf("%s: got format %s, claims %+v, err %v", name, token.format, claims, err)
+		}
+	}
+
+	// The static block is stored now and may be sent by reference
+	byRef := blocks(`{"session_id":"s1","sub":"urn:hipstershop:user:s1"}`)
+	delete(byRef, "x-jwt-static")
+	if _, err := tokenFromMetadata(byRef); err != nil {
+		t.Errorf("static block by reference: %v", err)
+	}
+	byRef.Set("x-jwt-static-sha", "0000000000000000")
+	if _, err := tokenFromMetadata(byRef); !isStaticBlockUnknown(err) {
+		t.Errorf("unknown static block reference: got %v", err)
+	}
+
+	token, err := tokenFromMetadata(blocks(`{"session_id":"s1","sub":"urn:hipstershop:user:s2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySplitToken(keys, token); !errors.Is(err, errJWTSigInvalid) {
+		t.Errorf("tampered session block: got %v, want %v", err, errJWTSigInvalid)
+	}
+
+	// A token without exp would never expire
+	noExp := `{"session_id":"s1","sub":"urn:hipstershop:user:s1","iss":"https://auth.hipstershop.com","aud":["urn:hipstershop:api"]}`
+	token, err = tokenFromMetadata(metadata.Pairs("authorization", "Bearer "+iss.Sign([]byte(`{"alg":"RS256","typ":"JWT"}`), []byte(noExp))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySplitToken(keys, token); !errors.Is(err, errJWTClaimsInvalid) {
+		t.Errorf("token without exp: got %v, want %v", err, errJWTClaimsInvalid)
+	}
+
+	// Identical repeats are read once, conflicting ones refused
+	repeated := blocks(`{"session_id":"s1","sub":"urn:hipstershop:user:s1"}`)
+	repeated.Append("x-jwt-sig", sig)
+	if _, err := tokenFromMetadata(repeated); err != nil {
+		t.Errorf("identical repeat: %v", err)
+	}
+	repeated.Append("x-jwt-session", `{"session_id":"s2","sub":"urn:hipstershop:user:s2"}`)
+	if _, err := tokenFromMetadata(repeated); !errors.Is(err, errJWTDuplicate) {
+		t.Errorf("conflicting repeat: got %v, want %v", err, errJWTDuplicate)
+	}
+}
+
+// TestOrderStore checks limits, idempotent retries and replay from the file
+func TestOrderStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	s, err := newOrderStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "b", "c"} {
+		if err := s.Record("alice", &pb.HistoricalOrder{Order: &pb.OrderResult{OrderId: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Record("bob", &pb.HistoricalOrder{Order: &pb.OrderResult{OrderId: "d"}})
+
+	reopened, err := newOrderStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []*orderStore{s, reopened} {
+		got := store.List("alice", 0)
+		if len(got) != 2 || got[0].GetOrder().GetOrderId() != "c" || got[1].GetOrder().GetOrderId() != "b" {
+			t.Errorf("alice's orders: got %v, want c, b", got)
+		}
+		if got := store.List("alice", 1); len(got) != 1 {
+			t.Errorf("limit 1: got %d orders", len(got))
+		}
+		if got := store.List("bob", 0); len(got) != 1 {
+			t.Errorf("bob's orders: got %d, want 1", len(got))
+		}
+	}
+}
+
+// TestRecordOrderAuthorization checks that the authorization snapshot is
+// persisted with the order when checkout signed it, dropped when it didn't,
+// and refused when it names another token
+func TestRecordOrderAuthorization(t *testing.T) {
+	defer func(key []byte) { orderSnapshotKey = key }(orderSnapshotKey)
+	orderSnapshotKey = []byte("snapshot-key")
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	store, err := newOrderStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{store: store}
+	ctx := context.WithValue(context.Background(), ctxKeyClaims{}, &UserClaims{Subject: "alice", ID: "jti-1"})
+	snapshot := &pb.AuthorizationSnapshot{SubjectHash: "ab12", Roles: []string{"customer"}, TokenId: "jti-1", Verification: "verified"}
+
+	if _, err := srv.RecordOrder(ctx, &pb.RecordOrderRequest{
+		Order:         &pb.OrderResult{OrderId: "a"},
+		Authorization: &pb.AuthorizationSnapshot{TokenId: "jti-2"},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("snapshot of another token: got %v, want InvalidArgument", err)
+	}
+	signed := func(key []byte, orderID string) context.Context {
+		sig := base64.RawURLEncoding.EncodeToString(snapshotMAC(key, orderID, snapshot))
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(mdSnapshotSignature, sig))
+	}
+	for _, tc := range []struct {
+		orderID string
+		ctx     context.Context
+	}{
+		{"unsigned", ctx},
+		{"other-key", signed([]byte("forged"), "other-key")},
+		{"other-order", signed(orderSnapshotKey, "a")},
+		{"a", signed(orderSnapshotKey, "a")},
+	} {
+		if _, err := srv.RecordOrder(tc.ctx, &pb.RecordOrderRequest{Order: &pb.OrderResult{OrderId: tc.orderID}, Authorization: snapshot}); err != nil {
+			t.Fatalf("%s: %v", tc.orderID, err)
+		}
+	}
+
+	reopened, err := newOrderStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reopened.List("alice", 0)
+	if len(got) != 4 {
+		t.Fatalf("stored %d orders, want 4", len(got))
+	}
+	for _, o := range got {
+		want := o.GetOrder().GetOrderId() == "a"
+		if has := proto.Equal(o.GetAuthorization(), snapshot); has != want {
+			t.Errorf("order %s stored with snapshot %v, want signed only", o.GetOrder().GetOrderId(), o.GetAuthorization())
+		}
+	}
+}
+
+// TestRecoveryInterceptor checks that a handler panic becomes an Internal
+// error and is counted
+func TestRecoveryInterceptor(t *testing.T) {
+	method := "/hipstershop.OrderHistoryService/ListOrders"
+	_, err := recoveryUnaryServerInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method},
+		func(context.Context, interface{}) (interface{}, error) { panic("boom") })
+	if status.Code(err) != codes.Internal {
+		t.Errorf("got %v, want Internal", err)
+	}
+	if n := panicsTotal.Get(method); n == nil || n.String() != "1" {
+		t.Errorf("panics counted: %v, want 1", n)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"runtime/debug"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/subjecthash"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Handler panics are recovered as codes.Internal, like in the other Go
+// services, so one bad order can't take the history of every user down. The
+// panic is logged with its stack, never with the request metadata, and
+// counted in the grpc_server_panics_total map of the debug server.
+
+// panicsTotal counts recovered handler panics per full method name
+var panicsTotal = expvar.NewMap("grpc_server_panics_total")
+
+// recoveryUnaryServerInterceptor converts handler panics into codes.Internal
+func recoveryUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverPanic(info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// recoveryStreamServerInterceptor converts stream handler panics into codes.Internal
+func recoveryStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverPanic(info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// recoverPanic logs and counts the panic and returns the error sent to the
+// caller
+func recoverPanic(method string, r interface{}) error {
+	panicsTotal.Add(method, 1)
+	log.WithField("method", method).WithField("stack", string(debug.Stack())).Errorf("[PANIC] recovered panic in %s: %v", method, r)
+	return status.Errorf(codes.Internal, "internal error")
+}
+
+// subjects hashes the subjects written to logs, under the keys in
+// SUBJECT_HASH_KEY_FILE
+var subjects = loadSubjectHasher()
+
+// loadSubjectHasher falls back to hashing without a key when the key file
+// can't be read; startup refuses it
+func loadSubjectHasher() *subjecthash.Hasher {
+	h, err := subjecthash.Load(os.Getenv("SUBJECT_HASH_KEY_FILE"))
+	if err != nil {
+		return subjecthash.New()
+	}
+	return h
+}
+
+// pseudonym returns the short hash logged in place of a subject, the same
+// in every service sharing the key file
+func pseudonym(id string) string {
+	if id == "" {
+		return ""
+	}
+	return subjects.Short(id)
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/genproto"
+)
+
+// Authorization snapshots are checkout's account of the claims an order was
+// placed under. Any caller with a user token can call RecordOrder, so a
+// snapshot is stored only when checkout signed it: x-authz-snapshot-sig is
+// the base64url HMAC-SHA256 under ORDER_SNAPSHOT_KEY of the order ID and the
+// snapshot's deterministic encoding. Without the key no snapshot is stored.
+
+const mdSnapshotSignature = "x-authz-snapshot-sig"
+
+var orderSnapshotKey = []byte(os.Getenv("ORDER_SNAPSHOT_KEY"))
+
+// snapshotSigned reports whether the incoming metadata of ctx carries
+// checkout's signature of snapshot for the order orderID
+func snapshotSigned(ctx context.Context, orderID string, snapshot *pb.AuthorizationSnapshot) bool {
+	if len(orderSnapshotKey) == 0 {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	sigs := md.Get(mdSnapshotSignature)
+	if len(sigs) != 1 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigs[0])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, snapshotMAC(orderSnapshotKey, orderID, snapshot))
+}
+
+// snapshotMAC is the HMAC-SHA256 under key of the order ID and the
+// deterministic encoding of snapshot
+func snapshotMAC(key []byte, orderID string, snapshot *pb.AuthorizationSnapshot) []byte {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(snapshot)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(orderID))
+	mac.Write([]byte{0})
+	mac.Write(b)
+	return mac.Sum(nil)
+}
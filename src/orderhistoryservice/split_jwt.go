@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Split JWT formats
+//
+// Order history reads user tokens in the form senders put them on the wire
+// instead of rebuilding the compact token first:
+//
+//	version 1  authorization: Bearer <header.payload.signature>
+//	version 2  x-jwt-header, x-jwt-payload (raw JSON), x-jwt-sig
+//	version 3  x-jwt-header, x-jwt-sig and the claim blocks x-jwt-static
+//	           (or its x-jwt-static-sha reference), x-jwt-session and
+//	           x-jwt-dynamic, merged in the key order of x-jwt-claims
+//
+// Claims are decoded straight from the raw JSON payload of versions 2 and 3;
+// only the signature check needs the payload base64url encoded again.
+//
+// Proxies can repeat metadata values. Identical repeats of authorization and
+// the x-jwt-* keys are accepted and read once; a request whose repeats
+// differ is refused with JWT_DUPLICATE_HEADER, as checkout and shipping do,
+// since picking the first value would let a proxy choose the token.
+
+const (
+	formatAuthorization = "v1"
+	formatSplitPayload  = "v2"
+	formatClaimBlocks   = "v3"
+)
+
+const (
+	staticBlockUnknownReason = "JWT_STATIC_BLOCK_UNKNOWN"
+	jwtErrorDomain           = "jwt-split.hipstershop"
+)
+
+// jwtFormats counts incoming tokens per format
+var jwtFormats = expvar.NewMap("jwt_formats")
+
+// splitToken is a user token as received
+type splitToken struct {
+	header    string // base64url, as signed
+	payload   string // raw JSON
+	signature string // base64url
+	format    string
+}
+
+// signingInput is the header.payload the signature covers
+func (t *splitToken) signingInput() string {
+	return t.header + "." + base64.RawURLEncoding.EncodeToString([]byte(t.payload))
+}
+
+// tokenFromMetadata returns the user token carried by md, or nil when there
+// is none
+func tokenFromMetadata(md metadata.MD) (*splitToken, error) {
+	if err := checkDuplicates(md); err != nil {
+		return nil, err
+	}
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	header, sig := first("x-jwt-header"), first("x-jwt-sig")
+	if payload := first("x-jwt-payload"); payload != "" {
+		return &splitToken{header: header, payload: payload, signature: sig, format: formatSplitPayload}, nil
+	}
+	if order := first("x-jwt-claims"); order != "" {
+		static, err := staticBlockFromMetadata(md)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := mergeClaimBlocks(order, static, first("x-jwt-session"), first("x-jwt-dynamic"))
+		if err != nil {
+			return nil, err
+		}
+		return &splitToken{header: header, payload: payload, signature: sig, format: formatClaimBlocks}, nil
+	}
+	if auth := first("authorization"); auth != "" {
+		parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%w: expected 3 parts, got %d", errJWTMalformed, len(parts))
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to decode payload: %v", errJWTMalformed, err)
+		}
+		return &splitToken{header: parts[0], payload: string(payload), signature: parts[2], format: formatAuthorization}, nil
+	}
+	return nil, nil
+}
+
+// checkDuplicates refuses md when a JWT key has conflicting values, the
+// first in key order
+func checkDuplicates(md metadata.MD) error {
+	keys := make([]string, 0, len(md))
+	for k, v := range md {
+		if len(v) > 1 && (k == "authorization" || strings.HasPrefix(k, "x-jwt-")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := md[k]
+		for _, v := range values[1:] {
+			if v != values[0] {
+				return fmt.Errorf("%w: %s sent %d times with conflicting values", errJWTDuplicate, k, len(values))
+			}
+		}
+	}
+	return nil
+}
+
+// claimMember is one top-level member of a JSON object, value kept verbatim
+type claimMember struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// claimMembers parses a JSON object into its members in document order
+func claimMembers(obj string) ([]claimMember, error) {
+	dec := json.NewDecoder(strings.NewReader(obj))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("claims are not a JSON object")
+	}
+	var members []claimMember
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		members = append(members, claimMember{Key: key, Value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// mergeClaimBlocks rebuilds the raw JSON payload from claim blocks: the
+// members of all blocks, in the key order given by x-jwt-claims. The result
+// must match the signed payload byte for byte.
+func mergeClaimBlocks(order string, blocks ...string) (string, error) {
+	var keys []string
+	if err := json.Unmarshal([]byte(order), &keys); err != nil {
+		return "", fmt.Errorf("%w: invalid claim order: %v", errJWTMalformed, err)
+	}
+	values := make(map[string]json.RawMessage, len(keys))
+	for _, block := range blocks {
+		if block == "" {
+			continue
+		}
+		members, err := claimMembers(block)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid claim block: %v", errJWTMalformed, err)
+		}
+		for _, m := range members {
+			values[m.Key] = m.Value
+		}
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		v, ok := values[k]
+		if !ok {
+			return "", fmt.Errorf("%w: claim %q missing from claim blocks", errJWTMalformed, k)
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+// Static blocks sent by reference (x-jwt-static-sha, the first 8 bytes of
+// the block's SHA-256) are looked up in blocks stored from earlier calls; an
+// unknown reference fails with FailedPrecondition and an ErrorInfo asking
+// the sender to resend the block.
+
+var staticBlocks = newStaticBlockDictionary(1024)
+
+type staticBlockDictionary struct {
+	mu     sync.Mutex
+	max    int
+	blocks map[string]string
+	order  []string
+}
+
+func newStaticBlockDictionary(max int) *staticBlockDictionary {
+	return &staticBlockDictionary{max: max, blocks: make(map[string]string)}
+}
+
+func (d *staticBlockDictionary) Get(sha string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	block, ok := d.blocks[sha]
+	return block, ok
+}
+
+func (d *staticBlockDictionary) Put(sha, block string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.blocks[sha]; ok {
+		return
+	}
+	if len(d.order) >= d.max {
+		delete(d.blocks, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.blocks[sha] = block
+	d.order = append(d.order, sha)
+}
+
+func staticBlockSHA(block string) string {
+	sum := sha256.Sum256([]byte(block))
+	return hex.EncodeToString(sum[:8])
+}
+
+// staticBlockUnknownError asks the sender for the full static block
+type staticBlockUnknownError struct {
+	sha string
+}
+
+func (e *staticBlockUnknownError) Error() string {
+	return fmt.Sprintf("unknown static claim block %s", e.sha)
+}
+
+func (e *staticBlockUnknownError) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   staticBlockUnknownReason,
+		Domain:   jwtErrorDomain,
+		Metadata: map[string]string{"sha": e.sha},
+	}); err == nil {
+		return detailed
+	}
+	return st
+}
+
+func isStaticBlockUnknown(err error) bool {
+	var unknown *staticBlockUnknownError
+	return errors.As(err, &unknown)
+}
+
+// staticBlockFromMetadata returns the static claim block sent in full or by
+// reference, storing blocks that arrive with their reference
+func staticBlockFromMetadata(md metadata.MD) (string, error) {
+	var block, sha string
+	if v := md.Get("x-jwt-static"); len(v) > 0 {
+		block = v[0]
+	}
+	if v := md.Get("x-jwt-static-sha"); len(v) > 0 {
+		sha = v[0]
+	}
+	switch {
+	case sha == "":
+		return block, nil
+	case block != "":
+		if staticBlockSHA(block) != sha {
+			return "", fmt.Errorf("%w: x-jwt-static-sha %s does not match x-jwt-static", errJWTMalformed, sha)
+		}
+		staticBlocks.Put(sha, block)
+		return block, nil
+	}
+	if block, ok := staticBlocks.Get(sha); ok {
+		return block, nil
+	}
+	return "", &staticBlockUnknownError{sha: sha}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/orderhistoryservice/genproto"
+)
+
+// orderStore keeps the latest orders of each subject. With a file, every
+// recorded order is appended to it as a JSON line and the file is replayed on
+// start, so history survives restarts of a single replica.
+type orderStore struct {
+	mu     sync.Mutex
+	max    int
+	orders map[string][]*pb.HistoricalOrder // oldest first
+	file   *os.File
+}
+
+// storedOrder is one line of the store file
+type storedOrder struct {
+	Subject string          `json:"sub"`
+	Order   json.RawMessage `json:"order"`
+}
+
+// newOrderStore returns a store keeping max orders per subject, persisted to
+// path unless it is empty
+func newOrderStore(path string, max int) (*orderStore, error) {
+	s := &orderStore{max: max, orders: make(map[string][]*pb.HistoricalOrder)}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var rec storedOrder
+		order := &pb.HistoricalOrder{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if err := protojson.Unmarshal(rec.Order, order); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		s.add(rec.Subject, order)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+// Record stores order for subject. Recording an order ID the subject already
+// has is a no-op, so callers may retry.
+func (s *orderStore) Record(subject string, order *pb.HistoricalOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.orders[subject] {
+		if o.GetOrder().GetOrderId() == order.GetOrder().GetOrderId() {
+			return nil
+		}
+	}
+	if s.file != nil {
+		raw, err := protojson.Marshal(order)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(storedOrder{Subject: subject, Order: raw})
+		if err != nil {
+			return err
+		}
+		if _, err := s.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	s.add(subject, order)
+	return nil
+}
+
+func (s *orderStore) add(subject string, order *pb.HistoricalOrder) {
+	orders := append(s.orders[subject], order)
+	if len(orders) > s.max {
+		orders = orders[len(orders)-s.max:]
+	}
+	s.orders[subject] = orders
+}
+
+// List returns up to limit orders of subject, newest first; limit 0 returns
+// all of them
+func (s *orderStore) List(subject string, limit int) []*pb.HistoricalOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := s.orders[subject]
+	if limit <= 0 || limit > len(orders) {
+		limit = len(orders)
+	}
+	out := make([]*pb.HistoricalOrder, 0, limit)
+	for i := len(orders) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, orders[i])
+	}
+	return out
+}
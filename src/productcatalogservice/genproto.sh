@@ -20,6 +20,6 @@ PATH=$PATH:$(go env GOPATH)/bin
 protodir=../../protos
 outdir=./genproto
 
-protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative $protodir/demo.proto
+protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative $protodir/auth_options.proto $protodir/demo.proto
 
 # [END gke_productcatalogservice_genproto]
\ No newline at end of file
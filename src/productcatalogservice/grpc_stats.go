@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+)
+
+// JWT wire modes recorded per RPC, derived from the metadata actually sent/received
+const (
+	jwtModeCompressed = "compressed" // x-jwt-header + x-jwt-payload + x-jwt-sig
+	jwtModeFull       = "full"       // authorization: Bearer <jwt>
+	jwtModeNone       = "none"       // no JWT metadata on the RPC
+)
+
+// wireStats is the process-wide stats handler shared by all clients and servers
+var wireStats = newWireStatsHandler()
+
+// rpcWireStats holds cumulative wire statistics for one side/method/mode combination
+type rpcWireStats struct {
+	Side             string `json:"side"` // "client" or "server"
+	Method           string `json:"method"`
+	JWTMode          string `json:"jwt_mode"`
+	Calls            int64  `json:"calls"`
+	Errors           int64  `json:"errors"`
+	HeaderWireBytes  int64  `json:"header_wire_bytes"`  // HPACK-encoded size (inbound server headers only)
+	MetadataBytes    int64  `json:"metadata_bytes"`     // Uncompressed key+value size of all metadata
+	JWTMetadataBytes int64  `json:"jwt_metadata_bytes"` // Uncompressed key+value size of JWT metadata only
+	PayloadWireIn    int64  `json:"payload_wire_bytes_in"`
+	PayloadWireOut   int64  `json:"payload_wire_bytes_out"`
+}
+
+// rpcStatsTag accumulates the statistics of a single RPC until it ends
+type rpcStatsTag struct {
+	mu    sync.Mutex
+	stats rpcWireStats
+}
+
+type ctxKeyRPCStatsTag struct{}
+
+// wireStatsHandler is a grpc stats.Handler recording per-RPC wire sizes,
+// metadata sizes and the JWT compression mode in use
+type wireStatsHandler struct {
+	mu      sync.Mutex
+	entries map[string]*rpcWireStats
+}
+
+func newWireStatsHandler() *wireStatsHandler {
+	return &wireStatsHandler{entries: make(map[string]*rpcWireStats)}
+}
+
+// TagRPC attaches a per-RPC accumulator to the context
+func (h *wireStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	tag := &rpcStatsTag{}
+	tag.stats.Method = info.FullMethodName
+	tag.stats.JWTMode = jwtModeNone
+	return context.WithValue(ctx, ctxKeyRPCStatsTag{}, tag)
+}
+
+// HandleRPC records header, payload and completion events for the tagged RPC
+func (h *wireStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	tag, ok := ctx.Value(ctxKeyRPCStatsTag{}).(*rpcStatsTag)
+	if !ok {
+		return
+	}
+
+	tag.mu.Lock()
+	defer tag.mu.Unlock()
+
+	switch ev := s.(type) {
+	case *stats.OutHeader:
+		// Only the client's request headers carry the JWT
+		if ev.Client {
+			tag.recordMetadata(ev.Header)
+		}
+	case *stats.InHeader:
+		if !ev.Client {
+			tag.stats.HeaderWireBytes += int64(ev.WireLength)
+			tag.recordMetadata(ev.Header)
+		}
+	case *stats.InPayload:
+		tag.stats.PayloadWireIn += int64(ev.WireLength)
+	case *stats.OutPayload:
+		tag.stats.PayloadWireOut += int64(ev.WireLength)
+	case *stats.End:
+		tag.stats.Side = "server"
+		if ev.Client {
+			tag.stats.Side = "client"
+		}
+		tag.stats.Calls = 1
+		if ev.Error != nil {
+			tag.stats.Errors = 1
+		}
+		h.commit(&tag.stats)
+	}
+}
+
+// TagConn is a no-op; statistics are kept per RPC
+func (h *wireStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn is a no-op; statistics are kept per RPC
+func (h *wireStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// recordMetadata adds the metadata sizes and detects the JWT wire mode
+func (t *rpcStatsTag) recordMetadata(md metadata.MD) {
+	for k, vals := range md {
+		for _, v := range vals {
+			size := int64(len(k) + len(v))
+			t.stats.MetadataBytes += size
+			if isJWTMetadataKey(k) {
+				t.stats.JWTMetadataBytes += size
+			}
+		}
+	}
+	t.stats.JWTMode = jwtModeFromMetadata(md)
+}
+
+// commit folds a finished RPC into the aggregated statistics
+func (h *wireStatsHandler) commit(rpc *rpcWireStats) {
+	key := rpc.Side + "|" + rpc.Method + "|" + rpc.JWTMode
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	agg, ok := h.entries[key]
+	if !ok {
+		agg = &rpcWireStats{Side: rpc.Side, Method: rpc.Method, JWTMode: rpc.JWTMode}
+		h.entries[key] = agg
+	}
+	agg.Calls += rpc.Calls
+	agg.Errors += rpc.Errors
+	agg.HeaderWireBytes += rpc.HeaderWireBytes
+	agg.MetadataBytes += rpc.MetadataBytes
+	agg.JWTMetadataBytes += rpc.JWTMetadataBytes
+	agg.PayloadWireIn += rpc.PayloadWireIn
+	agg.PayloadWireOut += rpc.PayloadWireOut
+}
+
+// Snapshot returns a copy of the aggregated statistics, sorted by side and method
+func (h *wireStatsHandler) Snapshot() []rpcWireStats {
+	h.mu.Lock()
+	out := make([]rpcWireStats, 0, len(h.entries))
+	for _, e := range h.entries {
+		out = append(out, *e)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Side != out[j].Side {
+			return out[i].Side < out[j].Side
+		}
+		if out[i].Method != out[j].Method {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].JWTMode < out[j].JWTMode
+	})
+	return out
+}
+
+// ServeHTTP renders the aggregated statistics as JSON
+func (h *wireStatsHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(h.Snapshot()); err != nil {
+		log.Warnf("failed to encode grpc stats: %v", err)
+	}
+}
+
+// isJWTMetadataKey reports whether a metadata key carries (part of) the JWT
+func isJWTMetadataKey(key string) bool {
+	switch key {
+	case "authorization", "x-jwt-header", "x-jwt-payload", "x-jwt-sig",
+		"x-jwt-actor", "x-jwt-actor-header", "x-jwt-actor-payload", "x-jwt-actor-sig":
+		return true
+	}
+	return false
+}
+
+// jwtModeFromMetadata determines how the JWT was transmitted on an RPC
+func jwtModeFromMetadata(md metadata.MD) string {
+	if len(md.Get("x-jwt-payload")) > 0 {
+		return jwtModeCompressed
+	}
+	if len(md.Get("authorization")) > 0 {
+		return jwtModeFull
+	}
+	return jwtModeNone
+}
+
+// startDebugServer exposes the gRPC wire statistics over HTTP when DEBUG_PORT is set
+func startDebugServer() {
+	port := os.Getenv("DEBUG_PORT")
+	if port == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/grpcstats", wireStats)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		log.Infof("starting debug server on :%s", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			log.Warnf("debug server stopped: %v", err)
+		}
+	}()
+}
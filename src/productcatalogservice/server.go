@@ -26,6 +26,8 @@ import (
 	"time"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/subjecthash"
+	channelzservice "google.golang.org/grpc/channelz/service"
 	"google.golang.org/grpc/credentials/insecure"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
@@ -74,6 +76,10 @@ func main() {
 		log.Info("Tracing disabled.")
 	}
 
+	if _, err := subjecthash.Load(os.Getenv("SUBJECT_HASH_KEY_FILE")); err != nil {
+		log.Fatalf("SUBJECT_HASH_KEY_FILE: %v", err)
+	}
+
 	if os.Getenv("DISABLE_PROFILER") == "" {
 		log.Info("Profiling enabled.")
 		go initProfiling("productcatalogservice", "1.0.0")
@@ -116,6 +122,7 @@ func main() {
 	}
 	log.Infof("starting grpc server at :%s", port)
 	run(port)
+	startDebugServer()
 	select {}
 }
 
@@ -131,8 +138,9 @@ func run(port string) string {
 			propagation.TraceContext{}, propagation.Baggage{}))
 	var srv *grpc.Server
 	srv = grpc.NewServer(
-		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
-		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()))
+		grpc.ChainUnaryInterceptor(recoveryUnaryServerInterceptor, otelgrpc.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(recoveryStreamServerInterceptor, otelgrpc.StreamServerInterceptor()),
+		grpc.StatsHandler(wireStats))
 
 	svc := &productCatalog{}
 	err = loadCatalog(&svc.catalog)
@@ -142,6 +150,7 @@ func run(port string) string {
 
 	pb.RegisterProductCatalogServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
+	channelzservice.RegisterChannelzServiceToServer(srv)
 	go srv.Serve(listener)
 
 	return listener.Addr().String()
@@ -210,7 +219,8 @@ func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 	*conn, err = grpc.DialContext(ctx, addr,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
-		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()))
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+		grpc.WithStatsHandler(wireStats))
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
 	}
@@ -21,6 +21,6 @@
 # requires gRPC tools:
 #   pip install -r requirements.txt
 
-python -m grpc_tools.protoc -I../../protos --python_out=. --grpc_python_out=. ../../protos/demo.proto
+python -m grpc_tools.protoc -I../../protos --python_out=. --grpc_python_out=. ../../protos/auth_options.proto ../../protos/demo.proto
 
 # [END gke_recommendationservice_genproto]
\ No newline at end of file
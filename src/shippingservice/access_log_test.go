@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccessLogFailedCall(t *testing.T) {
+	defer func(n uint64) { accessLogSampleEvery = n }(accessLogSampleEvery)
+	accessLogSampleEvery = 1000
+	var buf bytes.Buffer
+	out, formatter := log.Out, log.Formatter
+	log.Out, log.Formatter = &buf, &logrus.JSONFormatter{}
+	defer func() { log.Out, log.Formatter = out, formatter }()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/ShipOrder"}
+	_, err := accessLogUnaryServerInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		a := accessFromContext(ctx)
+		a.reassembled(time.Millisecond)
+		a.verifiedAs(&UserClaims{Subject: "user-1"}, false, false, 3*time.Millisecond)
+		return nil, status.Error(codes.Unauthenticated, "bad token")
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("err = %v", err)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed call not logged despite sampling: %q", buf.String())
+	}
+	if line["grpc.code"] != "Unauthenticated" || line["auth.verified"] != false || line["auth.subject_hash"] != pseudonym("user-1") {
+		t.Errorf("line = %v", line)
+	}
+	if line["latency.decompose_us"] != float64(1000) || line["latency.verify_us"] != float64(3000) {
+		t.Errorf("latency fields = %v", line)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+	"google.golang.org/grpc/metadata"
+)
+
+// TestActorJWTVerified checks that only actor tokens from a trusted issuer
+// reach the handlers
+func TestActorJWTVerified(t *testing.T) {
+	iss := jwttest.RS256().With(jwttest.Claims{"iss": jwtIssuer, "aud": jwtAudience, "sub": "spiffe://hipstershop/checkoutservice"})
+	keys, err := keyring.New(context.Background(), keyring.File(testKeyFile(t, iss)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring) { jwtKeys = k }(jwtKeys)
+	jwtKeys = keys
+	other, err := jwttest.NewIssuer("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := iss.Mint(nil)
+	for _, tc := range []struct {
+		name, actor string
+		kept        bool
+	}{
+		{"trusted issuer", trusted, true},
+		{"untrusted issuer", other.With(jwttest.Claims{"iss": jwtIssuer, "aud": jwtAudience}).Mint(nil), false},
+		{"bad signature", jwttest.BadSignature(trusted), false},
+		{"expired", iss.Mint(nil, jwttest.TTL(-time.Minute)), false},
+		{"not a JWT", "made-up-actor", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := withActorJWT(context.Background(), metadata.Pairs(mdActorFull, tc.actor))
+			got, ok := ActorJWTFromContext(ctx)
+			if ok != tc.kept || (ok && got != tc.actor) {
+				t.Errorf("ActorJWTFromContext = %q, %v, want kept %v", got, ok, tc.kept)
+			}
+		})
+	}
+}
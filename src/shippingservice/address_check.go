@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+)
+
+// Address consistency
+//
+// GetQuote and ShipOrder compare the destination country with the market_id
+// claim of the user token. A mismatch is logged and counted; with
+// JWT_ENFORCE_ADDRESS_MARKET=true the call fails with FailedPrecondition.
+// Markets not listed here, and tokens without the claim, aren't checked.
+
+var enforceAddressMarket = os.Getenv("JWT_ENFORCE_ADDRESS_MARKET") == "true"
+
+// marketCountries are the lower-cased country spellings each market ships to
+var marketCountries = map[string][]string{
+	"US": {"us", "usa", "united states", "united states of america"},
+	"CA": {"ca", "canada"},
+	"GB": {"gb", "uk", "united kingdom", "great britain", "england", "scotland", "wales", "northern ireland"},
+	"DE": {"de", "germany", "deutschland"},
+	"FR": {"fr", "france"},
+	"JP": {"jp", "japan"},
+}
+
+// addressChecks counts outcomes: match, mismatch and unchecked
+var addressChecks = expvar.NewMap("shipping_address_checks")
+
+// checkAddressMarket checks addr against the caller's market
+func checkAddressMarket(ctx context.Context, method string, addr *pb.Address) error {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.MarketID == "" {
+		addressChecks.Add("unchecked", 1)
+		return nil
+	}
+	countries, ok := marketCountries[strings.ToUpper(claims.MarketID)]
+	if !ok {
+		addressChecks.Add("unchecked", 1)
+		return nil
+	}
+	country := strings.ToLower(strings.TrimSpace(addr.GetCountry()))
+	for _, c := range countries {
+		if c == country {
+			addressChecks.Add("match", 1)
+			return nil
+		}
+	}
+	addressChecks.Add("mismatch", 1)
+	loggerFromContext(ctx).Warnf("[JWT-FLOW] %s: country %q is outside market %s of %s", method, addr.GetCountry(), claims.MarketID, pseudonym(claims.Subject))
+	if enforceAddressMarket {
+		return authError(codes.FailedPrecondition, reasonJWTMarketMismatch,
+			fmt.Sprintf("country %q is outside the user's market %s", addr.GetCountry(), claims.MarketID),
+			map[string]string{"market_id": claims.MarketID, "country": addr.GetCountry()})
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// JWT_VERIFY_MODE selects how incoming user tokens are verified once
+// JWT_PUBLIC_KEY_FILE is configured:
+//
+//	sync  - verify before the handler runs (default)
+//	async - for the read-only methods in asyncVerifyMethods, run the handler
+//	        optimistically while the signature is verified in parallel; the
+//	        response is held back until verification completes and replaced
+//	        with Unauthenticated if it fails. All other methods verify sync.
+const (
+	verifyModeSync  = "sync"
+	verifyModeAsync = "async"
+)
+
+var jwtVerifyMode = os.Getenv("JWT_VERIFY_MODE")
+
+// asyncVerifyMethods are the methods safe to run before their caller is
+// verified: no side effects, so a discarded response leaves nothing behind
+var asyncVerifyMethods = map[string]bool{
+	"/hipstershop.ShippingService/GetQuote": true,
+}
+
+// asyncVerifyOutcomes counts optimistic calls by verification outcome
+var asyncVerifyOutcomes = expvar.NewMap("jwt_async_verify")
+
+// verifyUnaryServerInterceptor verifies the user JWT stored by
+// jwtUnaryServerInterceptor and must run after it
+func verifyUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if jwtKeys == nil || !requiresJWT(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	token, _ := UserJWTFromContext(ctx)
+	if jwtVerifyMode == verifyModeAsync && asyncVerifyMethods[info.FullMethod] {
+		return verifyAsync(ctx, info.FullMethod, token, req, handler)
+	}
+
+	start := time.Now()
+	claims, err := verifyWithGrace(ctx, info.FullMethod, token)
+	accessFromContext(ctx).verifiedAs(claims, err == nil, false, time.Since(start))
+	if err != nil {
+		return nil, rejectUnverified(ctx, info.FullMethod, err)
+	}
+	return handler(ctx, req)
+}
+
+// verifyAsync runs the handler while the token is verified in the background.
+// The handler stays on the calling goroutine so recovery and deadlines behave
+// as usual; a failed verification cancels its context so it can stop early,
+// and its response is dropped.
+func verifyAsync(ctx context.Context, method, token string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	verified := make(chan error, 1)
+	go func() {
+		start := time.Now()
+		claims, err := verifyWithGrace(ctx, method, token)
+		accessFromContext(ctx).verifiedAs(claims, err == nil, true, time.Since(start))
+		if err != nil {
+			cancel()
+		}
+		verified <- err
+	}()
+
+	resp, err := handler(ctx, req)
+	if verr := <-verified; verr != nil {
+		asyncVerifyOutcomes.Add("rejected", 1)
+		return nil, rejectUnverified(ctx, method, verr)
+	}
+	asyncVerifyOutcomes.Add("accepted", 1)
+	return resp, err
+}
+
+// rejectUnverified records a failed verification and builds the status returned to the caller
+func rejectUnverified(ctx context.Context, method string, err error) error {
+	loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", method, err)
+	jwtSLO.RecordFailure(sloReasonVerification)
+	return authError(codes.Unauthenticated, verifyFailureReason(ctx, err), "invalid user JWT", nil)
+}
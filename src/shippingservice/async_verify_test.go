@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testKeyFile writes the public key of iss to a PEM file for keyring.File
+func testKeyFile(t *testing.T, iss *jwttest.Issuer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(iss.RSAPublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt_public_key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAsyncVerify(t *testing.T) {
+	iss := jwttest.RS256().With(jwttest.Claims{"iss": jwtIssuer, "aud": jwtAudience, "sub": "u"})
+	keys, err := keyring.New(context.Background(), keyring.File(testKeyFile(t, iss)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, m string) { jwtKeys, jwtVerifyMode = k, m }(jwtKeys, jwtVerifyMode)
+	jwtKeys, jwtVerifyMode = keys, verifyModeAsync
+
+	token := iss.Mint(nil, jwttest.TTL(time.Minute))
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/GetQuote"}
+
+	call := func(token string, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx := context.WithValue(context.Background(), ctxKeyJWT{}, token)
+		return verifyUnaryServerInterceptor(ctx, nil, info, handler)
+	}
+
+	resp, err := call(token, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "quote", nil
+	})
+	if err != nil || resp != "quote" {
+		t.Fatalf("valid token: got %v, %v; want quote", resp, err)
+	}
+
+	cancelled := false
+	resp, err = call(jwttest.BadSignature(token), func(ctx context.Context, req interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			cancelled = true
+		case <-time.After(5 * time.Second):
+		}
+		return "quote", nil
+	})
+	if status.Code(err) != codes.Unauthenticated || resp != nil {
+		t.Errorf("bad signature: got %v, %v; want Unauthenticated and no response", resp, err)
+	}
+	if !cancelled {
+		t.Errorf("optimistic handler was not cancelled after failed verification")
+	}
+}
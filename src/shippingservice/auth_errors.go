@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Auth failure reasons
+//
+// Every status refusing a request because of its user token carries a
+// google.rpc.ErrorInfo in jwtErrorDomain whose reason says why, so callers
+// can tell an expired session from a forged token without parsing messages.
+const (
+	reasonJWTMissing          = "JWT_MISSING"
+	reasonJWTMalformed        = "JWT_MALFORMED"
+	reasonJWTExpired          = "JWT_EXPIRED"
+	reasonJWTReassemblyFailed = "JWT_REASSEMBLY_FAILED"
+	reasonJWTSigInvalid       = "JWT_SIG_INVALID"
+	reasonJWTClaimsInvalid    = "JWT_CLAIMS_INVALID"
+	reasonJWTRevoked          = "JWT_REVOKED"
+	reasonJWTHeaderConflict   = "JWT_HEADER_CONFLICT"
+	reasonJWTDuplicateHeader  = "JWT_DUPLICATE_HEADER"
+	reasonJWTBindingMismatch  = "JWT_BINDING_MISMATCH"
+	reasonJWTMarketMismatch   = "JWT_MARKET_MISMATCH"
+)
+
+// Verification failures returned by verifyUserJWT, wrapped with the details
+var (
+	errJWTMissing       = errors.New("no user JWT")
+	errJWTMalformed     = errors.New("invalid JWT format")
+	errJWTExpired       = errors.New("token is expired")
+	errJWTSigInvalid    = errors.New("invalid JWT signature")
+	errJWTClaimsInvalid = errors.New("invalid JWT claims")
+)
+
+// authError builds a status of code carrying an ErrorInfo with reason
+func authError(code codes.Code, reason, msg string, metadata map[string]string) error {
+	st := status.New(code, msg)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   jwtErrorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// ctxKeyReassemblyFailed marks a request whose JWT headers were present but
+// could not be reassembled, so a later "missing token" is reported as such
+type ctxKeyReassemblyFailed struct{}
+
+// verifyFailureReason maps a verifyUserJWT error to its ErrorInfo reason
+func verifyFailureReason(ctx context.Context, err error) string {
+	switch {
+	case errors.Is(err, errJWTMissing):
+		if failed, _ := ctx.Value(ctxKeyReassemblyFailed{}).(bool); failed {
+			return reasonJWTReassemblyFailed
+		}
+		return reasonJWTMissing
+	case errors.Is(err, errJWTExpired):
+		return reasonJWTExpired
+	case errors.Is(err, errJWTSigInvalid):
+		return reasonJWTSigInvalid
+	case errors.Is(err, errJWTClaimsInvalid):
+		return reasonJWTClaimsInvalid
+	}
+	return reasonJWTMalformed
+}
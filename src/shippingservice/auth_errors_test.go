@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func errorInfoReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == jwtErrorDomain {
+			return info.GetReason()
+		}
+	}
+	return ""
+}
+
+func TestRejectionReasons(t *testing.T) {
+	iss := jwttest.RS256().With(jwttest.Claims{"iss": jwtIssuer, "aud": jwtAudience, "sub": "u"})
+	keys, err := keyring.New(context.Background(), keyring.File(testKeyFile(t, iss)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, m string) { jwtKeys, jwtVerifyMode = k, m }(jwtKeys, jwtVerifyMode)
+	jwtKeys, jwtVerifyMode = keys, verifyModeSync
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/GetQuote"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "quote", nil }
+
+	tests := []struct {
+		name       string
+		token      string
+		reassembly bool
+		want       string
+	}{
+		{"missing", "", false, reasonJWTMissing},
+		{"reassembly failed", "", true, reasonJWTReassemblyFailed},
+		{"malformed", "not-a-jwt", false, reasonJWTMalformed},
+		{"expired", iss.Mint(nil, jwttest.TTL(-time.Minute)), false, reasonJWTExpired},
+		{"no exp", iss.Mint(jwttest.Claims{"exp": nil}), false, reasonJWTClaimsInvalid},
+		{"bad signature", jwttest.BadSignature(iss.Mint(nil)), false, reasonJWTSigInvalid},
+		{"wrong issuer", iss.Mint(jwttest.Claims{"iss": "https://evil.example"}), false, reasonJWTClaimsInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.token != "" {
+				ctx = context.WithValue(ctx, ctxKeyJWT{}, tc.token)
+			}
+			if tc.reassembly {
+				ctx = context.WithValue(ctx, ctxKeyReassemblyFailed{}, true)
+			}
+			_, err := verifyUnaryServerInterceptor(ctx, nil, info, handler)
+			if status.Code(err) != codes.Unauthenticated {
+				t.Fatalf("got %v, want Unauthenticated", err)
+			}
+			if got := errorInfoReason(err); got != tc.want {
+				t.Errorf("reason = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
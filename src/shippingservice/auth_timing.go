@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Auth timing
+//
+// A call carrying x-debug-auth-timing from a peer in AUTH_TIMING_ALLOW (a
+// list of CIDRs, off when empty) gets an x-auth-timing trailer, one
+// Server-Timing style entry per value: how long reassembling and verifying
+// its token took here. The frontend returns the entries of every hop as the
+// Server-Timing trailer of the page. Unary calls only.
+
+const (
+	authTimingHeader  = "x-debug-auth-timing"
+	authTimingTrailer = "x-auth-timing"
+	authTimingHop     = "shippingservice"
+)
+
+var authTimingAllow, authTimingAllowErr = parseAuthTimingAllow(os.Getenv("AUTH_TIMING_ALLOW"))
+
+// parseAuthTimingAllow reads a comma separated list of CIDRs
+func parseAuthTimingAllow(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_TIMING_ALLOW: %q is not a CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// authTimingRequested reports whether the caller asked for the timings of
+// this call and may see them
+func authTimingRequested(ctx context.Context) bool {
+	if len(authTimingAllow) == 0 {
+		return false
+	}
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get(authTimingHeader)) == 0 {
+		return false
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	addr, ok := p.Addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range authTimingAllow {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// authTimingEntry formats one step of one hop
+func authTimingEntry(step string, d time.Duration, method string) string {
+	return fmt.Sprintf("%s-%s;dur=%.3f;desc=%q", authTimingHop, step, float64(d.Microseconds())/1000, method[strings.LastIndex(method, "/")+1:])
+}
+
+// sendAuthTiming sets the trailer of a finished call from its access record
+func sendAuthTiming(ctx context.Context, method string, a *accessRecord) {
+	a.mu.Lock()
+	entries := []string{authTimingEntry("reassemble", a.decompose, method), authTimingEntry("verify", a.verify, method)}
+	a.mu.Unlock()
+	grpc.SetTrailer(ctx, metadata.MD{authTimingTrailer: entries})
+}
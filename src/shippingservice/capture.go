@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwtcodec"
+)
+
+// Request capture
+//
+// With JWT_CAPTURE_FILE set, a sample of inbound RPCs (JWT_CAPTURE_RATE,
+// default 0.01) is appended to that file as JSON lines of method and JWT
+// metadata, for `jwtsplit replay` to re-send against a test deployment.
+// Records are sanitized: only JWT metadata and traceparent are kept, and
+// every signature is overwritten with filler of the same length so a capture
+// can't be used as a credential. Payloads are kept verbatim, since reassembly
+// bugs depend on their exact bytes.
+
+// capturedRequest is one line of a capture file
+type capturedRequest struct {
+	Time     time.Time           `json:"time"`
+	Method   string              `json:"method"`
+	Stream   bool                `json:"stream,omitempty"`
+	Metadata map[string][]string `json:"metadata"`
+}
+
+type captureRecorder struct {
+	rate float64
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// jwtCapture is nil unless JWT_CAPTURE_FILE is set
+var jwtCapture *captureRecorder
+
+// initCapture opens JWT_CAPTURE_FILE; it needs the logger, so it runs from
+// main rather than at package initialization
+func initCapture() {
+	jwtCapture = newCaptureRecorder(os.Getenv("JWT_CAPTURE_FILE"), os.Getenv("JWT_CAPTURE_RATE"))
+}
+
+func newCaptureRecorder(path, rate string) *captureRecorder {
+	if path == "" {
+		return nil
+	}
+	r := 0.01
+	if v, err := strconv.ParseFloat(rate, 64); err == nil && v >= 0 && v <= 1 {
+		r = v
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Warnf("[JWT-FLOW] Request capture disabled: %v", err)
+		return nil
+	}
+	log.Infof("[JWT-FLOW] Capturing %.2f%% of requests to %s", r*100, path)
+	return &captureRecorder{rate: r, enc: json.NewEncoder(f)}
+}
+
+// Record writes a sanitized copy of the request's metadata when sampled
+func (c *captureRecorder) Record(ctx context.Context, method string, stream bool) {
+	if c == nil || rand.Float64() >= c.rate {
+		return
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	rec := capturedRequest{Time: time.Now().UTC(), Method: method, Stream: stream, Metadata: sanitizeCapturedMetadata(md)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(rec); err != nil {
+		log.Warnf("[JWT-FLOW] Failed to write request capture: %v", err)
+	}
+}
+
+// sanitizeCapturedMetadata keeps the JWT metadata and traceparent, with
+// signatures overwritten
+func sanitizeCapturedMetadata(md metadata.MD) map[string][]string {
+	out := make(map[string][]string)
+	for k, vals := range md {
+		if !isJWTMetadataKey(k) && k != "traceparent" {
+			continue
+		}
+		switch k {
+		case "x-jwt-payload-gz-bin", "x-jwt-cbor-bin", "x-jwt-pb-bin", "x-jwt-ref":
+			// Binary values don't survive JSON and carry an unmasked
+			// signature; references can't be resolved at replay time
+			continue
+		}
+		for _, v := range vals {
+			switch k {
+			case "x-jwt-sig", "x-jwt-actor-sig":
+				v = strings.Repeat("A", len(v))
+			case "authorization", "x-jwt-actor":
+				v = maskLastSegment(v)
+			}
+			out[k] = append(out[k], v)
+		}
+	}
+	// Tokens in a binary codec are captured as a full token instead
+	if _, ok := out["authorization"]; !ok {
+		for _, name := range []string{"gzip-split", "cbor", "protobuf"} {
+			c, _ := jwtcodec.Lookup(name)
+			if token, ok, err := c.Decode(md); ok && err == nil {
+				out["authorization"] = []string{maskLastSegment("Bearer " + token)}
+				break
+			}
+		}
+	}
+	return out
+}
+
+// maskLastSegment replaces the signature of a compact JWT
+func maskLastSegment(v string) string {
+	if i := strings.LastIndexByte(v, '.'); i >= 0 {
+		v = v[:i+1] + strings.Repeat("A", len(v)-i-1)
+	}
+	return v
+}
+
+func captureUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	jwtCapture.Record(ctx, info.FullMethod, false)
+	return handler(ctx, req)
+}
+
+func captureStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	jwtCapture.Record(ss.Context(), info.FullMethod, true)
+	return handler(srv, ss)
+}
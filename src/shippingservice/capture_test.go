@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestCaptureIsSanitized(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c := newCaptureRecorder(path, "1")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-jwt-header", "eyJhbGciOiJSUzI1NiJ9",
+		"x-jwt-payload", `{"sub":"u1"}`,
+		"x-jwt-sig", "c2lnbmF0dXJl",
+		"x-jwt-actor", "aGVhZGVy.cGF5bG9hZA.c2lnbmF0dXJl",
+		"cookie", "shop_session-id=s1",
+	))
+	c.Record(ctx, "/hipstershop.ShippingService/GetQuote", false)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec capturedRequest
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	md := rec.Metadata
+	if md["x-jwt-payload"][0] != `{"sub":"u1"}` || md["x-jwt-header"][0] != "eyJhbGciOiJSUzI1NiJ9" {
+		t.Errorf("header or payload not kept verbatim: %v", md)
+	}
+	if sig := md["x-jwt-sig"][0]; sig != strings.Repeat("A", len("c2lnbmF0dXJl")) {
+		t.Errorf("x-jwt-sig = %q, want same-length filler", sig)
+	}
+	if actor := md["x-jwt-actor"][0]; !strings.HasPrefix(actor, "aGVhZGVy.cGF5bG9hZA.AAAA") {
+		t.Errorf("x-jwt-actor signature not sanitized: %q", actor)
+	}
+	if _, ok := md["cookie"]; ok {
+		t.Error("non-JWT metadata was captured")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sealedClaimVector is sealed by the frontend with a key of 32 sevens
+const sealedClaimVector = `{"sub":"u1","email":"enc:v1:MdivyZjLoX0WTcwIMRHcGDSwS0AdCRGYkkNUNvUwq38-hL6jLrJD6A3OUg"}`
+
+// TestClaimSealing checks that claims sealed by the frontend open into the
+// signed payload, and only with the key
+func TestClaimSealing(t *testing.T) {
+	s, err := newClaimSealer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"sub":"u1","email":"a@example.com"}`
+	if got, err := s.Open(sealedClaimVector); err != nil || got != payload {
+		t.Fatalf("Open = %s, %v, want %s", got, err, payload)
+	}
+	if _, err := (*claimSealer)(nil).Open(sealedClaimVector); err == nil {
+		t.Error("opened sealed claims without a key")
+	}
+	other, _ := newClaimSealer(bytes.Repeat([]byte{8}, 32))
+	if _, err := other.Open(sealedClaimVector); err == nil {
+		t.Error("opened sealed claims with the wrong key")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+)
+
+// Claims transformers
+//
+// A ClaimsTransformer adjusts the claims of a request once its token has been
+// reassembled, before they are put in the context for the handlers, e.g. to
+// map IdP groups to internal roles. Transformers run in the order they were
+// registered; the handlers only see their result once the token verifies
+// (in async mode a failed verification drops the response). A transformer
+// returning an error fails the call with PermissionDenied. With
+// CLAIMS_GROUP_ROLES set the built-in group_roles transformer is registered
+// first.
+
+// ClaimsTransformer mutates or augments verified user claims
+type ClaimsTransformer interface {
+	Name() string
+	Transform(ctx context.Context, claims *UserClaims) error
+}
+
+var (
+	claimsTransformersMu sync.RWMutex
+	claimsTransformers   []ClaimsTransformer
+)
+
+var (
+	claimsTransformTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_claims_transform_total",
+		Help: "Claims transformer runs by transformer and outcome (ok, error).",
+	}, []string{"transformer", "outcome"})
+	claimsTransformSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jwt_claims_transform_seconds",
+		Help:    "Time spent in each claims transformer.",
+		Buckets: prometheus.ExponentialBuckets(1e-6, 4, 9),
+	}, []string{"transformer"})
+)
+
+// RegisterClaimsTransformer appends t to the transformers, normally from init
+func RegisterClaimsTransformer(t ClaimsTransformer) {
+	claimsTransformersMu.Lock()
+	defer claimsTransformersMu.Unlock()
+	claimsTransformers = append(claimsTransformers, t)
+}
+
+// errClaimsRefused is returned to callers whose claims a transformer refused
+var errClaimsRefused = authError(codes.PermissionDenied, reasonJWTClaimsInvalid, "user claims were refused", nil)
+
+// Context key for the transformed claims of the incoming user token
+type ctxKeyUserClaims struct{}
+
+// withTransformedClaims parses the claims of token, runs the transformers on
+// them and stores the result for ClaimsFromContext. Without transformers
+// the claims are left to be parsed when needed.
+func withTransformedClaims(ctx context.Context, token string) (context.Context, error) {
+	claimsTransformersMu.RLock()
+	defer claimsTransformersMu.RUnlock()
+	if len(claimsTransformers) == 0 {
+		return ctx, nil
+	}
+	c, err := claimsFromToken(token)
+	if err != nil {
+		// Left to verification to reject
+		return ctx, nil
+	}
+	for _, t := range claimsTransformers {
+		start := time.Now()
+		err := t.Transform(ctx, c)
+		claimsTransformSeconds.WithLabelValues(t.Name()).Observe(time.Since(start).Seconds())
+		if err != nil {
+			claimsTransformTotal.WithLabelValues(t.Name(), "error").Inc()
+			return ctx, fmt.Errorf("claims transformer %s: %w", t.Name(), err)
+		}
+		claimsTransformTotal.WithLabelValues(t.Name(), "ok").Inc()
+	}
+	return context.WithValue(ctx, ctxKeyUserClaims{}, c), nil
+}
+
+// groupRoles grants internal roles to members of IdP groups. It is read from
+// CLAIMS_GROUP_ROLES, comma-separated group=role pairs; a group may be listed
+// more than once.
+type groupRoles map[string][]string
+
+func parseGroupRoles(v string) (groupRoles, error) {
+	m := groupRoles{}
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("CLAIMS_GROUP_ROLES entry %q must be group=role", pair)
+		}
+		m[group] = append(m[group], role)
+	}
+	return m, nil
+}
+
+func (groupRoles) Name() string { return "group_roles" }
+
+func (m groupRoles) Transform(_ context.Context, claims *UserClaims) error {
+	for _, g := range claims.Groups {
+		for _, r := range m[g] {
+			if !slices.Contains(claims.Roles, r) {
+				claims.Roles = append(claims.Roles, r)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	if m, err := parseGroupRoles(os.Getenv("CLAIMS_GROUP_ROLES")); err == nil && len(m) > 0 {
+		RegisterClaimsTransformer(m)
+	}
+}
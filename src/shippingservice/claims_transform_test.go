@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type claimsTransformerFunc struct {
+	name string
+	fn   func(*UserClaims) error
+}
+
+func (t claimsTransformerFunc) Name() string { return t.name }
+
+func (t claimsTransformerFunc) Transform(_ context.Context, c *UserClaims) error { return t.fn(c) }
+
+// TestClaimsTransformers checks that the interceptor runs the transformers in
+// order before the handler sees the claims, and refuses the call when one fails
+func TestClaimsTransformers(t *testing.T) {
+	defer func(ts []ClaimsTransformer) { claimsTransformers = ts }(claimsTransformers)
+	claimsTransformers = nil
+
+	roles, err := parseGroupRoles("admins=admin,admins=support,ops=operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterClaimsTransformer(roles)
+	RegisterClaimsTransformer(claimsTransformerFunc{"audit", func(c *UserClaims) error {
+		c.Roles = append(c.Roles, "seen-after-"+c.Roles[0])
+		return nil
+	}})
+
+	payload := `{"sub":"u","session_id":"s1","groups":["admins","guests"]}`
+	token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/GetQuote"}
+
+	var got *UserClaims
+	_, err = jwtUnaryServerInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		got, _ = ClaimsFromContext(ctx)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"admin", "support", "seen-after-admin"}; got == nil || !reflect.DeepEqual(got.Roles, want) {
+		t.Errorf("claims = %+v, want roles %v", got, want)
+	}
+
+	RegisterClaimsTransformer(claimsTransformerFunc{"deny", func(*UserClaims) error { return errors.New("suspended") }})
+	_, err = jwtUnaryServerInterceptor(ctx, nil, info, func(context.Context, interface{}) (interface{}, error) {
+		t.Error("handler ran with refused claims")
+		return nil, nil
+	})
+	if status.Code(err) != codes.PermissionDenied || errorInfoReason(err) != reasonJWTClaimsInvalid {
+		t.Errorf("refused claims: err = %v", err)
+	}
+}
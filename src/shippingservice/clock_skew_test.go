@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkewEstimator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	e := newSkewEstimator(30*time.Second, time.Minute)
+	e.nowFunc = func() time.Time { return now }
+	if got := e.Skew(); got != 0 {
+		t.Fatalf("Skew without samples = %v, want 0", got)
+	}
+
+	// Local clock 12s behind: the freshest token looks issued 12s in the future
+	e.ObserveIssuedAt(now.Add(12 * time.Second).Unix())
+	e.ObserveIssuedAt(now.Add(10 * time.Second).Unix())
+	if got := e.Skew(); got != -12*time.Second {
+		t.Errorf("Skew = %v, want -12s from the freshest token", got)
+	}
+	// Old tokens say nothing about the clock
+	e.ObserveIssuedAt(now.Add(-time.Hour).Unix())
+	if got := e.Skew(); got != -12*time.Second {
+		t.Errorf("Skew after an old token = %v, want -12s", got)
+	}
+
+	// The Date header estimate applies, capped by the iat bound
+	e.ObserveDate(-5 * time.Second)
+	if got := e.Skew(); got != -12*time.Second {
+		t.Errorf("Skew above the iat bound = %v, want -12s", got)
+	}
+	e.ObserveDate(-20 * time.Second)
+	if got := e.Skew(); got != -20*time.Second {
+		t.Errorf("Skew from the Date header = %v, want -20s", got)
+	}
+
+	// Estimates are capped and expire with their windows
+	e.ObserveDate(-time.Hour)
+	if got := e.Skew(); got != -30*time.Second {
+		t.Errorf("Skew beyond the maximum = %v, want -30s", got)
+	}
+	now = now.Add(3 * time.Minute)
+	if got := e.Skew(); got != 0 {
+		t.Errorf("Skew after the window = %v, want 0", got)
+	}
+}
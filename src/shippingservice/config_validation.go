@@ -0,0 +1,246 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/grpcserver"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/subjecthash"
+)
+
+// configReport collects every configuration problem so they can be reported
+// together rather than one restart at a time
+type configReport struct {
+	problems []string
+}
+
+func (c *configReport) addf(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *configReport) err() error {
+	if len(c.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration (%d problems):\n  - %s",
+		len(c.problems), strings.Join(c.problems, "\n  - "))
+}
+
+// checkBool flags values other than "true"/"false", which would otherwise be
+// silently read as false
+func (c *configReport) checkBool(key string) {
+	if v := os.Getenv(key); v != "" && v != "true" && v != "false" {
+		c.addf("%s=%q must be \"true\" or \"false\"", key, v)
+	}
+}
+
+// checkFloat flags values that don't parse or fall outside [min, max]
+func (c *configReport) checkFloat(key string, min, max float64) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || f > max {
+		c.addf("%s=%q must be a number between %g and %g", key, v, min, max)
+	}
+}
+
+// checkDuration flags values that are not positive Go durations
+func (c *configReport) checkDuration(key string) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+		c.addf("%s=%q must be a positive duration such as 5m", key, v)
+	}
+}
+
+// checkFile flags paths that can't be read
+func (c *configReport) checkFile(what, path string) {
+	if _, err := os.Stat(path); err != nil {
+		c.addf("%s %s is not readable: %v", what, path, err)
+	}
+}
+
+// validateConfig checks the JWT, context claims and SLO settings for
+// consistency before the server starts
+func validateConfig() error {
+	c := &configReport{}
+
+	c.checkBool("ENABLE_JWT_COMPRESSION")
+	c.checkBool("JWT_STREAM_BOUND_CLAIMS")
+	c.checkBool("JWT_TOKEN_BINDING")
+	tlsFiles := 0
+	for _, key := range []string{"GRPC_TLS_CERT_FILE", "GRPC_TLS_KEY_FILE", "GRPC_TLS_CA_FILE"} {
+		if path := os.Getenv(key); path != "" {
+			c.checkFile(key, path)
+			tlsFiles++
+		}
+	}
+	if tlsFiles != 0 && tlsFiles != 3 {
+		c.addf("GRPC_TLS_CERT_FILE, GRPC_TLS_KEY_FILE and GRPC_TLS_CA_FILE must be set together")
+	}
+	if os.Getenv("JWT_TOKEN_BINDING") == "true" && tlsFiles == 0 {
+		c.addf("JWT_TOKEN_BINDING=true needs GRPC_TLS_*: bound tokens are checked against TLS client certificates")
+	}
+	for relay := range parseBindingRelays(os.Getenv("JWT_BINDING_RELAYS")) {
+		if !validBindingRelay(relay) {
+			c.addf("JWT_BINDING_RELAYS entry %q is not a base64url SHA-256 certificate thumbprint", relay)
+		}
+	}
+	c.checkBool("JWT_ENFORCE_ADDRESS_MARKET")
+	switch headerConflictPolicy {
+	case headerConflictStrict, headerConflictPreferSplit, headerConflictPreferAuthorization:
+	default:
+		c.addf("JWT_HEADER_CONFLICT_POLICY=%q must be strict, prefer-split or prefer-authorization", headerConflictPolicy)
+	}
+	loader, err := keyring.FromEnv("JWT_PUBLIC_KEY", "")
+	if err != nil {
+		c.addf("%v", err)
+	} else if file, ok := loader.(keyring.File); ok {
+		c.checkFile("JWT_PUBLIC_KEY_FILE", string(file))
+	}
+	keyConfigured := loader != nil || err != nil
+	if configs, err := parseIssuerConfigs(os.Getenv("JWT_ISSUERS")); err != nil {
+		c.addf("%v", err)
+	} else if len(configs) > 0 && !keyConfigured {
+		c.addf("JWT_ISSUERS is set but no JWT public key is configured")
+	} else {
+		for _, ic := range configs {
+			l, err := keyring.FromEnv(ic.Keys, "")
+			switch {
+			case err != nil:
+				c.addf("JWT_ISSUERS issuer %q: %v", ic.Issuer, err)
+			case l == nil:
+				c.addf("JWT_ISSUERS issuer %q: neither %s_SOURCE nor %s_FILE is set", ic.Issuer, ic.Keys, ic.Keys)
+			default:
+				if file, ok := l.(keyring.File); ok {
+					c.checkFile(ic.Keys+"_FILE", string(file))
+				}
+			}
+		}
+	}
+	if v := os.Getenv("JWT_KEY_REFRESH_INTERVAL"); v != "0" {
+		c.checkDuration("JWT_KEY_REFRESH_INTERVAL")
+	}
+	if v := os.Getenv("JWT_KEY_MAX_STALENESS"); v != "0" {
+		c.checkDuration("JWT_KEY_MAX_STALENESS")
+	}
+	if v := os.Getenv("JWT_CLOCK_SKEW_MAX"); v != "" && v != "0" {
+		c.checkDuration("JWT_CLOCK_SKEW_MAX")
+		if d, err := time.ParseDuration(v); err == nil && d > 5*time.Minute {
+			c.addf("JWT_CLOCK_SKEW_MAX=%s is longer than 5m; fix the node's clock instead", v)
+		}
+	}
+	c.checkDuration("JWT_CLOCK_SKEW_WINDOW")
+	if v := os.Getenv("JWT_CLOCK_SKEW_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.addf("JWT_CLOCK_SKEW_URL=%q must be an http or https URL", v)
+		}
+		if clockSkewMax == 0 {
+			c.addf("JWT_CLOCK_SKEW_URL is set but JWT_CLOCK_SKEW_MAX is not")
+		}
+	}
+	switch mode := os.Getenv("JWT_VERIFY_MODE"); mode {
+	case "", "sync", "async":
+		if mode != "" && !keyConfigured {
+			c.addf("JWT_VERIFY_MODE=%q needs a JWT public key", mode)
+		}
+	default:
+		c.addf("JWT_VERIFY_MODE=%q must be \"sync\" or \"async\"", mode)
+	}
+	if v := os.Getenv("JWT_EXPIRY_GRACE"); v != "" && v != "0" {
+		c.checkDuration("JWT_EXPIRY_GRACE")
+		if d, err := time.ParseDuration(v); err == nil && d > 5*time.Minute {
+			c.addf("JWT_EXPIRY_GRACE=%s is longer than the 5m a page load needs", v)
+		}
+	}
+	if v := os.Getenv("CTX_CLAIMS_KEY"); v != "" && len(v) < 32 {
+		c.addf("CTX_CLAIMS_KEY must be at least 32 bytes for HS256, got %d", len(v))
+	}
+
+	if _, err := subjecthash.Load(os.Getenv("SUBJECT_HASH_KEY_FILE")); err != nil {
+		c.addf("SUBJECT_HASH_KEY_FILE: %v", err)
+	}
+	if _, err := loadFieldSealer(); err != nil {
+		c.addf("JWT_FIELD_KEY_FILE: %v", err)
+	}
+	if _, err := parseGroupRoles(os.Getenv("CLAIMS_GROUP_ROLES")); err != nil {
+		c.addf("%v", err)
+	}
+	c.checkBool("JWT_VALIDATE_PAYLOAD")
+	if v, ok := os.LookupEnv("JWT_REQUIRED_CLAIMS"); ok && len(parseRequiredClaims(v)) == 0 {
+		c.addf("JWT_REQUIRED_CLAIMS is set but names no claims")
+	}
+	if v := os.Getenv("JWT_REFERENCE_RESOLVER_URL"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("JWT_REFERENCE_RESOLVER_URL=%q must be an http(s) URL", v)
+	}
+	if v := os.Getenv("GRPC_MAX_HEADER_LIST_SIZE"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil || n == 0 {
+			c.addf("GRPC_MAX_HEADER_LIST_SIZE=%q must be a positive number of bytes", v)
+		}
+	}
+	if v := os.Getenv("GRPC_HEADER_TABLE_SIZE"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil || n > grpcserver.MaxHeaderTableSize {
+			c.addf("GRPC_HEADER_TABLE_SIZE=%q must be a number of bytes up to %d, grpc-go can't decode with a larger table", v, grpcserver.MaxHeaderTableSize)
+		}
+	}
+	if v := os.Getenv("JWT_DOWNGRADE_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			c.addf("JWT_DOWNGRADE_THRESHOLD=%q must be a number of failures, 0 to turn downgrades off", v)
+		}
+	}
+	c.checkDuration("JWT_DOWNGRADE_COOLDOWN")
+	if v := os.Getenv("ACCESS_LOG_SAMPLE"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.addf("ACCESS_LOG_SAMPLE=%q must be a non-negative integer (1 in N calls)", v)
+		}
+	}
+	c.checkDuration("ACCESS_LOG_SLOW")
+	if v := os.Getenv("LOAD_SHED_MAX_INFLIGHT"); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.addf("LOAD_SHED_MAX_INFLIGHT=%q must be a non-negative number of requests, 0 to turn shedding off", v)
+		}
+	}
+	c.checkDuration("LOAD_SHED_PUSHBACK")
+	if authTimingAllowErr != nil {
+		c.addf("%v", authTimingAllowErr)
+	}
+	c.checkFloat("JWT_CAPTURE_RATE", 0, 1)
+	if os.Getenv("JWT_CAPTURE_RATE") != "" && os.Getenv("JWT_CAPTURE_FILE") == "" {
+		c.addf("JWT_CAPTURE_RATE is set but JWT_CAPTURE_FILE is not")
+	}
+	if v := os.Getenv("PYROSCOPE_SERVER_ADDRESS"); v != "" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+		c.addf("PYROSCOPE_SERVER_ADDRESS=%q must be an http(s) URL", v)
+	}
+
+	c.checkFloat("JWT_SLO_TARGET", 0, 1)
+	if v := os.Getenv("JWT_SLO_TARGET"); v == "0" || v == "1" {
+		c.addf("JWT_SLO_TARGET=%q must be strictly between 0 and 1", v)
+	}
+	c.checkDuration("JWT_SLO_WINDOW")
+	c.checkFloat("JWT_SLO_BURN_RATE", 0, 1000)
+
+	return c.err()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// x-ctx-claims carries order-level context claims added by checkout, as a
+// compact HS256 JWS signed with the mesh-shared CTX_CLAIMS_KEY. They are
+// bound to the sub and jti of the user token the order was placed under, and
+// only trusted on calls carrying that token.
+const mdCtxClaims = "x-ctx-claims"
+
+// OrderClaims are the order-level attributes added by checkout's enrichment stage
+type OrderClaims struct {
+	OrderID         string `json:"order_id"`
+	CartValueBucket string `json:"cart_value_bucket"`
+	Currency        string `json:"currency"`
+	Subject         string `json:"sub"`
+	TokenID         string `json:"jti"`
+	IssuedAt        int64  `json:"iat"`
+	ExpiresAt       int64  `json:"exp"`
+}
+
+// Context key for verified order claims
+type ctxKeyOrderClaims struct{}
+
+// ctxClaimsKey is the HMAC key; context claims are ignored when it is empty
+var ctxClaimsKey = []byte(os.Getenv("CTX_CLAIMS_KEY"))
+
+// verifyCtxClaims checks the signature and expiry of an x-ctx-claims value
+func verifyCtxClaims(value string) (*OrderClaims, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid context claims format: expected 3 parts, got %d", len(parts))
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode context claims header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return nil, errors.New("unsupported context claims algorithm")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode context claims signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, ctxClaimsKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("context claims signature mismatch")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode context claims payload: %w", err)
+	}
+	claims := &OrderClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("failed to parse context claims: %w", err)
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, errors.New("context claims expired")
+	}
+	return claims, nil
+}
+
+// withCtxClaims verifies incoming x-ctx-claims and stores them in the context;
+// unverifiable claims are dropped, never trusted
+func withCtxClaims(ctx context.Context, md metadata.MD) context.Context {
+	vals := md.Get(mdCtxClaims)
+	if len(vals) == 0 || len(ctxClaimsKey) == 0 {
+		return ctx
+	}
+	claims, err := verifyCtxClaims(vals[0])
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Ignoring context claims: %v", err)
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyOrderClaims{}, claims)
+}
+
+// OrderClaimsFromContext returns the verified order claims of the request,
+// provided they are bound to its user token
+func OrderClaimsFromContext(ctx context.Context) (*OrderClaims, bool) {
+	claims, ok := ctx.Value(ctxKeyOrderClaims{}).(*OrderClaims)
+	if !ok {
+		return nil, false
+	}
+	user, ok := ClaimsFromContext(ctx)
+	if !ok || claims.Subject == "" || claims.Subject != user.Subject || claims.TokenID != user.ID {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Ignoring context claims of order %s: not bound to this call's user token", claims.OrderID)
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+)
+
+// signTestCtxClaims signs claims the way checkout does
+func signTestCtxClaims(key []byte, claims *OrderClaims) string {
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"ctx+jwt"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TestCtxClaimsBinding checks that order claims are trusted only when
+// checkout's signature verifies and they name the call's user token
+func TestCtxClaimsBinding(t *testing.T) {
+	defer func(key []byte) { ctxClaimsKey = key }(ctxClaimsKey)
+	ctxClaimsKey = []byte("ctx-claims-key")
+	exp := time.Now().Add(time.Minute).Unix()
+	bound := &OrderClaims{OrderID: "order-1", Subject: "alice", TokenID: "jti-1", ExpiresAt: exp}
+
+	iss := jwttest.RS256()
+	alice := iss.Mint(jwttest.Claims{"sub": "alice", "jti": "jti-1"})
+	for _, tc := range []struct {
+		name, token, ctxClaims string
+		trusted                bool
+	}{
+		{"bound", alice, signTestCtxClaims(ctxClaimsKey, bound), true},
+		{"other token of the subject", iss.Mint(jwttest.Claims{"sub": "alice", "jti": "jti-2"}), signTestCtxClaims(ctxClaimsKey, bound), false},
+		{"other subject", iss.Mint(jwttest.Claims{"sub": "mallory", "jti": "jti-1"}), signTestCtxClaims(ctxClaimsKey, bound), false},
+		{"unbound", alice, signTestCtxClaims(ctxClaimsKey, &OrderClaims{OrderID: "order-1", ExpiresAt: exp}), false},
+		{"no user token", "", signTestCtxClaims(ctxClaimsKey, bound), false},
+		{"other key", alice, signTestCtxClaims([]byte("forged"), bound), false},
+		{"expired", alice, signTestCtxClaims(ctxClaimsKey, &OrderClaims{OrderID: "order-1", Subject: "alice", TokenID: "jti-1", ExpiresAt: exp - 120}), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := withCtxClaims(context.Background(), metadata.Pairs(mdCtxClaims, tc.ctxClaims))
+			if tc.token != "" {
+				ctx = context.WithValue(ctx, ctxKeyJWT{}, tc.token)
+			}
+			claims, ok := OrderClaimsFromContext(ctx)
+			if ok != tc.trusted {
+				t.Fatalf("trusted = %v, want %v", ok, tc.trusted)
+			}
+			if ok && claims.OrderID != "order-1" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwtcodec"
+)
+
+// Duplicate JWT headers
+//
+// Proxies can repeat metadata values. Before anything reads the token,
+// jwtcodec.CheckDuplicates accepts identical repeats of authorization and
+// the x-jwt-* keys and refuses a request whose repeats differ, with
+// JWT_DUPLICATE_HEADER: picking the first value would let a proxy, or a
+// forger behind one, choose the token shipping acts on.
+
+var duplicateHeadersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jwt_duplicate_header_values_total",
+	Help: "Requests carrying a JWT metadata key more than once, by key and whether the values conflicted.",
+}, []string{"key", "outcome"})
+
+// duplicateHeaderKeys are the JWT keys senders use; any other key matching
+// the policy is counted as "other" so callers can't grow the metric
+var duplicateHeaderKeys = map[string]bool{
+	"authorization": true, "x-jwt-header": true, "x-jwt-payload": true, "x-jwt-sig": true,
+	"x-jwt-claims": true, "x-jwt-static": true, "x-jwt-static-sha": true, "x-jwt-session": true,
+	"x-jwt-dynamic": true, "x-jwt-ref": true, "x-jwt-codecs": true, "x-jwt-payload-gz-bin": true,
+	"x-jwt-cbor-bin": true, "x-jwt-pb-bin": true, "x-jwt-actor": true, "x-jwt-actor-header": true,
+	"x-jwt-actor-payload": true, "x-jwt-actor-sig": true,
+}
+
+// duplicateHeaderLabel is the key label of duplicateHeadersTotal for key
+func duplicateHeaderLabel(key string) string {
+	if duplicateHeaderKeys[key] {
+		return key
+	}
+	return "other"
+}
+
+// checkDuplicateHeaders refuses md when a JWT key has conflicting values
+func checkDuplicateHeaders(ctx context.Context, method string, md metadata.MD) error {
+	err := jwtcodec.CheckDuplicates(md, func(key string, _ int, conflicting bool) {
+		outcome := "identical"
+		if conflicting {
+			outcome = "conflicting"
+		}
+		duplicateHeadersTotal.WithLabelValues(duplicateHeaderLabel(key), outcome).Inc()
+	})
+	var dup *jwtcodec.DuplicateError
+	if !errors.As(err, &dup) {
+		return nil
+	}
+	loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", method, err)
+	jwtSLO.RecordFailure(sloReasonVerification)
+	return authError(codes.Unauthenticated, reasonJWTDuplicateHeader, "conflicting values for "+dup.Key,
+		map[string]string{"key": dup.Key, "values": strconv.Itoa(dup.Values)})
+}
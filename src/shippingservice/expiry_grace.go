@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Expired-token grace
+//
+// A page load fans out into several calls carrying the token the frontend
+// checked when the page was requested, and a token expiring mid-load fails
+// every call after the boundary. With JWT_EXPIRY_GRACE set (off by default)
+// the read-only methods of asyncVerifyMethods accept a token that expired
+// less than that long ago and otherwise verifies. The response then carries
+// a google.rpc.ErrorInfo, reason JWT_REFRESH_REQUIRED, in the
+// x-jwt-refresh-bin trailer, and the frontend renews the session's token on
+// its next request. Methods with side effects still refuse the token.
+
+const (
+	refreshTrailer           = "x-jwt-refresh-bin"
+	reasonJWTRefreshRequired = "JWT_REFRESH_REQUIRED"
+)
+
+var jwtExpiryGrace = expiryGrace()
+
+// expiryGraceAccepted counts expired tokens accepted within the grace window
+var expiryGraceAccepted = expvar.NewInt("jwt_expiry_grace_accepted")
+
+// expiryGrace reads JWT_EXPIRY_GRACE
+func expiryGrace() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("JWT_EXPIRY_GRACE"))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// verifyWithGrace is verifyUserJWT, except that a read-only method accepts a
+// token expired within the grace window and asks the caller to renew it
+func verifyWithGrace(ctx context.Context, method, token string) (*UserClaims, error) {
+	claims, err := verifyUserJWT(token)
+	if !errors.Is(err, errJWTExpired) || jwtExpiryGrace <= 0 || !asyncVerifyMethods[method] {
+		return claims, err
+	}
+	claims, gerr := verifyUserJWTWithin(token, jwtExpiryGrace)
+	if gerr != nil {
+		return nil, err
+	}
+	expiryGraceAccepted.Add(1)
+	loggerFromContext(ctx).Infof("[JWT-FLOW] accepting %s with a token expired %v ago", method, time.Since(time.Unix(claims.ExpiresAt, 0)).Round(time.Second))
+	requestRefresh(ctx, claims.ExpiresAt)
+	return claims, nil
+}
+
+// requestRefresh sets the trailer asking the caller for a fresh token
+func requestRefresh(ctx context.Context, exp int64) {
+	b, err := proto.Marshal(&errdetails.ErrorInfo{
+		Reason:   reasonJWTRefreshRequired,
+		Domain:   jwtErrorDomain,
+		Metadata: map[string]string{"expired_at": strconv.FormatInt(exp, 10)},
+	})
+	if err != nil {
+		return
+	}
+	grpc.SetTrailer(ctx, metadata.Pairs(refreshTrailer, string(b)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+)
+
+// trailerStream records the trailers set by a server handler
+type trailerStream struct {
+	grpc.ServerTransportStream
+	trailer metadata.MD
+}
+
+func (s *trailerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+func TestExpiryGrace(t *testing.T) {
+	iss := jwttest.RS256().With(jwttest.Claims{"iss": jwtIssuer, "aud": jwtAudience})
+	keys, err := keyring.New(context.Background(), keyring.File(testKeyFile(t, iss)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, m string, g time.Duration) { jwtKeys, jwtVerifyMode, jwtExpiryGrace = k, m, g }(jwtKeys, jwtVerifyMode, jwtExpiryGrace)
+	jwtKeys, jwtVerifyMode, jwtExpiryGrace = keys, verifyModeSync, 30*time.Second
+
+	call := func(method, token string) (metadata.MD, error) {
+		stream := &trailerStream{}
+		ctx := grpc.NewContextWithServerTransportStream(context.Background(), stream)
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, token)
+		_, err := verifyUnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return "ok", nil
+		})
+		return stream.trailer, err
+	}
+	const getQuote, shipOrder = "/hipstershop.ShippingService/GetQuote", "/hipstershop.ShippingService/ShipOrder"
+
+	justExpired := iss.Mint(nil, jwttest.Skew(-time.Hour-10*time.Second))
+	trailer, err := call(getQuote, justExpired)
+	if err != nil {
+		t.Fatalf("GetQuote with a token expired 10s ago: %v", err)
+	}
+	info := &errdetails.ErrorInfo{}
+	if v := trailer.Get(refreshTrailer); len(v) != 1 || proto.Unmarshal([]byte(v[0]), info) != nil || info.Reason != reasonJWTRefreshRequired {
+		t.Errorf("trailer %v, want a %s ErrorInfo", trailer, reasonJWTRefreshRequired)
+	}
+
+	if _, err := call(shipOrder, justExpired); err == nil {
+		t.Error("ShipOrder accepted an expired token")
+	}
+	if _, err := call(getQuote, iss.Mint(nil, jwttest.Skew(-time.Hour-time.Minute))); err == nil {
+		t.Error("GetQuote accepted a token expired past the grace window")
+	}
+	if _, err := call(getQuote, jwttest.BadSignature(justExpired)); err == nil {
+		t.Error("GetQuote accepted an expired token with a bad signature")
+	}
+	if trailer, err := call(getQuote, iss.Mint(nil)); err != nil || len(trailer.Get(refreshTrailer)) != 0 {
+		t.Errorf("valid token: trailer %v, %v; want no renewal request", trailer, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// Conflicting JWT headers
+//
+// Dual-writing senders put the same token in the split headers and in
+// authorization. When the two carry different tokens the request is either
+// forged or badly proxied, and JWT_HEADER_CONFLICT_POLICY decides:
+//
+//	strict                reject with Unauthenticated (default)
+//	prefer-split          use the split token and ignore authorization
+//	prefer-authorization  use authorization and ignore the split token
+//
+// Tokens are compared by header, signature and decoded claims, so a payload
+// sent as claim blocks matches its compact form.
+
+const (
+	headerConflictStrict              = "strict"
+	headerConflictPreferSplit         = "prefer-split"
+	headerConflictPreferAuthorization = "prefer-authorization"
+)
+
+var headerConflictPolicy = envOrDefault("JWT_HEADER_CONFLICT_POLICY", headerConflictStrict)
+
+var headerConflictTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jwt_header_conflicts_total",
+	Help: "Requests whose authorization header and split JWT headers carried different tokens.",
+}, []string{"policy"})
+
+var errHeaderConflict = authError(codes.Unauthenticated, reasonJWTHeaderConflict, "conflicting authorization and x-jwt-* headers", nil)
+
+// resolveHeaderConflict compares the split token of md, whose raw JSON
+// payload is payload, with its authorization header. useAuthorization is
+// true when the policy picks the authorization header over a differing split
+// token; err is errHeaderConflict when the request has to be refused.
+func resolveHeaderConflict(md metadata.MD, payload string) (useAuthorization bool, err error) {
+	auth := md.Get("authorization")
+	if len(auth) == 0 {
+		return false, nil
+	}
+	var header, sig string
+	if v := md.Get("x-jwt-header"); len(v) > 0 {
+		header = v[0]
+	}
+	if v := md.Get("x-jwt-sig"); len(v) > 0 {
+		sig = v[0]
+	}
+	if sameToken(strings.TrimPrefix(auth[0], "Bearer "), header, payload, sig) {
+		return false, nil
+	}
+	headerConflictTotal.WithLabelValues(headerConflictPolicy).Inc()
+	switch headerConflictPolicy {
+	case headerConflictPreferSplit:
+		return false, nil
+	case headerConflictPreferAuthorization:
+		return true, nil
+	}
+	return false, errHeaderConflict
+}
+
+// sameToken reports whether token is the compact form of the split token
+func sameToken(token, header, payload, sig string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header || parts[2] != sig {
+		return false
+	}
+	if base64.RawURLEncoding.EncodeToString([]byte(payload)) == parts[1] {
+		return true
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var a, b map[string]interface{}
+	if json.Unmarshal(decoded, &a) != nil || json.Unmarshal([]byte(payload), &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
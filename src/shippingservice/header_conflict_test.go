@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestResolveHeaderConflict(t *testing.T) {
+	defer func(p string) { headerConflictPolicy = p }(headerConflictPolicy)
+
+	payload := `{"sub":"alice","exp":1}`
+	token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+	other := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":1}`)) + ".b3RoZXI"
+	split := func(auth string) metadata.MD {
+		md := metadata.Pairs("x-jwt-header", "eyJhbGciOiJSUzI1NiJ9", "x-jwt-sig", "c2ln")
+		if auth != "" {
+			md.Set("authorization", "Bearer "+auth)
+		}
+		return md
+	}
+
+	for _, tc := range []struct {
+		name, policy, auth, payload string
+		wantAuth, wantErr           bool
+	}{
+		{"split only", headerConflictStrict, "", payload, false, false},
+		{"dual-write", headerConflictStrict, token, payload, false, false},
+		{"dual-write from claim blocks", headerConflictStrict, token, `{"exp":1,"sub":"alice"}`, false, false},
+		{"strict", headerConflictStrict, other, payload, false, true},
+		{"prefer-split", headerConflictPreferSplit, other, payload, false, false},
+		{"prefer-authorization", headerConflictPreferAuthorization, other, payload, true, false},
+	} {
+		headerConflictPolicy = tc.policy
+		useAuth, err := resolveHeaderConflict(split(tc.auth), tc.payload)
+		if useAuth != tc.wantAuth || (err != nil) != tc.wantErr {
+			t.Errorf("%s: got (%v, %v), want useAuthorization=%v error=%v", tc.name, useAuth, err, tc.wantAuth, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckDuplicateHeaders(t *testing.T) {
+	ctx := context.Background()
+	md := metadata.Pairs("x-jwt-sig", "c2ln", "x-jwt-sig", "c2ln")
+	if err := checkDuplicateHeaders(ctx, "/m", md); err != nil {
+		t.Errorf("identical duplicates refused: %v", err)
+	}
+	md.Append("x-jwt-sig", "b3RoZXI")
+	err := checkDuplicateHeaders(ctx, "/m", md)
+	if status.Code(err) != codes.Unauthenticated || errorInfoReason(err) != reasonJWTDuplicateHeader {
+		t.Errorf("conflicting duplicates: got %v, want %s", err, reasonJWTDuplicateHeader)
+	}
+}
+
+func TestDuplicateHeaderLabel(t *testing.T) {
+	for key, want := range map[string]string{
+		"authorization":   "authorization",
+		"x-jwt-sig":       "x-jwt-sig",
+		"x-jwt-whatever1": "other",
+	} {
+		if got := duplicateHeaderLabel(key); got != want {
+			t.Errorf("duplicateHeaderLabel(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+)
+
+// Token issuers
+//
+// JWT_ISSUERS trusts issuers besides the frontend's own (JWT_ISSUER,
+// JWT_AUDIENCE, JWT_PUBLIC_KEY), e.g. a partner IdP whose tokens reach this
+// service through the same pipeline. It is a JSON list, shared with the
+// frontend which reads the classifier of each entry:
+//
+//	[{"iss":"https://partner.example/","aud":"urn:partner:api","keys":"PARTNER_JWT_PUBLIC_KEY","classifier":"auth0"}]
+//
+// keys is an env prefix read like JWT_PUBLIC_KEY, e.g.
+// PARTNER_JWT_PUBLIC_KEY_SOURCE=jwks and PARTNER_JWT_PUBLIC_KEY_JWKS_URL; aud
+// defaults to JWT_AUDIENCE. A token is verified with the keys of the issuer
+// its iss claim names, so no issuer's key can vouch for another issuer's
+// tokens. Tokens naming an unknown issuer are checked against the frontend's
+// keys and rejected for their issuer, as before.
+
+// issuerConfig is one entry of JWT_ISSUERS
+type issuerConfig struct {
+	Issuer     string `json:"iss"`
+	Audience   string `json:"aud,omitempty"`
+	Keys       string `json:"keys"`
+	Classifier string `json:"classifier,omitempty"`
+}
+
+// trustedIssuer is an issuer whose tokens are accepted and the keys they
+// are verified with
+type trustedIssuer struct {
+	issuer   string
+	audience string
+	keys     *keyring.Keyring
+}
+
+// extraIssuers holds the JWT_ISSUERS entries by iss; set once at startup
+var extraIssuers map[string]*trustedIssuer
+
+// jwtIssuerVerifications counts verified tokens by issuer
+var jwtIssuerVerifications = expvar.NewMap("jwt_issuer_verifications")
+
+// parseIssuerConfigs reads a JWT_ISSUERS list
+func parseIssuerConfigs(v string) ([]issuerConfig, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var configs []issuerConfig
+	if err := json.Unmarshal([]byte(v), &configs); err != nil {
+		return nil, fmt.Errorf("JWT_ISSUERS must be a JSON list of issuers: %v", err)
+	}
+	seen := map[string]bool{jwtIssuer: true}
+	for _, c := range configs {
+		switch {
+		case c.Issuer == "":
+			return nil, errors.New("JWT_ISSUERS: every issuer needs an iss")
+		case seen[c.Issuer]:
+			return nil, fmt.Errorf("JWT_ISSUERS: issuer %q is listed twice or is JWT_ISSUER", c.Issuer)
+		case c.Keys == "":
+			return nil, fmt.Errorf("JWT_ISSUERS: issuer %q needs keys, the env prefix of its key source", c.Issuer)
+		}
+		seen[c.Issuer] = true
+	}
+	return configs, nil
+}
+
+// loadJWTIssuers builds a keyring for every JWT_ISSUERS entry, refreshed
+// like the frontend's key
+func loadJWTIssuers(ctx context.Context) error {
+	configs, err := parseIssuerConfigs(os.Getenv("JWT_ISSUERS"))
+	if err != nil {
+		return err
+	}
+	issuers := make(map[string]*trustedIssuer, len(configs))
+	for _, c := range configs {
+		loader, err := keyring.FromEnv(c.Keys, "")
+		if err != nil {
+			return fmt.Errorf("issuer %q: %w", c.Issuer, err)
+		}
+		if loader == nil {
+			return fmt.Errorf("issuer %q: neither %s_SOURCE nor %s_FILE is set", c.Issuer, c.Keys, c.Keys)
+		}
+		keys, err := keyring.New(ctx, loader)
+		if err != nil {
+			return fmt.Errorf("issuer %q: %w", c.Issuer, err)
+		}
+		iss := c.Issuer
+		keys.OnRotate(func(k *keyring.Keyring) {
+			log.Infof("[JWT-FLOW] Keys of issuer %s rotated from %s", iss, k.Source())
+		})
+		if interval := keyRefreshInterval(); interval > 0 {
+			go keys.Watch(ctx, interval, func(err error) {
+				log.Warnf("[JWT-FLOW] Failed to refresh keys of issuer %s: %v", iss, err)
+				keysDegraded(keys)
+			})
+		}
+		aud := c.Audience
+		if aud == "" {
+			aud = jwtAudience
+		}
+		issuers[iss] = &trustedIssuer{issuer: iss, audience: aud, keys: keys}
+		log.Infof("[JWT-FLOW] Trusting issuer %s with keys from %s", iss, keys.Source())
+	}
+	extraIssuers = issuers
+	return nil
+}
+
+// issuerFor picks the issuer a token is verified against by its unverified
+// iss claim
+func issuerFor(token string) *trustedIssuer {
+	if len(extraIssuers) > 0 {
+		if t, ok := extraIssuers[tokenIssuer(token)]; ok {
+			return t
+		}
+	}
+	return &trustedIssuer{issuer: jwtIssuer, audience: jwtAudience, keys: jwtKeys}
+}
+
+// tokenIssuer reads the iss claim of a token without verifying it
+func tokenIssuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
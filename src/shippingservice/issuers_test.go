@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+)
+
+func TestVerifyRoutesByIssuer(t *testing.T) {
+	internal := jwttest.RS256().With(jwttest.Claims{"sub": "u"})
+	partner, err := jwttest.NewIssuer("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partner = partner.With(jwttest.Claims{"sub": "u"})
+	keys, err := keyring.New(context.Background(), keyring.File(testKeyFile(t, internal)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, e map[string]*trustedIssuer) { jwtKeys, extraIssuers = k, e }(jwtKeys, extraIssuers)
+	jwtKeys = keys
+
+	t.Setenv("PARTNER_KEY_FILE", testKeyFile(t, partner))
+	t.Setenv("JWT_ISSUERS", `[{"iss":"https://partner.example/","aud":"urn:partner:api","keys":"PARTNER_KEY"}]`)
+	t.Setenv("JWT_KEY_REFRESH_INTERVAL", "0")
+	if err := loadJWTIssuers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(iss, aud string) jwttest.Claims {
+		return jwttest.Claims{"iss": iss, "aud": aud}
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"internal", internal.Mint(claims(jwtIssuer, jwtAudience)), nil},
+		{"partner", partner.Mint(claims("https://partner.example/", "urn:partner:api")), nil},
+		{"partner signed by internal key", internal.Mint(claims("https://partner.example/", "urn:partner:api")), errJWTSigInvalid},
+		{"internal signed by partner key", partner.Mint(claims(jwtIssuer, jwtAudience)), errJWTSigInvalid},
+		{"partner with internal audience", partner.Mint(claims("https://partner.example/", jwtAudience)), errJWTClaimsInvalid},
+		{"unknown issuer", internal.Mint(claims("https://other.example/", jwtAudience)), errJWTClaimsInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyUserJWT(tt.token)
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("verifyUserJWT() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("JWT_ISSUERS", `[{"iss":"`+jwtIssuer+`","keys":"PARTNER_KEY"}]`)
+	if _, err := parseIssuerConfigs(os.Getenv("JWT_ISSUERS")); err == nil {
+		t.Error("parseIssuerConfigs accepted JWT_ISSUER as an extra issuer")
+	}
+}
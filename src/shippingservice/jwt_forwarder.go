@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
@@ -11,79 +12,230 @@ import (
 // jwtUnaryServerInterceptor extracts and reassembles JWT from incoming metadata
 func jwtUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
+	grpc.SetHeader(ctx, codecAdvertisement())
+	ctx = withRequestLogger(ctx, info.FullMethod, md)
+	ctx = withActorJWT(ctx, md)
+	ctx = withCtxClaims(ctx, md)
 	if !ok {
 		// No metadata, continue without JWT
+		recordIncomingJWT(ctx, info.FullMethod, false)
 		return handler(ctx, req)
 	}
+	if err := checkDuplicateHeaders(ctx, info.FullMethod, md); err != nil {
+		return nil, err
+	}
 
-	var jwtToken string
+	start := time.Now()
+	jwtToken, split, err := splitJWTFromMetadata(ctx, md)
+	accessFromContext(ctx).reassembled(time.Since(start))
+	if isStaticBlockUnknown(err) {
+		// Not a failure: the sender resends the full block
+		return nil, err
+	}
+	if err == errHeaderConflict {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, err)
+		jwtSLO.RecordFailure(sloReasonVerification)
+		return nil, err
+	}
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to reassemble JWT: %v", err)
+		jwtSLO.RecordFailure(sloReasonReassembly)
+		if derr := reassemblyFailed(ctx); derr != nil {
+			return nil, derr
+		}
+		return handler(context.WithValue(ctx, ctxKeyReassemblyFailed{}, true), req)
+	}
 
-	// Check for compressed JWT format (x-jwt-payload header)
-	if payloadHeaders := md.Get("x-jwt-payload"); len(payloadHeaders) > 0 {
-		// Compressed format: raw JSON payload + signature
-		var signature string
-		
+	// JWT available for validation/claims extraction if needed
+	ctx = withWireFormat(ctx, wireFormatFromMetadata(md, split))
+	recordIncomingJWT(ctx, info.FullMethod, jwtToken != "")
+	if err := checkRevocation(ctx, jwtToken); err != nil {
+		return nil, err
+	}
+	if err := checkTokenBinding(ctx, jwtToken); err != nil {
+		return nil, err
+	}
+	if err := checkJWTPayload(ctx, jwtToken); err != nil {
+		return nil, err
+	}
+	if jwtToken != "" {
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
+		if ctx, err = withTransformedClaims(ctx, jwtToken); err != nil {
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, err)
+			return nil, errClaimsRefused
+		}
+	}
+
+	return handler(ctx, req)
+}
+
+// jwtFromMetadata returns the JWT carried by incoming metadata in either format,
+// reassembling it from x-jwt-header/x-jwt-sig and the split payload when split
+func jwtFromMetadata(md metadata.MD) (string, error) {
+	token, _, err := splitJWTFromMetadata(context.Background(), md)
+	return token, err
+}
+
+// splitJWTFromMetadata is jwtFromMetadata, also reporting whether the token
+// was reassembled from the split headers; a codec's I/O is bound to ctx
+func splitJWTFromMetadata(ctx context.Context, md metadata.MD) (string, bool, error) {
+	start := time.Now()
+	payload, split, err := splitPayloadFromMetadata(md)
+	if err != nil {
+		return "", false, err
+	}
+	useAuthorization := false
+	if split {
+		if useAuthorization, err = resolveHeaderConflict(md, payload); err != nil {
+			return "", false, err
+		}
+	}
+	if split && !useAuthorization {
+		defer observeReassembly(md, start)
+		// Compressed format: original header + raw JSON payload + signature
+		var header, signature string
+
+		if headerHeaders := md.Get("x-jwt-header"); len(headerHeaders) > 0 {
+			header = headerHeaders[0]
+		}
 		if sigHeaders := md.Get("x-jwt-sig"); len(sigHeaders) > 0 {
 			signature = sigHeaders[0]
 		}
-		
-		components := &JWTComponents{
-			Payload:   payloadHeaders[0],
-			Signature: signature,
-		}
 
 		// Reassemble JWT from components (1 base64 encode operation)
-		reassembled, err := ReassembleJWT(components)
-		if err != nil {
-			log.Warnf("Failed to reassemble JWT: %v", err)
-			return handler(ctx, req)
-		}
-		jwtToken = reassembled
+		token, err := ReassembleJWT(&JWTComponents{
+			Header:    header,
+			Payload:   payload,
+			Signature: signature,
+		})
+		return token, true, err
+	}
 
-	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
+	if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
 		// Standard format: "Bearer <token>"
-		jwtToken = strings.TrimPrefix(authHeaders[0], "Bearer ")
+		return strings.TrimPrefix(authHeaders[0], "Bearer "), false, nil
 	}
+	token, err := codecJWTFromMetadata(ctx, md, start)
+	return token, false, err
+}
 
-	// JWT available for validation/claims extraction if needed
-	_ = jwtToken
+// splitPayloadFromMetadata returns the raw JSON payload of a split JWT, sent
+// either whole in x-jwt-payload or as claim blocks listed by x-jwt-claims,
+// with its sealed claims opened
+func splitPayloadFromMetadata(md metadata.MD) (payload string, split bool, err error) {
+	if payloadHeaders := md.Get("x-jwt-payload"); len(payloadHeaders) > 0 {
+		payload, err = fieldSealer.Open(payloadHeaders[0])
+		return payload, true, err
+	}
+	order := md.Get("x-jwt-claims")
+	if len(order) == 0 {
+		return "", false, nil
+	}
+	block := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	static, err := staticBlockFromMetadata(md)
+	if err != nil {
+		return "", true, err
+	}
+	payload, err = mergeClaimBlocks(order[0], static, block("x-jwt-session"), block("x-jwt-dynamic"))
+	if err == nil {
+		payload, err = fieldSealer.Open(payload)
+	}
+	return payload, true, err
+}
 
-	return handler(ctx, req)
-}// jwtStreamServerInterceptor extracts JWT from incoming stream metadata
+// requiresJWT reports whether an incoming method must carry a JWT;
+// only infrastructure services (health, channelz, reflection) are exempt
+func requiresJWT(method string) bool {
+	return strings.HasPrefix(method, "/hipstershop.")
+}
+
+// recordIncomingJWT feeds the outcome of JWT extraction into the SLO tracker
+func recordIncomingJWT(ctx context.Context, method string, found bool) {
+	if !requiresJWT(method) {
+		return
+	}
+	if found {
+		jwtSLO.RecordSuccess()
+		loggerFromContext(ctx).Debugf("[JWT-FLOW] received JWT for %s", method)
+	} else {
+		jwtSLO.RecordFailure(sloReasonMissingJWT)
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] no JWT received for %s", method)
+	}
+}
+
+// jwtStreamServerInterceptor extracts JWT from incoming stream metadata
 func jwtStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 	ctx := ss.Context()
 	md, ok := metadata.FromIncomingContext(ctx)
+	ss.SetHeader(codecAdvertisement())
+	ctx = withRequestLogger(ctx, info.FullMethod, md)
+	ctx = withActorJWT(ctx, md)
+	ctx = withCtxClaims(ctx, md)
 	if !ok {
-		return handler(srv, ss)
+		recordIncomingJWT(ctx, info.FullMethod, false)
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+	if err := checkDuplicateHeaders(ctx, info.FullMethod, md); err != nil {
+		return err
 	}
 
-	var jwtToken string
-
-	// Check for compressed JWT format (x-jwt-payload header)
-	if payloadHeaders := md.Get("x-jwt-payload"); len(payloadHeaders) > 0 {
-		var signature string
-		
-		if sigHeaders := md.Get("x-jwt-sig"); len(sigHeaders) > 0 {
-			signature = sigHeaders[0]
-		}
-		
-		components := &JWTComponents{
-			Payload:   payloadHeaders[0],
-			Signature: signature,
+	start := time.Now()
+	jwtToken, split, err := splitJWTFromMetadata(ctx, md)
+	accessFromContext(ctx).reassembled(time.Since(start))
+	if isStaticBlockUnknown(err) {
+		// Not a failure: the sender resends the full block
+		return err
+	}
+	if err == errHeaderConflict {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, err)
+		jwtSLO.RecordFailure(sloReasonVerification)
+		return err
+	}
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Failed to reassemble JWT in stream: %v", err)
+		jwtSLO.RecordFailure(sloReasonReassembly)
+		if derr := reassemblyFailed(ctx); derr != nil {
+			return derr
 		}
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
 
-		reassembled, err := ReassembleJWT(components)
-		if err != nil {
-			log.Warnf("Failed to reassemble JWT in stream: %v", err)
-			return handler(srv, ss)
+	// JWT available for validation/claims extraction if needed
+	ctx = withWireFormat(ctx, wireFormatFromMetadata(md, split))
+	recordIncomingJWT(ctx, info.FullMethod, jwtToken != "")
+	if err := checkRevocation(ctx, jwtToken); err != nil {
+		return err
+	}
+	if err := checkTokenBinding(ctx, jwtToken); err != nil {
+		return err
+	}
+	if err := checkJWTPayload(ctx, jwtToken); err != nil {
+		return err
+	}
+	if jwtToken != "" {
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
+		if ctx, err = withTransformedClaims(ctx, jwtToken); err != nil {
+			loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting %s: %v", info.FullMethod, err)
+			return errClaimsRefused
 		}
-		jwtToken = reassembled
-	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
-		jwtToken = strings.TrimPrefix(authHeaders[0], "Bearer ")
 	}
 
-	// JWT available for validation/claims extraction if needed
-	_ = jwtToken
+	// The token arrives once with the stream headers; bind it to the stream
+	ctx, ss = bindStreamClaims(ctx, ss, jwtToken)
+	return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// wrappedServerStream wraps a grpc.ServerStream with a custom context
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
 
-	return handler(srv, ss)
+func (w *wrappedServerStream) Context() context.Context {
+	return w.ctx
 }
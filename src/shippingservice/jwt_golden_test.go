@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// goldenJWTFile is shared by the frontend, checkout and shipping tests so the
+// service copies of the JWT codec cannot drift apart unnoticed.
+const goldenJWTFile = "../../test-suite/golden/jwt_golden.json"
+
+type goldenJWT struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	Header    string `json:"header"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func loadGoldenJWTs(t *testing.T) []goldenJWT {
+	t.Helper()
+	data, err := os.ReadFile(goldenJWTFile)
+	if err != nil {
+		t.Fatalf("failed to read golden JWTs: %v", err)
+	}
+	var golden []goldenJWT
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatalf("failed to parse golden JWTs: %v", err)
+	}
+	return golden
+}
+
+// TestGoldenDecompose checks this service's DecomposeJWT against the golden components.
+func TestGoldenDecompose(t *testing.T) {
+	for _, g := range loadGoldenJWTs(t) {
+		c, err := DecomposeJWT(g.Token)
+		if err != nil {
+			t.Errorf("%s: DecomposeJWT failed: %v", g.Name, err)
+			continue
+		}
+		if c.Header != g.Header || c.Payload != g.Payload || c.Signature != g.Signature {
+			t.Errorf("%s: DecomposeJWT = %+v, want header=%q payload=%q signature=%q", g.Name, c, g.Header, g.Payload, g.Signature)
+		}
+	}
+}
+
+// TestGoldenReassembleFromMetadata checks that the server path rebuilds the
+// exact token from frontend-decomposed metadata in both wire formats.
+func TestGoldenReassembleFromMetadata(t *testing.T) {
+	for _, g := range loadGoldenJWTs(t) {
+		split := metadata.Pairs(
+			"x-jwt-header", g.Header,
+			"x-jwt-payload", g.Payload,
+			"x-jwt-sig", g.Signature,
+		)
+		got, err := jwtFromMetadata(split)
+		if err != nil {
+			t.Errorf("%s: jwtFromMetadata(split) failed: %v", g.Name, err)
+		} else if got != g.Token {
+			t.Errorf("%s: jwtFromMetadata(split) = %q, want %q", g.Name, got, g.Token)
+		}
+
+		full := metadata.Pairs("authorization", "Bearer "+g.Token)
+		got, err = jwtFromMetadata(full)
+		if err != nil {
+			t.Errorf("%s: jwtFromMetadata(authorization) failed: %v", g.Name, err)
+		} else if got != g.Token {
+			t.Errorf("%s: jwtFromMetadata(authorization) = %q, want %q", g.Name, got, g.Token)
+		}
+	}
+}
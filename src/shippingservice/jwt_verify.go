@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+)
+
+// Expected issuer and audience of user tokens minted by the frontend;
+// JWT_ISSUER and JWT_AUDIENCE override them when the frontend forwards tokens
+// from an external IdP instead
+var (
+	jwtIssuer   = envOrDefault("JWT_ISSUER", "https://auth.hipstershop.com")
+	jwtAudience = envOrDefault("JWT_AUDIENCE", "urn:hipstershop:api")
+)
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// jwtKeys verifies user tokens; nil when no JWT_PUBLIC_KEY source is
+// configured, in which case requests are not verified
+var jwtKeys *keyring.Keyring
+
+// UserClaims is the subset of the frontend JWT claims shipping relies on
+type UserClaims struct {
+	SessionID string      `json:"session_id"`
+	Name      string      `json:"name"`
+	Email     string      `json:"email"`
+	Currency  string      `json:"currency"`
+	MarketID  string      `json:"market_id"`
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  interface{} `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	IssuedAt  int64       `json:"iat,omitempty"`
+	NotBefore int64       `json:"nbf,omitempty"`
+	ID        string      `json:"jti,omitempty"`
+	Groups    []string    `json:"groups,omitempty"`
+	Roles     []string    `json:"roles,omitempty"` // internal, see claims_transform.go
+}
+
+// loadJWTPublicKey loads the RSA public key from the source selected by
+// JWT_PUBLIC_KEY_SOURCE or JWT_PUBLIC_KEY_FILE and refreshes it every
+// JWT_KEY_REFRESH_INTERVAL, so a rotated issuer key is picked up without
+// a restart
+func loadJWTPublicKey(ctx context.Context) error {
+	loader, err := keyring.FromEnv("JWT_PUBLIC_KEY", "")
+	if err != nil || loader == nil {
+		return err
+	}
+	keys, err := keyring.New(ctx, loader)
+	if err != nil {
+		return err
+	}
+	keys.OnRotate(func(k *keyring.Keyring) {
+		log.Infof("[JWT-FLOW] JWT public key rotated from %s", k.Source())
+	})
+	jwtKeys = keys
+
+	if interval := keyRefreshInterval(); interval > 0 {
+		go keys.Watch(ctx, interval, func(err error) {
+			log.Warnf("[JWT-FLOW] Failed to refresh JWT public key: %v", err)
+			keysDegraded(keys)
+		})
+	}
+	go watchIssuerClock(ctx)
+	return loadJWTIssuers(ctx)
+}
+
+// keyRefreshInterval reads JWT_KEY_REFRESH_INTERVAL; 0 disables refreshing
+func keyRefreshInterval() time.Duration {
+	v := os.Getenv("JWT_KEY_REFRESH_INTERVAL")
+	if v == "" {
+		return time.Minute
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Minute
+	}
+	return d
+}
+
+// verifyUserJWTNow checks the RS256 signature, expiry, issuer and audience of a
+// user token and returns its claims. The signature is checked with the keys
+// of the issuer the token names (see issuers.go).
+func verifyUserJWTNow(token string) (*UserClaims, error) {
+	return verifyUserJWTWithin(token, 0)
+}
+
+// verifyUserJWTWithin is verifyUserJWTNow accepting tokens expired up to
+// leeway ago (see expiry_grace.go)
+func verifyUserJWTWithin(token string, leeway time.Duration) (*UserClaims, error) {
+	if jwtKeys == nil {
+		return nil, errors.New("no JWT public key configured")
+	}
+	if token == "" {
+		return nil, errJWTMissing
+	}
+	if err := verifyNegativeCache.Lookup(token); err != nil {
+		return nil, err
+	}
+	// Expired tokens are rejected before spending an RSA verification on them.
+	// Time is the issuer's, see clock_skew.go.
+	issuer := issuerFor(token)
+	now := issuerNow(issuer.issuer).Add(-leeway)
+	if exp, ok := tokenExpiry(token); ok && now.After(exp) {
+		return nil, errJWTExpired
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", errJWTMalformed, len(parts))
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode header: %v", errJWTMalformed, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unexpected signing method %q", errJWTSigInvalid, header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode signature: %v", errJWTMalformed, err)
+	}
+	keys, ok := verificationKeys(issuer.keys, header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("%w: keys are stale and kid %q was never seen", errJWTSigInvalid, header.Kid)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifyWithAnyKey(keys, digest[:], sig) {
+		verifyNegativeCache.Add(token, errJWTSigInvalid)
+		return nil, errJWTSigInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode payload: %v", errJWTMalformed, err)
+	}
+	claims := &UserClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse claims: %v", errJWTMalformed, err)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: token has no exp", errJWTClaimsInvalid)
+	}
+	if now.Unix() > claims.ExpiresAt {
+		return nil, errJWTExpired
+	}
+	if claims.Issuer != issuer.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errJWTClaimsInvalid, claims.Issuer)
+	}
+	if !claims.hasAudience(issuer.audience) {
+		return nil, fmt.Errorf("%w: not issued for this audience", errJWTClaimsInvalid)
+	}
+	observeIssuedAt(issuer.issuer, claims.IssuedAt)
+	if claims.NotBefore != 0 && issuerNow(issuer.issuer).Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("%w: not valid yet", errJWTClaimsInvalid)
+	}
+	jwtIssuerVerifications.Add(claims.Issuer, 1)
+	return claims, nil
+}
+
+// verifyWithAnyKey accepts a signature made by any of keys; during a rotation
+// tokens signed with the previous key are still in flight
+func verifyWithAnyKey(keys []*rsa.PublicKey, digest, sig []byte) bool {
+	for _, key := range keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAudience handles both the string and array forms of the aud claim
+func (c *UserClaims) hasAudience(aud string) bool {
+	switch v := c.Audience.(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClaimsFromContext returns the claims of the incoming user token. They are
+// read from the token the interceptors put in the context: verification has
+// passed, or in async mode the response is dropped if it fails. Without a
+// JWT public key configured nothing is verified. With claims transformers
+// registered they are the transformed claims.
+func ClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	if claims, ok := ctx.Value(ctxKeyUserClaims{}).(*UserClaims); ok {
+		return claims, true
+	}
+	token, ok := UserJWTFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	claims, err := claimsFromToken(token)
+	return claims, err == nil
+}
+
+// claimsFromToken parses the payload of token without verifying it
+func claimsFromToken(token string) (*UserClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWT format: expected 3 parts, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := &UserClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+)
+
+// Key compromise drill
+//
+// A signed revocation naming a kid (see revocation.go) refuses that signing
+// key in every keyring of this process, whatever the key sources still serve.
+// /debug/keys reports the KeyIDs the frontend's tokens are verified with, so
+// `jwtsplit key-drill` can see whether a rotated key was picked up in time.
+
+// keysStatus is the JSON view of a keyring on /debug/keys
+type keysStatus struct {
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Current  string    `json:"current"`
+	KeyIDs   []string  `json:"kids"`
+	Revoked  []string  `json:"revoked"`
+}
+
+// revokeKey refuses the signing key kid from now on
+func revokeKey(kid string) {
+	if jwtKeys != nil {
+		jwtKeys.Revoke(kid)
+	}
+	for _, iss := range extraIssuers {
+		iss.keys.Revoke(kid)
+	}
+	revocationEvents.Add("keys", 1)
+}
+
+// keysHandler reports the keys user tokens are verified with
+var keysHandler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	if jwtKeys == nil {
+		http.Error(w, "no JWT public key configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keysStatus{
+		Source:   jwtKeys.Source(),
+		LoadedAt: jwtKeys.LoadedAt(),
+		Current:  keyring.KeyID(jwtKeys.PublicKey()),
+		KeyIDs:   jwtKeys.KeyIDs(),
+		Revoked:  jwtKeys.Revoked(),
+	})
+})
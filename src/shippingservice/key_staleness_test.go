@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+)
+
+func TestDegradedKeysAcceptSeenKidsOnly(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.New(context.Background(), keyring.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, d time.Duration) { jwtKeys, keyMaxStaleness = k, d }(jwtKeys, keyMaxStaleness)
+	jwtKeys = keys
+
+	sign := func(header string) string {
+		payload := `{"iss":"` + jwtIssuer + `","aud":"` + jwtAudience + `","sub":"u","exp":` +
+			strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + `}`
+		input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(payload))
+		digest := sha256.Sum256([]byte(input))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	withKid := sign(`{"alg":"RS256","kid":"` + keyring.KeyID(&key.PublicKey) + `"}`)
+	withoutKid := sign(`{"alg":"RS256"}`)
+	unknownKid := sign(`{"alg":"RS256","kid":"rotated-during-outage"}`)
+
+	keyMaxStaleness = time.Hour
+	for _, token := range []string{withKid, withoutKid, unknownKid} {
+		if _, err := verifyUserJWTNow(token); err != nil {
+			t.Errorf("fresh keys: verifyUserJWTNow() = %v", err)
+		}
+	}
+
+	keyMaxStaleness = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := verifyUserJWTNow(withKid); err != nil {
+		t.Errorf("degraded keys refused a previously seen kid: %v", err)
+	}
+	for name, token := range map[string]string{"no kid": withoutKid, "unknown kid": unknownKid} {
+		if _, err := verifyUserJWTNow(token); !errors.Is(err, errJWTSigInvalid) {
+			t.Errorf("degraded keys, %s: verifyUserJWTNow() = %v, want %v", name, err, errJWTSigInvalid)
+		}
+	}
+
+	// A successful refresh leaves degraded mode
+	keyMaxStaleness = time.Hour
+	if _, err := keys.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyUserJWTNow(withoutKid); err != nil {
+		t.Errorf("refreshed keys: verifyUserJWTNow() = %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyring
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File loads a PEM file from disk
+type File string
+
+func (f File) Load(context.Context) ([]byte, error) {
+	return os.ReadFile(string(f))
+}
+
+func (f File) String() string { return "file " + string(f) }
+
+// Store replaces the file atomically, so a concurrent Load sees the old key
+// or the new one
+func (f File) Store(_ context.Context, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(string(f)), filepath.Base(string(f))+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+// Env loads PEM from an environment variable. Literal \n sequences are
+// accepted in place of newlines, for platforms that can't set multi-line
+// values. The variable is read once per load, so it only rotates on restart.
+type Env string
+
+func (e Env) Load(context.Context) ([]byte, error) {
+	v := os.Getenv(string(e))
+	if v == "" {
+		return nil, fmt.Errorf("%s is not set", string(e))
+	}
+	return []byte(strings.ReplaceAll(v, `\n`, "\n")), nil
+}
+
+func (e Env) String() string { return "env " + string(e) }
+
+// Secret loads one key of a Kubernetes Secret mounted as a volume. The
+// kubelet swaps the whole directory when the Secret changes, so reloading
+// picks up rotations; subPath mounts are never updated and don't rotate.
+type Secret struct {
+	Dir string
+	Key string
+}
+
+func (s Secret) Load(context.Context) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.Dir, s.Key))
+}
+
+func (s Secret) String() string { return fmt.Sprintf("secret %s/%s", s.Dir, s.Key) }
+
+// Vault loads a field of a HashiCorp Vault KV secret, v2 or v1
+type Vault struct {
+	Addr  string
+	Token string
+	Path  string // e.g. secret/data/jwt for KV v2
+	Field string
+
+	Client *http.Client
+}
+
+func (v Vault) Load(ctx context.Context) ([]byte, error) {
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	url := strings.TrimRight(v.Addr, "/") + "/v1/" + strings.TrimLeft(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	fields := body.Data
+	// KV v2 nests the secret's fields under data.data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		fields = nested
+	}
+	value, ok := fields[v.Field].(string)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("field %q not found", v.Field)
+	}
+	return []byte(value), nil
+}
+
+func (v Vault) String() string { return fmt.Sprintf("vault %s field %s", v.Path, v.Field) }
+
+// FromEnv builds the loader selected by <prefix>_SOURCE:
+//
+//	file   - <prefix>_FILE, or defaultFile
+//	env    - PEM in <prefix> itself
+//	secret - <prefix>_SECRET_DIR and <prefix>_SECRET_KEY (default key.pem)
+//	vault  - VAULT_ADDR, VAULT_TOKEN, <prefix>_VAULT_PATH and
+//	         <prefix>_VAULT_FIELD (default key)
+//	jwks   - the JSON Web Key Set served at <prefix>_JWKS_URL
+//
+// Without a source, <prefix>_FILE or defaultFile is used when set. A nil
+// loader means no key is configured.
+func FromEnv(prefix, defaultFile string) (Loader, error) {
+	file := os.Getenv(prefix + "_FILE")
+	if file == "" {
+		file = defaultFile
+	}
+	switch source := os.Getenv(prefix + "_SOURCE"); source {
+	case "":
+		if file == "" {
+			return nil, nil
+		}
+		return File(file), nil
+	case "file":
+		if file == "" {
+			return nil, fmt.Errorf("%s_SOURCE=file needs %s_FILE", prefix, prefix)
+		}
+		return File(file), nil
+	case "env":
+		return Env(prefix), nil
+	case "secret":
+		dir := os.Getenv(prefix + "_SECRET_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("%s_SOURCE=secret needs %s_SECRET_DIR", prefix, prefix)
+		}
+		return Secret{Dir: dir, Key: getenvDefault(prefix+"_SECRET_KEY", "key.pem")}, nil
+	case "vault":
+		v := Vault{
+			Addr:  os.Getenv("VAULT_ADDR"),
+			Token: os.Getenv("VAULT_TOKEN"),
+			Path:  os.Getenv(prefix + "_VAULT_PATH"),
+			Field: getenvDefault(prefix+"_VAULT_FIELD", "key"),
+		}
+		if v.Addr == "" || v.Token == "" || v.Path == "" {
+			return nil, fmt.Errorf("%s_SOURCE=vault needs VAULT_ADDR, VAULT_TOKEN and %s_VAULT_PATH", prefix, prefix)
+		}
+		return v, nil
+	case "jwks":
+		url := os.Getenv(prefix + "_JWKS_URL")
+		if url == "" {
+			return nil, fmt.Errorf("%s_SOURCE=jwks needs %s_JWKS_URL", prefix, prefix)
+		}
+		return JWKS{URL: url}, nil
+	default:
+		return nil, fmt.Errorf("%s_SOURCE=%q must be file, env, secret, vault or jwks", prefix, source)
+	}
+}
+
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -24,11 +24,13 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	channelzservice "google.golang.org/grpc/channelz/service"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/grpcserver"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -53,6 +55,10 @@ func init() {
 }
 
 func main() {
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+
 	if os.Getenv("DISABLE_TRACING") == "" {
 		log.Info("Tracing enabled, but temporarily unavailable")
 		log.Info("See https://github.com/GoogleCloudPlatform/microservices-demo/issues/422 for more info.")
@@ -67,6 +73,12 @@ func main() {
 	} else {
 		log.Info("Profiling disabled.")
 	}
+	startPyroscope("shippingservice")
+
+	initCapture()
+	if err := loadJWTPublicKey(context.Background()); err != nil {
+		log.Fatalf("Failed to load JWT public key: %v", err)
+	}
 
 	port := defaultPort
 	if value, ok := os.LookupEnv("PORT"); ok {
@@ -79,26 +91,27 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	var srv *grpc.Server
-	// Configure HPACK table size: 512KB total (480KB HPACK table + 32KB overhead)
 	if os.Getenv("DISABLE_STATS") == "" {
 		log.Info("Stats enabled, but temporarily unavailable")
-		srv = grpc.NewServer(
-			grpc.ChainUnaryInterceptor(jwtUnaryServerInterceptor),
-			grpc.ChainStreamInterceptor(jwtStreamServerInterceptor),
-			grpc.MaxHeaderListSize(524288), // 512KB (480KB HPACK table + 32KB overhead)
-		)
 	} else {
 		log.Info("Stats disabled.")
-		srv = grpc.NewServer(
-			grpc.ChainUnaryInterceptor(jwtUnaryServerInterceptor),
-			grpc.ChainStreamInterceptor(jwtStreamServerInterceptor),
-			grpc.MaxHeaderListSize(524288), // 512KB (480KB HPACK table + 32KB overhead)
-		)
 	}
+	tlsOpts, err := serverTLSOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Header limits, keepalive and stream caps come from grpcserver
+	srv := grpcserver.New(grpcserver.Options{
+		Unary:        []grpc.UnaryServerInterceptor{recoveryUnaryServerInterceptor, accessLogUnaryServerInterceptor, loadShedUnaryServerInterceptor, captureUnaryServerInterceptor, profileLabelUnaryServerInterceptor, jwtUnaryServerInterceptor, tokenFreshnessUnaryServerInterceptor, verifyUnaryServerInterceptor},
+		Stream:       []grpc.StreamServerInterceptor{recoveryStreamServerInterceptor, accessLogStreamServerInterceptor, loadShedStreamServerInterceptor, captureStreamServerInterceptor, profileLabelStreamServerInterceptor, jwtStreamServerInterceptor},
+		StatsHandler: wireStats,
+		Extra:        tlsOpts,
+	})
 	svc := &server{}
 	pb.RegisterShippingServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
+	channelzservice.RegisterChannelzServiceToServer(srv)
+	startDebugServer()
 	log.Infof("Shipping Service listening on port %s", port)
 
 	// Register reflection service on gRPC server.
@@ -124,8 +137,12 @@ func (s *server) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Health_Watc
 
 // GetQuote produces a shipping quote (cost) in USD.
 func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
+	log := loggerFromContext(ctx)
 	log.Info("[GetQuote] received request")
 	defer log.Info("[GetQuote] completed request")
+	if err := checkAddressMarket(ctx, "GetQuote", in.Address); err != nil {
+		return nil, err
+	}
 
 	// 1. Generate a quote based on the total number of items to be shipped.
 	quote := CreateQuoteFromCount(0)
@@ -143,11 +160,19 @@ func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQ
 // ShipOrder mocks that the requested items will be shipped.
 // It supplies a tracking ID for notional lookup of shipment delivery status.
 func (s *server) ShipOrder(ctx context.Context, in *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
+	log := loggerFromContext(ctx)
 	log.Info("[ShipOrder] received request")
 	defer log.Info("[ShipOrder] completed request")
+	if claims, ok := OrderClaimsFromContext(ctx); ok {
+		log.Infof("[ShipOrder] order_id=%s cart_value_bucket=%s", claims.OrderID, claims.CartValueBucket)
+	}
+	if err := checkAddressMarket(ctx, "ShipOrder", in.Address); err != nil {
+		return nil, err
+	}
 	// 1. Create a Tracking ID
 	baseAddress := fmt.Sprintf("%s, %s, %s", in.Address.StreetAddress, in.Address.City, in.Address.State)
 	id := CreateTrackingId(baseAddress)
+	ordersShippedTotal.WithLabelValues(WireFormatFromContext(ctx)).Inc()
 
 	// 2. Generate a response.
 	return &pb.ShipOrderResponse{
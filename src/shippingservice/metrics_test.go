@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestReassemblyExemplarCarriesTraceID(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	md := metadata.Pairs(
+		"x-jwt-header", "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9",
+		"x-jwt-payload", `{"sub":"u1"}`,
+		"x-jwt-sig", "c2ln",
+		"traceparent", "00-"+traceID+"-00f067aa0ba902b7-01",
+	)
+	if _, err := jwtFromMetadata(md); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(rec, req)
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "jwt_reassembly_seconds_bucket") && strings.Contains(line, `trace_id="`+traceID+`"`) {
+			return
+		}
+	}
+	t.Errorf("no jwt_reassembly_seconds exemplar for trace %s in:\n%s", traceID, body)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifyNegativeCache remembers tokens that recently failed signature
+// verification, so a flood of requests replaying the same bad token costs a
+// hash lookup instead of an RSA verification each
+var verifyNegativeCache = newNegativeCache(10000, 5*time.Minute)
+
+// negativeCacheHits counts verifications answered from the negative cache
+var negativeCacheHits = expvar.NewInt("jwt_verify_negative_hits")
+
+type negativeCache struct {
+	maxEntries int
+	maxTTL     time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]negativeEntry
+}
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+func newNegativeCache(maxEntries int, maxTTL time.Duration) *negativeCache {
+	return &negativeCache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    make(map[[sha256.Size]byte]negativeEntry),
+	}
+}
+
+// Lookup returns the cached failure for token, or nil
+func (c *negativeCache) Lookup(token string) error {
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	negativeCacheHits.Add(1)
+	return e.err
+}
+
+// Add caches a verification failure. Entries live for maxTTL but never past
+// the token's own exp: after that the cheap expiry check rejects it anyway.
+func (c *negativeCache) Add(token string, err error) {
+	now := time.Now()
+	expires := now.Add(c.maxTTL)
+	if exp, ok := tokenExpiry(token); ok && exp.Before(expires) {
+		expires = exp
+	}
+	if !expires.After(now) {
+		return
+	}
+
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeEntry{err: err, expires: expires}
+}
+
+// tokenExpiry reads the unverified exp claim; only ever used to reject or to
+// bound a cache entry, never to accept a token
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.ExpiresAt, 0), true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// payloadValidationEnabled rejects tokens whose payload is not a JSON object
+// carrying the claims in JWT_REQUIRED_CLAIMS (default sub,exp,session_id)
+// with the expected types, before malformed claim sets reach the handlers
+var payloadValidationEnabled = os.Getenv("JWT_VALIDATE_PAYLOAD") == "true"
+
+var requiredClaims = parseRequiredClaims(envOrDefault("JWT_REQUIRED_CLAIMS", "sub,exp,session_id"))
+
+// claimKinds are the JSON types of the registered and session claims; claims
+// not listed only have to be present and non-null
+var claimKinds = map[string]string{
+	"sub":        "string",
+	"iss":        "string",
+	"session_id": "string",
+	"exp":        "number",
+	"iat":        "number",
+	"nbf":        "number",
+}
+
+func parseRequiredClaims(list string) []string {
+	var claims []string
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			claims = append(claims, c)
+		}
+	}
+	return claims
+}
+
+// validatePayload checks a raw JSON payload against the required claims
+func validatePayload(payload []byte, required []string) error {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("payload is not a JSON object")
+	}
+	for _, name := range required {
+		v, ok := claims[name]
+		if !ok || bytes.Equal(v, []byte("null")) {
+			return fmt.Errorf("missing required claim %q", name)
+		}
+		switch claimKinds[name] {
+		case "string":
+			var s string
+			if json.Unmarshal(v, &s) != nil || s == "" {
+				return fmt.Errorf("claim %q must be a non-empty string", name)
+			}
+		case "number":
+			var n float64
+			if json.Unmarshal(v, &n) != nil {
+				return fmt.Errorf("claim %q must be a number", name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkJWTPayload rejects a token whose payload fails validation
+func checkJWTPayload(ctx context.Context, token string) error {
+	if !payloadValidationEnabled || token == "" {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return authError(codes.Unauthenticated, reasonJWTMalformed, "invalid JWT payload: token is not a JWS", nil)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = validatePayload(payload, requiredClaims)
+	}
+	if err != nil {
+		loggerFromContext(ctx).Warnf("[JWT-FLOW] Rejecting JWT with invalid payload: %v", err)
+		jwtSLO.RecordFailure(sloReasonVerification)
+		return authError(codes.Unauthenticated, reasonJWTClaimsInvalid, fmt.Sprintf("invalid JWT payload: %v", err), nil)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckJWTPayload(t *testing.T) {
+	payloadValidationEnabled = true
+	defer func() { payloadValidationEnabled = false }()
+
+	token := func(payload string) string {
+		return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+	}
+	tests := []struct {
+		payload string
+		want    codes.Code
+	}{
+		{`{"sub":"u1","exp":1700000000,"session_id":"s1"}`, codes.OK},
+		{`{"sub":"u1","exp":1700000000}`, codes.Unauthenticated},
+		{`{"sub":"","exp":1700000000,"session_id":"s1"}`, codes.Unauthenticated},
+		{`{"sub":"u1","exp":"tomorrow","session_id":"s1"}`, codes.Unauthenticated},
+		{`{"sub":"u1","exp":null,"session_id":"s1"}`, codes.Unauthenticated},
+		{`["sub","exp","session_id"]`, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		if got := status.Code(checkJWTPayload(context.Background(), token(tt.payload))); got != tt.want {
+			t.Errorf("checkJWTPayload(%s) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/subjecthash"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// panicsTotal counts recovered handler panics per full method name
+var panicsTotal = expvar.NewMap("grpc_server_panics_total")
+
+// recoveryUnaryServerInterceptor converts handler panics into codes.Internal
+func recoveryUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverPanic(ctx, info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// recoveryStreamServerInterceptor converts stream handler panics into codes.Internal
+func recoveryStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverPanic(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// recoverPanic logs the panic with its stack and redacted JWT context,
+// counts it and returns the error sent to the caller
+func recoverPanic(ctx context.Context, method string, r interface{}) error {
+	panicsTotal.Add(method, 1)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	fields := redactedJWTFields(md)
+	fields["method"] = method
+	fields["stack"] = string(debug.Stack())
+	log.WithFields(fields).Errorf("[PANIC] recovered panic in %s: %v", method, r)
+
+	return status.Errorf(codes.Internal, "internal error")
+}
+
+// redactedJWTFields describes the JWT on a request without exposing it:
+// the wire mode and a hash of the session ID
+func redactedJWTFields(md metadata.MD) logrus.Fields {
+	fields := logrus.Fields{"jwt_mode": jwtModeFromMetadata(md)}
+	if sid := sessionIDFromMetadata(md); sid != "" {
+		fields["session_hash"] = pseudonym(sid)
+	}
+	return fields
+}
+
+// sessionIDFromMetadata extracts the session_id claim from either JWT format
+func sessionIDFromMetadata(md metadata.MD) string {
+	var payload []byte
+	if split, ok, err := splitPayloadFromMetadata(md); ok && err == nil {
+		payload = []byte(split)
+	} else if vals := md.Get("authorization"); len(vals) > 0 {
+		parts := strings.Split(strings.TrimPrefix(vals[0], "Bearer "), ".")
+		if len(parts) != 3 {
+			return ""
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return ""
+		}
+		payload = decoded
+	} else {
+		return ""
+	}
+
+	var claims struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.SessionID
+}
+
+// subjects hashes the user and session identifiers written to logs, under
+// the keys in SUBJECT_HASH_KEY_FILE
+var subjects = loadSubjectHasher()
+
+// loadSubjectHasher falls back to hashing without a key when the key file
+// can't be read; startup refuses it
+func loadSubjectHasher() *subjecthash.Hasher {
+	h, err := subjecthash.Load(os.Getenv("SUBJECT_HASH_KEY_FILE"))
+	if err != nil {
+		return subjecthash.New()
+	}
+	return h
+}
+
+// pseudonym returns the short hash logged in place of a user or session
+// identifier, the same in every service sharing the key file
+func pseudonym(id string) string {
+	if id == "" {
+		return ""
+	}
+	return subjects.Short(id)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+)
+
+// TestRecoveryInterceptors checks that handler panics become Internal
+// errors, are counted, and are logged with the session hash but not the token
+func TestRecoveryInterceptors(t *testing.T) {
+	var buf bytes.Buffer
+	out, formatter := log.Out, log.Formatter
+	log.Out, log.Formatter = &buf, &logrus.JSONFormatter{}
+	defer func() { log.Out, log.Formatter = out, formatter }()
+
+	token := jwttest.RS256().Mint(jwttest.Claims{"session_id": "s1"})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+
+	_, err := recoveryUnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/ShipOrder"},
+		func(context.Context, interface{}) (interface{}, error) { panic("boom") })
+	if status.Code(err) != codes.Internal {
+		t.Errorf("unary panic: got %v, want Internal", err)
+	}
+	err = recoveryStreamServerInterceptor(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/grpc.health.v1.Health/Watch"},
+		func(interface{}, grpc.ServerStream) error { panic("boom") })
+	if status.Code(err) != codes.Internal {
+		t.Errorf("stream panic: got %v, want Internal", err)
+	}
+	for _, method := range []string{"/hipstershop.ShippingService/ShipOrder", "/grpc.health.v1.Health/Watch"} {
+		if n := panicsTotal.Get(method); n == nil || n.String() == "0" {
+			t.Errorf("panic in %s not counted", method)
+		}
+	}
+
+	if strings.Contains(buf.String(), token) {
+		t.Error("panic log contains the token")
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &line); err != nil {
+		t.Fatalf("panic not logged: %q", buf.String())
+	}
+	if line["method"] != "/hipstershop.ShippingService/ShipOrder" || line["jwt_mode"] != jwtModeFull || line["session_hash"] != pseudonym("s1") || line["stack"] == "" {
+		t.Errorf("line = %v", line)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// The frontend POSTs a revocation to /jwt/revoke on DEBUG_PORT when a user
+// logs out (JWT_REVOCATION_URLS there). Incoming tokens whose jti or session
+// was revoked are refused, so split components replayed from a warm cache
+// stop working at once instead of when the token expires. The claims are read
+// unverified: they are only ever used to reject. A notice naming a kid revokes
+// that signing key instead, see key_drill.go.
+//
+// Notices must carry an X-Revocation-Signature, the base64url HMAC-SHA256 of
+// the body under JWT_REVOCATION_KEY shared with the frontend; without the key
+// every notice is refused.
+
+const (
+	revokedSessionTTL  = 10 * time.Minute
+	maxRevocationBytes = 4 << 10
+)
+
+var revocationKey = []byte(os.Getenv("JWT_REVOCATION_KEY"))
+
+var errTokenRevoked = authError(codes.Unauthenticated, reasonJWTRevoked, "user JWT has been revoked", nil)
+
+type revocationNotice struct {
+	JTI       string `json:"jti,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	Kid       string `json:"kid,omitempty"`
+	Expires   int64  `json:"exp"`
+}
+
+type revocationList struct {
+	maxEntries int
+
+	mu       sync.Mutex
+	jtis     map[string]time.Time
+	sessions map[string]time.Time
+}
+
+var revocations = newRevocationList(100000)
+
+// revocationEvents counts revocations received, signing keys revoked,
+// requests refused and revocations shed from a full list
+var revocationEvents = expvar.NewMap("jwt_revocations")
+
+func newRevocationList(maxEntries int) *revocationList {
+	return &revocationList{maxEntries: maxEntries, jtis: make(map[string]time.Time), sessions: make(map[string]time.Time)}
+}
+
+// Add revokes jti until it expires and session for at least
+// revokedSessionTTL; either may be empty
+func (l *revocationList) Add(jti, session string, expires time.Time) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.jtis)+len(l.sessions) >= l.maxEntries {
+		l.sweep(now)
+		// Still full of live revocations: make room for a burst of them
+		if len(l.jtis)+len(l.sessions) >= l.maxEntries {
+			l.shed(max(2, l.maxEntries/10))
+		}
+	}
+	if jti != "" {
+		l.jtis[jti] = expires
+	}
+	if session != "" {
+		if min := now.Add(revokedSessionTTL); expires.Before(min) {
+			expires = min
+		}
+		l.sessions[session] = expires
+	}
+}
+
+func (l *revocationList) sweep(now time.Time) {
+	for k, exp := range l.jtis {
+		if now.After(exp) {
+			delete(l.jtis, k)
+		}
+	}
+	for k, exp := range l.sessions {
+		if now.After(exp) {
+			delete(l.sessions, k)
+		}
+	}
+}
+
+// shed drops the n revocations closest to expiry, which a replay could use
+// for the shortest time, so a flood of logouts can't grow the list past
+// maxEntries
+func (l *revocationList) shed(n int) {
+	type entry struct {
+		m       map[string]time.Time
+		key     string
+		expires time.Time
+	}
+	entries := make([]entry, 0, len(l.jtis)+len(l.sessions))
+	for k, exp := range l.jtis {
+		entries = append(entries, entry{l.jtis, k, exp})
+	}
+	for k, exp := range l.sessions {
+		entries = append(entries, entry{l.sessions, k, exp})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].expires.Before(entries[j].expires) })
+	n = min(n, len(entries))
+	for _, e := range entries[:n] {
+		delete(e.m, e.key)
+	}
+	revocationEvents.Add("shed", int64(n))
+}
+
+// Revoked reports whether jti or session was revoked
+func (l *revocationList) Revoked(jti, session string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if exp, ok := l.jtis[jti]; ok && jti != "" && now.Before(exp) {
+		return true
+	}
+	exp, ok := l.sessions[session]
+	return ok && session != "" && now.Before(exp)
+}
+
+// Empty reports whether nothing is revoked, sparing the claims lookup
+func (l *revocationList) Empty() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.jtis) == 0 && len(l.sessions) == 0
+}
+
+// revocationHandler receives revocations from the frontend
+var revocationHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRevocationBytes))
+	if err != nil {
+		http.Error(w, "revocation too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !revocationSigned(body, r.Header.Get("X-Revocation-Signature")) {
+		revocationEvents.Add("unauthenticated", 1)
+		http.Error(w, "missing or bad revocation signature", http.StatusForbidden)
+		return
+	}
+	var notice revocationNotice
+	if err := json.Unmarshal(body, &notice); err != nil || (notice.JTI == "" && notice.SessionID == "" && notice.Kid == "") {
+		http.Error(w, "expected a JSON body with jti, session_id or kid", http.StatusBadRequest)
+		return
+	}
+	if notice.Kid != "" {
+		revokeKey(notice.Kid)
+	}
+	if notice.JTI != "" || notice.SessionID != "" {
+		revocations.Add(notice.JTI, notice.SessionID, time.Unix(notice.Expires, 0))
+	}
+	revocationEvents.Add("received", 1)
+	log.Infof("[JWT-FLOW] revoked jti=%q session_hash=%q kid=%q", notice.JTI, pseudonym(notice.SessionID), notice.Kid)
+	w.WriteHeader(http.StatusNoContent)
+})
+
+// revocationSigned reports whether sig is the HMAC of body under
+// JWT_REVOCATION_KEY
+func revocationSigned(body []byte, sig string) bool {
+	if len(revocationKey) == 0 {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, revocationKey)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// checkRevocation refuses token when it was revoked
+func checkRevocation(ctx context.Context, token string) error {
+	if revocations.Empty() {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims struct {
+		ID        string `json:"jti"`
+		SessionID string `json:"session_id"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || !revocations.Revoked(claims.ID, claims.SessionID) {
+		return nil
+	}
+	revocationEvents.Add("refused", 1)
+	loggerFromContext(ctx).Warnf("[JWT-FLOW] refusing revoked token jti=%q session_hash=%q", claims.ID, pseudonym(claims.SessionID))
+	return errTokenRevoked
+}
@@ -15,9 +15,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"testing"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
 )
@@ -88,3 +93,53 @@ func TestShipOrder(t *testing.T) {
 		t.Errorf("TestShipOrder: Tracking ID is malformed - has %d characters, %d expected", len(res.TrackingId), 18)
 	}
 }
+
+// headerStream accepts the response headers the JWT interceptor sets
+type headerStream struct{ fakeServerStream }
+
+func (*headerStream) SetHeader(metadata.MD) error { return nil }
+
+// TestStreamInterceptorPropagatesJWT checks that stream handlers see the
+// caller's token and claims, as unary handlers do
+func TestStreamInterceptorPropagatesJWT(t *testing.T) {
+	payload := `{"sub":"urn:hipstershop:user:s1","session_id":"s1","market_id":"US"}`
+	md := metadata.Pairs("x-jwt-header", "eyJhbGciOiJSUzI1NiJ9", "x-jwt-payload", payload, "x-jwt-sig", "c2ln")
+	ss := &headerStream{fakeServerStream{ctx: metadata.NewIncomingContext(context.Background(), md)}}
+
+	var got *UserClaims
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		got, _ = ClaimsFromContext(stream.Context())
+		return nil
+	}
+	info := &grpc.StreamServerInfo{FullMethod: "/hipstershop.ShippingService/Stream"}
+	if err := jwtStreamServerInterceptor(nil, ss, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.SessionID != "s1" || got.MarketID != "US" {
+		t.Errorf("stream handler claims = %+v", got)
+	}
+}
+
+// TestAddressMarketCheck checks GetQuote against the market_id claim
+func TestAddressMarketCheck(t *testing.T) {
+	defer func(v bool) { enforceAddressMarket = v }(enforceAddressMarket)
+	enforceAddressMarket = true
+
+	token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u","market_id":"US"}`)) + ".c2ln"
+	ctx := context.WithValue(context.Background(), ctxKeyJWT{}, token)
+	s := server{}
+	for country, want := range map[string]codes.Code{
+		"United States": codes.OK,
+		"usa":           codes.OK,
+		"England":       codes.FailedPrecondition,
+	} {
+		_, err := s.GetQuote(ctx, &pb.GetQuoteRequest{Address: &pb.Address{Country: country}})
+		if status.Code(err) != want {
+			t.Errorf("%s: GetQuote = %v, want %v", country, err, want)
+		}
+	}
+	// Without a token there is nothing to compare against
+	if _, err := s.GetQuote(context.Background(), &pb.GetQuoteRequest{Address: &pb.Address{Country: "England"}}); err != nil {
+		t.Errorf("GetQuote without a token = %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+//go:build soak
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/keyring"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Soak test
+//
+// TestSoak drives distinct synthetic sessions through the JWT interceptors
+// and checks that the caches they fill stay within their bounds and that the
+// heap stops growing once every cache is full. It is run by cmd/soak, or:
+//
+//	go test -tags soak -run TestSoak -timeout 0 . -args -soak.sessions=2000000
+
+var (
+	soakSessions = flag.Int("soak.sessions", 1000000, "distinct sessions to drive")
+	soakWorkers  = flag.Int("soak.workers", runtime.GOMAXPROCS(0), "sessions driven concurrently")
+	soakProfiles = flag.String("soak.profiles", "", "directory to write heap profiles to")
+)
+
+// soakCache is a bounded cache the soak test watches
+type soakCache struct {
+	name string
+	len  func() int
+	max  int
+}
+
+func soakCaches() []soakCache {
+	return []soakCache{
+		{"negative", func() int {
+			verifyNegativeCache.mu.Lock()
+			defer verifyNegativeCache.mu.Unlock()
+			return len(verifyNegativeCache.entries)
+		}, verifyNegativeCache.maxEntries},
+		{"revocations", func() int {
+			revocations.mu.Lock()
+			defer revocations.mu.Unlock()
+			return len(revocations.jtis) + len(revocations.sessions)
+		}, revocations.maxEntries},
+		{"reassembly_peers", func() int {
+			peerReassemblyFailures.mu.Lock()
+			defer peerReassemblyFailures.mu.Unlock()
+			return len(peerReassemblyFailures.peers)
+		}, maxReassemblyFailurePeers},
+	}
+}
+
+func TestSoak(t *testing.T) {
+	// 1024 bits keeps signing cheap; the key size doesn't change what's cached
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.New(context.Background(), keyring.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(k *keyring.Keyring, out io.Writer) { jwtKeys, log.Out = k, out }(jwtKeys, log.Out)
+	jwtKeys = keys
+	log.Out = io.Discard
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	badSig := base64.RawURLEncoding.EncodeToString(make([]byte, key.Size()))
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/ShipOrder"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return verifyUnaryServerInterceptor(ctx, req, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	}
+
+	// One in 16 sessions sends claim blocks that can't be merged, from its
+	// own address; of the rest one in 8 is validly signed, and every other
+	// session logs out
+	session := func(i int) {
+		id := "soak-" + strconv.Itoa(i)
+		ctx := context.Background()
+		var md metadata.MD
+		if i%16 == 15 {
+			md = metadata.Pairs("x-jwt-header", header, "x-jwt-claims", "{"+id, "x-jwt-sig", badSig)
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 443}})
+		} else {
+			payload := `{"iss":"` + jwtIssuer + `","aud":"` + jwtAudience + `","sub":"` + id + `","session_id":"` + id +
+				`","jti":"` + id + `","exp":` + exp + `}`
+			sig := badSig
+			if i%8 == 0 {
+				digest := sha256.Sum256([]byte(header + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))))
+				b, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				sig = base64.RawURLEncoding.EncodeToString(b)
+			}
+			md = metadata.Pairs("x-jwt-header", header, "x-jwt-payload", payload, "x-jwt-sig", sig)
+		}
+		jwtUnaryServerInterceptor(metadata.NewIncomingContext(ctx, md), nil, info, handler)
+		if i%2 == 0 {
+			revocations.Add(id, id, time.Now().Add(time.Hour))
+		}
+	}
+
+	// Sessions it takes to fill every cache at the rates above
+	fill := max(verifyNegativeCache.maxEntries*16/13+1, revocations.maxEntries, maxReassemblyFailurePeers*16)
+	runSoak(t, session, fill)
+}
+
+// runSoak drives *soakSessions sessions in ten batches and checks the cache
+// bounds after each. Maps don't shrink, so a cache's maps settle at their
+// working size only after its entries have turned over a few times: heap
+// growth is checked over the second half of the run, and not before the
+// caches have filled twice. Heap profiles are written at the start and the
+// end of that stretch.
+func runSoak(t *testing.T, session func(i int), fill int) {
+	const checkpoints = 10
+	settled := max(2*fill, *soakSessions/2)
+	var baseline uint64
+	for c := 1; c <= checkpoints; c++ {
+		from, to := *soakSessions*(c-1)/checkpoints, *soakSessions*c/checkpoints
+		var next atomic.Int64
+		next.Store(int64(from))
+		var wg sync.WaitGroup
+		for w := 0; w < *soakWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := int(next.Add(1) - 1); i < to; i = int(next.Add(1) - 1) {
+					session(i)
+				}
+			}()
+		}
+		wg.Wait()
+
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		sizes := ""
+		for _, cache := range soakCaches() {
+			n := cache.len()
+			sizes += fmt.Sprintf(" %s=%d/%d", cache.name, n, cache.max)
+			if n > cache.max {
+				t.Errorf("after %d sessions the %s cache holds %d entries, bound is %d", to, cache.name, n, cache.max)
+			}
+		}
+		t.Logf("%d sessions: heap %.1f MiB,%s", to, float64(m.HeapAlloc)/(1<<20), sizes)
+
+		if to < settled {
+			continue
+		}
+		if baseline == 0 {
+			baseline = m.HeapAlloc
+			writeSoakProfile(t, "heap-saturated.pb.gz")
+			continue
+		}
+		if limit := baseline + baseline/10 + 2<<20; m.HeapAlloc > limit {
+			t.Errorf("heap grew from %d to %d bytes after the caches filled", baseline, m.HeapAlloc)
+		}
+	}
+	if baseline == 0 {
+		t.Logf("the caches fill after about %d sessions; run at least %d to check heap growth", fill, 4*fill)
+		return
+	}
+	writeSoakProfile(t, "heap-final.pb.gz")
+}
+
+func writeSoakProfile(t *testing.T, name string) {
+	if *soakProfiles == "" {
+		return
+	}
+	if err := os.MkdirAll(*soakProfiles, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(*soakProfiles, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("wrote %s", f.Name())
+}
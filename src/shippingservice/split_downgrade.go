@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+// Split downgrade
+//
+// A caller whose split headers keep failing to reassemble (it sends a format
+// version this receiver can't read) is asked to send the whole token instead.
+// After JWT_DOWNGRADE_THRESHOLD failures (default 5, 0 turns this off) from
+// one peer address within a minute, its failing calls are refused with
+// FailedPrecondition and an ErrorInfo of reason JWT_SPLIT_DOWNGRADE whose
+// cooldown_seconds metadata is JWT_DOWNGRADE_COOLDOWN (default 5m). The
+// frontend and checkout retry once with authorization and keep sending this
+// service whole tokens until the cooldown ends.
+
+const splitDowngradeReason = "JWT_SPLIT_DOWNGRADE"
+
+const (
+	splitDowngradeWindow      = time.Minute
+	defaultDowngradeCooldown  = 5 * time.Minute
+	maxDowngradeCooldown      = time.Hour
+	maxReassemblyFailurePeers = 1024
+)
+
+var (
+	downgradeThreshold = loadDowngradeThreshold()
+	downgradeCooldown  = loadDowngradeCooldown()
+)
+
+func loadDowngradeThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("JWT_DOWNGRADE_THRESHOLD")); err == nil && n >= 0 {
+		return n
+	}
+	return 5
+}
+
+func loadDowngradeCooldown() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("JWT_DOWNGRADE_COOLDOWN")); err == nil && d > 0 {
+		return min(d, maxDowngradeCooldown)
+	}
+	return defaultDowngradeCooldown
+}
+
+// splitDowngradeTotal counts reassembly failures by outcome: tolerated or
+// downgrade_requested
+var splitDowngradeTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jwt_split_downgrade_total",
+	Help: "Split JWT reassembly failures and the full-JWT downgrades they caused.",
+}, []string{"outcome"})
+
+// reassemblyFailures counts failures per peer in fixed windows
+type reassemblyFailures struct {
+	mu    sync.Mutex
+	peers map[string]*failureWindow
+}
+
+type failureWindow struct {
+	start time.Time
+	count int
+}
+
+var peerReassemblyFailures = &reassemblyFailures{peers: make(map[string]*failureWindow)}
+
+// Record counts a failure from peer and reports whether it reached threshold
+func (f *reassemblyFailures) Record(peer string, threshold int, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := f.peers[peer]
+	if w == nil || now.Sub(w.start) >= splitDowngradeWindow {
+		if w == nil && len(f.peers) >= maxReassemblyFailurePeers {
+			f.peers = make(map[string]*failureWindow)
+		}
+		w = &failureWindow{start: now}
+		f.peers[peer] = w
+	}
+	w.count++
+	return w.count >= threshold
+}
+
+// peerHost is the address of the calling peer without its port
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// reassemblyFailed records a failed reassembly of the call's split headers
+// and returns the downgrade request to send back once the peer has failed
+// too often, nil while the failure is tolerated
+func reassemblyFailed(ctx context.Context) error {
+	if downgradeThreshold == 0 {
+		return nil
+	}
+	host := peerHost(ctx)
+	if !peerReassemblyFailures.Record(host, downgradeThreshold, time.Now()) {
+		splitDowngradeTotal.WithLabelValues("tolerated").Inc()
+		return nil
+	}
+	splitDowngradeTotal.WithLabelValues("downgrade_requested").Inc()
+	loggerFromContext(ctx).Warnf("[JWT-FLOW] %s keeps sending split JWTs that can't be reassembled, asking it to send whole tokens for %s", host, downgradeCooldown)
+	return authError(codes.FailedPrecondition, splitDowngradeReason,
+		"split JWT headers could not be reassembled, resend the token in authorization",
+		map[string]string{"cooldown_seconds": strconv.Itoa(int(downgradeCooldown / time.Second))})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv int
+}
+
+func (f *fakeServerStream) Context() context.Context { return f.ctx }
+func (f *fakeServerStream) RecvMsg(m interface{}) error {
+	f.recv++
+	return nil
+}
+
+func testStreamToken(exp time.Time) string {
+	payload := `{"sub":"urn:hipstershop:user:s1","session_id":"s1","exp":` + strconv.FormatInt(exp.Unix(), 10) + `}`
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestStreamBoundClaims(t *testing.T) {
+	defer func(v bool) { streamBoundClaimsEnabled = v }(streamBoundClaimsEnabled)
+	streamBoundClaimsEnabled = true
+
+	inner := &fakeServerStream{ctx: context.Background()}
+	ctx, ss := bindStreamClaims(inner.ctx, inner, testStreamToken(time.Now().Add(time.Minute)))
+	claims, ok := StreamClaimsFromContext(ctx)
+	if !ok || claims.Subject != "urn:hipstershop:user:s1" || claims.SessionID != "s1" {
+		t.Fatalf("StreamClaimsFromContext = %+v, %v", claims, ok)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ss.RecvMsg(nil); err != nil {
+			t.Fatalf("RecvMsg on live stream: %v", err)
+		}
+	}
+	if inner.recv != 3 {
+		t.Errorf("inner RecvMsg called %d times, want 3", inner.recv)
+	}
+
+	_, expired := bindStreamClaims(inner.ctx, inner, testStreamToken(time.Now().Add(-time.Second)))
+	if err := expired.RecvMsg(nil); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("RecvMsg with expired stream token = %v, want Unauthenticated", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func peerWithCert(der []byte) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Raw: der}},
+		}},
+	})
+}
+
+func boundToken(der []byte) string {
+	sum := sha256.Sum256(der)
+	payload := `{"sub":"svc","cnf":{"x5t#S256":"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"}}`
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestCheckTokenBinding(t *testing.T) {
+	defer func(v bool, r map[string]bool) { tokenBindingEnabled, bindingRelays = v, r }(tokenBindingEnabled, bindingRelays)
+	tokenBindingEnabled = true
+
+	certA, certB, relay := []byte("workload-a"), []byte("workload-b"), []byte("relay")
+	sum := sha256.Sum256(relay)
+	bindingRelays = parseBindingRelays(base64.RawURLEncoding.EncodeToString(sum[:]))
+	unbound := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"svc"}`)) + ".c2ln"
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		token string
+		want  codes.Code
+	}{
+		{"bound token from its workload", peerWithCert(certA), boundToken(certA), codes.OK},
+		{"bound token replayed by another workload", peerWithCert(certB), boundToken(certA), codes.Unauthenticated},
+		{"bound token forwarded by a relay", peerWithCert(relay), boundToken(certA), codes.OK},
+		{"bound token without client certificate", context.Background(), boundToken(certA), codes.Unauthenticated},
+		{"unbound token", context.Background(), unbound, codes.OK},
+	}
+	for _, tt := range tests {
+		if got := status.Code(checkTokenBinding(tt.ctx, tt.token)); got != tt.want {
+			t.Errorf("%s: code = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Mutual TLS
+//
+// GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE name the certificate shipping
+// serves; GRPC_TLS_CA_FILE holds the CA that signs the certificates of its
+// callers. With the three set the gRPC server only speaks TLS and verifies
+// the client certificates it is shown, which are the certificates
+// JWT_TOKEN_BINDING compares cnf-bound tokens against; without TLS every
+// connection stays plaintext and bound tokens are refused.
+
+var (
+	tlsCertFile = os.Getenv("GRPC_TLS_CERT_FILE")
+	tlsKeyFile  = os.Getenv("GRPC_TLS_KEY_FILE")
+	tlsCAFile   = os.Getenv("GRPC_TLS_CA_FILE")
+)
+
+// loadTLSConfig returns the TLS configuration of the server, nil when TLS
+// is off
+func loadTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("GRPC_TLS_CERT_FILE: %w", err)
+	}
+	caPEM, err := os.ReadFile(tlsCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("GRPC_TLS_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("GRPC_TLS_CA_FILE %s holds no certificates", tlsCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		// Health probes come without a certificate; bound tokens don't
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// serverTLSOptions returns the server option that turns on TLS, none when
+// TLS is off
+func serverTLSOptions() ([]grpc.ServerOption, error) {
+	cfg, err := loadTLSConfig()
+	if cfg == nil || err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(cfg))}, nil
+}
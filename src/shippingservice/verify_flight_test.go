@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyFlightCoalesces(t *testing.T) {
+	token := "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ1In0.c2ln"
+	key := sha256.Sum256([]byte(token))
+	leader := &UserClaims{Subject: "u"}
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		verifyFlight.Do(string(key[:]), func() (interface{}, error) {
+			<-release
+			return leader, nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	counter := func(name string) int64 {
+		if v, ok := verifyFlightEvents.Get(name).(interface{ Value() int64 }); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	coalesced, verifications := counter("coalesced"), counter("verifications")
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if claims, err := verifyUserJWT(token); err != nil || claims != leader {
+				t.Errorf("verifyUserJWT() = %v, %v; want the in-flight result", claims, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	<-done
+
+	if got := counter("coalesced") - coalesced; got != 5 {
+		t.Errorf("coalesced = %d, want 5", got)
+	}
+	if got := counter("verifications") - verifications; got != 0 {
+		t.Errorf("verifications = %d, want 0", got)
+	}
+	// Once the flight lands the next caller verifies on its own
+	if _, err := verifyUserJWT(token); err == nil {
+		t.Error("verifyUserJWT() without keys succeeded")
+	}
+	if got := counter("verifications") - verifications; got != 1 {
+		t.Errorf("verifications after the flight = %d, want 1", got)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/jwttest"
+)
+
+func TestWireFormatFromContext(t *testing.T) {
+	token := jwttest.RS256().Mint(jwttest.DefaultClaims())
+	components, _ := DecomposeJWT(token)
+	for _, tc := range []struct {
+		md   metadata.MD
+		want string
+	}{
+		{metadata.MD{}, wireFormatNone},
+		{metadata.Pairs("authorization", "Bearer "+token), wireFormatFull},
+		{metadata.Pairs("x-jwt-header", components.Header, "x-jwt-payload", components.Payload, "x-jwt-sig", components.Signature), wireFormatSplitV1},
+	} {
+		var got string
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			got = WireFormatFromContext(ctx)
+			return nil, nil
+		}
+		ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+		_, _ = jwtUnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/hipstershop.ShippingService/GetQuote"}, handler)
+		if got != tc.want {
+			t.Errorf("%v: WireFormatFromContext = %q, want %q", tc.md, got, tc.want)
+		}
+	}
+
+	blocks := metadata.Pairs("x-jwt-claims", "sub", "x-jwt-static-sha", "abc")
+	if got := wireFormatFromMetadata(blocks, true); got != wireFormatSplitV3 {
+		t.Errorf("static block reference = %q, want %q", got, wireFormatSplitV3)
+	}
+	if got := wireFormatFromMetadata(metadata.Pairs("x-jwt-ref", "r1"), false); got != wireFormatReference {
+		t.Errorf("reference = %q, want %q", got, wireFormatReference)
+	}
+}
@@ -0,0 +1,234 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// TestTokenBinding runs the stack over mutual TLS with JWT_TOKEN_BINDING on:
+// the frontend binds the tokens it signs to its client certificate, checkout
+// checks the binding on the first hop and shipping accepts the token from
+// checkout as a relay. A bound token presented with any other certificate is
+// turned away by both.
+func TestTokenBinding(t *testing.T) {
+	ca := newTestCA(t)
+	frontend, checkout, shipping := ca.issue(t, "frontend"), ca.issue(t, "checkoutservice"), ca.issue(t, "shippingservice")
+	stubs, attacker := ca.issue(t, "stubs"), ca.issue(t, "attacker")
+
+	s := startStackWith(t, true, stackOptions{
+		frontendEnv: ca.env(frontend),
+		checkoutEnv: ca.env(checkout),
+		shippingEnv: append(ca.env(shipping), "JWT_BINDING_RELAYS="+checkout.thumbprint),
+		stubOpts:    []grpc.ServerOption{grpc.Creds(credentials.NewTLS(ca.serverConfig(stubs)))},
+	})
+	placeOrder(t, s.frontendURL)
+
+	// Every token reaching the stubs, from the frontend or through checkout,
+	// is bound to the frontend
+	var bound int
+	for _, c := range s.stubs.Calls() {
+		if _, token := tokenFromMetadata(c.MD); token != "" {
+			if got := cnfThumbprint(t, token); got != frontend.thumbprint {
+				t.Errorf("%s: cnf = %q, want the frontend's %q", c.Method, got, frontend.thumbprint)
+			}
+			bound++
+		}
+	}
+	if bound == 0 {
+		t.Fatal("no token reached the stubs")
+	}
+	checkSLO(t, "checkoutservice", s.checkoutDebug)
+	checkSLO(t, "shippingservice", s.shippingDebug)
+
+	claims := userClaims("bound-user")
+	claims["cnf"] = map[string]string{"x5t#S256": frontend.thumbprint}
+	token := signToken(t, claims)
+	tests := []struct {
+		name string
+		addr string
+		cert testCert
+		want codes.Code
+	}{
+		{"shipping from the frontend", s.shippingAddr, frontend, codes.OK},
+		{"shipping from checkout as a relay", s.shippingAddr, checkout, codes.OK},
+		{"shipping replayed by another workload", s.shippingAddr, attacker, codes.Unauthenticated},
+		{"checkout replayed by another workload", s.checkoutAddr, attacker, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		cc, err := grpc.NewClient(tt.addr, grpc.WithTransportCredentials(credentials.NewTLS(ca.clientConfig(tt.cert))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), split(token)), 10*time.Second)
+		defer cancel()
+		if tt.addr == s.shippingAddr {
+			_, err = pb.NewShippingServiceClient(cc).GetQuote(ctx, &pb.GetQuoteRequest{Address: orderAddress})
+		} else {
+			_, err = pb.NewCheckoutServiceClient(cc).PlaceOrder(ctx, &pb.PlaceOrderRequest{
+				UserId:       "bound-user",
+				UserCurrency: "USD",
+				Email:        "someone@example.com",
+				Address:      orderAddress,
+				CreditCard: &pb.CreditCardInfo{
+					CreditCardNumber:          "4432801561520454",
+					CreditCardCvv:             672,
+					CreditCardExpirationYear:  int32(time.Now().Year() + 1),
+					CreditCardExpirationMonth: 1,
+				},
+			})
+		}
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: code = %v (%v), want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// testCA issues the certificates of one test stack
+type testCA struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	caFile string
+	pool   *x509.CertPool
+}
+
+// testCert is a workload certificate, valid for 127.0.0.1 both as client
+// and server
+type testCert struct {
+	certFile, keyFile string
+	pair              tls.Certificate
+	thumbprint        string // x5t#S256
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "integration CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	ca.caFile = ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) issue(t *testing.T, name string) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return testCert{
+		certFile:   ca.write(t, name+".pem", "CERTIFICATE", der),
+		keyFile:    ca.write(t, name+"-key.pem", "PRIVATE KEY", keyDER),
+		pair:       tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		thumbprint: base64.RawURLEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func (ca *testCA) write(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// env turns on mutual TLS and token binding for a service holding c
+func (ca *testCA) env(c testCert) []string {
+	return []string{
+		"GRPC_TLS_CERT_FILE=" + c.certFile,
+		"GRPC_TLS_KEY_FILE=" + c.keyFile,
+		"GRPC_TLS_CA_FILE=" + ca.caFile,
+		"JWT_TOKEN_BINDING=true",
+	}
+}
+
+func (ca *testCA) serverConfig(c testCert) *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{c.pair}, ClientCAs: ca.pool, ClientAuth: tls.VerifyClientCertIfGiven}
+}
+
+func (ca *testCA) clientConfig(c testCert) *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{c.pair}, RootCAs: ca.pool}
+}
+
+// cnfThumbprint returns the x5t#S256 confirmation of a token
+func cnfThumbprint(t *testing.T, token string) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Cnf struct {
+			X5tS256 string `json:"x5t#S256"`
+		} `json:"cnf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims.Cnf.X5tS256
+}
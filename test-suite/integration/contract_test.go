@@ -0,0 +1,186 @@
+//go:build contract
+
+package integration
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// The contract tests impersonate the frontend against running downstreams,
+// whatever language they're written in, and record how each one answers a
+// token in the authorization header, in the split x-jwt-* headers and no
+// token at all. Downstreams are found through the frontend's and checkout's
+// *_SERVICE_ADDR variables; unset ones are skipped. The report goes to
+// CONTRACT_REPORT (jwt_contract_report.json by default) and is read by the
+// frontend and checkout through JWT_CONTRACT_REPORT:
+//
+//	CART_SERVICE_ADDR=localhost:7070 go test -tags contract ./...
+
+const (
+	modeAuthorization = "authorization"
+	modeSplit         = "split"
+	modeNone          = "none"
+)
+
+// The report format; the frontend and checkout keep their own copy in
+// contract_report.go
+type contractReport struct {
+	GeneratedAt time.Time                 `json:"generated_at"`
+	Services    map[string]contractResult `json:"services"`
+}
+
+type contractResult struct {
+	Method   string            `json:"method"`
+	Outcomes map[string]string `json:"outcomes"` // header mode -> gRPC code
+	Codecs   string            `json:"codecs,omitempty"`
+	Verdict  string            `json:"verdict"`
+}
+
+type contractCall func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error
+
+// contractTargets has one cheap call per downstream
+var contractTargets = []struct {
+	env, service, method string
+	call                 contractCall
+}{
+	{"CART_SERVICE_ADDR", "hipstershop.CartService", "GetCart", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewCartServiceClient(cc).GetCart(ctx, &pb.GetCartRequest{UserId: "contract-test"}, opts...)
+		return err
+	}},
+	{"CURRENCY_SERVICE_ADDR", "hipstershop.CurrencyService", "GetSupportedCurrencies", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewCurrencyServiceClient(cc).GetSupportedCurrencies(ctx, &pb.Empty{}, opts...)
+		return err
+	}},
+	{"PRODUCT_CATALOG_SERVICE_ADDR", "hipstershop.ProductCatalogService", "ListProducts", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewProductCatalogServiceClient(cc).ListProducts(ctx, &pb.Empty{}, opts...)
+		return err
+	}},
+	{"RECOMMENDATION_SERVICE_ADDR", "hipstershop.RecommendationService", "ListRecommendations", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewRecommendationServiceClient(cc).ListRecommendations(ctx, &pb.ListRecommendationsRequest{UserId: "contract-test"}, opts...)
+		return err
+	}},
+	{"AD_SERVICE_ADDR", "hipstershop.AdService", "GetAds", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewAdServiceClient(cc).GetAds(ctx, &pb.AdRequest{ContextKeys: []string{"accessories"}}, opts...)
+		return err
+	}},
+	{"SHIPPING_SERVICE_ADDR", "hipstershop.ShippingService", "GetQuote", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewShippingServiceClient(cc).GetQuote(ctx, &pb.GetQuoteRequest{Address: contractAddress}, opts...)
+		return err
+	}},
+	{"PAYMENT_SERVICE_ADDR", "hipstershop.PaymentService", "Charge", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewPaymentServiceClient(cc).Charge(ctx, &pb.ChargeRequest{
+			Amount: &pb.Money{CurrencyCode: "USD", Units: 10},
+			CreditCard: &pb.CreditCardInfo{
+				CreditCardNumber:          "4432801561520454",
+				CreditCardCvv:             672,
+				CreditCardExpirationYear:  int32(time.Now().Year() + 1),
+				CreditCardExpirationMonth: 1,
+			},
+		}, opts...)
+		return err
+	}},
+	{"EMAIL_SERVICE_ADDR", "hipstershop.EmailService", "SendOrderConfirmation", func(ctx context.Context, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := pb.NewEmailServiceClient(cc).SendOrderConfirmation(ctx, &pb.SendOrderConfirmationRequest{
+			Email: "someone@example.com",
+			Order: &pb.OrderResult{OrderId: "contract-test", ShippingAddress: contractAddress, ShippingCost: &pb.Money{CurrencyCode: "USD"}},
+		}, opts...)
+		return err
+	}},
+}
+
+var contractAddress = &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043}
+
+func TestDownstreamContracts(t *testing.T) {
+	token := signToken(t, userClaims("contract-test"))
+	report := contractReport{GeneratedAt: time.Now().UTC(), Services: make(map[string]contractResult)}
+	for _, target := range contractTargets {
+		addr := os.Getenv(target.env)
+		t.Run(target.service, func(t *testing.T) {
+			if addr == "" {
+				t.Skipf("%s not set", target.env)
+			}
+			cc, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cc.Close()
+
+			result := contractResult{Method: "/" + target.service + "/" + target.method, Outcomes: make(map[string]string)}
+			for _, mode := range []string{modeAuthorization, modeSplit, modeNone} {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				ctx = metadata.NewOutgoingContext(ctx, contractMetadata(mode, token))
+				var header metadata.MD
+				err := target.call(ctx, cc, grpc.Header(&header))
+				cancel()
+				result.Outcomes[mode] = status.Code(err).String()
+				if codecs := strings.Join(header.Get("x-jwt-codecs"), ","); codecs != "" {
+					result.Codecs = codecs
+				}
+				t.Logf("%s: %s (%v)", mode, result.Outcomes[mode], err)
+			}
+			result.Verdict = contractVerdict(result)
+			report.Services[target.service] = result
+
+			// Every downstream has to take the Bearer header, it's what the
+			// frontend falls back to; one that advertises codecs has to
+			// read the built-in split format too
+			if result.Outcomes[modeAuthorization] != "OK" {
+				t.Errorf("rejected the authorization header: %s", result.Outcomes[modeAuthorization])
+			}
+			if result.Codecs != "" && result.Outcomes[modeSplit] != "OK" {
+				t.Errorf("advertises %q but rejected the split headers: %s", result.Codecs, result.Outcomes[modeSplit])
+			}
+		})
+	}
+	if len(report.Services) == 0 {
+		return
+	}
+	path := os.Getenv("CONTRACT_REPORT")
+	if path == "" {
+		path = "jwt_contract_report.json"
+	}
+	b, _ := json.MarshalIndent(report, "", "  ")
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("wrote %s", path)
+}
+
+// contractVerdict is what the frontend should send the service: split when
+// it took the split headers, authorization when it only took the Bearer
+// header, broken when it took neither
+func contractVerdict(r contractResult) string {
+	switch {
+	case r.Outcomes[modeAuthorization] != "OK":
+		return "broken"
+	case r.Outcomes[modeSplit] == "OK":
+		return "split"
+	default:
+		return "authorization"
+	}
+}
+
+func contractMetadata(mode, token string) metadata.MD {
+	switch mode {
+	case modeAuthorization:
+		return metadata.Pairs("authorization", "Bearer "+token)
+	case modeSplit:
+		parts := strings.Split(token, ".")
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		return metadata.Pairs("x-jwt-header", parts[0], "x-jwt-payload", string(payload), "x-jwt-sig", parts[2])
+	}
+	return metadata.MD{}
+}
@@ -0,0 +1,11 @@
+// Package integration runs the frontend, checkout and shipping binaries
+// together against in-process stubs of the other services and checks how
+// the user JWT travels between them. The tests need the integration build
+// tag and a Go toolchain to build the services:
+//
+//	go test -tags integration ./...
+//
+// The contract build tag instead checks already running downstreams, in any
+// language, and writes the compatibility report the frontend and checkout
+// read from JWT_CONTRACT_REPORT (see contract_test.go).
+package integration
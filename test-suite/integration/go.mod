@@ -0,0 +1,18 @@
+module github.com/GoogleCloudPlatform/microservices-demo/test-suite/integration
+
+go 1.23.0
+
+require (
+	github.com/GoogleCloudPlatform/microservices-demo/src/frontend v0.0.0
+	google.golang.org/grpc v1.71.0
+)
+
+require (
+	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250218202821-56aae31c358a // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+)
+
+replace github.com/GoogleCloudPlatform/microservices-demo/src/frontend => ../../src/frontend
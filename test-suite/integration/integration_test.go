@@ -0,0 +1,429 @@
+//go:build integration
+
+package integration
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const csrfKey = "integration-csrf-key"
+
+var (
+	srcDir = filepath.Join("..", "..", "src")
+	binDir string
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "jwt-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binDir = dir
+	for _, svc := range []string{"frontend", "checkoutservice", "shippingservice"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, svc), ".")
+		cmd.Dir = filepath.Join(srcDir, svc)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "building %s: %v\n", svc, err)
+			os.RemoveAll(binDir)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(binDir)
+	os.Exit(code)
+}
+
+// stack is one running frontend -> checkout -> shipping deployment
+type stack struct {
+	stubs         *stubServices
+	frontendURL   string
+	checkoutAddr  string
+	shippingAddr  string
+	checkoutDebug string
+	shippingDebug string
+}
+
+func TestCheckoutJWTPropagation(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compression=%t", compression), func(t *testing.T) {
+			s := startStack(t, compression)
+			placeOrder(t, s.frontendURL)
+
+			key := publicKey(t)
+			var splitBytes, fullBytes int
+			calls := s.stubs.Calls()
+			for _, c := range calls {
+				mode, token := tokenFromMetadata(c.MD)
+				if mode == "" {
+					continue
+				}
+				if err := verifyRS256(key, token); err != nil {
+					t.Errorf("%s: token doesn't verify: %v", c.Method, err)
+				}
+				switch mode {
+				case "split":
+					splitBytes += jwtMetadataBytes(c.MD)
+					fullBytes += len("authorization") + len("Bearer ") + len(token)
+					if !compression {
+						t.Errorf("%s: got split JWT with compression off", c.Method)
+					}
+				case "full":
+					if compression && strings.Contains(c.Method, "CartService") {
+						t.Errorf("%s: got full JWT with compression on", c.Method)
+					}
+				}
+				if compression && mode == "split" && forcedAuthorization(c.Method) {
+					t.Errorf("%s: should always carry the authorization header", c.Method)
+				}
+			}
+			for _, m := range []string{"CartService/GetCart", "PaymentService/Charge", "EmailService/SendOrderConfirmation"} {
+				if !sawJWT(calls, m) {
+					t.Errorf("no JWT reached %s", m)
+				}
+			}
+			if compression && splitBytes >= fullBytes {
+				t.Errorf("split metadata is %d bytes, not smaller than %d as full tokens", splitBytes, fullBytes)
+			}
+			t.Logf("split metadata %d bytes vs %d as full tokens", splitBytes, fullBytes)
+
+			checkSLO(t, "checkoutservice", s.checkoutDebug)
+			checkSLO(t, "shippingservice", s.shippingDebug)
+		})
+	}
+}
+
+// stackOptions are what a test adds to the default stack: extra environment
+// per service and options of the stub server
+type stackOptions struct {
+	frontendEnv, checkoutEnv, shippingEnv []string
+	stubOpts                              []grpc.ServerOption
+}
+
+func startStack(t *testing.T, compression bool) *stack {
+	t.Helper()
+	return startStackWith(t, compression, stackOptions{})
+}
+
+func startStackWith(t *testing.T, compression bool, opts stackOptions) *stack {
+	t.Helper()
+	stubs, stubAddr := startStubs(t, opts.stubOpts...)
+	pubKey, _ := filepath.Abs(filepath.Join(srcDir, "frontend", "jwt_public_key.pem"))
+	common := []string{
+		fmt.Sprintf("ENABLE_JWT_COMPRESSION=%t", compression),
+		"JWT_SPLIT_MIN_BYTES=0",
+		"DISABLE_TRACING=1",
+		"DISABLE_PROFILER=1",
+		"JWT_REVOCATION_KEY=integration-revocation-key",
+	}
+
+	shippingPort, shippingDebug := freePort(t), freePort(t)
+	start(t, "shippingservice", "", append(append(common,
+		"PORT="+shippingPort,
+		"DEBUG_PORT="+shippingDebug,
+		"JWT_PUBLIC_KEY_FILE="+pubKey,
+	), opts.shippingEnv...))
+	waitTCP(t, "127.0.0.1:"+shippingPort)
+
+	checkoutPort, checkoutDebug := freePort(t), freePort(t)
+	start(t, "checkoutservice", "", append(append(common,
+		"PORT="+checkoutPort,
+		"DEBUG_PORT="+checkoutDebug,
+		"JWT_PUBLIC_KEY_FILE="+pubKey,
+		"SHIPPING_SERVICE_ADDR=127.0.0.1:"+shippingPort,
+		"PRODUCT_CATALOG_SERVICE_ADDR="+stubAddr,
+		"CART_SERVICE_ADDR="+stubAddr,
+		"CURRENCY_SERVICE_ADDR="+stubAddr,
+		"EMAIL_SERVICE_ADDR="+stubAddr,
+		"PAYMENT_SERVICE_ADDR="+stubAddr,
+	), opts.checkoutEnv...))
+	waitTCP(t, "127.0.0.1:"+checkoutPort)
+
+	// The frontend reads its templates and signing key from its source dir
+	frontendPort := freePort(t)
+	start(t, "frontend", filepath.Join(srcDir, "frontend"), append(append(common,
+		"PORT="+frontendPort,
+		"CSRF_KEY="+csrfKey,
+		"JWT_REVOCATION_URLS=http://127.0.0.1:"+checkoutDebug+"/jwt/revoke,http://127.0.0.1:"+shippingDebug+"/jwt/revoke",
+		"CHECKOUT_SERVICE_ADDR=127.0.0.1:"+checkoutPort,
+		"SHIPPING_SERVICE_ADDR=127.0.0.1:"+shippingPort,
+		"PRODUCT_CATALOG_SERVICE_ADDR="+stubAddr,
+		"CURRENCY_SERVICE_ADDR="+stubAddr,
+		"CART_SERVICE_ADDR="+stubAddr,
+		"RECOMMENDATION_SERVICE_ADDR="+stubAddr,
+		"AD_SERVICE_ADDR="+stubAddr,
+		"SHOPPING_ASSISTANT_SERVICE_ADDR="+stubAddr,
+	), opts.frontendEnv...))
+	frontendURL := "http://127.0.0.1:" + frontendPort
+	waitHTTP(t, frontendURL+"/_healthz")
+
+	return &stack{
+		stubs:         stubs,
+		frontendURL:   frontendURL,
+		checkoutAddr:  "127.0.0.1:" + checkoutPort,
+		shippingAddr:  "127.0.0.1:" + shippingPort,
+		checkoutDebug: "http://127.0.0.1:" + checkoutDebug,
+		shippingDebug: "http://127.0.0.1:" + shippingDebug,
+	}
+}
+
+// start runs a built service until the test ends; its output goes to the
+// test log so failures show why a service exited
+func start(t *testing.T, svc, dir string, env []string) {
+	t.Helper()
+	cmd := exec.Command(filepath.Join(binDir, svc))
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = testWriter{t, svc}
+	cmd.Stderr = testWriter{t, svc}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %s: %v", svc, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+}
+
+type testWriter struct {
+	t   *testing.T
+	svc string
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	if testing.Verbose() {
+		w.t.Logf("%s: %s", w.svc, strings.TrimRight(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return port
+}
+
+func waitTCP(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s did not come up", addr)
+}
+
+func waitHTTP(t *testing.T, u string) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get(u); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s did not come up", u)
+}
+
+// placeOrder opens a session, then submits the checkout form with the CSRF
+// token the frontend derives for that session
+func placeOrder(t *testing.T, base string) {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 30 * time.Second}
+	resp, err := client.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /: %s", resp.Status)
+	}
+
+	u, _ := url.Parse(base)
+	var token string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "shop_jwt" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("frontend set no shop_jwt cookie")
+	}
+
+	resp, err = client.PostForm(base+"/cart/checkout", url.Values{
+		"csrf_token":                   {csrfToken(t, token)},
+		"email":                        {"someone@example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"94043"},
+		"city":                         {"Mountain View"},
+		"state":                        {"CA"},
+		"country":                      {"United States"},
+		"credit_card_number":           {"4432801561520454"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {fmt.Sprint(time.Now().Year() + 1)},
+		"credit_card_cvv":              {"672"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /cart/checkout: %s", resp.Status)
+	}
+}
+
+// csrfToken derives the CSRF token the frontend expects from the session of
+// its shop_jwt cookie
+func csrfToken(t *testing.T, token string) string {
+	t.Helper()
+	var claims struct {
+		Subject   string `json:"sub"`
+		SessionID string `json:"session_id"`
+	}
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		t.Fatalf("unreadable shop_jwt cookie: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(csrfKey))
+	mac.Write([]byte(claims.Subject + "|" + claims.SessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenFromMetadata rebuilds the JWT a stub received and reports how it
+// travelled: "full", "split" or "" for none
+func tokenFromMetadata(md metadata.MD) (mode, token string) {
+	if v := md.Get("authorization"); len(v) > 0 {
+		return "full", strings.TrimPrefix(v[0], "Bearer ")
+	}
+	header, payload, sig := md.Get("x-jwt-header"), md.Get("x-jwt-payload"), md.Get("x-jwt-sig")
+	if len(header) == 0 || len(payload) == 0 || len(sig) == 0 {
+		return "", ""
+	}
+	return "split", header[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(payload[0])) + "." + sig[0]
+}
+
+// jwtMetadataBytes is the size of the JWT headers of a call, names included
+func jwtMetadataBytes(md metadata.MD) int {
+	n := 0
+	for k, vs := range md {
+		if k != "authorization" && !strings.HasPrefix(k, "x-jwt-") {
+			continue
+		}
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+func forcedAuthorization(method string) bool {
+	for _, svc := range []string{"PaymentService", "EmailService", "CurrencyService"} {
+		if strings.Contains(method, svc) {
+			return true
+		}
+	}
+	return false
+}
+
+func sawJWT(calls []recordedCall, method string) bool {
+	for _, c := range calls {
+		if mode, _ := tokenFromMetadata(c.MD); mode != "" && strings.HasSuffix(c.Method, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func publicKey(t *testing.T) *rsa.PublicKey {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(srcDir, "frontend", "jwt_public_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatal("jwt_public_key.pem holds no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("jwt_public_key.pem holds a %T, not an RSA key", key)
+	}
+	return rsaKey
+}
+
+func verifyRS256(key *rsa.PublicKey, token string) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return fmt.Errorf("not a compact JWS")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(token[:i]))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+}
+
+// checkSLO asserts that a service verified tokens and failed none
+func checkSLO(t *testing.T, svc, debugURL string) {
+	t.Helper()
+	resp, err := http.Get(debugURL + "/debug/jwtslo")
+	if err != nil {
+		t.Fatalf("%s: %v", svc, err)
+	}
+	defer resp.Body.Close()
+	var slo struct {
+		Total    int64            `json:"total"`
+		Failures map[string]int64 `json:"failures"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&slo); err != nil {
+		t.Fatalf("%s: decoding /debug/jwtslo: %v", svc, err)
+	}
+	if slo.Total == 0 {
+		t.Errorf("%s: handled no JWTs", svc)
+	}
+	for reason, n := range slo.Failures {
+		if n > 0 {
+			t.Errorf("%s: %d JWT failures (%s)", svc, n, reason)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// Red-team cases: tokens an attacker can build without the signing key, and
+// header combinations a confused receiver might resolve in their favour.
+// Every service has to turn each of them away.
+
+const attackerSession = "attacker-impersonated"
+
+// attack builds the metadata of one forged call. legit is a token the
+// frontend really signed for the caller's own session.
+type attack struct {
+	name  string
+	build func(t *testing.T, legit string) metadata.MD
+}
+
+var attacks = []attack{
+	{"alg none full", func(t *testing.T, legit string) metadata.MD {
+		return bearer(algNoneToken())
+	}},
+	{"alg none split", func(t *testing.T, legit string) metadata.MD {
+		return split(algNoneToken())
+	}},
+	{"hs256 keyed with the public key", func(t *testing.T, legit string) metadata.MD {
+		return bearer(hs256Token(t))
+	}},
+	{"signature from another token full", func(t *testing.T, legit string) metadata.MD {
+		return bearer(forgedPayload(legit))
+	}},
+	{"signature from another token split", func(t *testing.T, legit string) metadata.MD {
+		return split(forgedPayload(legit))
+	}},
+	{"header from another token split", func(t *testing.T, legit string) metadata.MD {
+		md := split(legit)
+		md.Set("x-jwt-header", encodeSegment(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "attacker"}))
+		return md
+	}},
+	{"split and authorization disagree", func(t *testing.T, legit string) metadata.MD {
+		md := split(legit)
+		md.Set("authorization", "Bearer "+signToken(t, userClaims(attackerSession)))
+		return md
+	}},
+	{"authorization and forged split disagree", func(t *testing.T, legit string) metadata.MD {
+		md := split(forgedPayload(legit))
+		md.Set("authorization", "Bearer "+legit)
+		return md
+	}},
+	{"oversize payload", func(t *testing.T, legit string) metadata.MD {
+		claims := userClaims("oversize")
+		claims["padding"] = strings.Repeat("A", 64<<10)
+		return split(signToken(t, claims))
+	}},
+}
+
+// knownGaps are attacks a service still accepts because the check that
+// stops them hasn't landed; they're skipped rather than failed, and the
+// entry goes once the service rejects the attack
+var knownGaps = map[string]string{
+	"oversize payload": "no receiver bounds the size of a validly signed token",
+}
+
+func TestForgedTokensRejected(t *testing.T) {
+	s := startStack(t, true)
+	legit := signToken(t, userClaims("legitimate-user"))
+
+	targets := []struct {
+		name string
+		addr string
+		call func(ctx context.Context, cc *grpc.ClientConn) error
+	}{
+		{"shippingservice", s.shippingAddr, func(ctx context.Context, cc *grpc.ClientConn) error {
+			_, err := pb.NewShippingServiceClient(cc).GetQuote(ctx, &pb.GetQuoteRequest{Address: orderAddress})
+			return err
+		}},
+		{"checkoutservice", s.checkoutAddr, func(ctx context.Context, cc *grpc.ClientConn) error {
+			_, err := pb.NewCheckoutServiceClient(cc).PlaceOrder(ctx, &pb.PlaceOrderRequest{
+				UserId:       "legitimate-user",
+				UserCurrency: "USD",
+				Email:        "someone@example.com",
+				Address:      orderAddress,
+				CreditCard: &pb.CreditCardInfo{
+					CreditCardNumber:          "4432801561520454",
+					CreditCardCvv:             672,
+					CreditCardExpirationYear:  int32(time.Now().Year() + 1),
+					CreditCardExpirationMonth: 1,
+				},
+			})
+			return err
+		}},
+	}
+	for _, target := range targets {
+		cc, err := grpc.NewClient(target.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		invoke := func(md metadata.MD) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return target.call(metadata.NewOutgoingContext(ctx, md), cc)
+		}
+
+		// A genuine token has to get through, or every rejection below
+		// would prove nothing
+		if err := invoke(split(legit)); err != nil {
+			t.Fatalf("%s: genuine token rejected: %v", target.name, err)
+		}
+		for _, a := range attacks {
+			t.Run(target.name+"/"+a.name, func(t *testing.T) {
+				err := invoke(a.build(t, legit))
+				if err != nil {
+					t.Logf("rejected: %s", status.Convert(err).Message())
+					return
+				}
+				if gap, ok := knownGaps[a.name]; ok {
+					t.Skipf("accepted, known gap: %s", gap)
+				}
+				t.Error("forged call accepted")
+			})
+		}
+	}
+}
+
+// TestForgedCookieNotForwarded checks the frontend replaces a forged shop_jwt
+// cookie instead of passing it downstream
+func TestForgedCookieNotForwarded(t *testing.T) {
+	s := startStack(t, true)
+	legit := signToken(t, userClaims("legitimate-user"))
+	u, _ := url.Parse(s.frontendURL)
+
+	for name, forged := range map[string]string{
+		"alg none":                        algNoneToken(),
+		"hs256 keyed with the public key": hs256Token(t),
+		"signature from another token":    forgedPayload(legit),
+	} {
+		t.Run(name, func(t *testing.T) {
+			jar, _ := cookiejar.New(nil)
+			jar.SetCookies(u, []*http.Cookie{{Name: "shop_jwt", Value: forged}})
+			client := &http.Client{Jar: jar, Timeout: 30 * time.Second}
+			resp, err := client.Get(s.frontendURL + "/cart")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			for _, c := range jar.Cookies(u) {
+				if c.Name == "shop_jwt" && c.Value == forged {
+					t.Error("frontend kept the forged cookie")
+				}
+			}
+		})
+	}
+	for _, c := range s.stubs.Calls() {
+		if _, token := tokenFromMetadata(c.MD); strings.Contains(token, encodeSegment(attackerClaims())) {
+			t.Errorf("%s received the forged token", c.Method)
+		}
+	}
+}
+
+// TestLogoutRevokesReplay checks that a token captured before logout can't
+// be replayed downstream afterwards, split or whole
+func TestLogoutRevokesReplay(t *testing.T) {
+	s := startStack(t, true)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 30 * time.Second}
+	resp, err := client.Get(s.frontendURL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(s.frontendURL)
+	var captured string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "shop_jwt" {
+			captured = c.Value
+		}
+	}
+
+	cc, err := grpc.NewClient(s.shippingAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	replay := func(md metadata.MD) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := pb.NewShippingServiceClient(cc).GetQuote(metadata.NewOutgoingContext(ctx, md), &pb.GetQuoteRequest{Address: orderAddress})
+		return err
+	}
+	if err := replay(split(captured)); err != nil {
+		t.Fatalf("token rejected before logout: %v", err)
+	}
+
+	resp, err = client.PostForm(s.frontendURL+"/logout", url.Values{"csrf_token": {csrfToken(t, captured)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Downstreams are told asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for replay(split(captured)) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("split token still accepted after logout")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := replay(bearer(captured)); err == nil {
+		t.Error("full token still accepted after logout")
+	}
+}
+
+func bearer(token string) metadata.MD {
+	return metadata.Pairs("authorization", "Bearer "+token)
+}
+
+func split(token string) metadata.MD {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	return metadata.Pairs("x-jwt-header", parts[0], "x-jwt-payload", string(payload), "x-jwt-sig", parts[2])
+}
+
+// attackerClaims are fixed so forged tokens can be recognised downstream
+func attackerClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"session_id": attackerSession,
+		"email":      "attacker@example.com",
+		"iss":        "https://auth.hipstershop.com",
+		"sub":        "urn:hipstershop:user:" + attackerSession,
+		"aud":        []string{"urn:hipstershop:api"},
+		"exp":        int64(4102444800),
+	}
+}
+
+func algNoneToken() string {
+	return encodeSegment(map[string]string{"alg": "none", "typ": "JWT"}) + "." + encodeSegment(attackerClaims()) + "."
+}
+
+// hs256Token is the algorithm confusion attack: an HMAC keyed with the
+// verifier's public key, which is no secret
+func hs256Token(t *testing.T) string {
+	t.Helper()
+	pub, err := os.ReadFile(filepath.Join(srcDir, "frontend", "jwt_public_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := encodeSegment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeSegment(attackerClaims())
+	mac := hmac.New(sha256.New, pub)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// forgedPayload keeps legit's header and signature around the attacker's
+// claims
+func forgedPayload(legit string) string {
+	parts := strings.Split(legit, ".")
+	return parts[0] + "." + encodeSegment(attackerClaims()) + "." + parts[2]
+}
+
+var orderAddress = &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043}
@@ -0,0 +1,132 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// recordedCall is one RPC a stub received
+type recordedCall struct {
+	Method string
+	MD     metadata.MD
+}
+
+// stubServices stands in for the services that aren't written in Go or
+// aren't under test (cart, catalog, currency, payment, email, ads,
+// recommendations) and records the metadata of every call
+type stubServices struct {
+	pb.UnimplementedCartServiceServer
+	pb.UnimplementedProductCatalogServiceServer
+	pb.UnimplementedCurrencyServiceServer
+	pb.UnimplementedPaymentServiceServer
+	pb.UnimplementedEmailServiceServer
+	pb.UnimplementedRecommendationServiceServer
+	pb.UnimplementedAdServiceServer
+
+	mu    sync.Mutex
+	calls []recordedCall
+}
+
+// startStubs serves the stubs on a free port and returns its address
+func startStubs(t *testing.T, opts ...grpc.ServerOption) (*stubServices, string) {
+	t.Helper()
+	s := &stubServices{}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(append(opts, grpc.UnaryInterceptor(s.record))...)
+	pb.RegisterCartServiceServer(srv, s)
+	pb.RegisterProductCatalogServiceServer(srv, s)
+	pb.RegisterCurrencyServiceServer(srv, s)
+	pb.RegisterPaymentServiceServer(srv, s)
+	pb.RegisterEmailServiceServer(srv, s)
+	pb.RegisterRecommendationServiceServer(srv, s)
+	pb.RegisterAdServiceServer(srv, s)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return s, lis.Addr().String()
+}
+
+func (s *stubServices) record(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	s.calls = append(s.calls, recordedCall{Method: info.FullMethod, MD: md.Copy()})
+	s.mu.Unlock()
+	return handler(ctx, req)
+}
+
+// Calls returns the calls recorded so far
+func (s *stubServices) Calls() []recordedCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedCall(nil), s.calls...)
+}
+
+var stubProduct = &pb.Product{
+	Id:          "OLJCESPC7Z",
+	Name:        "Sunglasses",
+	Description: "Add a modern touch to your outfits.",
+	Picture:     "/static/img/products/sunglasses.jpg",
+	PriceUsd:    &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000},
+	Categories:  []string{"accessories"},
+}
+
+func (s *stubServices) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	return &pb.Cart{UserId: req.UserId, Items: []*pb.CartItem{{ProductId: stubProduct.Id, Quantity: 1}}}, nil
+}
+
+func (s *stubServices) AddItem(context.Context, *pb.AddItemRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (s *stubServices) EmptyCart(context.Context, *pb.EmptyCartRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (s *stubServices) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+	return &pb.ListProductsResponse{Products: []*pb.Product{stubProduct}}, nil
+}
+
+func (s *stubServices) GetProduct(context.Context, *pb.GetProductRequest) (*pb.Product, error) {
+	return stubProduct, nil
+}
+
+func (s *stubServices) SearchProducts(context.Context, *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	return &pb.SearchProductsResponse{Results: []*pb.Product{stubProduct}}, nil
+}
+
+func (s *stubServices) GetSupportedCurrencies(context.Context, *pb.Empty) (*pb.GetSupportedCurrenciesResponse, error) {
+	return &pb.GetSupportedCurrenciesResponse{CurrencyCodes: []string{"USD", "EUR"}}, nil
+}
+
+// Convert keeps the amount and relabels it, rates don't matter here
+func (s *stubServices) Convert(_ context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	return &pb.Money{CurrencyCode: req.ToCode, Units: req.From.GetUnits(), Nanos: req.From.GetNanos()}, nil
+}
+
+func (s *stubServices) Charge(context.Context, *pb.ChargeRequest) (*pb.ChargeResponse, error) {
+	return &pb.ChargeResponse{TransactionId: "integration-transaction"}, nil
+}
+
+func (s *stubServices) SendOrderConfirmation(context.Context, *pb.SendOrderConfirmationRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (s *stubServices) ListRecommendations(context.Context, *pb.ListRecommendationsRequest) (*pb.ListRecommendationsResponse, error) {
+	return &pb.ListRecommendationsResponse{}, nil
+}
+
+func (s *stubServices) GetAds(context.Context, *pb.AdRequest) (*pb.AdResponse, error) {
+	// The frontend picks one ad at random, so there has to be at least one
+	return &pb.AdResponse{Ads: []*pb.Ad{{RedirectUrl: "/product/" + stubProduct.Id, Text: "Sunglasses for sale"}}}, nil
+}
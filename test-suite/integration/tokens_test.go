@@ -0,0 +1,74 @@
+//go:build integration || contract
+
+package integration
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// userClaims are claims shaped like the frontend's for session
+func userClaims(session string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"session_id": session,
+		"name":       "Jane Doe",
+		"email":      "someone@example.com",
+		"market_id":  "US",
+		"currency":   "USD",
+		"cart_id":    "cart-" + session,
+		"iss":        "https://auth.hipstershop.com",
+		"sub":        "urn:hipstershop:user:" + session,
+		"aud":        []string{"urn:hipstershop:api"},
+		"exp":        now.Add(5 * time.Minute).Unix(),
+		"iat":        now.Unix(),
+		"jti":        fmt.Sprintf("%s-%d", session, now.UnixNano()),
+	}
+}
+
+// signToken signs claims with the demo key the services are configured to
+// trust
+func signToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("..", "..", "src", "frontend", "jwt_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatal("jwt_private_key.pem holds no PEM block")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("jwt_private_key.pem holds a %T, not an RSA key", parsed)
+	}
+
+	signed := encodeSegment(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encodeSegment(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// encodeSegment is the base64url JSON encoding of a JWS header or payload
+func encodeSegment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}